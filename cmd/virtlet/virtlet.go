@@ -18,16 +18,23 @@ package main
 
 import (
 	"flag"
+	"io"
 	"math/rand"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
 
+	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/api/resource"
 
 	"github.com/Mirantis/virtlet/pkg/cni"
+	"github.com/Mirantis/virtlet/pkg/control"
+	"github.com/Mirantis/virtlet/pkg/image"
 	"github.com/Mirantis/virtlet/pkg/libvirttools"
 	"github.com/Mirantis/virtlet/pkg/manager"
+	"github.com/Mirantis/virtlet/pkg/stream"
 	"github.com/Mirantis/virtlet/pkg/tapmanager"
 	"github.com/Mirantis/virtlet/pkg/utils"
 	"github.com/Mirantis/virtlet/pkg/version"
@@ -36,24 +43,132 @@ import (
 var (
 	libvirtURI = flag.String("libvirt-uri", "qemu:///system",
 		"Libvirt connection URI")
+	libvirtConnPoolSize = flag.Int("libvirt-connection-pool-size", 1,
+		"Number of libvirt connections to keep open and share among the operations")
+	libvirtConnIdleTimeout = flag.Duration("libvirt-connection-idle-timeout", 0,
+		"Time after which an unused libvirt connection is closed until it's needed again (0 means the connections are kept open)")
+	libvirtConnHealthCheckInterval = flag.Duration("libvirt-connection-health-check-interval", 30*time.Second,
+		"How often a libvirt connection is checked to be alive before it's used")
 	imageDir = flag.String("image dir", "/var/lib/virtlet/images",
 		"Image directory")
 	boltPath = flag.String("bolt-path", "/var/lib/virtlet/virtlet.db",
 		"Path to the bolt database file")
 	listen = flag.String("listen", "/run/virtlet.sock",
 		"The unix socket to listen on, e.g. /run/virtlet.sock")
+	controlSocketPath = flag.String("control-socket", control.DefaultSocketPath,
+		"The unix socket to serve the control requests made by virtletctl on")
+	controlRequest = flag.String("control-request", "",
+		"Make a request to the control socket of the running Virtlet process, e.g. 'PUT /containers/<id>/cloud-init', print the response and exit")
+	controlData = flag.String("control-data", "",
+		"The body of the request made using -control-request")
 	cniPluginsDir = flag.String("cni-bin-dir", "/opt/cni/bin",
 		"Path to CNI plugin binaries")
 	cniConfigsDir = flag.String("cni-conf-dir", "/etc/cni/net.d",
 		"Location of CNI configurations (first file name in lexicographic order will be chosen)")
 	imageDownloadProtocol = flag.String("image-download-protocol", "https",
 		"Image download protocol. Can be https (default) or http.")
-	rawDevices = flag.String("raw-devices", "loop*",
+	rawDevices = flag.String("raw-devices", libvirttools.DefaultRawDevices,
 		"Comma separated list of raw device glob patterns to which VM can have an access (with skipped /dev/ prefix)")
+	gpuDevices = flag.String("gpu-devices", "",
+		"Comma separated list of PCI addresses of the host GPUs which can be passed through to the VMs using VirtletGPUDevices annotation")
+	interfaceSources = flag.String("interface-sources", "",
+		"Comma separated list of the host bridges, host interfaces and libvirt networks (bridge:<name>, direct:<name> or network:<name>) which the VMs can be connected to using VirtletInterfaceSource annotation")
 	fdServerSocketPath = flag.String("fd-server-socket-path", "/var/lib/virtlet/tapfdserver.sock",
 		"Path to fd server socket")
+	imageDecompression = flag.String("image-decompression", "",
+		"Comma separated list of compression formats of the images to decompress during the pull (gzip, xz, zstd). Empty string means all the supported formats, 'none' disables the decompression")
 	imageTranslationConfigsDir = flag.String("image-translations-dir", "",
 		"Image name translation configs directory")
+	qemuImgNice = flag.Int("qemu-img-nice", 0,
+		"Niceness (0-19) to run qemu-img commands with, so they don't compete with the VMs for CPU (0 means the priority is not changed)")
+	qemuImgIOClass = flag.String("qemu-img-ionice-class", "",
+		"I/O scheduling class to run qemu-img commands with: 'best-effort' or 'idle' (empty string means the I/O priority is not changed)")
+	qemuImgIOLevel = flag.Int("qemu-img-ionice-level", 4,
+		"I/O priority (0-7, 7 being the lowest) within best-effort scheduling class for qemu-img commands")
+	imageTenantIsolation = flag.Bool("image-tenant-isolation", false,
+		"Keep a separate image cache for each namespace, so the pods only use the images pulled for their namespace")
+	storagePoolType = flag.String("storage-pool-type", "dir",
+		"Type of libvirt storage pool to use for the volumes (dir, logical or rbd)")
+	storagePoolSource = flag.String("storage-pool-source", "",
+		"Volume group name for logical storage pool or ceph pool name for rbd storage pool")
+	storagePoolDevices = flag.String("storage-pool-devices", "",
+		"Comma separated list of physical volumes of the existing volume group for logical storage pool")
+	storagePoolHosts = flag.String("storage-pool-hosts", "",
+		"Comma separated list of ceph monitors (host or host:port) for rbd storage pool")
+	storagePoolPath = flag.String("storage-pool-path", "",
+		"Directory for the volumes of dir storage pool (defaults to /var/lib/virtlet/volumes)")
+	reclaimStorage = flag.Bool("reclaim-storage", false,
+		"Remove the orphaned volumes from the storage pool before failing volume creation because the pool is out of space")
+	disableDomainEvents = flag.Bool("disable-domain-events", false,
+		"Don't watch libvirt domain events, so the VMs powered off by the guest OS are detected by ContainerStatus calls only")
+	warmPoolSize = flag.Int("warm-pool-size", 0,
+		"Number of pre-booted VMs to keep for the pods without network (0 disables the warm pool)")
+	warmPoolImage = flag.String("warm-pool-image", "",
+		"Base image for the pre-booted VMs in the warm pool")
+	maxVolumeCount = flag.Int("max-volumes-per-vm", 0,
+		"Maximum number of volumes per VM including the root and the config volumes (0 means only disk driver limits are applied)")
+	nodeDefaultAnnotations = flag.String("node-default-annotations", "",
+		"Virtlet annotations to apply to all the VMs that don't set them, as a YAML or JSON map, e.g. '{\"VirtletGuestAgent\": \"true\"}'")
+	missingMountPolicy = flag.String("missing-mount-policy", "fail",
+		"What to do when the host path of a container mount doesn't exist (e.g. a volume isn't staged yet): 'fail' (CreateContainer fails with a retryable error) or 'skip' (the mount is skipped)")
+	guestAgentTimeout = flag.Duration("guest-agent-timeout", 5*time.Second,
+		"Time limit for a single guest agent call")
+	guestAgentRetries = flag.Int("guest-agent-retries", 2,
+		"Number of additional attempts to make if a guest agent call fails or times out")
+	startupTimeout = flag.Duration("startup-timeout", 10*time.Second,
+		"Time limit for a VM to reach the running state upon StartContainer, after which the VM is destroyed")
+	waitForGuestAgent = flag.Bool("wait-for-guest-agent", false,
+		"Make StartContainer also wait for the guest agent to become ready within the startup timeout for the VMs that have it enabled")
+	bootReadinessSignal = flag.String("boot-readiness-signal", "none",
+		"Way to find out that the guest OS is ready in order to measure VM boot time: 'none', 'guest-agent', 'phone-home' or 'console'")
+	bootPhoneHomeURL = flag.String("boot-phone-home-url", "",
+		"Base URL of the phone-home endpoint served on the metrics address as seen from the VMs, e.g. 'http://10.0.0.1:9101/phone-home' (used with 'phone-home' boot readiness signal)")
+	bootConsolePattern = flag.String("boot-console-pattern", "",
+		"Regular expression to look for on the VM serial console (used with 'console' boot readiness signal)")
+	bootTimeout = flag.Duration("boot-timeout", 10*time.Minute,
+		"Time limit for the guest OS to become ready after which the boot time measurement is abandoned")
+	deviceProfile = flag.String("device-profile", "default",
+		"Set of optional devices to add to the VMs: 'default' or 'minimal' (no USB, graphics and memory balloon unless requested via VirtletOptionalDevices annotation)")
+	memoryBackingDir = flag.String("memory-backing-dir", "",
+		"Directory for file-backed VM memory, must match memory_backing_dir in libvirt's qemu.conf (empty string disables file-backed memory)")
+	savedStateDir = flag.String("saved-state-dir", libvirttools.DefaultSavedStateDir,
+		"Directory for the saved VM states")
+	networkDetachOrder = flag.String("network-detach-order", "destroy-first",
+		"Order in which StopPodSandbox destroys the VMs that are still running and tears down the pod network: 'destroy-first' or 'detach-first'")
+	minStopTimeout = flag.Duration("min-graceful-stop-timeout", 0,
+		"Shortest container stop timeout (grace period) for which graceful VM shutdown is attempted. The VMs are destroyed right away if the timeout is shorter or zero")
+	containerTombstoneTTL = flag.Duration("container-tombstone-ttl", 0,
+		"Time to keep reporting the removed containers as exited ones, so their status can still be queried (zero disables it)")
+	maxConcurrentBoots = flag.Int("max-concurrent-boots", 0,
+		"Maximum number of VMs that can be started at the same time. StartContainer calls over the limit wait for their turn (0 means no limit)")
+	qosScheduling = flag.String("qos-scheduling", "",
+		"CPU scheduling settings of the QEMU processes for the pod QoS classes, as a YAML or JSON map, e.g. '{\"Guaranteed\": {\"nice\": -5, \"cpuWeight\": 500}, \"BestEffort\": {\"nice\": 10, \"cpuWeight\": 10}}'")
+	skipNoopConfigISO = flag.Bool("skip-noop-config-iso", false,
+		"Don't attach cloud-init config ISO to the VMs that have no SSH keys, user-data, meta-data, environment variables, mounts or extra network interfaces (can be overridden using VirtletForceConfigISO annotation)")
+	configISOInPool = flag.Bool("config-iso-in-pool", false,
+		"Store cloud-init config ISOs as volumes in the storage pool instead of the files in the config ISO directory (only supported for dir storage pools)")
+	enableMonitorCommands = flag.Bool("enable-monitor-commands", false,
+		"Accept the requests to execute read-only QEMU monitor commands for the VMs on the control socket (used by 'virtletctl monitor')")
+	maxConsoles = flag.Int("max-consoles", 0,
+		"Maximum number of VM serial consoles to read and log at the same time. When it's reached, the least active console stops being read (0 means no limit)")
+	consoleReconnectMaxBackoff = flag.Duration("console-reconnect-max-backoff", 30*time.Second,
+		"Maximum interval between the checks whether the VM is still running while waiting for it to reconnect its serial console after the console socket drops, so the console log resumes in the same file (0 means the console log is closed as soon as the console disconnects)")
+	consoleLogMaxSize = flag.String("console-log-max-size", "0",
+		"Size of a VM console log after which it's rotated, e.g. '10Mi' (0 disables the rotation, can be overridden using VirtletConsoleLogMaxSize annotation)")
+	consoleLogMaxFiles = flag.Int("console-log-max-files", 1,
+		"Number of rotated VM console log files to keep besides the current one (0 means the log is truncated instead, can be overridden using VirtletConsoleLogMaxFiles annotation)")
+	postCreateHook = flag.String("post-create-hook", "",
+		"Command to run after a VM is created, with container id, VM IP and MAC address as the arguments (empty string means no command)")
+	postRemoveHook = flag.String("post-remove-hook", "",
+		"Command to run after a VM is removed, with container id, VM IP and MAC address as the arguments (empty string means no command)")
+	failOnHookError = flag.Bool("fail-on-post-create-hook-error", false,
+		"Fail the container creation if the post-create hook fails instead of just logging the error")
+	hookTimeout = flag.Duration("hook-timeout", 30*time.Second,
+		"Time limit for a post-create or post-remove hook command")
+	metricsAddress = flag.String("metrics-address", "",
+		"Address to serve Prometheus metrics on, e.g. ':9101' (empty string disables the metrics)")
+	diskStatsInterval = flag.Duration("disk-stats-interval", 0,
+		"Interval between the collections of per-disk I/O stats of the VMs exposed via Prometheus metrics (0 disables the collection)")
 	displayVersion = flag.Bool("version", false, "Display version and exit")
 	versionFormat  = flag.String("version-format", "text", "Version format to use (text, short, json, yaml)")
 )
@@ -68,16 +183,101 @@ func runVirtlet() {
 		glog.Infoln("KUBERNETES_POD_LOGS environment variables must be set")
 		os.Exit(1)
 	}
+	var defaultAnnotations map[string]string
+	if err := yaml.Unmarshal([]byte(*nodeDefaultAnnotations), &defaultAnnotations); err != nil {
+		glog.Errorf("Bad node default annotations: %v", err)
+		os.Exit(1)
+	}
+	var qosSchedulingConfig libvirttools.QOSSchedulingConfig
+	if err := yaml.Unmarshal([]byte(*qosScheduling), &qosSchedulingConfig); err != nil {
+		glog.Errorf("Bad QoS scheduling config: %v", err)
+		os.Exit(1)
+	}
+	maxLogSize, err := resource.ParseQuantity(*consoleLogMaxSize)
+	if err != nil || maxLogSize.Sign() < 0 {
+		glog.Errorf("Bad console log max size %q", *consoleLogMaxSize)
+		os.Exit(1)
+	}
 	manager := manager.NewVirtletManager(&manager.VirtletConfig{
 		FDServerSocketPath:         *fdServerSocketPath,
 		DatabasePath:               *boltPath,
 		DownloadProtocol:           *imageDownloadProtocol,
 		ImageDir:                   *imageDir,
+		ImageDecompression:         *imageDecompression,
 		ImageTranslationConfigsDir: *imageTranslationConfigsDir,
+		ImageTenantIsolation:       *imageTenantIsolation,
 		LibvirtURI:                 *libvirtURI,
 		PodLogDir:                  kubernetesDir,
 		RawDevices:                 *rawDevices,
+		GPUDevices:                 *gpuDevices,
+		InterfaceSources:           *interfaceSources,
 		CRISocketPath:              *listen,
+		ControlSocketPath:          *controlSocketPath,
+		ConsoleReconnectMaxBackoff: *consoleReconnectMaxBackoff,
+		ConsoleLogRotation: stream.LogRotationConfig{
+			MaxSize:  maxLogSize.Value(),
+			MaxFiles: *consoleLogMaxFiles,
+		},
+		LibvirtConnectionPool: libvirttools.ConnectionPoolConfig{
+			Size:                *libvirtConnPoolSize,
+			IdleTimeout:         *libvirtConnIdleTimeout,
+			HealthCheckInterval: *libvirtConnHealthCheckInterval,
+		},
+		StoragePool: libvirttools.StoragePoolConfig{
+			Type:          *storagePoolType,
+			SourceName:    *storagePoolSource,
+			SourceDevices: splitList(*storagePoolDevices),
+			SourceHosts:   splitList(*storagePoolHosts),
+			TargetPath:    *storagePoolPath,
+		},
+		ReclaimStorage:      *reclaimStorage,
+		DisableDomainEvents: *disableDomainEvents,
+		MaxConsoles:         *maxConsoles,
+		QemuImgPriority: image.CommandPriority{
+			Nice:    *qemuImgNice,
+			IOClass: *qemuImgIOClass,
+			IOLevel: *qemuImgIOLevel,
+		},
+		WarmPool: libvirttools.WarmPoolConfig{
+			Size:  *warmPoolSize,
+			Image: *warmPoolImage,
+		},
+		MaxVolumeCount: *maxVolumeCount,
+		GuestAgent: libvirttools.GuestAgentConfig{
+			Timeout: *guestAgentTimeout,
+			Retries: *guestAgentRetries,
+		},
+		Startup: libvirttools.StartupConfig{
+			Timeout:           *startupTimeout,
+			WaitForGuestAgent: *waitForGuestAgent,
+		},
+		MissingMountPolicy:     libvirttools.MissingMountPolicy(*missingMountPolicy),
+		NodeDefaultAnnotations: defaultAnnotations,
+		BootTime: libvirttools.BootTimeConfig{
+			Signal:         libvirttools.BootReadinessSignal(*bootReadinessSignal),
+			PhoneHomeURL:   *bootPhoneHomeURL,
+			ConsolePattern: *bootConsolePattern,
+			Timeout:        *bootTimeout,
+		},
+		DeviceProfile:          libvirttools.DeviceProfile(*deviceProfile),
+		MemoryBackingDir:       *memoryBackingDir,
+		SavedStateDir:          *savedStateDir,
+		SkipNoopConfigISO:      *skipNoopConfigISO,
+		ConfigISOInPool:        *configISOInPool,
+		EnableMonitorCommands:  *enableMonitorCommands,
+		MinGracefulStopTimeout: *minStopTimeout,
+		ContainerTombstoneTTL:  *containerTombstoneTTL,
+		MaxConcurrentBoots:     *maxConcurrentBoots,
+		QOSScheduling:          qosSchedulingConfig,
+		NetworkDetachOrder:     manager.NetworkDetachOrder(*networkDetachOrder),
+		Hooks: libvirttools.HookConfig{
+			PostCreateCommand: *postCreateHook,
+			PostRemoveCommand: *postRemoveHook,
+			FailCreateOnError: *failOnHookError,
+			Timeout:           *hookTimeout,
+		},
+		MetricsAddress:    *metricsAddress,
+		DiskStatsInterval: *diskStatsInterval,
 	})
 	if err := manager.Run(); err != nil {
 		glog.Errorf("Error: %v", err)
@@ -85,6 +285,13 @@ func runVirtlet() {
 	}
 }
 
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
 func runTapManager() {
 	cniClient, err := cni.NewClient(*cniPluginsDir, *cniConfigsDir)
 	if err != nil {
@@ -136,6 +343,22 @@ func printVersion() {
 	}
 }
 
+func doControlRequest() {
+	parts := strings.SplitN(*controlRequest, " ", 2)
+	if len(parts) != 2 {
+		glog.Errorf("Bad control request %q, expected 'METHOD PATH'", *controlRequest)
+		os.Exit(1)
+	}
+	var body io.Reader
+	if *controlData != "" {
+		body = strings.NewReader(*controlData)
+	}
+	if err := control.Request(*controlSocketPath, parts[0], parts[1], body, os.Stdout); err != nil {
+		glog.Errorf("Error: %v", err)
+		os.Exit(1)
+	}
+}
+
 func main() {
 	utils.HandleNsFixReexec()
 	flag.Parse()
@@ -143,6 +366,10 @@ func main() {
 		printVersion()
 		os.Exit(0)
 	}
+	if *controlRequest != "" {
+		doControlRequest()
+		os.Exit(0)
+	}
 
 	rand.Seed(time.Now().UnixNano())
 	if os.Getenv(WantTapManagerEnv) == "" {
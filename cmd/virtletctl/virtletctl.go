@@ -47,6 +47,12 @@ func newRootCmd() *cobra.Command {
 	cmd.AddCommand(tools.NewVirshCmd(client, os.Stdout))
 	cmd.AddCommand(tools.NewSSHCmd(client, os.Stdout, ""))
 	cmd.AddCommand(tools.NewVNCCmd(client, os.Stdout, true))
+	cmd.AddCommand(tools.NewUpdateCloudInitCmd(client, os.Stdout))
+	cmd.AddCommand(tools.NewBlockJobCmd(client, os.Stdout))
+	cmd.AddCommand(tools.NewSnapshotCmd(client, os.Stdout))
+	cmd.AddCommand(tools.NewStateCmd(client, os.Stdout))
+	cmd.AddCommand(tools.NewReconcileCmd(client, os.Stdout))
+	cmd.AddCommand(tools.NewMonitorCmd(client, os.Stdout))
 	cmd.AddCommand(tools.NewInstallCmd(cmd, "", ""))
 	cmd.AddCommand(tools.NewGenDocCmd(cmd))
 	cmd.AddCommand(tools.NewGenCmd(os.Stdout))
@@ -35,6 +35,7 @@ const (
 	defaultEmulator = "/usr/bin/qemu-system-x86_64" // FIXME
 	emulatorVar     = "VIRTLET_EMULATOR"
 	netKeyEnvVar    = "VIRTLET_NET_KEY"
+	nicOffloadsVar  = "VIRTLET_NIC_OFFLOADS"
 	vmsProcFile     = "/var/lib/virtlet/vms.procfile"
 )
 
@@ -79,7 +80,6 @@ func main() {
 		emulator = defaultEmulator
 	} else {
 		netFdKey := os.Getenv(netKeyEnvVar)
-		nextToUseHostdevNo := 0
 
 		if netFdKey != "" {
 			c := tapmanager.NewFDClient(fdSocketPath)
@@ -99,6 +99,12 @@ func main() {
 				os.Exit(1)
 			}
 
+			offloads, err := network.ParseNICOffloads(os.Getenv(nicOffloadsVar))
+			if err != nil {
+				glog.Errorf("Bad NIC offload settings: %v", err)
+				os.Exit(1)
+			}
+
 			for i, desc := range descriptions {
 				switch desc.Type {
 				case network.InterfaceTypeTap:
@@ -106,17 +112,11 @@ func main() {
 						"-netdev",
 						fmt.Sprintf("tap,id=tap%d,fd=%d", desc.FdIndex, fds[desc.FdIndex]),
 						"-device",
-						fmt.Sprintf("virtio-net-pci,netdev=tap%d,id=net%d,mac=%s", desc.FdIndex, i, desc.HardwareAddr),
+						fmt.Sprintf("virtio-net-pci,netdev=tap%d,id=net%d,mac=%s%s", desc.FdIndex, i, desc.HardwareAddr, network.NICOffloadDeviceProperties(offloads, i)),
 					)
 				case network.InterfaceTypeVF:
-					netArgs = append(netArgs,
-						"-device",
-						fmt.Sprintf("vfio-pci,host=%s,id=hostdev%d",
-							desc.PCIAddress[5:],
-							nextToUseHostdevNo,
-						),
-					)
-					nextToUseHostdevNo += 1
+					// SR-IOV VFs are attached to the domain by
+					// libvirt as hostdev interfaces
 				default:
 					// Impossible situation when tapmanager is built from other sources than vmwrapper
 					glog.Errorf("Received unknown interface type: %d", int(desc.Type))
@@ -30,6 +30,11 @@ else
   sed -i "/# @DEVS@/d" /etc/libvirt/qemu.conf
 fi
 
+if [[ ${VIRTLET_MEMORY_BACKING_DIR:-} ]]; then
+  mkdir -p "${VIRTLET_MEMORY_BACKING_DIR}"
+  echo "memory_backing_dir = \"${VIRTLET_MEMORY_BACKING_DIR}\"" >>/etc/libvirt/qemu.conf
+fi
+
 chown root:root /etc/libvirt/libvirtd.conf
 chown root:root /etc/libvirt/qemu.conf
 chmod 644 /etc/libvirt/libvirtd.conf
@@ -15,6 +15,114 @@ opts=(-v=${VIRTLET_LOGLEVEL:-3} -logtostderr=true -image-download-protocol="${PR
 if [[ ${VIRTLET_RAW_DEVICES:-} ]]; then
   opts+=(-raw-devices "${VIRTLET_RAW_DEVICES}")
 fi
+if [[ ${VIRTLET_GPU_DEVICES:-} ]]; then
+  opts+=(-gpu-devices "${VIRTLET_GPU_DEVICES}")
+fi
+if [[ ${VIRTLET_INTERFACE_SOURCES:-} ]]; then
+  opts+=(-interface-sources "${VIRTLET_INTERFACE_SOURCES}")
+fi
+if [[ ${VIRTLET_MEMORY_BACKING_DIR:-} ]]; then
+  opts+=(-memory-backing-dir "${VIRTLET_MEMORY_BACKING_DIR}")
+fi
+if [[ ${VIRTLET_QEMU_IMG_NICE:-} ]]; then
+  opts+=(-qemu-img-nice "${VIRTLET_QEMU_IMG_NICE}")
+fi
+if [[ ${VIRTLET_QEMU_IMG_IONICE_CLASS:-} ]]; then
+  opts+=(-qemu-img-ionice-class "${VIRTLET_QEMU_IMG_IONICE_CLASS}")
+fi
+if [[ ${VIRTLET_QEMU_IMG_IONICE_LEVEL:-} ]]; then
+  opts+=(-qemu-img-ionice-level "${VIRTLET_QEMU_IMG_IONICE_LEVEL}")
+fi
+if [[ ${VIRTLET_IMAGE_TENANT_ISOLATION:-} ]]; then
+  opts+=(-image-tenant-isolation)
+fi
+if [[ ${VIRTLET_RECLAIM_STORAGE:-} ]]; then
+  opts+=(-reclaim-storage)
+fi
+if [[ ${VIRTLET_DISABLE_DOMAIN_EVENTS:-} ]]; then
+  opts+=(-disable-domain-events)
+fi
+if [[ ${VIRTLET_SKIP_NOOP_CONFIG_ISO:-} ]]; then
+  opts+=(-skip-noop-config-iso)
+fi
+if [[ ${VIRTLET_CONFIG_ISO_IN_POOL:-} ]]; then
+  opts+=(-config-iso-in-pool)
+fi
+if [[ ${VIRTLET_ENABLE_MONITOR_COMMANDS:-} ]]; then
+  opts+=(-enable-monitor-commands)
+fi
+if [[ ${VIRTLET_LIBVIRT_CONNECTION_POOL_SIZE:-} ]]; then
+  opts+=(-libvirt-connection-pool-size "${VIRTLET_LIBVIRT_CONNECTION_POOL_SIZE}")
+fi
+if [[ ${VIRTLET_LIBVIRT_CONNECTION_IDLE_TIMEOUT:-} ]]; then
+  opts+=(-libvirt-connection-idle-timeout "${VIRTLET_LIBVIRT_CONNECTION_IDLE_TIMEOUT}")
+fi
+if [[ ${VIRTLET_LIBVIRT_CONNECTION_HEALTH_CHECK_INTERVAL:-} ]]; then
+  opts+=(-libvirt-connection-health-check-interval "${VIRTLET_LIBVIRT_CONNECTION_HEALTH_CHECK_INTERVAL}")
+fi
+if [[ ${VIRTLET_MAX_CONSOLES:-} ]]; then
+  opts+=(-max-consoles "${VIRTLET_MAX_CONSOLES}")
+fi
+if [[ ${VIRTLET_CONSOLE_RECONNECT_MAX_BACKOFF:-} ]]; then
+  opts+=(-console-reconnect-max-backoff "${VIRTLET_CONSOLE_RECONNECT_MAX_BACKOFF}")
+fi
+if [[ ${VIRTLET_CONSOLE_LOG_MAX_SIZE:-} ]]; then
+  opts+=(-console-log-max-size "${VIRTLET_CONSOLE_LOG_MAX_SIZE}")
+fi
+if [[ ${VIRTLET_CONSOLE_LOG_MAX_FILES:-} ]]; then
+  opts+=(-console-log-max-files "${VIRTLET_CONSOLE_LOG_MAX_FILES}")
+fi
+if [[ ${VIRTLET_NODE_DEFAULT_ANNOTATIONS:-} ]]; then
+  opts+=(-node-default-annotations "${VIRTLET_NODE_DEFAULT_ANNOTATIONS}")
+fi
+if [[ ${VIRTLET_MISSING_MOUNT_POLICY:-} ]]; then
+  opts+=(-missing-mount-policy "${VIRTLET_MISSING_MOUNT_POLICY}")
+fi
+if [[ ${VIRTLET_NETWORK_DETACH_ORDER:-} ]]; then
+  opts+=(-network-detach-order "${VIRTLET_NETWORK_DETACH_ORDER}")
+fi
+if [[ ${VIRTLET_STARTUP_TIMEOUT:-} ]]; then
+  opts+=(-startup-timeout "${VIRTLET_STARTUP_TIMEOUT}")
+fi
+if [[ ${VIRTLET_WAIT_FOR_GUEST_AGENT:-} ]]; then
+  opts+=(-wait-for-guest-agent)
+fi
+if [[ ${VIRTLET_BOOT_READINESS_SIGNAL:-} ]]; then
+  opts+=(-boot-readiness-signal "${VIRTLET_BOOT_READINESS_SIGNAL}")
+fi
+if [[ ${VIRTLET_BOOT_PHONE_HOME_URL:-} ]]; then
+  opts+=(-boot-phone-home-url "${VIRTLET_BOOT_PHONE_HOME_URL}")
+fi
+if [[ ${VIRTLET_BOOT_CONSOLE_PATTERN:-} ]]; then
+  opts+=(-boot-console-pattern "${VIRTLET_BOOT_CONSOLE_PATTERN}")
+fi
+if [[ ${VIRTLET_BOOT_TIMEOUT:-} ]]; then
+  opts+=(-boot-timeout "${VIRTLET_BOOT_TIMEOUT}")
+fi
+if [[ ${VIRTLET_MIN_GRACEFUL_STOP_TIMEOUT:-} ]]; then
+  opts+=(-min-graceful-stop-timeout "${VIRTLET_MIN_GRACEFUL_STOP_TIMEOUT}")
+fi
+if [[ ${VIRTLET_CONTAINER_TOMBSTONE_TTL:-} ]]; then
+  opts+=(-container-tombstone-ttl "${VIRTLET_CONTAINER_TOMBSTONE_TTL}")
+fi
+if [[ ${VIRTLET_MAX_CONCURRENT_BOOTS:-} ]]; then
+  opts+=(-max-concurrent-boots "${VIRTLET_MAX_CONCURRENT_BOOTS}")
+fi
+if [[ ${VIRTLET_QOS_SCHEDULING:-} ]]; then
+  opts+=(-qos-scheduling "${VIRTLET_QOS_SCHEDULING}")
+fi
+if [[ ${VIRTLET_POST_CREATE_HOOK:-} ]]; then
+  opts+=(-post-create-hook "${VIRTLET_POST_CREATE_HOOK}")
+fi
+if [[ ${VIRTLET_POST_REMOVE_HOOK:-} ]]; then
+  opts+=(-post-remove-hook "${VIRTLET_POST_REMOVE_HOOK}")
+fi
+if [[ ${VIRTLET_FAIL_ON_HOOK_ERROR:-} ]]; then
+  opts+=(-fail-on-post-create-hook-error)
+fi
+if [[ ${VIRTLET_HOOK_TIMEOUT:-} ]]; then
+  opts+=(-hook-timeout "${VIRTLET_HOOK_TIMEOUT}")
+fi
 
 while [ ! -S /var/run/libvirt/libvirt-sock ] ; do
   echo >&1 "Waiting for libvirt..."
@@ -0,0 +1,227 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package control
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// DefaultSocketPath is the default path of the control socket
+	DefaultSocketPath = "/run/virtlet-control.sock"
+	// ContainersPath is the path prefix for the container requests
+	ContainersPath = "/containers/"
+	// ReconcilePath is the path of the request that makes Virtlet
+	// look for the inconsistencies between its metadata, libvirt
+	// domains, the storage pool and the config ISOs
+	ReconcilePath = "/reconcile"
+)
+
+// CloudInitUpdate is the body of the control request that updates
+// the cloud-init data of a VM
+type CloudInitUpdate struct {
+	// PodAnnotations are the new annotations of the VM pod
+	PodAnnotations map[string]string `json:"podAnnotations"`
+	// Rerun makes the guest re-run cloud-init after the
+	// update using the guest agent
+	Rerun bool `json:"rerun,omitempty"`
+}
+
+// CloudInitPath returns the path of the cloud-init data of the
+// specified container
+func CloudInitPath(containerID string) string {
+	return ContainersPath + containerID + "/cloud-init"
+}
+
+// SnapshotRequest is the body of the control request that creates
+// a snapshot of a VM
+type SnapshotRequest struct {
+	// Name is the name of the snapshot
+	Name string `json:"name"`
+	// Description is an optional description of the snapshot
+	Description string `json:"description,omitempty"`
+}
+
+// SnapshotsPath returns the path of the snapshot list of the
+// specified container
+func SnapshotsPath(containerID string) string {
+	return ContainersPath + containerID + "/snapshots"
+}
+
+// SnapshotPath returns the path of the specified snapshot of the
+// container
+func SnapshotPath(containerID, name string) string {
+	return SnapshotsPath(containerID) + "/" + name
+}
+
+// SnapshotRevertPath returns the path which is used to revert the
+// VM of the container to the specified snapshot
+func SnapshotRevertPath(containerID, name string) string {
+	return SnapshotPath(containerID, name) + "/revert"
+}
+
+// SnapshotChangesPath returns the path of the changes made to the
+// disks of the VM of the container since the specified snapshot
+func SnapshotChangesPath(containerID, name string) string {
+	return SnapshotPath(containerID, name) + "/changes"
+}
+
+// DiskChanges describes the changes made to a VM disk since a
+// snapshot
+type DiskChanges struct {
+	// Device is the name of QEMU block device of the disk
+	Device string `json:"device"`
+	// Granularity is the size of a tracked block in bytes
+	Granularity uint64 `json:"granularity"`
+	// ChangedBlocks is the number of the changed blocks
+	ChangedBlocks uint64 `json:"changedBlocks"`
+	// ChangedBytes is the total size of the changed blocks
+	ChangedBytes uint64 `json:"changedBytes"`
+}
+
+// SaveStatePath returns the path which is used to save the state
+// of the VM of the specified container and stop it
+func SaveStatePath(containerID string) string {
+	return ContainersPath + containerID + "/save"
+}
+
+// RestoreStatePath returns the path which is used to resume the VM
+// of the specified container from its saved state
+func RestoreStatePath(containerID string) string {
+	return ContainersPath + containerID + "/restore"
+}
+
+// SaveStateImagePath returns the path which is used to save the
+// state of the VM of the specified container as a saved state image
+func SaveStateImagePath(containerID string) string {
+	return ContainersPath + containerID + "/save-image"
+}
+
+// SaveStateImageRequest is the body of the control request that
+// saves the state of a VM as a saved state image
+type SaveStateImageRequest struct {
+	// Name is the name of the saved state image
+	Name string `json:"name"`
+}
+
+// SaveStateImageResult is the response body of the request that
+// saves the state of a VM as a saved state image
+type SaveStateImageResult struct {
+	// ImageRef is the reference to the image the root disk of
+	// the VM was exported to, including its digest
+	ImageRef string `json:"imageRef"`
+}
+
+// BlockJob describes a block job running on a disk of a VM
+type BlockJob struct {
+	// Disk is the target device name of the disk, e.g. "vda"
+	Disk string `json:"disk"`
+	// Type is the kind of the block job
+	Type string `json:"type"`
+	// Progress is the percentage of the work that is done
+	Progress int `json:"progress"`
+}
+
+// BlockJobsPath returns the path of the list of the block jobs
+// running on the disks of the VM of the specified container
+func BlockJobsPath(containerID string) string {
+	return ContainersPath + containerID + "/block-jobs"
+}
+
+// BlockJobPath returns the path of the block job running on the
+// specified disk of the VM of the container
+func BlockJobPath(containerID, disk string) string {
+	return BlockJobsPath(containerID) + "/" + disk
+}
+
+// MonitorRequest is the body of the control request that executes
+// a read-only QEMU monitor command for a VM
+type MonitorRequest struct {
+	// Command is the QMP or HMP command to execute
+	Command string `json:"command"`
+}
+
+// MonitorPath returns the path which is used to execute QEMU
+// monitor commands for the VM of the specified container
+func MonitorPath(containerID string) string {
+	return ContainersPath + containerID + "/monitor"
+}
+
+// ReconcileRequest is the body of the control request that makes
+// Virtlet look for the inconsistencies and repair them
+type ReconcileRequest struct {
+	// DryRun makes Virtlet only report the inconsistencies
+	// without repairing them
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// ReconcileDrift describes an inconsistency found by Virtlet
+type ReconcileDrift struct {
+	// Kind is the kind of the inconsistency
+	Kind string `json:"kind"`
+	// ContainerID is the id of the container the inconsistency
+	// relates to, if it's known
+	ContainerID string `json:"containerID,omitempty"`
+	// Name is the name of the domain or the volume or the path
+	// to the config ISO
+	Name string `json:"name,omitempty"`
+	// Repaired is true if the inconsistency was fixed
+	Repaired bool `json:"repaired,omitempty"`
+}
+
+// ReconcileResult is the response body of the reconcile request
+type ReconcileResult struct {
+	// Drifts lists the inconsistencies that were found
+	Drifts []ReconcileDrift `json:"drifts"`
+	// Errors lists the errors that happened while looking for
+	// the inconsistencies or repairing them
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Request makes a request to the control socket of the running
+// Virtlet process and copies the response body to out. The body
+// may be nil.
+func Request(socketPath, method, path string, body io.Reader, out io.Writer) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(string, string) (net.Conn, error) {
+				return net.Dial("unix", socketPath)
+			},
+		},
+	}
+	// the host part of the url is ignored
+	req, err := http.NewRequest(method, "http://virtlet"+path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("control request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("control request failed: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
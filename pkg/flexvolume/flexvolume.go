@@ -70,10 +70,64 @@ type FlexVolumeDriver struct {
 	mounter Mounter
 }
 
+// NewFlexVolumeDriver creates a new FlexVolumeDriver. If uuidGen is
+// nil, random (version 4) uuids are used for the volumes.
 func NewFlexVolumeDriver(uuidGen UuidGen, mounter Mounter) *FlexVolumeDriver {
+	if uuidGen == nil {
+		uuidGen = utils.NewUUID
+	}
 	return &FlexVolumeDriver{uuidGen: uuidGen, mounter: mounter}
 }
 
+// attachedVolumeDirs returns the directories of the flexvolumes that
+// may be attached on the node besides the one being mounted at
+// targetMountDir. With kubelet directory layout
+// (pods/<pod uid>/volumes/<driver>/<volume name>) these are the
+// volumes of all the pods, otherwise just the sibling directories of
+// targetMountDir.
+func attachedVolumeDirs(targetMountDir string) ([]string, error) {
+	pattern := filepath.Join(filepath.Dir(targetMountDir), "*")
+	volumesDir := filepath.Dir(filepath.Dir(targetMountDir))
+	if filepath.Base(volumesDir) == "volumes" {
+		podsDir := filepath.Dir(filepath.Dir(volumesDir))
+		pattern = filepath.Join(podsDir, "*", "volumes", "*", "*")
+	}
+	dirs, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var r []string
+	for _, dir := range dirs {
+		if filepath.Clean(dir) == filepath.Clean(targetMountDir) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, flexvolumeDataFile)); err == nil {
+			r = append(r, dir)
+		}
+	}
+	return r, nil
+}
+
+// checkUUIDCollision returns an error if any of the attached
+// flexvolumes already uses the specified uuid
+func checkUUIDCollision(targetMountDir, uuid string) error {
+	dirs, err := attachedVolumeDirs(targetMountDir)
+	if err != nil {
+		return fmt.Errorf("can't list the attached volumes: %v", err)
+	}
+	for _, dir := range dirs {
+		otherUUID, _, err := GetFlexvolumeInfo(dir)
+		if err != nil {
+			// not a volume we can mistake for the new one
+			continue
+		}
+		if otherUUID == uuid {
+			return fmt.Errorf("uuid %q of the volume collides with the volume at %q", uuid, dir)
+		}
+	}
+	return nil
+}
+
 func (d *FlexVolumeDriver) populateVolumeDir(targetDir string, opts map[string]interface{}) error {
 	return utils.WriteJSON(filepath.Join(targetDir, flexvolumeDataFile), opts, 0700)
 }
@@ -112,7 +166,11 @@ func (d *FlexVolumeDriver) mount(targetMountDir, jsonOptions string) (map[string
 	if err := json.Unmarshal([]byte(jsonOptions), &opts); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal json options: %v", err)
 	}
-	opts[uuidOptionsKey] = d.uuidGen()
+	uuid := d.uuidGen()
+	if err := checkUUIDCollision(targetMountDir, uuid); err != nil {
+		return nil, err
+	}
+	opts[uuidOptionsKey] = uuid
 	if err := os.MkdirAll(targetMountDir, 0700); err != nil {
 		return nil, fmt.Errorf("os.MkDirAll(): %v", err)
 	}
@@ -307,3 +307,69 @@ func TestFlexVolume(t *testing.T) {
 }
 
 // TODO: escape xml in iso path
+
+func TestFlexVolumeUUIDCollision(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "flexvolume-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := utils.MapToJSON(map[string]interface{}{"type": "qcow2"})
+	for _, tc := range []struct {
+		name      string
+		firstDir  string
+		secondDir string
+	}{
+		{
+			name:      "kubelet pod dirs",
+			firstDir:  "pods/pod1/volumes/virtlet~flexvolume_driver/vol1",
+			secondDir: "pods/pod2/volumes/virtlet~flexvolume_driver/vol2",
+		},
+		{
+			name:      "sibling dirs",
+			firstDir:  "siblings/vol1",
+			secondDir: "siblings/vol2",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			uuid := fakeUuid
+			uuidGen := func() string { return uuid }
+			mount := func(dir string) map[string]interface{} {
+				targetDir := filepath.Join(tmpDir, dir)
+				d := NewFlexVolumeDriver(uuidGen, newFakeMounter(t, filepath.Dir(targetDir)))
+				var m map[string]interface{}
+				if err := json.Unmarshal([]byte(d.Run([]string{"mount", targetDir, opts})), &m); err != nil {
+					t.Fatalf("failed to unmarshal test result: %v", err)
+				}
+				return m
+			}
+
+			if m := mount(tc.firstDir); m["status"] != "Success" {
+				t.Fatalf("mounting the first volume failed: %v", m)
+			}
+
+			m := mount(tc.secondDir)
+			if m["status"] != "Failure" {
+				t.Errorf("mounting the volume with duplicate uuid didn't fail")
+			} else if msg, _ := m["message"].(string); !strings.Contains(msg, "collides") {
+				t.Errorf("bad error message: %q", msg)
+			}
+			if _, err := os.Stat(filepath.Join(tmpDir, tc.secondDir)); !os.IsNotExist(err) {
+				t.Errorf("the volume dir was created for a volume with duplicate uuid")
+			}
+
+			uuid = "e3a69f29-4e2a-4ebc-5c70-1d67e2ee0a3e"
+			if m := mount(tc.secondDir); m["status"] != "Success" {
+				t.Errorf("mounting the volume with a unique uuid failed: %v", m)
+			}
+			dataUUID, _, err := GetFlexvolumeInfo(filepath.Join(tmpDir, tc.secondDir))
+			if err != nil {
+				t.Fatalf("GetFlexvolumeInfo(): %v", err)
+			}
+			if dataUUID != uuid {
+				t.Errorf("bad volume uuid %q instead of %q", dataUUID, uuid)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AuthConfig contains the credentials used to download the image
+// from a registry that requires authentication. It mirrors the
+// AuthConfig passed by kubelet in CRI PullImage requests, which is
+// built from the image pull secrets of the pod. The credentials
+// must never be logged, so AuthConfig is formatted as a redacted
+// string.
+type AuthConfig struct {
+	// Username is the user name for basic authentication
+	Username string
+	// Password is the password for basic authentication
+	Password string
+	// Auth is base64-encoded "username:password" string
+	// that's used if Username is empty
+	Auth string
+	// IdentityToken is the refresh token that's used to obtain
+	// the bearer token from the registry's token service
+	IdentityToken string
+	// RegistryToken is the bearer token that's sent to the
+	// registry as is
+	RegistryToken string
+	// ServerAddress is the address of the server the credentials
+	// are intended for. As the image name may be translated to an
+	// URL pointing to another server, the credentials are only used
+	// if the host of the URL matches the host of the address. Empty
+	// ServerAddress matches any host.
+	ServerAddress string
+}
+
+// String implements fmt.Stringer so the credentials don't get into
+// the logs and the error messages when the config is printed
+func (a *AuthConfig) String() string {
+	return "AuthConfig{<redacted>}"
+}
+
+// GoString implements fmt.GoStringer for the same purpose as String
+func (a *AuthConfig) GoString() string {
+	return a.String()
+}
+
+// TranslatorWithAuth returns an image translator that adds the
+// specified credentials to the endpoints returned by the specified
+// translator. If auth is nil, the translator is returned as is.
+func TranslatorWithAuth(translator Translator, auth *AuthConfig) Translator {
+	if auth == nil {
+		return translator
+	}
+	return func(ctx context.Context, name string) Endpoint {
+		ep := translator(ctx, name)
+		ep.Auth = auth
+		return ep
+	}
+}
+
+// matchesURL returns true if the credentials can be used for the
+// specified URL
+func (a *AuthConfig) matchesURL(rawURL string) bool {
+	if a == nil {
+		return false
+	}
+	if a.ServerAddress == "" {
+		return true
+	}
+	address := a.ServerAddress
+	if !strings.Contains(address, "://") {
+		address = "https://" + address
+	}
+	server, err := url.Parse(address)
+	if err != nil {
+		return false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(server.Hostname(), u.Hostname())
+}
+
+// basicCredentials returns the user name and the password for basic
+// authentication, if there are any
+func (a *AuthConfig) basicCredentials() (string, string, bool) {
+	if a == nil {
+		return "", "", false
+	}
+	if a.Username != "" {
+		return a.Username, a.Password, true
+	}
+	if a.Auth == "" {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+	if err != nil {
+		return "", "", false
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// authorize sets the Authorization header of the request. The
+// bearer token obtained from the token service takes precedence over
+// the registry token, which takes precedence over basic credentials.
+func (a *AuthConfig) authorize(req *http.Request, bearerToken string) {
+	switch {
+	case bearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+bearerToken)
+	case a == nil:
+	case a.RegistryToken != "":
+		req.Header.Set("Authorization", "Bearer "+a.RegistryToken)
+	default:
+		if username, password, ok := a.basicCredentials(); ok {
+			req.SetBasicAuth(username, password)
+		}
+	}
+}
+
+// parseBearerChallenge parses the value of WWW-Authenticate header
+// like 'Bearer realm="https://auth.example.com/token",service="registry"'
+// and returns its parameters. It returns false if the challenge
+// is not a bearer one or doesn't specify the realm.
+func parseBearerChallenge(header string) (map[string]string, bool) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return nil, false
+	}
+	params := make(map[string]string)
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimLeft(rest[eq+1:], " ")
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				return nil, false
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = strings.TrimSpace(value)
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	if params["realm"] == "" {
+		return nil, false
+	}
+	return params, true
+}
+
+type bearerTokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+// fetchBearerToken obtains the bearer token from the token service
+// specified in the challenge. If the identity token is set, it's
+// exchanged for the bearer token using OAuth2 refresh token grant,
+// otherwise the token is requested using basic credentials or
+// anonymously if there are none.
+func fetchBearerToken(ctx context.Context, client *http.Client, challenge map[string]string, auth *AuthConfig) (string, error) {
+	realm, err := url.Parse(challenge["realm"])
+	if err != nil {
+		return "", fmt.Errorf("bad bearer token realm %q: %v", challenge["realm"], err)
+	}
+
+	var req *http.Request
+	if auth != nil && auth.IdentityToken != "" {
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", auth.IdentityToken)
+		form.Set("client_id", "virtlet")
+		if service := challenge["service"]; service != "" {
+			form.Set("service", service)
+		}
+		if scope := challenge["scope"]; scope != "" {
+			form.Set("scope", scope)
+		}
+		req, err = http.NewRequest("POST", realm.String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := realm.Query()
+		if service := challenge["service"]; service != "" {
+			query.Set("service", service)
+		}
+		if scope := challenge["scope"]; scope != "" {
+			query.Set("scope", scope)
+		}
+		realm.RawQuery = query.Encode()
+		req, err = http.NewRequest("GET", realm.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if username, password, ok := auth.basicCredentials(); ok {
+			req.SetBasicAuth(username, password)
+		}
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("bearer token request to %q failed: %v", challenge["realm"], err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &httpStatusError{statusCode: resp.StatusCode, status: resp.Status}
+	}
+
+	var tokenResp bearerTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("can't decode bearer token response from %q: %v", challenge["realm"], err)
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	if tokenResp.AccessToken != "" {
+		return tokenResp.AccessToken, nil
+	}
+	return "", fmt.Errorf("no bearer token in the response from %q", challenge["realm"])
+}
@@ -0,0 +1,272 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	// NoDecompression is used in place of the list of
+	// decompression formats to disable the decompression
+	NoDecompression = "none"
+	// maxMagicSize is the size of the longest magic number
+	// among the supported compression formats
+	maxMagicSize = 6
+)
+
+type compressionFormat struct {
+	name      string
+	magic     []byte
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var compressionFormats = []compressionFormat{
+	{
+		name:  "gzip",
+		magic: []byte{0x1f, 0x8b},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		name:  "xz",
+		magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			xr, err := xz.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(xr), nil
+		},
+	},
+	{
+		name:  "zstd",
+		magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return zr.IOReadCloser(), nil
+		},
+	},
+}
+
+// DecompressionFormats returns the names of all the supported
+// image compression formats
+func DecompressionFormats() []string {
+	var r []string
+	for _, f := range compressionFormats {
+		r = append(r, f.name)
+	}
+	return r
+}
+
+// ParseDecompressionFormats parses a comma-separated list of
+// compression formats. Empty string denotes all the supported
+// formats, while NoDecompression disables the decompression.
+func ParseDecompressionFormats(s string) ([]string, error) {
+	switch strings.TrimSpace(s) {
+	case "":
+		return DecompressionFormats(), nil
+	case NoDecompression:
+		return nil, nil
+	}
+	var r []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if findCompressionFormat(name) == nil {
+			return nil, fmt.Errorf("unsupported image compression format %q", name)
+		}
+		r = append(r, name)
+	}
+	return r, nil
+}
+
+func findCompressionFormat(name string) *compressionFormat {
+	for n := range compressionFormats {
+		if compressionFormats[n].name == name {
+			return &compressionFormats[n]
+		}
+	}
+	return nil
+}
+
+// decompressionError denotes corrupt compressed image data
+type decompressionError struct {
+	format string
+	err    error
+}
+
+func (e *decompressionError) Error() string {
+	return fmt.Sprintf("error decompressing %s image data: %v", e.format, e.err)
+}
+
+// decompressingWriter detects the compression format of the data
+// using its magic number and decompresses the data on the fly if
+// the format is among the enabled ones. Data in other formats is
+// passed through unchanged. Close() must be called after all the
+// data is written.
+type decompressingWriter struct {
+	w       io.Writer
+	formats []string
+	header  []byte
+	started bool
+	format  string
+	pw      *io.PipeWriter
+	done    chan error
+	// writeFailed is set if the decompression failed
+	// before all the data was written
+	writeFailed bool
+	// decompressStart is the time when the decompression
+	// has started
+	decompressStart time.Time
+	// decompressDuration is the time spent decompressing
+	// and writing the data, not including the time spent
+	// waiting for the compressed data to arrive. It's only
+	// valid after Close() returns.
+	decompressDuration time.Duration
+}
+
+var _ io.WriteCloser = &decompressingWriter{}
+
+func newDecompressingWriter(w io.Writer, formats []string) *decompressingWriter {
+	return &decompressingWriter{w: w, formats: formats}
+}
+
+func (dw *decompressingWriter) detectFormat() *compressionFormat {
+	for _, name := range dw.formats {
+		f := findCompressionFormat(name)
+		if f != nil && bytes.HasPrefix(dw.header, f.magic) {
+			return f
+		}
+	}
+	return nil
+}
+
+func (dw *decompressingWriter) start() error {
+	dw.started = true
+	header := dw.header
+	if f := dw.detectFormat(); f != nil {
+		pr, pw := io.Pipe()
+		dw.format = f.name
+		dw.pw = pw
+		dw.done = make(chan error, 1)
+		dw.decompressStart = time.Now()
+		go func() {
+			r := &waitTimingReader{r: pr}
+			err := dw.decompress(f, r)
+			dw.decompressDuration = time.Since(dw.decompressStart) - r.wait
+			// unblock the writer if the decompression fails
+			pr.CloseWithError(err)
+			dw.done <- err
+		}()
+	}
+	dw.header = nil
+	return dw.write(header)
+}
+
+// waitTimingReader measures the time spent waiting for the
+// data in Read()
+type waitTimingReader struct {
+	r    io.Reader
+	wait time.Duration
+}
+
+func (r *waitTimingReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := r.r.Read(p)
+	r.wait += time.Since(start)
+	return n, err
+}
+
+func (dw *decompressingWriter) decompress(f *compressionFormat, r io.Reader) error {
+	dr, err := f.newReader(r)
+	if err != nil {
+		return &decompressionError{format: f.name, err: err}
+	}
+	defer dr.Close()
+	if _, err := io.CopyBuffer(dw.w, dr, make([]byte, copyBufferSize)); err != nil {
+		return &decompressionError{format: f.name, err: err}
+	}
+	// make sure all of the compressed data was consumed
+	if n, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	} else if n != 0 {
+		return &decompressionError{format: f.name, err: fmt.Errorf("%d bytes of trailing data", n)}
+	}
+	return nil
+}
+
+func (dw *decompressingWriter) write(p []byte) error {
+	var err error
+	if dw.pw != nil {
+		if _, err = dw.pw.Write(p); err != nil {
+			dw.writeFailed = true
+		}
+	} else {
+		_, err = dw.w.Write(p)
+	}
+	return err
+}
+
+// Write implements Write method of io.Writer interface
+func (dw *decompressingWriter) Write(p []byte) (int, error) {
+	if !dw.started {
+		dw.header = append(dw.header, p...)
+		if len(dw.header) < maxMagicSize {
+			return len(p), nil
+		}
+		if err := dw.start(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if err := dw.write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close flushes the data and waits for the decompression
+// to finish. It returns decompressionError if the compressed
+// data is corrupt.
+func (dw *decompressingWriter) Close() error {
+	var err error
+	if !dw.started {
+		err = dw.start()
+	}
+	if dw.pw == nil {
+		return err
+	}
+	dw.pw.Close()
+	dw.pw = nil
+	if decompErr := <-dw.done; decompErr != nil {
+		return decompErr
+	}
+	return err
+}
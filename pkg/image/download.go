@@ -57,6 +57,10 @@ type Endpoint struct {
 
 	// Transport profile name for this endpoint. Provided for logging/debugging
 	ProfileName string
+
+	// Auth contains the credentials for the registry that requires
+	// authentication. nil means no credentials.
+	Auth *AuthConfig
 }
 
 // TLSConfig has the TLS transport parameters
@@ -193,19 +197,34 @@ func (d *defaultDownloader) DownloadFile(ctx context.Context, endpoint Endpoint,
 
 	glog.V(2).Infof("Start downloading %s", url)
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return err
+	auth := endpoint.Auth
+	if auth != nil && !auth.matchesURL(url) {
+		glog.V(2).Infof("Not using the image pull credentials for %s as they're intended for another server", url)
+		auth = nil
 	}
-	req = req.WithContext(ctx)
-	resp, err := client.Do(req)
+
+	resp, err := d.get(ctx, client, url, auth, "")
 	if err != nil {
 		return err
 	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		// the registry may require a bearer token from its token service
+		if challenge, ok := parseBearerChallenge(resp.Header.Get("WWW-Authenticate")); ok {
+			resp.Body.Close()
+			glog.V(2).Infof("Requesting bearer token for %s", url)
+			token, err := fetchBearerToken(ctx, client, challenge, auth)
+			if err != nil {
+				return err
+			}
+			if resp, err = d.get(ctx, client, url, auth, token); err != nil {
+				return err
+			}
+		}
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad http status %q", resp.Status)
+		return &httpStatusError{statusCode: resp.StatusCode, status: resp.Status}
 	}
 
 	if _, err = io.CopyBuffer(w, resp.Body, make([]byte, copyBufferSize)); err != nil {
@@ -218,4 +237,13 @@ func (d *defaultDownloader) DownloadFile(ctx context.Context, endpoint Endpoint,
 	return nil
 }
 
+func (d *defaultDownloader) get(ctx context.Context, client *http.Client, url string, auth *AuthConfig, bearerToken string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	auth.authorize(req, bearerToken)
+	return client.Do(req.WithContext(ctx))
+}
+
 // Note that the tests for defaultDownloader are in 'imagetranslation' package (FIXME)
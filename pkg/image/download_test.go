@@ -20,6 +20,8 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -152,3 +154,144 @@ func TestNotFound(t *testing.T) {
 		t.Errorf("bad error message for nonexistent image")
 	}
 }
+
+func authHandler(t *testing.T, content string, expectedAuth string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != expectedAuth {
+			t.Errorf("bad Authorization header: %q instead of %q", auth, expectedAuth)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		downloadHandler(content)(w, r)
+	}
+}
+
+func TestBasicAuthDownload(t *testing.T) {
+	expectedAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	for _, tc := range []struct {
+		name string
+		auth *AuthConfig
+	}{
+		{
+			name: "username and password",
+			auth: &AuthConfig{Username: "user", Password: "secret"},
+		},
+		{
+			name: "encoded auth",
+			auth: &AuthConfig{Auth: base64.StdEncoding.EncodeToString([]byte("user:secret"))},
+		},
+		{
+			name: "matching server address",
+			auth: &AuthConfig{Username: "user", Password: "secret", ServerAddress: "https://127.0.0.1/v1/"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(authHandler(t, "foobar", expectedAuth))
+			defer ts.Close()
+			verifyDownload(t, "http", "foobar", Endpoint{
+				URL:  ts.Listener.Addr().String() + "/base.qcow2",
+				Auth: tc.auth,
+			})
+		})
+	}
+}
+
+func TestRegistryTokenDownload(t *testing.T) {
+	ts := httptest.NewServer(authHandler(t, "foobar", "Bearer regtoken"))
+	defer ts.Close()
+	verifyDownload(t, "http", "foobar", Endpoint{
+		URL:  ts.Listener.Addr().String() + "/base.qcow2",
+		Auth: &AuthConfig{RegistryToken: "regtoken"},
+	})
+}
+
+func TestCredentialsNotSentToAnotherServer(t *testing.T) {
+	ts := httptest.NewServer(authHandler(t, "foobar", ""))
+	defer ts.Close()
+	verifyDownload(t, "http", "foobar", Endpoint{
+		URL:  ts.Listener.Addr().String() + "/base.qcow2",
+		Auth: &AuthConfig{Username: "user", Password: "secret", ServerAddress: "registry.example.com"},
+	})
+}
+
+func TestBearerAuthDownload(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		auth *AuthConfig
+	}{
+		{
+			name: "basic credentials",
+			auth: &AuthConfig{Username: "user", Password: "secret"},
+		},
+		{
+			name: "identity token",
+			auth: &AuthConfig{IdentityToken: "refreshtoken"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tokenRequests := 0
+			tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tokenRequests++
+				if tc.auth.IdentityToken != "" {
+					if r.Method != "POST" {
+						t.Errorf("bad token request method %q", r.Method)
+					}
+					if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != tc.auth.IdentityToken {
+						t.Errorf("bad refresh token request: %v", r.Form)
+					}
+				} else if username, password, ok := r.BasicAuth(); !ok || username != tc.auth.Username || password != tc.auth.Password {
+					t.Errorf("bad credentials in the token request")
+				}
+				if r.FormValue("service") != "registry.test" || r.FormValue("scope") != "repository:base:pull" {
+					t.Errorf("bad token request parameters: %v", r.Form)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"token":"bearertoken"}`))
+			}))
+			defer tokenServer.Close()
+
+			registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer bearertoken" {
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry.test",scope="repository:base:pull"`, tokenServer.URL))
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				downloadHandler("foobar")(w, r)
+			}))
+			defer registry.Close()
+
+			verifyDownload(t, "http", "foobar", Endpoint{
+				URL:  registry.Listener.Addr().String() + "/base.qcow2",
+				Auth: tc.auth,
+			})
+			if tokenRequests != 1 {
+				t.Errorf("%d token requests instead of 1", tokenRequests)
+			}
+		})
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+	downloader := NewDownloader("http")
+	var buf bytes.Buffer
+	ep := Endpoint{
+		URL:  ts.Listener.Addr().String() + "/base.qcow2",
+		Auth: &AuthConfig{Username: "user", Password: "wrong"},
+	}
+	err := downloader.DownloadFile(context.Background(), ep, &buf)
+	switch {
+	case err == nil:
+		t.Errorf("no error returned for bad credentials")
+	case !strings.Contains(err.Error(), "Unauthorized"):
+		t.Errorf("bad error message for bad credentials: %v", err)
+	case strings.Contains(err.Error(), "wrong"):
+		t.Errorf("the credentials leaked into the error message: %v", err)
+	}
+	if s := fmt.Sprintf("%v %#v %+v", ep.Auth, ep.Auth, ep.Auth); strings.Contains(s, "wrong") {
+		t.Errorf("the credentials leaked into the formatted auth config: %s", s)
+	}
+}
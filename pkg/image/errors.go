@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var errImageNotFound = errors.New("image not found")
+
+// ImageError is returned when an image can't be obtained.
+// It tells whether retrying the operation may help.
+type ImageError struct {
+	// Image is the name or the reference of the image
+	Image string
+	// Permanent is true if the error will not go away if
+	// the operation is retried, e.g. if the image doesn't exist.
+	// Otherwise, the error is considered retryable, e.g. if
+	// the image registry is unreachable.
+	Permanent bool
+	// Err is the cause of the error
+	Err error
+}
+
+func (e *ImageError) Error() string {
+	kind := "retryable"
+	if e.Permanent {
+		kind = "permanent"
+	}
+	return fmt.Sprintf("image %q: %v (%s error)", e.Image, e.Err, kind)
+}
+
+// NewImageNotFoundError returns a permanent ImageError for the
+// image that doesn't exist
+func NewImageNotFoundError(image string) *ImageError {
+	return &ImageError{Image: image, Permanent: true, Err: errImageNotFound}
+}
+
+// IsPermanentError returns true if the specified error is an
+// ImageError that will not go away if the operation is retried
+func IsPermanentError(err error) bool {
+	imageErr, ok := err.(*ImageError)
+	return ok && imageErr.Permanent
+}
+
+// IsRetryableError returns true if the specified error is an
+// ImageError that may go away if the operation is retried
+func IsRetryableError(err error) bool {
+	imageErr, ok := err.(*ImageError)
+	return ok && !imageErr.Permanent
+}
+
+// httpStatusError is returned by the downloader when the server
+// responds with an unexpected http status
+type httpStatusError struct {
+	statusCode int
+	status     string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("bad http status %q", e.status)
+}
+
+// permanent returns true if the http status means that retrying
+// the download will not help
+func (e *httpStatusError) permanent() bool {
+	switch e.statusCode {
+	case http.StatusNotFound, http.StatusGone, http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	default:
+		return false
+	}
+}
+
+// newDownloadError wraps the error returned by the downloader
+// in ImageError. Errors caused by http statuses such as 404 and
+// corrupt compressed data are considered permanent, while all the
+// other ones, such as connection errors, are considered retryable.
+func newDownloadError(image, url string, err error) *ImageError {
+	permanent := false
+	switch err := err.(type) {
+	case *httpStatusError:
+		permanent = err.permanent()
+	case *decompressionError:
+		permanent = true
+	}
+	return &ImageError{
+		Image:     image,
+		Permanent: permanent,
+		Err:       fmt.Errorf("error downloading %q: %v", url, err),
+	}
+}
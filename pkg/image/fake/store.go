@@ -18,7 +18,6 @@ package image
 
 import (
 	"context"
-	"fmt"
 	"sort"
 
 	"github.com/docker/distribution/reference"
@@ -54,13 +53,40 @@ func (s *FakeStore) ListImages(filter string) ([]*image.Image, error) {
 		}
 	}
 	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
-	return r, nil
+	return s.markImagesInUse(r)
 }
 
 // ImageStatus implements ImageStatus method of Store interface.
 func (s *FakeStore) ImageStatus(name string) (*image.Image, error) {
 	name = image.StripTags(name)
-	return s.images[name], nil
+	img, found := s.images[name]
+	if !found {
+		return nil, nil
+	}
+	r, err := s.markImagesInUse([]*image.Image{img})
+	if err != nil {
+		return nil, err
+	}
+	return r[0], nil
+}
+
+// markImagesInUse returns copies of the images with InUse flag
+// set for the images that are referenced by the containers
+func (s *FakeStore) markImagesInUse(images []*image.Image) ([]*image.Image, error) {
+	refSet := make(map[string]bool)
+	if s.refGetter != nil {
+		var err error
+		if refSet, err = s.refGetter(); err != nil {
+			return nil, err
+		}
+	}
+	r := make([]*image.Image, len(images))
+	for n, img := range images {
+		imgCopy := *img
+		imgCopy.InUse = refSet[img.Name] || refSet[img.Digest] || refSet[img.Name+"@"+img.Digest]
+		r[n] = &imgCopy
+	}
+	return r, nil
 }
 
 // PullImage implements PullImage method of Store interface.
@@ -77,10 +103,11 @@ func (s *FakeStore) PullImage(ctx context.Context, name string, translator image
 		return "", err
 	}
 	s.images[name] = &image.Image{
-		Digest: d.String(),
-		Name:   name,
-		Path:   "/fake/volume/" + name,
-		Size:   uint64(len(name)),
+		Digest:      d.String(),
+		Name:        name,
+		Path:        "/fake/volume/" + name,
+		Size:        uint64(len(name)),
+		VirtualSize: uint64(len(name)),
 	}
 	s.rec.Rec("PullImage", map[string]interface{}{
 		"url":   ep.URL,
@@ -116,9 +143,9 @@ func (s *FakeStore) GC() error {
 func (s *FakeStore) GetImagePathAndVirtualSize(imageName string) (string, uint64, error) {
 	img, found := s.images[imageName]
 	if !found {
-		return "", 0, fmt.Errorf("image not found: %q", imageName)
+		return "", 0, image.NewImageNotFoundError(imageName)
 	}
-	return img.Path, img.Size, nil
+	return img.Path, img.VirtualSize, nil
 }
 
 // SetRefGetter implements SetRefGetter method of Store interface.
@@ -35,7 +35,13 @@ type Image struct {
 	Digest string
 	Name   string
 	Path   string
-	Size   uint64
+	// Size is the actual size of the image data file
+	Size uint64
+	// VirtualSize is the virtual size of the image
+	VirtualSize uint64
+	// InUse is true if the image is used by some of the
+	// containers, which means that it can't be removed by GC
+	InUse bool
 }
 
 func (img *Image) hexDigest() (string, error) {
@@ -99,6 +105,19 @@ type FileStore struct {
 	downloader Downloader
 	vsizeFunc  VirtualSizeFunc
 	refGetter  RefGetter
+	observer   PullObserver
+	// convertFunc is used to convert the imported image files
+	convertFunc ConvertFunc
+	// vsizes caches the virtual sizes of the image data files
+	// by their hex digests
+	vsizes map[string]uint64
+	// decompressionFormats lists the compression formats of
+	// the images that are decompressed during the pull
+	decompressionFormats []string
+	// tenants holds the stores of the tenants by their keys.
+	// It's nil for the tenant stores themselves.
+	tenants    map[string]*FileStore
+	tenantLock sync.Mutex
 }
 
 var _ Store = &FileStore{}
@@ -112,9 +131,13 @@ func NewFileStore(dir string, downloader Downloader, vsizeFunc VirtualSizeFunc)
 		vsizeFunc = GetImageVirtualSize
 	}
 	return &FileStore{
-		dir:        dir,
-		downloader: downloader,
-		vsizeFunc:  vsizeFunc,
+		dir:                  dir,
+		downloader:           downloader,
+		vsizeFunc:            vsizeFunc,
+		convertFunc:          ConvertImage,
+		decompressionFormats: DecompressionFormats(),
+		vsizes:               make(map[string]uint64),
+		tenants:              make(map[string]*FileStore),
 	}
 }
 
@@ -160,24 +183,35 @@ func (s *FileStore) renameIfNewOrDelete(oldPath string, newPath string) (bool, e
 	}
 }
 
-func (s *FileStore) getImageHexDigestsInUse() (map[string]bool, error) {
-	imagesInUse := make(map[string]bool)
-	var imgList []string
-	if s.refGetter != nil {
-		refSet, err := s.refGetter()
-		if err != nil {
-			return nil, fmt.Errorf("error listing images in use: %v", err)
+// getReferencedImages returns the sets of hex digests and
+// names of the images that are used by the containers
+func (s *FileStore) getReferencedImages() (map[string]bool, map[string]bool, error) {
+	hexDigests := make(map[string]bool)
+	names := make(map[string]bool)
+	if s.refGetter == nil {
+		return hexDigests, names, nil
+	}
+	refSet, err := s.refGetter()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing images in use: %v", err)
+	}
+	for spec, present := range refSet {
+		if !present {
+			continue
 		}
-		for spec, present := range refSet {
-			if present {
-				imgList = append(imgList, spec)
-			}
+		if d := GetHexDigest(spec); d != "" {
+			hexDigests[d] = true
+		} else {
+			names[StripTags(spec)] = true
 		}
 	}
-	for _, imgSpec := range imgList {
-		if d := GetHexDigest(imgSpec); d != "" {
-			imagesInUse[d] = true
-		}
+	return hexDigests, names, nil
+}
+
+func (s *FileStore) getImageHexDigestsInUse() (map[string]bool, error) {
+	imagesInUse, _, err := s.getReferencedImages()
+	if err != nil {
+		return nil, err
 	}
 	images, err := s.listImagesUnlocked("")
 	if err != nil {
@@ -334,11 +368,47 @@ func (s *FileStore) listImagesUnlocked(filter string) ([]*Image, error) {
 	return r, nil
 }
 
+// addImageDetails fills in the virtual sizes of the images
+// and marks the images that are used by the containers
+func (s *FileStore) addImageDetails(images []*Image) error {
+	hexDigests, names, err := s.getReferencedImages()
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		hexDigest, err := img.hexDigest()
+		if err != nil {
+			glog.Warningf("error calculating digest for image %q: %v", img.Name, err)
+			continue
+		}
+		img.InUse = hexDigests[hexDigest] || names[img.Name]
+		vsize, found := s.vsizes[hexDigest]
+		if !found {
+			if vsize, err = s.vsizeFunc(img.Path); err != nil {
+				glog.Warningf("error getting virtual size of image %q: %v", img.Name, err)
+				continue
+			}
+			// the data files are named by their digests
+			// and thus are never changed
+			s.vsizes[hexDigest] = vsize
+		}
+		img.VirtualSize = vsize
+	}
+	return nil
+}
+
 // ListImages implements ListImages method of ImageStore interface.
 func (s *FileStore) ListImages(filter string) ([]*Image, error) {
 	s.Lock()
 	defer s.Unlock()
-	return s.listImagesUnlocked(filter)
+	images, err := s.listImagesUnlocked(filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addImageDetails(images); err != nil {
+		return nil, err
+	}
+	return images, nil
 }
 
 func (s *FileStore) imageStatusUnlocked(name string) (*Image, error) {
@@ -358,12 +428,26 @@ func (s *FileStore) imageStatusUnlocked(name string) (*Image, error) {
 func (s *FileStore) ImageStatus(name string) (*Image, error) {
 	s.Lock()
 	defer s.Unlock()
-	return s.imageStatusUnlocked(name)
+	img, err := s.imageStatusUnlocked(name)
+	if err != nil || img == nil {
+		return img, err
+	}
+	if err := s.addImageDetails([]*Image{img}); err != nil {
+		return nil, err
+	}
+	return img, nil
 }
 
 // PullImage implements PullImage method of Store interface.
 func (s *FileStore) PullImage(ctx context.Context, name string, translator Translator) (string, error) {
 	name = StripTags(name)
+	trace := newPullTrace(name)
+	var pulledDigest string
+	defer func() {
+		trace.finish(pulledDigest, s.observer)
+	}()
+
+	trace.begin(PullPhaseResolve)
 	ep := translator(ctx, name)
 	glog.V(1).Infof("Image translation: %q -> %q", name, ep.URL)
 	if err := os.MkdirAll(s.dataDir(), 0777); err != nil {
@@ -373,14 +457,26 @@ func (s *FileStore) PullImage(ctx context.Context, name string, translator Trans
 	if err != nil {
 		return "", fmt.Errorf("failed to create a temporary file: %v", err)
 	}
-	if err := s.downloader.DownloadFile(ctx, ep, tempFile); err != nil {
+	trace.begin(PullPhaseDownload)
+	w := newDecompressingWriter(tempFile, s.decompressionFormats)
+	err = s.downloader.DownloadFile(ctx, ep, w)
+	// if the decompression fails, the downloader gets an error
+	// from the writer, so the decompression error is reported instead
+	if closeErr := w.Close(); err == nil || w.writeFailed {
+		err = closeErr
+	}
+	if err != nil {
 		tempFile.Close()
 		if err := os.Remove(tempFile.Name()); err != nil {
 			glog.Warningf("Error removing %q: %v", tempFile.Name(), err)
 		}
-		return "", fmt.Errorf("error downloading %q: %v", ep.URL, err)
+		return "", newDownloadError(name, ep.URL, err)
+	}
+	if w.format != "" {
+		trace.add(PullPhaseConvert, w.decompressStart, w.decompressDuration)
 	}
 
+	trace.begin(PullPhaseVerify)
 	if _, err := tempFile.Seek(0, os.SEEK_SET); err != nil {
 		return "", fmt.Errorf("can't get the digest for %q: Seek(): %v", tempFile.Name(), err)
 	}
@@ -392,6 +488,9 @@ func (s *FileStore) PullImage(ctx context.Context, name string, translator Trans
 	if err := tempFile.Close(); err != nil {
 		return "", fmt.Errorf("closing %q: %v", tempFile.Name(), err)
 	}
+	pulledDigest = d.String()
+
+	trace.begin(PullPhaseRegister)
 	if err := s.placeImage(tempFile.Name(), d.Hex(), name); err != nil {
 		return "", err
 	}
@@ -415,7 +514,18 @@ func (s *FileStore) RemoveImage(name string) error {
 }
 
 // GC implements GC method of Store interface.
+// It also does GC for the image stores of all the tenants.
 func (s *FileStore) GC() error {
+	if err := s.gcData(); err != nil {
+		return err
+	}
+	if s.tenants == nil {
+		return nil
+	}
+	return s.gcTenants()
+}
+
+func (s *FileStore) gcData() error {
 	s.Lock()
 	defer s.Unlock()
 	imagesInUse, err := s.getImageHexDigestsInUse()
@@ -468,6 +578,9 @@ func (s *FileStore) GetImagePathAndVirtualSize(ref string) (string, uint64, erro
 		if named, ok := parsed.(reference.Named); ok && named.Name() != "" {
 			linkFileName := s.linkFileName(named.Name())
 			if pathViaName, err = os.Readlink(linkFileName); err != nil {
+				if os.IsNotExist(err) && pathViaDigest == "" {
+					return "", 0, NewImageNotFoundError(ref)
+				}
 				glog.Warningf("error reading link %q: %v", pathViaName, err)
 			} else {
 				pathViaName = filepath.Join(s.linkDir(), pathViaName)
@@ -481,13 +594,20 @@ func (s *FileStore) GetImagePathAndVirtualSize(ref string) (string, uint64, erro
 		return "", 0, fmt.Errorf("bad image reference %q", ref)
 	case pathViaDigest == "":
 		path = pathViaName
-	case pathViaName != "":
+	case pathViaName == "":
+		if _, err := os.Stat(pathViaDigest); os.IsNotExist(err) {
+			return "", 0, NewImageNotFoundError(ref)
+		}
+	default:
 		fi1, err := os.Stat(pathViaName)
 		if err != nil {
 			return "", 0, err
 		}
 		fi2, err := os.Stat(pathViaDigest)
-		if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			return "", 0, NewImageNotFoundError(ref)
+		case err != nil:
 			return "", 0, err
 		}
 		if !os.SameFile(fi1, fi2) {
@@ -507,6 +627,20 @@ func (s *FileStore) SetRefGetter(imageRefGetter RefGetter) {
 	s.refGetter = imageRefGetter
 }
 
+// SetDecompressionFormats sets the list of compression formats
+// of the images that are decompressed during the pull. The
+// compression format is detected using the magic number of the
+// image data. Empty list disables the decompression.
+func (s *FileStore) SetDecompressionFormats(formats []string) {
+	s.decompressionFormats = formats
+}
+
+// SetPullObserver sets a function that will receive the timings
+// of image pull phases
+func (s *FileStore) SetPullObserver(observer PullObserver) {
+	s.observer = observer
+}
+
 // StripTags removes tags from an image name.
 func StripTags(imageName string) string {
 	ref, err := reference.Parse(imageName)
@@ -17,12 +17,16 @@ limitations under the License.
 package image
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -31,6 +35,8 @@ import (
 	"testing"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 )
 
 func sha256str(s string) string {
@@ -63,20 +69,65 @@ func (d *fakeDownloader) DownloadFile(ctx context.Context, endpoint Endpoint, w
 		d.cancelled = true
 		return ctx.Err()
 	}
+	switch {
+	case strings.Contains(endpoint.URL, "nosuchimage"):
+		return &httpStatusError{statusCode: http.StatusNotFound, status: "404 Not Found"}
+	case strings.Contains(endpoint.URL, "badgateway"):
+		return &httpStatusError{statusCode: http.StatusBadGateway, status: "502 Bad Gateway"}
+	case strings.Contains(endpoint.URL, "unreachable"):
+		return errors.New("dial tcp: connection refused")
+	}
 	if f, ok := w.(*os.File); ok {
 		d.t.Logf("fakeDownloader: writing %q to %q", endpoint.URL, f.Name())
 	}
 	// add "###" prefix to endpoint URL to make the contents
 	// more easily distinguishable from the URLs themselves
 	// in the test code
-	if n, err := w.Write([]byte("###" + endpoint.URL)); err != nil {
+	data := []byte("###" + endpoint.URL)
+	switch {
+	case strings.Contains(endpoint.URL, "corrupt"):
+		data = append([]byte{0x1f, 0x8b}, data...)
+	case strings.Contains(endpoint.URL, "gzipped"):
+		data = compressData(d.t, "gzip", data)
+	case strings.Contains(endpoint.URL, "xzipped"):
+		data = compressData(d.t, "xz", data)
+	case strings.Contains(endpoint.URL, "zstdcompressed"):
+		data = compressData(d.t, "zstd", data)
+	}
+	if n, err := w.Write(data); err != nil {
 		return fmt.Errorf("WriteString(): %v", err)
-	} else if n < len(endpoint.URL) {
+	} else if n < len(data) {
 		return fmt.Errorf("WriteString(): short write")
 	}
 	return nil
 }
 
+func compressData(t *testing.T, format string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch format {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "xz":
+		w, err = xz.NewWriter(&buf)
+	case "zstd":
+		w, err = zstd.NewWriter(&buf)
+	default:
+		t.Fatalf("bad compression format %q", format)
+	}
+	if err != nil {
+		t.Fatalf("error making %s writer: %v", format, err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("error compressing the data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("error compressing the data: %v", err)
+	}
+	return buf.Bytes()
+}
+
 func fakeVirtualSize(imagePath string) (uint64, error) {
 	var fi os.FileInfo
 	var err error
@@ -148,10 +199,11 @@ func (tst *ifsTester) sampleImages() ([]*Image, []string) {
 		image := &Image{
 			// fakeDownloader writes URL to the image file,
 			// and the image digest contains sha256 of the file
-			Digest: "sha256:" + sha256,
-			Name:   imageName,
-			Path:   tst.subpath("data/" + sha256),
-			Size:   uint64(len(imageName) + 3),
+			Digest:      "sha256:" + sha256,
+			Name:        imageName,
+			Path:        tst.subpath("data/" + sha256),
+			Size:        uint64(len(imageName) + 3),
+			VirtualSize: uint64(len(imageName) + 1003),
 		}
 		images = append(images, image)
 		refs = append(refs, image.Name+"@"+image.Digest)
@@ -304,10 +356,11 @@ func TestReplaceImage(t *testing.T) {
 	tst.translatorPrefix = "xx"
 	sha256 := sha256str("###xxbaz")
 	updatedImage := &Image{
-		Digest: "sha256:" + sha256,
-		Name:   tst.images[1].Name,
-		Path:   tst.subpath("data/" + sha256),
-		Size:   uint64(8),
+		Digest:      "sha256:" + sha256,
+		Name:        tst.images[1].Name,
+		Path:        tst.subpath("data/" + sha256),
+		Size:        uint64(8),
+		VirtualSize: uint64(1008),
 	}
 
 	updatedRef := updatedImage.Name + "@" + updatedImage.Digest
@@ -332,10 +385,11 @@ func TestReplaceReferencedImage(t *testing.T) {
 	tst.translatorPrefix = "xx"
 	sha256 := sha256str("###xxexample.com:1234/foo/bar")
 	updatedImage := &Image{
-		Digest: "sha256:" + sha256,
-		Name:   tst.images[0].Name,
-		Path:   tst.subpath("data/" + sha256),
-		Size:   uint64(29),
+		Digest:      "sha256:" + sha256,
+		Name:        tst.images[0].Name,
+		Path:        tst.subpath("data/" + sha256),
+		Size:        uint64(29),
+		VirtualSize: uint64(1029),
 	}
 
 	tst.referencedImages = []string{tst.images[0].Digest}
@@ -362,10 +416,11 @@ func TestReplaceUnreferencedImage(t *testing.T) {
 	tst.translatorPrefix = "xx"
 	sha256 := sha256str("###xxexample.com:1234/foo/bar")
 	updatedImage := &Image{
-		Digest: "sha256:" + sha256,
-		Name:   tst.images[0].Name,
-		Path:   tst.subpath("data/" + sha256),
-		Size:   uint64(29),
+		Digest:      "sha256:" + sha256,
+		Name:        tst.images[0].Name,
+		Path:        tst.subpath("data/" + sha256),
+		Size:        uint64(29),
+		VirtualSize: uint64(1029),
 	}
 
 	updatedRef := updatedImage.Name + "@" + updatedImage.Digest
@@ -412,6 +467,32 @@ func TestRemoveImage(t *testing.T) {
 	tst.verifyDataFiles(sha256str("###example.com:1234/foo/bar"))
 }
 
+func TestImageInUse(t *testing.T) {
+	tst := newIfsTester(t)
+	defer tst.teardown()
+	tst.pullAllImages()
+
+	// the image is referenced by the digest
+	tst.referencedImages = []string{tst.refs[0]}
+	pinnedImage := *tst.images[0]
+	pinnedImage.InUse = true
+	tst.verifyListImages("", tst.images[1], &pinnedImage, tst.images[2])
+	tst.verifyImageStatus(tst.images[0].Name, &pinnedImage)
+	tst.verifyImageStatus(tst.images[1].Name, tst.images[1])
+
+	// the image is referenced by the name only, so the image
+	// that shares its data file isn't considered to be in use
+	tst.referencedImages = []string{tst.images[1].Name + ":latest"}
+	pinnedImage = *tst.images[1]
+	pinnedImage.InUse = true
+	tst.verifyListImages("", &pinnedImage, tst.images[0], tst.images[2])
+	tst.verifyImageStatus(tst.images[1].Name, &pinnedImage)
+	tst.verifyImageStatus(tst.images[2].Name, tst.images[2])
+
+	tst.referencedImages = nil
+	tst.verifyListImages("", tst.images[1], tst.images[0], tst.images[2])
+}
+
 func TestImageGC(t *testing.T) {
 	tst := newIfsTester(t)
 	defer tst.teardown()
@@ -437,7 +518,10 @@ func TestImageGC(t *testing.T) {
 	tst.referencedImages = []string{tst.images[1].Digest}
 	tst.removeFile("links/example.com:1234%foo%bar")
 	tst.store.GC()
-	tst.verifyListImages("", tst.images[2])
+	// foobar shares the data file with the referenced image
+	usedImage := *tst.images[2]
+	usedImage.InUse = true
+	tst.verifyListImages("", &usedImage)
 	tst.verifyImage(tst.refs[2], "###baz")
 	tst.verifyDataFiles(sha256str("###baz"))
 
@@ -456,6 +540,63 @@ func TestImageGC(t *testing.T) {
 	tst.verifyDataFiles()
 }
 
+func TestTenantImages(t *testing.T) {
+	tst := newIfsTester(t)
+	defer tst.teardown()
+
+	var paths []string
+	for _, tenant := range []string{"tenant1", "tenant2"} {
+		store, err := tst.store.ForTenant(tenant)
+		if err != nil {
+			t.Fatalf("ForTenant(): %v", err)
+		}
+		ref, err := store.PullImage(context.Background(), tst.images[0].Name, tst.translateImageName)
+		if err != nil {
+			t.Fatalf("PullImage(): %v", err)
+		}
+		if ref != tst.refs[0] {
+			t.Errorf("bad image ref returned: %q instead of %q", ref, tst.refs[0])
+		}
+		path, _, err := store.GetImagePathAndVirtualSize(ref)
+		if err != nil {
+			t.Fatalf("GetImagePathAndVirtualSize(): %v", err)
+		}
+		expectedPath := tst.subpath("tenants/" + tenant + "/data/" + sha256str("###"+tst.images[0].Name))
+		if path != expectedPath {
+			t.Errorf("bad image path for tenant %q: %q instead of %q", tenant, path, expectedPath)
+		}
+		tst.verifyFileContents(path, "###"+tst.images[0].Name)
+		paths = append(paths, path)
+	}
+
+	// the tenant images aren't visible in the shared store
+	tst.verifyListImages("")
+	tst.verifyImageStatus(tst.images[0].Name, nil)
+	if _, _, err := tst.store.GetImagePathAndVirtualSize(tst.refs[0]); err == nil {
+		t.Errorf("GetImagePathAndVirtualSize() didn't fail for a tenant image in the shared store")
+	}
+
+	// removing the image of one tenant doesn't affect the other one
+	store1, err := tst.store.ForTenant("tenant1")
+	if err != nil {
+		t.Fatalf("ForTenant(): %v", err)
+	}
+	if err := store1.RemoveImage(tst.images[0].Name); err != nil {
+		t.Fatalf("RemoveImage(): %v", err)
+	}
+	if err := tst.store.GC(); err != nil {
+		t.Fatalf("GC(): %v", err)
+	}
+	if _, err := os.Stat(paths[0]); !os.IsNotExist(err) {
+		t.Errorf("the image data of the first tenant wasn't removed")
+	}
+	tst.verifyFileContents(paths[1], "###"+tst.images[0].Name)
+
+	if _, err := tst.store.ForTenant("../tenant1"); err == nil {
+		t.Errorf("ForTenant() didn't fail for a bad tenant key")
+	}
+}
+
 func TestCancelPullImage(t *testing.T) {
 	tst := newIfsTester(t)
 	defer tst.teardown()
@@ -476,3 +617,149 @@ func TestCancelPullImage(t *testing.T) {
 		t.Errorf("the downloader isn't marked as canelled")
 	}
 }
+
+func TestPullImageErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		permanent bool
+	}{
+		{name: "nosuchimage", permanent: true},
+		{name: "badgateway", permanent: false},
+		{name: "unreachable", permanent: false},
+		{name: "corrupt", permanent: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tst := newIfsTester(t)
+			defer tst.teardown()
+
+			_, err := tst.store.PullImage(context.Background(), tc.name, tst.translateImageName)
+			switch {
+			case err == nil:
+				t.Fatalf("PullImage() didn't return an error")
+			case IsPermanentError(err) != tc.permanent:
+				t.Errorf("bad permanent flag for the error %q: %v instead of %v", err, !tc.permanent, tc.permanent)
+			case IsRetryableError(err) == tc.permanent:
+				t.Errorf("bad retryable flag for the error %q: %v instead of %v", err, tc.permanent, !tc.permanent)
+			}
+			tst.verifyDataDirIsEmpty()
+		})
+	}
+}
+
+func TestPullCompressedImage(t *testing.T) {
+	for _, name := range []string{"gzipped", "xzipped", "zstdcompressed"} {
+		t.Run(name, func(t *testing.T) {
+			tst := newIfsTester(t)
+			defer tst.teardown()
+
+			imageName := "example.com/" + name
+			expectedContents := "###" + imageName
+			ref := imageName + "@sha256:" + sha256str(expectedContents)
+			tst.pullImage(imageName, ref)
+			tst.verifyImage(ref, expectedContents)
+			tst.verifyDataFiles(sha256str(expectedContents))
+		})
+	}
+}
+
+func TestPullCompressedImageWithoutDecompression(t *testing.T) {
+	tst := newIfsTester(t)
+	defer tst.teardown()
+
+	tst.store.SetDecompressionFormats([]string{"xz"})
+	imageName := "example.com/gzipped"
+	ref, err := tst.store.PullImage(context.Background(), imageName, tst.translateImageName)
+	if err != nil {
+		t.Fatalf("PullImage(): %v", err)
+	}
+	path, _, err := tst.store.GetImagePathAndVirtualSize(ref)
+	if err != nil {
+		t.Fatalf("GetImagePathAndVirtualSize(): %v", err)
+	}
+	tst.verifyFileContents(path, string(compressData(t, "gzip", []byte("###"+imageName))))
+}
+
+func TestParseDecompressionFormats(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected []string
+		err      bool
+	}{
+		{value: "", expected: []string{"gzip", "xz", "zstd"}},
+		{value: "none"},
+		{value: "zstd, gzip", expected: []string{"zstd", "gzip"}},
+		{value: "gzip,bzip2", err: true},
+	} {
+		formats, err := ParseDecompressionFormats(tc.value)
+		switch {
+		case tc.err && err == nil:
+			t.Errorf("ParseDecompressionFormats(%q) didn't return an error", tc.value)
+		case !tc.err && err != nil:
+			t.Errorf("ParseDecompressionFormats(%q): %v", tc.value, err)
+		case !reflect.DeepEqual(formats, tc.expected):
+			t.Errorf("ParseDecompressionFormats(%q): %v instead of %v", tc.value, formats, tc.expected)
+		}
+	}
+}
+
+func TestGetImagePathOfMissingImage(t *testing.T) {
+	tst := newIfsTester(t)
+	defer tst.teardown()
+
+	tst.pullImage(tst.images[0].Name, tst.refs[0])
+	for _, ref := range []string{
+		"example.com/nosuchimage",
+		"sha256:" + sha256str("nosuchimage"),
+	} {
+		_, _, err := tst.store.GetImagePathAndVirtualSize(ref)
+		if !IsPermanentError(err) {
+			t.Errorf("GetImagePathAndVirtualSize(%q) didn't return a permanent error: %v", ref, err)
+		}
+	}
+}
+
+func TestImportImage(t *testing.T) {
+	tst := newIfsTester(t)
+	defer tst.teardown()
+
+	srcPath := tst.subpath("exported.qcow2")
+	if err := ioutil.WriteFile(srcPath, []byte("overlay"), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	tst.store.SetConvertFunc(func(src, dst string) error {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		// "flatten" the image
+		return ioutil.WriteFile(dst, append([]byte("###base+"), data...), 0644)
+	})
+	ref, err := tst.store.ImportImage("example.com/exported:latest", srcPath)
+	if err != nil {
+		t.Fatalf("ImportImage(): %v", err)
+	}
+	sha256 := sha256str("###base+overlay")
+	expectedImage := &Image{
+		Digest:      "sha256:" + sha256,
+		Name:        "example.com/exported",
+		Path:        tst.subpath("data/" + sha256),
+		Size:        15,
+		VirtualSize: 1015,
+	}
+	if expectedRef := expectedImage.Name + "@" + expectedImage.Digest; ref != expectedRef {
+		t.Errorf("bad image ref returned: %q instead of %q", ref, expectedRef)
+	}
+	tst.verifyListImages("", expectedImage)
+	tst.verifyImage(ref, "###base+overlay")
+	tst.verifyDataFiles(sha256)
+
+	tst.store.SetConvertFunc(func(src, dst string) error {
+		return errors.New("qemu-img failed")
+	})
+	if _, err := tst.store.ImportImage("example.com/broken", srcPath); err == nil {
+		t.Errorf("ImportImage() didn't fail")
+	}
+	// the temporary file must be removed
+	tst.verifyDataFiles(sha256)
+	tst.verifyListImages("", expectedImage)
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	imageStatsLabels = []string{"image", "digest"}
+	imageSizeDesc    = prometheus.NewDesc(
+		"virtlet_image_size_bytes",
+		"Actual size of the image data file",
+		imageStatsLabels, nil)
+	imageVirtualSizeDesc = prometheus.NewDesc(
+		"virtlet_image_virtual_size_bytes",
+		"Virtual size of the image",
+		imageStatsLabels, nil)
+	imageInUseDesc = prometheus.NewDesc(
+		"virtlet_image_in_use",
+		"1 if the image is used by some of the containers and can't be removed by GC, 0 otherwise",
+		imageStatsLabels, nil)
+)
+
+// imageStatsCollector exposes the sizes and the in-use state
+// of the images in the store as Prometheus gauges
+type imageStatsCollector struct {
+	store Store
+}
+
+var _ prometheus.Collector = &imageStatsCollector{}
+
+// NewImageStatsCollector returns Prometheus collector that exposes
+// the actual and virtual sizes of the images in the store and
+// whether they're used by the containers. The gauges are labeled
+// by the image name and digest and are updated upon each scrape.
+func NewImageStatsCollector(store Store) prometheus.Collector {
+	return &imageStatsCollector{store: store}
+}
+
+// Describe implements Describe method of prometheus.Collector interface
+func (c *imageStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- imageSizeDesc
+	ch <- imageVirtualSizeDesc
+	ch <- imageInUseDesc
+}
+
+// Collect implements Collect method of prometheus.Collector interface
+func (c *imageStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	images, err := c.store.ListImages("")
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(imageSizeDesc, fmt.Errorf("error listing images: %v", err))
+		return
+	}
+	for _, img := range images {
+		inUse := 0.
+		if img.InUse {
+			inUse = 1
+		}
+		for _, item := range []struct {
+			desc  *prometheus.Desc
+			value float64
+		}{
+			{imageSizeDesc, float64(img.Size)},
+			{imageVirtualSizeDesc, float64(img.VirtualSize)},
+			{imageInUseDesc, inUse},
+		} {
+			ch <- prometheus.MustNewConstMetric(item.desc, prometheus.GaugeValue, item.value, img.Name, img.Digest)
+		}
+	}
+}
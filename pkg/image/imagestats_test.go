@@ -0,0 +1,71 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatherImageStats returns the values of the image gauges
+// mapped by "metric image"
+func gatherImageStats(t *testing.T, collector prometheus.Collector) map[string]float64 {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather(): %v", err)
+	}
+	r := make(map[string]float64)
+	for _, family := range families {
+		if family.GetType() != dto.MetricType_GAUGE {
+			t.Errorf("%s is not a gauge", family.GetName())
+		}
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			r[family.GetName()+" "+labels["image"]] = m.GetGauge().GetValue()
+		}
+	}
+	return r
+}
+
+func TestImageStatsCollector(t *testing.T) {
+	tst := newIfsTester(t)
+	defer tst.teardown()
+	tst.pullAllImages()
+	tst.referencedImages = []string{tst.refs[0]}
+
+	expected := make(map[string]float64)
+	for n, img := range tst.images {
+		expected["virtlet_image_size_bytes "+img.Name] = float64(img.Size)
+		expected["virtlet_image_virtual_size_bytes "+img.Name] = float64(img.VirtualSize)
+		inUse := 0.
+		if n == 0 {
+			inUse = 1
+		}
+		expected["virtlet_image_in_use "+img.Name] = inUse
+	}
+	if stats := gatherImageStats(t, NewImageStatsCollector(tst.store)); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("bad image stats: %#v instead of %#v", stats, expected)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/distribution/reference"
+	"github.com/golang/glog"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ConvertFunc specifies a function that converts the QCOW2 image
+// file at srcPath, including its backing chain, into a standalone
+// QCOW2 image file at dstPath.
+type ConvertFunc func(srcPath, dstPath string) error
+
+// Importer is implemented by the stores that can register local
+// image files produced by Virtlet itself, e.g. the exported disks
+// of the VMs
+type Importer interface {
+	// ImportImage converts the specified QCOW2 image file into
+	// a standalone image and stores it under the specified name.
+	// It returns the reference to the new image that includes its
+	// digest.
+	ImportImage(name, srcPath string) (string, error)
+}
+
+var _ Importer = &FileStore{}
+
+// ConvertImage converts the specified QCOW2 image file flattening
+// its backing chain. It can be passed to SetConvertFunc.
+func ConvertImage(srcPath, dstPath string) error {
+	q, _ := NewQemuImg(CommandPriority{})
+	return q.Convert(srcPath, dstPath)
+}
+
+// SetConvertFunc sets the function that's used to convert the
+// imported image files
+func (s *FileStore) SetConvertFunc(convertFunc ConvertFunc) {
+	s.convertFunc = convertFunc
+}
+
+// ImportImage implements ImportImage method of Importer interface.
+// The converted image data is placed into the data directory of the
+// store just like the data of the pulled images, so the image can
+// be used by the pods, listed and removed as usual. If there's an
+// image with the same name, it's replaced.
+func (s *FileStore) ImportImage(name, srcPath string) (string, error) {
+	name = StripTags(name)
+	named, err := reference.WithName(name)
+	if err != nil {
+		return "", fmt.Errorf("bad image name %q: %v", name, err)
+	}
+	if err := os.MkdirAll(s.dataDir(), 0777); err != nil {
+		return "", fmt.Errorf("mkdir %q: %v", s.dataDir(), err)
+	}
+	tempFile, err := ioutil.TempFile(s.dataDir(), "part_")
+	if err != nil {
+		return "", fmt.Errorf("failed to create a temporary file: %v", err)
+	}
+	tempPath := tempFile.Name()
+	tempFile.Close()
+	removeTempFile := func() {
+		if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("Error removing %q: %v", tempPath, err)
+		}
+	}
+
+	if err := s.convertFunc(srcPath, tempPath); err != nil {
+		removeTempFile()
+		return "", fmt.Errorf("error converting %q into image %q: %v", srcPath, name, err)
+	}
+
+	f, err := os.Open(tempPath)
+	if err != nil {
+		removeTempFile()
+		return "", err
+	}
+	d, err := digest.FromReader(f)
+	f.Close()
+	if err != nil {
+		removeTempFile()
+		return "", fmt.Errorf("can't get the digest for %q: %v", tempPath, err)
+	}
+
+	if err := s.placeImage(tempPath, d.Hex(), name); err != nil {
+		return "", err
+	}
+	withDigest, err := reference.WithDigest(named, d)
+	if err != nil {
+		return "", err
+	}
+	return withDigest.String(), nil
+}
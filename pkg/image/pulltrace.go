@@ -0,0 +1,140 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PullPhase denotes a phase of the image pull
+type PullPhase string
+
+const (
+	// PullPhaseResolve is the translation of the image name
+	// to the endpoint
+	PullPhaseResolve PullPhase = "resolve"
+	// PullPhaseDownload is the download of the image data
+	PullPhaseDownload PullPhase = "download"
+	// PullPhaseConvert is the decompression of the compressed
+	// image data. As it's done while the image is downloaded,
+	// its span overlaps the download one and only includes
+	// the time spent decompressing and writing the data
+	PullPhaseConvert PullPhase = "convert"
+	// PullPhaseVerify is the calculation of the digest of the
+	// downloaded image data
+	PullPhaseVerify PullPhase = "verify"
+	// PullPhaseRegister is placing the image data into the
+	// store and linking the image name to it
+	PullPhaseRegister PullPhase = "register"
+)
+
+// PullSpan contains the timing of a single image pull phase
+type PullSpan struct {
+	// Phase is the phase of the image pull
+	Phase PullPhase
+	// Ref is the name of the image being pulled
+	Ref string
+	// Digest is the digest of the image. It's empty if
+	// the pull has failed before the digest became known
+	Digest string
+	// Start is the time when the phase has started
+	Start time.Time
+	// Duration is the duration of the phase
+	Duration time.Duration
+}
+
+// PullObserver is a function that receives the spans of the
+// image pulls. It can be used e.g. to export them as tracing spans.
+type PullObserver func(span PullSpan)
+
+var pullPhaseDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "virtlet",
+		Subsystem: "image",
+		Name:      "pull_phase_duration_seconds",
+		Help:      "Duration of the image pull phases in seconds",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	},
+	[]string{"phase"},
+)
+
+func init() {
+	prometheus.MustRegister(pullPhaseDuration)
+}
+
+// pullTrace records the timings of image pull phases
+type pullTrace struct {
+	ref   string
+	spans []PullSpan
+	// open is true while the last span is not ended
+	open bool
+}
+
+func newPullTrace(ref string) *pullTrace {
+	return &pullTrace{ref: ref}
+}
+
+// begin ends the current phase, if any, and starts the specified one
+func (t *pullTrace) begin(phase PullPhase) {
+	now := time.Now()
+	t.endCurrent(now)
+	t.spans = append(t.spans, PullSpan{
+		Phase: phase,
+		Ref:   t.ref,
+		Start: now,
+	})
+	t.open = true
+}
+
+// add ends the current phase, if any, and records the phase
+// that was timed separately
+func (t *pullTrace) add(phase PullPhase, start time.Time, duration time.Duration) {
+	t.endCurrent(time.Now())
+	t.spans = append(t.spans, PullSpan{
+		Phase:    phase,
+		Ref:      t.ref,
+		Start:    start,
+		Duration: duration,
+	})
+}
+
+func (t *pullTrace) endCurrent(now time.Time) {
+	if !t.open {
+		return
+	}
+	last := &t.spans[len(t.spans)-1]
+	last.Duration = now.Sub(last.Start)
+	t.open = false
+}
+
+// finish ends the current phase and reports the spans, setting
+// their digest to the specified value
+func (t *pullTrace) finish(digest string, observer PullObserver) {
+	t.endCurrent(time.Now())
+	for _, span := range t.spans {
+		span.Digest = digest
+		glog.V(1).Infof("Image pull phase %s: ref %q, digest %q, took %v", span.Phase, span.Ref, span.Digest, span.Duration)
+		pullPhaseDuration.WithLabelValues(string(span.Phase)).Observe(span.Duration.Seconds())
+		if observer != nil {
+			observer(span)
+		}
+	}
+	t.spans = nil
+}
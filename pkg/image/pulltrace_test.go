@@ -0,0 +1,138 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func pullPhaseSampleCount(t *testing.T, phase PullPhase) uint64 {
+	h, err := pullPhaseDuration.GetMetricWithLabelValues(string(phase))
+	if err != nil {
+		t.Fatalf("GetMetricWithLabelValues(): %v", err)
+	}
+	var m dto.Metric
+	if err := h.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestPullImagePhaseTimings(t *testing.T) {
+	tst := newIfsTester(t)
+	defer tst.teardown()
+
+	allPhases := []PullPhase{PullPhaseResolve, PullPhaseDownload, PullPhaseVerify, PullPhaseRegister}
+	oldCounts := make(map[PullPhase]uint64)
+	for _, phase := range allPhases {
+		oldCounts[phase] = pullPhaseSampleCount(t, phase)
+	}
+
+	var spans []PullSpan
+	tst.store.SetPullObserver(func(span PullSpan) {
+		spans = append(spans, span)
+	})
+	tst.pullImage(tst.images[2].Name, tst.refs[2])
+
+	var phases []PullPhase
+	for _, span := range spans {
+		phases = append(phases, span.Phase)
+		if span.Ref != tst.images[2].Name {
+			t.Errorf("bad ref for phase %s: %q instead of %q", span.Phase, span.Ref, tst.images[2].Name)
+		}
+		if span.Digest != tst.images[2].Digest {
+			t.Errorf("bad digest for phase %s: %q instead of %q", span.Phase, span.Digest, tst.images[2].Digest)
+		}
+		if span.Start.IsZero() || span.Duration < 0 {
+			t.Errorf("bad timing for phase %s:\n%s", span.Phase, spew.Sdump(span))
+		}
+	}
+	if !reflect.DeepEqual(phases, allPhases) {
+		t.Errorf("bad pull phases: %v instead of %v", phases, allPhases)
+	}
+
+	for _, phase := range allPhases {
+		if n := pullPhaseSampleCount(t, phase); n != oldCounts[phase]+1 {
+			t.Errorf("bad sample count for phase %s: %d instead of %d", phase, n, oldCounts[phase]+1)
+		}
+	}
+}
+
+func TestPullCompressedImagePhaseTimings(t *testing.T) {
+	tst := newIfsTester(t)
+	defer tst.teardown()
+
+	oldCount := pullPhaseSampleCount(t, PullPhaseConvert)
+	var spans []PullSpan
+	tst.store.SetPullObserver(func(span PullSpan) {
+		spans = append(spans, span)
+	})
+	if _, err := tst.store.PullImage(context.Background(), "example.com/gzipped", tst.translateImageName); err != nil {
+		t.Fatalf("PullImage(): %v", err)
+	}
+
+	var phases []PullPhase
+	for _, span := range spans {
+		phases = append(phases, span.Phase)
+		if span.Start.IsZero() || span.Duration < 0 {
+			t.Errorf("bad timing for phase %s:\n%s", span.Phase, spew.Sdump(span))
+		}
+	}
+	expectedPhases := []PullPhase{PullPhaseResolve, PullPhaseDownload, PullPhaseConvert, PullPhaseVerify, PullPhaseRegister}
+	if !reflect.DeepEqual(phases, expectedPhases) {
+		t.Errorf("bad pull phases: %v instead of %v", phases, expectedPhases)
+	}
+	if n := pullPhaseSampleCount(t, PullPhaseConvert); n != oldCount+1 {
+		t.Errorf("bad sample count for phase %s: %d instead of %d", PullPhaseConvert, n, oldCount+1)
+	}
+}
+
+func TestFailedPullImagePhaseTimings(t *testing.T) {
+	tst := newIfsTester(t)
+	defer tst.teardown()
+
+	var spans []PullSpan
+	tst.store.SetPullObserver(func(span PullSpan) {
+		spans = append(spans, span)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-tst.downloader.started
+		cancel()
+	}()
+	if _, err := tst.store.PullImage(ctx, "cancelme", tst.translateImageName); err == nil {
+		t.Fatalf("PullImage() didn't fail")
+	}
+
+	var phases []PullPhase
+	for _, span := range spans {
+		phases = append(phases, span.Phase)
+		if span.Digest != "" {
+			t.Errorf("unexpected digest for phase %s: %q", span.Phase, span.Digest)
+		}
+	}
+	expectedPhases := []PullPhase{PullPhaseResolve, PullPhaseDownload}
+	if !reflect.DeepEqual(phases, expectedPhases) {
+		t.Errorf("bad pull phases: %v instead of %v", phases, expectedPhases)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+const (
+	// IOClassBestEffort denotes best-effort I/O scheduling class
+	IOClassBestEffort = "best-effort"
+	// IOClassIdle denotes idle I/O scheduling class, which makes
+	// the process only get disk time when no other process needs it
+	IOClassIdle = "idle"
+
+	maxNice    = 19
+	maxIOLevel = 7
+)
+
+// CommandPriority specifies the CPU and I/O scheduling priority
+// for the external commands
+type CommandPriority struct {
+	// Nice is the niceness of the command, from 0 to 19.
+	// Zero value means that the CPU priority is not changed.
+	Nice int
+	// IOClass is the I/O scheduling class of the command, either
+	// IOClassBestEffort or IOClassIdle. Empty value means that
+	// the I/O priority is not changed.
+	IOClass string
+	// IOLevel is the I/O priority within best-effort class, from
+	// 0 (highest) to 7 (lowest). It's ignored for idle class.
+	IOLevel int
+}
+
+func (p CommandPriority) validate() error {
+	if p.Nice < 0 || p.Nice > maxNice {
+		return fmt.Errorf("bad nice value %d. Must be between 0 and %d", p.Nice, maxNice)
+	}
+	switch p.IOClass {
+	case "", IOClassIdle:
+	case IOClassBestEffort:
+		if p.IOLevel < 0 || p.IOLevel > maxIOLevel {
+			return fmt.Errorf("bad I/O priority level %d. Must be between 0 and %d", p.IOLevel, maxIOLevel)
+		}
+	default:
+		return fmt.Errorf("bad I/O scheduling class %q. Must be either %q or %q", p.IOClass, IOClassBestEffort, IOClassIdle)
+	}
+	return nil
+}
+
+// wrap prepends nice and ionice commands to the command line as
+// necessary and returns the resulting command and its arguments
+func (p CommandPriority) wrap(command string, args []string) (string, []string) {
+	cmdLine := append([]string{command}, args...)
+	switch p.IOClass {
+	case IOClassBestEffort:
+		cmdLine = append([]string{"ionice", "-c", "2", "-n", strconv.Itoa(p.IOLevel)}, cmdLine...)
+	case IOClassIdle:
+		cmdLine = append([]string{"ionice", "-c", "3"}, cmdLine...)
+	}
+	if p.Nice != 0 {
+		cmdLine = append([]string{"nice", "-n", strconv.Itoa(p.Nice)}, cmdLine...)
+	}
+	return cmdLine[0], cmdLine[1:]
+}
+
+// QemuImg runs qemu-img commands with the specified priority
+type QemuImg struct {
+	priority    CommandPriority
+	execCommand func(name string, arg ...string) *exec.Cmd
+}
+
+// NewQemuImg returns a new QemuImg that runs qemu-img with the
+// specified CPU and I/O priority
+func NewQemuImg(priority CommandPriority) (*QemuImg, error) {
+	if err := priority.validate(); err != nil {
+		return nil, err
+	}
+	return &QemuImg{priority: priority, execCommand: exec.Command}, nil
+}
+
+// run runs qemu-img with the specified arguments and returns
+// its standard output
+func (q *QemuImg) run(args ...string) ([]byte, error) {
+	command, args := q.priority.wrap("qemu-img", args)
+	out, err := q.execCommand(command, args...).Output()
+	if err == nil {
+		return out, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return nil, fmt.Errorf("qemu-img failed: %v\noutput:\n%s", err, exitErr.Stderr)
+	}
+	return nil, fmt.Errorf("qemu-img failed: %v", err)
+}
+
+// VirtualSize returns the virtual size of the specified QCOW2 image.
+// It can be passed to NewFileStore as VirtualSizeFunc.
+func (q *QemuImg) VirtualSize(imagePath string) (uint64, error) {
+	out, err := q.run("info", "--output", "json", imagePath)
+	if err != nil {
+		return 0, err
+	}
+	return extractImageSizeFromInfo(out)
+}
+
+// Convert converts the specified QCOW2 image into a standalone QCOW2
+// image that doesn't depend on any backing files
+func (q *QemuImg) Convert(srcPath, dstPath string) error {
+	_, err := q.run("convert", "-O", "qcow2", srcPath, dstPath)
+	return err
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestQemuImgPriority(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		priority        CommandPriority
+		expectedCmdLine []string
+		invalid         bool
+	}{
+		{
+			name:            "default priority",
+			expectedCmdLine: []string{"qemu-img", "info", "--output", "json", "/images/foo"},
+		},
+		{
+			name:            "nice",
+			priority:        CommandPriority{Nice: 10},
+			expectedCmdLine: []string{"nice", "-n", "10", "qemu-img", "info", "--output", "json", "/images/foo"},
+		},
+		{
+			name:            "idle I/O class",
+			priority:        CommandPriority{IOClass: IOClassIdle},
+			expectedCmdLine: []string{"ionice", "-c", "3", "qemu-img", "info", "--output", "json", "/images/foo"},
+		},
+		{
+			name:     "nice and best-effort I/O class",
+			priority: CommandPriority{Nice: 19, IOClass: IOClassBestEffort, IOLevel: 7},
+			expectedCmdLine: []string{
+				"nice", "-n", "19", "ionice", "-c", "2", "-n", "7",
+				"qemu-img", "info", "--output", "json", "/images/foo",
+			},
+		},
+		{
+			name:     "negative nice",
+			priority: CommandPriority{Nice: -5},
+			invalid:  true,
+		},
+		{
+			name:     "nice too big",
+			priority: CommandPriority{Nice: 20},
+			invalid:  true,
+		},
+		{
+			name:     "bad I/O class",
+			priority: CommandPriority{IOClass: "realtime"},
+			invalid:  true,
+		},
+		{
+			name:     "bad I/O level",
+			priority: CommandPriority{IOClass: IOClassBestEffort, IOLevel: 8},
+			invalid:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q, err := NewQemuImg(tc.priority)
+			switch {
+			case tc.invalid && err == nil:
+				t.Fatalf("NewQemuImg() didn't fail for an invalid priority")
+			case tc.invalid:
+				return
+			case err != nil:
+				t.Fatalf("NewQemuImg(): %v", err)
+			}
+
+			var cmdLine []string
+			q.execCommand = func(name string, arg ...string) *exec.Cmd {
+				cmdLine = append([]string{name}, arg...)
+				return exec.Command("echo", `{"virtual-size": 10485760}`)
+			}
+			size, err := q.VirtualSize("/images/foo")
+			if err != nil {
+				t.Fatalf("VirtualSize(): %v", err)
+			}
+			if size != expectedImageSize {
+				t.Errorf("bad image size: %d instead of %d", size, expectedImageSize)
+			}
+			if !reflect.DeepEqual(cmdLine, tc.expectedCmdLine) {
+				t.Errorf("bad command line: %#v instead of %#v", cmdLine, tc.expectedCmdLine)
+			}
+		})
+	}
+}
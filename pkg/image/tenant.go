@@ -0,0 +1,122 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/golang/glog"
+)
+
+// tenantKeyRx matches valid tenant keys. The keys are used as
+// directory names, so they're restricted to DNS labels, just like
+// the namespace names they're derived from.
+var tenantKeyRx = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// TenantStore is implemented by the stores that can keep separate
+// image caches for different tenants
+type TenantStore interface {
+	// ForTenant returns the store that holds the images of the
+	// specified tenant. An empty tenant key denotes the shared
+	// store that's not bound to any tenant.
+	ForTenant(tenant string) (Store, error)
+}
+
+var _ TenantStore = &FileStore{}
+
+func (s *FileStore) tenantDir() string {
+	return filepath.Join(s.dir, "tenants")
+}
+
+// ForTenant implements ForTenant method of TenantStore interface.
+// The images of each tenant are kept in a separate FileStore under
+// tenants/ subdirectory of the store directory, so the image data
+// is never shared between the tenants and the images of one tenant
+// aren't visible to the others. The tenant stores inherit the
+// settings of the parent store.
+func (s *FileStore) ForTenant(tenant string) (Store, error) {
+	if tenant == "" {
+		return s, nil
+	}
+	if s.tenants == nil {
+		return nil, fmt.Errorf("can't get a store for tenant %q from a tenant store", tenant)
+	}
+	if !tenantKeyRx.MatchString(tenant) {
+		return nil, fmt.Errorf("bad image tenant key %q", tenant)
+	}
+	s.tenantLock.Lock()
+	defer s.tenantLock.Unlock()
+	if ts, found := s.tenants[tenant]; found {
+		return ts, nil
+	}
+	ts := &FileStore{
+		dir:                  filepath.Join(s.tenantDir(), tenant),
+		downloader:           s.downloader,
+		vsizeFunc:            s.vsizeFunc,
+		convertFunc:          s.convertFunc,
+		refGetter:            s.refGetter,
+		observer:             s.observer,
+		vsizes:               make(map[string]uint64),
+		decompressionFormats: s.decompressionFormats,
+	}
+	s.tenants[tenant] = ts
+	return ts, nil
+}
+
+// listTenants returns the keys of the tenants that have image
+// directories in the store
+func (s *FileStore) listTenants() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.tenantDir())
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("readdir %q: %v", s.tenantDir(), err)
+	}
+	var r []string
+	for _, fi := range infos {
+		if !fi.IsDir() || !tenantKeyRx.MatchString(fi.Name()) {
+			glog.Warningf("skipping unexpected item %q in the tenant image directory %q", fi.Name(), s.tenantDir())
+			continue
+		}
+		r = append(r, fi.Name())
+	}
+	return r, nil
+}
+
+// gcTenants performs GC in the stores of all the tenants that
+// have image directories in the store
+func (s *FileStore) gcTenants() error {
+	tenants, err := s.listTenants()
+	if err != nil {
+		return err
+	}
+	for _, tenant := range tenants {
+		ts, err := s.ForTenant(tenant)
+		if err != nil {
+			return err
+		}
+		if err := ts.GC(); err != nil {
+			return fmt.Errorf("GC for tenant %q: %v", tenant, err)
+		}
+	}
+	return nil
+}
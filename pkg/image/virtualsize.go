@@ -34,13 +34,6 @@ func extractImageSizeFromInfo(out []byte) (uint64, error) {
 
 // GetImageVirtualSize returns the virtual size of the specified QCOW2 image
 func GetImageVirtualSize(imagePath string) (uint64, error) {
-	cmd := exec.Command("qemu-img", "info", "--output", "json", imagePath)
-	out, err := cmd.Output()
-	if err == nil {
-		return extractImageSizeFromInfo(out)
-	}
-	if exitErr, ok := err.(*exec.ExitError); ok {
-		return 0, fmt.Errorf("qemu-img failed: %v\noutput:\n%s", err, exitErr.Stderr)
-	}
-	return 0, fmt.Errorf("qemu-img failed: %v", err)
+	q := &QemuImg{execCommand: exec.Command}
+	return q.VirtualSize(imagePath)
 }
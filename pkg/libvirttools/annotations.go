@@ -18,24 +18,37 @@ package libvirttools
 
 import (
 	"fmt"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 
 	// use this instead of "gopkg.in/yaml.v2" so we don't get
 	// map[interface{}]interface{} when unmarshalling cloud-init data
 	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/api/resource"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 
+	"github.com/Mirantis/virtlet/pkg/network"
 	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/virt"
 )
 
 type diskDriverName string
 
 type imageType string
 
+type seedMechanism string
+
+type ipConfigPolicy string
+
+type guestTimeSync string
+
 const (
 	maxVCPUCount                                     = 255
+	maxPCIeRootPorts                                 = 32
+	defaultPCIeRootPorts                             = 4
 	vcpuCountAnnotationKeyName                       = "VirtletVCPUCount"
 	cloudInitMetaDataKeyName                         = "VirtletCloudInitMetaData"
 	cloudInitUserDataKeyName                         = "VirtletCloudInitUserData"
@@ -43,13 +56,68 @@ const (
 	cloudInitUserDataOverwriteKeyName                = "VirtletCloudInitUserDataOverwrite"
 	cloudInitUserDataScriptKeyName                   = "VirtletCloudInitUserDataScript"
 	cloudInitImageType                               = "VirtletCloudInitImageType"
+	cloudInitImageLabelKeyName                       = "VirtletCloudInitImageLabel"
+	cloudInitDualLayoutKeyName                       = "VirtletCloudInitDualLayout"
+	seedMechanismKeyName                             = "VirtletSeedMechanism"
+	restartPolicyKeyName                             = "VirtletRestartPolicy"
+	cpuFeaturesKeyName                               = "VirtletCPUFeatures"
 	sshKeysKeyName                                   = "VirtletSSHKeys"
 	sshKeySourceKeyName                              = "VirtletSSHKeySource"
 	diskDriverKeyName                                = "VirtletDiskDriver"
+	panicDeviceKeyName                               = "VirtletPanicDevice"
+	userKeyName                                      = "VirtletUser"
+	userPasswordKeyName                              = "VirtletUserPassword"
+	preserveVolumesKeyName                           = "VirtletPreserveVolumesOnDelete"
+	wipeOnDeleteKeyName                              = "VirtletWipeOnDelete"
+	restoreFromKeyName                               = "VirtletRestoreFrom"
+	autostartKeyName                                 = "VirtletAutostart"
+	emulatorPinKeyName                               = "VirtletEmulatorPin"
+	isolateEmulatorKeyName                           = "VirtletIsolateEmulator"
+	seedFromKeyName                                  = "VirtletSeedFrom"
+	shutdownModeKeyName                              = "VirtletShutdownMode"
+	ipConfigPolicyKeyName                            = "VirtletIPConfigPolicy"
+	powerStateKeyName                                = "VirtletPowerState"
+	domainTypeKeyName                                = "VirtletDomainType"
+	metadataAnnotationsKeyName                       = "VirtletDomainMetadataAnnotations"
+	rootVolumeQueuesKeyName                          = "VirtletRootVolumeQueues"
+	rootVolumeQueueSizeKeyName                       = "VirtletRootVolumeQueueSize"
+	nicOffloadsKeyName                               = "VirtletNICOffloads"
+	guestAgentKeyName                                = "VirtletGuestAgent"
+	guestTimeSyncKeyName                             = "VirtletGuestTimeSync"
+	nvdimmKeyName                                    = "VirtletNVDIMM"
+	optionalDevicesKeyName                           = "VirtletOptionalDevices"
+	numaNodeKeyName                                  = "VirtletNUMANode"
+	rootVolumeCopyOnReadKeyName                      = "VirtletRootVolumeCopyOnRead"
+	sshHostKeySourceKeyName                          = "VirtletSSHHostKeySource"
+	forceConfigISOKeyName                            = "VirtletForceConfigISO"
+	pcieRootPortsKeyName                             = "VirtletPCIeRootPorts"
+	pcieHotplugKeyName                               = "VirtletPCIeHotplug"
+	interfaceSourceKeyName                           = "VirtletInterfaceSource"
+	memoryRequestKeyName                             = "VirtletMemoryRequest"
+	caCertsKeyName                                   = "VirtletCACerts"
+	caCertsSourceKeyName                             = "VirtletCACertsSource"
+	caCertsRemoveDefaultsKeyName                     = "VirtletCACertsRemoveDefaults"
+	primaryInterfaceKeyName                          = "VirtletPrimaryInterface"
+	consoleLogMaxSizeKeyName                         = "VirtletConsoleLogMaxSize"
+	consoleLogMaxFilesKeyName                        = "VirtletConsoleLogMaxFiles"
+	rtSchedulerKeyName                               = "VirtletRTScheduler"
+	growpartDevicesKeyName                           = "VirtletGrowpartDevices"
+	scratchDiskSizeKeyName                           = "VirtletScratchDiskSize"
+	scratchDiskMountPointKeyName                     = "VirtletScratchDiskMountPoint"
+	gpuDevicesKeyName                                = "VirtletGPUDevices"
 	diskDriverVirtio                  diskDriverName = "virtio"
 	diskDriverScsi                    diskDriverName = "scsi"
 	imageTypeNoCloud                  imageType      = "nocloud"
 	imageTypeConfigDrive              imageType      = "configdrive"
+	seedMechanismISO                  seedMechanism  = "iso"
+	seedMechanismFwCfg                seedMechanism  = "fw_cfg"
+	seedMechanismSMBIOS               seedMechanism  = "smbios"
+	ipConfigStatic                    ipConfigPolicy = "static"
+	ipConfigDHCP                      ipConfigPolicy = "dhcp"
+	ipConfigStaticWithFallback        ipConfigPolicy = "static-with-fallback"
+	guestTimeSyncNone                 guestTimeSync  = "none"
+	guestTimeSyncAgent                guestTimeSync  = "agent"
+	guestTimeSyncHypervClock          guestTimeSync  = "hypervclock"
 )
 
 // VirtletAnnotations contains parsed values for pod annotations supported
@@ -63,8 +131,196 @@ type VirtletAnnotations struct {
 	UserDataScript    string
 	SSHKeys           []string
 	DiskDriver        diskDriverName
+	// DisablePanicDevice disables the panic device which is used
+	// to detect guest kernel panics
+	DisablePanicDevice bool
+	// User is the name of the user to create in the VM
+	User string
+	// UserPassword is crypt(3) hash of the password for the User.
+	// Plaintext passwords are not accepted.
+	UserPassword string
+	// PreserveVolumesOnDelete makes Virtlet keep the volumes of
+	// the VM upon container removal, renaming them instead
+	PreserveVolumesOnDelete bool
+	// WipeOnDelete is the algorithm used to wipe the volumes of the
+	// VM in the storage pool before they're deleted upon container
+	// removal. Empty value means the volumes aren't wiped.
+	WipeOnDelete virt.WipeAlgorithm
+	// RestoreFrom is the name of the saved state image the VM is
+	// restored from upon its first start instead of booting.
+	// Empty value means booting the VM.
+	RestoreFrom string
+	// PowerState contains cloud-init power_state settings which
+	// can be used to reboot or power off the VM after provisioning
+	PowerState map[string]interface{}
+	// DomainType is the libvirt domain type to use ("kvm" or
+	// "qemu"). Empty value means using the node-wide setting.
+	DomainType string
+	// MetadataAnnotations lists the pod annotations to include
+	// in the domain metadata besides the pod labels
+	MetadataAnnotations []string
+	// RootVolumeQueues is the number of virtio queues of the root
+	// disk. Zero value means using the hypervisor default.
+	RootVolumeQueues uint
+	// RootVolumeQueueSize is the size of the virtio queues of the
+	// root disk. Zero value means using the hypervisor default.
+	RootVolumeQueueSize uint
+	// NICOffloads contains the settings of the offload features
+	// of the virtio NICs. The features that aren't listed keep
+	// the hypervisor defaults.
+	NICOffloads []network.NICOffloadSetting
+	// EnableGuestAgent adds the qemu guest agent channel to the
+	// VM, so the agent can be used for graceful shutdown
+	EnableGuestAgent bool
+	// GuestTimeSync specifies how the guest clock is resynchronized
+	// after the VM is restored from a saved state: by means of
+	// guest-set-time command of the guest agent or by relying on
+	// Hyper-V reference clock exposed to the guest. Empty value
+	// means no resync.
+	GuestTimeSync guestTimeSync
+	// NVDIMM specifies the emulated NVDIMM (persistent memory)
+	// device of the VM. Nil value means no NVDIMM device.
+	NVDIMM *NVDIMMConfig
+	// OptionalDevices lists the optional devices to add to the VM
+	// if the node uses the minimal device profile
+	OptionalDevices []string
+	// NUMANode specifies the host NUMA node to bind the VM's
+	// vCPUs and memory to. Nil value means no binding.
+	NUMANode *int
+	// RootVolumeCopyOnRead makes the hypervisor copy the blocks
+	// read from the backing file (the VM image) into the root
+	// volume, reducing the reads of the backing file that's
+	// shared between the VMs
+	RootVolumeCopyOnRead bool
+	// SSHHostKeys contains the pre-generated SSH host keys of the
+	// VM keyed by cloud-init ssh_keys names, e.g. rsa_private and
+	// rsa_public. The keys are loaded from the secret specified
+	// using VirtletSSHHostKeySource annotation. The private keys
+	// must never be logged.
+	SSHHostKeys map[string]string
+	// ForceConfigISO makes Virtlet attach the cloud-init config
+	// ISO to the VM even if it has nothing to configure
+	ForceConfigISO bool
+	// PCIeRootPorts specifies the number of PCIe root ports to
+	// add to the VM so the devices can be hotplugged into them.
+	// Non-zero value makes the VM use q35 machine type.
+	PCIeRootPorts int
+	// PCIeHotplug makes the VM ready for hotplugging the PCIe
+	// devices. Unless PCIeRootPorts is set explicitly, it's
+	// set to defaultPCIeRootPorts.
+	PCIeHotplug bool
+	// InterfaceSource specifies an additional network interface
+	// of the VM that's connected to a host bridge, a host interface
+	// or a libvirt network. Nil value means no such interface.
+	InterfaceSource *InterfaceSourceConfig
+	// CACerts contains PEM encoded CA certificates which the VM
+	// should trust. They're passed to cloud-init via ca_certs.
+	CACerts []string
+	// CACertsRemoveDefaults makes cloud-init remove the default
+	// trusted CA certificates of the VM, so only CACerts are trusted
+	CACertsRemoveDefaults bool
+	// ImageLabel is the volume label of the config ISO. Empty
+	// value means the default label for the ImageType.
+	ImageLabel string
+	// DualConfigLayout makes Virtlet write both NoCloud and
+	// ConfigDrive files to the config ISO, so it can be used
+	// by the guests looking for either of them
+	DualConfigLayout bool
+	// RestartPolicy is the policy of restarting the VM after a
+	// crash ("Always", "OnFailure" or "Never"), which is expected
+	// to match the restartPolicy of the pod. Empty value means
+	// that the VM isn't restarted by Virtlet.
+	RestartPolicy string
+	// CPUFeatures lists the guest CPU features to enable or
+	// disable
+	CPUFeatures []CPUFeature
+	// SeedMechanism specifies how cloud-init data is passed to
+	// the VM: as a config ISO, as fw_cfg entries or as a config
+	// ISO together with the NoCloud seed in SMBIOS serial number.
+	// Empty value means the config ISO.
+	SeedMechanism seedMechanism
+	// Autostart makes libvirt start the VM automatically when
+	// libvirtd starts, e.g. after the node reboot, if the VM
+	// was running at the time
+	Autostart bool
+	// EmulatorPin is the list of the host CPUs in cpulist format,
+	// e.g. "0-1,4", to pin the emulator threads and the iothreads
+	// of the VM to. Empty value means no pinning.
+	EmulatorPin string
+	// IsolateEmulator requires EmulatorPin not to overlap the
+	// host CPUs the vCPUs of the VM are pinned to
+	IsolateEmulator bool
+	// RTScheduler specifies the real-time scheduling policy for
+	// the vCPU threads of the VM. nil means the default scheduling
+	// policy.
+	RTScheduler *RTSchedulerConfig
+	// GrowpartDevices lists the devices, partitions or mount points
+	// that cloud-init growpart module should grow, e.g. "/" and
+	// "/dev/vdb1". Empty list means the default of the image,
+	// which is growing the root partition only.
+	GrowpartDevices []string
+	// ScratchDiskSize is the size of the empty scratch disk of the
+	// VM in bytes. CRI doesn't pass the ephemeral storage limit,
+	// so it's specified using VirtletScratchDiskSize annotation.
+	// Zero value means no scratch disk.
+	ScratchDiskSize int64
+	// ScratchDiskMountPoint is the guest directory to mount the
+	// scratch disk on. Empty value means /mnt/scratch.
+	ScratchDiskMountPoint string
+	// GPUDevices lists the PCI addresses of the host GPUs to be
+	// passed through to the VM, e.g. "0000:01:00.0". The other
+	// devices of their IOMMU groups are passed through, too.
+	GPUDevices []string
+	// UserDataRaw contains MIME multipart or gzip-compressed
+	// user-data that's passed to the VM as is instead of the
+	// generated cloud-config
+	UserDataRaw []byte
+	// SeedFrom is the HTTP(S) URL the guest fetches its
+	// cloud-init user-data and meta-data from instead of the
+	// user-data embedded in the config image. It always ends
+	// with a slash.
+	SeedFrom string
+	// ShutdownModes lists the mechanisms StopContainer uses to shut
+	// down the VM gracefully in the order they're tried before the
+	// VM is destroyed. Empty list means using the guest agent, if
+	// any, and then ACPI shutdown.
+	ShutdownModes []ShutdownMode
+	// IPConfigPolicy specifies how the guest network interfaces are
+	// configured by cloud-init: using static addresses obtained from
+	// CNI, using DHCP or using static addresses with DHCP as the
+	// fallback. Empty value means static addresses.
+	IPConfigPolicy ipConfigPolicy
+	// PrimaryInterface is the name of the pod network interface
+	// in the CNI result, e.g. eth1, which becomes the first NIC
+	// of the VM and gets the default route. Empty value means
+	// keeping the CNI result order.
+	PrimaryInterface string
+	// ConsoleLogMaxSize is the size of the serial console log in
+	// bytes after which it's rotated. Nil value means using the
+	// node-wide setting, zero value disables the rotation.
+	ConsoleLogMaxSize *int64
+	// ConsoleLogMaxFiles is the number of the rotated console log
+	// files to keep. Nil value means using the node-wide setting,
+	// zero value means that the log is truncated instead.
+	ConsoleLogMaxFiles *int
 }
 
+var (
+	// sshHostKeyTypes lists the SSH host key types supported
+	// by cloud-init
+	sshHostKeyTypes = []string{"rsa", "dsa", "ecdsa", "ed25519"}
+
+	// ISO 9660 volume id
+	imageLabelRx = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+	userNameRx   = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+	// the name of a file under the saved images dir
+	savedImageNameRx = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+	// Linux network interface name
+	interfaceNameRx = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+	// SHA-512, SHA-256 or MD5 based crypt(3) hash, or bcrypt hash
+	passwordHashRx = regexp.MustCompile(`^(\$(1|5|6)\$(rounds=[0-9]+\$)?[./0-9A-Za-z]{1,16}\$[./0-9A-Za-z]{22,86}|\$2[aby]\$[0-9]{2}\$[./0-9A-Za-z]{53})$`)
+)
+
 // LoadAnnotations parses map of strings to VirtletAnnotations using provided
 // ns value.
 func LoadAnnotations(ns string, podAnnotations map[string]string) (*VirtletAnnotations, error) {
@@ -103,38 +359,216 @@ func (va *VirtletAnnotations) parsePodAnnotations(ns string, podAnnotations map[
 	}
 
 	if userDataStr, found := podAnnotations[cloudInitUserDataKeyName]; found {
-		var userData map[string]interface{}
-		if err := yaml.Unmarshal([]byte(userDataStr), &userData); err != nil {
-			return fmt.Errorf("failed to unmarshal cloud-init userdata")
-		}
-		if va.UserDataOverwrite {
-			va.UserData = userData
+		if raw := opaqueUserData(userDataStr); raw != nil {
+			va.UserDataRaw = raw
 		} else {
-			va.UserData = utils.Merge(va.UserData, userData).(map[string]interface{})
+			var userData map[string]interface{}
+			if err := yaml.Unmarshal([]byte(userDataStr), &userData); err != nil {
+				return fmt.Errorf("failed to unmarshal cloud-init userdata")
+			}
+			if va.UserDataOverwrite {
+				va.UserData = userData
+			} else {
+				va.UserData = utils.Merge(va.UserData, userData).(map[string]interface{})
+			}
 		}
 	}
 
 	va.UserDataScript = podAnnotations[cloudInitUserDataScriptKeyName]
+	if seedFrom := strings.TrimSpace(podAnnotations[seedFromKeyName]); seedFrom != "" && !strings.HasSuffix(seedFrom, "/") {
+		// cloud-init appends file names to the URL
+		va.SeedFrom = seedFrom + "/"
+	} else {
+		va.SeedFrom = seedFrom
+	}
 
 	if sshKeysStr, found := podAnnotations[sshKeysKeyName]; found {
 		if va.UserDataOverwrite {
 			va.SSHKeys = nil
 		}
-		keys := strings.Split(sshKeysStr, "\n")
-		for _, k := range keys {
-			k = strings.TrimSpace(k)
-			if k != "" {
-				va.SSHKeys = append(va.SSHKeys, k)
-			}
+		keys, err := parseSSHKeys(va.SSHKeys, sshKeysStr)
+		if err != nil {
+			return fmt.Errorf("error parsing %s annotation: %v", sshKeysKeyName, err)
 		}
+		va.SSHKeys = keys
 	}
 
 	va.ImageType = imageType(strings.ToLower(podAnnotations[cloudInitImageType]))
+	va.ImageLabel = podAnnotations[cloudInitImageLabelKeyName]
+	va.DualConfigLayout = utils.GetBoolFromString(podAnnotations[cloudInitDualLayoutKeyName])
+	va.SeedMechanism = seedMechanism(strings.ToLower(podAnnotations[seedMechanismKeyName]))
+	va.RestartPolicy = podAnnotations[restartPolicyKeyName]
+	va.IPConfigPolicy = ipConfigPolicy(strings.ToLower(podAnnotations[ipConfigPolicyKeyName]))
 	va.DiskDriver = diskDriverName(podAnnotations[diskDriverKeyName])
 
+	if panicDeviceStr, found := podAnnotations[panicDeviceKeyName]; found {
+		va.DisablePanicDevice = !utils.GetBoolFromString(panicDeviceStr)
+	}
+
+	va.PreserveVolumesOnDelete = utils.GetBoolFromString(podAnnotations[preserveVolumesKeyName])
+	va.RestoreFrom = strings.TrimSpace(podAnnotations[restoreFromKeyName])
+	switch wipeStr := strings.ToLower(strings.TrimSpace(podAnnotations[wipeOnDeleteKeyName])); wipeStr {
+	case "", "false":
+	case "true":
+		va.WipeOnDelete = virt.WipeAlgorithmZero
+	default:
+		va.WipeOnDelete = virt.WipeAlgorithm(wipeStr)
+	}
+	va.Autostart = utils.GetBoolFromString(podAnnotations[autostartKeyName])
+	va.EmulatorPin = strings.TrimSpace(podAnnotations[emulatorPinKeyName])
+	va.IsolateEmulator = utils.GetBoolFromString(podAnnotations[isolateEmulatorKeyName])
+	va.EnableGuestAgent = utils.GetBoolFromString(podAnnotations[guestAgentKeyName])
+	va.GuestTimeSync = guestTimeSync(strings.ToLower(strings.TrimSpace(podAnnotations[guestTimeSyncKeyName])))
+	if va.GuestTimeSync == guestTimeSyncNone {
+		va.GuestTimeSync = ""
+	}
+	va.RootVolumeCopyOnRead = utils.GetBoolFromString(podAnnotations[rootVolumeCopyOnReadKeyName])
+	va.ForceConfigISO = utils.GetBoolFromString(podAnnotations[forceConfigISOKeyName])
+	va.CACertsRemoveDefaults = utils.GetBoolFromString(podAnnotations[caCertsRemoveDefaultsKeyName])
+
+	if caCertsStr, found := podAnnotations[caCertsKeyName]; found {
+		certs, err := parseCACerts(va.CACerts, caCertsStr)
+		if err != nil {
+			return fmt.Errorf("error parsing %s annotation: %v", caCertsKeyName, err)
+		}
+		va.CACerts = certs
+	}
+
+	if powerStateStr, found := podAnnotations[powerStateKeyName]; found {
+		if err := yaml.Unmarshal([]byte(powerStateStr), &va.PowerState); err != nil {
+			return fmt.Errorf("failed to unmarshal cloud-init power_state")
+		}
+	}
+
+	va.DomainType = podAnnotations[domainTypeKeyName]
+
+	if metadataAnnotationsStr := podAnnotations[metadataAnnotationsKeyName]; metadataAnnotationsStr != "" {
+		for _, key := range strings.Split(metadataAnnotationsStr, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				va.MetadataAnnotations = append(va.MetadataAnnotations, key)
+			}
+		}
+	}
+
+	if growpartDevicesStr := podAnnotations[growpartDevicesKeyName]; growpartDevicesStr != "" {
+		for _, device := range strings.Split(growpartDevicesStr, ",") {
+			if device = strings.TrimSpace(device); device != "" {
+				va.GrowpartDevices = append(va.GrowpartDevices, device)
+			}
+		}
+	}
+
+	va.ScratchDiskMountPoint = podAnnotations[scratchDiskMountPointKeyName]
+
+	if gpuDevicesStr := podAnnotations[gpuDevicesKeyName]; gpuDevicesStr != "" {
+		for _, addr := range strings.Split(gpuDevicesStr, ",") {
+			if addr = strings.ToLower(strings.TrimSpace(addr)); addr != "" {
+				va.GPUDevices = append(va.GPUDevices, addr)
+			}
+		}
+	}
+
+	var err error
+	if va.RootVolumeQueues, err = parseQueueOptionValue(rootVolumeQueuesKeyName, podAnnotations[rootVolumeQueuesKeyName]); err != nil {
+		return err
+	}
+	if va.RootVolumeQueueSize, err = parseQueueOptionValue(rootVolumeQueueSizeKeyName, podAnnotations[rootVolumeQueueSizeKeyName]); err != nil {
+		return err
+	}
+
+	if va.NICOffloads, err = network.ParseNICOffloads(podAnnotations[nicOffloadsKeyName]); err != nil {
+		return fmt.Errorf("error parsing %s: %v", nicOffloadsKeyName, err)
+	}
+
+	if va.CPUFeatures, err = parseCPUFeatures(podAnnotations[cpuFeaturesKeyName]); err != nil {
+		return fmt.Errorf("error parsing %s: %v", cpuFeaturesKeyName, err)
+	}
+
+	if va.ShutdownModes, err = parseShutdownModes(podAnnotations[shutdownModeKeyName]); err != nil {
+		return fmt.Errorf("error parsing %s: %v", shutdownModeKeyName, err)
+	}
+
+	if nvdimmStr, found := podAnnotations[nvdimmKeyName]; found {
+		if va.NVDIMM, err = parseNVDIMMConfig(nvdimmStr); err != nil {
+			return fmt.Errorf("error parsing %s: %v", nvdimmKeyName, err)
+		}
+	}
+
+	if rtSchedulerStr, found := podAnnotations[rtSchedulerKeyName]; found {
+		if va.RTScheduler, err = parseRTSchedulerConfig(rtSchedulerStr); err != nil {
+			return fmt.Errorf("error parsing %s: %v", rtSchedulerKeyName, err)
+		}
+	}
+
+	if numaNodeStr, found := podAnnotations[numaNodeKeyName]; found {
+		node, err := strconv.Atoi(numaNodeStr)
+		if err != nil {
+			return fmt.Errorf("error parsing %s: %v", numaNodeKeyName, err)
+		}
+		va.NUMANode = &node
+	}
+
+	if maxSizeStr, found := podAnnotations[consoleLogMaxSizeKeyName]; found {
+		q, err := resource.ParseQuantity(maxSizeStr)
+		if err != nil {
+			return fmt.Errorf("error parsing %s: %v", consoleLogMaxSizeKeyName, err)
+		}
+		maxSize := q.Value()
+		va.ConsoleLogMaxSize = &maxSize
+	}
+
+	if scratchDiskSizeStr, found := podAnnotations[scratchDiskSizeKeyName]; found {
+		q, err := resource.ParseQuantity(scratchDiskSizeStr)
+		if err != nil {
+			return fmt.Errorf("error parsing %s: %v", scratchDiskSizeKeyName, err)
+		}
+		if va.ScratchDiskSize = q.Value(); va.ScratchDiskSize <= 0 {
+			return fmt.Errorf("bad %s value %q: must be positive", scratchDiskSizeKeyName, scratchDiskSizeStr)
+		}
+	}
+
+	if maxFilesStr, found := podAnnotations[consoleLogMaxFilesKeyName]; found {
+		maxFiles, err := strconv.Atoi(maxFilesStr)
+		if err != nil {
+			return fmt.Errorf("error parsing %s: %v", consoleLogMaxFilesKeyName, err)
+		}
+		va.ConsoleLogMaxFiles = &maxFiles
+	}
+
+	va.PCIeHotplug = utils.GetBoolFromString(podAnnotations[pcieHotplugKeyName])
+	if pcieRootPortsStr, found := podAnnotations[pcieRootPortsKeyName]; found {
+		if va.PCIeRootPorts, err = strconv.Atoi(pcieRootPortsStr); err != nil {
+			return fmt.Errorf("error parsing %s: %v", pcieRootPortsKeyName, err)
+		}
+	} else if va.PCIeHotplug {
+		va.PCIeRootPorts = defaultPCIeRootPorts
+	}
+
+	if interfaceSourceStr, found := podAnnotations[interfaceSourceKeyName]; found {
+		if va.InterfaceSource, err = parseInterfaceSourceConfig(interfaceSourceStr); err != nil {
+			return fmt.Errorf("error parsing %s: %v", interfaceSourceKeyName, err)
+		}
+	}
+
+	if va.OptionalDevices, err = parseOptionalDevices(podAnnotations[optionalDevicesKeyName]); err != nil {
+		return fmt.Errorf("error parsing %s: %v", optionalDevicesKeyName, err)
+	}
+
+	va.User = podAnnotations[userKeyName]
+	va.UserPassword = podAnnotations[userPasswordKeyName]
+	va.PrimaryInterface = PrimaryInterfaceName(podAnnotations)
+
 	return nil
 }
 
+// PrimaryInterfaceName returns the name of the pod network interface
+// specified by VirtletPrimaryInterface annotation, or an empty
+// string if the annotation isn't set. It's used when adding the
+// pod to the network, before the container is created.
+func PrimaryInterfaceName(podAnnotations map[string]string) string {
+	return strings.TrimSpace(podAnnotations[primaryInterfaceKeyName])
+}
+
 func (va *VirtletAnnotations) applyDefaults() {
 	if va.VCPUCount <= 0 {
 		va.VCPUCount = 1
@@ -163,6 +597,171 @@ func (va *VirtletAnnotations) validate() error {
 		errs = append(errs, fmt.Sprintf("unknown config image type %q. Must be either %q or %q", va.ImageType, imageTypeNoCloud, imageTypeConfigDrive))
 	}
 
+	if va.ImageLabel != "" && !imageLabelRx.MatchString(va.ImageLabel) {
+		errs = append(errs, fmt.Sprintf("bad config image label %q. It must be at most 32 characters long and consist of letters, digits, '_', '.' and '-'", va.ImageLabel))
+	}
+
+	switch va.SeedMechanism {
+	case "", seedMechanismISO:
+	case seedMechanismFwCfg, seedMechanismSMBIOS:
+		// only NoCloud datasource can be seeded without a config-2 ISO
+		// or pointed at via SMBIOS
+		if va.ImageType != imageTypeNoCloud || va.DualConfigLayout {
+			errs = append(errs, fmt.Sprintf("seed mechanism %q can only be used with %q config image type without dual layout", va.SeedMechanism, imageTypeNoCloud))
+		}
+		if va.SeedMechanism == seedMechanismFwCfg && va.ImageLabel != "" {
+			errs = append(errs, fmt.Sprintf("config image label can't be set for %q seed mechanism as there's no config image", seedMechanismFwCfg))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("bad seed mechanism %q. Must be one of %q, %q or %q", va.SeedMechanism, seedMechanismISO, seedMechanismFwCfg, seedMechanismSMBIOS))
+	}
+
+	if va.SeedFrom != "" {
+		if err := validateSeedFromURL(va.SeedFrom); err != nil {
+			errs = append(errs, fmt.Sprintf("bad %s: %v", seedFromKeyName, err))
+		}
+		if va.ImageType != imageTypeNoCloud || va.DualConfigLayout {
+			errs = append(errs, fmt.Sprintf("%s can only be used with %q config image type without dual layout", seedFromKeyName, imageTypeNoCloud))
+		}
+		if len(va.UserData) != 0 || va.UserDataScript != "" || va.UserDataRaw != nil {
+			errs = append(errs, fmt.Sprintf("%s can't be used together with embedded cloud-init user-data", seedFromKeyName))
+		}
+	}
+
+	switch va.IPConfigPolicy {
+	case "", ipConfigStatic, ipConfigDHCP, ipConfigStaticWithFallback:
+	default:
+		errs = append(errs, fmt.Sprintf("bad ip config policy %q. Must be one of %q, %q or %q", va.IPConfigPolicy, ipConfigStatic, ipConfigDHCP, ipConfigStaticWithFallback))
+	}
+
+	switch va.GuestTimeSync {
+	case "", guestTimeSyncAgent, guestTimeSyncHypervClock:
+	default:
+		errs = append(errs, fmt.Sprintf("bad %s value %q. Must be one of %q, %q or %q", guestTimeSyncKeyName, va.GuestTimeSync, guestTimeSyncNone, guestTimeSyncAgent, guestTimeSyncHypervClock))
+	}
+
+	if va.WipeOnDelete != "" && !isValidWipeAlgorithm(va.WipeOnDelete) {
+		errs = append(errs, fmt.Sprintf("bad %s value %q. Must be \"true\", \"false\" or one of %q", wipeOnDeleteKeyName, va.WipeOnDelete, virt.WipeAlgorithms))
+	}
+	if va.RestoreFrom != "" && !savedImageNameRx.MatchString(va.RestoreFrom) {
+		errs = append(errs, fmt.Sprintf("bad %s value %q. It must consist of letters, digits, '_', '.' and '-' and must not start with '.'", restoreFromKeyName, va.RestoreFrom))
+	}
+	if va.WipeOnDelete != "" && va.PreserveVolumesOnDelete {
+		errs = append(errs, fmt.Sprintf("%s can't be used together with %s", wipeOnDeleteKeyName, preserveVolumesKeyName))
+	}
+
+	switch va.RestartPolicy {
+	case "", restartPolicyAlways, restartPolicyOnFailure, restartPolicyNever:
+	default:
+		errs = append(errs, fmt.Sprintf("bad restart policy %q. Must be one of %q, %q or %q", va.RestartPolicy, restartPolicyAlways, restartPolicyOnFailure, restartPolicyNever))
+	}
+
+	switch va.DomainType {
+	case "", defaultDomainType, noKvmDomainType:
+	default:
+		errs = append(errs, fmt.Sprintf("bad domain type %q. Must be either %q or %q", va.DomainType, defaultDomainType, noKvmDomainType))
+	}
+
+	rootVolumeQueueOptions := diskQueueOptions{Queues: va.RootVolumeQueues, QueueSize: va.RootVolumeQueueSize}
+	if err := rootVolumeQueueOptions.validate(); err != nil {
+		errs = append(errs, fmt.Sprintf("bad root volume queue settings: %v", err))
+	}
+
+	if va.NVDIMM != nil {
+		if err := va.NVDIMM.validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("bad NVDIMM settings: %v", err))
+		}
+	}
+
+	if va.NUMANode != nil && *va.NUMANode < 0 {
+		errs = append(errs, fmt.Sprintf("bad NUMA node %d", *va.NUMANode))
+	}
+
+	if va.EmulatorPin != "" {
+		if _, err := parseCPUList(va.EmulatorPin); err != nil {
+			errs = append(errs, fmt.Sprintf("bad %s: %v", emulatorPinKeyName, err))
+		}
+	} else if va.IsolateEmulator {
+		errs = append(errs, fmt.Sprintf("%s requires %s to be set", isolateEmulatorKeyName, emulatorPinKeyName))
+	}
+
+	if va.RTScheduler != nil {
+		if err := va.RTScheduler.validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("bad real-time scheduler settings: %v", err))
+		}
+		if !va.IsolateEmulator {
+			errs = append(errs, fmt.Sprintf("%s requires %s to be set", rtSchedulerKeyName, isolateEmulatorKeyName))
+		}
+	}
+
+	if va.PCIeRootPorts < 0 || va.PCIeRootPorts > maxPCIeRootPorts {
+		errs = append(errs, fmt.Sprintf("bad PCIe root port count %d, must be between 0 and %d", va.PCIeRootPorts, maxPCIeRootPorts))
+	}
+	if va.PCIeHotplug && va.PCIeRootPorts == 0 {
+		errs = append(errs, "PCIe hotplug requires at least one PCIe root port")
+	}
+
+	if va.InterfaceSource != nil {
+		if err := va.InterfaceSource.validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("bad interface source settings: %v", err))
+		}
+	}
+
+	if va.User != "" && !userNameRx.MatchString(va.User) {
+		errs = append(errs, fmt.Sprintf("bad user name %q", va.User))
+	}
+
+	if va.UserPassword != "" {
+		if va.User == "" {
+			errs = append(errs, fmt.Sprintf("%s requires %s to be set", userPasswordKeyName, userKeyName))
+		}
+		// don't include the value in the error message
+		// so plaintext passwords don't end up in the logs
+		if !passwordHashRx.MatchString(va.UserPassword) {
+			errs = append(errs, fmt.Sprintf("%s must be a crypt(3) password hash (SHA-512, SHA-256, MD5 or bcrypt)", userPasswordKeyName))
+		}
+	}
+
+	if va.PrimaryInterface != "" && !interfaceNameRx.MatchString(va.PrimaryInterface) {
+		errs = append(errs, fmt.Sprintf("bad %s value %q", primaryInterfaceKeyName, va.PrimaryInterface))
+	}
+
+	if va.ConsoleLogMaxSize != nil && *va.ConsoleLogMaxSize < 0 {
+		errs = append(errs, fmt.Sprintf("%s must not be negative", consoleLogMaxSizeKeyName))
+	}
+
+	if va.ConsoleLogMaxFiles != nil && *va.ConsoleLogMaxFiles < 0 {
+		errs = append(errs, fmt.Sprintf("%s must not be negative", consoleLogMaxFilesKeyName))
+	}
+
+	for _, device := range va.GrowpartDevices {
+		if !strings.HasPrefix(device, "/") {
+			errs = append(errs, fmt.Sprintf("bad %s entry %q: must be an absolute device path or mount point", growpartDevicesKeyName, device))
+		}
+	}
+
+	for _, addr := range va.GPUDevices {
+		if _, err := parsePCIAddress(addr); err != nil {
+			errs = append(errs, fmt.Sprintf("bad %s entry %q: must be a PCI address such as 0000:01:00.0", gpuDevicesKeyName, addr))
+		}
+	}
+
+	if va.ScratchDiskMountPoint != "" && !strings.HasPrefix(va.ScratchDiskMountPoint, "/") {
+		errs = append(errs, fmt.Sprintf("bad %s value %q: must be an absolute path", scratchDiskMountPointKeyName, va.ScratchDiskMountPoint))
+	}
+
+	if va.CACertsRemoveDefaults && len(va.CACerts) == 0 {
+		errs = append(errs, fmt.Sprintf("%s requires CA certificates to be specified", caCertsRemoveDefaultsKeyName))
+	}
+
+	if va.PowerState != nil {
+		switch mode := va.PowerState["mode"]; mode {
+		case "reboot", "poweroff", "halt":
+		default:
+			errs = append(errs, fmt.Sprintf("bad power_state mode %v. Must be one of \"reboot\", \"poweroff\" or \"halt\"", mode))
+		}
+	}
+
 	if errs != nil {
 		return fmt.Errorf("bad virtlet annotations. Errors:\n%s", strings.Join(errs, "\n"))
 	}
@@ -170,6 +769,27 @@ func (va *VirtletAnnotations) validate() error {
 	return nil
 }
 
+// validateSeedFromURL verifies that the URL can be used as NoCloud
+// seedfrom location
+func validateSeedFromURL(seedFrom string) error {
+	u, err := url.Parse(seedFrom)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q is not an http or https URL", seedFrom)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("no host in URL %q", seedFrom)
+	}
+	// semicolons separate the fields of the NoCloud datasource
+	// specification passed via SMBIOS
+	if strings.Contains(seedFrom, ";") {
+		return fmt.Errorf("URL %q contains a semicolon", seedFrom)
+	}
+	return nil
+}
+
 func (va *VirtletAnnotations) loadExternalUserData(ns string, podAnnotations map[string]string) error {
 	if ns == "" {
 		return nil
@@ -203,6 +823,34 @@ func (va *VirtletAnnotations) loadExternalUserData(ns string, podAnnotations map
 			return err
 		}
 	}
+	sshHostKeySourceKey := podAnnotations[sshHostKeySourceKeyName]
+	if sshHostKeySourceKey != "" {
+		var err error
+		if clientset == nil {
+			clientset, err = utils.GetK8sClientset(nil)
+			if err != nil {
+				return err
+			}
+		}
+		err = va.loadSSHHostKeysFromDataSource(ns, sshHostKeySourceKey, clientset)
+		if err != nil {
+			return err
+		}
+	}
+	caCertsSourceKey := podAnnotations[caCertsSourceKeyName]
+	if caCertsSourceKey != "" {
+		var err error
+		if clientset == nil {
+			clientset, err = utils.GetK8sClientset(nil)
+			if err != nil {
+				return err
+			}
+		}
+		err = va.loadCACertsFromDataSource(ns, caCertsSourceKey, clientset)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -238,17 +886,80 @@ func (va *VirtletAnnotations) loadSSHKeysFromDataSource(ns, key string, clientse
 	if err != nil {
 		return err
 	}
-	sshKeys := ud[dataKey]
-	keys := strings.Split(sshKeys, "\n")
-	for _, k := range keys {
-		k = strings.TrimSpace(k)
-		if k != "" {
-			va.SSHKeys = append(va.SSHKeys, k)
-		}
+	keys, err := parseSSHKeys(va.SSHKeys, ud[dataKey])
+	if err != nil {
+		return fmt.Errorf("error parsing ssh keys from %s: %v", key, err)
 	}
+	va.SSHKeys = keys
 	return nil
 }
 
+func (va *VirtletAnnotations) loadCACertsFromDataSource(ns, key string, clientset *kubernetes.Clientset) error {
+	parts := strings.Split(key, "/")
+	if len(parts) != 2 && len(parts) != 3 {
+		return fmt.Errorf("invalid %s annotation format. Expected kind/name[/key], but insted got %s", caCertsSourceKeyName, key)
+	}
+	dataKey := "ca.crt"
+	if len(parts) == 3 {
+		dataKey = parts[2]
+	}
+	data, err := readK8sKeySource(parts[0], parts[1], ns, dataKey, clientset)
+	if err != nil {
+		return err
+	}
+	certs, err := parseCACerts(va.CACerts, data[dataKey])
+	if err != nil {
+		return fmt.Errorf("error parsing CA certificates from %s: %v", key, err)
+	}
+	va.CACerts = certs
+	return nil
+}
+
+func (va *VirtletAnnotations) loadSSHHostKeysFromDataSource(ns, key string, clientset *kubernetes.Clientset) error {
+	parts := strings.Split(key, "/")
+	// the private keys may only be stored in secrets
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "secret" {
+		return fmt.Errorf("invalid %s annotation format. Expected secret/name, but insted got %s", sshHostKeySourceKeyName, key)
+	}
+	data, err := readK8sKeySource(parts[0], parts[1], ns, "", clientset)
+	if err != nil {
+		return err
+	}
+	if va.SSHHostKeys, err = parseSSHHostKeys(data); err != nil {
+		return fmt.Errorf("bad SSH host keys in secret %q: %v", parts[1], err)
+	}
+	return nil
+}
+
+// parseSSHHostKeys picks the SSH host keys from the secret data
+// that has the keys named like in cloud-init ssh_keys, e.g.
+// rsa_private and rsa_public. The other items are ignored. Each
+// private key must be accompanied by the matching public key.
+// The key contents are never included in the errors.
+func parseSSHHostKeys(data map[string]string) (map[string]string, error) {
+	r := make(map[string]string)
+	for _, keyType := range sshHostKeyTypes {
+		privateKey := strings.TrimSpace(data[keyType+"_private"])
+		publicKey := strings.TrimSpace(data[keyType+"_public"])
+		switch {
+		case privateKey == "" && publicKey == "":
+			continue
+		case privateKey == "":
+			return nil, fmt.Errorf("%s_public is specified without %s_private", keyType, keyType)
+		case publicKey == "":
+			return nil, fmt.Errorf("%s_private is specified without %s_public", keyType, keyType)
+		case !strings.HasPrefix(privateKey, "-----BEGIN "):
+			return nil, fmt.Errorf("%s_private is not a PEM encoded private key", keyType)
+		}
+		r[keyType+"_private"] = privateKey + "\n"
+		r[keyType+"_public"] = publicKey
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("no SSH host keys found. Expected one or more of %s key pairs", strings.Join(sshHostKeyTypes, ", "))
+	}
+	return r, nil
+}
+
 func readK8sKeySource(sourceType, sourceName, ns, key string, clientset *kubernetes.Clientset) (map[string]string, error) {
 	sourceType = strings.ToLower(sourceType)
 	switch sourceType {
@@ -282,3 +993,12 @@ func readK8sKeySource(sourceType, sourceName, ns, key string, clientset *kuberne
 		return nil, fmt.Errorf("unsupported source kind %s. Must be one of (secret, configmap)", sourceType)
 	}
 }
+
+func isValidWipeAlgorithm(algorithm virt.WipeAlgorithm) bool {
+	for _, alg := range virt.WipeAlgorithms {
+		if alg == algorithm {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const (
+	restartPolicyAlways    = "Always"
+	restartPolicyOnFailure = "OnFailure"
+	restartPolicyNever     = "Never"
+
+	// the backoff between the restarts of a crashed VM starts
+	// at restartBackoffBase and doubles after each restart
+	// till it reaches restartBackoffMax, like kubelet does for
+	// the containers that keep crashing
+	restartBackoffBase = 10 * time.Second
+	restartBackoffMax  = 5 * time.Minute
+
+	// kubelet uses this container annotation to keep track of
+	// the number of container restarts
+	restartCountAnnotation = "io.kubernetes.container.restartCount"
+)
+
+// restartsOnCrash returns true if Virtlet is to restart the VM
+// of the container after a crash. A crash is a failure, so both
+// Always and OnFailure policies apply.
+func restartsOnCrash(containerInfo *metadata.ContainerInfo) bool {
+	return containerInfo.RestartPolicy == restartPolicyAlways || containerInfo.RestartPolicy == restartPolicyOnFailure
+}
+
+// restartBackoff returns the minimum time between the previous
+// restart and the next one for the VM that was already restarted
+// the specified number of times
+func restartBackoff(restartCount int) time.Duration {
+	backoff := restartBackoffBase
+	for i := 1; i < restartCount && backoff < restartBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > restartBackoffMax {
+		backoff = restartBackoffMax
+	}
+	return backoff
+}
+
+// annotationsWithRestartCount returns the container annotations
+// with kubelet's restart count increased by the number of the
+// restarts performed by Virtlet, so they're reflected in the
+// pod status
+func annotationsWithRestartCount(containerInfo *metadata.ContainerInfo) map[string]string {
+	if containerInfo.RestartCount == 0 {
+		return containerInfo.Annotations
+	}
+	annotations := make(map[string]string)
+	for k, v := range containerInfo.Annotations {
+		annotations[k] = v
+	}
+	count, err := strconv.Atoi(annotations[restartCountAnnotation])
+	if err != nil {
+		count = 0
+	}
+	annotations[restartCountAnnotation] = strconv.Itoa(count + containerInfo.RestartCount)
+	return annotations
+}
+
+// RestartCrashedVMs restarts the crashed VMs of the running
+// containers with Always or OnFailure restart policy, keeping the
+// domains and their volumes. The VMs that were restarted recently
+// are skipped till the backoff period passes.
+func (v *VirtualizationTool) RestartCrashedVMs() []error {
+	ids, fatal, errs := v.retrieveListOfContainerIDs()
+	if fatal {
+		return errs
+	}
+	for _, containerID := range ids {
+		if err := v.restartIfCrashed(containerID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func (v *VirtualizationTool) restartIfCrashed(containerID string) error {
+	defer v.containerLocks.lock(containerID)()
+
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	if err != nil {
+		return fmt.Errorf("can't retrieve the metadata of container %q: %v", containerID, err)
+	}
+	if containerInfo == nil || containerInfo.State != kubeapi.ContainerState_CONTAINER_RUNNING || !restartsOnCrash(containerInfo) {
+		return nil
+	}
+
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerID)
+	switch {
+	case err == virt.ErrDomainNotFound:
+		return nil
+	case err != nil:
+		return fmt.Errorf("can't look up domain %q: %v", containerID, err)
+	}
+	state, err := domain.State()
+	if err != nil {
+		return fmt.Errorf("can't get the state of domain %q: %v", containerID, err)
+	}
+	if state != virt.DomainStateCrashed {
+		return nil
+	}
+
+	if containerInfo.RestartCount > 0 {
+		backoff := restartBackoff(containerInfo.RestartCount)
+		if since := v.clock.Since(time.Unix(0, containerInfo.LastRestartAt)); since < backoff {
+			glog.V(2).Infof("Domain %q crashed, waiting %v before restarting it", containerID, backoff-since)
+			return nil
+		}
+	}
+
+	glog.Infof("Domain %q crashed, restarting it (restart count: %d)", containerID, containerInfo.RestartCount+1)
+	// crashed domains are still active and must be destroyed
+	// before they can be started again
+	if err := domain.Destroy(); err != nil {
+		return fmt.Errorf("failed to destroy crashed domain %q: %v", containerID, err)
+	}
+	// the restart attempt is counted even if it fails, so the
+	// backoff applies to the VMs that fail to start, too
+	now := v.clock.Now().UnixNano()
+	if err := v.metadataStore.Container(containerID).Save(
+		func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+			if c != nil {
+				c.RestartCount++
+				c.LastRestartAt = now
+			}
+			return c, nil
+		}); err != nil {
+		return fmt.Errorf("can't update the metadata of container %q: %v", containerID, err)
+	}
+	if err := v.startDomain(containerID, domain); err != nil {
+		return err
+	}
+	return v.markContainerStarted(containerID)
+}
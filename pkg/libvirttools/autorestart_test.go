@@ -0,0 +1,123 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"testing"
+	"time"
+
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func (ct *containerTester) crashDomain(containerID string) virt.Domain {
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		ct.t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	if err := domain.(*fake.FakeDomain).InjectPanic(); err != nil {
+		ct.t.Fatalf("InjectPanic(): %v", err)
+	}
+	return domain
+}
+
+func (ct *containerTester) restartCrashedVMs() {
+	for _, err := range ct.virtTool.RestartCrashedVMs() {
+		ct.t.Errorf("RestartCrashedVMs(): %v", err)
+	}
+}
+
+func verifyDomainState(t *testing.T, domain virt.Domain, expectedState virt.DomainState) {
+	if state, err := domain.State(); err != nil {
+		t.Errorf("State(): %v", err)
+	} else if state != expectedState {
+		t.Errorf("bad domain state %v instead of %v", state, expectedState)
+	}
+}
+
+func TestRestartCrashedVM(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	sandbox.Annotations = map[string]string{
+		"VirtletRestartPolicy": "Always",
+	}
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	ct.startContainer(containerID)
+
+	domain := ct.crashDomain(containerID)
+	// the crashed VM must not be re-created by kubelet
+	if status := ct.containerStatus(containerID); status.State != kubeapi.ContainerState_CONTAINER_RUNNING {
+		t.Errorf("bad container state %v instead of %v", status.State, kubeapi.ContainerState_CONTAINER_RUNNING)
+	}
+	ct.restartCrashedVMs()
+	verifyDomainState(t, domain, virt.DomainStateRunning)
+	if status := ct.containerStatus(containerID); status.Annotations[restartCountAnnotation] != "1" {
+		t.Errorf("bad restart count %q instead of \"1\"", status.Annotations[restartCountAnnotation])
+	}
+
+	// the next restart is delayed
+	ct.crashDomain(containerID)
+	ct.restartCrashedVMs()
+	verifyDomainState(t, domain, virt.DomainStateCrashed)
+	ct.clock.Advance(restartBackoffBase)
+	ct.restartCrashedVMs()
+	verifyDomainState(t, domain, virt.DomainStateRunning)
+	if status := ct.containerStatus(containerID); status.Annotations[restartCountAnnotation] != "2" {
+		t.Errorf("bad restart count %q instead of \"2\"", status.Annotations[restartCountAnnotation])
+	}
+}
+
+func TestCrashedVMNotRestartedWithoutPolicy(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	ct.startContainer(containerID)
+
+	domain := ct.crashDomain(containerID)
+	ct.restartCrashedVMs()
+	verifyDomainState(t, domain, virt.DomainStateCrashed)
+	if status := ct.containerStatus(containerID); status.State != kubeapi.ContainerState_CONTAINER_EXITED {
+		t.Errorf("bad container state %v instead of %v", status.State, kubeapi.ContainerState_CONTAINER_EXITED)
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		restartCount int
+		backoff      time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{6, 5 * time.Minute},
+		{100, 5 * time.Minute},
+	} {
+		if backoff := restartBackoff(tc.restartCount); backoff != tc.backoff {
+			t.Errorf("restartBackoff(%d) = %v instead of %v", tc.restartCount, backoff, tc.backoff)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// setDomainAutostart enables or disables libvirt autostart for the
+// domain of a container with VirtletAutostart annotation. The
+// autostart is only kept enabled while the container is running, so
+// that the VMs stopped by kubelet, whose volumes are already cleaned
+// up, don't come back after the node reboot.
+func (v *VirtualizationTool) setDomainAutostart(containerID string, domain virt.Domain, autostart bool) error {
+	config, _, err := v.getVMConfigFromMetadata(containerID)
+	if err != nil || config == nil || !config.ParsedAnnotations.Autostart {
+		return err
+	}
+	if err := domain.SetAutostart(autostart); err != nil {
+		return fmt.Errorf("failed to set autostart to %v for domain %q: %v", autostart, containerID, err)
+	}
+	glog.V(2).Infof("Autostart of the domain %q set to %v", containerID, autostart)
+	return nil
+}
+
+// reconcileAutostart checks that libvirt autostart is enabled for
+// the domain of the container if and only if the container has
+// VirtletAutostart annotation and is running
+func (v *VirtualizationTool) reconcileAutostart(containerID string, domain virt.Domain, report *ReconcileReport) {
+	config, state, err := v.getVMConfigFromMetadata(containerID)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("cannot get the config of container %q: %v", containerID, err))
+		return
+	}
+	if config == nil {
+		return
+	}
+	autostart, err := domain.Autostart()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("cannot get autostart flag of domain %q: %v", containerID, err))
+		return
+	}
+	expected := config.ParsedAnnotations.Autostart && state == kubeapi.ContainerState_CONTAINER_RUNNING
+	if autostart == expected {
+		return
+	}
+	report.add(Drift{Kind: DriftAutostartMismatch, ContainerID: containerID}, func() error {
+		if err := domain.SetAutostart(expected); err != nil {
+			return fmt.Errorf("cannot set autostart flag of domain %q: %v", containerID, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"testing"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func (ct *containerTester) verifyAutostart(containerID string, expected bool) {
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		ct.t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	autostart, err := domain.Autostart()
+	switch {
+	case err != nil:
+		ct.t.Errorf("Autostart(): %v", err)
+	case autostart != expected:
+		ct.t.Errorf("bad autostart flag of domain %q: %v instead of %v", containerID, autostart, expected)
+	}
+}
+
+func TestDomainAutostart(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		autostart   bool
+	}{
+		{
+			name:        "autostart annotation",
+			annotations: map[string]string{"VirtletAutostart": "true"},
+			autostart:   true,
+		},
+		{
+			name: "no autostart annotation",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newContainerTester(t, testutils.NewToplevelRecorder())
+			defer ct.teardown()
+
+			sandbox := criapi.GetSandboxes(1)[0]
+			sandbox.Annotations = tc.annotations
+			ct.setPodSandbox(sandbox)
+			containerID := ct.createContainer(sandbox, nil)
+			ct.verifyAutostart(containerID, false)
+
+			ct.startContainer(containerID)
+			ct.verifyAutostart(containerID, tc.autostart)
+
+			ct.stopContainer(containerID)
+			ct.verifyAutostart(containerID, false)
+		})
+	}
+}
+
+func TestReconcileAutostart(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandboxes := criapi.GetSandboxes(2)
+	sandboxes[0].Annotations = map[string]string{"VirtletAutostart": "true"}
+	var containerIDs []string
+	for _, sandbox := range sandboxes {
+		ct.setPodSandbox(sandbox)
+		containerID := ct.createContainer(sandbox, nil)
+		ct.startContainer(containerID)
+		containerIDs = append(containerIDs, containerID)
+	}
+
+	// flip the autostart flags of both domains
+	for n, containerID := range containerIDs {
+		domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+		if err != nil {
+			t.Fatalf("LookupDomainByUUIDString(): %v", err)
+		}
+		if err := domain.SetAutostart(n != 0); err != nil {
+			t.Fatalf("SetAutostart(): %v", err)
+		}
+	}
+
+	report := ct.virtTool.Reconcile(false)
+	if len(report.Errors) != 0 {
+		t.Errorf("Reconcile() errors: %v", report.Errors)
+	}
+	var drifts []string
+	for _, drift := range report.Drifts {
+		if drift.Kind != DriftAutostartMismatch || !drift.Repaired {
+			t.Errorf("unexpected drift: %#v", drift)
+		}
+		drifts = append(drifts, drift.ContainerID)
+	}
+	if len(drifts) != 2 {
+		t.Errorf("bad autostart mismatch drifts: %v", drifts)
+	}
+	ct.verifyAutostart(containerIDs[0], true)
+	ct.verifyAutostart(containerIDs[1], false)
+}
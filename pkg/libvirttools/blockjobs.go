@@ -0,0 +1,111 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// BlockJob describes the progress of a long-running block
+// operation on a VM disk, such as a copy or a snapshot commit
+type BlockJob struct {
+	// Disk is the target device name of the disk, e.g. "vda"
+	Disk string
+	// Type is the kind of the block job
+	Type virt.BlockJobType
+	// Progress is the percentage of the work that is done
+	Progress int
+}
+
+// String returns a human-readable description of the block job
+func (j BlockJob) String() string {
+	return fmt.Sprintf("%s: %s %d%%", j.Disk, j.Type, j.Progress)
+}
+
+func blockJobProgress(info *virt.BlockJobInfo) int {
+	if info.End == 0 {
+		return 0
+	}
+	if info.Cur >= info.End {
+		return 100
+	}
+	return int(info.Cur * 100 / info.End)
+}
+
+// BlockJobs returns the block jobs that are running on the disks of
+// the VM of the specified container. The disks without block jobs
+// are skipped.
+func (v *VirtualizationTool) BlockJobs(containerID string) ([]BlockJob, error) {
+	domain, err := v.lookupRunningDomain(containerID)
+	if err != nil {
+		return nil, err
+	}
+	def, err := domain.XML()
+	if err != nil {
+		return nil, fmt.Errorf("can't get the definition of domain %q: %v", containerID, err)
+	}
+	if def.Devices == nil {
+		return nil, nil
+	}
+	var jobs []BlockJob
+	for _, disk := range def.Devices.Disks {
+		if disk.Target == nil {
+			continue
+		}
+		info, err := domain.BlockJob(disk.Target.Dev)
+		if err != nil {
+			return nil, fmt.Errorf("can't get block job info for disk %q of domain %q: %v", disk.Target.Dev, containerID, err)
+		}
+		if info == nil {
+			continue
+		}
+		jobs = append(jobs, BlockJob{
+			Disk:     disk.Target.Dev,
+			Type:     info.Type,
+			Progress: blockJobProgress(info),
+		})
+	}
+	return jobs, nil
+}
+
+// CancelBlockJob aborts the block job that's running on the disk
+// of the VM of the specified container. The disk is identified by
+// its target device name, e.g. "vda".
+func (v *VirtualizationTool) CancelBlockJob(containerID, disk string) error {
+	defer v.containerLocks.lock(containerID)()
+
+	domain, err := v.lookupRunningDomain(containerID)
+	if err != nil {
+		return err
+	}
+	info, err := domain.BlockJob(disk)
+	switch {
+	case err != nil:
+		return fmt.Errorf("can't get block job info for disk %q of domain %q: %v", disk, containerID, err)
+	case info == nil:
+		return fmt.Errorf("no block job is running on disk %q of domain %q", disk, containerID)
+	}
+	glog.V(1).Infof("Cancelling %s block job on disk %q of domain %q", info.Type, disk, containerID)
+	if err := domain.AbortBlockJob(disk); err != nil {
+		return fmt.Errorf("can't cancel block job on disk %q of domain %q: %v", disk, containerID, err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+)
+
+func (ct *containerTester) verifyBlockJobs(containerID string, expectedJobs []BlockJob) {
+	jobs, err := ct.virtTool.BlockJobs(containerID)
+	if err != nil {
+		ct.t.Fatalf("BlockJobs(): %v", err)
+	}
+	if !reflect.DeepEqual(jobs, expectedJobs) {
+		ct.t.Errorf("bad block jobs: %#v instead of %#v", jobs, expectedJobs)
+	}
+}
+
+func TestBlockJobs(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	containerID := ct.startMonitorTestContainer()
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+
+	ct.verifyBlockJobs(containerID, nil)
+	if err := ct.virtTool.CancelBlockJob(containerID, "sda"); err == nil {
+		t.Errorf("CancelBlockJob() didn't fail without a block job")
+	}
+
+	if err := domain.(*fake.FakeDomain).StartBlockJob("sda", virt.BlockJobInfo{
+		Type: virt.BlockJobTypeCopy,
+		Cur:  512 * 1024 * 1024,
+		End:  1024 * 1024 * 1024,
+	}); err != nil {
+		t.Fatalf("StartBlockJob(): %v", err)
+	}
+	expectedJobs := []BlockJob{
+		{Disk: "sda", Type: virt.BlockJobTypeCopy, Progress: 50},
+	}
+	ct.verifyBlockJobs(containerID, expectedJobs)
+	if s := expectedJobs[0].String(); s != "sda: copy 50%" {
+		t.Errorf("bad block job description %q", s)
+	}
+
+	if err := ct.virtTool.CancelBlockJob(containerID, "sda"); err != nil {
+		t.Errorf("CancelBlockJob(): %v", err)
+	}
+	ct.verifyBlockJobs(containerID, nil)
+
+	ct.stopContainer(containerID)
+	if _, err := ct.virtTool.BlockJobs(containerID); err == nil {
+		t.Errorf("BlockJobs() didn't fail for a stopped container")
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// bootSlotWaitTimeout is the maximum time StartContainer waits for
+// a free boot slot. It's kept well below the default CRI request
+// timeout of kubelet (2 minutes), as the container lock is held
+// while waiting, blocking the other requests for the container.
+const bootSlotWaitTimeout = time.Minute
+
+var (
+	bootingVMs = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "virtlet",
+			Subsystem: "vm",
+			Name:      "booting",
+			Help:      "Number of VMs that are being started by StartContainer",
+		},
+	)
+	queuedVMBoots = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "virtlet",
+			Subsystem: "vm",
+			Name:      "queued_boots",
+			Help:      "Number of StartContainer calls waiting for the concurrent boot limit",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(bootingVMs, queuedVMBoots)
+}
+
+// BootSlotUnavailableError is returned by StartContainer when the
+// limit of concurrently booting VMs is reached and no boot slot
+// is freed in time. Retrying the operation later may help.
+type BootSlotUnavailableError struct {
+	// ContainerID is the id of the container that couldn't be
+	// started
+	ContainerID string
+	// Timeout is the time spent waiting for a boot slot
+	Timeout time.Duration
+}
+
+func (e *BootSlotUnavailableError) Error() string {
+	return fmt.Sprintf("the limit of concurrently booting VMs is reached, container %q didn't get a boot slot in %v", e.ContainerID, e.Timeout)
+}
+
+// IsBootSlotUnavailable returns true if the error means that the VM
+// couldn't be started because of the concurrent boot limit
+func IsBootSlotUnavailable(err error) bool {
+	_, ok := err.(*BootSlotUnavailableError)
+	return ok
+}
+
+// bootLimiter limits the number of VMs that are in the boot phase
+// (StartContainer) at the same time. The calls over the limit wait
+// for the running ones to finish, but no longer than
+// bootSlotWaitTimeout. The zero value means no limit.
+type bootLimiter struct {
+	slots chan struct{}
+}
+
+func newBootLimiter(maxBoots int) *bootLimiter {
+	if maxBoots <= 0 {
+		return &bootLimiter{}
+	}
+	return &bootLimiter{slots: make(chan struct{}, maxBoots)}
+}
+
+// run runs the specified function that boots a VM once there's a
+// free boot slot. If no slot is freed within bootSlotWaitTimeout,
+// BootSlotUnavailableError is returned without running the function.
+func (l *bootLimiter) run(clock clockwork.Clock, containerID string, boot func() error) error {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			glog.V(2).Infof("The limit of concurrently booting VMs reached, container %q waits for its turn to start", containerID)
+			queuedVMBoots.Inc()
+			select {
+			case l.slots <- struct{}{}:
+				queuedVMBoots.Dec()
+			case <-clock.After(bootSlotWaitTimeout):
+				queuedVMBoots.Dec()
+				return &BootSlotUnavailableError{ContainerID: containerID, Timeout: bootSlotWaitTimeout}
+			}
+		}
+		defer func() { <-l.slots }()
+	}
+	bootingVMs.Inc()
+	defer bootingVMs.Dec()
+	return boot()
+}
+
+// SetMaxConcurrentBoots sets the maximum number of the VMs that can
+// be started by StartContainer at the same time. The StartContainer
+// calls over the limit wait for the running ones to finish, failing
+// with BootSlotUnavailableError if they wait for too long. This
+// limit is independent of the image pull limits. Zero or a negative
+// value means no limit. It must be called before any containers
+// are started.
+func (v *VirtualizationTool) SetMaxConcurrentBoots(maxBoots int) {
+	v.bootLimiter = newBootLimiter(maxBoots)
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+)
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestBootLimiter(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		maxBoots         int
+		expectedMaxBoots int
+	}{
+		{
+			name:             "limited",
+			maxBoots:         3,
+			expectedMaxBoots: 3,
+		},
+		{
+			name:             "unlimited",
+			maxBoots:         0,
+			expectedMaxBoots: 10,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newBootLimiter(tc.maxBoots)
+			var lock sync.Mutex
+			booting, maxBooting := 0, 0
+			release := make(chan struct{})
+			started := make(chan struct{}, 10)
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(n int) {
+					defer wg.Done()
+					if err := l.run(clockwork.NewRealClock(), fmt.Sprintf("container-%d", n), func() error {
+						lock.Lock()
+						booting++
+						if booting > maxBooting {
+							maxBooting = booting
+						}
+						lock.Unlock()
+						started <- struct{}{}
+						<-release
+						lock.Lock()
+						booting--
+						lock.Unlock()
+						return nil
+					}); err != nil {
+						t.Errorf("run(): %v", err)
+					}
+				}(i)
+			}
+
+			for i := 0; i < tc.expectedMaxBoots; i++ {
+				select {
+				case <-started:
+				case <-time.After(10 * time.Second):
+					t.Fatalf("timed out waiting for the boots to start")
+				}
+			}
+			// give the goroutines over the limit a chance to
+			// enter the boot phase if the limit doesn't work
+			time.Sleep(100 * time.Millisecond)
+			if v := gaugeValue(t, bootingVMs); int(v) != tc.expectedMaxBoots {
+				t.Errorf("bad booting VM gauge value %v instead of %d", v, tc.expectedMaxBoots)
+			}
+			if v := gaugeValue(t, queuedVMBoots); int(v) != 10-tc.expectedMaxBoots {
+				t.Errorf("bad queued boot gauge value %v instead of %d", v, 10-tc.expectedMaxBoots)
+			}
+			close(release)
+			wg.Wait()
+
+			if maxBooting != tc.expectedMaxBoots {
+				t.Errorf("max number of concurrent boots %d instead of %d", maxBooting, tc.expectedMaxBoots)
+			}
+			if v := gaugeValue(t, bootingVMs); v != 0 {
+				t.Errorf("booting VM gauge is %v after all the boots finished", v)
+			}
+		})
+	}
+}
+
+func TestBootLimiterPassesErrors(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	ct.virtTool.SetMaxConcurrentBoots(1)
+	if err := ct.virtTool.StartContainer("no-such-container"); err == nil {
+		t.Errorf("StartContainer() didn't fail for a nonexistent container")
+	}
+	// the boot slot must be released after the error
+	if err := ct.virtTool.bootLimiter.run(ct.clock, "container", func() error { return nil }); err != nil {
+		t.Errorf("run(): %v", err)
+	}
+}
+
+func TestBootLimiterTimeout(t *testing.T) {
+	clock := clockwork.NewFakeClockAt(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := newBootLimiter(1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- l.run(clock, "container-1", func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- l.run(clock, "container-2", func() error {
+			t.Errorf("the boot function was called after the boot slot wait timeout")
+			return nil
+		})
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(bootSlotWaitTimeout)
+	select {
+	case err := <-errCh:
+		if !IsBootSlotUnavailable(err) {
+			t.Errorf("run() returned %v instead of BootSlotUnavailableError", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for run() to fail")
+	}
+	if v := gaugeValue(t, queuedVMBoots); v != 0 {
+		t.Errorf("queued boot gauge is %v after the wait timed out", v)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("run(): %v", err)
+	}
+	// the slot of the timed out call isn't taken
+	if err := l.run(clock, "container-3", func() error { return nil }); err != nil {
+		t.Errorf("run(): %v", err)
+	}
+}
@@ -0,0 +1,315 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const (
+	defaultBootTimeout = 10 * time.Minute
+	bootCheckInterval  = time.Second
+)
+
+// BootReadinessSignal denotes the way to find out that the guest
+// OS has finished booting
+type BootReadinessSignal string
+
+const (
+	// BootSignalNone disables boot time measurement
+	BootSignalNone BootReadinessSignal = "none"
+	// BootSignalGuestAgent means that the guest is considered
+	// booted once its guest agent responds to a ping. The VMs
+	// without the guest agent are not measured.
+	BootSignalGuestAgent BootReadinessSignal = "guest-agent"
+	// BootSignalPhoneHome means that the guest is considered
+	// booted once cloud-init phone_home module reports to
+	// Virtlet (see NotifyBootReady)
+	BootSignalPhoneHome BootReadinessSignal = "phone-home"
+	// BootSignalConsole means that the guest is considered booted
+	// once a line matching the specified pattern appears on its
+	// serial console
+	BootSignalConsole BootReadinessSignal = "console"
+)
+
+var vmBootDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "virtlet",
+		Subsystem: "vm",
+		Name:      "boot_duration_seconds",
+		Help:      "Time from StartContainer till the guest OS reports it's ready",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	},
+	[]string{"signal"},
+)
+
+func init() {
+	prometheus.MustRegister(vmBootDuration)
+}
+
+// BootTimeConfig specifies how the boot time of the VMs is measured
+type BootTimeConfig struct {
+	// Signal is the way to find out that the guest OS is ready.
+	// Empty value means BootSignalNone.
+	Signal BootReadinessSignal
+	// PhoneHomeURL is the base URL of Virtlet phone-home endpoint
+	// as seen from the VMs, e.g. http://10.0.0.1:9101/phone-home.
+	// The container id is appended to it. Used with BootSignalPhoneHome.
+	PhoneHomeURL string
+	// ConsolePattern is the regular expression to look for on
+	// the serial console. Used with BootSignalConsole.
+	ConsolePattern string
+	// LogDir is the directory where the pod logs, including the
+	// VM console logs, are stored. Used with BootSignalConsole.
+	LogDir string
+	// Timeout is the time limit for the guest OS to become ready
+	// after which the measurement is abandoned. Zero value means
+	// using the default of 10 minutes.
+	Timeout time.Duration
+}
+
+func (c BootTimeConfig) withDefaults() BootTimeConfig {
+	if c.Signal == "" {
+		c.Signal = BootSignalNone
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultBootTimeout
+	}
+	return c
+}
+
+// bootWatch holds the state of the boot time measurement for a
+// single container
+type bootWatch struct {
+	start   time.Time
+	readyAt time.Time
+}
+
+// SetBootTimeConfig sets the way the boot time of the VMs is measured
+func (v *VirtualizationTool) SetBootTimeConfig(config BootTimeConfig) error {
+	config = config.withDefaults()
+	var consoleRx *regexp.Regexp
+	switch config.Signal {
+	case BootSignalNone, BootSignalGuestAgent:
+	case BootSignalPhoneHome:
+		if config.PhoneHomeURL == "" {
+			return fmt.Errorf("phone home URL must be specified for %q boot readiness signal", config.Signal)
+		}
+	case BootSignalConsole:
+		if config.LogDir == "" {
+			return fmt.Errorf("pod log directory must be specified for %q boot readiness signal", config.Signal)
+		}
+		var err error
+		if consoleRx, err = regexp.Compile(config.ConsolePattern); err != nil || config.ConsolePattern == "" {
+			return fmt.Errorf("bad console pattern %q", config.ConsolePattern)
+		}
+	default:
+		return fmt.Errorf("bad boot readiness signal %q", config.Signal)
+	}
+	v.bootTimeConfig = config
+	v.bootConsoleRx = consoleRx
+	return nil
+}
+
+// bootPhoneHomeURL returns the base phone_home URL to put into
+// cloud-init user-data, or an empty string if phone_home isn't used
+func (v *VirtualizationTool) bootPhoneHomeURL() string {
+	if v.bootTimeConfig.Signal != BootSignalPhoneHome {
+		return ""
+	}
+	return v.bootTimeConfig.PhoneHomeURL
+}
+
+// watchBoot starts measuring the boot time of the VM that was
+// started at the specified time. The measurement ends when the
+// configured readiness signal is received, the domain stops running
+// or the boot timeout expires.
+func (v *VirtualizationTool) watchBoot(containerID string, domain virt.Domain, start time.Time) error {
+	config := v.bootTimeConfig.withDefaults()
+	var check func() (bool, error)
+	switch config.Signal {
+	case BootSignalNone:
+		return nil
+	case BootSignalGuestAgent:
+		switch hasGuestAgent, err := domainHasGuestAgent(domain); {
+		case err != nil:
+			return fmt.Errorf("failed to get the definition of the domain %q: %v", containerID, err)
+		case !hasGuestAgent:
+			return nil
+		}
+		check = func() (bool, error) {
+			return v.guestAgentResponds(domain), nil
+		}
+	case BootSignalPhoneHome:
+		check = func() (bool, error) {
+			return !v.bootReadyAt(containerID).IsZero(), nil
+		}
+	case BootSignalConsole:
+		containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+		if err != nil {
+			return err
+		}
+		if containerInfo == nil {
+			return fmt.Errorf("missing containerInfo for containerID: %s", containerID)
+		}
+		logPath := filepath.Join(config.LogDir, containerInfo.SandboxID, fmt.Sprintf("%s_%d.log", containerInfo.Name, containerInfo.Attempt))
+		check = newConsoleMatcher(logPath, v.bootConsoleRx).check
+	}
+
+	v.bootWatchLock.Lock()
+	v.bootWatches[containerID] = &bootWatch{start: start}
+	v.bootWatchLock.Unlock()
+
+	go func() {
+		defer func() {
+			v.bootWatchLock.Lock()
+			delete(v.bootWatches, containerID)
+			v.bootWatchLock.Unlock()
+		}()
+		err := utils.WaitLoop(func() (bool, error) {
+			state, err := domain.State()
+			if err != nil {
+				return false, err
+			}
+			if state != virt.DomainStateRunning {
+				return false, fmt.Errorf("the domain is not running")
+			}
+			return check()
+		}, bootCheckInterval, config.Timeout-v.clock.Since(start), v.clock)
+		if err != nil {
+			glog.V(2).Infof("Not measuring the boot time of container %q: %v", containerID, err)
+			return
+		}
+		readyAt := v.bootReadyAt(containerID)
+		if readyAt.IsZero() {
+			readyAt = v.clock.Now()
+		}
+		duration := readyAt.Sub(start)
+		glog.V(1).Infof("Container %q booted in %v", containerID, duration)
+		vmBootDuration.WithLabelValues(string(config.Signal)).Observe(duration.Seconds())
+		if err := v.metadataStore.Container(containerID).Save(
+			func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+				if c != nil && c.State == kubeapi.ContainerState_CONTAINER_RUNNING {
+					c.BootDuration = int64(duration)
+				}
+				return c, nil
+			}); err != nil {
+			glog.Warningf("Failed to store the boot time of container %q: %v", containerID, err)
+		}
+	}()
+	return nil
+}
+
+func (v *VirtualizationTool) bootReadyAt(containerID string) time.Time {
+	v.bootWatchLock.Lock()
+	defer v.bootWatchLock.Unlock()
+	if w := v.bootWatches[containerID]; w != nil {
+		return w.readyAt
+	}
+	return time.Time{}
+}
+
+// NotifyBootReady records that the guest OS of the specified
+// container reported that it has finished booting. It's used with
+// BootSignalPhoneHome.
+func (v *VirtualizationTool) NotifyBootReady(containerID string) error {
+	v.bootWatchLock.Lock()
+	defer v.bootWatchLock.Unlock()
+	w := v.bootWatches[containerID]
+	if w == nil {
+		return fmt.Errorf("container %q is not booting", containerID)
+	}
+	if w.readyAt.IsZero() {
+		w.readyAt = v.clock.Now()
+	}
+	return nil
+}
+
+// ContainerBootDuration returns the boot time of the container
+// which was measured during its last start. Zero value means that
+// the boot time is not known.
+func (v *VirtualizationTool) ContainerBootDuration(containerID string) (time.Duration, error) {
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	if err != nil {
+		return 0, err
+	}
+	if containerInfo == nil {
+		return 0, fmt.Errorf("missing containerInfo for containerID: %s", containerID)
+	}
+	return time.Duration(containerInfo.BootDuration), nil
+}
+
+// consoleMatcher looks for a line matching the pattern in the
+// console log written by the stream server. It keeps the offset
+// of the part of the file that's already looked through.
+type consoleMatcher struct {
+	path   string
+	rx     *regexp.Regexp
+	offset int64
+}
+
+func newConsoleMatcher(path string, rx *regexp.Regexp) *consoleMatcher {
+	return &consoleMatcher{path: path, rx: rx}
+}
+
+func (m *consoleMatcher) check() (bool, error) {
+	f, err := os.Open(m.path)
+	if os.IsNotExist(err) {
+		// the console isn't being logged yet
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(m.offset, io.SeekStart); err != nil {
+		return false, err
+	}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// the incomplete line is read again next time
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		m.offset += int64(len(line))
+		var entry struct {
+			Log string `json:"log"`
+		}
+		if json.Unmarshal(line, &entry) == nil && m.rx.MatchString(entry.Log) {
+			return true, nil
+		}
+	}
+}
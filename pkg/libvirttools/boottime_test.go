@@ -0,0 +1,162 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func bootDurationSampleCount(t *testing.T, signal BootReadinessSignal) uint64 {
+	h, err := vmBootDuration.GetMetricWithLabelValues(string(signal))
+	if err != nil {
+		t.Fatalf("GetMetricWithLabelValues(): %v", err)
+	}
+	var m dto.Metric
+	if err := h.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func (ct *containerTester) verifyBootDuration(containerID string, expected time.Duration) {
+	var d time.Duration
+	for i := 0; i < 100; i++ {
+		var err error
+		d, err = ct.virtTool.ContainerBootDuration(containerID)
+		if err != nil {
+			ct.t.Fatalf("ContainerBootDuration(): %v", err)
+		}
+		if d != 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if d != expected {
+		ct.t.Errorf("bad boot duration %v instead of %v", d, expected)
+	}
+}
+
+func TestBootTimePhoneHome(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	if err := ct.virtTool.SetBootTimeConfig(BootTimeConfig{
+		Signal:       BootSignalPhoneHome,
+		PhoneHomeURL: "http://10.0.0.1:9101/phone-home",
+	}); err != nil {
+		t.Fatalf("SetBootTimeConfig(): %v", err)
+	}
+	oldCount := bootDurationSampleCount(t, BootSignalPhoneHome)
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	if err := ct.virtTool.NotifyBootReady(containerID); err == nil {
+		t.Errorf("NotifyBootReady() didn't fail for a container that's not started")
+	}
+	ct.startContainer(containerID)
+
+	ct.clock.BlockUntil(1)
+	ct.clock.Advance(20 * time.Second)
+	// wait for the boot watch to make its check and go to sleep
+	// again, so the readiness is only noticed after the next
+	// check interval
+	ct.clock.BlockUntil(1)
+	if err := ct.virtTool.NotifyBootReady(containerID); err != nil {
+		t.Fatalf("NotifyBootReady(): %v", err)
+	}
+	ct.clock.Advance(bootCheckInterval)
+	ct.verifyBootDuration(containerID, 20*time.Second)
+
+	if count := bootDurationSampleCount(t, BootSignalPhoneHome); count != oldCount+1 {
+		t.Errorf("bad boot duration sample count %d instead of %d", count, oldCount+1)
+	}
+}
+
+func TestBootTimeConsole(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	logDir := filepath.Join(ct.tmpDir, "logs")
+	if err := ct.virtTool.SetBootTimeConfig(BootTimeConfig{
+		Signal:         BootSignalConsole,
+		ConsolePattern: "login:",
+		LogDir:         logDir,
+	}); err != nil {
+		t.Fatalf("SetBootTimeConfig(): %v", err)
+	}
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	ct.startContainer(containerID)
+
+	containerInfo, err := ct.metadataStore.Container(containerID).Retrieve()
+	if err != nil {
+		t.Fatalf("Retrieve(): %v", err)
+	}
+	logPath := filepath.Join(logDir, containerInfo.SandboxID, fmt.Sprintf("%s_%d.log", containerInfo.Name, containerInfo.Attempt))
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		t.Fatalf("MkdirAll(): %v", err)
+	}
+	if err := ioutil.WriteFile(logPath, []byte(`{"log":"Booting...\n","stream":"stdout"}`+"\n"), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		ct.clock.BlockUntil(1)
+		ct.clock.Advance(5 * time.Second)
+	}
+	// make sure the boot watch doesn't check the log while
+	// it's being updated
+	ct.clock.BlockUntil(1)
+
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile(): %v", err)
+	}
+	if _, err := f.WriteString(`{"log":"cirros login: \n","stream":"stdout"}` + "\n"); err != nil {
+		t.Fatalf("WriteString(): %v", err)
+	}
+	f.Close()
+	ct.clock.Advance(5 * time.Second)
+	ct.verifyBootDuration(containerID, 15*time.Second)
+}
+
+func TestBootTimeConfigValidation(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	for _, config := range []BootTimeConfig{
+		{Signal: "foobar"},
+		{Signal: BootSignalPhoneHome},
+		{Signal: BootSignalConsole, LogDir: "/var/log/pods"},
+		{Signal: BootSignalConsole, LogDir: "/var/log/pods", ConsolePattern: "login:("},
+		{Signal: BootSignalConsole, ConsolePattern: "login:"},
+	} {
+		if err := ct.virtTool.SetBootTimeConfig(config); err == nil {
+			t.Errorf("SetBootTimeConfig() didn't fail for %#v", config)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// parseCACerts parses PEM encoded CA certificates. Each PEM block
+// must contain a valid X.509 certificate. The certificates already
+// present in existingCerts and the duplicate ones are skipped. The
+// certificates are appended to existingCerts in PEM format and the
+// resulting list is returned.
+func parseCACerts(existingCerts []string, data string) ([]string, error) {
+	seen := make(map[string]bool)
+	for _, c := range existingCerts {
+		seen[c] = true
+	}
+	rest := []byte(data)
+	for n := 1; ; n++ {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("PEM block %d: unexpected block type %q, expected CERTIFICATE", n, block.Type)
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, fmt.Errorf("PEM block %d: bad certificate: %v", n, err)
+		}
+		cert := string(pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: block.Bytes}))
+		if seen[cert] {
+			continue
+		}
+		seen[cert] = true
+		existingCerts = append(existingCerts, cert)
+	}
+	if len(bytes.TrimSpace(rest)) != 0 {
+		return nil, fmt.Errorf("the data contains something besides PEM encoded certificates")
+	}
+	return existingCerts, nil
+}
+
+// caCertsUserData returns cloud-init ca_certs settings for the
+// specified CA certificates
+func caCertsUserData(certs []string, removeDefaults bool) map[string]interface{} {
+	var trusted []interface{}
+	for _, cert := range certs {
+		trusted = append(trusted, cert)
+	}
+	r := map[string]interface{}{
+		"trusted": trusted,
+	}
+	if removeDefaults {
+		r["remove_defaults"] = true
+	}
+	return r
+}
@@ -30,16 +30,15 @@ import (
 )
 
 type cephFlexvolumeOptions struct {
-	// Type field is needed here so it gets written during
-	// remarshalling after removing the contents of 'Secret' field
-	Type     string `json:"type"`
-	Monitor  string `json:"monitor"`
-	Pool     string `json:"pool"`
-	Volume   string `json:"volume"`
-	Secret   string `json:"secret"`
-	User     string `json:"user"`
-	Protocol string `json:"protocol"`
-	UUID     string `json:"uuid"`
+	Monitor string `json:"monitor"`
+	Pool    string `json:"pool"`
+	Volume  string `json:"volume"`
+	Secret  string `json:"secret"`
+	// SecretUUID refers to an existing libvirt secret that's
+	// managed outside Virtlet. It can't be used together with Secret.
+	SecretUUID string `json:"secretUUID"`
+	User       string `json:"user"`
+	Protocol   string `json:"protocol"`
 }
 
 // cephVolume denotes a Ceph RBD volume
@@ -49,25 +48,32 @@ type cephVolume struct {
 	opts       *cephFlexvolumeOptions
 }
 
-var _ VMVolume = &cephVolume{}
+var _ VolumeDriver = &cephVolume{}
 
-func newCephVolume(volumeName, configPath string, config *VMConfig, owner volumeOwner) (VMVolume, error) {
-	v := &cephVolume{
-		volumeBase: volumeBase{config, owner},
+func (v *cephVolume) Name() string { return "ceph" }
+
+func (v *cephVolume) Prepare(info *FlexvolumeInfo) error {
+	if err := utils.ReadJSON(info.ConfigPath, &v.opts); err != nil {
+		return fmt.Errorf("failed to parse ceph flexvolume config %q: %v", info.ConfigPath, err)
 	}
-	if err := utils.ReadJSON(configPath, &v.opts); err != nil {
-		return nil, fmt.Errorf("failed to parse ceph flexvolume config %q: %v", configPath, err)
+	if v.opts.Secret != "" && v.opts.SecretUUID != "" {
+		return fmt.Errorf("ceph flexvolume config %q: secret and secretUUID can't be specified at the same time", info.ConfigPath)
 	}
-	v.volumeName = volumeName
+	v.volumeBase = volumeBase{info.Config, info.Owner}
+	v.volumeName = info.Name
 	// Remove the key from flexvolume options to limit exposure.
 	// The file itself will be needed to recreate cephVolume during the teardown,
-	// but we don't need secret content at that time anymore
-	safeOpts := *v.opts
-	safeOpts.Secret = ""
-	if err := utils.WriteJSON(configPath, safeOpts, 0700); err != nil {
-		return nil, fmt.Errorf("failed to overwrite ceph flexvolume config %q: %v", configPath, err)
+	// but we don't need secret content at that time anymore.
+	// The rest of the options are kept intact.
+	var safeOpts map[string]interface{}
+	if err := utils.ReadJSON(info.ConfigPath, &safeOpts); err != nil {
+		return fmt.Errorf("failed to parse ceph flexvolume config %q: %v", info.ConfigPath, err)
+	}
+	delete(safeOpts, "secret")
+	if err := utils.WriteJSON(info.ConfigPath, safeOpts, 0700); err != nil {
+		return fmt.Errorf("failed to overwrite ceph flexvolume config %q: %v", info.ConfigPath, err)
 	}
-	return v, nil
+	return nil
 }
 
 func (v *cephVolume) secretUsageName() string {
@@ -88,28 +94,15 @@ func (v *cephVolume) secretDef() *libvirtxml.Secret {
 	}
 }
 
-func (v *cephVolume) UUID() string {
-	return v.opts.UUID
-}
-
-func (v *cephVolume) Setup() (*libvirtxml.DomainDisk, error) {
+func (v *cephVolume) DiskXML() (*libvirtxml.DomainDisk, error) {
 	ipPortPair := strings.Split(v.opts.Monitor, ":")
 	if len(ipPortPair) != 2 {
 		return nil, fmt.Errorf("invalid format of ceph monitor setting: %s. Expected ip:port", v.opts.Monitor)
 	}
 
-	secret, err := v.owner.DomainConnection().DefineSecret(v.secretDef())
+	diskSecret, err := v.setupSecret()
 	if err != nil {
-		return nil, fmt.Errorf("error defining ceph secret: %v", err)
-	}
-
-	key, err := base64.StdEncoding.DecodeString(v.opts.Secret)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding ceph secret: %v", err)
-	}
-
-	if err := secret.SetValue([]byte(key)); err != nil {
-		return nil, fmt.Errorf("error setting value of secret %q: %v", v.secretUsageName(), err)
+		return nil, err
 	}
 
 	return &libvirtxml.DomainDisk{
@@ -117,10 +110,7 @@ func (v *cephVolume) Setup() (*libvirtxml.DomainDisk, error) {
 		Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw"},
 		Auth: &libvirtxml.DomainDiskAuth{
 			Username: v.opts.User,
-			Secret: &libvirtxml.DomainDiskSecret{
-				Type:  "ceph",
-				Usage: v.secretUsageName(),
-			},
+			Secret:   diskSecret,
 		},
 		Source: &libvirtxml.DomainDiskSource{
 			Network: &libvirtxml.DomainDiskSourceNetwork{
@@ -137,7 +127,44 @@ func (v *cephVolume) Setup() (*libvirtxml.DomainDisk, error) {
 	}, nil
 }
 
+// setupSecret returns the secret reference for the disk definition.
+// If the flexvolume refers to an existing libvirt secret by its
+// UUID, the secret is only verified to exist, otherwise a new
+// secret with the key from the flexvolume is defined.
+func (v *cephVolume) setupSecret() (*libvirtxml.DomainDiskSecret, error) {
+	if v.opts.SecretUUID != "" {
+		_, err := v.owner.DomainConnection().LookupSecretByUUIDString(v.opts.SecretUUID)
+		switch {
+		case err == virt.ErrSecretNotFound:
+			return nil, fmt.Errorf("libvirt secret %q referenced by ceph volume %q not found", v.opts.SecretUUID, v.volumeName)
+		case err != nil:
+			return nil, fmt.Errorf("error looking up libvirt secret %q: %v", v.opts.SecretUUID, err)
+		}
+		return &libvirtxml.DomainDiskSecret{Type: "ceph", UUID: v.opts.SecretUUID}, nil
+	}
+
+	secret, err := v.owner.DomainConnection().DefineSecret(v.secretDef())
+	if err != nil {
+		return nil, fmt.Errorf("error defining ceph secret: %v", err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(v.opts.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding ceph secret: %v", err)
+	}
+
+	if err := secret.SetValue([]byte(key)); err != nil {
+		return nil, fmt.Errorf("error setting value of secret %q: %v", v.secretUsageName(), err)
+	}
+
+	return &libvirtxml.DomainDiskSecret{Type: "ceph", Usage: v.secretUsageName()}, nil
+}
+
 func (v *cephVolume) Teardown() error {
+	if v.opts.SecretUUID != "" {
+		// the secret is managed outside Virtlet
+		return nil
+	}
 	secret, err := v.owner.DomainConnection().LookupSecretByUsageName("ceph", v.secretUsageName())
 	switch {
 	case err == virt.ErrSecretNotFound:
@@ -155,7 +182,5 @@ func (v *cephVolume) Teardown() error {
 }
 
 func init() {
-	addFlexvolumeSource("ceph", newCephVolume)
+	RegisterVolumeDriver(func() VolumeDriver { return &cephVolume{} })
 }
-
-// TODO: this file needs a test
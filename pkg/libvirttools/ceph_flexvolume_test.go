@@ -0,0 +1,112 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+const fakeExternalSecretUUID = "6a1b9e3c-b357-4e4b-91c3-5f4e2d7a4df1"
+
+func (ct *containerTester) setupCephSecretUUIDVolume(sandbox *kubeapi.PodSandboxConfig, secretUUID string) {
+	volDir := filepath.Join(ct.kubeletRootDir, sandbox.Metadata.Uid, flexvolumeSubdir, "ceph")
+	if err := os.MkdirAll(volDir, 0755); err != nil {
+		ct.t.Fatalf("MkdirAll(): %v", err)
+	}
+	if err := utils.WriteJSON(filepath.Join(volDir, flexvolumeDataFile), map[string]string{
+		"type":       "ceph",
+		"monitor":    "127.0.0.1:6789",
+		"pool":       "libvirt-pool",
+		"volume":     "rbd-test-image",
+		"user":       "libvirt",
+		"secretUUID": secretUUID,
+		"uuid":       fakeUUID,
+	}, 0700); err != nil {
+		ct.t.Fatalf("WriteJSON(): %v", err)
+	}
+}
+
+func TestCephVolumeWithExistingSecret(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	// the secret is managed outside Virtlet
+	if _, err := ct.domainConn.DefineSecret(&libvirtxml.Secret{
+		Ephemeral: "no",
+		Private:   "no",
+		UUID:      fakeExternalSecretUUID,
+		Usage:     &libvirtxml.SecretUsage{Name: "external-ceph-secret", Type: "ceph"},
+	}); err != nil {
+		t.Fatalf("DefineSecret(): %v", err)
+	}
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	ct.setupCephSecretUUIDVolume(sandbox, fakeExternalSecretUUID)
+
+	containerID := ct.createContainer(sandbox, nil)
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	def, err := domain.XML()
+	if err != nil {
+		t.Fatalf("XML(): %v", err)
+	}
+	var cephDisk *libvirtxml.DomainDisk
+	for n, disk := range def.Devices.Disks {
+		if disk.Source != nil && disk.Source.Network != nil && disk.Source.Network.Protocol == "rbd" {
+			cephDisk = &def.Devices.Disks[n]
+		}
+	}
+	switch {
+	case cephDisk == nil:
+		t.Fatalf("ceph disk not found in the domain:\n%s", spew.Sdump(def.Devices.Disks))
+	case cephDisk.Auth == nil || cephDisk.Auth.Secret == nil:
+		t.Fatalf("ceph disk has no auth secret:\n%s", spew.Sdump(cephDisk))
+	case cephDisk.Auth.Secret.UUID != fakeExternalSecretUUID || cephDisk.Auth.Secret.Usage != "":
+		t.Errorf("bad ceph disk secret reference:\n%s", spew.Sdump(cephDisk.Auth.Secret))
+	}
+
+	ct.removeContainer(containerID)
+	if _, err := ct.domainConn.LookupSecretByUUIDString(fakeExternalSecretUUID); err != nil {
+		t.Errorf("the external secret was removed together with the container: %v", err)
+	}
+}
+
+func TestCephVolumeWithMissingSecret(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	ct.setupCephSecretUUIDVolume(sandbox, fakeExternalSecretUUID)
+
+	if _, err := ct.virtTool.CreateContainer(ct.vmConfig(sandbox, nil), "/tmp/fakenetns"); err == nil {
+		t.Errorf("CreateContainer() didn't fail for a missing ceph secret")
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+var (
+	qemuPidDir = "/var/run/libvirt/qemu"
+	cgroupRoot = "/sys/fs/cgroup"
+)
+
+// CgroupStats contains the resource usage of the cgroup of the
+// hypervisor (QEMU) process of a VM as seen from the host, which
+// includes both the resources consumed by the guest and the overhead
+// of the hypervisor
+type CgroupStats struct {
+	// CPUTime is the CPU time used by the processes of the cgroup
+	// in nanoseconds
+	CPUTime uint64
+	// MemoryUsage is the memory used by the processes of the
+	// cgroup in bytes
+	MemoryUsage uint64
+}
+
+// HostUsage describes the resources used by a VM on the host
+// along with the hypervisor overhead, that is, the part of them
+// that isn't consumed by the guest
+type HostUsage struct {
+	CgroupStats
+	// CPUOverhead is the CPU time used by the hypervisor process
+	// on top of the CPU time used by the guest in nanoseconds
+	CPUOverhead uint64
+	// MemoryOverhead is the memory used by the hypervisor process
+	// on top of the memory of the guest in bytes
+	MemoryOverhead uint64
+}
+
+func readCgroupValue(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad value in %q: %v", path, err)
+	}
+	return v, nil
+}
+
+// readCgroupV2CPUTime reads the CPU time in nanoseconds from
+// cpu.stat file of a cgroup v2 cgroup
+func readCgroupV2CPUTime(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			v, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("bad usage_usec value in %q: %v", path, err)
+			}
+			return v * 1000, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("usage_usec not found in %q", path)
+}
+
+// qemuPID returns the pid of the QEMU process of the domain with
+// the specified name
+func qemuPID(domainName string) (string, error) {
+	pidFile := filepath.Join(qemuPidDir, domainName+".pid")
+	pidData, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return "", fmt.Errorf("can't read QEMU pid file: %v", err)
+	}
+	return strings.TrimSpace(string(pidData)), nil
+}
+
+// getCgroupStats retrieves the resource usage of the cgroup of the
+// QEMU process of the domain with the specified name. Both cgroup v1
+// (cpuacct and memory controllers) and cgroup v2 hierarchies are
+// supported.
+func getCgroupStats(domainName string) (*CgroupStats, error) {
+	pid, err := qemuPID(domainName)
+	if err != nil {
+		return nil, err
+	}
+	cgroupData, err := ioutil.ReadFile(filepath.Join("/proc", pid, "cgroup"))
+	if err != nil {
+		return nil, fmt.Errorf("can't read the cgroups of QEMU process %s: %v", pid, err)
+	}
+
+	var cpuPath, memoryPath, unifiedPath string
+	for _, line := range strings.Split(string(cgroupData), "\n") {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			unifiedPath = parts[2]
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			switch controller {
+			case "cpuacct":
+				cpuPath = filepath.Join(cgroupRoot, parts[1], parts[2], "cpuacct.usage")
+			case "memory":
+				memoryPath = filepath.Join(cgroupRoot, parts[1], parts[2], "memory.usage_in_bytes")
+			}
+		}
+	}
+
+	var stats CgroupStats
+	switch {
+	case cpuPath != "" && memoryPath != "":
+		if stats.CPUTime, err = readCgroupValue(cpuPath); err != nil {
+			return nil, err
+		}
+		if stats.MemoryUsage, err = readCgroupValue(memoryPath); err != nil {
+			return nil, err
+		}
+	case unifiedPath != "":
+		dir := filepath.Join(cgroupRoot, unifiedPath)
+		if stats.CPUTime, err = readCgroupV2CPUTime(filepath.Join(dir, "cpu.stat")); err != nil {
+			return nil, err
+		}
+		if stats.MemoryUsage, err = readCgroupValue(filepath.Join(dir, "memory.current")); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("cpuacct and memory cgroups of QEMU process %s not found", pid)
+	}
+	return &stats, nil
+}
+
+// guestCPUTime returns the CPU time used by the guest, falling back
+// to the CPU time of the whole domain if the time of the virtual CPUs
+// isn't known
+func guestCPUTime(stats *virt.DomainStats) uint64 {
+	if stats.VCPUTime != 0 {
+		return stats.VCPUTime
+	}
+	return stats.CPUTime
+}
+
+// guestMemoryUsage returns the memory used by the guest in bytes,
+// which is the current balloon size less the memory the guest
+// reports as unused
+func guestMemoryUsage(stats *virt.DomainStats) uint64 {
+	return overhead(stats.BalloonMemory, stats.UnusedMemory) * 1024
+}
+
+func overhead(total, used uint64) uint64 {
+	if total < used {
+		return 0
+	}
+	return total - used
+}
+
+// HostUsage returns the resources used on the host by the running
+// VM of the specified container. The overhead is calculated using
+// the CPU time of the virtual CPUs and the current memory size of
+// the guest.
+func (v *VirtualizationTool) HostUsage(containerID string) (*HostUsage, error) {
+	domain, err := v.lookupRunningDomain(containerID)
+	if err != nil {
+		return nil, err
+	}
+	name, err := domain.Name()
+	if err != nil {
+		return nil, fmt.Errorf("can't get the name of domain %q: %v", containerID, err)
+	}
+	cgroupStats, err := v.cgroupStatsGetter(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't get cgroup stats of domain %q: %v", containerID, err)
+	}
+	domainStats, err := domain.Stats()
+	if err != nil {
+		return nil, fmt.Errorf("can't get stats of domain %q: %v", containerID, err)
+	}
+	return &HostUsage{
+		CgroupStats:    *cgroupStats,
+		CPUOverhead:    overhead(cgroupStats.CPUTime, guestCPUTime(domainStats)),
+		MemoryOverhead: overhead(cgroupStats.MemoryUsage, domainStats.BalloonMemory*1024),
+	}, nil
+}
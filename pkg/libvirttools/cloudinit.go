@@ -49,8 +49,12 @@ const (
 // CloudInitGenerator provides a common part for Cloud Init ISO drive preparation
 // for NoCloud and ConfigDrive volume sources.
 type CloudInitGenerator struct {
-	config *VMConfig
-	isoDir string
+	config  *VMConfig
+	isoDir  string
+	isoPath string
+	// secondary makes the generator produce the secondary ISO
+	// image of the dual config layout
+	secondary bool
 }
 
 // NewCloudInitGenerator returns new CloudInitGenerator.
@@ -62,12 +66,20 @@ func NewCloudInitGenerator(config *VMConfig, isoDir string) *CloudInitGenerator
 }
 
 func (g *CloudInitGenerator) generateMetaData() ([]byte, error) {
+	return g.generateMetaDataForImageType(g.config.ParsedAnnotations.ImageType)
+}
+
+func (g *CloudInitGenerator) instanceID() string {
+	return fmt.Sprintf("%s.%s", g.config.PodName, g.config.PodNamespace)
+}
+
+func (g *CloudInitGenerator) generateMetaDataForImageType(t imageType) ([]byte, error) {
 	m := map[string]interface{}{
-		"instance-id":    fmt.Sprintf("%s.%s", g.config.PodName, g.config.PodNamespace),
+		"instance-id":    g.instanceID(),
 		"local-hostname": g.config.PodName,
 	}
 
-	if g.config.ParsedAnnotations.ImageType == imageTypeConfigDrive {
+	if t == imageTypeConfigDrive {
 		m["uuid"] = m["instance-id"]
 		m["hostname"] = m["local-hostname"]
 	}
@@ -84,6 +96,10 @@ func (g *CloudInitGenerator) generateMetaData() ([]byte, error) {
 		m[k] = v
 	}
 
+	if seedFrom := g.config.ParsedAnnotations.SeedFrom; seedFrom != "" {
+		m["seedfrom"] = seedFrom
+	}
+
 	r, err := json.Marshal(m)
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling meta-data: %v", err)
@@ -99,6 +115,23 @@ func (g *CloudInitGenerator) generateUserData(volumeMap diskPathMap) ([]byte, er
 		return []byte(strings.Replace(userDataScript, mountScriptSubst, mountScript, -1)), nil
 	}
 
+	if g.config.ParsedAnnotations.SeedFrom != "" {
+		// the guest fetches its user-data from the seedfrom URL
+		if len(mounts) != 0 {
+			glog.Warningf("Pod %s/%s: the volume mounts aren't added to user-data when %s is used", g.config.PodNamespace, g.config.PodName, seedFromKeyName)
+		}
+		return []byte("#cloud-config\n"), nil
+	}
+
+	if raw := g.config.ParsedAnnotations.UserDataRaw; raw != nil {
+		// multipart and compressed user-data can't be merged with
+		// the generated cloud-config
+		if len(mounts) != 0 || len(g.config.ParsedAnnotations.SSHKeys) != 0 {
+			glog.Warningf("Pod %s/%s: the volume mounts and SSH keys aren't added to MIME multipart or compressed user-data", g.config.PodNamespace, g.config.PodName)
+		}
+		return raw, nil
+	}
+
 	userData := make(map[string]interface{})
 	for k, v := range g.config.ParsedAnnotations.UserData {
 		userData[k] = v
@@ -109,6 +142,22 @@ func (g *CloudInitGenerator) generateUserData(volumeMap diskPathMap) ([]byte, er
 		userData["mounts"] = mounts
 	}
 
+	g.addUser(userData)
+	g.addSSHHostKeys(userData)
+
+	if caCerts := g.config.ParsedAnnotations.CACerts; len(caCerts) != 0 {
+		userData["ca_certs"] = utils.Merge(userData["ca_certs"], caCertsUserData(caCerts, g.config.ParsedAnnotations.CACertsRemoveDefaults))
+	}
+
+	if powerState := g.config.ParsedAnnotations.PowerState; powerState != nil {
+		userData["power_state"] = powerState
+	}
+
+	g.addPhoneHome(userData)
+	g.addGrowpart(userData)
+	g.addRootfsOverlay(userData, volumeMap)
+	g.addScratchDisk(userData, volumeMap)
+
 	writeFilesUpdater := newWriteFilesUpdater(g.config.Mounts)
 	writeFilesUpdater.addSecrets()
 	writeFilesUpdater.addConfigMapEntries()
@@ -132,15 +181,118 @@ func (g *CloudInitGenerator) generateUserData(volumeMap diskPathMap) ([]byte, er
 	return []byte("#cloud-config\n" + string(r)), nil
 }
 
+// addPhoneHome makes cloud-init report to Virtlet once the VM
+// is booted, so its boot time can be measured. phone_home
+// specified in the user-data itself takes precedence.
+func (g *CloudInitGenerator) addPhoneHome(userData map[string]interface{}) {
+	url := g.config.BootPhoneHomeURL
+	if url == "" {
+		return
+	}
+	if _, found := userData["phone_home"]; found {
+		return
+	}
+	userData["phone_home"] = map[string]interface{}{
+		"url":   strings.TrimSuffix(url, "/") + "/" + g.config.DomainUUID,
+		"post":  []interface{}{"instance_id"},
+		"tries": 10,
+	}
+}
+
+// addGrowpart makes cloud-init growpart module grow the devices
+// specified via VirtletGrowpartDevices annotation instead of the
+// root partition only. growpart specified in the user-data itself
+// takes precedence.
+func (g *CloudInitGenerator) addGrowpart(userData map[string]interface{}) {
+	devices := g.config.ParsedAnnotations.GrowpartDevices
+	if len(devices) == 0 {
+		return
+	}
+	if _, found := userData["growpart"]; found {
+		return
+	}
+	var deviceList []interface{}
+	for _, device := range devices {
+		deviceList = append(deviceList, device)
+	}
+	userData["growpart"] = map[string]interface{}{
+		"mode":    "auto",
+		"devices": deviceList,
+	}
+}
+
+// addSSHHostKeys adds the pre-generated SSH host keys specified
+// via VirtletSSHHostKeySource annotation to the user-data, so the
+// VM keeps its host keys when it's re-created. ssh_keys specified
+// in the user-data itself take precedence.
+func (g *CloudInitGenerator) addSSHHostKeys(userData map[string]interface{}) {
+	hostKeys := g.config.ParsedAnnotations.SSHHostKeys
+	if len(hostKeys) == 0 {
+		return
+	}
+	if _, found := userData["ssh_keys"]; found {
+		return
+	}
+	keys := make(map[string]interface{})
+	for name, key := range hostKeys {
+		keys[name] = key
+	}
+	userData["ssh_keys"] = keys
+}
+
+// addUser adds the user specified via VirtletUser annotation
+// to the user-data, enabling ssh password authentication if the
+// password hash is specified, too
+func (g *CloudInitGenerator) addUser(userData map[string]interface{}) {
+	userName := g.config.ParsedAnnotations.User
+	if userName == "" {
+		return
+	}
+
+	user := map[string]interface{}{
+		"name": userName,
+	}
+	if len(g.config.ParsedAnnotations.SSHKeys) != 0 {
+		var keys []interface{}
+		for _, key := range g.config.ParsedAnnotations.SSHKeys {
+			keys = append(keys, key)
+		}
+		user["ssh_authorized_keys"] = keys
+	}
+	passwordHash := g.config.ParsedAnnotations.UserPassword
+	if passwordHash != "" {
+		user["passwd"] = passwordHash
+		user["lock_passwd"] = false
+	}
+
+	// keep the default user of the image
+	users := []interface{}{"default", user}
+	userData["users"] = utils.Merge(userData["users"], users)
+
+	if passwordHash == "" {
+		return
+	}
+	if _, found := userData["ssh_pwauth"]; !found {
+		userData["ssh_pwauth"] = true
+	}
+	if _, found := userData["chpasswd"]; !found {
+		userData["chpasswd"] = map[string]interface{}{"expire": false}
+	}
+}
+
 func (g *CloudInitGenerator) generateNetworkConfiguration() ([]byte, error) {
-	switch g.config.ParsedAnnotations.ImageType {
+	return g.generateNetworkConfigurationForImageType(g.config.ParsedAnnotations.ImageType)
+}
+
+func (g *CloudInitGenerator) generateNetworkConfigurationForImageType(t imageType) ([]byte, error) {
+	switch t {
 	case imageTypeNoCloud:
 		return g.generateNetworkConfigurationNoCloud()
 	case imageTypeConfigDrive:
 		return g.generateNetworkConfigurationConfigDrive()
 	}
 
-	return nil, fmt.Errorf("unknown cloud-init config image type: %q", g.config.ParsedAnnotations.ImageType)
+	return nil, fmt.Errorf("unknown cloud-init config image type: %q", t)
 }
 
 func (g *CloudInitGenerator) generateNetworkConfigurationNoCloud() ([]byte, error) {
@@ -150,6 +302,7 @@ func (g *CloudInitGenerator) generateNetworkConfigurationNoCloud() ([]byte, erro
 		return []byte("version: 1\n"), nil
 	}
 	cniResult := g.config.ContainerSideNetwork.Result
+	policy := g.config.ParsedAnnotations.IPConfigPolicy
 
 	var config []map[string]interface{}
 	var gateways []net.IP
@@ -162,6 +315,7 @@ func (g *CloudInitGenerator) generateNetworkConfigurationNoCloud() ([]byte, erro
 		}
 		subnets, curGateways := g.getSubnetsAndGatewaysForNthInterface(i, cniResult)
 		gateways = append(gateways, curGateways...)
+		subnets = applyIPConfigPolicy(policy, subnets)
 		mtu, err := mtuForMacAddress(iface.Mac, g.config.ContainerSideNetwork.Interfaces)
 		if err != nil {
 			return nil, err
@@ -176,6 +330,12 @@ func (g *CloudInitGenerator) generateNetworkConfigurationNoCloud() ([]byte, erro
 		config = append(config, interfaceConf)
 	}
 
+	// with DHCP, the guest gets routes and DNS settings
+	// from Virtlet's DHCP server
+	if policy == ipConfigDHCP {
+		return marshalNetworkConfigV1(config)
+	}
+
 	// routes
 	gotDefault := false
 	for _, cniRoute := range cniResult.Routes {
@@ -213,6 +373,10 @@ func (g *CloudInitGenerator) generateNetworkConfigurationNoCloud() ([]byte, erro
 		config = append(config, dnsData...)
 	}
 
+	return marshalNetworkConfigV1(config)
+}
+
+func marshalNetworkConfigV1(config []map[string]interface{}) ([]byte, error) {
 	r, err := yaml.Marshal(map[string]interface{}{
 		"config": config,
 	})
@@ -222,6 +386,26 @@ func (g *CloudInitGenerator) generateNetworkConfigurationNoCloud() ([]byte, erro
 	return []byte("version: 1\n" + string(r)), nil
 }
 
+// applyIPConfigPolicy updates the list of NoCloud subnets of an
+// interface according to VirtletIPConfigPolicy. With DHCP fallback,
+// cloud-init brings up the static address together with DHCP, so
+// the interface gets an address even if the static one doesn't work.
+func applyIPConfigPolicy(policy ipConfigPolicy, subnets []map[string]interface{}) []map[string]interface{} {
+	dhcpSubnet := map[string]interface{}{"type": "dhcp"}
+	switch {
+	case policy == ipConfigDHCP:
+		return []map[string]interface{}{dhcpSubnet}
+	case policy != ipConfigStaticWithFallback:
+		return subnets
+	}
+	for _, subnet := range subnets {
+		if subnet["type"] == "dhcp" {
+			return subnets
+		}
+	}
+	return append(subnets, dhcpSubnet)
+}
+
 func (g *CloudInitGenerator) getSubnetsAndGatewaysForNthInterface(interfaceNo int, cniResult *cnicurrent.Result) ([]map[string]interface{}, []net.IP) {
 	var subnets []map[string]interface{}
 	var gateways []net.IP
@@ -299,8 +483,12 @@ func (g *CloudInitGenerator) generateNetworkConfigurationConfigDrive() ([]byte,
 	}
 	config["links"] = links
 
+	policy := g.config.ParsedAnnotations.IPConfigPolicy
 	var networks []map[string]interface{}
 	for i, ipConfig := range cniResult.IPs {
+		if policy == ipConfigDHCP {
+			break
+		}
 		netConf := map[string]interface{}{
 			"id": fmt.Sprintf("net-%d", i),
 			// config from openstack have as network_id network uuid
@@ -318,10 +506,23 @@ func (g *CloudInitGenerator) generateNetworkConfigurationConfigDrive() ([]byte,
 
 		networks = append(networks, netConf)
 	}
+	if policy == ipConfigDHCP || policy == ipConfigStaticWithFallback {
+		for _, link := range links {
+			id := fmt.Sprintf("net-%d", len(networks))
+			networks = append(networks, map[string]interface{}{
+				"id":         id,
+				"network_id": id,
+				"type":       "ipv4_dhcp",
+				"link":       link["id"],
+			})
+		}
+	}
 	config["networks"] = networks
 
+	// with DHCP, the guest gets DNS settings from Virtlet's
+	// DHCP server
 	dnsData := getDNSData(cniResult.DNS)
-	if dnsData != nil {
+	if dnsData != nil && policy != ipConfigDHCP {
 		config["services"] = dnsData
 	}
 
@@ -363,6 +564,12 @@ func mtuForMacAddress(mac string, ifaces []*network.InterfaceDescription) (uint1
 
 // IsoPath returns a full path to iso image with configuration for VM pod.
 func (g *CloudInitGenerator) IsoPath() string {
+	if g.isoPath != "" {
+		return g.isoPath
+	}
+	if g.secondary {
+		return filepath.Join(g.isoDir, fmt.Sprintf("config-%s-secondary.iso", g.config.DomainUUID))
+	}
 	return filepath.Join(g.isoDir, fmt.Sprintf("config-%s.iso", g.config.DomainUUID))
 }
 
@@ -377,6 +584,42 @@ func (g *CloudInitGenerator) DiskDef() *libvirtxml.DomainDisk {
 	}
 }
 
+// configImageLayout describes the locations of the files and the
+// default volume label of a config ISO type
+type configImageLayout struct {
+	userData, metaData, networkConfig, label string
+}
+
+var configImageLayouts = map[imageType]configImageLayout{
+	imageTypeNoCloud: {
+		userData:      "user-data",
+		metaData:      "meta-data",
+		networkConfig: "network-config",
+		label:         "cidata",
+	},
+	imageTypeConfigDrive: {
+		userData:      "openstack/latest/user_data",
+		metaData:      "openstack/latest/meta_data.json",
+		networkConfig: "openstack/latest/network_data.json",
+		label:         "config-2",
+	},
+}
+
+// configImageType returns the type of the config ISO the generator
+// produces. With the dual config layout, the secondary ISO image has
+// the type other than the one specified by VirtletCloudInitImageType
+// annotation.
+func (g *CloudInitGenerator) configImageType() imageType {
+	t := g.config.ParsedAnnotations.ImageType
+	if !g.secondary {
+		return t
+	}
+	if t == imageTypeConfigDrive {
+		return imageTypeNoCloud
+	}
+	return imageTypeConfigDrive
+}
+
 // GenerateImage collects metadata, userdata and network configuration and uses
 // them to prepare an ISO image for NoCloud or ConfigDrive selecting the type
 // using an info from pod annotations.
@@ -387,48 +630,51 @@ func (g *CloudInitGenerator) GenerateImage(volumeMap diskPathMap) error {
 	}
 	defer os.RemoveAll(tmpDir)
 
-	var metaData, userData, networkConfiguration []byte
-	metaData, err = g.generateMetaData()
-	if err == nil {
-		userData, err = g.generateUserData(volumeMap)
+	t := g.configImageType()
+	layout, found := configImageLayouts[t]
+	if !found {
+		// that should newer happen, as imageType should be validated
+		// already earlier
+		return fmt.Errorf("unknown cloud-init config image type: %q", t)
+	}
+
+	metaData, err := g.generateMetaDataForImageType(t)
+	if err != nil {
+		return err
 	}
-	if err == nil {
-		networkConfiguration, err = g.generateNetworkConfiguration()
+	userData, err := g.generateUserData(volumeMap)
+	if err != nil {
+		return err
 	}
+	networkConfiguration, err := g.generateNetworkConfigurationForImageType(t)
 	if err != nil {
 		return err
 	}
+	files := map[string][]byte{
+		layout.userData:      userData,
+		layout.metaData:      metaData,
+		layout.networkConfig: networkConfiguration,
+	}
 
-	var userDataLocation, metaDataLocation, networkConfigLocation string
-	var volumeName string
+	if g.usesFwCfg() {
+		return g.writeSeedFiles(files)
+	}
 
-	switch g.config.ParsedAnnotations.ImageType {
-	case imageTypeNoCloud:
-		userDataLocation = "user-data"
-		metaDataLocation = "meta-data"
-		networkConfigLocation = "network-config"
-		volumeName = "cidata"
-	case imageTypeConfigDrive:
-		userDataLocation = "openstack/latest/user_data"
-		metaDataLocation = "openstack/latest/meta_data.json"
-		networkConfigLocation = "openstack/latest/network_data.json"
-		volumeName = "config-2"
-	default:
-		// that should newer happen, as imageType should be validated
-		// already earlier
-		return fmt.Errorf("unknown cloud-init config image type: %q", g.config.ParsedAnnotations.ImageType)
+	// the datasources of cloud-init look for the volumes by
+	// their labels, so the custom label is only applied to the
+	// primary ISO image
+	volumeName := layout.label
+	if !g.secondary && g.config.ParsedAnnotations.ImageLabel != "" {
+		volumeName = g.config.ParsedAnnotations.ImageLabel
 	}
 
-	if err := utils.WriteFiles(tmpDir, map[string][]byte{
-		userDataLocation:      userData,
-		metaDataLocation:      metaData,
-		networkConfigLocation: networkConfiguration,
-	}); err != nil {
+	if err := utils.WriteFiles(tmpDir, files); err != nil {
 		return fmt.Errorf("can't write user-data: %v", err)
 	}
 
-	if err := os.MkdirAll(g.isoDir, 0777); err != nil {
-		return fmt.Errorf("error making iso directory %q: %v", g.isoDir, err)
+	isoDir := filepath.Dir(g.IsoPath())
+	if err := os.MkdirAll(isoDir, 0777); err != nil {
+		return fmt.Errorf("error making iso directory %q: %v", isoDir, err)
 	}
 
 	if err := utils.GenIsoImage(g.IsoPath(), volumeName, tmpDir); err != nil {
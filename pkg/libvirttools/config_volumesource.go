@@ -17,58 +17,282 @@ limitations under the License.
 package libvirttools
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"os"
+	"sort"
 
 	"github.com/golang/glog"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/virt"
 )
 
 var configIsoDir = "/var/lib/virtlet/config"
 
+// configISOVolumeCapacity is the initial capacity of the storage pool
+// volume for the config ISO
+const configISOVolumeCapacity = 1024 * 1024
+
 // configVolume denotes an ISO image using config format
 // that contains cloud-init meta-data and user-data
 type configVolume struct {
 	volumeBase
+	// secondary is true for the second ISO image of the dual
+	// config layout which uses the other config format
+	secondary bool
 }
 
 var _ VMVolume = &configVolume{}
 
 // GetConfigVolume returns a config volume source which will produce an ISO
-// image with CloudInit compatible configuration data.
-func GetConfigVolume(config *VMConfig, owner volumeOwner) ([]VMVolume, error) {
-	return []VMVolume{
-		&configVolume{
-			volumeBase{config, owner},
-		},
-	}, nil
+// image with CloudInit compatible configuration data. With the dual
+// config layout, it produces two ISO images, one for NoCloud and one
+// for ConfigDrive, each having the volume label the corresponding
+// cloud-init datasource looks for.
+func GetConfigVolume(config *VMConfig, owner VolumeOwner) ([]VMVolume, error) {
+	if owner.SkipNoopConfigISO() && !config.ParsedAnnotations.ForceConfigISO && isNoopCloudInitConfig(config) {
+		return nil, nil
+	}
+	volumes := []VMVolume{
+		&configVolume{volumeBase: volumeBase{config, owner}},
+	}
+	if config.ParsedAnnotations.DualConfigLayout {
+		volumes = append(volumes, &configVolume{volumeBase: volumeBase{config, owner}, secondary: true})
+	}
+	return volumes, nil
 }
 
 func (v *configVolume) UUID() string { return "" }
 
 func (v *configVolume) cloudInitGenerator() *CloudInitGenerator {
-	return NewCloudInitGenerator(v.config, configIsoDir)
+	g := NewCloudInitGenerator(v.config, configIsoDir)
+	g.secondary = v.secondary
+	return g
+}
+
+// volumeName returns the name of the storage pool volume that holds
+// the config ISO if it's stored in the pool. The name makes GC treat
+// the volume like the other volumes of the VM.
+func (v *configVolume) volumeName() string {
+	if v.secondary {
+		return "virtlet-" + v.config.DomainUUID + "-config-secondary.iso"
+	}
+	return "virtlet-" + v.config.DomainUUID + "-config.iso"
+}
+
+// inPool returns true if the config ISO is stored as a storage
+// pool volume
+func (v *configVolume) inPool() bool {
+	return v.owner.ConfigISOInPool() && !v.diskless()
+}
+
+// poolGenerator returns the cloud-init generator that writes the
+// config ISO to its storage pool volume if the ISO is stored in the
+// pool. If create is true, the volume is created if it doesn't
+// exist yet.
+func (v *configVolume) poolGenerator(create bool) (*CloudInitGenerator, error) {
+	g := v.cloudInitGenerator()
+	if !v.inPool() {
+		return g, nil
+	}
+	storagePool, err := v.owner.StoragePool()
+	if err != nil {
+		return nil, err
+	}
+	vol, err := storagePool.LookupVolumeByName(v.volumeName())
+	if err == virt.ErrStorageVolumeNotFound && create {
+		// the actual size is known after the ISO is generated,
+		// the dir pool volume file is just replaced with the ISO
+		vol, err = createStorageVolume(v.owner, storagePool, v.config.DomainUUID, &libvirtxml.StorageVolume{
+			Type: "file",
+			Name: v.volumeName(),
+			Allocation: &libvirtxml.StorageVolumeSize{
+				Unit:  "b",
+				Value: 0,
+			},
+			Capacity: &libvirtxml.StorageVolumeSize{
+				Unit:  "b",
+				Value: configISOVolumeCapacity,
+			},
+			Target: &libvirtxml.StorageVolumeTarget{
+				Format: &libvirtxml.StorageVolumeTargetFormat{Type: "raw"},
+			},
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't get config ISO volume %q: %v", v.volumeName(), err)
+	}
+	if g.isoPath, err = vol.Path(); err != nil {
+		return nil, fmt.Errorf("can't get the path of config ISO volume %q: %v", v.volumeName(), err)
+	}
+	return g, nil
 }
 
 func (v *configVolume) Setup() (*libvirtxml.DomainDisk, error) {
-	return v.cloudInitGenerator().DiskDef(), nil
+	g, err := v.poolGenerator(true)
+	if err != nil {
+		return nil, err
+	}
+	return g.DiskDef(), nil
 }
 
 func (v *configVolume) WriteImage(volumeMap diskPathMap) error {
-	return v.cloudInitGenerator().GenerateImage(volumeMap)
+	g, err := v.poolGenerator(false)
+	if err != nil {
+		return err
+	}
+	return g.GenerateImage(volumeMap)
 }
 
 func (v *configVolume) Teardown() error {
+	// the placement of the config ISO may have been changed
+	// since the VM was created, so both are cleaned up
+	if v.owner.ConfigISOInPool() {
+		if storagePool, err := v.owner.StoragePool(); err != nil {
+			glog.Warningf("Cannot remove config ISO volume %q: %v", v.volumeName(), err)
+		} else if err := storagePool.RemoveVolumeByName(v.volumeName()); err != nil && err != virt.ErrStorageVolumeNotFound {
+			glog.Warningf("Cannot remove config ISO volume %q: %v", v.volumeName(), err)
+		}
+	}
 	isoPath := v.cloudInitGenerator().IsoPath()
 	if err := os.Remove(isoPath); err != nil && !os.IsNotExist(err) {
 		glog.Warningf("Cannot remove temporary config file %q: %v", isoPath, err)
 	}
+	seedDir := v.cloudInitGenerator().SeedDir()
+	if err := os.RemoveAll(seedDir); err != nil {
+		glog.Warningf("Cannot remove cloud-init seed directory %q: %v", seedDir, err)
+	}
 	return nil
 }
 
+// diskless returns true if the cloud-init data is passed to the VM
+// without a disk
+func (v *configVolume) diskless() bool {
+	return v.cloudInitGenerator().usesFwCfg()
+}
+
+// isNoopCloudInitConfig returns true if the VM doesn't need any
+// cloud-init configuration from Virtlet. A single network interface
+// doesn't need network-config as it's configured by Virtlet's DHCP
+// server. The VMs the boot of which is signalled via cloud-init
+// phone_home need the config ISO, too.
+func isNoopCloudInitConfig(config *VMConfig) bool {
+	va := config.ParsedAnnotations
+	if len(va.SSHKeys) != 0 || len(va.SSHHostKeys) != 0 ||
+		len(va.UserData) != 0 || len(va.UserDataRaw) != 0 || va.UserDataScript != "" ||
+		len(va.MetaData) != 0 || va.User != "" || va.PowerState != nil ||
+		len(va.CACerts) != 0 || va.SeedFrom != "" ||
+		len(va.GrowpartDevices) != 0 || va.ScratchDiskSize > 0 {
+		return false
+	}
+	if len(config.Environment) != 0 || len(config.Mounts) != 0 || config.ReadonlyRootfs ||
+		config.BootPhoneHomeURL != "" {
+		return false
+	}
+	return config.ContainerSideNetwork == nil || len(config.ContainerSideNetwork.Interfaces) <= 1
+}
+
 // SetConfigIsoDir sets a directory for config iso dir.
 // It can be useful in tests
 func SetConfigIsoDir(dir string) {
 	configIsoDir = dir
 }
 
+// configAnnotationsHash returns the hash of the pod and container
+// annotations of the VM which determine the contents of its config
+// ISO
+func configAnnotationsHash(config *VMConfig) string {
+	h := sha256.New()
+	for _, annotations := range []map[string]string{config.PodAnnotations, config.ContainerAnnotations} {
+		keys := make([]string, 0, len(annotations))
+		for k := range annotations {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(h, "%q=%q\n", k, annotations[k])
+		}
+		// separate the pod annotations from the container ones
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// refreshConfigISO generates the config ISO of a stopped VM again
+// if the annotations of the VM changed since the ISO was generated,
+// so the VM doesn't boot with stale cloud-init data. This happens
+// when the pod annotations are updated by UpdateCloudInit while the
+// VM is stopped or when the node default annotations are changed
+// upon Virtlet restart. The disks of the VM can't be changed here,
+// so if the VM was created without the config ISO, it's not added.
+func (v *VirtualizationTool) refreshConfigISO(containerID string, domain virt.Domain) error {
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	if err != nil {
+		return fmt.Errorf("can't retrieve the metadata of container %q: %v", containerID, err)
+	}
+	// the containers created by older Virtlet versions
+	// don't have the hash
+	if containerInfo == nil || containerInfo.ConfigAnnotationsHash == "" {
+		return nil
+	}
+	config, _, err := v.getVMConfigFromMetadata(containerID)
+	if err != nil || config == nil {
+		return err
+	}
+
+	hash := configAnnotationsHash(config)
+	if hash == containerInfo.ConfigAnnotationsHash {
+		glog.V(2).Infof("Annotations of container %q didn't change, reusing its config ISO", containerID)
+		return nil
+	}
+	var gens []*CloudInitGenerator
+	for _, secondary := range []bool{false, true} {
+		vol := &configVolume{volumeBase: volumeBase{config, v}, secondary: secondary}
+		gen, err := vol.poolGenerator(false)
+		if err != nil {
+			// the VM may have been created before the config ISOs
+			// were moved to the storage pool
+			gen = vol.cloudInitGenerator()
+		}
+		switch {
+		case gen.hasConfigImage():
+			gens = append(gens, gen)
+		case !secondary:
+			glog.Warningf("Annotations of container %q changed, but it has no config ISO %q to regenerate. The VM must be recreated to apply the changes", containerID, gen.IsoPath())
+			return nil
+		}
+	}
+
+	glog.Infof("Annotations of container %q changed since its config ISO was generated, regenerating the ISO", containerID)
+	diskList, err := newDiskList(config, v.volumeSource, v)
+	if err != nil {
+		return err
+	}
+	volumeMap, err := diskList.volumeMap(domain)
+	if err != nil {
+		return err
+	}
+	for _, gen := range gens {
+		if err := gen.GenerateImage(volumeMap); err != nil {
+			return fmt.Errorf("error regenerating config ISO for container %q: %v", containerID, err)
+		}
+	}
+	glog.V(1).Infof("Config ISO of container %q regenerated", containerID)
+	return v.setConfigAnnotationsHash(containerID, hash)
+}
+
+// setConfigAnnotationsHash stores the hash of the annotations the
+// config ISO of the container was generated for
+func (v *VirtualizationTool) setConfigAnnotationsHash(containerID, hash string) error {
+	return v.metadataStore.Container(containerID).Save(
+		func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+			if c != nil {
+				c.ConfigAnnotationsHash = hash
+			}
+			return c, nil
+		})
+}
+
 // TODO: this file needs a test
@@ -0,0 +1,78 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"testing"
+)
+
+func TestIsNoopCloudInitConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   *VMConfig
+		expected bool
+	}{
+		{
+			name:     "no config",
+			config:   &VMConfig{ParsedAnnotations: &VirtletAnnotations{}},
+			expected: true,
+		},
+		{
+			name: "user data",
+			config: &VMConfig{ParsedAnnotations: &VirtletAnnotations{
+				UserData: map[string]interface{}{"runcmd": []string{"echo hi"}},
+			}},
+		},
+		{
+			name: "raw user data",
+			config: &VMConfig{ParsedAnnotations: &VirtletAnnotations{
+				UserDataRaw: []byte("Content-Type: multipart/mixed; boundary=\"XYZ\"\n\n--XYZ--\n"),
+			}},
+		},
+		{
+			name: "seed url",
+			config: &VMConfig{ParsedAnnotations: &VirtletAnnotations{
+				SeedFrom: "http://seed.example.com/foo/",
+			}},
+		},
+		{
+			name: "growpart devices",
+			config: &VMConfig{ParsedAnnotations: &VirtletAnnotations{
+				GrowpartDevices: []string{"/dev/vdb1"},
+			}},
+		},
+		{
+			name: "scratch disk",
+			config: &VMConfig{ParsedAnnotations: &VirtletAnnotations{
+				ScratchDiskSize: 1 << 30,
+			}},
+		},
+		{
+			name: "boot phone home",
+			config: &VMConfig{
+				ParsedAnnotations: &VirtletAnnotations{},
+				BootPhoneHomeURL:  "http://192.168.0.1:10080/phone-home",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if r := isNoopCloudInitConfig(tc.config); r != tc.expected {
+				t.Errorf("isNoopCloudInitConfig(): %v instead of %v", r, tc.expected)
+			}
+		})
+	}
+}
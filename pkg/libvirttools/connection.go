@@ -17,80 +17,306 @@ limitations under the License.
 package libvirttools
 
 import (
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/jonboulle/clockwork"
 	libvirt "github.com/libvirt/libvirt-go"
 )
 
 const (
 	libvirtReconnectInterval = 1 * time.Second
 	libvirtReconnectAttempts = 120
+
+	defaultConnectionHealthCheckInterval = 30 * time.Second
+
+	eventLoopErrorInterval    = 100 * time.Millisecond
+	eventLoopMaxErrorInterval = 10 * time.Second
 )
 
 type libvirtCall func(c *libvirt.Connect) (interface{}, error)
 
 type libvirtConnection interface {
 	invoke(call libvirtCall) (interface{}, error)
+	newEventConnection() (*libvirt.Connect, error)
+}
+
+var (
+	eventLoopOnce sync.Once
+	eventLoopErr  error
+)
+
+// ConnectionPoolConfig specifies the pool of long-lived libvirt
+// connections shared by the domain and storage operations
+type ConnectionPoolConfig struct {
+	// Size is the number of the connections in the pool. The
+	// operations are distributed among the connections in
+	// round-robin fashion. Zero value means a single connection.
+	Size int
+	// IdleTimeout specifies the time after which a connection
+	// that wasn't used is closed. It's reopened when it's needed
+	// again. Zero value means that the idle connections are
+	// kept open.
+	IdleTimeout time.Duration
+	// HealthCheckInterval specifies how often a connection is
+	// checked to be alive before it's used. Zero value means
+	// the default of 30 seconds.
+	HealthCheckInterval time.Duration
+}
+
+func (c ConnectionPoolConfig) withDefaults() ConnectionPoolConfig {
+	if c.Size <= 0 {
+		c.Size = 1
+	}
+	if c.HealthCheckInterval <= 0 {
+		c.HealthCheckInterval = defaultConnectionHealthCheckInterval
+	}
+	return c
+}
+
+// pooledConn is the subset of libvirt.Connect methods that's
+// used by connPool
+type pooledConn interface {
+	IsAlive() (bool, error)
+	Close() (int, error)
+}
+
+type connPoolEntry struct {
+	conn        pooledConn
+	lastUsed    time.Time
+	lastChecked time.Time
+}
+
+// connPool keeps the libvirt connections open so they're reused
+// by the operations instead of reconnecting each time. The
+// connections returned by get are counted as used till they're
+// returned using put, and they're never closed while being used.
+type connPool struct {
+	sync.Mutex
+	config  ConnectionPoolConfig
+	dial    func() (pooledConn, error)
+	clock   clockwork.Clock
+	entries []*connPoolEntry
+	next    int
+	// users holds the number of the operations using each
+	// connection, including the ones no longer in the pool
+	users map[pooledConn]int
+}
+
+func newConnPool(config ConnectionPoolConfig, dial func() (pooledConn, error), clock clockwork.Clock) *connPool {
+	config = config.withDefaults()
+	p := &connPool{
+		config:  config,
+		dial:    dial,
+		clock:   clock,
+		entries: make([]*connPoolEntry, config.Size),
+		users:   make(map[pooledConn]int),
+	}
+	for n := range p.entries {
+		p.entries[n] = &connPoolEntry{}
+	}
+	return p
+}
+
+// closeConn removes the connection from the pool entry. The
+// connection is closed right away unless it's being used, in which
+// case it's closed by put after the last operation that uses it
+// is done.
+func (p *connPool) closeConn(e *connPoolEntry, reason string) {
+	conn := e.conn
+	e.conn = nil
+	if p.users[conn] > 0 {
+		glog.V(1).Infof("Removing libvirt connection from the pool: %s", reason)
+		return
+	}
+	glog.V(1).Infof("Closing libvirt connection: %s", reason)
+	doCloseConn(conn)
+}
+
+func doCloseConn(conn pooledConn) {
+	if _, err := conn.Close(); err != nil {
+		glog.Warningf("Error closing libvirt connection: %v", err)
+	}
+}
+
+// get returns the next connection in the pool, connecting to
+// libvirt if the connection isn't open, was idle for too long
+// or failed the health check. The connection must be returned
+// using put after it's used.
+func (p *connPool) get() (pooledConn, error) {
+	p.Lock()
+	defer p.Unlock()
+	e := p.entries[p.next]
+	p.next = (p.next + 1) % len(p.entries)
+
+	now := p.clock.Now()
+	if e.conn != nil && p.config.IdleTimeout > 0 && p.users[e.conn] == 0 && now.Sub(e.lastUsed) >= p.config.IdleTimeout {
+		p.closeConn(e, "idle timeout")
+	}
+	if e.conn != nil && now.Sub(e.lastChecked) >= p.config.HealthCheckInterval {
+		if alive, err := e.conn.IsAlive(); err != nil || !alive {
+			p.closeConn(e, "health check failed")
+		} else {
+			e.lastChecked = now
+		}
+	}
+	if e.conn == nil {
+		conn, err := p.dial()
+		if err != nil {
+			return nil, err
+		}
+		e.conn = conn
+		e.lastChecked = p.clock.Now()
+	}
+	e.lastUsed = p.clock.Now()
+	p.users[e.conn]++
+	return e.conn, nil
+}
+
+// put returns the connection obtained using get after it's used.
+// The connection is closed if it was removed from the pool while
+// being used.
+func (p *connPool) put(conn pooledConn) {
+	p.Lock()
+	defer p.Unlock()
+	if p.users[conn]--; p.users[conn] > 0 {
+		return
+	}
+	delete(p.users, conn)
+	for _, e := range p.entries {
+		if e.conn == conn {
+			// the idle time is counted since the
+			// connection was last used
+			e.lastUsed = p.clock.Now()
+			return
+		}
+	}
+	glog.V(1).Infof("Closing libvirt connection removed from the pool")
+	doCloseConn(conn)
+}
+
+// markDead removes the connection from the pool so it's replaced
+// by a new one when it's needed. It does nothing if the connection
+// is already replaced.
+func (p *connPool) markDead(conn pooledConn) {
+	p.Lock()
+	defer p.Unlock()
+	for _, e := range p.entries {
+		if e.conn == conn {
+			p.closeConn(e, "connection is dead")
+		}
+	}
 }
 
 // Connection combines accessors for methods which operated on libvirt storage
 // and domains.
 type Connection struct {
 	uri  string
-	conn *libvirt.Connect
+	pool *connPool
 	*libvirtDomainConnection
 	*libvirtStorageConnection
 }
 
 // NewConnection uses uri to construct connection to libvirt used later by
-// both storage and domains manipulators.
-func NewConnection(uri string) (*Connection, error) {
+// both storage and domains manipulators. The connections are kept
+// in a pool described by poolConfig.
+func NewConnection(uri string, poolConfig ConnectionPoolConfig) (*Connection, error) {
 	conn, err := libvirt.NewConnect(uri)
 	if err != nil {
 		return nil, err
 	}
-	r := &Connection{
-		uri:  uri,
-		conn: conn,
+	r := &Connection{uri: uri}
+	first := true
+	r.pool = newConnPool(poolConfig, func() (pooledConn, error) {
+		if first {
+			first = false
+			return conn, nil
+		}
+		return r.connect()
+	}, clockwork.NewRealClock())
+	// put the initial connection into the pool
+	initialConn, err := r.pool.get()
+	if err != nil {
+		return nil, err
 	}
+	r.pool.put(initialConn)
 	r.libvirtDomainConnection = newLibvirtDomainConnection(r)
 	r.libvirtStorageConnection = newLibvirtStorageConnection(r)
 	return r, nil
 }
 
-func (c *Connection) connect() error {
+func (c *Connection) connect() (pooledConn, error) {
 	var err error
 	for i := 0; i < libvirtReconnectAttempts; i++ {
 		if i > 0 {
 			time.Sleep(libvirtReconnectInterval)
 		}
 		glog.V(1).Infof("Connecting to libvirt at %s", c.uri)
-		c.conn, err = libvirt.NewConnect(c.uri)
+		var conn *libvirt.Connect
+		conn, err = libvirt.NewConnect(c.uri)
 		if err == nil {
-			return nil
+			return conn, nil
 		}
 		glog.Warningf("Error connecting to libvirt at %s: %v", c.uri, err)
 	}
 	glog.Warningf("Failed to connect to libvirt at %s after %d attempts", c.uri, libvirtReconnectAttempts)
-	return err
+	return nil, err
+}
+
+// newEventConnection opens a connection for the event callbacks.
+// It's not a part of the pool, so it's not closed when it's idle.
+// The default libvirt event loop is started first because libvirt
+// requires it to be registered before the connection is opened.
+func (c *Connection) newEventConnection() (*libvirt.Connect, error) {
+	eventLoopOnce.Do(func() {
+		if eventLoopErr = libvirt.EventRegisterDefaultImpl(); eventLoopErr != nil {
+			return
+		}
+		go func() {
+			// back off on the errors so a broken event loop
+			// doesn't spin flooding the log
+			interval := eventLoopErrorInterval
+			for {
+				if err := libvirt.EventRunDefaultImpl(); err != nil {
+					glog.Errorf("Error running libvirt event loop: %v", err)
+					time.Sleep(interval)
+					if interval *= 2; interval > eventLoopMaxErrorInterval {
+						interval = eventLoopMaxErrorInterval
+					}
+				} else {
+					interval = eventLoopErrorInterval
+				}
+			}
+		}()
+	})
+	if eventLoopErr != nil {
+		return nil, fmt.Errorf("can't register libvirt event loop: %v", eventLoopErr)
+	}
+	return libvirt.NewConnect(c.uri)
 }
 
 func (c *Connection) invoke(call libvirtCall) (interface{}, error) {
 	for {
-		if c.conn == nil {
-			if err := c.connect(); err != nil {
-				return nil, err
-			}
+		conn, err := c.pool.get()
+		if err != nil {
+			return nil, err
+		}
+		libvirtConn, ok := conn.(*libvirt.Connect)
+		if !ok {
+			c.pool.put(conn)
+			return nil, fmt.Errorf("unexpected libvirt connection type %T", conn)
 		}
 
-		r, err := call(c.conn)
+		r, err := call(libvirtConn)
+		c.pool.put(conn)
 		switch err := err.(type) {
 		case nil:
 			return r, nil
 		case libvirt.Error:
 			if err.Domain == libvirt.FROM_RPC && err.Code == libvirt.ERR_INTERNAL_ERROR {
-				c.conn = nil
+				c.pool.markDead(conn)
 				continue
 			}
 			return nil, err
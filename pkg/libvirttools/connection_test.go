@@ -0,0 +1,198 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+type fakePooledConn struct {
+	id     int
+	alive  bool
+	closed bool
+	checks int
+}
+
+var _ pooledConn = &fakePooledConn{}
+
+func (c *fakePooledConn) IsAlive() (bool, error) {
+	c.checks++
+	return c.alive && !c.closed, nil
+}
+
+func (c *fakePooledConn) Close() (int, error) {
+	if c.closed {
+		return 0, errors.New("already closed")
+	}
+	c.closed = true
+	return 0, nil
+}
+
+type fakeDialer struct {
+	conns []*fakePooledConn
+}
+
+func (d *fakeDialer) dial() (pooledConn, error) {
+	c := &fakePooledConn{id: len(d.conns) + 1, alive: true}
+	d.conns = append(d.conns, c)
+	return c, nil
+}
+
+func (d *fakeDialer) verifyDialCount(t *testing.T, expected int) {
+	if len(d.conns) != expected {
+		t.Errorf("bad number of connections made: %d instead of %d", len(d.conns), expected)
+	}
+}
+
+// getPooledConn gets a connection from the pool and returns it to
+// the pool right away, like an operation that's done quickly.
+func getPooledConn(t *testing.T, p *connPool) *fakePooledConn {
+	conn := acquirePooledConn(t, p)
+	p.put(conn)
+	return conn
+}
+
+func acquirePooledConn(t *testing.T, p *connPool) *fakePooledConn {
+	conn, err := p.get()
+	if err != nil {
+		t.Fatalf("get(): %v", err)
+	}
+	return conn.(*fakePooledConn)
+}
+
+func TestConnPoolReuse(t *testing.T) {
+	d := &fakeDialer{}
+	clock := clockwork.NewFakeClockAt(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	p := newConnPool(ConnectionPoolConfig{Size: 2}, d.dial, clock)
+
+	var ids []int
+	for i := 0; i < 6; i++ {
+		ids = append(ids, getPooledConn(t, p).id)
+		clock.Advance(time.Second)
+	}
+	// the connections are used in round-robin fashion
+	for n, id := range ids {
+		if id != n%2+1 {
+			t.Errorf("bad connection ids: %v", ids)
+			break
+		}
+	}
+	d.verifyDialCount(t, 2)
+
+	// the connection marked dead is replaced, the other one
+	// is still used
+	dead := getPooledConn(t, p)
+	p.markDead(dead)
+	if !dead.closed {
+		t.Errorf("the dead connection wasn't closed")
+	}
+	// marking the connection dead twice does nothing
+	p.markDead(dead)
+	if other := getPooledConn(t, p); other.id != 2 || other.closed {
+		t.Errorf("bad connection after marking connection 1 dead: %#v", other)
+	}
+	if replacement := getPooledConn(t, p); replacement.id != 3 {
+		t.Errorf("the dead connection wasn't replaced: %#v", replacement)
+	}
+	d.verifyDialCount(t, 3)
+}
+
+func TestConnPoolHealthCheck(t *testing.T) {
+	d := &fakeDialer{}
+	clock := clockwork.NewFakeClockAt(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	p := newConnPool(ConnectionPoolConfig{HealthCheckInterval: 10 * time.Second}, d.dial, clock)
+
+	conn := getPooledConn(t, p)
+	clock.Advance(5 * time.Second)
+	if c := getPooledConn(t, p); c != conn || conn.checks != 0 {
+		t.Errorf("the connection was health checked too early")
+	}
+
+	clock.Advance(5 * time.Second)
+	if c := getPooledConn(t, p); c != conn || conn.checks != 1 {
+		t.Errorf("the connection wasn't health checked or was replaced")
+	}
+
+	conn.alive = false
+	clock.Advance(10 * time.Second)
+	if c := getPooledConn(t, p); c == conn || !conn.closed {
+		t.Errorf("the connection that failed the health check wasn't replaced")
+	}
+	d.verifyDialCount(t, 2)
+}
+
+func TestConnPoolIdleTimeout(t *testing.T) {
+	d := &fakeDialer{}
+	clock := clockwork.NewFakeClockAt(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	p := newConnPool(ConnectionPoolConfig{IdleTimeout: time.Minute}, d.dial, clock)
+
+	conn := getPooledConn(t, p)
+	for i := 0; i < 3; i++ {
+		clock.Advance(50 * time.Second)
+		if c := getPooledConn(t, p); c != conn {
+			t.Errorf("the connection that's in use was replaced")
+		}
+	}
+
+	clock.Advance(time.Minute)
+	if c := getPooledConn(t, p); c == conn || !conn.closed {
+		t.Errorf("the idle connection wasn't closed")
+	}
+	d.verifyDialCount(t, 2)
+}
+
+func TestConnPoolConnectionsInUse(t *testing.T) {
+	d := &fakeDialer{}
+	clock := clockwork.NewFakeClockAt(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	p := newConnPool(ConnectionPoolConfig{IdleTimeout: time.Minute}, d.dial, clock)
+
+	// a long operation keeps the connection from being
+	// closed as an idle one
+	conn := acquirePooledConn(t, p)
+	clock.Advance(2 * time.Minute)
+	if c := getPooledConn(t, p); c != conn || conn.closed {
+		t.Errorf("the connection that's in use was closed as an idle one")
+	}
+	p.put(conn)
+
+	// the idle time is counted since the connection was returned
+	clock.Advance(50 * time.Second)
+	if c := getPooledConn(t, p); c != conn || conn.closed {
+		t.Errorf("the connection was closed before the idle timeout")
+	}
+	d.verifyDialCount(t, 1)
+
+	// the connection that is marked dead while being used is
+	// replaced right away, but only closed after it's returned
+	conn = acquirePooledConn(t, p)
+	p.markDead(conn)
+	if conn.closed {
+		t.Errorf("the dead connection was closed while being used")
+	}
+	if c := getPooledConn(t, p); c == conn {
+		t.Errorf("the dead connection wasn't replaced")
+	}
+	p.put(conn)
+	if !conn.closed {
+		t.Errorf("the dead connection wasn't closed after it was returned to the pool")
+	}
+	d.verifyDialCount(t, 2)
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"sync"
+)
+
+// containerLock is a lock for a single container that's kept
+// while there are any goroutines that hold it or wait for it
+type containerLock struct {
+	sync.Mutex
+	refCount int
+}
+
+// containerLocks is used to serialize the lifecycle operations on
+// the same container, such as StopContainer and RemoveContainer
+// invoked concurrently by kubelet, while letting the operations on
+// different containers run concurrently. Zero value of
+// containerLocks is ready to use.
+type containerLocks struct {
+	sync.Mutex
+	locks map[string]*containerLock
+}
+
+// lock acquires the lock for the specified container and returns
+// a function that releases it
+func (l *containerLocks) lock(containerID string) func() {
+	l.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*containerLock)
+	}
+	cl, found := l.locks[containerID]
+	if !found {
+		cl = &containerLock{}
+		l.locks[containerID] = cl
+	}
+	cl.refCount++
+	l.Unlock()
+
+	cl.Lock()
+	return func() {
+		cl.Unlock()
+		l.Lock()
+		defer l.Unlock()
+		cl.refCount--
+		if cl.refCount == 0 {
+			delete(l.locks, containerID)
+		}
+	}
+}
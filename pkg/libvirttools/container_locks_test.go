@@ -0,0 +1,116 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestContainerLocks(t *testing.T) {
+	var locks containerLocks
+	unlock1 := locks.lock("container1")
+
+	// a different container must not be blocked
+	done := make(chan struct{})
+	go func() {
+		locks.lock("container2")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the lock for container2 is blocked by container1")
+	}
+
+	// the same container must be blocked
+	locked := make(chan struct{})
+	go func() {
+		locks.lock("container1")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("container1 was locked twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock1()
+	select {
+	case <-locked:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the lock for container1 wasn't released")
+	}
+
+	locks.Lock()
+	defer locks.Unlock()
+	if len(locks.locks) != 0 {
+		t.Errorf("the container locks weren't cleaned up: %v", locks.locks)
+	}
+}
+
+func TestConcurrentStopAndRemoveContainer(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	for i := 0; i < 10; i++ {
+		containerID := ct.createContainer(sandbox, nil)
+		ct.startContainer(containerID)
+
+		var wg sync.WaitGroup
+		var stopErr, removeErr error
+		start := make(chan struct{})
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			stopErr = ct.virtTool.StopContainer(containerID, stopContainerTimeout)
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			removeErr = ct.virtTool.RemoveContainer(containerID)
+		}()
+		close(start)
+		wg.Wait()
+
+		if stopErr != nil {
+			t.Errorf("StopContainer(): %v", stopErr)
+		}
+		if removeErr != nil {
+			t.Errorf("RemoveContainer(): %v", removeErr)
+		}
+		if domains, err := ct.domainConn.ListDomains(); err != nil {
+			t.Errorf("ListDomains(): %v", err)
+		} else if len(domains) != 0 {
+			t.Errorf("%d domains left after removing the container", len(domains))
+		}
+		if containerInfo, err := ct.metadataStore.Container(containerID).Retrieve(); err != nil {
+			t.Errorf("Retrieve(): %v", err)
+		} else if containerInfo != nil {
+			t.Errorf("container metadata left after removing the container: %#v", containerInfo)
+		}
+		if containers := ct.listContainers(nil); len(containers) != 0 {
+			t.Errorf("%d containers left after removing the container", len(containers))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	cpuFeaturePolicyRequire = "require"
+	cpuFeaturePolicyDisable = "disable"
+	// the CPU model to add the features to for the domains that
+	// don't use KVM and thus can't use host-model CPU
+	defaultEmulatedCPUModel = "qemu64"
+)
+
+// feature names as used by libvirt, e.g. pdpe1gb, sse4.2 or tsc-deadline
+var cpuFeatureNameRx = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+// CPUFeature denotes a guest CPU feature to enable or disable
+type CPUFeature struct {
+	// Name is the name of the feature, e.g. pdpe1gb
+	Name string
+	// Policy is the libvirt policy of the feature, "require"
+	// or "disable"
+	Policy string
+}
+
+// parseCPUFeatures parses a comma-separated list of CPU features
+// prefixed with '+' (enable) or '-' (disable), e.g. "+pdpe1gb,-rtm".
+// The features without a prefix are enabled.
+func parseCPUFeatures(s string) ([]CPUFeature, error) {
+	var features []CPUFeature
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		policy := cpuFeaturePolicyRequire
+		switch item[0] {
+		case '-':
+			policy = cpuFeaturePolicyDisable
+			fallthrough
+		case '+':
+			item = item[1:]
+		}
+		if !cpuFeatureNameRx.MatchString(item) {
+			return nil, fmt.Errorf("bad CPU feature name %q", item)
+		}
+		if seen[item] {
+			return nil, fmt.Errorf("CPU feature %q is specified more than once", item)
+		}
+		seen[item] = true
+		features = append(features, CPUFeature{Name: item, Policy: policy})
+	}
+	return features, nil
+}
+
+// addCPUFeatures adds the CPU features to the domain. The features
+// are applied on top of the host CPU model for KVM domains and on
+// top of the default emulated CPU model otherwise.
+func addCPUFeatures(domain *libvirtxml.Domain, features []CPUFeature) {
+	if domain.CPU == nil {
+		domain.CPU = &libvirtxml.DomainCPU{}
+	}
+	if domain.CPU.Mode == "" && domain.CPU.Model == nil {
+		if domain.Type == defaultDomainType {
+			domain.CPU.Mode = "host-model"
+		} else {
+			domain.CPU.Model = &libvirtxml.DomainCPUModel{
+				Fallback: "allow",
+				Value:    defaultEmulatedCPUModel,
+			}
+		}
+	}
+	for _, f := range features {
+		domain.CPU.Features = append(domain.CPU.Features, libvirtxml.DomainCPUFeature{
+			Policy: f.Policy,
+			Name:   f.Name,
+		})
+	}
+}
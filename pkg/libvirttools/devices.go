@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"strings"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// DeviceProfile denotes the set of the optional devices
+// that are added to the VMs
+type DeviceProfile string
+
+const (
+	// DeviceProfileDefault means adding all the optional devices
+	// to the VMs
+	DeviceProfileDefault DeviceProfile = "default"
+	// DeviceProfileMinimal means leaving out all the optional
+	// devices besides the ones explicitly requested using the
+	// VirtletOptionalDevices annotation. This reduces the memory
+	// footprint of the hypervisor process and its attack surface.
+	DeviceProfileMinimal DeviceProfile = "minimal"
+
+	// optionalDeviceUSB denotes the USB controller together
+	// with the USB tablet
+	optionalDeviceUSB = "usb"
+	// optionalDeviceGraphics denotes the VNC graphics together
+	// with the video adapter
+	optionalDeviceGraphics = "graphics"
+	// optionalDeviceBalloon denotes the memory balloon device
+	optionalDeviceBalloon = "balloon"
+)
+
+var optionalDevices = []string{optionalDeviceUSB, optionalDeviceGraphics, optionalDeviceBalloon}
+
+// SetDeviceProfile sets the profile that determines which
+// optional devices are added to the VMs. Empty value means
+// using the default profile.
+func (v *VirtualizationTool) SetDeviceProfile(profile DeviceProfile) error {
+	switch profile {
+	case "":
+		profile = DeviceProfileDefault
+	case DeviceProfileDefault, DeviceProfileMinimal:
+	default:
+		return fmt.Errorf("bad device profile %q. Must be either %q or %q", profile, DeviceProfileDefault, DeviceProfileMinimal)
+	}
+	v.deviceProfile = profile
+	return nil
+}
+
+// parseOptionalDevices parses a comma-separated list of
+// optional devices
+func parseOptionalDevices(s string) ([]string, error) {
+	var r []string
+	for _, item := range strings.Split(s, ",") {
+		name := strings.TrimSpace(item)
+		if name == "" {
+			continue
+		}
+		if !isOptionalDevice(name) {
+			return nil, fmt.Errorf("unknown optional device %q. Must be one of %s", name, strings.Join(optionalDevices, ", "))
+		}
+		r = append(r, name)
+	}
+	return r, nil
+}
+
+func isOptionalDevice(name string) bool {
+	for _, item := range optionalDevices {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasOptionalDevice(config *VMConfig, name string) bool {
+	for _, item := range config.ParsedAnnotations.OptionalDevices {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+// applyDeviceProfile removes the optional devices that aren't
+// requested for the VM from the domain definition if the minimal
+// device profile is used. libvirt adds some of the devices
+// implicitly, so these are disabled explicitly.
+func (ds *domainSettings) applyDeviceProfile(domain *libvirtxml.Domain, config *VMConfig) {
+	if ds.deviceProfile != DeviceProfileMinimal {
+		return
+	}
+	if !hasOptionalDevice(config, optionalDeviceUSB) {
+		domain.Devices.Inputs = nil
+		domain.Devices.Controllers = append(domain.Devices.Controllers,
+			libvirtxml.DomainController{Type: "usb", Model: "none"})
+	}
+	if !hasOptionalDevice(config, optionalDeviceGraphics) {
+		domain.Devices.Graphics = nil
+		domain.Devices.Videos = nil
+	}
+	// the balloon is needed to grow the VM memory from the
+	// memory request up to the limit
+	if !hasOptionalDevice(config, optionalDeviceBalloon) && ds.currentMemory == 0 {
+		domain.Devices.MemBalloon = &libvirtxml.DomainMemBalloon{Model: "none"}
+	}
+}
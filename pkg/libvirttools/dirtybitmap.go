@@ -0,0 +1,232 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const checkpointBitmapPrefix = "virtlet-"
+
+var checkpointNameRx = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// DiskChanges describes the changes made to a VM disk since
+// a checkpoint
+type DiskChanges struct {
+	// Device is the name of QEMU block device of the disk
+	Device string
+	// Granularity is the size of a block tracked by the dirty
+	// bitmap in bytes
+	Granularity uint64
+	// ChangedBlocks is the number of the blocks that were
+	// changed since the checkpoint
+	ChangedBlocks uint64
+	// ChangedBytes is the total size of the changed blocks
+	ChangedBytes uint64
+}
+
+type qmpDirtyBitmap struct {
+	Name        string `json:"name"`
+	Count       uint64 `json:"count"`
+	Granularity uint64 `json:"granularity"`
+}
+
+type qmpBlockInfo struct {
+	Device   string `json:"device"`
+	Inserted *struct {
+		ReadOnly bool `json:"ro"`
+	} `json:"inserted"`
+	DirtyBitmaps []qmpDirtyBitmap `json:"dirty-bitmaps"`
+}
+
+func (bi *qmpBlockInfo) bitmap(name string) *qmpDirtyBitmap {
+	for n := range bi.DirtyBitmaps {
+		if bi.DirtyBitmaps[n].Name == name {
+			return &bi.DirtyBitmaps[n]
+		}
+	}
+	return nil
+}
+
+// qmpExecute executes a QMP command and stores its return value
+// in result, unless result is nil
+func qmpExecute(domain virt.Domain, execute string, args map[string]interface{}, result interface{}) error {
+	cmd := map[string]interface{}{"execute": execute}
+	if args != nil {
+		cmd["arguments"] = args
+	}
+	cmdJSON, err := json.Marshal(cmd)
+	if err != nil {
+		return fmt.Errorf("error marshalling QMP command: %v", err)
+	}
+	out, err := domain.QemuMonitorCommand(string(cmdJSON))
+	if err != nil {
+		return fmt.Errorf("QMP command %s failed: %v", cmdJSON, err)
+	}
+	if result == nil {
+		return nil
+	}
+	r := struct {
+		Return interface{} `json:"return"`
+	}{Return: result}
+	if err := json.Unmarshal([]byte(out), &r); err != nil {
+		return fmt.Errorf("error unmarshalling the result of QMP command %s: %v", cmdJSON, err)
+	}
+	return nil
+}
+
+// checkpointDisks returns the writable disks of the domain, which
+// are tracked by the checkpoints
+func checkpointDisks(domain virt.Domain) ([]qmpBlockInfo, error) {
+	var blocks []qmpBlockInfo
+	if err := qmpExecute(domain, "query-block", nil, &blocks); err != nil {
+		return nil, err
+	}
+	var r []qmpBlockInfo
+	for _, bi := range blocks {
+		if bi.Inserted != nil && !bi.Inserted.ReadOnly {
+			r = append(r, bi)
+		}
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("the domain has no writable disks")
+	}
+	return r, nil
+}
+
+func checkpointBitmapName(checkpoint string) (string, error) {
+	if !checkpointNameRx.MatchString(checkpoint) {
+		return "", fmt.Errorf("bad checkpoint name %q", checkpoint)
+	}
+	return checkpointBitmapPrefix + checkpoint, nil
+}
+
+// checkpointCommand executes the dirty bitmap QMP command for the
+// bitmap of the checkpoint on the specified disk
+func checkpointCommand(domain virt.Domain, execute, device, bitmapName string, persistent bool) error {
+	args := map[string]interface{}{
+		"node": device,
+		"name": bitmapName,
+	}
+	if persistent {
+		args["persistent"] = true
+	}
+	return qmpExecute(domain, execute, args, nil)
+}
+
+// addCheckpoint starts tracking the blocks of the writable disks of
+// the running VM that are changed after this point, using a
+// persistent QEMU dirty bitmap per disk. The bitmaps are kept in the
+// qcow2 images, so they survive VM restarts. The bitmaps that are
+// left from an earlier checkpoint with the same name, e.g. the one
+// of a snapshot removed while the VM wasn't running, are cleared.
+// It's called with the container lock held.
+func (v *VirtualizationTool) addCheckpoint(containerID string, domain virt.Domain, checkpoint string) error {
+	bitmapName, err := checkpointBitmapName(checkpoint)
+	if err != nil {
+		return err
+	}
+	disks, err := checkpointDisks(domain)
+	if err != nil {
+		return fmt.Errorf("can't create checkpoint %q for domain %q: %v", checkpoint, containerID, err)
+	}
+	for _, bi := range disks {
+		execute := "block-dirty-bitmap-add"
+		if bi.bitmap(bitmapName) != nil {
+			execute = "block-dirty-bitmap-clear"
+		}
+		glog.V(1).Infof("Executing %s for dirty bitmap %q of disk %q of domain %q", execute, bitmapName, bi.Device, containerID)
+		if err := checkpointCommand(domain, execute, bi.Device, bitmapName, execute == "block-dirty-bitmap-add"); err != nil {
+			return fmt.Errorf("can't create checkpoint %q for disk %q of domain %q: %v", checkpoint, bi.Device, containerID, err)
+		}
+	}
+	return nil
+}
+
+// removeCheckpoint stops tracking changes since the specified
+// checkpoint, removing its dirty bitmaps from the disks of the
+// running VM. Removing a checkpoint that doesn't exist does nothing.
+// It's called with the container lock held.
+func (v *VirtualizationTool) removeCheckpoint(containerID string, domain virt.Domain, checkpoint string) error {
+	bitmapName, err := checkpointBitmapName(checkpoint)
+	if err != nil {
+		return err
+	}
+	disks, err := checkpointDisks(domain)
+	if err != nil {
+		return fmt.Errorf("can't remove checkpoint %q for domain %q: %v", checkpoint, containerID, err)
+	}
+	for _, bi := range disks {
+		if bi.bitmap(bitmapName) == nil {
+			continue
+		}
+		if err := checkpointCommand(domain, "block-dirty-bitmap-remove", bi.Device, bitmapName, false); err != nil {
+			return fmt.Errorf("can't remove checkpoint %q for disk %q of domain %q: %v", checkpoint, bi.Device, containerID, err)
+		}
+	}
+	return nil
+}
+
+// ChangedBlocks returns the number of the blocks of each writable
+// disk of the running VM of the specified container that were
+// changed since the snapshot was taken or the VM was last reverted
+// to it. The changes are tracked using the dirty bitmaps that are
+// created together with the snapshot.
+func (v *VirtualizationTool) ChangedBlocks(containerID, snapshot string) ([]DiskChanges, error) {
+	bitmapName, err := checkpointBitmapName(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := v.retrieveSnapshots(containerID)
+	if err != nil {
+		return nil, err
+	}
+	if findSnapshot(snapshots, snapshot) < 0 {
+		return nil, fmt.Errorf("snapshot %q not found for domain %q", snapshot, containerID)
+	}
+	domain, err := v.lookupRunningDomain(containerID)
+	if err != nil {
+		return nil, err
+	}
+	disks, err := checkpointDisks(domain)
+	if err != nil {
+		return nil, fmt.Errorf("can't get the changes since snapshot %q for domain %q: %v", snapshot, containerID, err)
+	}
+	var r []DiskChanges
+	for _, bi := range disks {
+		bitmap := bi.bitmap(bitmapName)
+		if bitmap == nil {
+			return nil, fmt.Errorf("the changes since snapshot %q aren't tracked for disk %q of domain %q", snapshot, bi.Device, containerID)
+		}
+		changes := DiskChanges{
+			Device:       bi.Device,
+			Granularity:  bitmap.Granularity,
+			ChangedBytes: bitmap.Count,
+		}
+		if bitmap.Granularity != 0 {
+			changes.ChangedBlocks = (bitmap.Count + bitmap.Granularity - 1) / bitmap.Granularity
+		}
+		r = append(r, changes)
+	}
+	return r, nil
+}
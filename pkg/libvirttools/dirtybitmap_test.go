@@ -0,0 +1,143 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+)
+
+func (ct *containerTester) verifyChangedBlocks(containerID, snapshot string, expectedChanges []DiskChanges) {
+	changes, err := ct.virtTool.ChangedBlocks(containerID, snapshot)
+	if err != nil {
+		ct.t.Fatalf("ChangedBlocks(): %v", err)
+	}
+	if !reflect.DeepEqual(changes, expectedChanges) {
+		ct.t.Errorf("bad changes since snapshot %q:\n%s\ninstead of\n%s", snapshot, spew.Sdump(changes), spew.Sdump(expectedChanges))
+	}
+}
+
+func TestChangedBlocks(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	containerID := ct.startMonitorTestContainer()
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	fakeDomain := domain.(*fake.FakeDomain)
+
+	if _, err := ct.virtTool.ChangedBlocks(containerID, "snap1"); err == nil {
+		t.Errorf("ChangedBlocks() didn't fail for a nonexistent snapshot")
+	}
+
+	if err := ct.virtTool.CreateSnapshot(containerID, "snap1", ""); err != nil {
+		t.Fatalf("CreateSnapshot(): %v", err)
+	}
+	// the config ISO is read-only and isn't tracked
+	ct.verifyChangedBlocks(containerID, "snap1", []DiskChanges{
+		{Device: "drive-sda", Granularity: fake.FakeDirtyBitmapGranularity},
+	})
+
+	fakeDomain.MarkDirty("drive-sda", 100000)
+	ct.verifyChangedBlocks(containerID, "snap1", []DiskChanges{
+		{
+			Device:        "drive-sda",
+			Granularity:   fake.FakeDirtyBitmapGranularity,
+			ChangedBlocks: 2,
+			ChangedBytes:  2 * fake.FakeDirtyBitmapGranularity,
+		},
+	})
+
+	if err := ct.virtTool.CreateSnapshot(containerID, "snap2", ""); err != nil {
+		t.Fatalf("CreateSnapshot(): %v", err)
+	}
+	fakeDomain.MarkDirty("drive-sda", 1)
+	ct.verifyChangedBlocks(containerID, "snap1", []DiskChanges{
+		{
+			Device:        "drive-sda",
+			Granularity:   fake.FakeDirtyBitmapGranularity,
+			ChangedBlocks: 3,
+			ChangedBytes:  3 * fake.FakeDirtyBitmapGranularity,
+		},
+	})
+	ct.verifyChangedBlocks(containerID, "snap2", []DiskChanges{
+		{
+			Device:        "drive-sda",
+			Granularity:   fake.FakeDirtyBitmapGranularity,
+			ChangedBlocks: 1,
+			ChangedBytes:  fake.FakeDirtyBitmapGranularity,
+		},
+	})
+
+	// reverting to the snapshot resets its changes
+	if err := ct.virtTool.RevertToSnapshot(containerID, "snap1"); err != nil {
+		t.Fatalf("RevertToSnapshot(): %v", err)
+	}
+	ct.verifyChangedBlocks(containerID, "snap1", []DiskChanges{
+		{Device: "drive-sda", Granularity: fake.FakeDirtyBitmapGranularity},
+	})
+
+	if err := ct.virtTool.RemoveSnapshot(containerID, "snap1"); err != nil {
+		t.Fatalf("RemoveSnapshot(): %v", err)
+	}
+	if _, err := ct.virtTool.ChangedBlocks(containerID, "snap1"); err == nil {
+		t.Errorf("ChangedBlocks() didn't fail for a removed snapshot")
+	}
+	ct.verifyChangedBlocks(containerID, "snap2", []DiskChanges{
+		{
+			Device:        "drive-sda",
+			Granularity:   fake.FakeDirtyBitmapGranularity,
+			ChangedBlocks: 1,
+			ChangedBytes:  fake.FakeDirtyBitmapGranularity,
+		},
+	})
+
+	// the bitmaps of the removed snapshot are gone, so taking
+	// a snapshot with the same name starts from scratch
+	if err := ct.virtTool.CreateSnapshot(containerID, "snap1", ""); err != nil {
+		t.Fatalf("CreateSnapshot(): %v", err)
+	}
+	ct.verifyChangedBlocks(containerID, "snap1", []DiskChanges{
+		{Device: "drive-sda", Granularity: fake.FakeDirtyBitmapGranularity},
+	})
+}
+
+func TestChangedBlocksErrors(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	containerID := ct.startMonitorTestContainer()
+
+	for _, name := range []string{"", "foo bar", "../foo"} {
+		if _, err := ct.virtTool.ChangedBlocks(containerID, name); err == nil {
+			t.Errorf("ChangedBlocks() didn't fail for bad snapshot name %q", name)
+		}
+	}
+
+	if err := ct.virtTool.CreateSnapshot(containerID, "snap1", ""); err != nil {
+		t.Fatalf("CreateSnapshot(): %v", err)
+	}
+	ct.stopContainer(containerID)
+	if _, err := ct.virtTool.ChangedBlocks(containerID, "snap1"); err == nil {
+		t.Errorf("ChangedBlocks() didn't fail for a stopped VM")
+	}
+}
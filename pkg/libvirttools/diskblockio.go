@@ -0,0 +1,153 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// diskSectorFormat denotes a sector scheme of a disk
+type diskSectorFormat string
+
+const (
+	// diskSector512n denotes the disks with 512-byte logical
+	// and physical sectors
+	diskSector512n diskSectorFormat = "512n"
+	// diskSector512e denotes the disks with 4096-byte physical
+	// sectors that emulate 512-byte logical sectors
+	diskSector512e diskSectorFormat = "512e"
+	// diskSector4Kn denotes the disks with 4096-byte logical
+	// and physical sectors
+	diskSector4Kn diskSectorFormat = "4Kn"
+)
+
+// diskSectorSizes maps the sector formats to the logical and
+// physical block sizes of the disk
+var diskSectorSizes = map[diskSectorFormat][2]uint{
+	diskSector512n: {512, 512},
+	diskSector512e: {512, 4096},
+	diskSector4Kn:  {4096, 4096},
+}
+
+// diskSectorOptions contains the block sizes the disk presents
+// to the guest
+type diskSectorOptions struct {
+	// LogicalBlockSize is the logical block (sector) size of
+	// the disk in bytes
+	LogicalBlockSize uint
+	// PhysicalBlockSize is the physical block size of the disk
+	// in bytes
+	PhysicalBlockSize uint
+}
+
+// sectorTunableVolume is implemented by the volumes that support
+// setting the sector sizes
+type sectorTunableVolume interface {
+	sectorOptions() diskSectorOptions
+}
+
+func (o *diskSectorOptions) sectorOptions() diskSectorOptions {
+	return *o
+}
+
+func (o diskSectorOptions) isEmpty() bool {
+	return o.LogicalBlockSize == 0 && o.PhysicalBlockSize == 0
+}
+
+// format returns the sector format that matches the block sizes,
+// or an empty string if there's no such format
+func (o diskSectorOptions) format() diskSectorFormat {
+	for format, sizes := range diskSectorSizes {
+		if o.LogicalBlockSize == sizes[0] && o.PhysicalBlockSize == sizes[1] {
+			return format
+		}
+	}
+	return ""
+}
+
+func parseBlockSize(name, value string) (uint, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s (%q)", name, value)
+	}
+	return uint(n), nil
+}
+
+// parseDiskSectorOptions parses the sector format and the block
+// sizes and makes sure they describe one of the supported sector
+// formats: 512n (512-byte logical and physical blocks), 512e
+// (512-byte logical and 4096-byte physical blocks) or 4Kn
+// (4096-byte logical and physical blocks). If both the format
+// and the block sizes are specified, they must match.
+func parseDiskSectorOptions(formatStr, logicalStr, physicalStr string) (diskSectorOptions, error) {
+	var opts diskSectorOptions
+	var err error
+	if opts.LogicalBlockSize, err = parseBlockSize("logical block size", logicalStr); err != nil {
+		return diskSectorOptions{}, err
+	}
+	if opts.PhysicalBlockSize, err = parseBlockSize("physical block size", physicalStr); err != nil {
+		return diskSectorOptions{}, err
+	}
+
+	if formatStr != "" {
+		sizes, found := diskSectorSizes[diskSectorFormat(formatStr)]
+		if !found {
+			return diskSectorOptions{}, fmt.Errorf("bad sector format %q. Must be one of %q, %q or %q", formatStr, diskSector512n, diskSector512e, diskSector4Kn)
+		}
+		if (opts.LogicalBlockSize != 0 && opts.LogicalBlockSize != sizes[0]) ||
+			(opts.PhysicalBlockSize != 0 && opts.PhysicalBlockSize != sizes[1]) {
+			return diskSectorOptions{}, fmt.Errorf("block sizes %d/%d don't match sector format %q", opts.LogicalBlockSize, opts.PhysicalBlockSize, formatStr)
+		}
+		return diskSectorOptions{LogicalBlockSize: sizes[0], PhysicalBlockSize: sizes[1]}, nil
+	}
+
+	if !opts.isEmpty() && opts.format() == "" {
+		return diskSectorOptions{}, fmt.Errorf("logical/physical block sizes %d/%d don't match any supported sector format (512/512 for 512n, 512/4096 for 512e, 4096/4096 for 4Kn)", opts.LogicalBlockSize, opts.PhysicalBlockSize)
+	}
+	return opts, nil
+}
+
+// parseFlexvolumeSectorOptions extracts the sector settings from
+// the flexvolume config. They're common for all the flexvolume
+// types.
+func parseFlexvolumeSectorOptions(content []byte) (diskSectorOptions, error) {
+	var fvOpts struct {
+		SectorFormat      string `json:"sectorFormat,omitempty"`
+		LogicalBlockSize  string `json:"logicalBlockSize,omitempty"`
+		PhysicalBlockSize string `json:"physicalBlockSize,omitempty"`
+	}
+	if err := json.Unmarshal(content, &fvOpts); err != nil {
+		return diskSectorOptions{}, err
+	}
+	return parseDiskSectorOptions(fvOpts.SectorFormat, fvOpts.LogicalBlockSize, fvOpts.PhysicalBlockSize)
+}
+
+// applySectorOptions sets the block sizes of the disk using
+// <blockio> element of the disk definition
+func applySectorOptions(disk *libvirtxml.DomainDisk, opts diskSectorOptions) {
+	disk.BlockIO = &libvirtxml.DomainDiskBlockIO{
+		LogicalBlockSize:  opts.LogicalBlockSize,
+		PhysicalBlockSize: opts.PhysicalBlockSize,
+	}
+}
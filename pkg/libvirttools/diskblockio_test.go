@@ -0,0 +1,103 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFlexvolumeSectorOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		content      string
+		expectedOpts diskSectorOptions
+		valid        bool
+	}{
+		{
+			name:    "no sector settings",
+			content: `{"type": "qcow2"}`,
+			valid:   true,
+		},
+		{
+			name:         "512n format",
+			content:      `{"type": "qcow2", "sectorFormat": "512n"}`,
+			expectedOpts: diskSectorOptions{LogicalBlockSize: 512, PhysicalBlockSize: 512},
+			valid:        true,
+		},
+		{
+			name:         "512e format",
+			content:      `{"type": "qcow2", "sectorFormat": "512e"}`,
+			expectedOpts: diskSectorOptions{LogicalBlockSize: 512, PhysicalBlockSize: 4096},
+			valid:        true,
+		},
+		{
+			name:         "4Kn format",
+			content:      `{"type": "raw", "path": "/dev/sdb", "sectorFormat": "4Kn"}`,
+			expectedOpts: diskSectorOptions{LogicalBlockSize: 4096, PhysicalBlockSize: 4096},
+			valid:        true,
+		},
+		{
+			name:         "512e block sizes",
+			content:      `{"type": "qcow2", "logicalBlockSize": "512", "physicalBlockSize": "4096"}`,
+			expectedOpts: diskSectorOptions{LogicalBlockSize: 512, PhysicalBlockSize: 4096},
+			valid:        true,
+		},
+		{
+			name:         "format with a matching block size",
+			content:      `{"type": "qcow2", "sectorFormat": "4Kn", "logicalBlockSize": "4096"}`,
+			expectedOpts: diskSectorOptions{LogicalBlockSize: 4096, PhysicalBlockSize: 4096},
+			valid:        true,
+		},
+		{
+			name:    "bad format",
+			content: `{"type": "qcow2", "sectorFormat": "4Ke"}`,
+		},
+		{
+			name:    "format with a mismatching block size",
+			content: `{"type": "qcow2", "sectorFormat": "512e", "physicalBlockSize": "512"}`,
+		},
+		{
+			name:    "logical block size bigger than the physical one",
+			content: `{"type": "qcow2", "logicalBlockSize": "4096", "physicalBlockSize": "512"}`,
+		},
+		{
+			name:    "logical block size only",
+			content: `{"type": "qcow2", "logicalBlockSize": "4096"}`,
+		},
+		{
+			name:    "unsupported block sizes",
+			content: `{"type": "qcow2", "logicalBlockSize": "1024", "physicalBlockSize": "1024"}`,
+		},
+		{
+			name:    "non-numeric block size",
+			content: `{"type": "qcow2", "logicalBlockSize": "4k", "physicalBlockSize": "4k"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts, err := parseFlexvolumeSectorOptions([]byte(tc.content))
+			switch {
+			case tc.valid && err != nil:
+				t.Errorf("parseFlexvolumeSectorOptions(): %v", err)
+			case !tc.valid && err == nil:
+				t.Errorf("invalid sector settings considered valid")
+			case !reflect.DeepEqual(opts, tc.expectedOpts):
+				t.Errorf("bad sector options %#v instead of %#v", opts, tc.expectedOpts)
+			}
+		})
+	}
+}
@@ -31,12 +31,18 @@ const (
 	// the root volume), but we want to be on the safe side here
 	maxVirtioBlockDevChar = 'u'
 	maxScsiBlockDevChar   = 'z'
+
+	maxVirtioBlockDevices = maxVirtioBlockDevChar - minBlockDevChar + 1
+	maxScsiBlockDevices   = maxScsiBlockDevChar - minBlockDevChar + 1
 )
 
 type diskDriver interface {
 	diskPath(domainDef *libvirtxml.Domain) (*diskPath, error)
 	target() *libvirtxml.DomainDiskTarget
 	address() *libvirtxml.DomainAddress
+	applyQueueOptions(domainDef *libvirtxml.Domain, disk *libvirtxml.DomainDisk, opts diskQueueOptions) error
+	applyInquiryOptions(disk *libvirtxml.DomainDisk, opts diskInquiryOptions) error
+	applyIOOptions(domainDef *libvirtxml.Domain, disk *libvirtxml.DomainDisk, opts diskIOOptions) error
 }
 
 type diskDriverFactory func(n int) (diskDriver, error)
@@ -100,6 +106,46 @@ func (d *virtioBlkDriver) address() *libvirtxml.DomainAddress {
 	}
 }
 
+func (d *virtioBlkDriver) applyQueueOptions(domainDef *libvirtxml.Domain, disk *libvirtxml.DomainDisk, opts diskQueueOptions) error {
+	if opts.Queues != 0 {
+		if disk.Driver == nil {
+			disk.Driver = &libvirtxml.DomainDiskDriver{}
+		}
+		queues := opts.Queues
+		disk.Driver.Queues = &queues
+	}
+	if opts.QueueSize != 0 {
+		// libvirt uses virtio-diskN aliases for virtio-blk disks
+		setQEMUDeviceProperty(domainDef, fmt.Sprintf("virtio-disk%d", d.n), "queue-size", opts.QueueSize)
+	}
+	return nil
+}
+
+func (d *virtioBlkDriver) applyInquiryOptions(disk *libvirtxml.DomainDisk, opts diskInquiryOptions) error {
+	return errors.New("wwn, vendor and product can only be set for scsi disks")
+}
+
+func (d *virtioBlkDriver) applyIOOptions(domainDef *libvirtxml.Domain, disk *libvirtxml.DomainDisk, opts diskIOOptions) error {
+	if opts.AIO != "" {
+		if err := setDiskAIO(disk, opts.AIO); err != nil {
+			return err
+		}
+	}
+	if opts.PollMaxNs != 0 {
+		// polling is done by iothreads, so the disk gets an
+		// iothread of its own. libvirt uses iothreadN aliases
+		// for the iothread objects
+		if disk.Driver == nil {
+			disk.Driver = &libvirtxml.DomainDiskDriver{}
+		}
+		domainDef.IOThreads++
+		ioThread := domainDef.IOThreads
+		disk.Driver.IOThread = &ioThread
+		setQEMUProperty(domainDef, "object", fmt.Sprintf("iothread%d", ioThread), "poll-max-ns", opts.PollMaxNs)
+	}
+	return nil
+}
+
 type scsiDriver struct {
 	n        int
 	diskChar int
@@ -179,6 +225,52 @@ func (d *scsiDriver) address() *libvirtxml.DomainAddress {
 	}
 }
 
+func (d *scsiDriver) applyQueueOptions(domainDef *libvirtxml.Domain, disk *libvirtxml.DomainDisk, opts diskQueueOptions) error {
+	// The queues belong to the virtio-scsi controller which is
+	// shared by all the scsi disks, so the largest values
+	// requested for the disks are used
+	var controller *libvirtxml.DomainController
+	for n, c := range domainDef.Devices.Controllers {
+		if c.Type == "scsi" && c.Index != nil && *c.Index == 0 {
+			controller = &domainDef.Devices.Controllers[n]
+			break
+		}
+	}
+	if controller == nil {
+		return errors.New("scsi controller not found")
+	}
+	if opts.Queues != 0 {
+		if controller.Driver == nil {
+			controller.Driver = &libvirtxml.DomainControllerDriver{}
+		}
+		if controller.Driver.Queues == nil || *controller.Driver.Queues < opts.Queues {
+			queues := opts.Queues
+			controller.Driver.Queues = &queues
+		}
+	}
+	if opts.QueueSize != 0 {
+		setQEMUDeviceProperty(domainDef, scsiControllerAlias, "virtqueue_size", opts.QueueSize)
+	}
+	return nil
+}
+
+func (d *scsiDriver) applyInquiryOptions(disk *libvirtxml.DomainDisk, opts diskInquiryOptions) error {
+	disk.WWN = opts.WWN
+	disk.Vendor = opts.Vendor
+	disk.Product = opts.Product
+	return nil
+}
+
+func (d *scsiDriver) applyIOOptions(domainDef *libvirtxml.Domain, disk *libvirtxml.DomainDisk, opts diskIOOptions) error {
+	if opts.PollMaxNs != 0 {
+		return errors.New("pollMaxNs can only be set for virtio disks")
+	}
+	if opts.AIO != "" {
+		return setDiskAIO(disk, opts.AIO)
+	}
+	return nil
+}
+
 func getDiskDriverFactory(name diskDriverName) (diskDriverFactory, error) {
 	if f, found := diskDriverMap[name]; found {
 		return f, nil
@@ -235,7 +327,7 @@ func pciPath(domainDef *libvirtxml.Domain, address *libvirtxml.DomainAddress) (s
 		if address == nil || address.PCI == nil || address.PCI.Domain == nil || address.PCI.Bus == nil || address.PCI.Slot == nil || address.PCI.Function == nil {
 			return fmt.Errorf("can't make path for device address %#v", address)
 		}
-		if *address.PCI.Bus > uint(len(pciControllers)) {
+		if *address.PCI.Bus >= uint(len(pciControllers)) {
 			return fmt.Errorf("bad PCI bus number: %#v", address)
 		}
 		ctl := pciControllers[*address.PCI.Bus]
@@ -0,0 +1,104 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// the sizes of the vendor identification and product
+	// identification fields of SCSI inquiry data
+	maxSCSIVendorLength  = 8
+	maxSCSIProductLength = 16
+)
+
+// libvirt requires WWN to be 16 hex digits with optional 0x prefix
+var wwnRx = regexp.MustCompile(`^(0x)?[0-9a-fA-F]{16}$`)
+
+// diskInquiryOptions contains the settings of a disk that are
+// reported to the guest in SCSI inquiry data
+type diskInquiryOptions struct {
+	// WWN is the World Wide Name of the disk
+	WWN string
+	// Vendor is the vendor identification of the disk
+	Vendor string
+	// Product is the product identification of the disk
+	Product string
+}
+
+// inquiryTunableVolume is implemented by the volumes that support
+// SCSI inquiry data settings
+type inquiryTunableVolume interface {
+	inquiryOptions() diskInquiryOptions
+}
+
+func (o *diskInquiryOptions) inquiryOptions() diskInquiryOptions {
+	return *o
+}
+
+func (o diskInquiryOptions) isEmpty() bool {
+	return o.WWN == "" && o.Vendor == "" && o.Product == ""
+}
+
+func isPrintableASCII(s string) bool {
+	for _, c := range s {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func (o diskInquiryOptions) validate() error {
+	var errs []string
+	if o.WWN != "" && !wwnRx.MatchString(o.WWN) {
+		errs = append(errs, fmt.Sprintf("bad disk wwn %q. Must be 16 hex digits with optional 0x prefix", o.WWN))
+	}
+	if len(o.Vendor) > maxSCSIVendorLength || !isPrintableASCII(o.Vendor) {
+		errs = append(errs, fmt.Sprintf("bad disk vendor %q. Must be at most %d printable ASCII characters", o.Vendor, maxSCSIVendorLength))
+	}
+	if len(o.Product) > maxSCSIProductLength || !isPrintableASCII(o.Product) {
+		errs = append(errs, fmt.Sprintf("bad disk product %q. Must be at most %d printable ASCII characters", o.Product, maxSCSIProductLength))
+	}
+	if errs != nil {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// parseFlexvolumeInquiryOptions extracts the SCSI inquiry data
+// settings from the flexvolume config. They're common for all the
+// flexvolume types.
+func parseFlexvolumeInquiryOptions(content []byte) (diskInquiryOptions, error) {
+	var fvOpts struct {
+		WWN     string `json:"wwn,omitempty"`
+		Vendor  string `json:"vendor,omitempty"`
+		Product string `json:"product,omitempty"`
+	}
+	if err := json.Unmarshal(content, &fvOpts); err != nil {
+		return diskInquiryOptions{}, err
+	}
+	opts := diskInquiryOptions(fvOpts)
+	if err := opts.validate(); err != nil {
+		return diskInquiryOptions{}, err
+	}
+	return opts, nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFlexvolumeInquiryOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		content      string
+		expectedOpts diskInquiryOptions
+		valid        bool
+	}{
+		{
+			name:    "no inquiry options",
+			content: `{"type": "qcow2"}`,
+			valid:   true,
+		},
+		{
+			name:    "all inquiry options",
+			content: `{"type": "qcow2", "wwn": "0x5000c50015ea71ac", "vendor": "VIRTLET", "product": "FASTDISK"}`,
+			expectedOpts: diskInquiryOptions{
+				WWN:     "0x5000c50015ea71ac",
+				Vendor:  "VIRTLET",
+				Product: "FASTDISK",
+			},
+			valid: true,
+		},
+		{
+			name:         "wwn without 0x prefix",
+			content:      `{"type": "qcow2", "wwn": "5000C50015EA71AC"}`,
+			expectedOpts: diskInquiryOptions{WWN: "5000C50015EA71AC"},
+			valid:        true,
+		},
+		{
+			name:    "short wwn",
+			content: `{"type": "qcow2", "wwn": "0x5000c50015ea71"}`,
+		},
+		{
+			name:    "non-hex wwn",
+			content: `{"type": "qcow2", "wwn": "0x5000c50015ea71zz"}`,
+		},
+		{
+			name:    "vendor too long",
+			content: `{"type": "qcow2", "vendor": "VIRTLET12"}`,
+		},
+		{
+			name:    "product too long",
+			content: `{"type": "qcow2", "product": "FASTDISK-12345678"}`,
+		},
+		{
+			name:    "non-printable product",
+			content: `{"type": "qcow2", "product": "FAST\tDISK"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts, err := parseFlexvolumeInquiryOptions([]byte(tc.content))
+			switch {
+			case tc.valid && err != nil:
+				t.Errorf("parseFlexvolumeInquiryOptions(): %v", err)
+			case !tc.valid && err == nil:
+				t.Errorf("invalid inquiry options considered valid")
+			case !reflect.DeepEqual(opts, tc.expectedOpts):
+				t.Errorf("bad inquiry options %#v instead of %#v", opts, tc.expectedOpts)
+			}
+		})
+	}
+}
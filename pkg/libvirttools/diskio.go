@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/glog"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	diskAIONative  = "native"
+	diskAIOThreads = "threads"
+	diskAIOIOURing = "io_uring"
+
+	// io_uring support was added in qemu 5.0 and libvirt 6.3.
+	// libvirt reports the versions as major * 1000000 + minor * 1000 + release
+	minIOURingQEMUVersion    = 5000000
+	minIOURingLibvirtVersion = 6003000
+)
+
+// diskIOOptions contains the settings of the I/O backend of a disk
+type diskIOOptions struct {
+	// AIO is the asynchronous I/O backend used by the hypervisor
+	// for the disk (native, threads or io_uring)
+	AIO string
+	// PollMaxNs is the maximum time in nanoseconds the iothread
+	// of the disk busy-polls for new requests before sleeping
+	PollMaxNs uint
+}
+
+// ioTunableVolume is implemented by the volumes that support
+// I/O backend settings
+type ioTunableVolume interface {
+	ioOptions() diskIOOptions
+}
+
+func (o *diskIOOptions) ioOptions() diskIOOptions {
+	return *o
+}
+
+func (o diskIOOptions) isEmpty() bool {
+	return o.AIO == "" && o.PollMaxNs == 0
+}
+
+func (o diskIOOptions) validate() error {
+	switch o.AIO {
+	case "", diskAIONative, diskAIOThreads, diskAIOIOURing:
+		return nil
+	default:
+		return fmt.Errorf("bad disk aio mode %q. Must be one of %s, %s, %s", o.AIO, diskAIONative, diskAIOThreads, diskAIOIOURing)
+	}
+}
+
+// parseFlexvolumeIOOptions extracts the I/O backend settings from
+// the flexvolume config. They're common for all the flexvolume
+// types.
+func parseFlexvolumeIOOptions(content []byte) (diskIOOptions, error) {
+	var fvOpts struct {
+		AIO       string `json:"aio,omitempty"`
+		PollMaxNs string `json:"pollMaxNs,omitempty"`
+	}
+	if err := json.Unmarshal(content, &fvOpts); err != nil {
+		return diskIOOptions{}, err
+	}
+	opts := diskIOOptions{AIO: fvOpts.AIO}
+	var err error
+	if opts.PollMaxNs, err = parseQueueOptionValue("disk pollMaxNs", fvOpts.PollMaxNs); err != nil {
+		return diskIOOptions{}, err
+	}
+	if err := opts.validate(); err != nil {
+		return diskIOOptions{}, err
+	}
+	return opts, nil
+}
+
+// setDiskAIO sets the aio mode of the disk. Native aio requires
+// the disk to be opened with O_DIRECT, so unless a caching mode is
+// already set for the disk, the host page cache is bypassed for it.
+func setDiskAIO(disk *libvirtxml.DomainDisk, aio string) error {
+	if disk.Driver == nil {
+		disk.Driver = &libvirtxml.DomainDiskDriver{}
+	}
+	if aio == diskAIONative {
+		switch disk.Driver.Cache {
+		case "":
+			disk.Driver.Cache = "none"
+		case "none", "directsync":
+		default:
+			return fmt.Errorf("native aio can't be used with %q cache mode", disk.Driver.Cache)
+		}
+	}
+	disk.Driver.IO = aio
+	return nil
+}
+
+// ioURingSupported returns true if both libvirt and the hypervisor
+// are recent enough to use io_uring aio mode
+func (v *VirtualizationTool) ioURingSupported() (bool, error) {
+	versions, err := v.hypervisorVersions()
+	if err != nil {
+		return false, err
+	}
+	return versions.libvirt >= minIOURingLibvirtVersion && versions.qemu >= minIOURingQEMUVersion, nil
+}
+
+// applyIOOptions applies the I/O backend settings of the volumes to
+// the domain definition. It must be called after the disks of the
+// diskList are added to the domain definition. If io_uring is
+// requested for a disk but isn't supported by the hypervisor, native
+// aio is used instead.
+func (dl *diskList) applyIOOptions(domainDef *libvirtxml.Domain, ioURingSupported func() (bool, error)) error {
+	if len(domainDef.Devices.Disks) != len(dl.items) {
+		return fmt.Errorf("disk count mismatch: %d disks in the domain definition, %d volumes", len(domainDef.Devices.Disks), len(dl.items))
+	}
+	checkedIOURing, haveIOURing := false, false
+	for n, item := range dl.items {
+		tunable, ok := item.volume.(ioTunableVolume)
+		if !ok {
+			continue
+		}
+		opts := tunable.ioOptions()
+		if opts.isEmpty() {
+			continue
+		}
+		if opts.AIO == diskAIOIOURing {
+			if !checkedIOURing {
+				var err error
+				if haveIOURing, err = ioURingSupported(); err != nil {
+					return err
+				}
+				checkedIOURing = true
+			}
+			if !haveIOURing {
+				glog.Warningf("io_uring aio mode requested for disk %d of VM %q is not supported by the hypervisor, using native aio instead", n, dl.config.Name)
+				opts.AIO = diskAIONative
+			}
+		}
+		if err := item.driver.applyIOOptions(domainDef, &domainDef.Devices.Disks[n], opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
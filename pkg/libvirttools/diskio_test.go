@@ -0,0 +1,163 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+func TestParseFlexvolumeIOOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		content      string
+		expectedOpts diskIOOptions
+		valid        bool
+	}{
+		{
+			name:    "no io options",
+			content: `{"type": "raw"}`,
+			valid:   true,
+		},
+		{
+			name:         "io_uring with polling",
+			content:      `{"type": "raw", "aio": "io_uring", "pollMaxNs": "32768"}`,
+			expectedOpts: diskIOOptions{AIO: "io_uring", PollMaxNs: 32768},
+			valid:        true,
+		},
+		{
+			name:         "threads",
+			content:      `{"type": "raw", "aio": "threads"}`,
+			expectedOpts: diskIOOptions{AIO: "threads"},
+			valid:        true,
+		},
+		{
+			name:    "bad aio mode",
+			content: `{"type": "raw", "aio": "posix"}`,
+		},
+		{
+			name:    "bad pollMaxNs",
+			content: `{"type": "raw", "pollMaxNs": "-1"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts, err := parseFlexvolumeIOOptions([]byte(tc.content))
+			switch {
+			case tc.valid && err != nil:
+				t.Errorf("parseFlexvolumeIOOptions(): %v", err)
+			case !tc.valid && err == nil:
+				t.Errorf("invalid io options considered valid")
+			case !reflect.DeepEqual(opts, tc.expectedOpts):
+				t.Errorf("bad io options %#v instead of %#v", opts, tc.expectedOpts)
+			}
+		})
+	}
+}
+
+func TestApplyIOOptions(t *testing.T) {
+	ioThread := uint(1)
+	for _, tc := range []struct {
+		name             string
+		driverName       diskDriverName
+		opts             diskIOOptions
+		ioURingSupported bool
+		expectedDriver   libvirtxml.DomainDiskDriver
+		expectedArgs     []string
+		expectError      bool
+	}{
+		{
+			name:             "io_uring",
+			driverName:       diskDriverVirtio,
+			opts:             diskIOOptions{AIO: "io_uring"},
+			ioURingSupported: true,
+			expectedDriver:   libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw", IO: "io_uring"},
+		},
+		{
+			name:           "io_uring fallback when unsupported",
+			driverName:     diskDriverVirtio,
+			opts:           diskIOOptions{AIO: "io_uring"},
+			expectedDriver: libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw", IO: "native", Cache: "none"},
+		},
+		{
+			name:           "native aio on scsi disk",
+			driverName:     diskDriverScsi,
+			opts:           diskIOOptions{AIO: "native"},
+			expectedDriver: libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw", IO: "native", Cache: "none"},
+		},
+		{
+			name:           "polling",
+			driverName:     diskDriverVirtio,
+			opts:           diskIOOptions{AIO: "threads", PollMaxNs: 32768},
+			expectedDriver: libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw", IO: "threads", IOThread: &ioThread},
+			expectedArgs:   []string{"-set", "object.iothread1.poll-max-ns=32768"},
+		},
+		{
+			name:        "polling on scsi disk",
+			driverName:  diskDriverScsi,
+			opts:        diskIOOptions{PollMaxNs: 32768},
+			expectError: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			driverFactory, err := getDiskDriverFactory(tc.driverName)
+			if err != nil {
+				t.Fatalf("getDiskDriverFactory(): %v", err)
+			}
+			driver, err := driverFactory(0)
+			if err != nil {
+				t.Fatalf("driverFactory(): %v", err)
+			}
+			dl := &diskList{
+				config: &VMConfig{Name: "vm"},
+				items: []*diskItem{
+					{driver: driver, volume: &driverVolume{diskIOOptions: tc.opts}},
+				},
+			}
+			domainDef := &libvirtxml.Domain{
+				Devices: &libvirtxml.DomainDeviceList{
+					Disks: []libvirtxml.DomainDisk{
+						{Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw"}},
+					},
+				},
+				QEMUCommandline: &libvirtxml.DomainQEMUCommandline{},
+			}
+			err = dl.applyIOOptions(domainDef, func() (bool, error) {
+				return tc.ioURingSupported, nil
+			})
+			switch {
+			case tc.expectError && err == nil:
+				t.Fatalf("applyIOOptions() didn't fail")
+			case tc.expectError:
+				return
+			case err != nil:
+				t.Fatalf("applyIOOptions(): %v", err)
+			}
+			if driver := *domainDef.Devices.Disks[0].Driver; !reflect.DeepEqual(driver, tc.expectedDriver) {
+				t.Errorf("bad disk driver %#v instead of %#v", driver, tc.expectedDriver)
+			}
+			var args []string
+			for _, arg := range domainDef.QEMUCommandline.Args {
+				args = append(args, arg.Value)
+			}
+			if !reflect.DeepEqual(args, tc.expectedArgs) {
+				t.Errorf("bad qemu args %#v instead of %#v", args, tc.expectedArgs)
+			}
+		})
+	}
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package libvirttools
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 
@@ -38,36 +39,95 @@ func (di *diskItem) setup(config *VMConfig) (*libvirtxml.DomainDisk, error) {
 	}
 	diskDef.Target = di.driver.target()
 	diskDef.Address = di.driver.address()
+	if serial := di.serial(); serial != "" {
+		diskDef.Serial = serial
+	}
+	if shareable, ok := di.volume.(shareableVolume); ok && shareable.shareOptions().Shareable {
+		diskDef.Shareable = &libvirtxml.DomainDiskShareable{}
+	}
+	if tunable, ok := di.volume.(sectorTunableVolume); ok {
+		if opts := tunable.sectorOptions(); !opts.isEmpty() {
+			applySectorOptions(diskDef, opts)
+		}
+	}
+	if tunable, ok := di.volume.(inquiryTunableVolume); ok {
+		if opts := tunable.inquiryOptions(); !opts.isEmpty() {
+			if err := di.driver.applyInquiryOptions(diskDef, opts); err != nil {
+				return nil, err
+			}
+		}
+	}
 	return diskDef, nil
 }
 
 type diskList struct {
 	config *VMConfig
 	items  []*diskItem
+	// diskless contains the volumes that are passed to the VM
+	// without a disk, such as the config volume for fw_cfg
+	// seed mechanism
+	diskless []VMVolume
 }
 
 // newDiskList creates a diskList for the specified VMConfig, volume
 // source and volume owner
-func newDiskList(config *VMConfig, source VMVolumeSource, owner volumeOwner) (*diskList, error) {
+func newDiskList(config *VMConfig, source VMVolumeSource, owner VolumeOwner) (*diskList, error) {
 	vmVols, err := source(config, owner)
 	if err != nil {
 		return nil, err
 	}
 
-	diskDriverFactory, err := getDiskDriverFactory(config.ParsedAnnotations.DiskDriver)
+	if len(vmVols) > maxScsiBlockDevices {
+		return nil, fmt.Errorf("too many volumes: %d. At most %d volumes are supported per VM including the root and the config volumes "+
+			"(virtio-blk disk driver supports up to %d volumes, for more volumes virtio-scsi driver is used automatically)",
+			len(vmVols), maxScsiBlockDevices, maxVirtioBlockDevices)
+	}
+	driverName := config.ParsedAnnotations.DiskDriver
+	if driverName == diskDriverVirtio && len(vmVols) > maxVirtioBlockDevices {
+		glog.Warningf("VM %q has %d volumes which exceeds virtio-blk limit of %d volumes, using virtio-scsi disk driver instead",
+			config.Name, len(vmVols), maxVirtioBlockDevices)
+		driverName = diskDriverScsi
+	}
+
+	diskDriverFactory, err := getDiskDriverFactory(driverName)
 	if err != nil {
 		return nil, err
 	}
 	var items []*diskItem
-	for n, volume := range vmVols {
-		driver, err := diskDriverFactory(n)
+	var diskless []VMVolume
+	for _, volume := range vmVols {
+		if cv, ok := volume.(*configVolume); ok && cv.diskless() {
+			diskless = append(diskless, volume)
+			continue
+		}
+		driver, err := diskDriverFactory(len(items))
 		if err != nil {
 			return nil, err
 		}
 		items = append(items, &diskItem{driver, volume})
 	}
 
-	return &diskList{config, items}, nil
+	return &diskList{config, items, diskless}, nil
+}
+
+// volumes returns all the volumes in the diskList including
+// the diskless ones
+func (dl *diskList) volumes() []VMVolume {
+	var volumes []VMVolume
+	for _, item := range dl.items {
+		volumes = append(volumes, item.volume)
+	}
+	return append(volumes, dl.diskless...)
+}
+
+// setupSeed updates the domain definition so the cloud-init data
+// is passed to the VM using the seed mechanism of the VM
+func (dl *diskList) setupSeed(domainDef *libvirtxml.Domain) {
+	for _, volume := range dl.volumes() {
+		if cv, ok := volume.(*configVolume); ok {
+			cv.cloudInitGenerator().setupSeed(domainDef)
+		}
+	}
 }
 
 // setup performs the setup procedure on each volume in the diskList
@@ -94,9 +154,26 @@ func (dl *diskList) setup() ([]libvirtxml.DomainDisk, error) {
 // images (such as cloud-init nocloud datasource).  It must be passed
 // a Domain for which images are being generated.
 func (dl *diskList) writeImages(domain virt.Domain) error {
+	volumeMap, err := dl.volumeMap(domain)
+	if err != nil {
+		return err
+	}
+
+	for _, volume := range dl.volumes() {
+		if err := volume.WriteImage(volumeMap); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// volumeMap returns a diskPathMap for the volumes in the diskList that
+// have UUIDs. It must be passed a Domain that uses these volumes.
+func (dl *diskList) volumeMap(domain virt.Domain) (diskPathMap, error) {
 	domainDesc, err := domain.XML()
 	if err != nil {
-		return fmt.Errorf("couldn't get domain xml: %v", err)
+		return nil, fmt.Errorf("couldn't get domain xml: %v", err)
 	}
 
 	volumeMap := make(diskPathMap)
@@ -105,25 +182,123 @@ func (dl *diskList) writeImages(domain virt.Domain) error {
 		if uuid != "" {
 			diskPath, err := item.driver.diskPath(domainDesc)
 			if err != nil {
-				return err
+				return nil, err
+			}
+			// by-path links depend on the disk addresses, by-id
+			// links only depend on the serial
+			if byIDPath := item.byIDPath(); byIDPath != "" {
+				diskPath.devPath = byIDPath
 			}
 			volumeMap[uuid] = *diskPath
 		}
 	}
+	return volumeMap, nil
+}
 
+// regenerateConfig rewrites the config image (cloud-init data) for
+// the domain and changes the media in the corresponding cdrom drive
+// so the new image is visible to the guest. The fw_cfg seed files
+// are only rewritten as fw_cfg entries are read by qemu when the VM
+// starts.
+func (dl *diskList) regenerateConfig(domain virt.Domain) error {
+	volumeMap, err := dl.volumeMap(domain)
+	if err != nil {
+		return err
+	}
+
+	for _, volume := range dl.diskless {
+		if _, ok := volume.(*configVolume); ok {
+			return volume.WriteImage(volumeMap)
+		}
+	}
+
+	found := false
+	// with the dual config layout, there are two config images
 	for _, item := range dl.items {
+		if _, ok := item.volume.(*configVolume); !ok {
+			continue
+		}
+		found = true
 		if err := item.volume.WriteImage(volumeMap); err != nil {
 			return err
 		}
+		diskDef, err := item.setup(dl.config)
+		if err != nil {
+			return err
+		}
+		// libvirt doesn't change the media if the path of the
+		// image stays the same, so the old media is ejected first
+		ejected := *diskDef
+		ejected.Source = nil
+		if err := domain.UpdateDisk(&ejected); err != nil {
+			return fmt.Errorf("error ejecting the config image: %v", err)
+		}
+		if err := domain.UpdateDisk(diskDef); err != nil {
+			return err
+		}
 	}
 
+	if !found {
+		return errors.New("config volume not found")
+	}
+	return nil
+}
+
+// preserve tears down the volumes in the diskList except for those
+// that can be preserved, which are renamed using the specified
+// timestamp so they're kept for later analysis
+func (dl *diskList) preserve(timestamp string) error {
+	var errs []string
+	for _, volume := range dl.volumes() {
+		var err error
+		if pv, ok := asPreservableVolume(volume); ok {
+			var volPath string
+			volPath, err = pv.Preserve(timestamp)
+			if err == nil {
+				glog.Infof("Preserved volume of the container %q: %s", dl.config.DomainUUID, volPath)
+			}
+		} else {
+			err = volume.Teardown()
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if errs != nil {
+		return fmt.Errorf("failed to preserve or tear down some of the volumes:\n%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// teardownStopped tears down the flexvolumes of a stopped VM, which
+// are about to be unmounted by kubelet. The volumes managed by
+// Virtlet itself, such as the root volume and the config volume, are
+// kept till the container is removed, so the VM can be started again
+// or its disk can be exported. If keepPreservable is true, the
+// flexvolumes that can be preserved are kept, too.
+func (dl *diskList) teardownStopped(keepPreservable bool) error {
+	var errs []string
+	for _, volume := range dl.volumes() {
+		if _, ok := volume.(*driverVolume); !ok {
+			continue
+		}
+		if _, ok := asPreservableVolume(volume); ok && keepPreservable {
+			continue
+		}
+		if err := volume.Teardown(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if errs != nil {
+		return fmt.Errorf("failed to tear down some of the volumes:\n%s", strings.Join(errs, "\n"))
+	}
 	return nil
 }
 
 func (dl *diskList) teardown() error {
 	var errs []string
-	for _, item := range dl.items {
-		if err := item.volume.Teardown(); err != nil {
+	for _, volume := range dl.volumes() {
+		if err := volume.Teardown(); err != nil {
 			errs = append(errs, err.Error())
 		}
 	}
@@ -0,0 +1,173 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	// qemu requires virtqueue size to be a power of two
+	// greater than 2 and not exceeding VIRTQUEUE_MAX_SIZE
+	minDiskQueueSize = 4
+	maxDiskQueueSize = 1024
+	// there's no point in having more queues than vCPUs
+	maxDiskQueues = maxVCPUCount
+	// scsiControllerAlias is the alias libvirt assigns to the
+	// virtio-scsi controller with index 0
+	scsiControllerAlias = "scsi0"
+)
+
+// diskQueueOptions contains virtio queue settings of a disk
+type diskQueueOptions struct {
+	// Queues is the number of virtqueues (num_queues)
+	Queues uint
+	// QueueSize is the size of each virtqueue (queue_size)
+	QueueSize uint
+}
+
+// queueTunableVolume is implemented by the volumes that support
+// virtio queue settings
+type queueTunableVolume interface {
+	queueOptions() diskQueueOptions
+}
+
+func (o *diskQueueOptions) queueOptions() diskQueueOptions {
+	return *o
+}
+
+func (o diskQueueOptions) isEmpty() bool {
+	return o.Queues == 0 && o.QueueSize == 0
+}
+
+func (o diskQueueOptions) validate() error {
+	var errs []string
+	if o.Queues > maxDiskQueues {
+		errs = append(errs, fmt.Sprintf("disk queue count %d too big, max is %d", o.Queues, maxDiskQueues))
+	}
+	if o.QueueSize != 0 {
+		if o.QueueSize < minDiskQueueSize || o.QueueSize > maxDiskQueueSize || o.QueueSize&(o.QueueSize-1) != 0 {
+			errs = append(errs, fmt.Sprintf("bad disk queue size %d. Must be a power of two between %d and %d", o.QueueSize, minDiskQueueSize, maxDiskQueueSize))
+		}
+	}
+	if errs != nil {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+func parseQueueOptionValue(name, value string) (uint, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s (%q)", name, value)
+	}
+	return uint(n), nil
+}
+
+// parseDiskQueueOptions parses and validates the virtio queue
+// settings that are passed as strings
+func parseDiskQueueOptions(queuesStr, queueSizeStr string) (diskQueueOptions, error) {
+	var opts diskQueueOptions
+	var err error
+	if opts.Queues, err = parseQueueOptionValue("disk queue count", queuesStr); err != nil {
+		return diskQueueOptions{}, err
+	}
+	if opts.QueueSize, err = parseQueueOptionValue("disk queue size", queueSizeStr); err != nil {
+		return diskQueueOptions{}, err
+	}
+	if err := opts.validate(); err != nil {
+		return diskQueueOptions{}, err
+	}
+	return opts, nil
+}
+
+// parseFlexvolumeQueueOptions extracts the virtio queue settings
+// from the flexvolume config. They're common for all the flexvolume
+// types.
+func parseFlexvolumeQueueOptions(content []byte) (diskQueueOptions, error) {
+	var fvOpts struct {
+		Queues    string `json:"queues,omitempty"`
+		QueueSize string `json:"queueSize,omitempty"`
+	}
+	if err := json.Unmarshal(content, &fvOpts); err != nil {
+		return diskQueueOptions{}, err
+	}
+	return parseDiskQueueOptions(fvOpts.Queues, fvOpts.QueueSize)
+}
+
+// setQEMUDeviceProperty sets a property of the qemu device with
+// the specified alias using `-set` command line option. If the
+// property is already set, the larger value is kept. This is used
+// for the properties that can't be set via the libvirt domain
+// definition, such as the virtqueue size of the disks which is not
+// supported by libvirt used by Virtlet.
+func setQEMUDeviceProperty(domainDef *libvirtxml.Domain, alias, prop string, value uint) {
+	setQEMUProperty(domainDef, "device", alias, prop, value)
+}
+
+// setQEMUProperty sets a property of the qemu option with the
+// specified group (e.g. device or object) and id using `-set`
+// command line option. If the property is already set, the larger
+// value is kept.
+func setQEMUProperty(domainDef *libvirtxml.Domain, group, id, prop string, value uint) {
+	prefix := fmt.Sprintf("%s.%s.%s=", group, id, prop)
+	newValue := prefix + strconv.FormatUint(uint64(value), 10)
+	args := domainDef.QEMUCommandline.Args
+	for n := 1; n < len(args); n++ {
+		if args[n-1].Value != "-set" || !strings.HasPrefix(args[n].Value, prefix) {
+			continue
+		}
+		if oldValue, err := strconv.ParseUint(strings.TrimPrefix(args[n].Value, prefix), 10, 32); err != nil || uint(oldValue) < value {
+			args[n].Value = newValue
+		}
+		return
+	}
+	domainDef.QEMUCommandline.Args = append(args,
+		libvirtxml.DomainQEMUCommandlineArg{Value: "-set"},
+		libvirtxml.DomainQEMUCommandlineArg{Value: newValue})
+}
+
+// applyQueueOptions applies the virtio queue settings of the
+// volumes to the domain definition. It must be called after the
+// disks of the diskList are added to the domain definition.
+func (dl *diskList) applyQueueOptions(domainDef *libvirtxml.Domain) error {
+	if len(domainDef.Devices.Disks) != len(dl.items) {
+		return fmt.Errorf("disk count mismatch: %d disks in the domain definition, %d volumes", len(domainDef.Devices.Disks), len(dl.items))
+	}
+	for n, item := range dl.items {
+		tunable, ok := item.volume.(queueTunableVolume)
+		if !ok {
+			continue
+		}
+		opts := tunable.queueOptions()
+		if opts.isEmpty() {
+			continue
+		}
+		if err := item.driver.applyQueueOptions(domainDef, &domainDef.Devices.Disks[n], opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
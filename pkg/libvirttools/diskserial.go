@@ -0,0 +1,97 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// virtio-blk limits the serial to 20 bytes, and udev uses the
+// serial to make /dev/disk/by-id links
+var diskSerialRx = regexp.MustCompile(`^[A-Za-z0-9_.+-]{1,20}$`)
+
+const (
+	// the by-id link name prefixes that udev uses for virtio-blk
+	// disks and for the virtio-scsi disks with the default
+	// vendor and product identification of qemu
+	virtioByIDPrefix = "/dev/disk/by-id/virtio-"
+	scsiByIDPrefix   = "/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_"
+)
+
+// diskSerialOptions contains the serial number of a disk that
+// gives the disk a stable /dev/disk/by-id path inside the VM
+type diskSerialOptions struct {
+	// Serial is the serial number of the disk
+	Serial string
+}
+
+// serialTunableVolume is implemented by the volumes that
+// support setting the disk serial number
+type serialTunableVolume interface {
+	serialOptions() diskSerialOptions
+}
+
+func (o *diskSerialOptions) serialOptions() diskSerialOptions {
+	return *o
+}
+
+// parseFlexvolumeSerialOptions extracts the disk serial from the
+// flexvolume config. It's common for all the flexvolume types.
+func parseFlexvolumeSerialOptions(content []byte) (diskSerialOptions, error) {
+	var fvOpts struct {
+		Serial string `json:"serial,omitempty"`
+	}
+	if err := json.Unmarshal(content, &fvOpts); err != nil {
+		return diskSerialOptions{}, err
+	}
+	if fvOpts.Serial != "" && !diskSerialRx.MatchString(fvOpts.Serial) {
+		return diskSerialOptions{}, fmt.Errorf("bad disk serial %q. Must be 1 to 20 letters, digits, '_', '.', '+' or '-'", fvOpts.Serial)
+	}
+	return diskSerialOptions(fvOpts), nil
+}
+
+// serial returns the serial number of the disk item, if it has any
+func (di *diskItem) serial() string {
+	if tunable, ok := di.volume.(serialTunableVolume); ok {
+		return tunable.serialOptions().Serial
+	}
+	return ""
+}
+
+// byIDPath returns /dev/disk/by-id path of the disk inside the VM,
+// or an empty string if the disk doesn't have a serial or the path
+// can't be determined. The by-id names of virtio-scsi disks include
+// SCSI vendor and product identification, so only the disks that
+// don't have these settings overridden get by-id paths.
+func (di *diskItem) byIDPath() string {
+	serial := di.serial()
+	if serial == "" {
+		return ""
+	}
+	switch di.driver.(type) {
+	case *virtioBlkDriver:
+		return virtioByIDPrefix + serial
+	case *scsiDriver:
+		if tunable, ok := di.volume.(inquiryTunableVolume); ok && !tunable.inquiryOptions().isEmpty() {
+			return ""
+		}
+		return scsiByIDPrefix + serial
+	}
+	return ""
+}
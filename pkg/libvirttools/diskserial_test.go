@@ -0,0 +1,169 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/ghodss/yaml"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/flexvolume"
+	"github.com/Mirantis/virtlet/pkg/utils"
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestParseFlexvolumeSerialOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		content      string
+		expectedOpts diskSerialOptions
+		valid        bool
+	}{
+		{
+			name:    "no serial",
+			content: `{"type": "qcow2"}`,
+			valid:   true,
+		},
+		{
+			name:         "serial",
+			content:      `{"type": "qcow2", "serial": "data-1.a_b+c"}`,
+			expectedOpts: diskSerialOptions{Serial: "data-1.a_b+c"},
+			valid:        true,
+		},
+		{
+			name:    "serial too long",
+			content: `{"type": "qcow2", "serial": "abcdefghij0123456789x"}`,
+		},
+		{
+			name:    "serial with spaces",
+			content: `{"type": "qcow2", "serial": "data 1"}`,
+		},
+		{
+			name:    "serial with slash",
+			content: `{"type": "qcow2", "serial": "../data"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts, err := parseFlexvolumeSerialOptions([]byte(tc.content))
+			switch {
+			case tc.valid && err != nil:
+				t.Errorf("parseFlexvolumeSerialOptions(): %v", err)
+			case !tc.valid && err == nil:
+				t.Errorf("invalid serial considered valid")
+			case !reflect.DeepEqual(opts, tc.expectedOpts):
+				t.Errorf("bad serial options %#v instead of %#v", opts, tc.expectedOpts)
+			}
+		})
+	}
+}
+
+func TestCloudInitMountsUseDiskSerial(t *testing.T) {
+	flexVolumeDriver := flexvolume.NewFlexVolumeDriver(func() string {
+		return fakeUUID
+	}, flexvolume.NullMounter)
+	for _, tc := range []struct {
+		name            string
+		annotations     map[string]string
+		flexVolume      map[string]interface{}
+		expectedDevPath string
+	}{
+		{
+			name:            "virtio-blk",
+			annotations:     map[string]string{"VirtletDiskDriver": "virtio"},
+			flexVolume:      map[string]interface{}{"type": "qcow2", "serial": "data1"},
+			expectedDevPath: "/dev/disk/by-id/virtio-data1-part1",
+		},
+		{
+			name:            "virtio-scsi",
+			flexVolume:      map[string]interface{}{"type": "qcow2", "serial": "data1"},
+			expectedDevPath: "/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_data1-part1",
+		},
+		{
+			name:            "virtio-scsi with custom vendor",
+			flexVolume:      map[string]interface{}{"type": "qcow2", "serial": "data1", "vendor": "VIRTLET"},
+			expectedDevPath: "/dev/disk/by-path/virtio-pci-",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := testutils.NewToplevelRecorder()
+			rec.AddFilter("iso image")
+			rec.AddFilter("DefineDomain")
+			ct := newContainerTester(t, rec)
+			defer ct.teardown()
+
+			sandbox := criapi.GetSandboxes(1)[0]
+			sandbox.Annotations = tc.annotations
+			ct.setPodSandbox(sandbox)
+
+			targetDir := filepath.Join(ct.kubeletRootDir, sandbox.Metadata.Uid, "volumes/virtlet~flexvolume_driver", "data")
+			var r map[string]interface{}
+			if err := json.Unmarshal([]byte(flexVolumeDriver.Run([]string{"mount", targetDir, utils.MapToJSON(tc.flexVolume)})), &r); err != nil {
+				t.Fatalf("failed to unmarshal flexvolume mount result: %v", err)
+			}
+			if r["status"] != "Success" {
+				t.Fatalf("mounting flexvolume failed: %s", r["message"])
+			}
+
+			containerID := ct.createContainer(sandbox, []*kubeapi.Mount{
+				{HostPath: targetDir, ContainerPath: "/data"},
+			})
+			ct.startContainer(containerID)
+
+			var userData map[string]interface{}
+			serialFound := false
+			for _, r := range ct.rec.Content() {
+				switch {
+				case strings.HasSuffix(r.Name, "DefineDomain"):
+					def, _ := r.Value.(string)
+					serialFound = strings.Contains(def, "<serial>data1</serial>")
+				case strings.HasSuffix(r.Name, "iso image"):
+					isoContent, ok := r.Value.(map[string]interface{})
+					if !ok {
+						t.Fatalf("bad iso image record:\n%s", spew.Sdump(r))
+					}
+					userDataStr, _ := isoContent["user-data"].(string)
+					if err := yaml.Unmarshal([]byte(userDataStr), &userData); err != nil {
+						t.Fatalf("can't unmarshal user-data: %v", err)
+					}
+				}
+			}
+			if !serialFound {
+				t.Errorf("the disk serial is not set in the domain definition")
+			}
+
+			mounts, _ := userData["mounts"].([]interface{})
+			if len(mounts) != 1 {
+				t.Fatalf("bad mounts in the user-data:\n%s", spew.Sdump(userData["mounts"]))
+			}
+			mount, _ := mounts[0].([]interface{})
+			if len(mount) != 2 || mount[1] != "/data" {
+				t.Fatalf("bad mount entry:\n%s", spew.Sdump(mounts[0]))
+			}
+			devPath, _ := mount[0].(string)
+			if !strings.HasPrefix(devPath, tc.expectedDevPath) {
+				t.Errorf("bad device path for the mount: %q instead of %q", devPath, tc.expectedDevPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+var (
+	diskStatsLabels           = []string{"container_id", "disk"}
+	diskReadRequestsTotalDesc = prometheus.NewDesc(
+		"virtlet_vm_disk_read_requests_total",
+		"Number of read requests made by the VM to the disk",
+		diskStatsLabels, nil)
+	diskReadBytesTotalDesc = prometheus.NewDesc(
+		"virtlet_vm_disk_read_bytes_total",
+		"Number of bytes read by the VM from the disk",
+		diskStatsLabels, nil)
+	diskWriteRequestsTotalDesc = prometheus.NewDesc(
+		"virtlet_vm_disk_write_requests_total",
+		"Number of write requests made by the VM to the disk",
+		diskStatsLabels, nil)
+	diskWriteBytesTotalDesc = prometheus.NewDesc(
+		"virtlet_vm_disk_write_bytes_total",
+		"Number of bytes written by the VM to the disk",
+		diskStatsLabels, nil)
+)
+
+type diskStatsKey struct {
+	containerID string
+	disk        string
+}
+
+// diskCounters holds the I/O counters of a single disk. The stats
+// reported by the hypervisor are reset when the VM is restarted,
+// so the counters accumulate the stats of the previous runs of
+// the VM to stay monotonic.
+type diskCounters struct {
+	base, last virt.BlockStats
+}
+
+func addBlockStats(a, b virt.BlockStats) virt.BlockStats {
+	return virt.BlockStats{
+		ReadRequests:  a.ReadRequests + b.ReadRequests,
+		ReadBytes:     a.ReadBytes + b.ReadBytes,
+		WriteRequests: a.WriteRequests + b.WriteRequests,
+		WriteBytes:    a.WriteBytes + b.WriteBytes,
+	}
+}
+
+func (c *diskCounters) update(stats virt.BlockStats) {
+	if stats.ReadRequests < c.last.ReadRequests || stats.ReadBytes < c.last.ReadBytes ||
+		stats.WriteRequests < c.last.WriteRequests || stats.WriteBytes < c.last.WriteBytes {
+		// the hypervisor process was restarted
+		c.base = c.total()
+	}
+	c.last = stats
+}
+
+func (c *diskCounters) total() virt.BlockStats {
+	return addBlockStats(c.base, c.last)
+}
+
+// diskStatsCollector exposes the disk I/O stats collected by
+// CollectDiskStats as Prometheus counters
+type diskStatsCollector struct {
+	sync.Mutex
+	counters map[diskStatsKey]*diskCounters
+}
+
+var _ prometheus.Collector = &diskStatsCollector{}
+
+func newDiskStatsCollector() *diskStatsCollector {
+	return &diskStatsCollector{counters: make(map[diskStatsKey]*diskCounters)}
+}
+
+// Describe implements Describe method of prometheus.Collector interface
+func (c *diskStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- diskReadRequestsTotalDesc
+	ch <- diskReadBytesTotalDesc
+	ch <- diskWriteRequestsTotalDesc
+	ch <- diskWriteBytesTotalDesc
+}
+
+// Collect implements Collect method of prometheus.Collector interface
+func (c *diskStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+	for key, counters := range c.counters {
+		total := counters.total()
+		for _, item := range []struct {
+			desc  *prometheus.Desc
+			value uint64
+		}{
+			{diskReadRequestsTotalDesc, total.ReadRequests},
+			{diskReadBytesTotalDesc, total.ReadBytes},
+			{diskWriteRequestsTotalDesc, total.WriteRequests},
+			{diskWriteBytesTotalDesc, total.WriteBytes},
+		} {
+			ch <- prometheus.MustNewConstMetric(item.desc, prometheus.CounterValue, float64(item.value), key.containerID, key.disk)
+		}
+	}
+}
+
+// update replaces the set of the disks the counters are exposed
+// for. The stats are only updated for the disks that are present
+// in the stats map, e.g. the disks of the running VMs. The series
+// of the disks that aren't listed in disks are removed.
+func (c *diskStatsCollector) update(disks []diskStatsKey, stats map[diskStatsKey]virt.BlockStats) {
+	c.Lock()
+	defer c.Unlock()
+	counters := make(map[diskStatsKey]*diskCounters)
+	for _, key := range disks {
+		dc := c.counters[key]
+		if dc == nil {
+			dc = &diskCounters{}
+		}
+		if s, found := stats[key]; found {
+			dc.update(s)
+		}
+		counters[key] = dc
+	}
+	c.counters = counters
+}
+
+// DiskStatsCollector returns Prometheus collector that exposes the
+// per-disk I/O counters of the VMs, which are labeled by the
+// container id and the disk target device name. The counters are
+// updated by CollectDiskStats.
+func (v *VirtualizationTool) DiskStatsCollector() prometheus.Collector {
+	return v.diskStats
+}
+
+// CollectDiskStats retrieves the I/O stats of the disks of the
+// running VMs and updates the counters exposed by DiskStatsCollector.
+// The counters of the stopped VMs keep their values till the VMs
+// are started again or removed. The counters of the disks that are
+// removed from the VM are removed, too.
+func (v *VirtualizationTool) CollectDiskStats() []error {
+	ids, fatal, errs := v.retrieveListOfContainerIDs()
+	if fatal {
+		return errs
+	}
+
+	var disks []diskStatsKey
+	stats := make(map[diskStatsKey]virt.BlockStats)
+	for _, id := range ids {
+		domain, err := v.domainConn.LookupDomainByUUIDString(id)
+		switch {
+		case err == virt.ErrDomainNotFound:
+			continue
+		case err != nil:
+			errs = append(errs, fmt.Errorf("failed to look up domain %q: %v", id, err))
+			continue
+		}
+		def, err := domain.XML()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to get the definition of the domain %q: %v", id, err))
+			continue
+		}
+		state, err := domain.State()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to get state of the domain %q: %v", id, err))
+			continue
+		}
+		if def.Devices == nil {
+			continue
+		}
+		for _, disk := range def.Devices.Disks {
+			// skip the config ISOs and other cdroms
+			if disk.Device != "disk" || disk.Target == nil || disk.Target.Dev == "" {
+				continue
+			}
+			key := diskStatsKey{containerID: id, disk: disk.Target.Dev}
+			disks = append(disks, key)
+			if state != virt.DomainStateRunning {
+				continue
+			}
+			s, err := domain.BlockStats(disk.Target.Dev)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to get the stats of disk %q of the domain %q: %v", disk.Target.Dev, id, err))
+				continue
+			}
+			stats[key] = *s
+		}
+	}
+	v.diskStats.update(disks, stats)
+	return errs
+}
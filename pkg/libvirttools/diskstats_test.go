@@ -0,0 +1,132 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+// gatherDiskCounters returns the values of the disk I/O counters
+// mapped by "metric container_id disk"
+func gatherDiskCounters(t *testing.T, collector prometheus.Collector) map[string]float64 {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather(): %v", err)
+	}
+	r := make(map[string]float64)
+	for _, family := range families {
+		if family.GetType() != dto.MetricType_COUNTER {
+			t.Errorf("%s is not a counter", family.GetName())
+		}
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			r[family.GetName()+" "+labels["container_id"]+" "+labels["disk"]] = m.GetCounter().GetValue()
+		}
+	}
+	return r
+}
+
+func TestDiskStats(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	imagePath := filepath.Join(ct.tmpDir, "data.img")
+	if err := ioutil.WriteFile(imagePath, make([]byte, 4096), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID, err := ct.createContainerWithFlexvolume(sandbox, map[string]interface{}{"type": "rawfile", "path": imagePath})
+	if err != nil {
+		t.Fatalf("CreateContainer(): %v", err)
+	}
+	ct.startContainer(containerID)
+
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	def, err := domain.XML()
+	if err != nil {
+		t.Fatalf("XML(): %v", err)
+	}
+	var disks []string
+	for _, disk := range def.Devices.Disks {
+		if disk.Device == "disk" {
+			disks = append(disks, disk.Target.Dev)
+		}
+	}
+	sort.Strings(disks)
+	if len(disks) != 2 {
+		t.Fatalf("expected 2 disks, got %v", disks)
+	}
+
+	expectedCounters := func(n float64) map[string]float64 {
+		r := make(map[string]float64)
+		if n == 0 {
+			return r
+		}
+		for _, disk := range disks {
+			r["virtlet_vm_disk_read_requests_total "+containerID+" "+disk] = n * 10
+			r["virtlet_vm_disk_read_bytes_total "+containerID+" "+disk] = n * 10 * 4096
+			r["virtlet_vm_disk_write_requests_total "+containerID+" "+disk] = n * 5
+			r["virtlet_vm_disk_write_bytes_total "+containerID+" "+disk] = n * 5 * 4096
+		}
+		return r
+	}
+	collect := func(expectedCalls float64) {
+		if errs := ct.virtTool.CollectDiskStats(); len(errs) != 0 {
+			t.Errorf("CollectDiskStats(): %v", errs)
+		}
+		counters := gatherDiskCounters(t, ct.virtTool.DiskStatsCollector())
+		if expected := expectedCounters(expectedCalls); !reflect.DeepEqual(counters, expected) {
+			t.Errorf("bad disk counters:\n%#v\ninstead of\n%#v", counters, expected)
+		}
+	}
+
+	collect(1)
+	collect(2)
+
+	// the counters of the stopped VM keep their values
+	ct.stopContainer(containerID)
+	collect(2)
+
+	// the stats reported by the hypervisor are reset when the
+	// VM is restarted, but the counters keep growing
+	ct.startContainer(containerID)
+	collect(3)
+
+	// the series are removed together with the container
+	ct.stopContainer(containerID)
+	ct.removeContainer(containerID)
+	collect(0)
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// WatchDomainEvents subscribes to the domain lifecycle events so
+// the containers whose VMs are powered off by the guest OS are marked
+// as exited right away instead of on the next ContainerStatus call.
+// The returned function stops watching the events.
+func (v *VirtualizationTool) WatchDomainEvents() (func(), error) {
+	stop, err := v.domainConn.WatchDomainEvents(func(event virt.DomainEvent) {
+		if event.Type != virt.DomainEventGuestShutdown {
+			return
+		}
+		// the event loop must not wait for StopContainer
+		// calls that hold the container lock
+		v.domainEventsWG.Add(1)
+		go func() {
+			defer v.domainEventsWG.Done()
+			if err := v.handleGuestShutdown(event.DomainUUID); err != nil {
+				glog.Warningf("Error handling guest shutdown: %v", err)
+			}
+		}()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't watch domain events: %v", err)
+	}
+	return func() {
+		stop()
+		v.domainEventsWG.Wait()
+	}, nil
+}
+
+// handleGuestShutdown marks the container as exited after its VM was
+// shut off. It does nothing if the container is not running, which is
+// the case when the shutdown was requested by StopContainer, or if
+// the VM was started again before the event was handled.
+func (v *VirtualizationTool) handleGuestShutdown(containerID string) error {
+	defer v.containerLocks.lock(containerID)()
+
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	if err != nil {
+		return fmt.Errorf("can't retrieve the metadata of container %q: %v", containerID, err)
+	}
+	// the VMs in the warm pool have no metadata
+	if containerInfo == nil || containerInfo.State != kubeapi.ContainerState_CONTAINER_RUNNING {
+		return nil
+	}
+
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerID)
+	switch {
+	case err == virt.ErrDomainNotFound:
+		return nil
+	case err != nil:
+		return fmt.Errorf("can't look up domain %q: %v", containerID, err)
+	}
+	state, err := domain.State()
+	if err != nil {
+		return fmt.Errorf("can't get the state of domain %q: %v", containerID, err)
+	}
+	if state != virt.DomainStateShutoff {
+		return nil
+	}
+
+	glog.Infof("VM %q was powered off by the guest OS, marking the container as exited", containerID)
+	// the VM must not come back after the node reboot, same as
+	// after StopContainer
+	if err := v.setDomainAutostart(containerID, domain, false); err != nil {
+		glog.Warningf("handleGuestShutdown(): %v", err)
+	}
+	if err := v.metadataStore.Container(containerID).Save(
+		func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+			// make sure the container is not removed during the call
+			if c != nil {
+				c.State = kubeapi.ContainerState_CONTAINER_EXITED
+				c.GuestShutdown = true
+			}
+			return c, nil
+		}); err != nil {
+		return fmt.Errorf("can't update the metadata of container %q: %v", containerID, err)
+	}
+	return nil
+}
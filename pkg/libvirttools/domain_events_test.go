@@ -0,0 +1,88 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"testing"
+
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func (ct *containerTester) verifyStoredContainerState(containerID string, expectedState kubeapi.ContainerState) {
+	containerInfo, err := ct.metadataStore.Container(containerID).Retrieve()
+	switch {
+	case err != nil:
+		ct.t.Errorf("Retrieve(): %v", err)
+	case containerInfo == nil:
+		ct.t.Errorf("container %q not found", containerID)
+	case containerInfo.State != expectedState:
+		ct.t.Errorf("bad stored container state %v instead of %v", containerInfo.State, expectedState)
+	}
+}
+
+func TestGuestShutdown(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	stop, err := ct.virtTool.WatchDomainEvents()
+	if err != nil {
+		t.Fatalf("WatchDomainEvents(): %v", err)
+	}
+	defer stop()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	ct.startContainer(containerID)
+
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	if err := domain.(*fake.FakeDomain).InjectGuestShutdown(); err != nil {
+		t.Fatalf("InjectGuestShutdown(): %v", err)
+	}
+	ct.virtTool.domainEventsWG.Wait()
+
+	// the container is marked as exited without waiting
+	// for the status to be polled
+	ct.verifyStoredContainerState(containerID, kubeapi.ContainerState_CONTAINER_EXITED)
+	status := ct.containerStatus(containerID)
+	if status.State != kubeapi.ContainerState_CONTAINER_EXITED {
+		t.Errorf("bad container state %v instead of %v", status.State, kubeapi.ContainerState_CONTAINER_EXITED)
+	}
+	if status.Reason != "GuestShutdown" {
+		t.Errorf("bad container status reason %q instead of \"GuestShutdown\"", status.Reason)
+	}
+
+	// the shutdown requested by StopContainer is not
+	// reported as a guest shutdown
+	ct.startContainer(containerID)
+	ct.stopContainer(containerID)
+	ct.virtTool.domainEventsWG.Wait()
+	status = ct.containerStatus(containerID)
+	if status.State != kubeapi.ContainerState_CONTAINER_EXITED {
+		t.Errorf("bad container state %v instead of %v", status.State, kubeapi.ContainerState_CONTAINER_EXITED)
+	}
+	if status.Reason != "" {
+		t.Errorf("unexpected container status reason %q after StopContainer", status.Reason)
+	}
+}
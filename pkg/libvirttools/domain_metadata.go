@@ -0,0 +1,112 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bytes"
+	"encoding/xml"
+	"sort"
+	"strings"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	// virtletMetadataNamespace is the XML namespace of the Virtlet
+	// element inside the domain metadata
+	virtletMetadataNamespace = "http://virtlet.cloud/metadata/1.0"
+	// virtletMetadataPrefix is the prefix used for the Virtlet
+	// metadata namespace
+	virtletMetadataPrefix = "virtlet"
+	// virtletAnnotationPrefix is the prefix of Virtlet-specific
+	// pod annotations. These are never included in the domain
+	// metadata as they may contain sensitive data such as
+	// passwords or cloud-init user data
+	virtletAnnotationPrefix = "Virtlet"
+)
+
+// excludedMetadataAnnotations are the annotations that are never
+// included in the domain metadata. kubectl stores the whole pod
+// definition including the Virtlet-specific annotations in
+// last-applied-configuration.
+var excludedMetadataAnnotations = map[string]bool{
+	"kubectl.kubernetes.io/last-applied-configuration": true,
+}
+
+// domainMetadataAnnotations returns the pod annotations which should
+// be included in the domain metadata
+func domainMetadataAnnotations(config *VMConfig) map[string]string {
+	r := map[string]string{}
+	for _, key := range config.ParsedAnnotations.MetadataAnnotations {
+		if strings.HasPrefix(key, virtletAnnotationPrefix) || excludedMetadataAnnotations[key] {
+			continue
+		}
+		if value, found := config.PodAnnotations[key]; found {
+			r[key] = value
+		}
+	}
+	return r
+}
+
+func writeMetadataMap(buf *bytes.Buffer, listName, itemName string, m map[string]string) {
+	if len(m) == 0 {
+		return
+	}
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf.WriteString("<" + virtletMetadataPrefix + ":" + listName + ">")
+	for _, k := range keys {
+		buf.WriteString("<" + virtletMetadataPrefix + ":" + itemName + ` name="`)
+		xml.EscapeText(buf, []byte(k))
+		buf.WriteString(`">`)
+		xml.EscapeText(buf, []byte(m[k]))
+		buf.WriteString("</" + virtletMetadataPrefix + ":" + itemName + ">")
+	}
+	buf.WriteString("</" + virtletMetadataPrefix + ":" + listName + ">")
+}
+
+// virtletMetadataXML returns the Virtlet element for the domain
+// metadata which contains the pod labels and the annotations
+// selected via VirtletDomainMetadataAnnotations. It returns an empty
+// string if there are no labels and annotations to include.
+func virtletMetadataXML(config *VMConfig) string {
+	annotations := domainMetadataAnnotations(config)
+	if len(config.PodLabels) == 0 && len(annotations) == 0 {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("<" + virtletMetadataPrefix + ":virtlet xmlns:" + virtletMetadataPrefix + `="` + virtletMetadataNamespace + `">`)
+	writeMetadataMap(&buf, "labels", "label", config.PodLabels)
+	writeMetadataMap(&buf, "annotations", "annotation", annotations)
+	buf.WriteString("</" + virtletMetadataPrefix + ":virtlet>")
+	return buf.String()
+}
+
+// domainMetadata returns the metadata element for the domain
+// definition or nil if there's no metadata to include
+func domainMetadata(config *VMConfig) *libvirtxml.DomainMetadata {
+	metadataXML := virtletMetadataXML(config)
+	if metadataXML == "" {
+		return nil
+	}
+	return &libvirtxml.DomainMetadata{XML: metadataXML}
+}
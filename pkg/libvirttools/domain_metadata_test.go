@@ -0,0 +1,119 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDomainMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		labels         map[string]string
+		annotations    map[string]string
+		expectedXML    string
+		mustNotContain []string
+	}{
+		{
+			name: "no labels and annotations",
+		},
+		{
+			name:   "labels",
+			labels: map[string]string{"foo": "bar", "app": "<vm & co>"},
+			expectedXML: `<virtlet:virtlet xmlns:virtlet="http://virtlet.cloud/metadata/1.0">` +
+				`<virtlet:labels>` +
+				`<virtlet:label name="app">&lt;vm &amp; co&gt;</virtlet:label>` +
+				`<virtlet:label name="foo">bar</virtlet:label>` +
+				`</virtlet:labels>` +
+				`</virtlet:virtlet>`,
+		},
+		{
+			name: "selected annotations",
+			annotations: map[string]string{
+				"VirtletDomainMetadataAnnotations": "owner,team",
+				"owner":                            "alice",
+				"team":                             "infra",
+				"other":                            "not selected",
+			},
+			expectedXML: `<virtlet:virtlet xmlns:virtlet="http://virtlet.cloud/metadata/1.0">` +
+				`<virtlet:annotations>` +
+				`<virtlet:annotation name="owner">alice</virtlet:annotation>` +
+				`<virtlet:annotation name="team">infra</virtlet:annotation>` +
+				`</virtlet:annotations>` +
+				`</virtlet:virtlet>`,
+		},
+		{
+			name:   "secrets",
+			labels: map[string]string{"foo": "bar"},
+			annotations: map[string]string{
+				"VirtletDomainMetadataAnnotations": "VirtletUser,VirtletUserPassword,VirtletCloudInitUserData",
+				"VirtletUser":                      "cloudy",
+				"VirtletUserPassword":              testPasswordHash,
+				"VirtletCloudInitUserData":         "password: secret",
+			},
+			expectedXML: `<virtlet:virtlet xmlns:virtlet="http://virtlet.cloud/metadata/1.0">` +
+				`<virtlet:labels>` +
+				`<virtlet:label name="foo">bar</virtlet:label>` +
+				`</virtlet:labels>` +
+				`</virtlet:virtlet>`,
+			mustNotContain: []string{testPasswordHash, "secret", "annotation"},
+		},
+		{
+			name: "last applied configuration",
+			annotations: map[string]string{
+				"VirtletDomainMetadataAnnotations": "owner,kubectl.kubernetes.io/last-applied-configuration",
+				"owner":                            "alice",
+				"kubectl.kubernetes.io/last-applied-configuration": `{"metadata":{"annotations":{"VirtletUserPassword":"secret"}}}`,
+			},
+			expectedXML: `<virtlet:virtlet xmlns:virtlet="http://virtlet.cloud/metadata/1.0">` +
+				`<virtlet:annotations>` +
+				`<virtlet:annotation name="owner">alice</virtlet:annotation>` +
+				`</virtlet:annotations>` +
+				`</virtlet:virtlet>`,
+			mustNotContain: []string{"secret", "last-applied-configuration"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &VMConfig{
+				PodAnnotations: tc.annotations,
+				PodLabels:      tc.labels,
+			}
+			if err := config.LoadAnnotations(); err != nil {
+				t.Fatalf("LoadAnnotations(): %v", err)
+			}
+			metadata := domainMetadata(config)
+			if tc.expectedXML == "" {
+				if metadata != nil {
+					t.Errorf("unexpected domain metadata: %q", metadata.XML)
+				}
+				return
+			}
+			if metadata == nil {
+				t.Fatalf("domain metadata not set")
+			}
+			if metadata.XML != tc.expectedXML {
+				t.Errorf("bad domain metadata:\n%s\ninstead of\n%s", metadata.XML, tc.expectedXML)
+			}
+			for _, s := range tc.mustNotContain {
+				if strings.Contains(metadata.XML, s) {
+					t.Errorf("domain metadata must not contain %q:\n%s", s, metadata.XML)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"sort"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// applyEmulatorPin pins the emulator threads and the iothreads of
+// the domain to the host CPUs specified using VirtletEmulatorPin
+// annotation, so the I/O doesn't interfere with the vCPUs. It must
+// be called after all the iothreads are added to the domain.
+// If VirtletIsolateEmulator is set, the vCPUs must be pinned to
+// the host CPUs that aren't used by the emulator.
+func applyEmulatorPin(domainDef *libvirtxml.Domain, config *VMConfig) error {
+	cpuSet := config.ParsedAnnotations.EmulatorPin
+	if cpuSet == "" {
+		return nil
+	}
+
+	if config.ParsedAnnotations.IsolateEmulator {
+		if domainDef.VCPU == nil || domainDef.VCPU.CPUSet == "" {
+			return fmt.Errorf("%s requires the vCPUs of the VM to be pinned, e.g. using %s", isolateEmulatorKeyName, numaNodeKeyName)
+		}
+		emulatorCPUs, err := parseCPUList(cpuSet)
+		if err != nil {
+			return fmt.Errorf("bad %s: %v", emulatorPinKeyName, err)
+		}
+		vcpuCPUs, err := parseCPUList(domainDef.VCPU.CPUSet)
+		if err != nil {
+			return fmt.Errorf("bad vCPU cpuset: %v", err)
+		}
+		var overlap []int
+		for cpu := range emulatorCPUs {
+			if vcpuCPUs[cpu] {
+				overlap = append(overlap, cpu)
+			}
+		}
+		if len(overlap) != 0 {
+			sort.Ints(overlap)
+			return fmt.Errorf("%s %q overlaps the vCPU cpuset %q (CPUs %v)", emulatorPinKeyName, cpuSet, domainDef.VCPU.CPUSet, overlap)
+		}
+	}
+
+	if domainDef.CPUTune == nil {
+		domainDef.CPUTune = &libvirtxml.DomainCPUTune{}
+	}
+	domainDef.CPUTune.EmulatorPin = &libvirtxml.DomainCPUTuneEmulatorPin{CPUSet: cpuSet}
+	for n := uint(1); n <= domainDef.IOThreads; n++ {
+		domainDef.CPUTune.IOThreadPin = append(domainDef.CPUTune.IOThreadPin, libvirtxml.DomainCPUTuneIOThreadPin{
+			IOThread: n,
+			CPUSet:   cpuSet,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/image"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// ExportContainerImage converts the root volume of the container
+// into a standalone QCOW2 image, flattening its backing chain, and
+// registers it in the image store under the specified name, so the
+// new pods can boot from it. With image tenant isolation, the image
+// is registered for the namespace of the pod. The VM must not be
+// running, e.g. the guest OS should be shut down before exporting
+// the disk. The root volume is kept after the container is stopped
+// via CRI till the container is removed, so the disk can be exported
+// after StopContainer, too. The function returns the reference to
+// the new image including its digest.
+func (v *VirtualizationTool) ExportContainerImage(containerID, imageName string) (string, error) {
+	defer v.containerLocks.lock(containerID)()
+	return v.exportContainerImage(containerID, imageName)
+}
+
+func (v *VirtualizationTool) exportContainerImage(containerID, imageName string) (string, error) {
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	if err != nil {
+		return "", fmt.Errorf("can't retrieve container info for %q: %v", containerID, err)
+	}
+	if containerInfo == nil {
+		return "", fmt.Errorf("container %q not found", containerID)
+	}
+
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up domain %q: %v", containerID, err)
+	}
+	state, err := domain.State()
+	if err != nil {
+		return "", fmt.Errorf("failed to get state of the domain %q: %v", containerID, err)
+	}
+	if state != virt.DomainStateShutoff {
+		return "", fmt.Errorf("can't export the disk of container %q: the VM is not shut off (state %v)", containerID, state)
+	}
+
+	storagePool, err := v.StoragePool()
+	if err != nil {
+		return "", err
+	}
+	volumeName := "virtlet_root_" + containerID
+	vol, err := storagePool.LookupVolumeByName(volumeName)
+	switch {
+	case err == virt.ErrStorageVolumeNotFound:
+		return "", fmt.Errorf("can't export the disk of container %q: the root volume doesn't exist", containerID)
+	case err != nil:
+		return "", err
+	}
+	volPath, err := vol.Path()
+	if err != nil {
+		return "", fmt.Errorf("error getting root volume path: %v", err)
+	}
+
+	importer, err := v.imageImporter(containerInfo.SandboxID)
+	if err != nil {
+		return "", err
+	}
+	ref, err := importer.ImportImage(imageName, volPath)
+	if err != nil {
+		return "", fmt.Errorf("can't export the disk of container %q: %v", containerID, err)
+	}
+	glog.V(1).Infof("Exported the disk of container %q as %q", containerID, ref)
+	return ref, nil
+}
+
+// imageImporter returns the image store to export the images of
+// the containers of the specified pod sandbox to
+func (v *VirtualizationTool) imageImporter(podSandboxID string) (image.Importer, error) {
+	var imageManager interface{} = v.imageManager
+	if v.imageTenants {
+		sandboxInfo, err := v.metadataStore.PodSandbox(podSandboxID).Retrieve()
+		if err != nil {
+			return nil, fmt.Errorf("can't retrieve pod sandbox info for %q: %v", podSandboxID, err)
+		}
+		if sandboxInfo == nil {
+			return nil, fmt.Errorf("pod sandbox %q not found", podSandboxID)
+		}
+		tenantStore, ok := v.imageManager.(image.TenantStore)
+		if !ok {
+			return nil, fmt.Errorf("the image manager doesn't support image tenants")
+		}
+		if imageManager, err = tenantStore.ForTenant(sandboxInfo.Metadata.Namespace); err != nil {
+			return nil, err
+		}
+	}
+	importer, ok := imageManager.(image.Importer)
+	if !ok {
+		return nil, fmt.Errorf("the image manager doesn't support importing images")
+	}
+	return importer, nil
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestExportContainerImage(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	ct.startContainer(containerID)
+
+	// running VMs can't be exported
+	if _, err := ct.virtTool.ExportContainerImage(containerID, "exported-image"); err == nil {
+		t.Errorf("ExportContainerImage() didn't fail for a running VM")
+	}
+	if len(ct.imageManager.imported) != 0 {
+		t.Errorf("unexpected imported images: %#v", ct.imageManager.imported)
+	}
+
+	// the guest OS shuts down
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	if err := domain.Destroy(); err != nil {
+		t.Fatalf("Destroy(): %v", err)
+	}
+
+	ref, err := ct.virtTool.ExportContainerImage(containerID, "exported-image")
+	if err != nil {
+		t.Fatalf("ExportContainerImage(): %v", err)
+	}
+	pool, err := ct.virtTool.StoragePool()
+	if err != nil {
+		t.Fatalf("StoragePool(): %v", err)
+	}
+	rootVol, err := pool.LookupVolumeByName("virtlet_root_" + containerID)
+	if err != nil {
+		t.Fatalf("LookupVolumeByName(): %v", err)
+	}
+	rootVolPath, err := rootVol.Path()
+	if err != nil {
+		t.Fatalf("Path(): %v", err)
+	}
+	expectedImported := map[string]string{"exported-image": rootVolPath}
+	if !reflect.DeepEqual(ct.imageManager.imported, expectedImported) {
+		t.Errorf("bad imported images: %#v instead of %#v", ct.imageManager.imported, expectedImported)
+	}
+	if expectedRef, _ := ct.imageManager.ImportImage("exported-image", rootVolPath); ref != expectedRef {
+		t.Errorf("bad image ref %q instead of %q", ref, expectedRef)
+	}
+
+	// the root volume is kept after StopContainer, so the disk
+	// can still be exported
+	ct.stopContainer(containerID)
+	if _, err := ct.virtTool.ExportContainerImage(containerID, "another-image"); err != nil {
+		t.Errorf("ExportContainerImage() failed after StopContainer(): %v", err)
+	}
+	if path := ct.imageManager.imported["another-image"]; path != rootVolPath {
+		t.Errorf("bad path of the image exported after StopContainer(): %q instead of %q", path, rootVolPath)
+	}
+
+	// after RemoveContainer, the root volume is gone
+	ct.removeContainer(containerID)
+	if _, err := ct.virtTool.ExportContainerImage(containerID, "removed-image"); err == nil {
+		t.Errorf("ExportContainerImage() didn't fail for a removed container")
+	}
+	if _, found := ct.imageManager.imported["removed-image"]; found {
+		t.Errorf("the image was exported for a removed container")
+	}
+}
@@ -22,8 +22,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/golang/glog"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
 )
 
 const (
@@ -31,17 +33,159 @@ const (
 	flexvolumeDataFile = "virtlet-flexvolume.json"
 )
 
-type flexvolumeSource func(volumeName, configPath string, config *VMConfig, owner volumeOwner) (VMVolume, error)
+// FlexvolumeInfo describes a flexvolume that's used by a VM
+type FlexvolumeInfo struct {
+	// Name is the name of the volume in the pod definition
+	Name string
+	// ConfigPath is the path to JSON file that contains the
+	// flexvolume options
+	ConfigPath string
+	// Config is the configuration of the VM that uses the volume
+	Config *VMConfig
+	// Owner provides access to the resources managed by Virtlet
+	Owner VolumeOwner
+}
+
+// VolumeDriver handles a single flexvolume of a particular type.
+// A new VolumeDriver is made for each volume using the factory
+// passed to RegisterVolumeDriver. Note that the drivers are also
+// made for the volumes of the containers being removed, in which
+// case only Prepare and Teardown are called.
+type VolumeDriver interface {
+	// Name returns the flexvolume type handled by the driver,
+	// i.e. the value of "type" flexvolume option
+	Name() string
+	// Prepare parses the flexvolume options. It's called before
+	// DiskXML and Teardown.
+	Prepare(info *FlexvolumeInfo) error
+	// DiskXML sets up the volume and returns the libvirt definition
+	// of the disk. The target and the address of the disk are
+	// assigned by Virtlet.
+	DiskXML() (*libvirtxml.DomainDisk, error)
+	// Teardown releases the resources used by the volume
+	Teardown() error
+}
+
+// VolumeDriverFactory makes a new VolumeDriver
+type VolumeDriverFactory func() VolumeDriver
+
+var (
+	volumeDriverLock sync.Mutex
+	volumeDrivers    = map[string]VolumeDriverFactory{}
+)
 
-var flexvolumeTypeMap = map[string]flexvolumeSource{}
+// RegisterVolumeDriver makes the flexvolume type handled by the
+// drivers made by the factory available to the VMs. The type name
+// is taken from the Name() of the driver. RegisterVolumeDriver is
+// intended to be called from init() functions. It panics if the
+// name is empty or the type is already registered.
+func RegisterVolumeDriver(factory VolumeDriverFactory) {
+	name := factory().Name()
+	if name == "" {
+		panic("volume driver with empty name")
+	}
+	volumeDriverLock.Lock()
+	defer volumeDriverLock.Unlock()
+	if _, found := volumeDrivers[name]; found {
+		panic(fmt.Sprintf("volume driver %q is already registered", name))
+	}
+	volumeDrivers[name] = factory
+}
+
+func getVolumeDriverFactory(fvType string) (VolumeDriverFactory, bool) {
+	volumeDriverLock.Lock()
+	defer volumeDriverLock.Unlock()
+	factory, found := volumeDrivers[fvType]
+	return factory, found
+}
 
-func addFlexvolumeSource(fvType string, source flexvolumeSource) {
-	flexvolumeTypeMap[fvType] = source
+// driverVolume is a VMVolume that's handled by a VolumeDriver
+type driverVolume struct {
+	diskQueueOptions
+	diskInquiryOptions
+	diskIOOptions
+	diskSectorOptions
+	diskSerialOptions
+	diskShareOptions
+	driver VolumeDriver
+	uuid   string
 }
 
+var _ VMVolume = &driverVolume{}
+
+// newFlexvolume reads the flexvolume options and prepares the
+// volume using the driver registered for its type
+func newFlexvolume(info *FlexvolumeInfo) (*driverVolume, error) {
+	content, err := ioutil.ReadFile(info.ConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading flexvolume config %q: %v", info.ConfigPath, err)
+	}
+	var msi map[string]interface{}
+	if err = json.Unmarshal(content, &msi); err != nil {
+		return nil, fmt.Errorf("error unmarshal flexvolume config %q: %v", info.ConfigPath, err)
+	}
+	fvType, _ := msi["type"].(string)
+	if fvType == "" {
+		return nil, fmt.Errorf("flexvolume config %q: need to specify 'type' (a string)", info.ConfigPath)
+	}
+	factory, found := getVolumeDriverFactory(fvType)
+	if !found {
+		return nil, fmt.Errorf("bad flexvolume config %q: bad type %q", info.ConfigPath, fvType)
+	}
+	queueOpts, err := parseFlexvolumeQueueOptions(content)
+	if err != nil {
+		return nil, fmt.Errorf("bad flexvolume config %q: %v", info.ConfigPath, err)
+	}
+	inquiryOpts, err := parseFlexvolumeInquiryOptions(content)
+	if err != nil {
+		return nil, fmt.Errorf("bad flexvolume config %q: %v", info.ConfigPath, err)
+	}
+	ioOpts, err := parseFlexvolumeIOOptions(content)
+	if err != nil {
+		return nil, fmt.Errorf("bad flexvolume config %q: %v", info.ConfigPath, err)
+	}
+	sectorOpts, err := parseFlexvolumeSectorOptions(content)
+	if err != nil {
+		return nil, fmt.Errorf("bad flexvolume config %q: %v", info.ConfigPath, err)
+	}
+	serialOpts, err := parseFlexvolumeSerialOptions(content)
+	if err != nil {
+		return nil, fmt.Errorf("bad flexvolume config %q: %v", info.ConfigPath, err)
+	}
+	shareOpts, err := parseFlexvolumeShareOptions(content)
+	if err != nil {
+		return nil, fmt.Errorf("bad flexvolume config %q: %v", info.ConfigPath, err)
+	}
+
+	driver := factory()
+	if err := driver.Prepare(info); err != nil {
+		return nil, err
+	}
+	glog.V(3).Infof("Found flexvolume: %s", string(content))
+	uuid, _ := msi["uuid"].(string)
+	return &driverVolume{
+		diskQueueOptions:   queueOpts,
+		diskInquiryOptions: inquiryOpts,
+		diskIOOptions:      ioOpts,
+		diskSectorOptions:  sectorOpts,
+		diskSerialOptions:  serialOpts,
+		diskShareOptions:   shareOpts,
+		driver:             driver,
+		uuid:               uuid,
+	}, nil
+}
+
+func (v *driverVolume) UUID() string { return v.uuid }
+
+func (v *driverVolume) Setup() (*libvirtxml.DomainDisk, error) { return v.driver.DiskXML() }
+
+func (v *driverVolume) WriteImage(diskPathMap) error { return nil }
+
+func (v *driverVolume) Teardown() error { return v.driver.Teardown() }
+
 // ScanFlexVolumes using prepared by kubelet volumes and contained in pod sandbox
 // annotations prepares volumes to be passed to libvirt as a DomainDisk definitions.
-func ScanFlexVolumes(config *VMConfig, owner volumeOwner) ([]VMVolume, error) {
+func ScanFlexVolumes(config *VMConfig, owner VolumeOwner) ([]VMVolume, error) {
 	dir := filepath.Join(owner.KubeletRootDir(), config.PodSandboxID, flexvolumeSubdir)
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		glog.V(2).Infof("No flexvolumes to process for %q with uuid %q", config.Name, config.DomainUUID)
@@ -62,28 +206,15 @@ func ScanFlexVolumes(config *VMConfig, owner volumeOwner) ([]VMVolume, error) {
 		if !fi.IsDir() {
 			continue
 		}
-		dataFilePath := filepath.Join(dir, fi.Name(), flexvolumeDataFile)
-		content, err := ioutil.ReadFile(dataFilePath)
-		if err != nil {
-			return nil, fmt.Errorf("error reading flexvolume config %q: %v", dataFilePath, err)
-		}
-		var msi map[string]interface{}
-		if err = json.Unmarshal(content, &msi); err != nil {
-			return nil, fmt.Errorf("error unmarshal flexvolume config %q: %v", dataFilePath, err)
-		}
-		fvType, _ := msi["type"].(string)
-		if fvType == "" {
-			return nil, fmt.Errorf("flexvolume config %q: need to specify 'type' (a string)", dataFilePath)
-		}
-		fvSource, found := flexvolumeTypeMap[fvType]
-		if !found {
-			return nil, fmt.Errorf("bad flexvolume config %q: bad type %q", dataFilePath, fvType)
-		}
-		vol, err := fvSource(fi.Name(), dataFilePath, config, owner)
+		vol, err := newFlexvolume(&FlexvolumeInfo{
+			Name:       fi.Name(),
+			ConfigPath: filepath.Join(dir, fi.Name(), flexvolumeDataFile),
+			Config:     config,
+			Owner:      owner,
+		})
 		if err != nil {
 			return nil, err
 		}
-		glog.V(3).Infof("Found flexvolume: %s", string(content))
 		vols = append(vols, vol)
 	}
 	return vols, nil
@@ -0,0 +1,142 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+const fakeCustomVolumeType = "fakecustom"
+
+var fakeCustomVolumeEvents []string
+
+// fakeCustomVolume is a volume driver that's registered outside
+// of the set of volume types that's built into Virtlet
+type fakeCustomVolume struct {
+	info *FlexvolumeInfo
+	path string
+}
+
+var _ VolumeDriver = &fakeCustomVolume{}
+
+func (v *fakeCustomVolume) Name() string { return fakeCustomVolumeType }
+
+func (v *fakeCustomVolume) Prepare(info *FlexvolumeInfo) error {
+	var opts struct {
+		Path string `json:"path"`
+	}
+	if err := utils.ReadJSON(info.ConfigPath, &opts); err != nil {
+		return err
+	}
+	if opts.Path == "" {
+		return errors.New("path not specified")
+	}
+	v.info = info
+	v.path = opts.Path
+	fakeCustomVolumeEvents = append(fakeCustomVolumeEvents, "Prepare "+info.Name)
+	return nil
+}
+
+func (v *fakeCustomVolume) DiskXML() (*libvirtxml.DomainDisk, error) {
+	fakeCustomVolumeEvents = append(fakeCustomVolumeEvents, "DiskXML "+v.info.Name)
+	return &libvirtxml.DomainDisk{
+		Device: "disk",
+		Source: &libvirtxml.DomainDiskSource{Block: &libvirtxml.DomainDiskSourceBlock{Dev: v.path}},
+		Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw"},
+	}, nil
+}
+
+func (v *fakeCustomVolume) Teardown() error {
+	fakeCustomVolumeEvents = append(fakeCustomVolumeEvents, "Teardown "+v.info.Name)
+	return nil
+}
+
+func init() {
+	RegisterVolumeDriver(func() VolumeDriver { return &fakeCustomVolume{} })
+}
+
+func TestCustomVolumeDriver(t *testing.T) {
+	fakeCustomVolumeEvents = nil
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	volDir := filepath.Join(ct.kubeletRootDir, sandbox.Metadata.Uid, flexvolumeSubdir, "custom")
+	if err := os.MkdirAll(volDir, 0755); err != nil {
+		t.Fatalf("MkdirAll(): %v", err)
+	}
+	if err := utils.WriteJSON(filepath.Join(volDir, flexvolumeDataFile), map[string]string{
+		"type": fakeCustomVolumeType,
+		"path": "/dev/fakecustom",
+		"uuid": fakeUUID,
+	}, 0700); err != nil {
+		t.Fatalf("WriteJSON(): %v", err)
+	}
+
+	containerID := ct.createContainer(sandbox, nil)
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	def, err := domain.XML()
+	if err != nil {
+		t.Fatalf("XML(): %v", err)
+	}
+	var customDisk *libvirtxml.DomainDisk
+	for n, disk := range def.Devices.Disks {
+		if disk.Source != nil && disk.Source.Block != nil && disk.Source.Block.Dev == "/dev/fakecustom" {
+			customDisk = &def.Devices.Disks[n]
+		}
+	}
+	switch {
+	case customDisk == nil:
+		t.Errorf("custom volume disk not found in the domain:\n%s", spew.Sdump(def.Devices.Disks))
+	case customDisk.Target == nil || customDisk.Target.Dev != "sdb":
+		t.Errorf("bad target of the custom volume disk:\n%s", spew.Sdump(customDisk))
+	}
+
+	if !reflect.DeepEqual(fakeCustomVolumeEvents, []string{"Prepare custom", "DiskXML custom"}) {
+		t.Errorf("bad custom volume events after creating the container: %v", fakeCustomVolumeEvents)
+	}
+
+	fakeCustomVolumeEvents = nil
+	ct.removeContainer(containerID)
+	if len(fakeCustomVolumeEvents) == 0 || fakeCustomVolumeEvents[len(fakeCustomVolumeEvents)-1] != "Teardown custom" {
+		t.Errorf("the custom volume was not torn down: %v", fakeCustomVolumeEvents)
+	}
+}
+
+func TestRegisterVolumeDriverTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering the same volume driver twice didn't cause a panic")
+		}
+	}()
+	RegisterVolumeDriver(func() VolumeDriver { return &fakeCustomVolume{} })
+}
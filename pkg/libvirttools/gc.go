@@ -21,6 +21,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/golang/glog"
 )
 
 const (
@@ -79,6 +81,17 @@ func (v *VirtualizationTool) retrieveListOfContainerIDs() ([]string, bool, []err
 	return containerIDs, false, allErrors
 }
 
+// configImageOwnerID returns the id of the container the config ISO
+// file belongs to or an empty string if the file isn't a config ISO.
+// The secondary ISO of the dual config layout has '-secondary' suffix.
+func configImageOwnerID(filename string) string {
+	if !strings.HasPrefix(filename, "config-") || !strings.HasSuffix(filename, ".iso") {
+		return ""
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(filename, "config-"), ".iso")
+	return strings.TrimSuffix(id, "-secondary")
+}
+
 func inList(list []string, filter func(string) bool) bool {
 	for _, element := range list {
 		if filter(element) {
@@ -140,6 +153,21 @@ func (v *VirtualizationTool) removeOrphanDomains(ids []string) []error {
 	return allErrors
 }
 
+// orphanVolumeConfig returns the VMConfig used to remove the
+// orphaned volumes. As the pod annotations of the orphaned volumes
+// aren't known, the node default annotations are used, so the
+// volumes are wiped if VirtletWipeOnDelete is set for the node.
+func (v *VirtualizationTool) orphanVolumeConfig() *VMConfig {
+	va, err := LoadAnnotations("", v.nodeAnnotations)
+	if err != nil {
+		// can't happen as the node default annotations
+		// are validated by SetNodeDefaultAnnotations
+		glog.Warningf("Bad node default annotations: %v", err)
+		va = nil
+	}
+	return &VMConfig{ParsedAnnotations: va}
+}
+
 func (v *VirtualizationTool) removeOrphanRootVolumes(ids []string) []error {
 	volumePool, err := v.StoragePool()
 	if err != nil {
@@ -150,6 +178,7 @@ func (v *VirtualizationTool) removeOrphanRootVolumes(ids []string) []error {
 		return []error{fmt.Errorf("cannot list libvirt volumes: %v", err)}
 	}
 
+	config := v.orphanVolumeConfig()
 	var allErrors []error
 	for _, volume := range volumes {
 		path, err := volume.Path()
@@ -167,7 +196,7 @@ func (v *VirtualizationTool) removeOrphanRootVolumes(ids []string) []error {
 		}
 
 		if strings.HasPrefix(filename, "virtlet_root_") && !inList(ids, filter) {
-			if err := volume.Remove(); err != nil {
+			if err := removeStorageVolume(v, config, volume.Name()); err != nil {
 				allErrors = append(
 					allErrors,
 					fmt.Errorf(
@@ -193,6 +222,7 @@ func (v *VirtualizationTool) removeOrphanQcow2Volumes(ids []string) []error {
 		return []error{fmt.Errorf("cannot list domains: %v", err)}
 	}
 
+	config := v.orphanVolumeConfig()
 	var allErrors []error
 	for _, volume := range volumes {
 		path, err := volume.Path()
@@ -210,7 +240,7 @@ func (v *VirtualizationTool) removeOrphanQcow2Volumes(ids []string) []error {
 		}
 
 		if strings.HasPrefix(filename, "virtlet-") && !inList(ids, filter) {
-			if err := volume.Remove(); err != nil {
+			if err := removeStorageVolume(v, config, volume.Name()); err != nil {
 				allErrors = append(
 					allErrors,
 					fmt.Errorf(
@@ -241,13 +271,13 @@ func (v *VirtualizationTool) removeOrphanConfigImages(ids []string, directory st
 
 	var allErrors []error
 	for _, path := range files {
-		filename := filepath.Base(path)
+		ownerID := configImageOwnerID(filepath.Base(path))
 
 		filter := func(id string) bool {
-			return filename == "config-"+id+".iso"
+			return ownerID == id
 		}
 
-		if strings.HasPrefix(filename, "config-") && strings.HasSuffix(filename, ".iso") && !inList(ids, filter) {
+		if ownerID != "" && !inList(ids, filter) {
 			if err := os.Remove(path); err != nil {
 				allErrors = append(
 					allErrors,
@@ -115,6 +115,53 @@ func TestRootVolumesCleanup(t *testing.T) {
 	gm.Verify(t, gm.NewYamlVerifier(ct.rec.Content()))
 }
 
+func TestOrphanVolumesWipe(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	if err := ct.virtTool.SetNodeDefaultAnnotations(map[string]string{"VirtletWipeOnDelete": "random"}); err != nil {
+		t.Fatalf("SetNodeDefaultAnnotations(): %v", err)
+	}
+
+	pool, err := ct.virtTool.StoragePool()
+	if err != nil {
+		t.Fatalf("StoragePool(): %v", err)
+	}
+	volumeName := "virtlet_root_" + randomUUIDs[0]
+	if _, err := pool.CreateStorageVol(&libvirtxml.StorageVolume{
+		Name:   volumeName,
+		Target: &libvirtxml.StorageVolumeTarget{Path: "/some/path/" + volumeName},
+	}); err != nil {
+		t.Fatalf("Cannot define new fake volume: %v", err)
+	}
+
+	if errors := ct.virtTool.removeOrphanRootVolumes(nil); errors != nil {
+		t.Errorf("removeOrphanRootVolumes returned errors: %v", errors)
+	}
+
+	wiped := false
+	removed := false
+	for _, r := range ct.rec.Content() {
+		switch {
+		case r.Name == "storage: volumes: "+volumeName+": Wipe":
+			if removed {
+				t.Errorf("the orphaned volume was wiped after it was removed")
+			}
+			if r.Value != "random" {
+				t.Errorf("bad wipe algorithm %v", r.Value)
+			}
+			wiped = true
+		case r.Name == "storage: volumes: RemoveVolumeByName" && r.Value == volumeName:
+			removed = true
+		}
+	}
+	if !wiped {
+		t.Errorf("the orphaned volume wasn't wiped")
+	}
+	if !removed {
+		t.Errorf("the orphaned volume wasn't removed")
+	}
+}
+
 func TestQcow2VolumesCleanup(t *testing.T) {
 	ct := newContainerTester(t, testutils.NewToplevelRecorder())
 	defer ct.teardown()
@@ -175,19 +222,23 @@ func TestConfigISOsCleanup(t *testing.T) {
 			file.Close()
 		}
 	}
-	fname := filepath.Join(directory, "some other.iso")
-	if file, err := os.Create(fname); err != nil {
-		t.Fatalf("Cannot create fake iso with name %q: %v", fname, err)
-	} else {
-		file.Close()
+	// the secondary ISO of the dual config layout
+	// for a container that exists must be kept
+	for _, name := range []string{"some other.iso", "config-" + randomUUIDs[1] + "-secondary.iso"} {
+		fname := filepath.Join(directory, name)
+		if file, err := os.Create(fname); err != nil {
+			t.Fatalf("Cannot create fake iso with name %q: %v", fname, err)
+		} else {
+			file.Close()
+		}
 	}
 
 	preCallFileNames, err := filepath.Glob(filepath.Join(directory, "*"))
 	if err != nil {
 		t.Fatalf("Error globbing names in temporary directory: %v", err)
 	}
-	if len(preCallFileNames) != 4 {
-		t.Fatalf("Expected 4 files in temporary directory, found: %d", len(preCallFileNames))
+	if len(preCallFileNames) != 5 {
+		t.Fatalf("Expected 5 files in temporary directory, found: %d", len(preCallFileNames))
 	}
 
 	// this should remove only config iso file corresponding to the first
@@ -0,0 +1,271 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const (
+	guestAgentChannelName    = "org.qemu.guest_agent.0"
+	defaultGuestAgentTimeout = 5 * time.Second
+	defaultGuestAgentRetries = 2
+	guestAgentRetryInterval  = 1 * time.Second
+	guestAgentPingCommand    = `{"execute":"guest-ping"}`
+	// guestExecTimeout is the time limit for a command started
+	// in the guest via guest-exec to finish
+	guestExecTimeout = 5 * time.Minute
+	// guestExecPollInterval is the interval between the checks
+	// whether the command started via guest-exec has finished
+	guestExecPollInterval = 1 * time.Second
+)
+
+// GuestAgentConfig specifies the time limits for the interactions
+// with the guest agents of the VMs
+type GuestAgentConfig struct {
+	// Timeout is the time limit for a single guest agent call.
+	// Zero value means using the default of 5 seconds.
+	Timeout time.Duration
+	// Retries is the number of additional attempts to make
+	// if a guest agent call fails or times out. Negative
+	// value means using the default of 2 retries.
+	Retries int
+}
+
+func (c GuestAgentConfig) withDefaults() GuestAgentConfig {
+	if c.Timeout <= 0 {
+		c.Timeout = defaultGuestAgentTimeout
+	}
+	if c.Retries < 0 {
+		c.Retries = defaultGuestAgentRetries
+	}
+	return c
+}
+
+// SetGuestAgentConfig sets the time limits for the guest agent calls
+func (v *VirtualizationTool) SetGuestAgentConfig(config GuestAgentConfig) {
+	v.guestAgentConfig = config.withDefaults()
+}
+
+// addGuestAgentChannel adds the virtio channel for the guest agent
+// to the domain definition
+func addGuestAgentChannel(domain *libvirtxml.Domain) {
+	domain.Devices.Channels = append(domain.Devices.Channels, libvirtxml.DomainChannel{
+		Source: &libvirtxml.DomainChardevSource{
+			UNIX: &libvirtxml.DomainChardevSourceUNIX{Mode: "bind"},
+		},
+		Target: &libvirtxml.DomainChannelTarget{
+			VirtIO: &libvirtxml.DomainChannelTargetVirtIO{Name: guestAgentChannelName},
+		},
+	})
+}
+
+// domainHasGuestAgent returns true if the domain definition
+// contains the guest agent channel
+func domainHasGuestAgent(domain virt.Domain) (bool, error) {
+	def, err := domain.XML()
+	if err != nil {
+		return false, err
+	}
+	if def.Devices == nil {
+		return false, nil
+	}
+	for _, ch := range def.Devices.Channels {
+		if ch.Target != nil && ch.Target.VirtIO != nil && ch.Target.VirtIO.Name == guestAgentChannelName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// callGuestAgent invokes a guest agent operation making several
+// attempts if necessary. Each attempt is limited by the configured
+// timeout even if the underlying call doesn't return, so a hung
+// agent can't block Virtlet operations.
+func (v *VirtualizationTool) callGuestAgent(what string, call func(timeout time.Duration) error) error {
+	return v.callGuestAgentUntil(what, time.Time{}, call)
+}
+
+// callGuestAgentUntil is like callGuestAgent, but it doesn't make
+// any attempts past the deadline and shortens the timeout of the
+// last attempt so it ends by the deadline. Zero deadline means
+// no limit.
+func (v *VirtualizationTool) callGuestAgentUntil(what string, deadline time.Time, call func(timeout time.Duration) error) error {
+	config := v.guestAgentConfig.withDefaults()
+	var err error
+	attempts := 0
+	for attempt := 0; attempt <= config.Retries; attempt++ {
+		if attempt > 0 {
+			glog.V(2).Infof("Retrying guest agent %s after error: %v", what, err)
+			v.clock.Sleep(guestAgentRetryInterval)
+		}
+		timeout := config.Timeout
+		if !deadline.IsZero() {
+			remaining := deadline.Sub(v.clock.Now())
+			if remaining <= 0 {
+				if err == nil {
+					err = virt.ErrGuestAgentUnresponsive
+				}
+				break
+			}
+			if remaining < timeout {
+				timeout = remaining
+			}
+		}
+		attempts++
+		if err = v.callGuestAgentOnce(timeout, call); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("guest agent %s failed after %d attempt(s): %v", what, attempts, err)
+}
+
+// callGuestAgentOnce makes a single guest agent call, returning
+// virt.ErrGuestAgentUnresponsive if it doesn't finish within
+// the timeout
+func (v *VirtualizationTool) callGuestAgentOnce(timeout time.Duration, call func(timeout time.Duration) error) error {
+	// the channel is buffered so the goroutine doesn't
+	// leak forever if the call returns after the timeout
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- call(timeout)
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-v.clock.After(timeout):
+		return virt.ErrGuestAgentUnresponsive
+	}
+}
+
+// pingGuestAgent checks whether the guest agent is responsive
+// before the deadline
+func (v *VirtualizationTool) pingGuestAgent(domain virt.Domain, deadline time.Time) error {
+	return v.callGuestAgentUntil("ping", deadline, func(timeout time.Duration) error {
+		_, err := domain.GuestAgentCommand(guestAgentPingCommand, timeout)
+		return err
+	})
+}
+
+// guestAgentResponds returns true if the guest agent responds
+// to a single ping within the configured timeout. It's used
+// by the loops that wait for the agent to become ready and
+// thus make their own attempts.
+func (v *VirtualizationTool) guestAgentResponds(domain virt.Domain) bool {
+	config := v.guestAgentConfig.withDefaults()
+	return v.callGuestAgentOnce(config.Timeout, func(timeout time.Duration) error {
+		_, err := domain.GuestAgentCommand(guestAgentPingCommand, timeout)
+		return err
+	}) == nil
+}
+
+// shutdownWithGuestAgent asks the guest agent to shut down the VM.
+// The guest agent is pinged first so a missing or hung agent is
+// detected before the shutdown request is made. The guest agent
+// calls are only made till the deadline.
+func (v *VirtualizationTool) shutdownWithGuestAgent(domain virt.Domain, deadline time.Time) error {
+	if err := v.pingGuestAgent(domain, deadline); err != nil {
+		return err
+	}
+	// libvirt doesn't accept a timeout for the guest agent
+	// shutdown request, so it's only enforced by not waiting
+	// for the call past the timeout
+	return v.callGuestAgentUntil("shutdown", deadline, func(time.Duration) error {
+		return domain.ShutdownWithGuestAgent()
+	})
+}
+
+type guestExecArguments struct {
+	Path          string   `json:"path"`
+	Arg           []string `json:"arg,omitempty"`
+	CaptureOutput bool     `json:"capture-output"`
+}
+
+type guestExecStatus struct {
+	Exited   bool   `json:"exited"`
+	ExitCode *int   `json:"exitcode"`
+	Signal   *int   `json:"signal"`
+	ErrData  string `json:"err-data"`
+}
+
+// guestExec runs the command in the guest via the guest agent and
+// waits for it to finish. An error is returned if the command can't
+// be started, doesn't finish in time, exits with non-zero code or is
+// killed by a signal. The error includes the stderr output of the
+// command, if any.
+func (v *VirtualizationTool) guestExec(domain virt.Domain, what, path string, args ...string) error {
+	command, err := json.Marshal(map[string]interface{}{
+		"execute": "guest-exec",
+		"arguments": guestExecArguments{
+			Path:          path,
+			Arg:           args,
+			CaptureOutput: true,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("can't marshal guest-exec command: %v", err)
+	}
+	var started struct {
+		PID int `json:"pid"`
+	}
+	if err := v.guestAgentQuery(domain, what, string(command), &started); err != nil {
+		return err
+	}
+
+	statusCommand := fmt.Sprintf(`{"execute":"guest-exec-status","arguments":{"pid":%d}}`, started.PID)
+	deadline := v.clock.Now().Add(guestExecTimeout)
+	for {
+		var status guestExecStatus
+		if err := v.guestAgentQuery(domain, what+" status", statusCommand, &status); err != nil {
+			return err
+		}
+		if status.Exited {
+			return status.err(what)
+		}
+		if !v.clock.Now().Before(deadline) {
+			return fmt.Errorf("guest %s didn't finish in %v", what, guestExecTimeout)
+		}
+		v.clock.Sleep(guestExecPollInterval)
+	}
+}
+
+func (s guestExecStatus) err(what string) error {
+	var msg string
+	switch {
+	case s.Signal != nil:
+		msg = fmt.Sprintf("killed by signal %d", *s.Signal)
+	case s.ExitCode != nil && *s.ExitCode != 0:
+		msg = fmt.Sprintf("exited with code %d", *s.ExitCode)
+	default:
+		return nil
+	}
+	if s.ErrData != "" {
+		if errData, err := base64.StdEncoding.DecodeString(s.ErrData); err == nil {
+			msg += ": " + strings.TrimSpace(string(errData))
+		}
+	}
+	return fmt.Errorf("guest %s failed: %s", what, msg)
+}
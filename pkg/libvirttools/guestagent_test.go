@@ -0,0 +1,190 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func (ct *containerTester) startGuestAgentContainer() string {
+	sandbox := criapi.GetSandboxes(1)[0]
+	sandbox.Annotations = map[string]string{"VirtletGuestAgent": "true"}
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	ct.startContainer(containerID)
+	return containerID
+}
+
+// domainCalls returns the names of the domain methods recorded
+// starting from the specified record index
+func (ct *containerTester) domainCalls(start int) []string {
+	var r []string
+	for _, rec := range ct.rec.Content()[start:] {
+		if !strings.HasPrefix(rec.Name, "domain conn: virtlet-") {
+			continue
+		}
+		// skip the contents of the config images recorded
+		// by the fake domain upon start
+		switch call := rec.Name[strings.LastIndex(rec.Name, ": ")+2:]; call {
+		case "iso image", "fw_cfg":
+		default:
+			r = append(r, call)
+		}
+	}
+	return r
+}
+
+func TestGuestAgentShutdown(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	containerID := ct.startGuestAgentContainer()
+	start := len(ct.rec.Content())
+	ct.stopContainer(containerID)
+	ct.verifyDomainState(containerID, virt.DomainStateShutoff)
+	expectedCalls := []string{"GuestAgentCommand", "ShutdownWithGuestAgent"}
+	if calls := ct.domainCalls(start); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Errorf("bad domain calls: %v instead of %v", calls, expectedCalls)
+	}
+}
+
+func TestHungGuestAgentShutdown(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	containerID := ct.startGuestAgentContainer()
+	start := len(ct.rec.Content())
+	ct.virtTool.SetGuestAgentConfig(GuestAgentConfig{Timeout: 3 * time.Second, Retries: 1})
+	ct.domainConn.SetGuestAgentHung(true)
+	defer ct.domainConn.SetGuestAgentHung(false)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ct.virtTool.StopContainer(containerID, stopContainerTimeout)
+	}()
+	for attempt := 0; attempt < 2; attempt++ {
+		if attempt > 0 {
+			// wait for the retry interval to pass
+			ct.clock.BlockUntil(1)
+			ct.clock.Advance(guestAgentRetryInterval)
+		}
+		ct.domainConn.WaitForHungGuestAgentCall()
+		ct.clock.BlockUntil(1)
+		ct.clock.Advance(3 * time.Second)
+	}
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("StopContainer(): %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("StopContainer() is blocked by the hung guest agent")
+	}
+	ct.verifyDomainState(containerID, virt.DomainStateShutoff)
+	// the ping is made twice, after which StopContainer
+	// falls back to ACPI shutdown
+	expectedCalls := []string{"GuestAgentCommand", "GuestAgentCommand", "Shutdown"}
+	if calls := ct.domainCalls(start); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Errorf("bad domain calls: %v instead of %v", calls, expectedCalls)
+	}
+}
+
+func TestGuestInfo(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	containerID := ct.startGuestAgentContainer()
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	domainName, err := domain.Name()
+	if err != nil {
+		t.Fatalf("Name(): %v", err)
+	}
+
+	start := len(ct.rec.Content())
+	ct.clock.Advance(time.Minute)
+	for i := 0; i < 2; i++ {
+		info, err := ct.virtTool.GuestInfo(containerID)
+		if err != nil {
+			t.Fatalf("GuestInfo(): %v", err)
+		}
+		expectedInfo := &GuestInfo{
+			Hostname:      domainName,
+			OSName:        "Ubuntu",
+			OSVersion:     "18.04 LTS (Bionic Beaver)",
+			KernelRelease: "4.15.0-20-generic",
+			Uptime:        time.Minute + time.Duration(i)*time.Second,
+		}
+		if !reflect.DeepEqual(info, expectedInfo) {
+			t.Errorf("bad guest info:\n%#v\ninstead of\n%#v", info, expectedInfo)
+		}
+		ct.clock.Advance(time.Second)
+	}
+	// the second call must use the cached info
+	expectedCalls := []string{"GuestAgentCommand", "GuestAgentCommand"}
+	if calls := ct.filterGuestAgentCalls(start); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Errorf("bad guest agent calls: %v instead of %v", calls, expectedCalls)
+	}
+
+	ct.clock.Advance(guestInfoCacheTTL)
+	if _, err := ct.virtTool.GuestInfo(containerID); err != nil {
+		t.Fatalf("GuestInfo(): %v", err)
+	}
+	expectedCalls = append(expectedCalls, "GuestAgentCommand", "GuestAgentCommand")
+	if calls := ct.filterGuestAgentCalls(start); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Errorf("the cached guest info didn't expire: %v instead of %v", calls, expectedCalls)
+	}
+}
+
+func TestGuestInfoWithoutGuestAgent(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	// the guest agent is also unavailable while the VM isn't running
+	if _, err := ct.virtTool.GuestInfo(containerID); err != ErrGuestAgentUnavailable {
+		t.Errorf("GuestInfo() on a stopped VM: unexpected error %v", err)
+	}
+	ct.startContainer(containerID)
+	if _, err := ct.virtTool.GuestInfo(containerID); err != ErrGuestAgentUnavailable {
+		t.Errorf("GuestInfo() without the guest agent: unexpected error %v", err)
+	}
+}
+
+// filterGuestAgentCalls returns the names of guest agent calls
+// recorded starting from the specified record index
+func (ct *containerTester) filterGuestAgentCalls(start int) []string {
+	var r []string
+	for _, call := range ct.domainCalls(start) {
+		if call == "GuestAgentCommand" {
+			r = append(r, call)
+		}
+	}
+	return r
+}
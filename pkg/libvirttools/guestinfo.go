@@ -0,0 +1,165 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const (
+	guestInfoCacheTTL         = 10 * time.Second
+	guestAgentOSInfoCommand   = `{"execute":"guest-get-osinfo"}`
+	guestAgentHostNameCommand = `{"execute":"guest-get-host-name"}`
+)
+
+// ErrGuestAgentUnavailable is returned by GuestInfo if the VM
+// has no guest agent channel or isn't running
+var ErrGuestAgentUnavailable = errors.New("guest agent unavailable")
+
+// GuestInfo contains the information about the guest OS
+// that's reported by the guest agent
+type GuestInfo struct {
+	// Hostname is the host name as seen by the guest
+	Hostname string
+	// OSName is the name of the guest OS, e.g. Ubuntu
+	OSName string
+	// OSVersion is the version of the guest OS,
+	// e.g. 18.04 LTS (Bionic Beaver)
+	OSVersion string
+	// KernelRelease is the release of the guest OS kernel
+	KernelRelease string
+	// Uptime is the time elapsed since the VM was started
+	Uptime time.Duration
+}
+
+type guestInfoCacheEntry struct {
+	info      GuestInfo
+	err       error
+	fetchedAt time.Time
+}
+
+type guestAgentOSInfo struct {
+	Name          string `json:"name"`
+	Version       string `json:"version"`
+	KernelRelease string `json:"kernel-release"`
+}
+
+type guestAgentHostName struct {
+	HostName string `json:"host-name"`
+}
+
+// guestAgentQuery invokes the guest agent command and decodes the
+// "return" part of the response into result
+func (v *VirtualizationTool) guestAgentQuery(domain virt.Domain, what, command string, result interface{}) error {
+	var resp string
+	if err := v.callGuestAgent(what, func(timeout time.Duration) error {
+		var err error
+		resp, err = domain.GuestAgentCommand(command, timeout)
+		return err
+	}); err != nil {
+		return err
+	}
+	wrapped := struct {
+		Return interface{} `json:"return"`
+	}{Return: result}
+	if err := json.Unmarshal([]byte(resp), &wrapped); err != nil {
+		return fmt.Errorf("bad guest agent %s response %q: %v", what, resp, err)
+	}
+	return nil
+}
+
+func (v *VirtualizationTool) fetchGuestInfo(domain virt.Domain) (GuestInfo, error) {
+	var osInfo guestAgentOSInfo
+	if err := v.guestAgentQuery(domain, "osinfo query", guestAgentOSInfoCommand, &osInfo); err != nil {
+		return GuestInfo{}, err
+	}
+	var hostName guestAgentHostName
+	if err := v.guestAgentQuery(domain, "host name query", guestAgentHostNameCommand, &hostName); err != nil {
+		return GuestInfo{}, err
+	}
+	return GuestInfo{
+		Hostname:      hostName.HostName,
+		OSName:        osInfo.Name,
+		OSVersion:     osInfo.Version,
+		KernelRelease: osInfo.KernelRelease,
+	}, nil
+}
+
+// GuestInfo returns the information about the guest OS of the
+// running VM which is retrieved using the guest agent. The results
+// are cached for a short time so the guest agent isn't queried
+// on every ContainerStatus call. ErrGuestAgentUnavailable is
+// returned if the VM has no guest agent channel or isn't running.
+func (v *VirtualizationTool) GuestInfo(containerID string) (*GuestInfo, error) {
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	if err != nil {
+		return nil, err
+	}
+	if containerInfo == nil {
+		return nil, fmt.Errorf("missing containerInfo for containerID: %s", containerID)
+	}
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		return nil, err
+	}
+	state, err := domain.State()
+	if err != nil {
+		return nil, err
+	}
+	if state != virt.DomainStateRunning {
+		return nil, ErrGuestAgentUnavailable
+	}
+	switch hasGuestAgent, err := domainHasGuestAgent(domain); {
+	case err != nil:
+		return nil, err
+	case !hasGuestAgent:
+		return nil, ErrGuestAgentUnavailable
+	}
+
+	v.guestInfoLock.Lock()
+	entry, found := v.guestInfoCache[containerID]
+	v.guestInfoLock.Unlock()
+	if !found || v.clock.Since(entry.fetchedAt) >= guestInfoCacheTTL {
+		// the failures are cached, too, so a broken agent
+		// isn't retried on every call
+		entry = &guestInfoCacheEntry{fetchedAt: v.clock.Now()}
+		entry.info, entry.err = v.fetchGuestInfo(domain)
+		v.guestInfoLock.Lock()
+		v.guestInfoCache[containerID] = entry
+		v.guestInfoLock.Unlock()
+	}
+	if entry.err != nil {
+		return nil, entry.err
+	}
+
+	info := entry.info
+	if containerInfo.StartedAt != 0 {
+		info.Uptime = v.clock.Now().Sub(time.Unix(0, containerInfo.StartedAt))
+	}
+	return &info, nil
+}
+
+func (v *VirtualizationTool) forgetGuestInfo(containerID string) {
+	v.guestInfoLock.Lock()
+	defer v.guestInfoLock.Unlock()
+	delete(v.guestInfoCache, containerID)
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	defaultHookTimeout = 30 * time.Second
+	postCreateHookName = "post-create"
+	postRemoveHookName = "post-remove"
+)
+
+// HookConfig specifies the commands that are invoked on the node
+// after a VM is created and after it's removed. The commands are
+// passed the container id, the IP address and the MAC address of
+// the VM as the arguments. The same values, as well as the pod
+// name and namespace, are passed via VIRTLET_* environment variables.
+type HookConfig struct {
+	// PostCreateCommand is the path to the executable to run
+	// after a VM is successfully created. Empty value means
+	// not running any command.
+	PostCreateCommand string
+	// PostRemoveCommand is the path to the executable to run
+	// after a VM is removed. Empty value means not running
+	// any command.
+	PostRemoveCommand string
+	// FailCreateOnError makes post-create hook failures fail
+	// the container creation. Otherwise the failures are only
+	// logged. Post-remove hook failures are always just logged.
+	FailCreateOnError bool
+	// Timeout is the time limit for a hook command.
+	// Zero value means using the default of 30 seconds.
+	Timeout time.Duration
+}
+
+func (c HookConfig) withDefaults() HookConfig {
+	if c.Timeout <= 0 {
+		c.Timeout = defaultHookTimeout
+	}
+	return c
+}
+
+// SetHookConfig sets the commands to run after VMs are created
+// and removed
+func (v *VirtualizationTool) SetHookConfig(config HookConfig) {
+	v.hookConfig = config.withDefaults()
+}
+
+// runHookCommand runs the hook command with the specified arguments
+// and additional environment variables
+func runHookCommand(command string, args, env []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%v, output: %q", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// vmAddresses returns the IP and MAC addresses of the VM network
+// interfaces in the order of the CNI result
+func vmAddresses(config *VMConfig) (ips []string, macs []string) {
+	if config.ContainerSideNetwork == nil || config.ContainerSideNetwork.Result == nil {
+		return nil, nil
+	}
+	result := config.ContainerSideNetwork.Result
+	for i, iface := range result.Interfaces {
+		if iface.Sandbox == "" {
+			// skip host interfaces
+			continue
+		}
+		macs = append(macs, iface.Mac)
+		for _, ipConfig := range result.IPs {
+			if ipConfig.Interface == i {
+				ips = append(ips, ipConfig.Address.IP.String())
+			}
+		}
+	}
+	return ips, macs
+}
+
+func (v *VirtualizationTool) runHook(hookName, command string, containerID string, config *VMConfig) error {
+	if command == "" {
+		return nil
+	}
+	ips, macs := vmAddresses(config)
+	var ip, mac string
+	if len(ips) > 0 {
+		ip = ips[0]
+	}
+	if len(macs) > 0 {
+		mac = macs[0]
+	}
+	env := []string{
+		"VIRTLET_HOOK=" + hookName,
+		"VIRTLET_CONTAINER_ID=" + containerID,
+		"VIRTLET_POD_NAME=" + config.PodName,
+		"VIRTLET_POD_NAMESPACE=" + config.PodNamespace,
+		"VIRTLET_VM_IP=" + ip,
+		"VIRTLET_VM_MAC=" + mac,
+		"VIRTLET_VM_IPS=" + strings.Join(ips, " "),
+		"VIRTLET_VM_MACS=" + strings.Join(macs, " "),
+	}
+	glog.V(2).Infof("Running %s hook %q for container %q", hookName, command, containerID)
+	if err := v.hookRunner(command, []string{containerID, ip, mac}, env, v.hookConfig.Timeout); err != nil {
+		return fmt.Errorf("%s hook %q failed for container %q: %v", hookName, command, containerID, err)
+	}
+	return nil
+}
+
+// runPostCreateHook runs the post-create hook for the container.
+// The error is only returned if the hook failures are configured
+// to fail the container creation.
+func (v *VirtualizationTool) runPostCreateHook(containerID string, config *VMConfig) error {
+	err := v.runHook(postCreateHookName, v.hookConfig.PostCreateCommand, containerID, config)
+	if err != nil && !v.hookConfig.FailCreateOnError {
+		glog.Warning(err)
+		return nil
+	}
+	return err
+}
+
+// runPostRemoveHook runs the post-remove hook for the container,
+// logging the failures
+func (v *VirtualizationTool) runPostRemoveHook(containerID string, config *VMConfig) {
+	if err := v.runHook(postRemoveHookName, v.hookConfig.PostRemoveCommand, containerID, config); err != nil {
+		glog.Warning(err)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/network"
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+const (
+	fakePostCreateHook = "/usr/local/bin/register-vm"
+	fakePostRemoveHook = "/usr/local/bin/unregister-vm"
+	fakeHookVMMac      = "42:a4:a6:22:80:2e"
+)
+
+type hookCall struct {
+	command string
+	args    []string
+	env     map[string]string
+}
+
+type fakeHookRunner struct {
+	t     *testing.T
+	calls []hookCall
+	err   error
+}
+
+func (r *fakeHookRunner) run(command string, args, env []string, timeout time.Duration) error {
+	if timeout != defaultHookTimeout {
+		r.t.Errorf("bad hook timeout %v", timeout)
+	}
+	envMap := make(map[string]string)
+	for _, item := range env {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			r.t.Errorf("bad env item %q", item)
+			continue
+		}
+		envMap[parts[0]] = parts[1]
+	}
+	r.calls = append(r.calls, hookCall{command, args, envMap})
+	return r.err
+}
+
+func setupHookTest(t *testing.T, config HookConfig) (*containerTester, *fakeHookRunner, *VMConfig) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	runner := &fakeHookRunner{t: t}
+	ct.virtTool.hookRunner = runner.run
+	ct.virtTool.SetHookConfig(config)
+
+	mac, _ := net.ParseMAC(fakeHookVMMac)
+	csn := &network.ContainerSideNetwork{
+		Result: &cnicurrent.Result{
+			Interfaces: []*cnicurrent.Interface{
+				{
+					Name:    "cni0",
+					Mac:     fakeHookVMMac,
+					Sandbox: "/var/run/netns/fake",
+				},
+			},
+			IPs: []*cnicurrent.IPConfig{
+				{
+					Version: "4",
+					Address: net.IPNet{
+						IP:   net.IPv4(10, 1, 90, 5),
+						Mask: net.CIDRMask(24, 32),
+					},
+					Gateway:   net.IPv4(10, 1, 90, 1),
+					Interface: 0,
+				},
+			},
+		},
+		NsPath: "/var/run/netns/fake",
+		Interfaces: []*network.InterfaceDescription{
+			{HardwareAddr: mac, MTU: 1500},
+		},
+	}
+	sandbox := criapi.GetSandboxes(1)[0]
+	psi, err := metadata.NewPodSandboxInfo(sandbox, csn, kubeapi.PodSandboxState_SANDBOX_READY, ct.clock)
+	if err != nil {
+		t.Fatalf("NewPodSandboxInfo(): %v", err)
+	}
+	if err := ct.metadataStore.PodSandbox(sandbox.Metadata.Uid).Save(
+		func(c *metadata.PodSandboxInfo) (*metadata.PodSandboxInfo, error) {
+			return psi, nil
+		}); err != nil {
+		t.Fatalf("Failed to store pod sandbox: %v", err)
+	}
+	vmConfig := ct.vmConfig(sandbox, nil)
+	vmConfig.ContainerSideNetwork = csn
+	return ct, runner, vmConfig
+}
+
+func expectedHookCall(command, hookName, containerID string) hookCall {
+	return hookCall{
+		command: command,
+		args:    []string{containerID, "10.1.90.5", fakeHookVMMac},
+		env: map[string]string{
+			"VIRTLET_HOOK":          hookName,
+			"VIRTLET_CONTAINER_ID":  containerID,
+			"VIRTLET_POD_NAME":      "testName_0",
+			"VIRTLET_POD_NAMESPACE": "default",
+			"VIRTLET_VM_IP":         "10.1.90.5",
+			"VIRTLET_VM_MAC":        fakeHookVMMac,
+			"VIRTLET_VM_IPS":        "10.1.90.5",
+			"VIRTLET_VM_MACS":       fakeHookVMMac,
+		},
+	}
+}
+
+func TestHooks(t *testing.T) {
+	ct, runner, vmConfig := setupHookTest(t, HookConfig{
+		PostCreateCommand: fakePostCreateHook,
+		PostRemoveCommand: fakePostRemoveHook,
+	})
+	defer ct.teardown()
+
+	containerID, err := ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns")
+	if err != nil {
+		t.Fatalf("CreateContainer(): %v", err)
+	}
+	expectedCalls := []hookCall{expectedHookCall(fakePostCreateHook, "post-create", containerID)}
+	if !reflect.DeepEqual(runner.calls, expectedCalls) {
+		t.Errorf("bad hook calls after CreateContainer():\n%#v\ninstead of\n%#v", runner.calls, expectedCalls)
+	}
+
+	ct.removeContainer(containerID)
+	expectedCalls = append(expectedCalls, expectedHookCall(fakePostRemoveHook, "post-remove", containerID))
+	if !reflect.DeepEqual(runner.calls, expectedCalls) {
+		t.Errorf("bad hook calls after RemoveContainer():\n%#v\ninstead of\n%#v", runner.calls, expectedCalls)
+	}
+}
+
+func TestHookFailures(t *testing.T) {
+	for _, failCreateOnError := range []bool{false, true} {
+		ct, runner, vmConfig := setupHookTest(t, HookConfig{
+			PostCreateCommand: fakePostCreateHook,
+			PostRemoveCommand: fakePostRemoveHook,
+			FailCreateOnError: failCreateOnError,
+		})
+		runner.err = errors.New("hook failed")
+
+		containerID, err := ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns")
+		switch {
+		case failCreateOnError && err == nil:
+			t.Errorf("CreateContainer() didn't fail with FailCreateOnError")
+		case !failCreateOnError && err != nil:
+			t.Errorf("CreateContainer() failed without FailCreateOnError: %v", err)
+		}
+
+		expectedContainerCount := 1
+		if failCreateOnError {
+			expectedContainerCount = 0
+		}
+		if containers := ct.listContainers(nil); len(containers) != expectedContainerCount {
+			t.Errorf("%d containers instead of %d (FailCreateOnError: %v)", len(containers), expectedContainerCount, failCreateOnError)
+		}
+		if domains, err := ct.domainConn.ListDomains(); err != nil {
+			t.Errorf("ListDomains(): %v", err)
+		} else if len(domains) != expectedContainerCount {
+			t.Errorf("%d domains instead of %d (FailCreateOnError: %v)", len(domains), expectedContainerCount, failCreateOnError)
+		}
+
+		if !failCreateOnError {
+			// post-remove hook failures don't fail the removal
+			ct.removeContainer(containerID)
+			if len(runner.calls) != 2 {
+				t.Errorf("bad number of hook calls %d", len(runner.calls))
+			}
+		}
+		ct.teardown()
+	}
+}
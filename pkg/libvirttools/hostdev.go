@@ -0,0 +1,271 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	vfioDevDir = "/dev/vfio"
+	// pciBridgeClassPrefix is the prefix of PCI class code of
+	// PCI bridges which are part of IOMMU groups but can't be
+	// passed through
+	pciBridgeClassPrefix = "0x0604"
+	// pciDisplayClassPrefix is the prefix of PCI class code of
+	// display controllers, i.e. GPUs
+	pciDisplayClassPrefix = "0x03"
+	// pciAudioClassPrefix is the prefix of PCI class code of
+	// multimedia audio controllers, such as the HDMI audio
+	// functions of the GPUs
+	pciAudioClassPrefix = "0x0403"
+)
+
+var (
+	sysfsIOMMUGroupsDir = "/sys/kernel/iommu_groups"
+	sysfsPCIDevicesDir  = "/sys/bus/pci/devices"
+)
+
+// isVFIOGroupDevice returns true if the specified device path
+// denotes a VFIO group, e.g. /dev/vfio/42. Device plugins allocate
+// such devices for PCI passthrough.
+func isVFIOGroupDevice(path string) bool {
+	return filepath.Dir(path) == vfioDevDir && filepath.Base(path) != "vfio"
+}
+
+// getVFIOGroupPCIDevices returns the PCI addresses of the devices
+// belonging to the IOMMU group of the specified VFIO group device,
+// skipping PCI bridges
+func getVFIOGroupPCIDevices(devicePath string) ([]string, error) {
+	addrs, err := iommuGroupPCIDevices(filepath.Base(devicePath))
+	if err != nil {
+		return nil, fmt.Errorf("can't get PCI devices of VFIO group %q: %v", devicePath, err)
+	}
+	return addrs, nil
+}
+
+// pciDeviceClass returns the PCI class code of the device in the
+// specified sysfs directory, e.g. 0x030000
+func pciDeviceClass(devDir string) (string, error) {
+	class, err := ioutil.ReadFile(filepath.Join(devDir, "class"))
+	if err != nil {
+		return "", fmt.Errorf("can't get PCI class of device %q: %v", filepath.Base(devDir), err)
+	}
+	return strings.TrimSpace(string(class)), nil
+}
+
+// iommuGroupPCIDevices returns the PCI addresses of the devices
+// belonging to the specified IOMMU group, skipping PCI bridges
+func iommuGroupPCIDevices(group string) ([]string, error) {
+	devicesDir := filepath.Join(sysfsIOMMUGroupsDir, group, "devices")
+	items, err := ioutil.ReadDir(devicesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("IOMMU group %q not found", group)
+		}
+		return nil, fmt.Errorf("can't list the devices of IOMMU group %q: %v", group, err)
+	}
+	var addrs []string
+	for _, item := range items {
+		class, err := pciDeviceClass(filepath.Join(devicesDir, item.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(class, pciBridgeClassPrefix) {
+			continue
+		}
+		addrs = append(addrs, item.Name())
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("IOMMU group %q has no PCI devices to pass through", group)
+	}
+	return addrs, nil
+}
+
+// getGPUGroupPCIDevices returns the PCI addresses of the devices
+// belonging to the IOMMU group of the specified GPU, which must be
+// passed through to the VM together, skipping PCI bridges.
+// It fails if the device is not found, the IOMMU is not enabled on
+// the host, the device is not a display controller or its IOMMU
+// group contains devices other than display and audio controllers,
+// e.g. a NIC or a storage controller of the host.
+func getGPUGroupPCIDevices(addr string) ([]string, error) {
+	devDir := filepath.Join(sysfsPCIDevicesDir, addr)
+	groupLink, err := os.Readlink(filepath.Join(devDir, "iommu_group"))
+	if err != nil {
+		if _, statErr := os.Stat(devDir); os.IsNotExist(statErr) {
+			return nil, fmt.Errorf("PCI device %q not found", addr)
+		}
+		return nil, fmt.Errorf("can't find IOMMU group of PCI device %q, make sure IOMMU is enabled on the host: %v", addr, err)
+	}
+	class, err := pciDeviceClass(devDir)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(class, pciDisplayClassPrefix) {
+		return nil, fmt.Errorf("PCI device %q is not a display controller (class %s) and can't be passed through as a GPU", addr, class)
+	}
+	group := filepath.Base(groupLink)
+	addrs, err := iommuGroupPCIDevices(group)
+	if err != nil {
+		return nil, fmt.Errorf("can't get PCI devices of the IOMMU group of %q: %v", addr, err)
+	}
+	for _, a := range addrs {
+		if a == addr {
+			continue
+		}
+		class, err := pciDeviceClass(filepath.Join(sysfsIOMMUGroupsDir, group, "devices", a))
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(class, pciDisplayClassPrefix) && !strings.HasPrefix(class, pciAudioClassPrefix) {
+			return nil, fmt.Errorf("IOMMU group of GPU %q contains PCI device %q (class %s) which is not a display or audio controller", addr, a, class)
+		}
+	}
+	return addrs, nil
+}
+
+// ParseGPUDevices parses a comma-separated list of the PCI addresses
+// of the host GPUs that can be passed through to the VMs using
+// VirtletGPUDevices annotation
+func ParseGPUDevices(s string) ([]string, error) {
+	var r []string
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.ToLower(strings.TrimSpace(addr))
+		if addr == "" {
+			continue
+		}
+		if _, err := parsePCIAddress(addr); err != nil {
+			return nil, err
+		}
+		r = append(r, addr)
+	}
+	return r, nil
+}
+
+// SetGPUDevices sets the list of the PCI addresses of the host GPUs
+// which the VMs can request using VirtletGPUDevices annotation.
+// See ParseGPUDevices for the format. Empty list means that no
+// GPUs can be requested this way.
+func (v *VirtualizationTool) SetGPUDevices(gpuDevices string) error {
+	addrs, err := ParseGPUDevices(gpuDevices)
+	if err != nil {
+		return err
+	}
+	v.gpuDevices = addrs
+	return nil
+}
+
+// gpuDeviceAllowed returns true if the GPU with the specified PCI
+// address is on the list set by SetGPUDevices
+func (v *VirtualizationTool) gpuDeviceAllowed(addr string) bool {
+	for _, a := range v.gpuDevices {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPCIDevices returns the PCI addresses of the host devices
+// that must be passed through to the VM based on the devices
+// allocated for the container and the GPUs listed in
+// VirtletGPUDevices annotation. The device nodes that don't
+// denote VFIO groups can't be passed to a VM and are skipped.
+// The GPUs must be on the list set by SetGPUDevices.
+func (v *VirtualizationTool) hostPCIDevices(config *VMConfig) ([]*libvirtxml.DomainAddressPCI, error) {
+	var r []*libvirtxml.DomainAddressPCI
+	seen := make(map[string]bool)
+	add := func(addrs []string) error {
+		for _, addr := range addrs {
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			pciAddr, err := parsePCIAddress(addr)
+			if err != nil {
+				return err
+			}
+			r = append(r, pciAddr)
+		}
+		return nil
+	}
+	for _, path := range config.HostDevices {
+		if !isVFIOGroupDevice(path) {
+			glog.V(2).Infof("Skipping non-VFIO device %q for container %q", path, config.Name)
+			continue
+		}
+		addrs, err := v.pciDevicesGetter(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(addrs); err != nil {
+			return nil, err
+		}
+	}
+	for _, gpu := range config.ParsedAnnotations.GPUDevices {
+		if !v.gpuDeviceAllowed(gpu) {
+			return nil, fmt.Errorf("GPU %q is not in the list of the GPUs that can be passed through to the VMs", gpu)
+		}
+		addrs, err := v.gpuDevicesGetter(gpu)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(addrs); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// parsePCIAddress parses PCI address in the form of
+// domain:bus:slot.function, e.g. 0000:01:00.0
+func parsePCIAddress(addr string) (*libvirtxml.DomainAddressPCI, error) {
+	var domain, bus, slot, function uint
+	if n, err := fmt.Sscanf(addr, "%x:%x:%x.%x", &domain, &bus, &slot, &function); err != nil || n != 4 {
+		return nil, fmt.Errorf("bad PCI address %q", addr)
+	}
+	return &libvirtxml.DomainAddressPCI{
+		Domain:   &domain,
+		Bus:      &bus,
+		Slot:     &slot,
+		Function: &function,
+	}, nil
+}
+
+// addHostPCIDevices adds the host PCI devices to the domain. The
+// devices are managed by libvirt, which detaches them from their host
+// drivers when the VM starts and reattaches them when it's destroyed.
+func (ds *domainSettings) addHostPCIDevices(domain *libvirtxml.Domain) {
+	for _, pciAddr := range ds.hostPCIDevices {
+		domain.Devices.Hostdevs = append(domain.Devices.Hostdevs, libvirtxml.DomainHostdev{
+			Managed: "yes",
+			SubsysPCI: &libvirtxml.DomainHostdevSubsysPCI{
+				Source: &libvirtxml.DomainHostdevSubsysPCISource{
+					Address: pciAddr,
+				},
+			},
+		})
+	}
+}
@@ -0,0 +1,318 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestGetVFIOGroupPCIDevices(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "iommu-groups-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	savedIOMMUGroupsDir := sysfsIOMMUGroupsDir
+	sysfsIOMMUGroupsDir = tmpDir
+	defer func() { sysfsIOMMUGroupsDir = savedIOMMUGroupsDir }()
+
+	for addr, class := range map[string]string{
+		"7/devices/0000:00:01.0": "0x060400", // PCI bridge
+		"7/devices/0000:01:00.0": "0x030000", // VGA controller
+		"7/devices/0000:01:00.1": "0x040300", // HDMI audio
+		"8/devices/0000:00:1f.0": "0x060100", // ISA bridge
+		"9/devices/0000:00:1c.0": "0x060400", // PCI bridge
+	} {
+		devDir := filepath.Join(tmpDir, addr)
+		if err := os.MkdirAll(devDir, 0755); err != nil {
+			t.Fatalf("MkdirAll(): %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(devDir, "class"), []byte(class+"\n"), 0644); err != nil {
+			t.Fatalf("WriteFile(): %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		devicePath    string
+		expectedAddrs []string
+	}{
+		{"/dev/vfio/7", []string{"0000:01:00.0", "0000:01:00.1"}},
+		{"/dev/vfio/8", []string{"0000:00:1f.0"}},
+		// only PCI bridges
+		{"/dev/vfio/9", nil},
+		// nonexistent group
+		{"/dev/vfio/10", nil},
+	} {
+		addrs, err := getVFIOGroupPCIDevices(tc.devicePath)
+		switch {
+		case tc.expectedAddrs == nil && err == nil:
+			t.Errorf("getVFIOGroupPCIDevices(%q) didn't fail", tc.devicePath)
+		case tc.expectedAddrs != nil && err != nil:
+			t.Errorf("getVFIOGroupPCIDevices(%q): %v", tc.devicePath, err)
+		case !reflect.DeepEqual(addrs, tc.expectedAddrs):
+			t.Errorf("bad PCI devices for %q: %v instead of %v", tc.devicePath, addrs, tc.expectedAddrs)
+		}
+	}
+}
+
+func TestHostPCIDevicePassthrough(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	ct.virtTool.pciDevicesGetter = func(devicePath string) ([]string, error) {
+		if devicePath != "/dev/vfio/7" {
+			t.Errorf("unexpected VFIO device %q", devicePath)
+		}
+		return []string{"0000:01:00.0", "0000:01:00.1"}, nil
+	}
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	// the devices allocated by a GPU device plugin
+	req := &kubeapi.CreateContainerRequest{
+		PodSandboxId: sandbox.Metadata.Uid,
+		Config: &kubeapi.ContainerConfig{
+			Metadata: &kubeapi.ContainerMetadata{
+				Name:    fakeContainerName,
+				Attempt: fakeContainerAttempt,
+			},
+			Image: &kubeapi.ImageSpec{
+				Image: fakeImageName,
+			},
+			Devices: []*kubeapi.Device{
+				{ContainerPath: "/dev/vfio/vfio", HostPath: "/dev/vfio/vfio", Permissions: "mrw"},
+				{ContainerPath: "/dev/vfio/7", HostPath: "/dev/vfio/7", Permissions: "mrw"},
+				// the same group is passed through once
+				{ContainerPath: "/dev/vfio/7", HostPath: "/dev/vfio/7", Permissions: "mrw"},
+				{ContainerPath: "/dev/nvidiactl", HostPath: "/dev/nvidiactl", Permissions: "mrw"},
+			},
+		},
+		SandboxConfig: sandbox,
+	}
+	vmConfig, err := GetVMConfig(req, nil)
+	if err != nil {
+		t.Fatalf("GetVMConfig(): %v", err)
+	}
+
+	containerID, err := ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns")
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	def, err := domain.XML()
+	if err != nil {
+		t.Fatalf("XML(): %v", err)
+	}
+
+	expectedHostdevs := []libvirtxml.DomainHostdev{
+		{
+			Managed: "yes",
+			SubsysPCI: &libvirtxml.DomainHostdevSubsysPCI{
+				Source: &libvirtxml.DomainHostdevSubsysPCISource{
+					Address: pciAddress(0, 1, 0, 0).PCI,
+				},
+			},
+		},
+		{
+			Managed: "yes",
+			SubsysPCI: &libvirtxml.DomainHostdevSubsysPCI{
+				Source: &libvirtxml.DomainHostdevSubsysPCISource{
+					Address: pciAddress(0, 1, 0, 1).PCI,
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(def.Devices.Hostdevs, expectedHostdevs) {
+		t.Errorf("bad hostdevs:\n%s\ninstead of\n%s", spew.Sdump(def.Devices.Hostdevs), spew.Sdump(expectedHostdevs))
+	}
+
+	ct.removeContainer(containerID)
+}
+
+func TestGetGPUGroupPCIDevices(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pci-devices-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	savedIOMMUGroupsDir, savedPCIDevicesDir := sysfsIOMMUGroupsDir, sysfsPCIDevicesDir
+	sysfsIOMMUGroupsDir = filepath.Join(tmpDir, "iommu_groups")
+	sysfsPCIDevicesDir = filepath.Join(tmpDir, "devices")
+	defer func() {
+		sysfsIOMMUGroupsDir, sysfsPCIDevicesDir = savedIOMMUGroupsDir, savedPCIDevicesDir
+	}()
+
+	for _, dev := range []struct{ group, addr, class string }{
+		{"7", "0000:00:01.0", "0x060400"}, // PCI bridge
+		{"7", "0000:01:00.0", "0x030000"}, // VGA controller
+		{"7", "0000:01:00.1", "0x040300"}, // HDMI audio
+		{"", "0000:02:00.0", "0x030000"},  // no IOMMU group
+		{"8", "0000:03:00.0", "0x020000"}, // Ethernet controller
+		{"9", "0000:04:00.0", "0x030200"}, // 3D controller
+		{"9", "0000:04:00.1", "0x010802"}, // NVMe controller
+	} {
+		devDir := filepath.Join(sysfsPCIDevicesDir, dev.addr)
+		if err := os.MkdirAll(devDir, 0755); err != nil {
+			t.Fatalf("MkdirAll(): %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(devDir, "class"), []byte(dev.class+"\n"), 0644); err != nil {
+			t.Fatalf("WriteFile(): %v", err)
+		}
+		if dev.group == "" {
+			continue
+		}
+		groupDir := filepath.Join(sysfsIOMMUGroupsDir, dev.group)
+		if err := os.Symlink(groupDir, filepath.Join(devDir, "iommu_group")); err != nil {
+			t.Fatalf("Symlink(): %v", err)
+		}
+		groupDevDir := filepath.Join(groupDir, "devices", dev.addr)
+		if err := os.MkdirAll(groupDevDir, 0755); err != nil {
+			t.Fatalf("MkdirAll(): %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(groupDevDir, "class"), []byte(dev.class+"\n"), 0644); err != nil {
+			t.Fatalf("WriteFile(): %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		addr          string
+		expectedAddrs []string
+	}{
+		{"0000:01:00.0", []string{"0000:01:00.0", "0000:01:00.1"}},
+		// not a display controller
+		{"0000:01:00.1", nil},
+		// PCI bridge
+		{"0000:00:01.0", nil},
+		// IOMMU is not enabled for the device
+		{"0000:02:00.0", nil},
+		// a NIC of the host
+		{"0000:03:00.0", nil},
+		// the IOMMU group contains a storage controller
+		{"0000:04:00.0", nil},
+		// nonexistent device
+		{"0000:05:00.0", nil},
+	} {
+		addrs, err := getGPUGroupPCIDevices(tc.addr)
+		switch {
+		case tc.expectedAddrs == nil && err == nil:
+			t.Errorf("getGPUGroupPCIDevices(%q) didn't fail", tc.addr)
+		case tc.expectedAddrs != nil && err != nil:
+			t.Errorf("getGPUGroupPCIDevices(%q): %v", tc.addr, err)
+		case !reflect.DeepEqual(addrs, tc.expectedAddrs):
+			t.Errorf("bad PCI devices for %q: %v instead of %v", tc.addr, addrs, tc.expectedAddrs)
+		}
+	}
+}
+
+func TestGPUPassthrough(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	ct.virtTool.gpuDevicesGetter = func(addr string) ([]string, error) {
+		if addr != "0000:01:00.0" {
+			t.Errorf("unexpected GPU %q", addr)
+		}
+		return []string{"0000:01:00.0", "0000:01:00.1"}, nil
+	}
+
+	sandboxes := criapi.GetSandboxes(2)
+	for _, sandbox := range sandboxes {
+		sandbox.Annotations["VirtletGPUDevices"] = "0000:01:00.0"
+		ct.setPodSandbox(sandbox)
+	}
+
+	// the GPUs must be allowed by the node administrator
+	if _, err := ct.virtTool.CreateContainer(ct.vmConfig(sandboxes[0], nil), "/tmp/fakenetns"); err == nil {
+		t.Errorf("CreateContainer() didn't fail for a GPU that's not allowed")
+	}
+	if err := ct.virtTool.SetGPUDevices("0000:02:00.0, 0000:01:00.0"); err != nil {
+		t.Fatalf("SetGPUDevices(): %v", err)
+	}
+
+	firstID := ct.createContainer(sandboxes[0], nil)
+	domain, err := ct.domainConn.LookupDomainByUUIDString(firstID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	def, err := domain.XML()
+	if err != nil {
+		t.Fatalf("XML(): %v", err)
+	}
+	var hostdevAddrs []string
+	for _, hostdev := range def.Devices.Hostdevs {
+		hostdevAddrs = append(hostdevAddrs, formatPCIAddress(hostdev.SubsysPCI.Source.Address))
+	}
+	if expectedAddrs := []string{"0000:01:00.0", "0000:01:00.1"}; !reflect.DeepEqual(hostdevAddrs, expectedAddrs) {
+		t.Errorf("bad hostdevs: %v instead of %v", hostdevAddrs, expectedAddrs)
+	}
+
+	// the registry is rebuilt from the domain definitions
+	// after Virtlet restart
+	ct.virtTool.pciDeviceClaims.owners = nil
+
+	_, err = ct.virtTool.CreateContainer(ct.vmConfig(sandboxes[1], nil), "/tmp/fakenetns")
+	switch {
+	case err == nil:
+		t.Errorf("CreateContainer() didn't fail for a GPU that's in use")
+	case !IsPCIDeviceConflict(err):
+		t.Errorf("CreateContainer() returned a wrong error: %v", err)
+	case err.(*PCIDeviceConflictError).ContainerID != firstID:
+		t.Errorf("bad container id in the conflict error: %v", err)
+	}
+
+	// the GPU is released when the container is removed
+	ct.removeContainer(firstID)
+	secondID := ct.createContainer(sandboxes[1], nil)
+	ct.removeContainer(secondID)
+}
+
+func TestParseGPUDevices(t *testing.T) {
+	for _, tc := range []struct {
+		value         string
+		expectedAddrs []string
+		expectError   bool
+	}{
+		{value: ""},
+		{value: "0000:01:00.0", expectedAddrs: []string{"0000:01:00.0"}},
+		{value: " 0000:01:00.0 ,0000:0A:00.0,", expectedAddrs: []string{"0000:01:00.0", "0000:0a:00.0"}},
+		{value: "0000:01:00.0,gpu0", expectError: true},
+	} {
+		addrs, err := ParseGPUDevices(tc.value)
+		switch {
+		case tc.expectError && err == nil:
+			t.Errorf("ParseGPUDevices(%q) didn't return an error", tc.value)
+		case !tc.expectError && err != nil:
+			t.Errorf("ParseGPUDevices(%q): %v", tc.value, err)
+		case !reflect.DeepEqual(addrs, tc.expectedAddrs):
+			t.Errorf("ParseGPUDevices(%q): %v instead of %v", tc.value, addrs, tc.expectedAddrs)
+		}
+	}
+}
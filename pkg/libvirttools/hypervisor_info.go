@@ -0,0 +1,87 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"os"
+)
+
+// HypervisorInfo describes the virtualization stack that
+// runs the VMs
+type HypervisorInfo struct {
+	// LibvirtVersion is the version of libvirt, e.g. 4.0.0
+	LibvirtVersion string
+	// QEMUVersion is the version of the hypervisor, e.g. 2.11.1
+	QEMUVersion string
+	// KVMAvailable is true if the VMs can use KVM acceleration
+	KVMAvailable bool
+}
+
+type hypervisorVersions struct {
+	libvirt, qemu uint32
+}
+
+// formatVersion converts a version number as returned by libvirt
+// (major * 1,000,000 + minor * 1,000 + release) to a string
+func formatVersion(version uint32) string {
+	return fmt.Sprintf("%d.%d.%d", version/1000000, version/1000%1000, version%1000)
+}
+
+// hypervisorVersions returns the versions of libvirt and the
+// hypervisor. The versions are only retrieved from libvirt upon
+// the first successful call as they're not expected to change
+// while Virtlet is running.
+func (v *VirtualizationTool) hypervisorVersions() (hypervisorVersions, error) {
+	v.versionLock.Lock()
+	defer v.versionLock.Unlock()
+	if v.versions != nil {
+		return *v.versions, nil
+	}
+	libvirtVersion, err := v.domainConn.LibVersion()
+	if err != nil {
+		return hypervisorVersions{}, fmt.Errorf("can't get libvirt version: %v", err)
+	}
+	qemuVersion, err := v.domainConn.HypervisorVersion()
+	if err != nil {
+		return hypervisorVersions{}, fmt.Errorf("can't get hypervisor version: %v", err)
+	}
+	v.versions = &hypervisorVersions{libvirt: libvirtVersion, qemu: qemuVersion}
+	return *v.versions, nil
+}
+
+func kvmAvailable() bool {
+	if !canUseKvm() {
+		return false
+	}
+	_, err := os.Stat(kvmDevice)
+	return err == nil
+}
+
+// HypervisorInfo returns the versions of libvirt and the hypervisor
+// and tells whether KVM can be used on the node
+func (v *VirtualizationTool) HypervisorInfo() (*HypervisorInfo, error) {
+	versions, err := v.hypervisorVersions()
+	if err != nil {
+		return nil, err
+	}
+	return &HypervisorInfo{
+		LibvirtVersion: formatVersion(versions.libvirt),
+		QEMUVersion:    formatVersion(versions.qemu),
+		KVMAvailable:   v.forceKVM || kvmAvailable(),
+	}, nil
+}
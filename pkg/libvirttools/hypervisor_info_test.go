@@ -0,0 +1,53 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+)
+
+func TestHypervisorInfo(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	ct.domainConn.SetVersions(4010000, 3001002)
+	expectedInfo := &HypervisorInfo{
+		LibvirtVersion: "4.10.0",
+		QEMUVersion:    "3.1.2",
+		KVMAvailable:   true,
+	}
+	info, err := ct.virtTool.HypervisorInfo()
+	if err != nil {
+		t.Fatalf("HypervisorInfo(): %v", err)
+	}
+	if !reflect.DeepEqual(info, expectedInfo) {
+		t.Errorf("bad hypervisor info: %#v instead of %#v", info, expectedInfo)
+	}
+
+	// the versions are cached
+	ct.domainConn.SetVersions(5000000, 4000000)
+	info, err = ct.virtTool.HypervisorInfo()
+	if err != nil {
+		t.Fatalf("HypervisorInfo(): %v", err)
+	}
+	if !reflect.DeepEqual(info, expectedInfo) {
+		t.Errorf("bad hypervisor info after changing the versions: %#v instead of %#v", info, expectedInfo)
+	}
+}
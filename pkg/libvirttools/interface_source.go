@@ -0,0 +1,207 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	// interfaceSourceBridge means connecting the interface to
+	// a host bridge
+	interfaceSourceBridge = "bridge"
+	// interfaceSourceDirect means connecting the interface to
+	// a host interface using macvtap
+	interfaceSourceDirect = "direct"
+	// interfaceSourceNetwork means connecting the interface to
+	// a libvirt network
+	interfaceSourceNetwork = "network"
+	// maxInterfaceNameLength is the maximum length of Linux
+	// network interface name
+	maxInterfaceNameLength = 15
+)
+
+var sysfsNetDir = "/sys/class/net"
+
+var macvtapModes = []string{"vepa", "bridge", "private", "passthrough"}
+
+// InterfaceSourceConfig describes an additional VM network interface
+// that's connected to a host bridge, a host interface or a libvirt
+// network instead of a tap device provided by CNI
+type InterfaceSourceConfig struct {
+	// Type is the type of the interface source, which is
+	// either bridge, direct or network
+	Type string
+	// Source is the name of the bridge, the host interface or
+	// the libvirt network
+	Source string
+	// Mode is the macvtap mode for direct interfaces. Empty value
+	// means libvirt's default mode (vepa)
+	Mode string
+}
+
+// parseInterfaceSourceConfig parses interface source configuration in
+// the form of type=<bridge|direct|network>,source=<name>[,mode=<macvtap mode>]
+func parseInterfaceSourceConfig(s string) (*InterfaceSourceConfig, error) {
+	var config InterfaceSourceConfig
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad interface source option %q", item)
+		}
+		switch parts[0] {
+		case "type":
+			config.Type = parts[1]
+		case "source":
+			config.Source = parts[1]
+		case "mode":
+			config.Mode = parts[1]
+		default:
+			return nil, fmt.Errorf("unknown interface source option %q", parts[0])
+		}
+	}
+	if config.Type == "" {
+		return nil, errors.New("interface source type must be specified")
+	}
+	if config.Source == "" {
+		return nil, errors.New("interface source must be specified")
+	}
+	return &config, nil
+}
+
+func (c *InterfaceSourceConfig) validate() error {
+	switch c.Type {
+	case interfaceSourceBridge, interfaceSourceDirect:
+		if len(c.Source) > maxInterfaceNameLength || strings.ContainsAny(c.Source, "/ ") {
+			return fmt.Errorf("bad interface name %q", c.Source)
+		}
+	case interfaceSourceNetwork:
+	default:
+		return fmt.Errorf("bad interface source type %q. Must be one of %q, %q or %q", c.Type, interfaceSourceBridge, interfaceSourceDirect, interfaceSourceNetwork)
+	}
+	if c.Mode == "" {
+		return nil
+	}
+	if c.Type != interfaceSourceDirect {
+		return fmt.Errorf("mode can only be specified for %q interface source type", interfaceSourceDirect)
+	}
+	for _, mode := range macvtapModes {
+		if c.Mode == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("bad macvtap mode %q. Must be one of %s", c.Mode, strings.Join(macvtapModes, ", "))
+}
+
+// ParseInterfaceSources parses a comma-separated list of the host
+// bridges, host interfaces and libvirt networks which can be used in
+// VirtletInterfaceSource annotation. Each item has the form of
+// <bridge|direct|network>:<name>, e.g. bridge:br0,network:default
+func ParseInterfaceSources(s string) ([]InterfaceSourceConfig, error) {
+	var r []InterfaceSourceConfig
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad interface source %q, must be <type>:<name>", item)
+		}
+		c := InterfaceSourceConfig{Type: parts[0], Source: parts[1]}
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+		r = append(r, c)
+	}
+	return r, nil
+}
+
+// SetInterfaceSources sets the list of the host bridges, host
+// interfaces and libvirt networks which the VMs can be connected to
+// using VirtletInterfaceSource annotation. See ParseInterfaceSources
+// for the format. Empty list means that no additional interfaces can
+// be requested this way.
+func (v *VirtualizationTool) SetInterfaceSources(interfaceSources string) error {
+	sources, err := ParseInterfaceSources(interfaceSources)
+	if err != nil {
+		return err
+	}
+	v.interfaceSources = sources
+	return nil
+}
+
+// checkInterfaceSourceAllowed verifies that the source of the
+// interface is on the list set by SetInterfaceSources
+func (v *VirtualizationTool) checkInterfaceSourceAllowed(c *InterfaceSourceConfig) error {
+	for _, allowed := range v.interfaceSources {
+		if allowed.Type == c.Type && allowed.Source == c.Source {
+			return nil
+		}
+	}
+	return fmt.Errorf("bad %s value: %s interface source %q is not in the list of the interface sources the VMs can use", interfaceSourceKeyName, c.Type, c.Source)
+}
+
+// checkInterfaceSource verifies that the host bridge or interface
+// referenced by the interface source config exists. libvirt
+// networks are checked by libvirt when the domain is started.
+func checkInterfaceSource(c *InterfaceSourceConfig) error {
+	var path string
+	switch c.Type {
+	case interfaceSourceBridge:
+		path = filepath.Join(sysfsNetDir, c.Source, "bridge")
+	case interfaceSourceDirect:
+		path = filepath.Join(sysfsNetDir, c.Source)
+	default:
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			if c.Type == interfaceSourceBridge {
+				return fmt.Errorf("host bridge %q not found", c.Source)
+			}
+			return fmt.Errorf("host interface %q not found", c.Source)
+		}
+		return fmt.Errorf("can't check host interface %q: %v", c.Source, err)
+	}
+	return nil
+}
+
+// addInterfaceSource adds the network interface connected to the
+// source specified by VirtletInterfaceSource annotation to the domain
+func (ds *domainSettings) addInterfaceSource(domain *libvirtxml.Domain, config *VMConfig) {
+	c := config.ParsedAnnotations.InterfaceSource
+	var source libvirtxml.DomainInterfaceSource
+	switch c.Type {
+	case interfaceSourceBridge:
+		source.Bridge = &libvirtxml.DomainInterfaceSourceBridge{Bridge: c.Source}
+	case interfaceSourceDirect:
+		source.Direct = &libvirtxml.DomainInterfaceSourceDirect{Dev: c.Source, Mode: c.Mode}
+	case interfaceSourceNetwork:
+		source.Network = &libvirtxml.DomainInterfaceSourceNetwork{Network: c.Source}
+	}
+	domain.Devices.Interfaces = append(domain.Devices.Interfaces, libvirtxml.DomainInterface{
+		Source: &source,
+		Model:  &libvirtxml.DomainInterfaceModel{Type: "virtio"},
+	})
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestCheckInterfaceSource(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sysfs-net-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	savedSysfsNetDir := sysfsNetDir
+	sysfsNetDir = tmpDir
+	defer func() { sysfsNetDir = savedSysfsNetDir }()
+
+	for _, dir := range []string{"br0/bridge", "eth1"} {
+		if err := os.MkdirAll(filepath.Join(tmpDir, dir), 0755); err != nil {
+			t.Fatalf("MkdirAll(): %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		config InterfaceSourceConfig
+		valid  bool
+	}{
+		{InterfaceSourceConfig{Type: "bridge", Source: "br0"}, true},
+		{InterfaceSourceConfig{Type: "bridge", Source: "eth1"}, false},
+		{InterfaceSourceConfig{Type: "bridge", Source: "br1"}, false},
+		{InterfaceSourceConfig{Type: "direct", Source: "eth1", Mode: "vepa"}, true},
+		{InterfaceSourceConfig{Type: "direct", Source: "eth2"}, false},
+		// libvirt networks are checked by libvirt itself
+		{InterfaceSourceConfig{Type: "network", Source: "default"}, true},
+	} {
+		err := checkInterfaceSource(&tc.config)
+		switch {
+		case tc.valid && err != nil:
+			t.Errorf("checkInterfaceSource(%#v): %v", tc.config, err)
+		case !tc.valid && err == nil:
+			t.Errorf("checkInterfaceSource(%#v) didn't fail", tc.config)
+		}
+	}
+}
+
+func TestParseInterfaceSources(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected []InterfaceSourceConfig
+		valid    bool
+	}{
+		{"", nil, true},
+		{
+			"bridge:br0, direct:eth1,network:default",
+			[]InterfaceSourceConfig{
+				{Type: "bridge", Source: "br0"},
+				{Type: "direct", Source: "eth1"},
+				{Type: "network", Source: "default"},
+			},
+			true,
+		},
+		{"br0", nil, false},
+		{"user:br0", nil, false},
+		{"direct:../eth1", nil, false},
+	} {
+		sources, err := ParseInterfaceSources(tc.value)
+		switch {
+		case tc.valid && err != nil:
+			t.Errorf("ParseInterfaceSources(%q): %v", tc.value, err)
+		case !tc.valid && err == nil:
+			t.Errorf("ParseInterfaceSources(%q) didn't fail", tc.value)
+		case !reflect.DeepEqual(sources, tc.expected):
+			t.Errorf("ParseInterfaceSources(%q): %#v instead of %#v", tc.value, sources, tc.expected)
+		}
+	}
+}
+
+func TestInterfaceSourceNotAllowed(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	for _, ifSource := range []string{
+		"type=bridge,source=br1",
+		"type=direct,source=br0",
+		"type=network,source=other",
+	} {
+		sandbox := criapi.GetSandboxes(1)[0]
+		sandbox.Annotations = map[string]string{"VirtletInterfaceSource": ifSource}
+		ct.setPodSandbox(sandbox)
+		_, err := ct.virtTool.CreateContainer(ct.vmConfig(sandbox, nil), "/tmp/fakenetns")
+		switch {
+		case err == nil:
+			t.Errorf("CreateContainer() didn't fail for interface source %q", ifSource)
+		case !strings.Contains(err.Error(), "is not in the list of the interface sources"):
+			t.Errorf("CreateContainer(): unexpected error for interface source %q: %v", ifSource, err)
+		}
+	}
+}
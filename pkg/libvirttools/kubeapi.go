@@ -18,7 +18,9 @@ package libvirttools
 
 import (
 	"errors"
+	"fmt"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
 	"github.com/Mirantis/virtlet/pkg/network"
@@ -41,6 +43,7 @@ func GetVMConfig(in *kubeapi.CreateContainerRequest, csn *network.ContainerSideN
 		Image:                in.Config.Image.Image,
 		Attempt:              in.Config.Metadata.Attempt,
 		PodAnnotations:       in.SandboxConfig.Annotations,
+		PodLabels:            in.SandboxConfig.Labels,
 		ContainerAnnotations: in.Config.Annotations,
 		ContainerLabels:      in.Config.Labels,
 		ContainerSideNetwork: csn,
@@ -54,6 +57,28 @@ func GetVMConfig(in *kubeapi.CreateContainerRequest, csn *network.ContainerSideN
 		r.CPUQuota = res.CpuQuota
 	}
 
+	if linuxCfg := in.Config.Linux; linuxCfg != nil && linuxCfg.SecurityContext != nil {
+		r.ReadonlyRootfs = linuxCfg.SecurityContext.ReadonlyRootfs
+	}
+
+	if memoryRequestStr, found := in.SandboxConfig.Annotations[memoryRequestKeyName]; found {
+		q, err := resource.ParseQuantity(memoryRequestStr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", memoryRequestKeyName, err)
+		}
+		r.MemoryRequestInBytes = q.Value()
+		if r.MemoryRequestInBytes <= 0 {
+			return nil, fmt.Errorf("bad %s value %q: must be positive", memoryRequestKeyName, memoryRequestStr)
+		}
+		if r.MemoryLimitInBytes > 0 && r.MemoryRequestInBytes > r.MemoryLimitInBytes {
+			return nil, fmt.Errorf("memory request %d exceeds memory limit %d", r.MemoryRequestInBytes, r.MemoryLimitInBytes)
+		}
+	}
+
+	for _, device := range in.Config.Devices {
+		r.HostDevices = append(r.HostDevices, device.HostPath)
+	}
+
 	for _, entry := range in.Config.Envs {
 		r.Environment = append(r.Environment, &VMKeyValue{Key: entry.Key, Value: entry.Value})
 	}
@@ -18,6 +18,8 @@ package libvirttools
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	libvirt "github.com/libvirt/libvirt-go"
@@ -26,6 +28,11 @@ import (
 	"github.com/Mirantis/virtlet/pkg/virt"
 )
 
+const (
+	domainEventReconnectInterval    = 1 * time.Second
+	domainEventMaxReconnectInterval = 1 * time.Minute
+)
+
 type libvirtDomainConnection struct {
 	conn libvirtConnection
 }
@@ -95,6 +102,112 @@ func (dc *libvirtDomainConnection) LookupDomainByUUIDString(uuid string) (virt.D
 	return &libvirtDomain{d.(*libvirt.Domain)}, nil
 }
 
+// WatchDomainEvents subscribes to the domain lifecycle events using a
+// separate libvirt connection. If that connection is closed, e.g.
+// because libvirtd was restarted, it's reopened and the subscription
+// is renewed, retrying with an exponential backoff.
+func (dc *libvirtDomainConnection) WatchDomainEvents(handler func(event virt.DomainEvent)) (func(), error) {
+	sub, err := dc.subscribeDomainEvents(handler)
+	if err != nil {
+		return nil, err
+	}
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for {
+			select {
+			case <-stopCh:
+				sub.close()
+				return
+			case <-sub.closed:
+			}
+			glog.Warning("Libvirt event connection was closed, reconnecting")
+			sub.close()
+			interval := domainEventReconnectInterval
+			for {
+				select {
+				case <-stopCh:
+					return
+				case <-time.After(interval):
+				}
+				if sub, err = dc.subscribeDomainEvents(handler); err == nil {
+					break
+				}
+				glog.Warningf("Error re-subscribing to the domain events: %v", err)
+				if interval *= 2; interval > domainEventMaxReconnectInterval {
+					interval = domainEventMaxReconnectInterval
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stopCh)
+			<-doneCh
+		})
+	}, nil
+}
+
+// domainEventSubscription is the domain lifecycle event callback
+// registered on an event connection. The closed channel is closed
+// when libvirt reports that the connection was closed.
+type domainEventSubscription struct {
+	conn   *libvirt.Connect
+	id     int
+	closed chan struct{}
+}
+
+func (dc *libvirtDomainConnection) subscribeDomainEvents(handler func(event virt.DomainEvent)) (*domainEventSubscription, error) {
+	c, err := dc.conn.newEventConnection()
+	if err != nil {
+		return nil, err
+	}
+	sub := &domainEventSubscription{conn: c, closed: make(chan struct{})}
+	var closeOnce sync.Once
+	if err := c.RegisterCloseCallback(func(_ *libvirt.Connect, reason libvirt.ConnectCloseReason) {
+		glog.V(1).Infof("Libvirt event connection closed, reason: %d", reason)
+		closeOnce.Do(func() { close(sub.closed) })
+	}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	sub.id, err = c.DomainEventLifecycleRegister(nil, func(_ *libvirt.Connect, d *libvirt.Domain, event *libvirt.DomainEventLifecycle) {
+		uuid, err := d.GetUUIDString()
+		if err != nil {
+			glog.Warningf("Can't get the uuid of the domain for a lifecycle event: %v", err)
+			return
+		}
+		eventType := virt.DomainEventOther
+		if event.Event == libvirt.DOMAIN_EVENT_STOPPED && event.Detail == int(libvirt.DOMAIN_EVENT_STOPPED_SHUTDOWN) {
+			eventType = virt.DomainEventGuestShutdown
+		}
+		handler(virt.DomainEvent{DomainUUID: uuid, Type: eventType})
+	})
+	if err != nil {
+		c.UnregisterCloseCallback()
+		c.Close()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// close removes the callbacks and closes the event connection.
+// The errors are only logged because the connection may be
+// already dead at this point.
+func (sub *domainEventSubscription) close() {
+	if err := sub.conn.UnregisterCloseCallback(); err != nil {
+		glog.V(1).Infof("Error unregistering libvirt close callback: %v", err)
+	}
+	if err := sub.conn.DomainEventDeregister(sub.id); err != nil {
+		glog.V(1).Infof("Error deregistering domain lifecycle callback: %v", err)
+	}
+	if _, err := sub.conn.Close(); err != nil {
+		glog.V(1).Infof("Error closing libvirt event connection: %v", err)
+	}
+}
+
 func (dc *libvirtDomainConnection) DefineSecret(def *libvirtxml.Secret) (virt.Secret, error) {
 	xml, err := def.Marshal()
 	if err != nil {
@@ -142,6 +255,44 @@ func (dc *libvirtDomainConnection) LookupSecretByUsageName(usageType string, usa
 	return &libvirtSecret{secret.(*libvirt.Secret)}, nil
 }
 
+func (dc *libvirtDomainConnection) RestoreDomain(path string) error {
+	_, err := dc.conn.invoke(func(c *libvirt.Connect) (interface{}, error) {
+		return nil, c.DomainRestore(path)
+	})
+	return err
+}
+
+func (dc *libvirtDomainConnection) RestoreDomainWithXML(path string, def *libvirtxml.Domain) error {
+	xml, err := def.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = dc.conn.invoke(func(c *libvirt.Connect) (interface{}, error) {
+		return nil, c.DomainRestoreFlags(path, xml, libvirt.DOMAIN_SAVE_RUNNING)
+	})
+	return err
+}
+
+func (dc *libvirtDomainConnection) LibVersion() (uint32, error) {
+	version, err := dc.conn.invoke(func(c *libvirt.Connect) (interface{}, error) {
+		return c.GetLibVersion()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return version.(uint32), nil
+}
+
+func (dc *libvirtDomainConnection) HypervisorVersion() (uint32, error) {
+	version, err := dc.conn.invoke(func(c *libvirt.Connect) (interface{}, error) {
+		return c.GetVersion()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return version.(uint32), nil
+}
+
 type libvirtDomain struct {
 	d *libvirt.Domain
 }
@@ -157,7 +308,9 @@ func (domain *libvirtDomain) Destroy() error {
 }
 
 func (domain *libvirtDomain) Undefine() error {
-	return domain.d.Undefine()
+	// the snapshots are kept inside the volumes of the domain,
+	// so only their metadata needs to be removed
+	return domain.d.UndefineFlags(libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA)
 }
 
 func (domain *libvirtDomain) Shutdown() error {
@@ -191,6 +344,20 @@ func (domain *libvirtDomain) State() (virt.DomainState, error) {
 	}
 }
 
+func (domain *libvirtDomain) StateReason() (virt.DomainStateReason, error) {
+	state, reason, err := domain.d.GetState()
+	if err != nil {
+		return virt.DomainStateReasonUnknown, err
+	}
+	switch {
+	case state == libvirt.DOMAIN_CRASHED && libvirt.DomainCrashedReason(reason) == libvirt.DOMAIN_CRASHED_PANICKED:
+		return virt.DomainStateReasonPanicked, nil
+	case state == libvirt.DOMAIN_PAUSED && libvirt.DomainPausedReason(reason) == libvirt.DOMAIN_PAUSED_SHUTTING_DOWN:
+		return virt.DomainStateReasonShuttingDown, nil
+	}
+	return virt.DomainStateReasonUnknown, nil
+}
+
 func (domain *libvirtDomain) UUIDString() (string, error) {
 	return domain.d.GetUUIDString()
 }
@@ -211,6 +378,214 @@ func (domain *libvirtDomain) XML() (*libvirtxml.Domain, error) {
 	return &d, nil
 }
 
+func (domain *libvirtDomain) UpdateDisk(def *libvirtxml.DomainDisk) error {
+	xml, err := def.Marshal()
+	if err != nil {
+		return err
+	}
+	flags := libvirt.DOMAIN_DEVICE_MODIFY_CONFIG
+	active, err := domain.d.IsActive()
+	if err != nil {
+		return err
+	}
+	if active {
+		flags |= libvirt.DOMAIN_DEVICE_MODIFY_LIVE
+	}
+	return domain.d.UpdateDeviceFlags(xml, flags)
+}
+
+func (domain *libvirtDomain) SetMetadata(namespaceURI, prefix, metadataXML string) error {
+	flags := libvirt.DOMAIN_AFFECT_CONFIG
+	active, err := domain.d.IsActive()
+	if err != nil {
+		return err
+	}
+	if active {
+		flags |= libvirt.DOMAIN_AFFECT_LIVE
+	}
+	return domain.d.SetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, metadataXML, prefix, namespaceURI, flags)
+}
+
+func (domain *libvirtDomain) GuestAgentCommand(command string, timeout time.Duration) (string, error) {
+	seconds := int(timeout / time.Second)
+	if seconds <= 0 {
+		seconds = 1
+	}
+	r, err := domain.d.QemuAgentCommand(command, libvirt.DomainQemuAgentCommandTimeout(seconds), 0)
+	if err != nil {
+		return "", convertGuestAgentError(err)
+	}
+	return r, nil
+}
+
+func (domain *libvirtDomain) ShutdownWithGuestAgent() error {
+	return convertGuestAgentError(domain.d.ShutdownFlags(libvirt.DOMAIN_SHUTDOWN_GUEST_AGENT))
+}
+
+func (domain *libvirtDomain) ShutdownWithInitctl() error {
+	return domain.d.ShutdownFlags(libvirt.DOMAIN_SHUTDOWN_INITCTL)
+}
+
+func (domain *libvirtDomain) ShutdownWithSignal() error {
+	return domain.d.ShutdownFlags(libvirt.DOMAIN_SHUTDOWN_SIGNAL)
+}
+
+func (domain *libvirtDomain) Save(path string) error {
+	return domain.d.Save(path)
+}
+
+func (domain *libvirtDomain) Rename(name string) error {
+	return domain.d.Rename(name, 0)
+}
+
+func (domain *libvirtDomain) SetAutostart(autostart bool) error {
+	return domain.d.SetAutostart(autostart)
+}
+
+func (domain *libvirtDomain) Autostart() (bool, error) {
+	return domain.d.GetAutostart()
+}
+
+func (domain *libvirtDomain) QemuMonitorCommand(command string) (string, error) {
+	return domain.d.QemuMonitorCommand(command, libvirt.DOMAIN_QEMU_MONITOR_COMMAND_DEFAULT)
+}
+
+func (domain *libvirtDomain) BlockStats(disk string) (*virt.BlockStats, error) {
+	bs, err := domain.d.BlockStats(disk)
+	if err != nil {
+		return nil, err
+	}
+	var stats virt.BlockStats
+	// the values that aren't supported by the hypervisor are
+	// left zero
+	if bs.RdReqSet {
+		stats.ReadRequests = uint64(bs.RdReq)
+	}
+	if bs.RdBytesSet {
+		stats.ReadBytes = uint64(bs.RdBytes)
+	}
+	if bs.WrReqSet {
+		stats.WriteRequests = uint64(bs.WrReq)
+	}
+	if bs.WrBytesSet {
+		stats.WriteBytes = uint64(bs.WrBytes)
+	}
+	return &stats, nil
+}
+
+func (domain *libvirtDomain) Stats() (*virt.DomainStats, error) {
+	di, err := domain.d.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	memStats, err := domain.d.MemoryStats(uint32(libvirt.DOMAIN_MEMORY_STAT_NR), 0)
+	if err != nil {
+		return nil, err
+	}
+	stats := &virt.DomainStats{CPUTime: di.CpuTime}
+	// the total stats are returned as a single element. They're
+	// not available e.g. when the cgroup CPU accounting is off,
+	// in which case VCPUTime is left zero
+	cpuStats, err := domain.d.GetCPUStats(-1, 1, 0)
+	switch {
+	case err != nil:
+		glog.V(2).Infof("Can't get the vCPU time of the domain, using its total CPU time: %v", err)
+	case len(cpuStats) != 0 && cpuStats[0].VcpuTimeSet:
+		stats.VCPUTime = cpuStats[0].VcpuTime
+	}
+	for _, ms := range memStats {
+		switch libvirt.DomainMemoryStatTags(ms.Tag) {
+		case libvirt.DOMAIN_MEMORY_STAT_ACTUAL_BALLOON:
+			stats.BalloonMemory = ms.Val
+		case libvirt.DOMAIN_MEMORY_STAT_UNUSED:
+			stats.UnusedMemory = ms.Val
+		case libvirt.DOMAIN_MEMORY_STAT_RSS:
+			stats.RSS = ms.Val
+		}
+	}
+	return stats, nil
+}
+
+func (domain *libvirtDomain) BlockJob(disk string) (*virt.BlockJobInfo, error) {
+	info, err := domain.d.GetBlockJobInfo(disk, 0)
+	if err != nil {
+		return nil, err
+	}
+	// libvirt reports zeroed info if there's no block job
+	if info.Type == 0 && info.End == 0 {
+		return nil, nil
+	}
+	r := &virt.BlockJobInfo{Type: virt.BlockJobTypeUnknown, Cur: info.Cur, End: info.End}
+	switch info.Type {
+	case libvirt.DOMAIN_BLOCK_JOB_TYPE_PULL:
+		r.Type = virt.BlockJobTypePull
+	case libvirt.DOMAIN_BLOCK_JOB_TYPE_COPY:
+		r.Type = virt.BlockJobTypeCopy
+	case libvirt.DOMAIN_BLOCK_JOB_TYPE_COMMIT:
+		r.Type = virt.BlockJobTypeCommit
+	case libvirt.DOMAIN_BLOCK_JOB_TYPE_ACTIVE_COMMIT:
+		r.Type = virt.BlockJobTypeActiveCommit
+	}
+	return r, nil
+}
+
+func (domain *libvirtDomain) AbortBlockJob(disk string) error {
+	return domain.d.BlockJobAbort(disk, 0)
+}
+
+func (domain *libvirtDomain) CreateSnapshot(name, description string) error {
+	def := &libvirtxml.DomainSnapshot{Name: name, Description: description}
+	xml, err := def.Marshal()
+	if err != nil {
+		return err
+	}
+	// the snapshots of the running domains are internal ones by
+	// default, which include the memory of the domain
+	snapshot, err := domain.d.CreateSnapshotXML(xml, 0)
+	if err != nil {
+		return err
+	}
+	return snapshot.Free()
+}
+
+func (domain *libvirtDomain) lookupSnapshot(name string) (*libvirt.DomainSnapshot, error) {
+	snapshot, err := domain.d.SnapshotLookupByName(name, 0)
+	if err != nil {
+		libvirtErr, ok := err.(libvirt.Error)
+		if ok && libvirtErr.Code == libvirt.ERR_NO_DOMAIN_SNAPSHOT {
+			return nil, virt.ErrSnapshotNotFound
+		}
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (domain *libvirtDomain) RevertToSnapshot(name string) error {
+	snapshot, err := domain.lookupSnapshot(name)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Free()
+	return snapshot.RevertToSnapshot(libvirt.DOMAIN_SNAPSHOT_REVERT_RUNNING)
+}
+
+func (domain *libvirtDomain) RemoveSnapshot(name string) error {
+	snapshot, err := domain.lookupSnapshot(name)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Free()
+	return snapshot.Delete(0)
+}
+
+func convertGuestAgentError(err error) error {
+	libvirtErr, ok := err.(libvirt.Error)
+	if ok && (libvirtErr.Code == libvirt.ERR_AGENT_UNRESPONSIVE || libvirtErr.Code == libvirt.ERR_AGENT_UNSYNCED) {
+		return virt.ErrGuestAgentUnresponsive
+	}
+	return err
+}
+
 type libvirtSecret struct {
 	s *libvirt.Secret
 }
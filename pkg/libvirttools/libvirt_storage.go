@@ -18,6 +18,8 @@ package libvirttools
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 
 	"github.com/golang/glog"
 	libvirt "github.com/libvirt/libvirt-go"
@@ -44,7 +46,7 @@ func (sc *libvirtStorageConnection) CreateStoragePool(def *libvirtxml.StoragePoo
 	}
 	glog.V(2).Infof("Creating storage pool:\n%s", xml)
 	p, err := sc.conn.invoke(func(c *libvirt.Connect) (interface{}, error) {
-		return c.StoragePoolCreateXML(xml, 0)
+		return c.StoragePoolCreateXML(xml, storagePoolCreateFlags(def))
 	})
 	if err != nil {
 		return nil, err
@@ -52,6 +54,18 @@ func (sc *libvirtStorageConnection) CreateStoragePool(def *libvirtxml.StoragePoo
 	return &libvirtStoragePool{conn: sc.conn, p: p.(*libvirt.StoragePool)}, nil
 }
 
+// storagePoolCreateFlags returns the flags for creating the storage
+// pool. Only "dir" pools are built, which makes libvirt create the
+// target directory if it doesn't exist. Building a "logical" pool
+// would mean creating the volume group on its devices, while Virtlet
+// expects the volume group to exist already.
+func storagePoolCreateFlags(def *libvirtxml.StoragePool) libvirt.StoragePoolCreateFlags {
+	if def.Type == "dir" {
+		return libvirt.STORAGE_POOL_CREATE_WITH_BUILD
+	}
+	return 0
+}
+
 func (sc *libvirtStorageConnection) LookupStoragePoolByName(name string) (virt.StoragePool, error) {
 	p, err := sc.conn.invoke(func(c *libvirt.Connect) (interface{}, error) {
 		return c.LookupStoragePoolByName(name)
@@ -135,6 +149,60 @@ func (pool *libvirtStoragePool) RemoveVolumeByName(name string) error {
 	}
 }
 
+func (pool *libvirtStoragePool) RenameVolume(name, newName string) (virt.StorageVolume, error) {
+	vol, err := pool.LookupVolumeByName(name)
+	if err != nil {
+		return nil, err
+	}
+	volPath, err := vol.Path()
+	if err != nil {
+		return nil, err
+	}
+	// libvirt can't rename volumes, so the file is renamed
+	// directly and the pool is refreshed afterwards
+	fi, err := os.Stat(volPath)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("can't rename volume %q: %q is not a regular file", name, volPath)
+	}
+	newPath := filepath.Join(filepath.Dir(volPath), newName)
+	if _, err := os.Stat(newPath); err == nil {
+		return nil, fmt.Errorf("can't rename volume %q: %q already exists", name, newPath)
+	}
+	if err := os.Rename(volPath, newPath); err != nil {
+		return nil, fmt.Errorf("error renaming volume file %q: %v", volPath, err)
+	}
+	if err := pool.p.Refresh(0); err != nil {
+		return nil, fmt.Errorf("error refreshing storage pool: %v", err)
+	}
+	return pool.LookupVolumeByName(newName)
+}
+
+func (pool *libvirtStoragePool) IsActive() (bool, error) {
+	return pool.p.IsActive()
+}
+
+func (pool *libvirtStoragePool) Start() error {
+	return pool.p.Create(0)
+}
+
+func (pool *libvirtStoragePool) TargetPath() (string, error) {
+	desc, err := pool.p.GetXMLDesc(0)
+	if err != nil {
+		return "", err
+	}
+	var def libvirtxml.StoragePool
+	if err := def.Unmarshal(desc); err != nil {
+		return "", fmt.Errorf("error unmarshalling storage pool definition: %v", err)
+	}
+	if def.Target == nil {
+		return "", nil
+	}
+	return def.Target.Path, nil
+}
+
 type libvirtStorageVolume struct {
 	name string
 	v    *libvirt.StorageVol
@@ -154,6 +222,14 @@ func (volume *libvirtStorageVolume) Size() (uint64, error) {
 	return info.Capacity, nil
 }
 
+func (volume *libvirtStorageVolume) Allocation() (uint64, error) {
+	info, err := volume.v.GetInfo()
+	if err != nil {
+		return 0, err
+	}
+	return info.Allocation, nil
+}
+
 func (volume *libvirtStorageVolume) Path() (string, error) {
 	return volume.v.GetPath()
 }
@@ -162,6 +238,23 @@ func (volume *libvirtStorageVolume) Remove() error {
 	return volume.v.Delete(0)
 }
 
+var wipeAlgorithms = map[virt.WipeAlgorithm]libvirt.StorageVolWipeAlgorithm{
+	virt.WipeAlgorithmZero:    libvirt.STORAGE_VOL_WIPE_ALG_ZERO,
+	virt.WipeAlgorithmRandom:  libvirt.STORAGE_VOL_WIPE_ALG_RANDOM,
+	virt.WipeAlgorithmNNSA:    libvirt.STORAGE_VOL_WIPE_ALG_NNSA,
+	virt.WipeAlgorithmDoD:     libvirt.STORAGE_VOL_WIPE_ALG_DOD,
+	virt.WipeAlgorithmBSI:     libvirt.STORAGE_VOL_WIPE_ALG_BSI,
+	virt.WipeAlgorithmGutmann: libvirt.STORAGE_VOL_WIPE_ALG_GUTMANN,
+}
+
+func (volume *libvirtStorageVolume) Wipe(algorithm virt.WipeAlgorithm) error {
+	alg, found := wipeAlgorithms[algorithm]
+	if !found {
+		return fmt.Errorf("unsupported wipe algorithm %q", algorithm)
+	}
+	return volume.v.WipePattern(alg, 0)
+}
+
 func (volume *libvirtStorageVolume) Format() error {
 	volPath, err := volume.Path()
 	if err != nil {
@@ -0,0 +1,123 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// monitorQMPCommands lists the read-only QMP commands that can be
+// executed using MonitorCommand
+var monitorQMPCommands = map[string]bool{
+	"query-status":     true,
+	"query-blockstats": true,
+}
+
+// monitorHMPCommands lists the read-only HMP commands that can be
+// executed using MonitorCommand
+var monitorHMPCommands = map[string]bool{
+	"info registers": true,
+}
+
+// monitorCommandJSON returns the QMP command to execute for the
+// specified allow-listed QMP or HMP command. The HMP commands are
+// passed via QMP human-monitor-command.
+func monitorCommandJSON(command string) (string, error) {
+	command = strings.Join(strings.Fields(command), " ")
+	var cmd map[string]interface{}
+	switch {
+	case monitorQMPCommands[command]:
+		cmd = map[string]interface{}{"execute": command}
+	case monitorHMPCommands[command]:
+		cmd = map[string]interface{}{
+			"execute":   "human-monitor-command",
+			"arguments": map[string]interface{}{"command-line": command},
+		}
+	default:
+		return "", fmt.Errorf("monitor command %q is not allowed", command)
+	}
+	r, err := json.Marshal(cmd)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling monitor command: %v", err)
+	}
+	return string(r), nil
+}
+
+// lookupRunningDomain returns the domain of the specified container
+// making sure it's running
+func (v *VirtualizationTool) lookupRunningDomain(containerID string) (virt.Domain, error) {
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up domain %q: %v", containerID, err)
+	}
+	state, err := domain.State()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state of the domain %q: %v", containerID, err)
+	}
+	if state != virt.DomainStateRunning {
+		return nil, fmt.Errorf("domain %q is not running", containerID)
+	}
+	return domain, nil
+}
+
+// DomainActive returns true if the VM of the specified container
+// hasn't stopped. The VMs that are paused, e.g. while being rebooted,
+// are considered active.
+func (v *VirtualizationTool) DomainActive(containerID string) (bool, error) {
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerID)
+	switch {
+	case err == virt.ErrDomainNotFound:
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("failed to look up domain %q: %v", containerID, err)
+	}
+	state, err := domain.State()
+	if err != nil {
+		return false, fmt.Errorf("failed to get state of the domain %q: %v", containerID, err)
+	}
+	return state != virt.DomainStateShutoff && state != virt.DomainStateCrashed, nil
+}
+
+// MonitorCommand executes a read-only QEMU monitor command for the
+// running VM of the specified container for diagnostic purposes and
+// returns its JSON result. Only query-status and query-blockstats
+// QMP commands and "info registers" HMP command are allowed, so the
+// state of the VM can't be changed this way.
+func (v *VirtualizationTool) MonitorCommand(containerID, command string) (string, error) {
+	qmpCommand, err := monitorCommandJSON(command)
+	if err != nil {
+		return "", err
+	}
+
+	domain, err := v.lookupRunningDomain(containerID)
+	if err != nil {
+		return "", err
+	}
+
+	glog.V(2).Infof("Executing monitor command %s for domain %q", qmpCommand, containerID)
+	r, err := domain.QemuMonitorCommand(qmpCommand)
+	if err != nil {
+		return "", fmt.Errorf("monitor command %q failed for domain %q: %v", command, containerID, err)
+	}
+	return r, nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func (ct *containerTester) startMonitorTestContainer() string {
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	ct.startContainer(containerID)
+	return containerID
+}
+
+func TestMonitorCommand(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	containerID := ct.startMonitorTestContainer()
+
+	for _, tc := range []struct {
+		command  string
+		expected interface{}
+	}{
+		{
+			command: "query-status",
+			expected: map[string]interface{}{
+				"running":    true,
+				"singlestep": false,
+				"status":     "running",
+			},
+		},
+		{
+			command:  "info  registers",
+			expected: "fake output of info registers",
+		},
+	} {
+		r, err := ct.virtTool.MonitorCommand(containerID, tc.command)
+		if err != nil {
+			t.Errorf("MonitorCommand(%q): %v", tc.command, err)
+			continue
+		}
+		var resp struct {
+			Return interface{} `json:"return"`
+		}
+		if err := json.Unmarshal([]byte(r), &resp); err != nil {
+			t.Errorf("MonitorCommand(%q) returned bad JSON %q: %v", tc.command, r, err)
+			continue
+		}
+		if !reflect.DeepEqual(resp.Return, tc.expected) {
+			t.Errorf("MonitorCommand(%q): bad result %#v instead of %#v", tc.command, resp.Return, tc.expected)
+		}
+	}
+}
+
+func TestDisallowedMonitorCommand(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	containerID := ct.startMonitorTestContainer()
+
+	start := len(ct.rec.Content())
+	for _, command := range []string{"stop", "system_reset", "quit", "info registers; quit"} {
+		if _, err := ct.virtTool.MonitorCommand(containerID, command); err == nil {
+			t.Errorf("MonitorCommand(%q) didn't fail", command)
+		}
+	}
+	if calls := ct.domainCalls(start); len(calls) != 0 {
+		t.Errorf("unexpected domain calls for disallowed monitor commands: %v", calls)
+	}
+	ct.verifyDomainState(containerID, virt.DomainStateRunning)
+}
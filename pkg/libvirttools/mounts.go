@@ -0,0 +1,129 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+)
+
+// MissingMountPolicy specifies what CreateContainer does when the
+// host path of a container mount doesn't exist, e.g. because the
+// flexvolume or CSI volume isn't staged yet
+type MissingMountPolicy string
+
+const (
+	// MissingMountFail makes CreateContainer fail with a
+	// VolumeNotReadyError, so kubelet retries it later
+	MissingMountFail MissingMountPolicy = "fail"
+	// MissingMountSkip makes CreateContainer skip the mount
+	// logging a warning
+	MissingMountSkip MissingMountPolicy = "skip"
+)
+
+// VolumeNotReadyError is returned when the host path of a mount or
+// a block device used by a VM doesn't exist or can't be used yet.
+// Retrying the operation later may help.
+type VolumeNotReadyError struct {
+	// Path is the host path of the mount or the block device
+	Path string
+	// Err is the original error
+	Err error
+}
+
+func (e *VolumeNotReadyError) Error() string {
+	return fmt.Sprintf("volume not ready: %q: %v", e.Path, e.Err)
+}
+
+// IsVolumeNotReady returns true if the error means that a volume
+// used by the VM isn't ready yet
+func IsVolumeNotReady(err error) bool {
+	_, ok := err.(*VolumeNotReadyError)
+	return ok
+}
+
+// BadMountError is returned when a mount or a block device can't be
+// used by a VM because of its malformed spec. Retrying the operation
+// will not help.
+type BadMountError struct {
+	// HostPath is the host path of the mount or the block device
+	HostPath string
+	// ContainerPath is the path of the mount inside the VM. It's
+	// empty for the block devices.
+	ContainerPath string
+	// Reason describes the problem
+	Reason string
+}
+
+func (e *BadMountError) Error() string {
+	if e.ContainerPath == "" {
+		return fmt.Sprintf("bad mount %q: %s", e.HostPath, e.Reason)
+	}
+	return fmt.Sprintf("bad mount %q -> %q: %s", e.HostPath, e.ContainerPath, e.Reason)
+}
+
+// IsBadMount returns true if the error means that the spec of a
+// mount or a block device is malformed
+func IsBadMount(err error) bool {
+	_, ok := err.(*BadMountError)
+	return ok
+}
+
+// SetMissingMountPolicy sets what CreateContainer does when the
+// host path of a container mount doesn't exist. Empty value means
+// MissingMountFail.
+func (v *VirtualizationTool) SetMissingMountPolicy(policy MissingMountPolicy) error {
+	switch policy {
+	case "":
+		policy = MissingMountFail
+	case MissingMountFail, MissingMountSkip:
+	default:
+		return fmt.Errorf("bad missing mount policy %q", policy)
+	}
+	v.missingMounts = policy
+	return nil
+}
+
+// checkMounts verifies the mounts of the container, returning
+// BadMountError for a malformed mount and handling the mounts whose
+// host paths don't exist according to the missing mount policy
+func (v *VirtualizationTool) checkMounts(config *VMConfig) error {
+	var mounts []*VMMount
+	for _, m := range config.Mounts {
+		switch {
+		case m.HostPath == "":
+			return &BadMountError{ContainerPath: m.ContainerPath, Reason: "empty host path"}
+		case !filepath.IsAbs(m.HostPath):
+			return &BadMountError{HostPath: m.HostPath, ContainerPath: m.ContainerPath, Reason: "host path is not absolute"}
+		case m.ContainerPath != "" && !filepath.IsAbs(m.ContainerPath):
+			return &BadMountError{HostPath: m.HostPath, ContainerPath: m.ContainerPath, Reason: "container path is not absolute"}
+		}
+		if _, err := os.Stat(m.HostPath); err != nil {
+			if !os.IsNotExist(err) || v.missingMounts != MissingMountSkip {
+				return &VolumeNotReadyError{Path: m.HostPath, Err: err}
+			}
+			glog.Warningf("Skipping mount %q -> %q of container %q in pod %s/%s: the host path doesn't exist", m.HostPath, m.ContainerPath, config.Name, config.PodNamespace, config.PodName)
+			continue
+		}
+		mounts = append(mounts, m)
+	}
+	config.Mounts = mounts
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestContainerMountChecks(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		policy           MissingMountPolicy
+		hostPath         string
+		containerPath    string
+		missing          bool
+		expectNotReady   bool
+		expectBadMount   bool
+		expectedMountNum int
+	}{
+		{
+			name:             "existing host path",
+			hostPath:         "vol",
+			containerPath:    "/data",
+			expectedMountNum: 1,
+		},
+		{
+			name:           "missing host path",
+			hostPath:       "vol",
+			containerPath:  "/data",
+			missing:        true,
+			expectNotReady: true,
+		},
+		{
+			name:             "missing host path with skip policy",
+			policy:           MissingMountSkip,
+			hostPath:         "vol",
+			containerPath:    "/data",
+			missing:          true,
+			expectedMountNum: 0,
+		},
+		{
+			name:           "empty host path",
+			containerPath:  "/data",
+			expectBadMount: true,
+		},
+		{
+			name:           "relative container path",
+			policy:         MissingMountSkip,
+			hostPath:       "vol",
+			containerPath:  "data",
+			missing:        true,
+			expectBadMount: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newContainerTester(t, testutils.NewToplevelRecorder())
+			defer ct.teardown()
+			if tc.policy != "" {
+				if err := ct.virtTool.SetMissingMountPolicy(tc.policy); err != nil {
+					t.Fatalf("SetMissingMountPolicy(): %v", err)
+				}
+			}
+
+			hostPath := tc.hostPath
+			if hostPath != "" {
+				hostPath = filepath.Join(ct.tmpDir, hostPath)
+				if !tc.missing {
+					if err := os.MkdirAll(hostPath, 0755); err != nil {
+						t.Fatalf("MkdirAll(): %v", err)
+					}
+				}
+			}
+			sandbox := criapi.GetSandboxes(1)[0]
+			ct.setPodSandbox(sandbox)
+			config := ct.vmConfig(sandbox, []*kubeapi.Mount{
+				{HostPath: hostPath, ContainerPath: tc.containerPath},
+			})
+			_, err := ct.virtTool.CreateContainer(config, "/tmp/fakenetns")
+			switch {
+			case tc.expectNotReady:
+				if !IsVolumeNotReady(err) {
+					t.Errorf("CreateContainer() didn't return VolumeNotReadyError, the error is: %v", err)
+				}
+			case tc.expectBadMount:
+				if !IsBadMount(err) {
+					t.Errorf("CreateContainer() didn't return BadMountError, the error is: %v", err)
+				}
+			case err != nil:
+				t.Errorf("CreateContainer(): %v", err)
+			case len(config.Mounts) != tc.expectedMountNum:
+				t.Errorf("bad number of mounts: %d instead of %d", len(config.Mounts), tc.expectedMountNum)
+			}
+		})
+	}
+}
+
+func TestBlockDeviceReadiness(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("block devices are only checked on Linux")
+	}
+	err := verifyRawDeviceAccess("/dev/nonexistent-virtlet-test-device")
+	if !IsVolumeNotReady(err) {
+		t.Errorf("verifyRawDeviceAccess() didn't return VolumeNotReadyError for a missing device, the error is: %v", err)
+	}
+	if err := verifyRawDeviceAccess(os.TempDir()); !IsBadMount(err) {
+		t.Errorf("verifyRawDeviceAccess() didn't return BadMountError for a directory, the error is: %v", err)
+	}
+}
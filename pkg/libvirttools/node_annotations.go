@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// SetNodeDefaultAnnotations sets the Virtlet annotations that are
+// applied to all the VMs on the node unless the pod specifies the
+// same annotations itself, e.g. VirtletGuestAgent: "true".
+// Only Virtlet annotations (the ones that start with "Virtlet")
+// may be specified.
+func (v *VirtualizationTool) SetNodeDefaultAnnotations(annotations map[string]string) error {
+	for k := range annotations {
+		if !strings.HasPrefix(k, virtletAnnotationPrefix) {
+			return fmt.Errorf("bad node default annotation %q: only Virtlet annotations can be specified", k)
+		}
+	}
+	if _, err := LoadAnnotations("", annotations); err != nil {
+		return fmt.Errorf("bad node default annotations: %v", err)
+	}
+	v.nodeAnnotations = make(map[string]string)
+	for k, val := range annotations {
+		v.nodeAnnotations[k] = val
+	}
+	return nil
+}
+
+// withNodeAnnotations returns the pod annotations with the node
+// default annotations added for the keys that aren't set by the pod.
+// The original map is not modified.
+func (v *VirtualizationTool) withNodeAnnotations(podAnnotations map[string]string) map[string]string {
+	if len(v.nodeAnnotations) == 0 {
+		return podAnnotations
+	}
+	r := make(map[string]string)
+	for k, val := range v.nodeAnnotations {
+		r[k] = val
+	}
+	for k, val := range podAnnotations {
+		r[k] = val
+	}
+	return r
+}
+
+// logEffectiveAnnotations logs the Virtlet annotations used for
+// the VM. As the pod annotations may contain sensitive data, only
+// the values of the node default annotations are logged.
+func (v *VirtualizationTool) logEffectiveAnnotations(config *VMConfig) {
+	var items []string
+	for k, val := range config.PodAnnotations {
+		if !strings.HasPrefix(k, virtletAnnotationPrefix) {
+			continue
+		}
+		if nodeVal, found := v.nodeAnnotations[k]; found && nodeVal == val {
+			items = append(items, fmt.Sprintf("%s=%q (node default)", k, val))
+		} else {
+			items = append(items, k)
+		}
+	}
+	sort.Strings(items)
+	glog.Infof("Effective Virtlet annotations for pod %s/%s: %s", config.PodNamespace, config.PodName, strings.Join(items, ", "))
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"testing"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestNodeDefaultAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		annotations    map[string]string
+		expectedVCPUs  int
+		expectedDriver string
+	}{
+		{
+			name:           "node defaults applied",
+			expectedVCPUs:  2,
+			expectedDriver: "virtio",
+		},
+		{
+			name:           "node default overridden by the pod",
+			annotations:    map[string]string{"VirtletVCPUCount": "4"},
+			expectedVCPUs:  4,
+			expectedDriver: "virtio",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newContainerTester(t, testutils.NewToplevelRecorder())
+			defer ct.teardown()
+			nodeAnnotations := map[string]string{
+				"VirtletVCPUCount":  "2",
+				"VirtletDiskDriver": "virtio",
+			}
+			if err := ct.virtTool.SetNodeDefaultAnnotations(nodeAnnotations); err != nil {
+				t.Fatalf("SetNodeDefaultAnnotations(): %v", err)
+			}
+
+			sandbox := criapi.GetSandboxes(1)[0]
+			sandbox.Annotations = tc.annotations
+			ct.setPodSandbox(sandbox)
+			containerID := ct.createContainer(sandbox, nil)
+
+			domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+			if err != nil {
+				t.Fatalf("LookupDomainByUUIDString(): %v", err)
+			}
+			def, err := domain.XML()
+			if err != nil {
+				t.Fatalf("XML(): %v", err)
+			}
+			if def.VCPU == nil || def.VCPU.Value != tc.expectedVCPUs {
+				t.Errorf("bad vcpu definition %#v, expected %d vcpus", def.VCPU, tc.expectedVCPUs)
+			}
+			if bus := def.Devices.Disks[0].Target.Bus; bus != tc.expectedDriver {
+				t.Errorf("bad root disk bus %q instead of %q", bus, tc.expectedDriver)
+			}
+			// the pod annotations aren't modified
+			if _, found := sandbox.Annotations["VirtletDiskDriver"]; found {
+				t.Errorf("node default annotation was added to the pod annotations")
+			}
+
+			// the node defaults are also used for the VMs
+			// whose configs are restored from the metadata
+			config, _, err := ct.virtTool.getVMConfigFromMetadata(containerID)
+			if err != nil {
+				t.Fatalf("getVMConfigFromMetadata(): %v", err)
+			}
+			if config.ParsedAnnotations.VCPUCount != tc.expectedVCPUs || config.ParsedAnnotations.DiskDriver != diskDriverName(tc.expectedDriver) {
+				t.Errorf("bad annotations restored from the metadata: %#v", config.ParsedAnnotations)
+			}
+		})
+	}
+}
+
+func TestBadNodeDefaultAnnotations(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	for _, annotations := range []map[string]string{
+		{"foo": "bar"},
+		{"VirtletVCPUCount": "many"},
+	} {
+		if err := ct.virtTool.SetNodeDefaultAnnotations(annotations); err == nil {
+			t.Errorf("SetNodeDefaultAnnotations() didn't fail for %#v", annotations)
+		}
+	}
+}
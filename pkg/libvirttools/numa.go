@@ -0,0 +1,178 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const sysfsNodeDir = "/sys/devices/system/node"
+
+// numaNodeInfo describes a NUMA node of the host
+type numaNodeInfo struct {
+	// CPUs is the list of the node's CPUs in cpulist format,
+	// e.g. "0-3,8-11"
+	CPUs string
+	// FreeMemory is the amount of free memory of the node in bytes
+	FreeMemory uint64
+}
+
+// getNUMANodeInfo retrieves the information about the specified
+// host NUMA node from sysfs
+func getNUMANodeInfo(node int) (*numaNodeInfo, error) {
+	nodeDir := filepath.Join(sysfsNodeDir, fmt.Sprintf("node%d", node))
+	cpuList, err := ioutil.ReadFile(filepath.Join(nodeDir, "cpulist"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("host NUMA node %d not found", node)
+		}
+		return nil, fmt.Errorf("can't get the CPUs of host NUMA node %d: %v", node, err)
+	}
+
+	f, err := os.Open(filepath.Join(nodeDir, "meminfo"))
+	if err != nil {
+		return nil, fmt.Errorf("can't get memory info of host NUMA node %d: %v", node, err)
+	}
+	defer f.Close()
+	freeMemory, err := parseNodeFreeMemory(bufio.NewScanner(f))
+	if err != nil {
+		return nil, fmt.Errorf("can't get free memory of host NUMA node %d: %v", node, err)
+	}
+
+	return &numaNodeInfo{
+		CPUs:       strings.TrimSpace(string(cpuList)),
+		FreeMemory: freeMemory,
+	}, nil
+}
+
+// parseNodeFreeMemory finds 'Node N MemFree: NNN kB' line in
+// the contents of a NUMA node's meminfo file
+func parseNodeFreeMemory(scanner *bufio.Scanner) (uint64, error) {
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 5 || fields[0] != "Node" || fields[2] != "MemFree:" || fields[4] != "kB" {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[3], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad MemFree value %q", fields[3])
+		}
+		return v * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("MemFree not found")
+}
+
+// cpuListSize returns the number of CPUs in a list in cpulist
+// format, e.g. "0-3,8-11"
+func cpuListSize(cpuList string) (int, error) {
+	n := 0
+	for _, item := range strings.Split(cpuList, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "-", 2)
+		first, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return 0, fmt.Errorf("bad cpu list %q", cpuList)
+		}
+		last := first
+		if len(parts) == 2 {
+			if last, err = strconv.Atoi(parts[1]); err != nil || last < first {
+				return 0, fmt.Errorf("bad cpu list %q", cpuList)
+			}
+		}
+		n += last - first + 1
+	}
+	return n, nil
+}
+
+// parseCPUList parses a list of CPUs in cpulist format, e.g.
+// "0-3,8-11", and returns the set of the CPUs
+func parseCPUList(cpuList string) (map[int]bool, error) {
+	cpus := make(map[int]bool)
+	for _, item := range strings.Split(cpuList, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "-", 2)
+		first, err := strconv.Atoi(parts[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("bad cpu list %q", cpuList)
+		}
+		last := first
+		if len(parts) == 2 {
+			if last, err = strconv.Atoi(parts[1]); err != nil || last < first {
+				return nil, fmt.Errorf("bad cpu list %q", cpuList)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus[cpu] = true
+		}
+	}
+	if len(cpus) == 0 {
+		return nil, fmt.Errorf("empty cpu list %q", cpuList)
+	}
+	return cpus, nil
+}
+
+// bindToNUMANode verifies that the host NUMA node requested for the
+// VM has enough CPUs and free memory and makes the domain settings
+// use the CPUs of that node
+func (v *VirtualizationTool) bindToNUMANode(settings *domainSettings, node int) error {
+	info, err := v.numaInfoGetter(node)
+	if err != nil {
+		return err
+	}
+	cpuCount, err := cpuListSize(info.CPUs)
+	if err != nil {
+		return fmt.Errorf("can't get the CPUs of host NUMA node %d: %v", node, err)
+	}
+	if cpuCount < settings.vcpuNum {
+		return fmt.Errorf("host NUMA node %d has only %d CPUs, while %d vCPUs are requested", node, cpuCount, settings.vcpuNum)
+	}
+	if memory := settings.memoryInBytes(); info.FreeMemory < memory {
+		return fmt.Errorf("host NUMA node %d has only %d bytes of free memory, while %d bytes are requested", node, info.FreeMemory, memory)
+	}
+	settings.numaNodeCPUs = info.CPUs
+	return nil
+}
+
+// addNUMANodeBinding restricts the domain's vCPUs and memory to the
+// host NUMA node requested for the VM
+func (ds *domainSettings) addNUMANodeBinding(domain *libvirtxml.Domain, config *VMConfig) {
+	domain.VCPU.Placement = "static"
+	domain.VCPU.CPUSet = ds.numaNodeCPUs
+	domain.NUMATune = &libvirtxml.DomainNUMATune{
+		Memory: &libvirtxml.DomainNUMATuneMemory{
+			Mode:    "strict",
+			Nodeset: strconv.Itoa(*config.ParsedAnnotations.NUMANode),
+		},
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+// fakeNUMANodeInfo describes a fake host with two NUMA nodes
+func fakeNUMANodeInfo(node int) (*numaNodeInfo, error) {
+	switch node {
+	case 0:
+		return &numaNodeInfo{CPUs: "0-3", FreeMemory: 512 << 20}, nil
+	case 1:
+		return &numaNodeInfo{CPUs: "4-7", FreeMemory: 8 << 30}, nil
+	default:
+		return nil, fmt.Errorf("host NUMA node %d not found", node)
+	}
+}
+
+func TestParseNodeFreeMemory(t *testing.T) {
+	meminfo := `Node 1 MemTotal:       16337212 kB
+Node 1 MemFree:         8228576 kB
+Node 1 MemUsed:         8108636 kB
+`
+	freeMemory, err := parseNodeFreeMemory(bufio.NewScanner(strings.NewReader(meminfo)))
+	if err != nil {
+		t.Fatalf("parseNodeFreeMemory(): %v", err)
+	}
+	if freeMemory != 8228576*1024 {
+		t.Errorf("bad free memory: %d", freeMemory)
+	}
+
+	if _, err := parseNodeFreeMemory(bufio.NewScanner(strings.NewReader("Node 1 MemTotal: 16337212 kB\n"))); err == nil {
+		t.Errorf("parseNodeFreeMemory() didn't fail for meminfo without MemFree")
+	}
+}
+
+func TestCPUListSize(t *testing.T) {
+	for _, tc := range []struct {
+		cpuList string
+		size    int
+		error   bool
+	}{
+		{cpuList: "0", size: 1},
+		{cpuList: "0-3", size: 4},
+		{cpuList: "0-3,8-11,16", size: 9},
+		{cpuList: "3-0", error: true},
+		{cpuList: "a-b", error: true},
+	} {
+		size, err := cpuListSize(tc.cpuList)
+		switch {
+		case tc.error && err == nil:
+			t.Errorf("cpuListSize(%q) didn't fail", tc.cpuList)
+		case !tc.error && err != nil:
+			t.Errorf("cpuListSize(%q): %v", tc.cpuList, err)
+		case size != tc.size:
+			t.Errorf("cpuListSize(%q) = %d instead of %d", tc.cpuList, size, tc.size)
+		}
+	}
+}
+
+func TestNUMANodeResourceChecks(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+	}{
+		{
+			name:        "nonexistent node",
+			annotations: map[string]string{"VirtletNUMANode": "2"},
+		},
+		{
+			name: "not enough cpus",
+			annotations: map[string]string{
+				"VirtletNUMANode":  "1",
+				"VirtletVCPUCount": "8",
+			},
+		},
+		{
+			// the default VM memory size is 1 GiB
+			name:        "not enough memory",
+			annotations: map[string]string{"VirtletNUMANode": "0"},
+		},
+		{
+			name: "emulator pin overlapping vcpus",
+			annotations: map[string]string{
+				"VirtletNUMANode":        "1",
+				"VirtletEmulatorPin":     "2-4",
+				"VirtletIsolateEmulator": "true",
+			},
+		},
+		{
+			name: "emulator isolation without vcpu pinning",
+			annotations: map[string]string{
+				"VirtletEmulatorPin":     "0",
+				"VirtletIsolateEmulator": "true",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newContainerTester(t, testutils.NewToplevelRecorder())
+			defer ct.teardown()
+
+			sandbox := criapi.GetSandboxes(1)[0]
+			sandbox.Annotations = tc.annotations
+			ct.setPodSandbox(sandbox)
+			if _, err := ct.virtTool.CreateContainer(ct.vmConfig(sandbox, nil), "/tmp/fakenetns"); err == nil {
+				t.Errorf("CreateContainer() didn't fail")
+			}
+			if domains, err := ct.domainConn.ListDomains(); err != nil {
+				t.Errorf("ListDomains(): %v", err)
+			} else if len(domains) != 0 {
+				t.Errorf("unexpected domains after CreateContainer() failure: %d", len(domains))
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// nvdimmAlignment is the alignment required for the size
+	// of NVDIMM devices (the size of a huge page on x86_64)
+	nvdimmAlignment = 2 * 1024 * 1024
+)
+
+// nvdimmDir is the directory which contains the backing files
+// of the NVDIMM devices that don't have an explicit path specified
+var nvdimmDir = "/var/lib/virtlet/nvdimm"
+
+// NVDIMMConfig describes the emulated NVDIMM (persistent memory)
+// device of the VM
+type NVDIMMConfig struct {
+	// Size is the size of the device in bytes
+	Size uint64
+	// Path is the backing file or block device. Empty value means
+	// using a file in Virtlet's NVDIMM directory which is removed
+	// together with the VM.
+	Path string
+}
+
+// parseNVDIMMConfig parses NVDIMM configuration in the form of
+// size=<quantity>[,path=<file or block device>]
+func parseNVDIMMConfig(s string) (*NVDIMMConfig, error) {
+	var config NVDIMMConfig
+	sizeFound := false
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad NVDIMM option %q", item)
+		}
+		switch parts[0] {
+		case "size":
+			q, err := resource.ParseQuantity(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("bad NVDIMM size %q: %v", parts[1], err)
+			}
+			if q.Sign() <= 0 {
+				return nil, fmt.Errorf("bad NVDIMM size %q: must be positive", parts[1])
+			}
+			config.Size = uint64(q.Value())
+			sizeFound = true
+		case "path":
+			config.Path = parts[1]
+		default:
+			return nil, fmt.Errorf("unknown NVDIMM option %q", parts[0])
+		}
+	}
+	if !sizeFound {
+		return nil, errors.New("NVDIMM size must be specified")
+	}
+	return &config, nil
+}
+
+func (c *NVDIMMConfig) validate() error {
+	if c.Size%nvdimmAlignment != 0 {
+		return fmt.Errorf("NVDIMM size %d is not a multiple of %d bytes", c.Size, nvdimmAlignment)
+	}
+	if c.Path != "" && !filepath.IsAbs(c.Path) {
+		return fmt.Errorf("NVDIMM path %q is not absolute", c.Path)
+	}
+	return nil
+}
+
+// nvdimmPath returns the path to the backing file or device of
+// the NVDIMM of the VM
+func nvdimmPath(config *VMConfig) string {
+	if path := config.ParsedAnnotations.NVDIMM.Path; path != "" {
+		return path
+	}
+	return filepath.Join(nvdimmDir, config.DomainUUID+".nvdimm")
+}
+
+// checkNVDIMMSupport verifies that the NVDIMM device with the
+// specified backing path can be used on this node
+func checkNVDIMMSupport(path string) error {
+	if runtime.GOARCH != "amd64" {
+		return fmt.Errorf("NVDIMM devices aren't supported on %s", runtime.GOARCH)
+	}
+	fi, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		// the hypervisor creates the backing file
+		// if it doesn't exist
+		dir := filepath.Dir(path)
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("can't create NVDIMM backing file %q: %q is not a directory", path, dir)
+		}
+		return nil
+	case err != nil:
+		return fmt.Errorf("can't use NVDIMM backing file %q: %v", path, err)
+	case fi.Mode().IsRegular():
+		return nil
+	case fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0:
+		return nil
+	default:
+		return fmt.Errorf("NVDIMM backing path %q is neither a regular file nor a block device", path)
+	}
+}
+
+// addNVDIMM adds the NVDIMM device to the domain definition.
+// The device requires the domain to have a NUMA cell with all
+// the vCPUs and the boot memory, and <maxMemory> that has room
+// for the device.
+func (ds *domainSettings) addNVDIMM(domain *libvirtxml.Domain, config *VMConfig) {
+	nvdimm := config.ParsedAnnotations.NVDIMM
+	memoryBytes := ds.memoryInBytes()
+	domain.MaximumMemory = &libvirtxml.DomainMaxMemory{
+		Value: uint(memoryBytes + nvdimm.Size),
+		Unit:  "b",
+		Slots: 1,
+	}
+
+	cellID := uint(0)
+	cpus := "0"
+	if ds.vcpuNum > 1 {
+		cpus = fmt.Sprintf("0-%d", ds.vcpuNum-1)
+	}
+	domain.CPU = &libvirtxml.DomainCPU{
+		Numa: &libvirtxml.DomainNuma{
+			Cell: []libvirtxml.DomainCell{
+				{
+					ID:     &cellID,
+					CPUs:   cpus,
+					Memory: fmt.Sprint(memoryBytes),
+					Unit:   "b",
+				},
+			},
+		},
+	}
+
+	domain.Devices.Memorydevs = append(domain.Devices.Memorydevs, libvirtxml.DomainMemorydev{
+		Model:  "nvdimm",
+		Access: "shared",
+		Source: &libvirtxml.DomainMemorydevSource{Path: nvdimmPath(config)},
+		Target: &libvirtxml.DomainMemorydevTarget{
+			Size: &libvirtxml.DomainMemorydevTargetSize{Value: uint(nvdimm.Size), Unit: "b"},
+			Node: &libvirtxml.DomainMemorydevTargetNode{Value: 0},
+		},
+	})
+}
+
+// removeNVDIMMFile removes the backing file of the VM's NVDIMM
+// if it was created in Virtlet's NVDIMM directory. Explicitly
+// specified backing files and devices are left intact.
+func removeNVDIMMFile(config *VMConfig) error {
+	if nvdimm := config.ParsedAnnotations.NVDIMM; nvdimm == nil || nvdimm.Path != "" {
+		return nil
+	}
+	path := nvdimmPath(config)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove NVDIMM backing file %q: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestNVDIMMFileRemoval(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	savedNVDIMMDir := nvdimmDir
+	nvdimmDir = filepath.Join(ct.tmpDir, "nvdimm")
+	defer func() { nvdimmDir = savedNVDIMMDir }()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	sandbox.Annotations = map[string]string{"VirtletNVDIMM": "size=64Mi"}
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+
+	// the backing file is normally created by the hypervisor
+	backingFile := filepath.Join(nvdimmDir, containerID+".nvdimm")
+	if err := ioutil.WriteFile(backingFile, []byte("pmem"), 0600); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+
+	ct.removeContainer(containerID)
+	if _, err := os.Stat(backingFile); !os.IsNotExist(err) {
+		t.Errorf("NVDIMM backing file %q was not removed (stat error: %v)", backingFile, err)
+	}
+}
+
+func TestNVDIMMDeviceLeftIntact(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	backingFile := filepath.Join(ct.tmpDir, "pmem0")
+	if err := ioutil.WriteFile(backingFile, []byte("pmem"), 0600); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	sandbox.Annotations = map[string]string{"VirtletNVDIMM": "size=64Mi,path=" + backingFile}
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	ct.removeContainer(containerID)
+	if _, err := os.Stat(backingFile); err != nil {
+		t.Errorf("explicitly specified NVDIMM backing file %q was removed (stat error: %v)", backingFile, err)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"sync"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// PCIDeviceConflictError is returned when a VM needs a host PCI
+// device, e.g. a GPU, which is already passed through to another VM
+type PCIDeviceConflictError struct {
+	// Address is the PCI address of the device, e.g. 0000:01:00.0
+	Address string
+	// ContainerID is the id of the container that uses the device
+	ContainerID string
+}
+
+func (e *PCIDeviceConflictError) Error() string {
+	return fmt.Sprintf("PCI device conflict: %q is already in use by container %q", e.Address, e.ContainerID)
+}
+
+// IsPCIDeviceConflict returns true if the error means that a host
+// PCI device needed by the VM is used by another VM
+func IsPCIDeviceConflict(err error) bool {
+	_, ok := err.(*PCIDeviceConflictError)
+	return ok
+}
+
+// pciDeviceRegistry keeps track of the host PCI devices passed
+// through to the VMs on the node. Same as volumeClaimRegistry,
+// it's rebuilt from the domain definitions, so it survives
+// Virtlet restarts. The devices remain claimed while the domain
+// is defined, even if the VM isn't running.
+type pciDeviceRegistry struct {
+	sync.Mutex
+	// owners maps the PCI addresses to the ids of the containers
+	// that use the devices
+	owners map[string]string
+}
+
+func formatPCIAddress(addr *libvirtxml.DomainAddressPCI) string {
+	var domain, bus, slot, function uint
+	if addr.Domain != nil {
+		domain = *addr.Domain
+	}
+	if addr.Bus != nil {
+		bus = *addr.Bus
+	}
+	if addr.Slot != nil {
+		slot = *addr.Slot
+	}
+	if addr.Function != nil {
+		function = *addr.Function
+	}
+	return fmt.Sprintf("%04x:%02x:%02x.%x", domain, bus, slot, function)
+}
+
+// loadPCIDeviceClaims rebuilds the registry from the definitions of
+// the Virtlet domains. It must be called with the registry locked.
+func (v *VirtualizationTool) loadPCIDeviceClaims() error {
+	domainDevices, err := v.virtletDomainDevices()
+	if err != nil {
+		return err
+	}
+	owners := make(map[string]string)
+	for uuid, devices := range domainDevices {
+		for _, hostdev := range devices.Hostdevs {
+			if hostdev.SubsysPCI == nil || hostdev.SubsysPCI.Source == nil || hostdev.SubsysPCI.Source.Address == nil {
+				continue
+			}
+			owners[formatPCIAddress(hostdev.SubsysPCI.Source.Address)] = uuid
+		}
+	}
+	v.pciDeviceClaims.owners = owners
+	return nil
+}
+
+// claimPCIDevices registers the use of the host PCI devices by the
+// VM. If any of the devices is already used by another VM, none of
+// the devices are claimed and PCIDeviceConflictError is returned.
+func (v *VirtualizationTool) claimPCIDevices(containerID string, addrs []*libvirtxml.DomainAddressPCI) error {
+	if len(addrs) == 0 {
+		return nil
+	}
+	v.pciDeviceClaims.Lock()
+	defer v.pciDeviceClaims.Unlock()
+	if v.pciDeviceClaims.owners == nil {
+		if err := v.loadPCIDeviceClaims(); err != nil {
+			return fmt.Errorf("can't load PCI device claims: %v", err)
+		}
+	}
+	for _, addr := range addrs {
+		if owner, found := v.pciDeviceClaims.owners[formatPCIAddress(addr)]; found && owner != containerID {
+			return &PCIDeviceConflictError{Address: formatPCIAddress(addr), ContainerID: owner}
+		}
+	}
+	for _, addr := range addrs {
+		v.pciDeviceClaims.owners[formatPCIAddress(addr)] = containerID
+	}
+	return nil
+}
+
+// releasePCIDevices removes the claims of the container
+func (v *VirtualizationTool) releasePCIDevices(containerID string) {
+	v.pciDeviceClaims.Lock()
+	defer v.pciDeviceClaims.Unlock()
+	for addr, owner := range v.pciDeviceClaims.owners {
+		if owner == containerID {
+			delete(v.pciDeviceClaims.owners, addr)
+		}
+	}
+}
+
+// reloadPCIDeviceClaims rebuilds the PCI device registry from the
+// domain definitions
+func (v *VirtualizationTool) reloadPCIDeviceClaims() error {
+	v.pciDeviceClaims.Lock()
+	defer v.pciDeviceClaims.Unlock()
+	return v.loadPCIDeviceClaims()
+}
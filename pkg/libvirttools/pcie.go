@@ -0,0 +1,40 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// q35MachineType is the machine type that provides PCIe root complex
+const q35MachineType = "q35"
+
+// addPCIeRootPorts switches the domain to q35 machine type and adds
+// the specified number of empty PCIe root ports to it. On q35, each
+// hotplugged PCIe device needs a root port of its own, and the root
+// ports can't be added without restarting the VM.
+func addPCIeRootPorts(domain *libvirtxml.Domain, count int) {
+	domain.OS.Type.Machine = q35MachineType
+	rootIndex := uint(0)
+	domain.Devices.Controllers = append(domain.Devices.Controllers,
+		libvirtxml.DomainController{Type: "pci", Index: &rootIndex, Model: "pcie-root"})
+	for i := 1; i <= count; i++ {
+		index := uint(i)
+		domain.Devices.Controllers = append(domain.Devices.Controllers,
+			libvirtxml.DomainController{Type: "pci", Index: &index, Model: "pcie-root-port"})
+	}
+}
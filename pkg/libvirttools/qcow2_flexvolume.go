@@ -42,49 +42,40 @@ var capacityRx = regexp.MustCompile(`^\s*(\d+)\s*(\S*)\s*$`)
 
 type qcow2VolumeOptions struct {
 	Capacity string `json:"capacity,omitempty"`
-	UUID     string `json:"uuid"`
 }
 
 // qcow2Volume denotes a volume in QCOW2 format
 type qcow2Volume struct {
-	volumeBase
+	info         *FlexvolumeInfo
 	capacity     int
 	capacityUnit string
-	name         string
-	uuid         string
 }
 
-var _ VMVolume = &qcow2Volume{}
+var _ VolumeDriver = &qcow2Volume{}
 
-func newQCOW2Volume(volumeName, configPath string, config *VMConfig, owner volumeOwner) (VMVolume, error) {
+func (v *qcow2Volume) Name() string { return "qcow2" }
+
+func (v *qcow2Volume) Prepare(info *FlexvolumeInfo) error {
 	var err error
 	var opts qcow2VolumeOptions
-	if err = utils.ReadJSON(configPath, &opts); err != nil {
-		return nil, fmt.Errorf("failed to parse qcow2 volume config %q: %v", configPath, err)
-	}
-	v := &qcow2Volume{
-		volumeBase: volumeBase{config, owner},
-		name:       volumeName,
-		uuid:       opts.UUID,
+	if err = utils.ReadJSON(info.ConfigPath, &opts); err != nil {
+		return fmt.Errorf("failed to parse qcow2 volume config %q: %v", info.ConfigPath, err)
 	}
-
+	v.info = info
 	v.capacity, v.capacityUnit, err = parseCapacityStr(opts.Capacity)
-	if err != nil {
-		return nil, err
-	}
-	return v, nil
+	return err
 }
 
 func (v *qcow2Volume) volumeName() string {
-	return "virtlet-" + v.config.DomainUUID + "-" + v.name
+	return "virtlet-" + v.info.Config.DomainUUID + "-" + v.info.Name
 }
 
 func (v *qcow2Volume) createQCOW2Volume(capacity uint64, capacityUnit string) (virt.StorageVolume, error) {
-	storagePool, err := v.owner.StoragePool()
+	storagePool, err := v.info.Owner.StoragePool()
 	if err != nil {
 		return nil, err
 	}
-	return storagePool.CreateStorageVol(&libvirtxml.StorageVolume{
+	return createStorageVolume(v.info.Owner, storagePool, v.info.Config.DomainUUID, &libvirtxml.StorageVolume{
 		Name:       v.volumeName(),
 		Allocation: &libvirtxml.StorageVolumeSize{Value: 0},
 		Capacity:   &libvirtxml.StorageVolumeSize{Unit: capacityUnit, Value: capacity},
@@ -92,14 +83,13 @@ func (v *qcow2Volume) createQCOW2Volume(capacity uint64, capacityUnit string) (v
 	})
 }
 
-func (v *qcow2Volume) UUID() string {
-	return v.uuid
-}
-
-func (v *qcow2Volume) Setup() (*libvirtxml.DomainDisk, error) {
+func (v *qcow2Volume) DiskXML() (*libvirtxml.DomainDisk, error) {
 	vol, err := v.createQCOW2Volume(uint64(v.capacity), v.capacityUnit)
+	if IsInsufficientStorage(err) {
+		return nil, err
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error during creation of volume '%s' with virtlet description %s: %v", v.volumeName(), v.name, err)
+		return nil, fmt.Errorf("error during creation of volume '%s' with virtlet description %s: %v", v.volumeName(), v.info.Name, err)
 	}
 
 	path, err := vol.Path()
@@ -119,12 +109,12 @@ func (v *qcow2Volume) Setup() (*libvirtxml.DomainDisk, error) {
 	}, nil
 }
 
+func (v *qcow2Volume) Preserve(timestamp string) (string, error) {
+	return preserveStorageVolume(v.info.Owner, v.volumeName(), timestamp)
+}
+
 func (v *qcow2Volume) Teardown() error {
-	storagePool, err := v.owner.StoragePool()
-	if err != nil {
-		return err
-	}
-	return storagePool.RemoveVolumeByName(v.volumeName())
+	return removeStorageVolume(v.info.Owner, v.info.Config, v.volumeName())
 }
 
 func parseCapacityStr(capacityStr string) (int, string, error) {
@@ -153,7 +143,7 @@ func parseCapacityStr(capacityStr string) (int, string, error) {
 }
 
 func init() {
-	addFlexvolumeSource("qcow2", newQCOW2Volume)
+	RegisterVolumeDriver(func() VolumeDriver { return &qcow2Volume{} })
 }
 
 // TODO: this file needs a test
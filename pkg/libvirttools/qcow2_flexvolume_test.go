@@ -47,11 +47,10 @@ func prepareOptsFileForQcow2Volume() (string, error) {
 
 func TestQCOW2VolumeNaming(t *testing.T) {
 	v := qcow2Volume{
-		volumeBase: volumeBase{
-			&VMConfig{DomainUUID: testUUID},
-			nil,
+		info: &FlexvolumeInfo{
+			Name:   TestVolumeName,
+			Config: &VMConfig{DomainUUID: testUUID},
 		},
-		name: TestVolumeName,
 	}
 	expected := "virtlet-" + testUUID + "-" + TestVolumeName
 	volumeName := v.volumeName()
@@ -75,19 +74,19 @@ func TestQCOW2VolumeLifeCycle(t *testing.T) {
 	}
 	defer os.Remove(optsFilePath)
 
-	volume, err := newQCOW2Volume(
-		TestVolumeName,
-		optsFilePath,
-		&VMConfig{DomainUUID: testUUID, Image: "rootfs image name"},
-		newFakeVolumeOwner(spool, im),
-	)
-	if err != nil {
-		t.Fatalf("newQCOW2Volume returned an error: %v", err)
+	volume := &qcow2Volume{}
+	if err := volume.Prepare(&FlexvolumeInfo{
+		Name:       TestVolumeName,
+		ConfigPath: optsFilePath,
+		Config:     &VMConfig{DomainUUID: testUUID, Image: "rootfs image name"},
+		Owner:      newFakeVolumeOwner(spool, im),
+	}); err != nil {
+		t.Fatalf("Prepare returned an error: %v", err)
 	}
 
-	vol, err := volume.Setup()
+	vol, err := volume.DiskXML()
 	if err != nil {
-		t.Errorf("Setup returned an error: %v", err)
+		t.Errorf("DiskXML returned an error: %v", err)
 	}
 
 	if vol.Source.File == nil {
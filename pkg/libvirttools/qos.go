@@ -0,0 +1,89 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// qosClass denotes Kubernetes QoS class of the pod as it can
+// be derived from the CRI resources passed to CreateContainer()
+type qosClass string
+
+const (
+	qosGuaranteed qosClass = "Guaranteed"
+	qosBurstable  qosClass = "Burstable"
+	qosBestEffort qosClass = "BestEffort"
+
+	// minCPUShares is the value which kubelet passes as cpu shares
+	// for the containers that have no cpu request
+	minCPUShares = 2
+
+	// qemuMemoryOverhead is the memory allowed for the QEMU
+	// process on top of the guest RAM in the memtune hard limit,
+	// which includes device emulation, I/O buffers and the
+	// memory of QEMU itself
+	qemuMemoryOverhead = 256 * 1024 * 1024
+)
+
+// getQOSClass derives pod QoS class from the VM config.
+// CRI doesn't pass the QoS class itself, so we have to guess it
+// from the way kubelet translates the requests and the limits.
+// For Guaranteed pods, kubelet sets cpu shares that match cpu quota
+// (as the cpu request is equal to the cpu limit) and sets
+// the memory limit. BestEffort pods get neither limits nor
+// cpu shares above the minimal value.
+func getQOSClass(config *VMConfig) qosClass {
+	switch {
+	case config.MemoryLimitInBytes <= 0 && config.CPUQuota <= 0 && config.CPUShares <= minCPUShares:
+		return qosBestEffort
+	case config.MemoryLimitInBytes > 0 && config.CPUQuota > 0 && config.CPUPeriod > 0 &&
+		config.CPUShares == config.CPUQuota*1024/config.CPUPeriod:
+		return qosGuaranteed
+	default:
+		return qosBurstable
+	}
+}
+
+// memoryTune returns memtune settings for the domain based on
+// the pod's QoS class. The hard limit covers the whole QEMU process,
+// so it's set to the memory limit of the VM plus qemuMemoryOverhead,
+// otherwise the QEMU process would be killed by the OOM killer under
+// normal load. Guaranteed VMs get the soft limit equal to their memory
+// limit, Burstable VMs get it at the half of their memory limit so
+// they can be squeezed under memory pressure. BestEffort VMs have no
+// limits at all. The function returns nil if no memory limit is set.
+func memoryTune(config *VMConfig) *libvirtxml.DomainMemoryTune {
+	if config.MemoryLimitInBytes <= 0 {
+		return nil
+	}
+	limit := uint64(config.MemoryLimitInBytes)
+	switch getQOSClass(config) {
+	case qosGuaranteed:
+		return &libvirtxml.DomainMemoryTune{
+			HardLimit: &libvirtxml.DomainMemoryTuneLimit{Value: limit + qemuMemoryOverhead, Unit: "b"},
+			SoftLimit: &libvirtxml.DomainMemoryTuneLimit{Value: limit, Unit: "b"},
+		}
+	case qosBurstable:
+		return &libvirtxml.DomainMemoryTune{
+			HardLimit: &libvirtxml.DomainMemoryTuneLimit{Value: limit + qemuMemoryOverhead, Unit: "b"},
+			SoftLimit: &libvirtxml.DomainMemoryTuneLimit{Value: limit / 2, Unit: "b"},
+		}
+	default:
+		return nil
+	}
+}
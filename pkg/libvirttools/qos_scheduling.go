@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const (
+	minNice      = -20
+	maxNice      = 19
+	minCPUWeight = 1
+	maxCPUWeight = 10000
+)
+
+// QOSSchedulingSettings specifies the CPU scheduling settings of
+// the QEMU processes of the VMs of a QoS class
+type QOSSchedulingSettings struct {
+	// Nice is the nice value (-20 to 19) of the threads of the
+	// QEMU process
+	Nice int `json:"nice"`
+	// CPUWeight is cgroup v2 cpu.weight (1 to 10000) of the cgroup
+	// of the QEMU process. Zero value leaves the weight unchanged.
+	CPUWeight uint64 `json:"cpuWeight"`
+}
+
+// QOSSchedulingConfig maps the QoS class names (Guaranteed, Burstable
+// and BestEffort) to the CPU scheduling settings of the QEMU processes
+// of the VMs, so that e.g. BestEffort VMs yield to the Guaranteed ones
+// under contention. The VMs of the QoS classes that aren't listed
+// keep the default settings.
+type QOSSchedulingConfig map[string]QOSSchedulingSettings
+
+func (c QOSSchedulingConfig) validate() error {
+	for class, settings := range c {
+		switch qosClass(class) {
+		case qosGuaranteed, qosBurstable, qosBestEffort:
+		default:
+			return fmt.Errorf("bad QoS class %q", class)
+		}
+		if settings.Nice < minNice || settings.Nice > maxNice {
+			return fmt.Errorf("bad nice value %d for QoS class %q: must be between %d and %d", settings.Nice, class, minNice, maxNice)
+		}
+		if settings.CPUWeight != 0 && (settings.CPUWeight < minCPUWeight || settings.CPUWeight > maxCPUWeight) {
+			return fmt.Errorf("bad cpu weight %d for QoS class %q: must be between %d and %d", settings.CPUWeight, class, minCPUWeight, maxCPUWeight)
+		}
+	}
+	return nil
+}
+
+// SetQOSSchedulingConfig sets the mapping of the QoS classes of the
+// pods to the CPU scheduling settings of the QEMU processes, which are
+// applied when the VMs are started. Empty config disables the tuning.
+func (v *VirtualizationTool) SetQOSSchedulingConfig(config QOSSchedulingConfig) error {
+	if err := config.validate(); err != nil {
+		return fmt.Errorf("bad QoS scheduling config: %v", err)
+	}
+	v.qosScheduling = config
+	return nil
+}
+
+// applyQOSScheduling tunes the QEMU process of the VM that has just
+// been started according to the QoS class of the pod. The errors are
+// only logged as they don't prevent the VM from running.
+func (v *VirtualizationTool) applyQOSScheduling(containerID string, domain virt.Domain) {
+	if len(v.qosScheduling) == 0 {
+		return
+	}
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	if err != nil || containerInfo == nil {
+		glog.Warningf("Can't apply QoS scheduling settings to VM %q: can't retrieve container info: %v", containerID, err)
+		return
+	}
+	settings, found := v.qosScheduling[containerInfo.QOSClass]
+	if !found {
+		return
+	}
+	domainName, err := domain.Name()
+	if err != nil {
+		glog.Warningf("Can't apply QoS scheduling settings to VM %q: %v", containerID, err)
+		return
+	}
+	glog.V(2).Infof("Applying QoS scheduling settings for %s class to VM %q: nice %d, cpu weight %d", containerInfo.QOSClass, containerID, settings.Nice, settings.CPUWeight)
+	if err := v.processTuner(domainName, settings); err != nil {
+		glog.Warningf("Can't apply QoS scheduling settings to VM %q: %v", containerID, err)
+	}
+}
+
+// tuneQEMUProcess sets the nice value of all the threads of the QEMU
+// process of the domain with the specified name and the cpu.weight of
+// its cgroup
+func tuneQEMUProcess(domainName string, settings QOSSchedulingSettings) error {
+	pid, err := qemuPID(domainName)
+	if err != nil {
+		return err
+	}
+	taskDir := filepath.Join("/proc", pid, "task")
+	tasks, err := ioutil.ReadDir(taskDir)
+	if err != nil {
+		return fmt.Errorf("can't list the threads of QEMU process %s: %v", pid, err)
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, settings.Nice); err != nil {
+			return fmt.Errorf("can't set the nice value of thread %d of QEMU process %s: %v", tid, pid, err)
+		}
+	}
+
+	if settings.CPUWeight == 0 {
+		return nil
+	}
+	cgroupData, err := ioutil.ReadFile(filepath.Join("/proc", pid, "cgroup"))
+	if err != nil {
+		return fmt.Errorf("can't read the cgroups of QEMU process %s: %v", pid, err)
+	}
+	for _, line := range strings.Split(string(cgroupData), "\n") {
+		if !strings.HasPrefix(line, "0::") {
+			continue
+		}
+		cgroupPath := strings.TrimPrefix(line, "0::")
+		// libvirt keeps the QEMU process in 'emulator' child
+		// cgroup of the cgroup of the domain, with the vCPU
+		// threads in the sibling ones
+		if filepath.Base(cgroupPath) == "emulator" {
+			cgroupPath = filepath.Dir(cgroupPath)
+		}
+		weightPath := filepath.Join(cgroupRoot, cgroupPath, "cpu.weight")
+		if err := ioutil.WriteFile(weightPath, []byte(strconv.FormatUint(settings.CPUWeight, 10)), 0644); err != nil {
+			return fmt.Errorf("can't set cpu weight of QEMU process %s: %v", pid, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("can't set cpu weight of QEMU process %s: cgroup v2 hierarchy is not used", pid)
+}
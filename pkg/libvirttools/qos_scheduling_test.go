@@ -0,0 +1,167 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+type tunedProcess struct {
+	domainName string
+	settings   QOSSchedulingSettings
+}
+
+func TestQOSScheduling(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	config := QOSSchedulingConfig{
+		"Guaranteed": {Nice: -5, CPUWeight: 500},
+		"Burstable":  {Nice: 0, CPUWeight: 100},
+		"BestEffort": {Nice: 10, CPUWeight: 10},
+	}
+	if err := ct.virtTool.SetQOSSchedulingConfig(config); err != nil {
+		t.Fatalf("SetQOSSchedulingConfig(): %v", err)
+	}
+	var tuned []tunedProcess
+	ct.virtTool.processTuner = func(domainName string, settings QOSSchedulingSettings) error {
+		tuned = append(tuned, tunedProcess{domainName, settings})
+		return nil
+	}
+
+	sandboxes := criapi.GetSandboxes(4)
+	for n, tc := range []struct {
+		class     string
+		setConfig func(config *VMConfig)
+	}{
+		{
+			class: "BestEffort",
+			setConfig: func(config *VMConfig) {
+				config.CPUShares = 2
+			},
+		},
+		{
+			class: "Burstable",
+			setConfig: func(config *VMConfig) {
+				config.CPUShares = 512
+				config.MemoryLimitInBytes = 1024 * 1024 * 1024
+			},
+		},
+		{
+			class: "Guaranteed",
+			setConfig: func(config *VMConfig) {
+				config.CPUShares = 512
+				config.CPUPeriod = 100000
+				config.CPUQuota = 50000
+				config.MemoryLimitInBytes = 1024 * 1024 * 1024
+			},
+		},
+	} {
+		t.Run(tc.class, func(t *testing.T) {
+			ct.setPodSandbox(sandboxes[n])
+			vmConfig := ct.vmConfig(sandboxes[n], nil)
+			tc.setConfig(vmConfig)
+			containerID, err := ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns")
+			if err != nil {
+				t.Fatalf("CreateContainer(): %v", err)
+			}
+			tuned = nil
+			ct.startContainer(containerID)
+			expectedTuned := []tunedProcess{
+				{
+					domainName: "virtlet-" + containerID[:13] + "-" + vmConfig.Name,
+					settings:   config[tc.class],
+				},
+			}
+			if !reflect.DeepEqual(tuned, expectedTuned) {
+				t.Errorf("bad process tuning:\n%#v\ninstead of\n%#v", tuned, expectedTuned)
+			}
+		})
+	}
+
+	// the classes that aren't listed in the config aren't tuned
+	if err := ct.virtTool.SetQOSSchedulingConfig(QOSSchedulingConfig{
+		"Guaranteed": {Nice: -5},
+	}); err != nil {
+		t.Fatalf("SetQOSSchedulingConfig(): %v", err)
+	}
+	ct.setPodSandbox(sandboxes[3])
+	containerID := ct.createContainer(sandboxes[3], nil)
+	tuned = nil
+	ct.startContainer(containerID)
+	if len(tuned) != 0 {
+		t.Errorf("unexpected process tuning: %#v", tuned)
+	}
+}
+
+func TestQOSSchedulingConfigValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		config        QOSSchedulingConfig
+		expectedError string
+	}{
+		{
+			name:   "empty config",
+			config: nil,
+		},
+		{
+			name: "valid config",
+			config: QOSSchedulingConfig{
+				"Guaranteed": {Nice: -20, CPUWeight: 10000},
+				"Burstable":  {Nice: 0},
+				"BestEffort": {Nice: 19, CPUWeight: 1},
+			},
+		},
+		{
+			name:          "unknown QoS class",
+			config:        QOSSchedulingConfig{"Premium": {Nice: -5}},
+			expectedError: "bad QoS class",
+		},
+		{
+			name:          "nice value too low",
+			config:        QOSSchedulingConfig{"Guaranteed": {Nice: -21}},
+			expectedError: "bad nice value",
+		},
+		{
+			name:          "nice value too high",
+			config:        QOSSchedulingConfig{"BestEffort": {Nice: 20}},
+			expectedError: "bad nice value",
+		},
+		{
+			name:          "cpu weight too high",
+			config:        QOSSchedulingConfig{"Burstable": {CPUWeight: 10001}},
+			expectedError: "bad cpu weight",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.validate()
+			switch {
+			case tc.expectedError == "" && err != nil:
+				t.Errorf("validate(): %v", err)
+			case tc.expectedError != "" && err == nil:
+				t.Errorf("validate() didn't fail")
+			case tc.expectedError != "" && !strings.Contains(err.Error(), tc.expectedError):
+				t.Errorf("bad error message: %v", err)
+			}
+		})
+	}
+}
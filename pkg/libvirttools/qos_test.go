@@ -0,0 +1,83 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+func TestMemoryTune(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		config           *VMConfig
+		expectedQOSClass qosClass
+		expectedTune     *libvirtxml.DomainMemoryTune
+	}{
+		{
+			name:             "best effort",
+			config:           &VMConfig{CPUShares: 2},
+			expectedQOSClass: qosBestEffort,
+		},
+		{
+			name: "burstable with memory limit",
+			config: &VMConfig{
+				CPUShares:          102,
+				MemoryLimitInBytes: 1024 * 1024 * 1024,
+			},
+			expectedQOSClass: qosBurstable,
+			expectedTune: &libvirtxml.DomainMemoryTune{
+				HardLimit: &libvirtxml.DomainMemoryTuneLimit{Value: (1024 + 256) * 1024 * 1024, Unit: "b"},
+				SoftLimit: &libvirtxml.DomainMemoryTuneLimit{Value: 512 * 1024 * 1024, Unit: "b"},
+			},
+		},
+		{
+			name: "burstable without memory limit",
+			config: &VMConfig{
+				CPUShares: 512,
+			},
+			expectedQOSClass: qosBurstable,
+		},
+		{
+			name: "guaranteed",
+			config: &VMConfig{
+				CPUShares:          512,
+				CPUPeriod:          100000,
+				CPUQuota:           50000,
+				MemoryLimitInBytes: 1024 * 1024 * 1024,
+			},
+			expectedQOSClass: qosGuaranteed,
+			expectedTune: &libvirtxml.DomainMemoryTune{
+				HardLimit: &libvirtxml.DomainMemoryTuneLimit{Value: (1024 + 256) * 1024 * 1024, Unit: "b"},
+				SoftLimit: &libvirtxml.DomainMemoryTuneLimit{Value: 1024 * 1024 * 1024, Unit: "b"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if qos := getQOSClass(tc.config); qos != tc.expectedQOSClass {
+				t.Errorf("bad QoS class: %q instead of %q", qos, tc.expectedQOSClass)
+			}
+			tune := memoryTune(tc.config)
+			if !reflect.DeepEqual(tune, tc.expectedTune) {
+				t.Errorf("bad memtune:\n%s\nexpected:\n%s", spew.Sdump(tune), spew.Sdump(tc.expectedTune))
+			}
+		})
+	}
+}
@@ -26,15 +26,63 @@ import (
 	"github.com/Mirantis/virtlet/pkg/utils"
 )
 
+const (
+	// DefaultRawDevices is the default list of the raw device
+	// patterns which makes loop devices (/dev/loop0, /dev/loop1
+	// etc.) accessible for the VMs
+	DefaultRawDevices = "loop*"
+	rawDeviceDir      = "/dev/"
+)
+
+// ParseRawDevices parses a comma-separated list of glob patterns
+// of the device paths relative to /dev which can be used by the
+// VMs via raw flexvolumes, e.g. "loop*,sd[b-d],disk/by-id/*".
+// The patterns follow filepath.Match syntax, so '*' doesn't match
+// '/'. Empty string means that no raw devices can be used.
+func ParseRawDevices(s string) ([]string, error) {
+	var r []string
+	for _, item := range strings.Split(s, ",") {
+		pattern := strings.TrimSpace(item)
+		if pattern == "" {
+			continue
+		}
+		if strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("bad raw device pattern %q: must be relative to %s", pattern, rawDeviceDir)
+		}
+		if filepath.Clean(pattern) != pattern || pattern == ".." || strings.HasPrefix(pattern, "../") {
+			return nil, fmt.Errorf("bad raw device pattern %q: must be a clean path inside %s", pattern, rawDeviceDir)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad raw device pattern %q: %v", pattern, err)
+		}
+		r = append(r, pattern)
+	}
+	return r, nil
+}
+
+// SetRawDevices sets the list of glob patterns of the raw devices
+// which can be used by the VMs. See ParseRawDevices for the format.
+func (v *VirtualizationTool) SetRawDevices(rawDevices string) error {
+	patterns, err := ParseRawDevices(rawDevices)
+	if err != nil {
+		return err
+	}
+	v.rawDevices = patterns
+	return nil
+}
+
 type rawVolumeOptions struct {
 	Path string `json:"path"`
-	UUID string `json:"uuid"`
 }
 
 func (vo *rawVolumeOptions) validate() error {
-	if !strings.HasPrefix(vo.Path, "/dev/") {
+	if !strings.HasPrefix(vo.Path, rawDeviceDir) {
 		return fmt.Errorf("raw volume path needs to be prefixed by '/dev/', but it's whole value is: %s", vo.Path)
 	}
+	// make sure the path can't escape the whitelist via '..'
+	if filepath.Clean(vo.Path) != vo.Path {
+		return fmt.Errorf("raw volume path %q is not clean", vo.Path)
+	}
 	return nil
 }
 
@@ -44,25 +92,26 @@ type rawDeviceVolume struct {
 	opts *rawVolumeOptions
 }
 
-var _ VMVolume = &rawDeviceVolume{}
+var _ VolumeDriver = &rawDeviceVolume{}
 
-func newRawDeviceVolume(volumeName, configPath string, config *VMConfig, owner volumeOwner) (VMVolume, error) {
+func (v *rawDeviceVolume) Name() string { return "raw" }
+
+func (v *rawDeviceVolume) Prepare(info *FlexvolumeInfo) error {
 	var opts rawVolumeOptions
-	if err := utils.ReadJSON(configPath, &opts); err != nil {
-		return nil, fmt.Errorf("failed to parse raw volume config %q: %v", configPath, err)
+	if err := utils.ReadJSON(info.ConfigPath, &opts); err != nil {
+		return fmt.Errorf("failed to parse raw volume config %q: %v", info.ConfigPath, err)
 	}
 	if err := opts.validate(); err != nil {
-		return nil, err
+		return err
 	}
-	return &rawDeviceVolume{
-		volumeBase: volumeBase{config, owner},
-		opts:       &opts,
-	}, nil
+	v.volumeBase = volumeBase{info.Config, info.Owner}
+	v.opts = &opts
+	return nil
 }
 
 func (v *rawDeviceVolume) verifyRawDeviceWhitelisted(path string) error {
 	for _, deviceTemplate := range v.owner.RawDevices() {
-		matches, err := filepath.Match("/dev/"+deviceTemplate, path)
+		matches, err := filepath.Match(rawDeviceDir+deviceTemplate, path)
 		if err != nil {
 			return fmt.Errorf("bad raw device whitelist glob pattern '%s': %v", deviceTemplate, err)
 		}
@@ -73,11 +122,7 @@ func (v *rawDeviceVolume) verifyRawDeviceWhitelisted(path string) error {
 	return fmt.Errorf("device '%s' not whitelisted on this virtlet node", path)
 }
 
-func (v *rawDeviceVolume) UUID() string {
-	return v.opts.UUID
-}
-
-func (v *rawDeviceVolume) Setup() (*libvirtxml.DomainDisk, error) {
+func (v *rawDeviceVolume) DiskXML() (*libvirtxml.DomainDisk, error) {
 	if err := v.verifyRawDeviceWhitelisted(v.opts.Path); err != nil {
 		return nil, err
 	}
@@ -93,7 +138,5 @@ func (v *rawDeviceVolume) Setup() (*libvirtxml.DomainDisk, error) {
 }
 
 func init() {
-	addFlexvolumeSource("raw", newRawDeviceVolume)
+	RegisterVolumeDriver(func() VolumeDriver { return &rawDeviceVolume{} })
 }
-
-// TODO: this file needs a test
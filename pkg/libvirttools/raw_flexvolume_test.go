@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+)
+
+type rawDevicesOwner struct {
+	fakeVolumeOwner
+	rawDevices []string
+}
+
+func (vo rawDevicesOwner) RawDevices() []string { return vo.rawDevices }
+
+func TestParseRawDevices(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		value    string
+		patterns []string
+		error    bool
+	}{
+		{
+			name:  "empty list",
+			value: "",
+		},
+		{
+			name:     "default patterns",
+			value:    DefaultRawDevices,
+			patterns: []string{"loop*"},
+		},
+		{
+			name:     "custom patterns",
+			value:    "sd[b-c], disk/by-id/virtio-*,",
+			patterns: []string{"sd[b-c]", "disk/by-id/virtio-*"},
+		},
+		{
+			name:  "absolute path",
+			value: "/dev/sdb",
+			error: true,
+		},
+		{
+			name:  "path outside /dev",
+			value: "../etc/*",
+			error: true,
+		},
+		{
+			name:  "unclean path",
+			value: "disk//by-id/*",
+			error: true,
+		},
+		{
+			name:  "bad glob pattern",
+			value: "sd[b-",
+			error: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			patterns, err := ParseRawDevices(tc.value)
+			switch {
+			case tc.error && err == nil:
+				t.Errorf("ParseRawDevices(%q) didn't return an error", tc.value)
+			case !tc.error && err != nil:
+				t.Errorf("ParseRawDevices(%q): %v", tc.value, err)
+			case !reflect.DeepEqual(patterns, tc.patterns):
+				t.Errorf("bad patterns: %#v instead of %#v", patterns, tc.patterns)
+			}
+		})
+	}
+}
+
+func TestRawDeviceWhitelist(t *testing.T) {
+	patterns, err := ParseRawDevices("sd[b-c],disk/by-id/virtio-*")
+	if err != nil {
+		t.Fatalf("ParseRawDevices(): %v", err)
+	}
+	v := &rawDeviceVolume{volumeBase: volumeBase{nil, rawDevicesOwner{rawDevices: patterns}}}
+	for _, tc := range []struct {
+		path    string
+		matches bool
+	}{
+		{"/dev/sdb", true},
+		{"/dev/disk/by-id/virtio-data", true},
+		{"/dev/sdd", false},
+		{"/dev/loop0", false},
+		{"/dev/disk/by-id/virtio-data/foo", false},
+	} {
+		err := v.verifyRawDeviceWhitelisted(tc.path)
+		switch {
+		case tc.matches && err != nil:
+			t.Errorf("device %q not whitelisted: %v", tc.path, err)
+		case !tc.matches && err == nil:
+			t.Errorf("device %q unexpectedly whitelisted", tc.path)
+		}
+	}
+}
+
+func TestRawVolumeOptionsValidation(t *testing.T) {
+	for _, path := range []string{"/dev/sdb/../sda", "/dev//sdb", "/var/lib/sdb"} {
+		opts := rawVolumeOptions{Path: path}
+		if err := opts.validate(); err == nil {
+			t.Errorf("raw volume path %q considered valid", path)
+		}
+	}
+	opts := rawVolumeOptions{Path: "/dev/sdb"}
+	if err := opts.validate(); err != nil {
+		t.Errorf("raw volume path %q considered invalid: %v", opts.Path, err)
+	}
+}
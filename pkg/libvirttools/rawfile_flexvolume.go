@@ -0,0 +1,140 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+type rawFileVolumeOptions struct {
+	Path     string `json:"path"`
+	ReadOnly string `json:"readOnly"`
+	// ReadWrite is set by kubelet to "ro" for read-only volumes
+	ReadWrite string `json:"kubernetes.io/readwrite"`
+}
+
+func (vo *rawFileVolumeOptions) validate() error {
+	if !filepath.IsAbs(vo.Path) {
+		return fmt.Errorf("raw image file path must be absolute, but it's %q", vo.Path)
+	}
+	return nil
+}
+
+func (vo *rawFileVolumeOptions) readOnly() bool {
+	return utils.GetBoolFromString(vo.ReadOnly) || vo.ReadWrite == "ro"
+}
+
+// rawFileVolume denotes a raw image file on the host that's attached
+// to the VM directly, without copying it into the storage pool
+type rawFileVolume struct {
+	volumeBase
+	opts *rawFileVolumeOptions
+}
+
+var _ VolumeDriver = &rawFileVolume{}
+
+func (v *rawFileVolume) Name() string { return "rawfile" }
+
+func (v *rawFileVolume) Prepare(info *FlexvolumeInfo) error {
+	var opts rawFileVolumeOptions
+	if err := utils.ReadJSON(info.ConfigPath, &opts); err != nil {
+		return fmt.Errorf("failed to parse rawfile volume config %q: %v", info.ConfigPath, err)
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	v.volumeBase = volumeBase{info.Config, info.Owner}
+	v.opts = &opts
+	return nil
+}
+
+// verifyNotAttached makes sure the image file is not used by other
+// running domains in a conflicting way, i.e. the file may be shared
+// between several domains only if all of them use it read-only
+func (v *rawFileVolume) verifyNotAttached() error {
+	domains, err := v.owner.DomainConnection().ListDomains()
+	if err != nil {
+		return fmt.Errorf("cannot list domains: %v", err)
+	}
+	for _, domain := range domains {
+		uuid, err := domain.UUIDString()
+		if err != nil {
+			return err
+		}
+		if uuid == v.config.DomainUUID {
+			continue
+		}
+		state, err := domain.State()
+		if err != nil {
+			return fmt.Errorf("failed to get state of the domain %q: %v", uuid, err)
+		}
+		if state != virt.DomainStateRunning && state != virt.DomainStatePaused {
+			continue
+		}
+		def, err := domain.XML()
+		if err != nil {
+			return fmt.Errorf("couldn't get xml of the domain %q: %v", uuid, err)
+		}
+		if def.Devices == nil {
+			continue
+		}
+		for _, disk := range def.Devices.Disks {
+			if disk.Source == nil || disk.Source.File == nil || disk.Source.File.File != v.opts.Path {
+				continue
+			}
+			if !v.opts.readOnly() || disk.ReadOnly == nil {
+				return fmt.Errorf("raw image file %q is already in use by domain %q", v.opts.Path, uuid)
+			}
+		}
+	}
+	return nil
+}
+
+func (v *rawFileVolume) DiskXML() (*libvirtxml.DomainDisk, error) {
+	fi, err := os.Stat(v.opts.Path)
+	if err != nil {
+		return nil, fmt.Errorf("can't access raw image file %q: %v", v.opts.Path, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("raw image file path %q points to something other than regular file", v.opts.Path)
+	}
+
+	if err := v.verifyNotAttached(); err != nil {
+		return nil, err
+	}
+
+	disk := &libvirtxml.DomainDisk{
+		Device: "disk",
+		Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: v.opts.Path}},
+		Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw"},
+	}
+	if v.opts.readOnly() {
+		disk.ReadOnly = &libvirtxml.DomainDiskReadOnly{}
+	}
+	return disk, nil
+}
+
+func init() {
+	RegisterVolumeDriver(func() VolumeDriver { return &rawFileVolume{} })
+}
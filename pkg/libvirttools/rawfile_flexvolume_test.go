@@ -0,0 +1,204 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+)
+
+type rawFileVolumeTester struct {
+	t          *testing.T
+	tmpDir     string
+	imagePath  string
+	domainConn *fake.FakeDomainConnection
+}
+
+func newRawFileVolumeTester(t *testing.T) *rawFileVolumeTester {
+	tmpDir, err := ioutil.TempDir("", "rawfile-flexvol-test-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	imagePath := filepath.Join(tmpDir, "disk.img")
+	if err := ioutil.WriteFile(imagePath, make([]byte, 4096), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	return &rawFileVolumeTester{
+		t:          t,
+		tmpDir:     tmpDir,
+		imagePath:  imagePath,
+		domainConn: fake.NewFakeDomainConnection(testutils.NullRecorder),
+	}
+}
+
+func (vt *rawFileVolumeTester) teardown() {
+	os.RemoveAll(vt.tmpDir)
+}
+
+func (vt *rawFileVolumeTester) setup(opts map[string]string) (*libvirtxml.DomainDisk, error) {
+	optsFilePath := filepath.Join(vt.tmpDir, "virtlet-flexvolume.json")
+	if err := utils.WriteJSON(optsFilePath, opts, 0700); err != nil {
+		vt.t.Fatalf("WriteJSON(): %v", err)
+	}
+	owner := newFakeVolumeOwner(nil, nil)
+	owner.domainConn = vt.domainConn
+	vol := &rawFileVolume{}
+	if err := vol.Prepare(&FlexvolumeInfo{
+		Name:       "test-volume",
+		ConfigPath: optsFilePath,
+		Config:     &VMConfig{DomainUUID: testUUID},
+		Owner:      owner,
+	}); err != nil {
+		vt.t.Fatalf("Prepare(): %v", err)
+	}
+	return vol.DiskXML()
+}
+
+func (vt *rawFileVolumeTester) startOtherDomain(readOnly bool) {
+	disk := libvirtxml.DomainDisk{
+		Device: "disk",
+		Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: vt.imagePath}},
+		Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw"},
+	}
+	if readOnly {
+		disk.ReadOnly = &libvirtxml.DomainDiskReadOnly{}
+	}
+	domain, err := vt.domainConn.DefineDomain(&libvirtxml.Domain{
+		Name:    "other-domain",
+		UUID:    fakeUUID,
+		Devices: &libvirtxml.DomainDeviceList{Disks: []libvirtxml.DomainDisk{disk}},
+	})
+	if err != nil {
+		vt.t.Fatalf("DefineDomain(): %v", err)
+	}
+	if err := domain.Create(); err != nil {
+		vt.t.Fatalf("Create(): %v", err)
+	}
+}
+
+func TestRawFileVolume(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     map[string]string
+		readOnly bool
+	}{
+		{
+			name: "read-write",
+			opts: map[string]string{"type": "rawfile"},
+		},
+		{
+			name:     "read-only",
+			opts:     map[string]string{"type": "rawfile", "readOnly": "true"},
+			readOnly: true,
+		},
+		{
+			name:     "read-only volume mount",
+			opts:     map[string]string{"type": "rawfile", "kubernetes.io/readwrite": "ro"},
+			readOnly: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			vt := newRawFileVolumeTester(t)
+			defer vt.teardown()
+
+			tc.opts["path"] = vt.imagePath
+			disk, err := vt.setup(tc.opts)
+			if err != nil {
+				t.Fatalf("Setup(): %v", err)
+			}
+
+			expectedDisk := &libvirtxml.DomainDisk{
+				Device: "disk",
+				Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: vt.imagePath}},
+				Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw"},
+			}
+			if tc.readOnly {
+				expectedDisk.ReadOnly = &libvirtxml.DomainDiskReadOnly{}
+			}
+			if !reflect.DeepEqual(disk, expectedDisk) {
+				t.Errorf("bad disk definition:\n%s\nexpected:\n%s", spew.Sdump(disk), spew.Sdump(expectedDisk))
+			}
+		})
+	}
+}
+
+func TestRawFileVolumeSharing(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		otherReadOnly bool
+		readOnly      string
+		expectError   bool
+	}{
+		{
+			name:          "read-only in both domains",
+			otherReadOnly: true,
+			readOnly:      "true",
+		},
+		{
+			name:          "read-write in the other domain",
+			otherReadOnly: false,
+			readOnly:      "true",
+			expectError:   true,
+		},
+		{
+			name:          "read-write in the new domain",
+			otherReadOnly: true,
+			readOnly:      "false",
+			expectError:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			vt := newRawFileVolumeTester(t)
+			defer vt.teardown()
+
+			vt.startOtherDomain(tc.otherReadOnly)
+			_, err := vt.setup(map[string]string{
+				"type":     "rawfile",
+				"path":     vt.imagePath,
+				"readOnly": tc.readOnly,
+			})
+			switch {
+			case err == nil && tc.expectError:
+				t.Errorf("Setup() didn't fail for a file that's in use")
+			case err != nil && !tc.expectError:
+				t.Errorf("Setup(): %v", err)
+			}
+		})
+	}
+}
+
+func TestRawFileVolumeMissingFile(t *testing.T) {
+	vt := newRawFileVolumeTester(t)
+	defer vt.teardown()
+
+	if _, err := vt.setup(map[string]string{
+		"type": "rawfile",
+		"path": filepath.Join(vt.tmpDir, "nonexistent.img"),
+	}); err == nil {
+		t.Errorf("Setup() didn't fail for a nonexistent file")
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// DriftKind denotes a kind of inconsistency between Virtlet
+// metadata, libvirt domains, the storage pool and the config ISOs
+type DriftKind string
+
+const (
+	// DriftContainerWithoutDomain means that there's container
+	// metadata but no libvirt domain for it. The metadata is
+	// removed so kubelet can re-create the container.
+	DriftContainerWithoutDomain DriftKind = "container-without-domain"
+	// DriftDomainWithoutContainer means that there's a Virtlet
+	// domain that doesn't belong to any container. The domain is
+	// destroyed and undefined.
+	DriftDomainWithoutContainer DriftKind = "domain-without-container"
+	// DriftVolumeWithoutContainer means that there's a root or
+	// qcow2 flexvolume volume in the storage pool that doesn't
+	// belong to any container. The volume is removed. The preserved
+	// volumes are never considered orphaned.
+	DriftVolumeWithoutContainer DriftKind = "volume-without-container"
+	// DriftConfigISOWithoutContainer means that there's a
+	// cloud-init config ISO or fw_cfg seed directory that doesn't
+	// belong to any container. The ISO file or the directory is
+	// removed.
+	DriftConfigISOWithoutContainer DriftKind = "config-iso-without-container"
+	// DriftAutostartMismatch means that libvirt autostart flag of
+	// the domain doesn't match VirtletAutostart annotation of the
+	// container, taking into account that the autostart is only
+	// enabled while the container is running. The flag is fixed.
+	DriftAutostartMismatch DriftKind = "autostart-mismatch"
+)
+
+// Drift describes a single inconsistency found by Reconcile
+type Drift struct {
+	// Kind is the kind of the inconsistency
+	Kind DriftKind
+	// ContainerID is the id of the container the inconsistency
+	// relates to, if it can be determined
+	ContainerID string
+	// Name is the name of the domain or the volume or the path to
+	// the ISO file. It's empty for DriftContainerWithoutDomain.
+	Name string
+	// Repaired is true if the inconsistency was fixed
+	Repaired bool
+}
+
+// ReconcileReport contains the results of Reconcile
+type ReconcileReport struct {
+	// DryRun is true if the inconsistencies weren't repaired
+	DryRun bool
+	// Drifts lists the inconsistencies that were found
+	Drifts []Drift
+	// Errors lists the errors that happened while looking for
+	// the inconsistencies or repairing them
+	Errors []error
+}
+
+func (r *ReconcileReport) add(drift Drift, repair func() error) {
+	if !r.DryRun {
+		if err := repair(); err != nil {
+			r.Errors = append(r.Errors, err)
+		} else {
+			drift.Repaired = true
+		}
+	}
+	glog.V(1).Infof("Reconcile: %s %s %s (repaired: %v)", drift.Kind, drift.ContainerID, drift.Name, drift.Repaired)
+	r.Drifts = append(r.Drifts, drift)
+}
+
+// Reconcile looks for the inconsistencies between Virtlet metadata,
+// libvirt domains, the storage pool and the config ISOs. Unless
+// dryRun is true, it also repairs them according to the policy
+// described for each DriftKind. The containers without domains are
+// handled first, so their volumes and ISOs are considered orphaned
+// during the same run. The warm VMs aren't considered orphaned.
+// No containers are created while Reconcile is running.
+func (v *VirtualizationTool) Reconcile(dryRun bool) *ReconcileReport {
+	v.reconcileLock.Lock()
+	defer v.reconcileLock.Unlock()
+
+	report := &ReconcileReport{DryRun: dryRun}
+	ids, fatal, errs := v.retrieveListOfContainerIDs()
+	report.Errors = append(report.Errors, errs...)
+	if fatal {
+		return report
+	}
+
+	owned := make(map[string]bool)
+	for _, id := range ids {
+		domain, err := v.domainConn.LookupDomainByUUIDString(id)
+		switch {
+		case err == virt.ErrDomainNotFound:
+			containerID := id
+			report.add(Drift{Kind: DriftContainerWithoutDomain, ContainerID: containerID}, func() error {
+				return v.removeContainerMetadata(containerID)
+			})
+		case err != nil:
+			report.Errors = append(report.Errors, fmt.Errorf("cannot look up domain %q: %v", id, err))
+			// don't touch anything that may belong to the container
+			owned[id] = true
+		default:
+			owned[id] = true
+			v.reconcileAutostart(id, domain, report)
+		}
+	}
+
+	v.warmPoolLock.Lock()
+	for _, vm := range v.warmVMs {
+		owned[vm.config.DomainUUID] = true
+	}
+	v.warmPoolLock.Unlock()
+
+	v.reconcileDomains(owned, report)
+	v.reconcileVolumes(owned, report)
+	v.reconcileConfigISOs(owned, report)
+	if !dryRun {
+		// the domains may have been removed, so the external
+		// volumes they used are no longer claimed
+		if err := v.reloadVolumeClaims(); err != nil {
+			report.Errors = append(report.Errors, fmt.Errorf("cannot reload external volume claims: %v", err))
+		}
+		if err := v.reloadPCIDeviceClaims(); err != nil {
+			report.Errors = append(report.Errors, fmt.Errorf("cannot reload PCI device claims: %v", err))
+		}
+	}
+	return report
+}
+
+func (v *VirtualizationTool) removeContainerMetadata(containerID string) error {
+	defer v.containerLocks.lock(containerID)()
+	if err := v.metadataStore.Container(containerID).Save(
+		func(_ *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+			return nil, nil // delete container
+		},
+	); err != nil {
+		return fmt.Errorf("cannot remove metadata of container %q: %v", containerID, err)
+	}
+	return nil
+}
+
+func (v *VirtualizationTool) reconcileDomains(owned map[string]bool, report *ReconcileReport) {
+	domains, err := v.domainConn.ListDomains()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("cannot list domains: %v", err))
+		return
+	}
+
+	for _, domain := range domains {
+		name, err := domain.Name()
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Errorf("cannot retrieve domain name: %v", err))
+			continue
+		}
+		// leave alone the domains that aren't created by Virtlet
+		if !strings.HasPrefix(name, "virtlet-") {
+			continue
+		}
+		uuid, err := domain.UUIDString()
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Errorf("cannot retrieve uuid of domain %q: %v", name, err))
+			continue
+		}
+		if owned[uuid] {
+			continue
+		}
+		d := domain
+		report.add(Drift{Kind: DriftDomainWithoutContainer, ContainerID: uuid, Name: name}, func() error {
+			// ignore errors from stopping domain - it can be (and probably is) already stopped
+			d.Destroy()
+			if err := d.Undefine(); err != nil {
+				return fmt.Errorf("cannot undefine domain %q: %v", name, err)
+			}
+			return nil
+		})
+	}
+}
+
+// volumeOwnerID returns the id of the container the volume belongs
+// to, or an empty string if it's not a container volume.
+// Container ids are uuids, so the id ends at its fixed length.
+func volumeOwnerID(volumeName string) string {
+	const uuidLen = 36
+	var rest string
+	switch {
+	case strings.HasPrefix(volumeName, "virtlet_root_"):
+		rest = strings.TrimPrefix(volumeName, "virtlet_root_")
+		if len(rest) != uuidLen {
+			return ""
+		}
+	case strings.HasPrefix(volumeName, "virtlet-"):
+		rest = strings.TrimPrefix(volumeName, "virtlet-")
+		if len(rest) < uuidLen+2 || rest[uuidLen] != '-' {
+			return ""
+		}
+	default:
+		return ""
+	}
+	return rest[:uuidLen]
+}
+
+func (v *VirtualizationTool) reconcileVolumes(owned map[string]bool, report *ReconcileReport) {
+	storagePool, err := v.StoragePool()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("cannot get the storage pool: %v", err))
+		return
+	}
+	volumes, err := storagePool.ListAllVolumes()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("cannot list libvirt volumes: %v", err))
+		return
+	}
+
+	for _, volume := range volumes {
+		name := volume.Name()
+		id := volumeOwnerID(name)
+		if id == "" || owned[id] {
+			continue
+		}
+		vol := volume
+		report.add(Drift{Kind: DriftVolumeWithoutContainer, ContainerID: id, Name: name}, func() error {
+			if err := vol.Remove(); err != nil {
+				return fmt.Errorf("cannot remove volume %q: %v", name, err)
+			}
+			return nil
+		})
+	}
+}
+
+func (v *VirtualizationTool) reconcileConfigISOs(owned map[string]bool, report *ReconcileReport) {
+	files, err := filepath.Glob(filepath.Join(configIsoDir, configFilenameTemplate))
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("error while globbing %q files in %q directory: %v", configFilenameTemplate, configIsoDir, err))
+		return
+	}
+	sort.Strings(files)
+
+	for _, path := range files {
+		id := configImageOwnerID(filepath.Base(path))
+		if owned[id] {
+			continue
+		}
+		isoPath := path
+		report.add(Drift{Kind: DriftConfigISOWithoutContainer, ContainerID: id, Name: isoPath}, func() error {
+			if err := os.Remove(isoPath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("cannot remove config ISO %q: %v", isoPath, err)
+			}
+			return nil
+		})
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(configIsoDir, seedDirTemplate))
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("error while globbing %q directories in %q directory: %v", seedDirTemplate, configIsoDir, err))
+		return
+	}
+	sort.Strings(dirs)
+
+	for _, path := range dirs {
+		id := strings.TrimPrefix(filepath.Base(path), "seed-")
+		if owned[id] {
+			continue
+		}
+		seedDir := path
+		report.add(Drift{Kind: DriftConfigISOWithoutContainer, ContainerID: id, Name: seedDir}, func() error {
+			if err := os.RemoveAll(seedDir); err != nil {
+				return fmt.Errorf("cannot remove seed directory %q: %v", seedDir, err)
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+const (
+	orphanDomainUUID = "5edfe2ad-9852-439b-bbfb-3fe8b7c72906"
+	orphanVolumeUUID = "8a6163c3-e4ee-488f-836a-d2abe92d0744"
+	orphanISOUUID    = "13f51f8d-0f4e-4538-9db0-413380ff9c84"
+)
+
+func sortDrifts(drifts []Drift) {
+	sort.Slice(drifts, func(i, j int) bool {
+		if drifts[i].Kind != drifts[j].Kind {
+			return drifts[i].Kind < drifts[j].Kind
+		}
+		return drifts[i].Name < drifts[j].Name
+	})
+}
+
+func TestReconcile(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandboxes := criapi.GetSandboxes(2)
+	for _, sandbox := range sandboxes {
+		ct.setPodSandbox(sandbox)
+	}
+	goodContainerID := ct.createContainer(sandboxes[0], nil)
+	ct.startContainer(goodContainerID)
+
+	// container metadata without domain
+	lostContainerID := ct.createContainer(sandboxes[1], nil)
+	lostDomain, err := ct.domainConn.LookupDomainByUUIDString(lostContainerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	if err := lostDomain.Undefine(); err != nil {
+		t.Fatalf("Undefine(): %v", err)
+	}
+
+	// domain without metadata
+	orphanDomainName := "virtlet-" + orphanDomainUUID[:13] + "-container1"
+	if _, err := ct.domainConn.DefineDomain(&libvirtxml.Domain{
+		Name: orphanDomainName,
+		UUID: orphanDomainUUID,
+	}); err != nil {
+		t.Fatalf("DefineDomain(): %v", err)
+	}
+	// domains not created by Virtlet are left alone
+	if _, err := ct.domainConn.DefineDomain(&libvirtxml.Domain{
+		Name: "other-than-virtlet-domain",
+		UUID: "12fdc902-3345-4d8e-a3f1-11a091e59455",
+	}); err != nil {
+		t.Fatalf("DefineDomain(): %v", err)
+	}
+
+	// volumes without owners
+	pool, err := ct.virtTool.StoragePool()
+	if err != nil {
+		t.Fatalf("StoragePool(): %v", err)
+	}
+	orphanVolumeName := "virtlet-" + orphanVolumeUUID + "-vol1"
+	for _, name := range []string{orphanVolumeName, "preserved_20180101_" + orphanVolumeName} {
+		if _, err := pool.CreateStorageVol(&libvirtxml.StorageVolume{
+			Name:   name,
+			Target: &libvirtxml.StorageVolumeTarget{Path: "/some/path/" + name},
+		}); err != nil {
+			t.Fatalf("CreateStorageVol(): %v", err)
+		}
+	}
+
+	// config ISO without container
+	orphanISOPath := filepath.Join(configIsoDir, "config-"+orphanISOUUID+".iso")
+	if f, err := os.Create(orphanISOPath); err != nil {
+		t.Fatalf("Create(): %v", err)
+	} else {
+		f.Close()
+	}
+	lostISOPath := filepath.Join(configIsoDir, "config-"+lostContainerID+".iso")
+
+	expectedDrifts := []Drift{
+		{Kind: DriftConfigISOWithoutContainer, ContainerID: orphanISOUUID, Name: orphanISOPath},
+		{Kind: DriftConfigISOWithoutContainer, ContainerID: lostContainerID, Name: lostISOPath},
+		{Kind: DriftContainerWithoutDomain, ContainerID: lostContainerID},
+		{Kind: DriftDomainWithoutContainer, ContainerID: orphanDomainUUID, Name: orphanDomainName},
+		{Kind: DriftVolumeWithoutContainer, ContainerID: orphanVolumeUUID, Name: orphanVolumeName},
+		{Kind: DriftVolumeWithoutContainer, ContainerID: lostContainerID, Name: "virtlet_root_" + lostContainerID},
+	}
+	sortDrifts(expectedDrifts)
+
+	for _, dryRun := range []bool{true, false} {
+		report := ct.virtTool.Reconcile(dryRun)
+		if len(report.Errors) != 0 {
+			t.Errorf("Reconcile(%v) errors: %v", dryRun, report.Errors)
+		}
+		if report.DryRun != dryRun {
+			t.Errorf("bad DryRun value in the report")
+		}
+		sortDrifts(report.Drifts)
+		for n := range expectedDrifts {
+			expectedDrifts[n].Repaired = !dryRun
+		}
+		if !reflect.DeepEqual(report.Drifts, expectedDrifts) {
+			t.Errorf("Reconcile(%v): bad drifts:\n%s\ninstead of\n%s", dryRun, spew.Sdump(report.Drifts), spew.Sdump(expectedDrifts))
+		}
+
+		expectedContainerCount, expectedDomainCount, expectedVolumeCount := 2, 3, 4
+		if !dryRun {
+			expectedContainerCount, expectedDomainCount, expectedVolumeCount = 1, 2, 2
+		}
+		// ListContainers() only lists the containers that have
+		// domains, so the metadata store is checked directly
+		if ids, _, errs := ct.virtTool.retrieveListOfContainerIDs(); len(errs) != 0 {
+			t.Errorf("retrieveListOfContainerIDs(): %v", errs)
+		} else if len(ids) != expectedContainerCount {
+			t.Errorf("Reconcile(%v): %d containers instead of %d", dryRun, len(ids), expectedContainerCount)
+		}
+		if domains, err := ct.domainConn.ListDomains(); err != nil {
+			t.Errorf("ListDomains(): %v", err)
+		} else if len(domains) != expectedDomainCount {
+			t.Errorf("Reconcile(%v): %d domains instead of %d", dryRun, len(domains), expectedDomainCount)
+		}
+		if volumes, err := pool.ListAllVolumes(); err != nil {
+			t.Errorf("ListAllVolumes(): %v", err)
+		} else if len(volumes) != expectedVolumeCount {
+			t.Errorf("Reconcile(%v): %d volumes instead of %d", dryRun, len(volumes), expectedVolumeCount)
+		}
+		for _, path := range []string{orphanISOPath, lostISOPath} {
+			_, err := os.Stat(path)
+			if dryRun && err != nil {
+				t.Errorf("Reconcile(%v): %q was removed", dryRun, path)
+			} else if !dryRun && !os.IsNotExist(err) {
+				t.Errorf("Reconcile(%v): %q wasn't removed", dryRun, path)
+			}
+		}
+	}
+
+	// the container that's intact must still be usable
+	ct.stopContainer(goodContainerID)
+	ct.removeContainer(goodContainerID)
+
+	report := ct.virtTool.Reconcile(true)
+	if len(report.Errors) != 0 || len(report.Drifts) != 0 {
+		t.Errorf("unexpected drifts or errors after repair:\n%s", spew.Sdump(report))
+	}
+}
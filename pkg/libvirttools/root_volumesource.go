@@ -17,10 +17,14 @@ limitations under the License.
 package libvirttools
 
 import (
+	"errors"
 	"fmt"
+	"path/filepath"
 
+	"github.com/golang/glog"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 
+	"github.com/Mirantis/virtlet/pkg/image"
 	"github.com/Mirantis/virtlet/pkg/virt"
 )
 
@@ -32,29 +36,35 @@ type rootVolume struct {
 var _ VMVolume = &rootVolume{}
 
 // GetRootVolume returns volume source for root volume clone.
-func GetRootVolume(config *VMConfig, owner volumeOwner) ([]VMVolume, error) {
-	return []VMVolume{
+// If the root disk of the VM is read-only, the writable rootfs
+// overlay volume is returned, too.
+func GetRootVolume(config *VMConfig, owner VolumeOwner) ([]VMVolume, error) {
+	volumes := []VMVolume{
 		&rootVolume{
 			volumeBase{config, owner},
 		},
-	}, nil
+	}
+	if config.ReadonlyRootfs {
+		volumes = append(volumes, &rootfsOverlayVolume{
+			volumeBase{config, owner},
+		})
+	}
+	return volumes, nil
 }
 
 func (v *rootVolume) volumeName() string {
 	return "virtlet_root_" + v.config.DomainUUID
 }
 
-func (v *rootVolume) createVolume() (virt.StorageVolume, error) {
-	imagePath, virtualSize, err := v.owner.ImageManager().GetImagePathAndVirtualSize(v.config.Image)
+func (v *rootVolume) createVolume(imagePath string, virtualSize uint64) (virt.StorageVolume, error) {
+	storagePool, err := v.owner.StoragePool()
 	if err != nil {
 		return nil, err
 	}
-
-	storagePool, err := v.owner.StoragePool()
-	if err != nil {
+	if err := removeStaleVolume(v.owner, storagePool, v.volumeName(), v.config.DomainUUID); err != nil {
 		return nil, err
 	}
-	return storagePool.CreateStorageVol(&libvirtxml.StorageVolume{
+	return createStorageVolume(v.owner, storagePool, v.config.DomainUUID, &libvirtxml.StorageVolume{
 		Type: "file",
 		Name: v.volumeName(),
 		Allocation: &libvirtxml.StorageVolumeSize{
@@ -75,10 +85,62 @@ func (v *rootVolume) createVolume() (virt.StorageVolume, error) {
 	})
 }
 
+// removeStaleVolume removes the volume of the container left behind
+// by an earlier failed attempt to create the container, so the retry
+// starts from scratch. The volume is only removed if there's no
+// domain that may be using it.
+func removeStaleVolume(owner VolumeOwner, storagePool virt.StoragePool, volumeName, domainUUID string) error {
+	switch _, err := storagePool.LookupVolumeByName(volumeName); {
+	case err == virt.ErrStorageVolumeNotFound:
+		return nil
+	case err != nil:
+		return err
+	}
+
+	switch _, err := owner.DomainConnection().LookupDomainByUUIDString(domainUUID); {
+	case err == nil:
+		return fmt.Errorf("volume %q is already in use by domain %q", volumeName, domainUUID)
+	case err != virt.ErrDomainNotFound:
+		return err
+	}
+
+	glog.Warningf("Removing stale volume %q", volumeName)
+	return storagePool.RemoveVolumeByName(volumeName)
+}
+
+func (v *rootVolume) queueOptions() diskQueueOptions {
+	return diskQueueOptions{
+		Queues:    v.config.ParsedAnnotations.RootVolumeQueues,
+		QueueSize: v.config.ParsedAnnotations.RootVolumeQueueSize,
+	}
+}
+
 func (v *rootVolume) UUID() string { return "" }
 
+// imageManager returns the image manager that holds the VM image,
+// which is the one of the image tenant, if it's set.
+func (v *rootVolume) imageManager() (ImageManager, error) {
+	imageManager := v.owner.ImageManager()
+	if v.config.ImageTenant == "" {
+		return imageManager, nil
+	}
+	tenantStore, ok := imageManager.(image.TenantStore)
+	if !ok {
+		return nil, fmt.Errorf("the image manager doesn't support image tenants")
+	}
+	return tenantStore.ForTenant(v.config.ImageTenant)
+}
+
 func (v *rootVolume) Setup() (*libvirtxml.DomainDisk, error) {
-	vol, err := v.createVolume()
+	imageManager, err := v.imageManager()
+	if err != nil {
+		return nil, err
+	}
+	imagePath, virtualSize, err := imageManager.GetImagePathAndVirtualSize(v.config.Image)
+	if err != nil {
+		return nil, err
+	}
+	vol, err := v.createVolume(imagePath, virtualSize)
 	if err != nil {
 		return nil, err
 	}
@@ -86,18 +148,60 @@ func (v *rootVolume) Setup() (*libvirtxml.DomainDisk, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error getting root volume path: %v", err)
 	}
+	v.config.RootImageDigest = imageDataDigest(imagePath)
 
-	return &libvirtxml.DomainDisk{
+	disk := &libvirtxml.DomainDisk{
 		Device: "disk",
 		Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "qcow2"},
 		Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: volPath}},
-	}, nil
+	}
+	if v.config.ParsedAnnotations != nil && v.config.ParsedAnnotations.RootVolumeCopyOnRead {
+		if err := setCopyOnRead(disk, imagePath); err != nil {
+			return nil, err
+		}
+	}
+	if v.config.ReadonlyRootfs {
+		if disk.Driver.CopyOnRead != "" {
+			return nil, errors.New("copy-on-read can't be used for a read-only root disk")
+		}
+		disk.ReadOnly = &libvirtxml.DomainDiskReadOnly{}
+	}
+	return disk, nil
 }
 
-func (v *rootVolume) Teardown() error {
-	storagePool, err := v.owner.StoragePool()
-	if err != nil {
-		return err
+// imageDataDigest returns the digest of the image data file
+// which is used as the backing file of the root volume, or an
+// empty string if it can't be determined. The image store names
+// the data files after the hex digests of the images. The digest
+// is stored in container metadata so the image data isn't removed
+// while the root volume exists, even after the image is pulled
+// again under the same name.
+func imageDataDigest(imagePath string) string {
+	d := "sha256:" + filepath.Base(imagePath)
+	if image.GetHexDigest(d) == "" {
+		return ""
+	}
+	return d
+}
+
+// setCopyOnRead enables copy-on-read for the disk which is an
+// overlay over the specified backing file. Copy-on-read makes
+// no sense for the disks without backing files.
+func setCopyOnRead(disk *libvirtxml.DomainDisk, backingFile string) error {
+	if backingFile == "" {
+		return errors.New("copy-on-read can only be used for disks with a backing file")
+	}
+	if disk.Driver == nil || disk.Driver.Type != "qcow2" {
+		return errors.New("copy-on-read can only be used for qcow2 disks")
 	}
-	return storagePool.RemoveVolumeByName(v.volumeName())
+	disk.Driver.CopyOnRead = "on"
+	return nil
+}
+
+func (v *rootVolume) Preserve(timestamp string) (string, error) {
+	return preserveStorageVolume(v.owner, v.volumeName(), timestamp)
+}
+
+func (v *rootVolume) Teardown() error {
+	return removeStorageVolume(v.owner, v.config, v.volumeName())
 }
@@ -17,8 +17,14 @@ limitations under the License.
 package libvirttools
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	digest "github.com/opencontainers/go-digest"
+
+	"github.com/Mirantis/virtlet/pkg/image"
 	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
 	"github.com/Mirantis/virtlet/pkg/virt"
 	"github.com/Mirantis/virtlet/pkg/virt/fake"
@@ -31,9 +37,17 @@ const (
 
 type FakeImageManager struct {
 	rec testutils.Recorder
+	err error
+	// path is the image path returned by
+	// GetImagePathAndVirtualSize, /fake/volume/path by default
+	path string
+	// imported maps the names of the imported images to
+	// the paths of the files they were imported from
+	imported map[string]string
 }
 
 var _ ImageManager = &FakeImageManager{}
+var _ image.Importer = &FakeImageManager{}
 
 func NewFakeImageManager(rec testutils.Recorder) *FakeImageManager {
 	return &FakeImageManager{
@@ -43,9 +57,27 @@ func NewFakeImageManager(rec testutils.Recorder) *FakeImageManager {
 
 func (im *FakeImageManager) GetImagePathAndVirtualSize(imageName string) (string, uint64, error) {
 	im.rec.Rec("GetImagePathAndVirtualSize", imageName)
+	if im.err != nil {
+		return "", 0, im.err
+	}
+	if im.path != "" {
+		return im.path, 424242, nil
+	}
 	return "/fake/volume/path", 424242, nil
 }
 
+func (im *FakeImageManager) ImportImage(name, srcPath string) (string, error) {
+	im.rec.Rec("ImportImage", map[string]string{"name": name, "srcPath": srcPath})
+	if im.err != nil {
+		return "", im.err
+	}
+	if im.imported == nil {
+		im.imported = make(map[string]string)
+	}
+	im.imported[name] = srcPath
+	return name + "@" + digest.FromString(srcPath).String(), nil
+}
+
 func TestRootVolumeNaming(t *testing.T) {
 	v := rootVolume{
 		volumeBase{
@@ -113,12 +145,124 @@ func TestRootVolumeLifeCycle(t *testing.T) {
 	gm.Verify(t, gm.NewYamlVerifier(rec.Content()))
 }
 
+func TestRootVolumeOverlay(t *testing.T) {
+	const imageHexDigest = "0fa6fc2f3e0d4bbf1c5ab2a4ee1ec9c24a5f7e4b9e6ed29b74f34e3a6cbd14ad"
+	rec := testutils.NewToplevelRecorder()
+	spool := fake.NewFakeStoragePool(rec.Child("volumes"), "volumes", "/fake/volumes/pool")
+	im := NewFakeImageManager(rec.Child("image"))
+	im.path = "/var/lib/virtlet/images/data/" + imageHexDigest
+
+	config := &VMConfig{DomainUUID: testUUID, Image: "rootfs image name"}
+	volumes, err := GetRootVolume(config, newFakeVolumeOwner(spool, im))
+	if err != nil {
+		t.Fatalf("GetRootVolume returned an error: %v", err)
+	}
+	if _, err := volumes[0].Setup(); err != nil {
+		t.Fatalf("Setup returned an error: %v", err)
+	}
+
+	// the only storage operation must be the creation of an empty
+	// overlay that's backed by the image, with no data copying
+	var storageCalls []string
+	for _, r := range rec.Content() {
+		if strings.HasPrefix(r.Name, "volumes") {
+			storageCalls = append(storageCalls, r.Name)
+		}
+	}
+	if expectedCalls := []string{"volumes: CreateStorageVol"}; !reflect.DeepEqual(storageCalls, expectedCalls) {
+		t.Errorf("bad storage calls: %v instead of %v", storageCalls, expectedCalls)
+	}
+	vol, err := spool.LookupVolumeByName("virtlet_root_" + testUUID)
+	if err != nil {
+		t.Fatalf("LookupVolumeByName(): %v", err)
+	}
+	if allocation, err := vol.Allocation(); err != nil {
+		t.Errorf("Allocation(): %v", err)
+	} else if allocation != 0 {
+		t.Errorf("the root volume has %d bytes allocated instead of 0", allocation)
+	}
+
+	if expectedDigest := "sha256:" + imageHexDigest; config.RootImageDigest != expectedDigest {
+		t.Errorf("bad root image digest %q instead of %q", config.RootImageDigest, expectedDigest)
+	}
+}
+
+func TestReadonlyRootfs(t *testing.T) {
+	rec := testutils.NewToplevelRecorder()
+	spool := fake.NewFakeStoragePool(rec.Child("volumes"), "volumes", "/fake/volumes/pool")
+	im := NewFakeImageManager(rec.Child("image"))
+
+	config := &VMConfig{DomainUUID: testUUID, Image: "rootfs image name", ReadonlyRootfs: true}
+	volumes, err := GetRootVolume(config, newFakeVolumeOwner(spool, im))
+	if err != nil {
+		t.Fatalf("GetRootVolume returned an error: %v", err)
+	}
+	if len(volumes) != 2 {
+		t.Fatalf("GetRootVolume returned %d volumes instead of 2", len(volumes))
+	}
+
+	rootDisk, err := volumes[0].Setup()
+	if err != nil {
+		t.Fatalf("Setup returned an error for the root volume: %v", err)
+	}
+	if rootDisk.ReadOnly == nil {
+		t.Errorf("the root disk is not read-only")
+	}
+
+	overlayDisk, err := volumes[1].Setup()
+	if err != nil {
+		t.Fatalf("Setup returned an error for the overlay volume: %v", err)
+	}
+	if overlayDisk.ReadOnly != nil {
+		t.Errorf("the overlay disk is read-only")
+	}
+	overlayVolumeName := "virtlet-" + testUUID + "-rootfs-overlay"
+	vol, err := spool.LookupVolumeByName(overlayVolumeName)
+	if err != nil {
+		t.Fatalf("the overlay volume wasn't created: %v", err)
+	}
+	if path, err := vol.Path(); err != nil {
+		t.Errorf("Path(): %v", err)
+	} else if overlayDisk.Source.File == nil || overlayDisk.Source.File.File != path {
+		t.Errorf("the overlay disk doesn't refer to the overlay volume %q", path)
+	}
+	if volumes[1].UUID() == "" {
+		t.Errorf("the overlay volume has no uuid, so the guest can't locate it")
+	}
+
+	for _, v := range volumes {
+		if err := v.Teardown(); err != nil {
+			t.Errorf("Teardown returned an error: %v", err)
+		}
+	}
+	if _, err := spool.LookupVolumeByName(overlayVolumeName); err != virt.ErrStorageVolumeNotFound {
+		t.Errorf("the overlay volume wasn't removed")
+	}
+}
+
+func TestRootVolumeCopyOnRead(t *testing.T) {
+	disk := &libvirtxml.DomainDisk{Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "qcow2"}}
+	if err := setCopyOnRead(disk, ""); err == nil {
+		t.Errorf("setCopyOnRead() didn't fail for a disk without a backing file")
+	}
+	rawDisk := &libvirtxml.DomainDisk{Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw"}}
+	if err := setCopyOnRead(rawDisk, "/fake/volume/path"); err == nil {
+		t.Errorf("setCopyOnRead() didn't fail for a raw disk")
+	}
+	if err := setCopyOnRead(disk, "/fake/volume/path"); err != nil {
+		t.Errorf("setCopyOnRead(): %v", err)
+	} else if disk.Driver.CopyOnRead != "on" {
+		t.Errorf("bad copy_on_read value %q", disk.Driver.CopyOnRead)
+	}
+}
+
 type fakeVolumeOwner struct {
 	storagePool  *fake.FakeStoragePool
 	imageManager *FakeImageManager
+	domainConn   virt.DomainConnection
 }
 
-var _ volumeOwner = fakeVolumeOwner{}
+var _ VolumeOwner = fakeVolumeOwner{}
 
 func newFakeVolumeOwner(storagePool *fake.FakeStoragePool, imageManager *FakeImageManager) *fakeVolumeOwner {
 	return &fakeVolumeOwner{
@@ -132,7 +276,7 @@ func (vo fakeVolumeOwner) StoragePool() (virt.StoragePool, error) {
 }
 
 func (vo fakeVolumeOwner) DomainConnection() virt.DomainConnection {
-	return nil
+	return vo.domainConn
 }
 
 func (vo fakeVolumeOwner) ImageManager() ImageManager {
@@ -142,3 +286,9 @@ func (vo fakeVolumeOwner) ImageManager() ImageManager {
 func (vo fakeVolumeOwner) RawDevices() []string { return nil }
 
 func (vo fakeVolumeOwner) KubeletRootDir() string { return "" }
+
+func (vo fakeVolumeOwner) SkipNoopConfigISO() bool { return false }
+
+func (vo fakeVolumeOwner) ConfigISOInPool() bool { return false }
+
+func (vo fakeVolumeOwner) ReclaimStorage(domainUUID string) bool { return false }
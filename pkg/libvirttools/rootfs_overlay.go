@@ -0,0 +1,142 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const (
+	// rootfsOverlaySize is the size of the writable overlay
+	// volume of the VMs with read-only root disk
+	rootfsOverlaySize = 1024 * 1024 * 1024
+	// rootfsOverlayMountPoint is the guest directory the overlay
+	// volume is mounted on. It's located on tmpfs, so it can be
+	// created while the root filesystem is read-only.
+	rootfsOverlayMountPoint = "/run/virtlet-rootfs-overlay"
+	rootfsOverlayLabel      = "rootfs-overlay"
+)
+
+// rootfsOverlayPaths lists the guest directories that are made
+// writable using overlayfs with the upper layer on the overlay volume
+var rootfsOverlayPaths = []string{"/etc", "/var", "/home", "/tmp"}
+
+// rootfsOverlayVolume denotes the writable volume that holds the
+// mutable state of the VM with read-only root disk
+type rootfsOverlayVolume struct {
+	volumeBase
+}
+
+var _ VMVolume = &rootfsOverlayVolume{}
+
+func (v *rootfsOverlayVolume) volumeName() string {
+	return "virtlet-" + v.config.DomainUUID + "-rootfs-overlay"
+}
+
+// UUID returns the uuid of the overlay volume which is used to find
+// the device of the volume in the guest
+func (v *rootfsOverlayVolume) UUID() string {
+	return rootfsOverlayUUID(v.config)
+}
+
+func rootfsOverlayUUID(config *VMConfig) string {
+	return utils.NewUUID5(ContainerNsUUID, config.DomainUUID+"-rootfs-overlay")
+}
+
+func (v *rootfsOverlayVolume) Setup() (*libvirtxml.DomainDisk, error) {
+	storagePool, err := v.owner.StoragePool()
+	if err != nil {
+		return nil, err
+	}
+	if err := removeStaleVolume(v.owner, storagePool, v.volumeName(), v.config.DomainUUID); err != nil {
+		return nil, err
+	}
+	vol, err := createStorageVolume(v.owner, storagePool, v.config.DomainUUID, &libvirtxml.StorageVolume{
+		Type:       "file",
+		Name:       v.volumeName(),
+		Allocation: &libvirtxml.StorageVolumeSize{Unit: "b", Value: 0},
+		Capacity:   &libvirtxml.StorageVolumeSize{Unit: "b", Value: rootfsOverlaySize},
+		Target: &libvirtxml.StorageVolumeTarget{
+			Format: &libvirtxml.StorageVolumeTargetFormat{Type: "raw"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	volPath, err := vol.Path()
+	if err != nil {
+		return nil, fmt.Errorf("error getting rootfs overlay volume path: %v", err)
+	}
+	return &libvirtxml.DomainDisk{
+		Device: "disk",
+		Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw"},
+		Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: volPath}},
+	}, nil
+}
+
+func (v *rootfsOverlayVolume) Preserve(timestamp string) (string, error) {
+	return preserveStorageVolume(v.owner, v.volumeName(), timestamp)
+}
+
+func (v *rootfsOverlayVolume) Teardown() error {
+	return removeStorageVolume(v.owner, v.config, v.volumeName())
+}
+
+// rootfsOverlayScript returns the shell script that formats the
+// overlay volume upon the first boot and mounts the overlays over
+// the mutable paths of the guest
+func rootfsOverlayScript(devPath string) string {
+	lines := []string{
+		fmt.Sprintf("if ! mountpoint -q '%s'; then", rootfsOverlayMountPoint),
+		fmt.Sprintf("  mkdir -p '%s'", rootfsOverlayMountPoint),
+		fmt.Sprintf("  blkid '%s' >/dev/null || mkfs.ext4 -q -L '%s' '%s'", devPath, rootfsOverlayLabel, devPath),
+		fmt.Sprintf("  mount '%s' '%s'", devPath, rootfsOverlayMountPoint),
+	}
+	for _, p := range rootfsOverlayPaths {
+		upper, work := rootfsOverlayMountPoint+"/upper"+p, rootfsOverlayMountPoint+"/work"+p
+		lines = append(lines,
+			fmt.Sprintf("  mkdir -p '%s' '%s'", upper, work),
+			fmt.Sprintf("  mount -t overlay overlay -o 'lowerdir=%s,upperdir=%s,workdir=%s' '%s'", p, upper, work, p))
+	}
+	lines = append(lines, "fi")
+	return strings.Join(lines, "\n")
+}
+
+// addRootfsOverlay makes the guest with read-only root disk use the
+// overlay volume for its mutable paths. The overlays are mounted by
+// bootcmd, which runs upon each boot before the other cloud-init
+// modules that may need to write to these paths.
+func (g *CloudInitGenerator) addRootfsOverlay(userData map[string]interface{}, volumeMap diskPathMap) {
+	if !g.config.ReadonlyRootfs {
+		return
+	}
+	dpath, found := volumeMap[rootfsOverlayUUID(g.config)]
+	if !found {
+		glog.Errorf("Pod %s/%s: no device found for the rootfs overlay volume", g.config.PodNamespace, g.config.PodName)
+		return
+	}
+	bootcmd, _ := userData["bootcmd"].([]interface{})
+	userData["bootcmd"] = append([]interface{}{
+		[]interface{}{"sh", "-c", rootfsOverlayScript(dpath.devPath)},
+	}, bootcmd...)
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	rtSchedulerFIFO = "fifo"
+	rtSchedulerRR   = "rr"
+	// the range of the real-time priorities supported by Linux
+	minRTPriority = 1
+	maxRTPriority = 99
+)
+
+// rtRuntimeSysctlPath is the path to the sysctl that limits the
+// CPU time of the real-time tasks. Zero value means that no CPU
+// time is given to them.
+var rtRuntimeSysctlPath = "/proc/sys/kernel/sched_rt_runtime_us"
+
+// RTSchedulerConfig describes the real-time scheduling policy of
+// the vCPU threads of the VM
+type RTSchedulerConfig struct {
+	// Scheduler is the real-time scheduling policy, fifo or rr
+	Scheduler string
+	// Priority is the real-time priority of the threads
+	Priority int
+}
+
+// parseRTSchedulerConfig parses real-time scheduler configuration
+// in the form of [scheduler=<fifo|rr>,]priority=<1-99>. The default
+// scheduler is fifo.
+func parseRTSchedulerConfig(s string) (*RTSchedulerConfig, error) {
+	config := RTSchedulerConfig{Scheduler: rtSchedulerFIFO}
+	priorityFound := false
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad real-time scheduler option %q", item)
+		}
+		switch parts[0] {
+		case "scheduler":
+			config.Scheduler = parts[1]
+		case "priority":
+			priority, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("bad real-time priority %q", parts[1])
+			}
+			config.Priority = priority
+			priorityFound = true
+		default:
+			return nil, fmt.Errorf("unknown real-time scheduler option %q", parts[0])
+		}
+	}
+	if !priorityFound {
+		return nil, errors.New("real-time priority must be specified")
+	}
+	return &config, nil
+}
+
+func (c *RTSchedulerConfig) validate() error {
+	if c.Scheduler != rtSchedulerFIFO && c.Scheduler != rtSchedulerRR {
+		return fmt.Errorf("bad real-time scheduler %q, must be %q or %q", c.Scheduler, rtSchedulerFIFO, rtSchedulerRR)
+	}
+	if c.Priority < minRTPriority || c.Priority > maxRTPriority {
+		return fmt.Errorf("bad real-time priority %d, must be between %d and %d", c.Priority, minRTPriority, maxRTPriority)
+	}
+	return nil
+}
+
+// checkRTScheduling verifies that the real-time tasks can run on
+// this node
+func checkRTScheduling() error {
+	data, err := ioutil.ReadFile(rtRuntimeSysctlPath)
+	if err != nil {
+		return fmt.Errorf("can't check whether real-time scheduling is enabled: %v", err)
+	}
+	if strings.TrimSpace(string(data)) == "0" {
+		return fmt.Errorf("real-time scheduling is disabled on the node (%s is 0)", rtRuntimeSysctlPath)
+	}
+	return nil
+}
+
+// applyRTScheduler sets the real-time scheduling policy specified
+// using VirtletRTScheduler annotation for the vCPU threads of the VM.
+// The emulator threads keep the normal scheduling policy. The
+// real-time vCPUs may starve the emulator threads that run on the
+// same host CPUs, so the emulator must be pinned to separate CPUs
+// using VirtletEmulatorPin and VirtletIsolateEmulator, which is
+// ensured during the annotation validation. It must be called after
+// applyEmulatorPin.
+func applyRTScheduler(domainDef *libvirtxml.Domain, config *VMConfig) {
+	rtConfig := config.ParsedAnnotations.RTScheduler
+	if rtConfig == nil {
+		return
+	}
+	if domainDef.CPUTune == nil {
+		domainDef.CPUTune = &libvirtxml.DomainCPUTune{}
+	}
+	vcpus := "0"
+	if domainDef.VCPU.Value > 1 {
+		vcpus = fmt.Sprintf("0-%d", domainDef.VCPU.Value-1)
+	}
+	priority := rtConfig.Priority
+	domainDef.CPUTune.VCPUSched = []libvirtxml.DomainCPUTuneVCPUSched{
+		{
+			VCPUs:     vcpus,
+			Scheduler: rtConfig.Scheduler,
+			Priority:  &priority,
+		},
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckRTScheduling(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rtsched")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	savedPath := rtRuntimeSysctlPath
+	defer func() { rtRuntimeSysctlPath = savedPath }()
+
+	for _, tc := range []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{
+			name:    "default rt runtime",
+			content: "950000\n",
+			valid:   true,
+		},
+		{
+			name:    "unlimited rt runtime",
+			content: "-1\n",
+			valid:   true,
+		},
+		{
+			name:    "rt scheduling disabled",
+			content: "0\n",
+		},
+		{
+			name: "no sysctl",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rtRuntimeSysctlPath = filepath.Join(tmpDir, "sched_rt_runtime_us")
+			os.Remove(rtRuntimeSysctlPath)
+			if tc.content != "" {
+				if err := ioutil.WriteFile(rtRuntimeSysctlPath, []byte(tc.content), 0644); err != nil {
+					t.Fatalf("WriteFile(): %v", err)
+				}
+			}
+			err := checkRTScheduling()
+			switch {
+			case tc.valid && err != nil:
+				t.Errorf("checkRTScheduling(): %v", err)
+			case !tc.valid && err == nil:
+				t.Errorf("checkRTScheduling() didn't fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,468 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+	"github.com/golang/glog"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/network"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// DefaultSavedStateDir is the default directory for the
+// saved VM states
+const DefaultSavedStateDir = "/var/lib/virtlet/saved"
+
+const (
+	// savedImagesSubdir is the subdirectory of the saved state
+	// dir that contains the saved state images the new VMs can
+	// be restored from
+	savedImagesSubdir = "images"
+	// guestMACLookupFunc is the shell function that prints the
+	// name of the guest network interface with the specified
+	// MAC address
+	guestMACLookupFunc = `link_for_mac() { for d in /sys/class/net/*; do if [ "$(cat "$d/address")" = "$1" ]; then echo "${d##*/}"; return 0; fi; done; echo "no network interface with MAC address $1" >&2; return 1; }`
+)
+
+// savedImageInfo describes the VM a saved state image was taken
+// from. It's stored next to the image.
+type savedImageInfo struct {
+	// ImageDigest is the digest of the image the root disk of
+	// the VM was exported to when the state was saved
+	ImageDigest string `json:"imageDigest"`
+	// MACs are the MAC addresses of the network interfaces
+	// of the VM, in the order of the interfaces
+	MACs []string `json:"macs,omitempty"`
+}
+
+// SetMemoryBackingDir enables file-backed guest memory for the
+// VMs. The files are created by the hypervisor in the specified
+// directory which must match memory_backing_dir setting of
+// libvirt's qemu.conf. File-backed memory makes it possible to
+// save and restore the VM memory quickly. Empty value disables
+// file-backed memory.
+func (v *VirtualizationTool) SetMemoryBackingDir(dir string) error {
+	if dir != "" {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("memory backing dir must be an absolute path: %q", dir)
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create memory backing dir %q: %v", dir, err)
+		}
+	}
+	v.memoryBackingDir = dir
+	return nil
+}
+
+// SetSavedStateDir sets the directory that's used to store the
+// saved VM states. Empty value means using DefaultSavedStateDir.
+func (v *VirtualizationTool) SetSavedStateDir(dir string) error {
+	if dir == "" {
+		dir = DefaultSavedStateDir
+	}
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("saved state dir must be an absolute path: %q", dir)
+	}
+	v.savedStateDir = dir
+	return nil
+}
+
+// addFileBackedMemory makes the hypervisor allocate the memory of
+// the VM in a file under the memory backing dir. The memory is
+// shared so the file always contains the current memory of the VM.
+func (ds *domainSettings) addFileBackedMemory(domain *libvirtxml.Domain) {
+	domain.MemoryBacking = &libvirtxml.DomainMemoryBacking{
+		MemorySource: &libvirtxml.DomainMemorySource{Type: "file"},
+		MemoryAccess: &libvirtxml.DomainMemoryAccess{Mode: "shared"},
+	}
+}
+
+func (v *VirtualizationTool) savedStatePath(containerID string) string {
+	return filepath.Join(v.savedStateDir, containerID+".save")
+}
+
+// SaveContainer saves the state of the running VM including its
+// memory to a file under the saved state dir and stops the VM.
+// The path to the file is recorded in the container metadata.
+func (v *VirtualizationTool) SaveContainer(containerID string) error {
+	defer v.containerLocks.lock(containerID)()
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		return fmt.Errorf("failed to look up domain %q: %v", containerID, err)
+	}
+	state, err := domain.State()
+	if err != nil {
+		return fmt.Errorf("failed to get state of the domain %q: %v", containerID, err)
+	}
+	if state != virt.DomainStateRunning {
+		return fmt.Errorf("domain %q: bad state %v upon SaveContainer()", containerID, state)
+	}
+
+	if err := os.MkdirAll(v.savedStateDir, 0700); err != nil {
+		return fmt.Errorf("failed to create saved state dir %q: %v", v.savedStateDir, err)
+	}
+	path := v.savedStatePath(containerID)
+	if err := domain.Save(path); err != nil {
+		return fmt.Errorf("failed to save the state of domain %q: %v", containerID, err)
+	}
+
+	return v.metadataStore.Container(containerID).Save(
+		func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+			if c == nil {
+				return nil, fmt.Errorf("container %q was removed while saving its state", containerID)
+			}
+			c.State = kubeapi.ContainerState_CONTAINER_EXITED
+			c.SavedStatePath = path
+			return c, nil
+		})
+}
+
+// RestoreContainer resumes the VM from the state saved by
+// SaveContainer. The saved state is removed after the VM is resumed.
+// The guest clock is resynchronized according to VirtletGuestTimeSync
+// annotation.
+func (v *VirtualizationTool) RestoreContainer(containerID string) error {
+	defer v.containerLocks.lock(containerID)()
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	switch {
+	case err != nil:
+		return err
+	case containerInfo == nil:
+		return fmt.Errorf("missing containerInfo for containerID: %s", containerID)
+	case containerInfo.SavedStatePath == "":
+		return fmt.Errorf("container %q has no saved state", containerID)
+	}
+
+	if err := v.domainConn.RestoreDomain(containerInfo.SavedStatePath); err != nil {
+		return fmt.Errorf("failed to restore domain %q from %q: %v", containerID, containerInfo.SavedStatePath, err)
+	}
+	if domain, err := v.domainConn.LookupDomainByUUIDString(containerID); err != nil {
+		glog.Warningf("Failed to look up the restored domain %q, guest time sync skipped: %v", containerID, err)
+	} else {
+		v.syncGuestTime(containerID, domain)
+	}
+
+	if err := v.metadataStore.Container(containerID).Save(
+		func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+			if c != nil {
+				c.State = kubeapi.ContainerState_CONTAINER_RUNNING
+				c.StartedAt = v.clock.Now().UnixNano()
+				c.SavedStatePath = ""
+			}
+			return c, nil
+		}); err != nil {
+		return err
+	}
+
+	removeSavedStateFile(containerInfo.SavedStatePath)
+	return nil
+}
+
+// savedImagePath returns the path to the saved state image with
+// the specified name
+func (v *VirtualizationTool) savedImagePath(name string) string {
+	return filepath.Join(v.savedStateDir, savedImagesSubdir, name+".save")
+}
+
+// savedImageInfoPath returns the path to the description of the
+// saved state image with the specified name
+func (v *VirtualizationTool) savedImageInfoPath(name string) string {
+	return filepath.Join(v.savedStateDir, savedImagesSubdir, name+".json")
+}
+
+func (v *VirtualizationTool) loadSavedImageInfo(name string) (*savedImageInfo, error) {
+	data, err := ioutil.ReadFile(v.savedImageInfoPath(name))
+	if err != nil {
+		return nil, fmt.Errorf("can't read the description of saved state image %q: %v", name, err)
+	}
+	var info savedImageInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("bad description of saved state image %q: %v", name, err)
+	}
+	return &info, nil
+}
+
+// SaveStateImage saves the state of the running VM as a saved state
+// image with the specified name, so new VMs can be restored from it
+// using VirtletRestoreFrom annotation. The VM is stopped and its root
+// disk is exported to the image store under the same name as the
+// saved state image, as the memory of the guest only matches the
+// disk contents at the moment the state is saved. The pods that are
+// restored from the saved state image must use the exported image.
+// The function returns the reference to the exported image
+// including its digest.
+func (v *VirtualizationTool) SaveStateImage(containerID, name string) (string, error) {
+	if !savedImageNameRx.MatchString(name) {
+		return "", fmt.Errorf("bad saved state image name %q. It must consist of letters, digits, '_', '.' and '-' and must not start with '.'", name)
+	}
+	defer v.containerLocks.lock(containerID)()
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	switch {
+	case err != nil:
+		return "", err
+	case containerInfo == nil:
+		return "", fmt.Errorf("container %q not found", containerID)
+	}
+	config, _, err := v.getVMConfigFromMetadata(containerID)
+	switch {
+	case err != nil:
+		return "", err
+	case config == nil:
+		return "", fmt.Errorf("container %q not found", containerID)
+	}
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up domain %q: %v", containerID, err)
+	}
+	state, err := domain.State()
+	if err != nil {
+		return "", fmt.Errorf("failed to get state of the domain %q: %v", containerID, err)
+	}
+	if state != virt.DomainStateRunning {
+		return "", fmt.Errorf("domain %q: bad state %v upon SaveStateImage()", containerID, state)
+	}
+
+	path := v.savedImagePath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("failed to create saved state image dir: %v", err)
+	}
+	if err := domain.Save(path); err != nil {
+		return "", fmt.Errorf("failed to save the state of domain %q: %v", containerID, err)
+	}
+	if err := v.metadataStore.Container(containerID).Save(
+		func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+			if c != nil {
+				c.State = kubeapi.ContainerState_CONTAINER_EXITED
+			}
+			return c, nil
+		}); err != nil {
+		removeSavedStateFile(path)
+		return "", err
+	}
+
+	// the disk is exported after the VM is stopped,
+	// so it matches the saved memory of the guest
+	ref, err := v.exportContainerImage(containerID, name)
+	if err != nil {
+		removeSavedStateFile(path)
+		return "", err
+	}
+	info := savedImageInfo{MACs: guestMACs(config.ContainerSideNetwork)}
+	if n := strings.LastIndex(ref, "@"); n >= 0 {
+		info.ImageDigest = ref[n+1:]
+	}
+	data, err := json.Marshal(info)
+	if err == nil {
+		err = ioutil.WriteFile(v.savedImageInfoPath(name), data, 0600)
+	}
+	if err != nil {
+		removeSavedStateFile(path)
+		return "", fmt.Errorf("failed to store the description of saved state image %q: %v", name, err)
+	}
+	glog.V(1).Infof("Saved the state of container %q as saved state image %q, root disk image %q", containerID, name, ref)
+	return ref, nil
+}
+
+// restoreImagePath returns the path to the saved state image the
+// VM of the container must be restored from together with its
+// description, or an empty string if the VM must be booted. The VM
+// is only restored upon its first start, as later the disks of the
+// VM no longer match the saved state. An error is returned if the
+// root disk of the VM wasn't created from the image exported
+// together with the saved state image.
+func (v *VirtualizationTool) restoreImagePath(containerID string) (string, *savedImageInfo, error) {
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	switch {
+	case err != nil:
+		return "", nil, err
+	case containerInfo == nil:
+		return "", nil, fmt.Errorf("missing containerInfo for containerID: %s", containerID)
+	case containerInfo.StartedAt != 0:
+		return "", nil, nil
+	}
+	config, _, err := v.getVMConfigFromMetadata(containerID)
+	if err != nil || config == nil || config.ParsedAnnotations.RestoreFrom == "" {
+		return "", nil, err
+	}
+	name := config.ParsedAnnotations.RestoreFrom
+	info, err := v.loadSavedImageInfo(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if info.ImageDigest == "" || containerInfo.ImageDigest != info.ImageDigest {
+		return "", nil, fmt.Errorf("can't restore container %q from saved state image %q: the root disk of the VM must be created from the image with digest %q that was exported together with the saved state, but its image digest is %q", containerID, name, info.ImageDigest, containerInfo.ImageDigest)
+	}
+	return v.savedImagePath(name), info, nil
+}
+
+// guestMACs returns the MAC addresses of the guest network
+// interfaces of the pod
+func guestMACs(csn *network.ContainerSideNetwork) []string {
+	if csn == nil || csn.Result == nil {
+		return nil
+	}
+	var macs []string
+	for _, iface := range csn.Result.Interfaces {
+		if iface.Sandbox != "" {
+			macs = append(macs, strings.ToLower(iface.Mac))
+		}
+	}
+	return macs
+}
+
+// guestIdentityScript returns the shell script that makes the guest
+// restored from a saved state image take the network identity of
+// the new VM. The network interfaces of the saved VM are found by
+// their MAC addresses and get the MAC addresses of the interfaces of
+// the new VM in the same order. Unless DHCP is used, the interfaces
+// get the static addresses and the routes from the CNI result. The
+// script then runs cloud-init so it picks up the config ISO of the
+// restored VM. The instance id of the VM differs from the one of the
+// saved VM, so cloud-init runs its per-instance modules again,
+// setting up the hostname, the SSH keys and other per-pod settings.
+func guestIdentityScript(savedMACs []string, csn *network.ContainerSideNetwork, policy ipConfigPolicy) (string, error) {
+	lines := []string{"set -e", guestMACLookupFunc}
+	macs := guestMACs(csn)
+	if len(macs) != len(savedMACs) {
+		return "", fmt.Errorf("the VM has %d network interface(s), but the saved VM had %d", len(macs), len(savedMACs))
+	}
+	var cniResult *cnicurrent.Result
+	if csn != nil {
+		cniResult = csn.Result
+	}
+	devs := make(map[int]string)
+	var gateways []net.IP
+	n := 0
+	for i := 0; cniResult != nil && i < len(cniResult.Interfaces); i++ {
+		if cniResult.Interfaces[i].Sandbox == "" {
+			continue
+		}
+		dev := fmt.Sprintf("\"$dev%d\"", n)
+		devs[i] = dev
+		lines = append(lines,
+			fmt.Sprintf("dev%d=$(link_for_mac '%s')", n, savedMACs[n]),
+			"ip link set dev "+dev+" down",
+			fmt.Sprintf("ip link set dev %s address '%s'", dev, macs[n]),
+			"ip addr flush dev "+dev,
+			"ip link set dev "+dev+" up")
+		n++
+	}
+	if cniResult != nil && policy != ipConfigDHCP {
+		for _, ipConfig := range cniResult.IPs {
+			dev, found := devs[ipConfig.Interface]
+			if !found {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("ip addr add '%s' dev %s", ipConfig.Address.String(), dev))
+			if ipConfig.Gateway != nil && !ipConfig.Gateway.IsUnspecified() {
+				gateways = append(gateways, ipConfig.Gateway)
+			}
+		}
+		for _, route := range cniResult.Routes {
+			gw := route.GW
+			if gw == nil {
+				if len(gateways) == 0 {
+					continue
+				}
+				gw = gateways[0]
+			}
+			lines = append(lines, fmt.Sprintf("ip route replace '%s' via '%s'", route.Dst.String(), gw.String()))
+		}
+	}
+	lines = append(lines, "cloud-init init")
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// restoreDomainFromImage starts the domain by restoring the state
+// saved in the specified image instead of booting it. The saved
+// definition of the VM is replaced with the one of the domain, so
+// the VM gets the name, the UUID, the disks and the network
+// interfaces of the container. After the restore, the guest clock
+// is resynchronized if requested and the guest agent, if any, is
+// used to apply the network identity and the cloud-init
+// configuration of the container. If that fails, an error is
+// returned, so the VM doesn't run with the identity of the saved VM.
+func (v *VirtualizationTool) restoreDomainFromImage(containerID string, domain virt.Domain, path string, info *savedImageInfo) error {
+	def, err := domain.XML()
+	if err != nil {
+		return fmt.Errorf("failed to get the definition of the domain %q: %v", containerID, err)
+	}
+	config, _, err := v.getVMConfigFromMetadata(containerID)
+	switch {
+	case err != nil:
+		return err
+	case config == nil:
+		return fmt.Errorf("missing containerInfo for containerID: %s", containerID)
+	}
+	script, err := guestIdentityScript(info.MACs, config.ContainerSideNetwork, config.ParsedAnnotations.IPConfigPolicy)
+	if err != nil {
+		return fmt.Errorf("can't restore domain %q from %q: %v", containerID, path, err)
+	}
+
+	glog.V(1).Infof("Restoring domain %q from saved state image %q", containerID, path)
+	if err := v.waitForDomainStart(containerID, domain, func() error {
+		if err := v.domainConn.RestoreDomainWithXML(path, def); err != nil {
+			return fmt.Errorf("failed to restore domain %q from %q: %v", containerID, path, err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	v.syncGuestTime(containerID, domain)
+
+	switch hasGuestAgent, err := domainHasGuestAgent(domain); {
+	case err != nil:
+		return fmt.Errorf("failed to get the definition of the domain %q: %v", containerID, err)
+	case !hasGuestAgent:
+		glog.Warningf("Domain %q restored from %q has no guest agent, the guest keeps the identity of the saved VM", containerID, path)
+		return nil
+	}
+	if err := v.guestExec(domain, "identity update", "/bin/sh", "-c", script); err != nil {
+		return fmt.Errorf("failed to apply the identity of the restored domain %q: %v", containerID, err)
+	}
+	return nil
+}
+
+// removeSavedState removes the saved state of the container, if any
+func (v *VirtualizationTool) removeSavedState(containerID string) error {
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	if err != nil || containerInfo == nil {
+		return err
+	}
+	if containerInfo.SavedStatePath != "" {
+		removeSavedStateFile(containerInfo.SavedStatePath)
+	}
+	return nil
+}
+
+func removeSavedStateFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("Failed to remove saved VM state %q: %v", path, err)
+	}
+}
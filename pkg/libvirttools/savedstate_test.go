@@ -0,0 +1,369 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/network"
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestSaveAndRestoreContainer(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+
+	if err := ct.virtTool.SaveContainer(containerID); err == nil {
+		t.Errorf("SaveContainer() didn't fail for a container that isn't running")
+	}
+	if err := ct.virtTool.RestoreContainer(containerID); err == nil {
+		t.Errorf("RestoreContainer() didn't fail for a container without saved state")
+	}
+
+	ct.startContainer(containerID)
+	if err := ct.virtTool.SaveContainer(containerID); err != nil {
+		t.Fatalf("SaveContainer(): %v", err)
+	}
+
+	containerInfo, err := ct.metadataStore.Container(containerID).Retrieve()
+	if err != nil {
+		t.Fatalf("Retrieve(): %v", err)
+	}
+	savedStatePath := containerInfo.SavedStatePath
+	if savedStatePath != ct.virtTool.savedStatePath(containerID) {
+		t.Errorf("bad saved state path %q", savedStatePath)
+	}
+	if containerInfo.State != kubeapi.ContainerState_CONTAINER_EXITED {
+		t.Errorf("bad container state after SaveContainer(): %v", containerInfo.State)
+	}
+	if _, err := os.Stat(savedStatePath); err != nil {
+		t.Errorf("saved state file not found: %v", err)
+	}
+	ct.verifyDomainState(containerID, virt.DomainStateShutoff)
+
+	if err := ct.virtTool.RestoreContainer(containerID); err != nil {
+		t.Fatalf("RestoreContainer(): %v", err)
+	}
+	containerInfo, err = ct.metadataStore.Container(containerID).Retrieve()
+	if err != nil {
+		t.Fatalf("Retrieve(): %v", err)
+	}
+	if containerInfo.SavedStatePath != "" {
+		t.Errorf("saved state path not cleared after RestoreContainer(): %q", containerInfo.SavedStatePath)
+	}
+	if containerInfo.State != kubeapi.ContainerState_CONTAINER_RUNNING {
+		t.Errorf("bad container state after RestoreContainer(): %v", containerInfo.State)
+	}
+	if _, err := os.Stat(savedStatePath); !os.IsNotExist(err) {
+		t.Errorf("saved state file not removed after RestoreContainer()")
+	}
+	ct.verifyDomainState(containerID, virt.DomainStateRunning)
+
+	// the saved state is removed together with the container
+	if err := ct.virtTool.SaveContainer(containerID); err != nil {
+		t.Fatalf("SaveContainer(): %v", err)
+	}
+	ct.removeContainer(containerID)
+	if _, err := os.Stat(savedStatePath); !os.IsNotExist(err) {
+		t.Errorf("saved state file not removed after RemoveContainer()")
+	}
+}
+
+func TestRestoreFromSavedImage(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandboxes := criapi.GetSandboxes(4)
+	ct.setPodSandbox(sandboxes[0])
+	savedID := ct.createContainer(sandboxes[0], nil)
+	if _, err := ct.virtTool.SaveStateImage(savedID, "appliance"); err == nil {
+		t.Errorf("SaveStateImage() didn't fail for a container that isn't running")
+	}
+	ct.startContainer(savedID)
+	if _, err := ct.virtTool.SaveStateImage(savedID, "../appliance"); err == nil {
+		t.Errorf("SaveStateImage() didn't fail for a bad image name")
+	}
+	ref, err := ct.virtTool.SaveStateImage(savedID, "appliance")
+	if err != nil {
+		t.Fatalf("SaveStateImage(): %v", err)
+	}
+	ct.verifyDomainState(savedID, virt.DomainStateShutoff)
+	imagePath := ct.virtTool.savedImagePath("appliance")
+	if _, err := os.Stat(imagePath); err != nil {
+		t.Errorf("saved state image not found: %v", err)
+	}
+	if ct.imageManager.imported["appliance"] == "" {
+		t.Errorf("the root disk wasn't exported together with the saved state")
+	}
+	info, err := ct.virtTool.loadSavedImageInfo("appliance")
+	if err != nil {
+		t.Fatalf("loadSavedImageInfo(): %v", err)
+	}
+	if expectedRef := "appliance@" + info.ImageDigest; ref != expectedRef {
+		t.Errorf("bad image ref %q instead of %q", ref, expectedRef)
+	}
+
+	// the root disk of the VM created from another image
+	// doesn't match the saved memory of the guest
+	sandboxes[1].Annotations = map[string]string{
+		"VirtletRestoreFrom": "appliance",
+	}
+	ct.setPodSandbox(sandboxes[1])
+	containerID := ct.createContainer(sandboxes[1], nil)
+	if err := ct.virtTool.StartContainer(containerID); err == nil {
+		t.Errorf("StartContainer() didn't fail for a VM with a root disk that doesn't match the saved state")
+	} else if !strings.Contains(err.Error(), "exported together with the saved state") {
+		t.Errorf("unexpected StartContainer() error: %v", err)
+	}
+	ct.verifyDomainRemoved(containerID)
+
+	ct.imageManager.path = filepath.Join("/fake/images", strings.TrimPrefix(info.ImageDigest, "sha256:"))
+	sandboxes[2].Annotations = map[string]string{
+		"VirtletRestoreFrom": "appliance",
+	}
+	ct.setPodSandbox(sandboxes[2])
+	containerID = ct.createContainer(sandboxes[2], nil)
+	start := len(ct.rec.Content())
+	ct.startContainer(containerID)
+	ct.verifyDomainState(containerID, virt.DomainStateRunning)
+
+	countStarts := func() (int, int) {
+		restores, creates := 0, 0
+		for _, r := range ct.rec.Content()[start:] {
+			switch {
+			case strings.HasSuffix(r.Name, "RestoreDomainWithXML"):
+				expectedValue := map[string]string{"path": imagePath, "uuid": containerID}
+				if !reflect.DeepEqual(r.Value, expectedValue) {
+					t.Errorf("bad RestoreDomainWithXML() call: %#v", r.Value)
+				}
+				restores++
+			case strings.HasSuffix(r.Name, ": Create"):
+				creates++
+			}
+		}
+		return restores, creates
+	}
+	if restores, creates := countStarts(); restores != 1 || creates != 0 {
+		t.Errorf("the VM wasn't restored instead of booting: %d restore(s), %d create(s)", restores, creates)
+	}
+
+	// the disks of the VM no longer match the saved state,
+	// so the VM boots when it's started again
+	ct.stopContainer(containerID)
+	ct.startContainer(containerID)
+	if restores, creates := countStarts(); restores != 1 || creates != 1 {
+		t.Errorf("the VM wasn't booted upon restart: %d restore(s), %d create(s)", restores, creates)
+	}
+
+	// the saved state image is shared between the VMs
+	ct.removeContainer(containerID)
+	if _, err := os.Stat(imagePath); err != nil {
+		t.Errorf("saved state image removed together with the container: %v", err)
+	}
+
+	// the restored VM is removed if its identity can't be updated
+	sandboxes[3].Annotations = map[string]string{
+		"VirtletRestoreFrom": "appliance",
+		"VirtletGuestAgent":  "true",
+	}
+	ct.setPodSandbox(sandboxes[3])
+	containerID = ct.createContainer(sandboxes[3], nil)
+	ct.domainConn.SetGuestExecResult(1, "cloud-init: command not found\n")
+	if err := ct.virtTool.StartContainer(containerID); err == nil {
+		t.Errorf("StartContainer() didn't fail when the identity of the VM couldn't be updated")
+	} else if !strings.Contains(err.Error(), "exited with code 1: cloud-init: command not found") {
+		t.Errorf("unexpected StartContainer() error: %v", err)
+	}
+	ct.verifyDomainRemoved(containerID)
+
+	ct.domainConn.SetGuestExecResult(0, "")
+	containerID = ct.createContainer(sandboxes[3], nil)
+	ct.startContainer(containerID)
+	ct.verifyDomainState(containerID, virt.DomainStateRunning)
+}
+
+func (ct *containerTester) verifyDomainRemoved(containerID string) {
+	if _, err := ct.domainConn.LookupDomainByUUIDString(containerID); err != virt.ErrDomainNotFound {
+		ct.t.Errorf("the domain of container %q wasn't removed: %v", containerID, err)
+	}
+}
+
+func TestGuestIdentityScript(t *testing.T) {
+	csn := buildNetworkedPodConfig(&cnicurrent.Result{
+		Interfaces: []*cnicurrent.Interface{
+			{
+				Name:    "cni0",
+				Mac:     "00:11:22:33:44:55",
+				Sandbox: "/var/run/netns/bae464f1-6ee7-4ee2-826e-33293a9de95e",
+			},
+			{
+				Name:    "ignoreme0",
+				Mac:     "00:12:34:56:78:9a",
+				Sandbox: "", // host interface
+			},
+		},
+		IPs: []*cnicurrent.IPConfig{
+			{
+				Version: "4",
+				Address: net.IPNet{
+					IP:   net.IPv4(10, 1, 90, 5),
+					Mask: net.CIDRMask(16, 32),
+				},
+				Gateway:   net.IPv4(10, 1, 0, 1),
+				Interface: 0,
+			},
+		},
+		Routes: []*cnitypes.Route{
+			{
+				Dst: net.IPNet{
+					IP:   net.IPv4zero,
+					Mask: net.CIDRMask(0, 32),
+				},
+			},
+		},
+	}, "nocloud").ContainerSideNetwork
+	linkSetup := "set -e\n" + guestMACLookupFunc + "\n" +
+		"dev0=$(link_for_mac '00:11:22:33:44:66')\n" +
+		"ip link set dev \"$dev0\" down\n" +
+		"ip link set dev \"$dev0\" address '00:11:22:33:44:55'\n" +
+		"ip addr flush dev \"$dev0\"\n" +
+		"ip link set dev \"$dev0\" up\n"
+	for _, tc := range []struct {
+		name           string
+		savedMACs      []string
+		csn            *network.ContainerSideNetwork
+		policy         ipConfigPolicy
+		expectedScript string
+		errSubstring   string
+	}{
+		{
+			name:           "no network",
+			expectedScript: "set -e\n" + guestMACLookupFunc + "\ncloud-init init\n",
+		},
+		{
+			name:      "static addresses",
+			savedMACs: []string{"00:11:22:33:44:66"},
+			csn:       csn,
+			expectedScript: linkSetup +
+				"ip addr add '10.1.90.5/16' dev \"$dev0\"\n" +
+				"ip route replace '0.0.0.0/0' via '10.1.0.1'\n" +
+				"cloud-init init\n",
+		},
+		{
+			name:           "dhcp",
+			savedMACs:      []string{"00:11:22:33:44:66"},
+			csn:            csn,
+			policy:         ipConfigDHCP,
+			expectedScript: linkSetup + "cloud-init init\n",
+		},
+		{
+			name:         "interface count mismatch",
+			csn:          csn,
+			errSubstring: "the VM has 1 network interface(s), but the saved VM had 0",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			script, err := guestIdentityScript(tc.savedMACs, tc.csn, tc.policy)
+			switch {
+			case err != nil && tc.errSubstring == "":
+				t.Errorf("guestIdentityScript(): unexpected error: %v", err)
+			case err == nil && tc.errSubstring != "":
+				t.Errorf("guestIdentityScript() didn't fail")
+			case err != nil && !strings.Contains(err.Error(), tc.errSubstring):
+				t.Errorf("guestIdentityScript(): didn't get expected substring %q in the error: %v", tc.errSubstring, err)
+			case script != tc.expectedScript:
+				t.Errorf("bad script:\n%s\nexpected:\n%s", script, tc.expectedScript)
+			}
+		})
+	}
+}
+
+func TestGuestTimeSyncOnRestore(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		annotations     map[string]string
+		expectedSetTime bool
+	}{
+		{
+			name: "guest agent",
+			annotations: map[string]string{
+				"VirtletGuestAgent":    "true",
+				"VirtletGuestTimeSync": "agent",
+			},
+			expectedSetTime: true,
+		},
+		{
+			name:        "no guest agent",
+			annotations: map[string]string{"VirtletGuestTimeSync": "agent"},
+		},
+		{
+			name:        "no time sync",
+			annotations: map[string]string{"VirtletGuestAgent": "true"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newContainerTester(t, testutils.NewToplevelRecorder())
+			defer ct.teardown()
+
+			sandbox := criapi.GetSandboxes(1)[0]
+			sandbox.Annotations = tc.annotations
+			ct.setPodSandbox(sandbox)
+			containerID := ct.createContainer(sandbox, nil)
+			ct.startContainer(containerID)
+			if err := ct.virtTool.SaveContainer(containerID); err != nil {
+				t.Fatalf("SaveContainer(): %v", err)
+			}
+
+			start := len(ct.rec.Content())
+			if err := ct.virtTool.RestoreContainer(containerID); err != nil {
+				t.Fatalf("RestoreContainer(): %v", err)
+			}
+			ct.verifyDomainState(containerID, virt.DomainStateRunning)
+
+			expectedCommand := fmt.Sprintf(`{"execute":"guest-set-time","arguments":{"time":%d}}`, ct.clock.Now().UnixNano())
+			setTime := false
+			for _, r := range ct.rec.Content()[start:] {
+				if !strings.HasSuffix(r.Name, ": GuestAgentCommand") {
+					continue
+				}
+				if r.Value != expectedCommand {
+					t.Errorf("unexpected guest agent command %v", r.Value)
+				}
+				setTime = true
+			}
+			if setTime != tc.expectedSetTime {
+				t.Errorf("guest-set-time issued: %v, expected: %v", setTime, tc.expectedSetTime)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const (
+	// defaultScratchDiskMountPoint is the guest directory the
+	// scratch disk is mounted on unless specified otherwise
+	// using VirtletScratchDiskMountPoint annotation
+	defaultScratchDiskMountPoint = "/mnt/scratch"
+	scratchDiskLabel             = "scratch"
+)
+
+// scratchVolume denotes the empty throwaway volume that's created
+// for the VM scratch data and removed together with the VM
+type scratchVolume struct {
+	volumeBase
+}
+
+var _ VMVolume = &scratchVolume{}
+
+// GetScratchVolume returns the scratch volume of the VM if the scratch
+// disk is requested using VirtletScratchDiskSize annotation
+func GetScratchVolume(config *VMConfig, owner VolumeOwner) ([]VMVolume, error) {
+	if config.ParsedAnnotations == nil || config.ParsedAnnotations.ScratchDiskSize <= 0 {
+		return nil, nil
+	}
+	return []VMVolume{&scratchVolume{volumeBase{config, owner}}}, nil
+}
+
+func (v *scratchVolume) volumeName() string {
+	return "virtlet-" + v.config.DomainUUID + "-scratch"
+}
+
+// UUID returns the uuid of the scratch volume which is used to find
+// the device of the volume in the guest
+func (v *scratchVolume) UUID() string {
+	return scratchVolumeUUID(v.config)
+}
+
+func scratchVolumeUUID(config *VMConfig) string {
+	return utils.NewUUID5(ContainerNsUUID, config.DomainUUID+"-scratch")
+}
+
+func (v *scratchVolume) Setup() (*libvirtxml.DomainDisk, error) {
+	storagePool, err := v.owner.StoragePool()
+	if err != nil {
+		return nil, err
+	}
+	// the scratch data must not survive the VM re-creation
+	if err := removeStaleVolume(v.owner, storagePool, v.volumeName(), v.config.DomainUUID); err != nil {
+		return nil, err
+	}
+	vol, err := createStorageVolume(v.owner, storagePool, v.config.DomainUUID, &libvirtxml.StorageVolume{
+		Type:       "file",
+		Name:       v.volumeName(),
+		Allocation: &libvirtxml.StorageVolumeSize{Unit: "b", Value: 0},
+		Capacity:   &libvirtxml.StorageVolumeSize{Unit: "b", Value: uint64(v.config.ParsedAnnotations.ScratchDiskSize)},
+		Target: &libvirtxml.StorageVolumeTarget{
+			Format: &libvirtxml.StorageVolumeTargetFormat{Type: "qcow2"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	volPath, err := vol.Path()
+	if err != nil {
+		return nil, fmt.Errorf("error getting scratch volume path: %v", err)
+	}
+	return &libvirtxml.DomainDisk{
+		Device: "disk",
+		Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "qcow2"},
+		Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: volPath}},
+	}, nil
+}
+
+func (v *scratchVolume) Teardown() error {
+	return removeStorageVolume(v.owner, v.config, v.volumeName())
+}
+
+// scratchDiskScript returns the shell script that formats the
+// scratch disk upon the first boot and mounts it
+func scratchDiskScript(devPath, mountPoint string) string {
+	return strings.Join([]string{
+		fmt.Sprintf("if ! mountpoint -q '%s'; then", mountPoint),
+		fmt.Sprintf("  mkdir -p '%s'", mountPoint),
+		fmt.Sprintf("  blkid '%s' >/dev/null || mkfs.ext4 -q -L '%s' '%s'", devPath, scratchDiskLabel, devPath),
+		fmt.Sprintf("  mount '%s' '%s'", devPath, mountPoint),
+		"fi",
+	}, "\n")
+}
+
+// addScratchDisk makes the guest format and mount the scratch disk.
+// It's done by bootcmd, so the disk is mounted upon each boot.
+func (g *CloudInitGenerator) addScratchDisk(userData map[string]interface{}, volumeMap diskPathMap) {
+	if g.config.ParsedAnnotations.ScratchDiskSize <= 0 {
+		return
+	}
+	dpath, found := volumeMap[scratchVolumeUUID(g.config)]
+	if !found {
+		glog.Errorf("Pod %s/%s: no device found for the scratch volume", g.config.PodNamespace, g.config.PodName)
+		return
+	}
+	mountPoint := g.config.ParsedAnnotations.ScratchDiskMountPoint
+	if mountPoint == "" {
+		mountPoint = defaultScratchDiskMountPoint
+	}
+	bootcmd, _ := userData["bootcmd"].([]interface{})
+	userData["bootcmd"] = append(bootcmd, []interface{}{"sh", "-c", scratchDiskScript(dpath.devPath, mountPoint)})
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"testing"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestScratchVolume(t *testing.T) {
+	rec := testutils.NewToplevelRecorder()
+	spool := fake.NewFakeStoragePool(rec.Child("volumes"), "volumes", "/fake/volumes/pool")
+	owner := newFakeVolumeOwner(spool, NewFakeImageManager(rec.Child("image")))
+
+	volumes, err := GetScratchVolume(&VMConfig{DomainUUID: testUUID}, owner)
+	if err != nil {
+		t.Fatalf("GetScratchVolume returned an error: %v", err)
+	}
+	if len(volumes) != 0 {
+		t.Errorf("GetScratchVolume returned %d volumes for a VM without scratch disk", len(volumes))
+	}
+
+	const scratchSize = 10 * 1024 * 1024 * 1024
+	config := &VMConfig{
+		DomainUUID:        testUUID,
+		ParsedAnnotations: &VirtletAnnotations{ScratchDiskSize: scratchSize},
+	}
+	volumes, err = GetScratchVolume(config, owner)
+	if err != nil {
+		t.Fatalf("GetScratchVolume returned an error: %v", err)
+	}
+	if len(volumes) != 1 {
+		t.Fatalf("GetScratchVolume returned %d volumes instead of 1", len(volumes))
+	}
+
+	disk, err := volumes[0].Setup()
+	if err != nil {
+		t.Fatalf("Setup returned an error: %v", err)
+	}
+	if disk.Driver == nil || disk.Driver.Type != "qcow2" {
+		t.Errorf("the scratch disk is not a qcow2 one")
+	}
+	scratchVolumeName := "virtlet-" + testUUID + "-scratch"
+	vol, err := spool.LookupVolumeByName(scratchVolumeName)
+	if err != nil {
+		t.Fatalf("the scratch volume wasn't created: %v", err)
+	}
+	if size, err := vol.Size(); err != nil {
+		t.Errorf("Size(): %v", err)
+	} else if size != scratchSize {
+		t.Errorf("bad scratch volume size %d instead of %d", size, scratchSize)
+	}
+	if path, err := vol.Path(); err != nil {
+		t.Errorf("Path(): %v", err)
+	} else if disk.Source.File == nil || disk.Source.File.File != path {
+		t.Errorf("the scratch disk doesn't refer to the scratch volume %q", path)
+	}
+	if _, ok := asPreservableVolume(volumes[0]); ok {
+		t.Errorf("the scratch volume must not be preservable")
+	}
+
+	if err := volumes[0].Teardown(); err != nil {
+		t.Errorf("Teardown returned an error: %v", err)
+	}
+	if _, err := spool.LookupVolumeByName(scratchVolumeName); err != virt.ErrStorageVolumeNotFound {
+		t.Errorf("the scratch volume wasn't removed")
+	}
+}
+
+func TestScratchVolumeRemovedWithContainer(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	sandbox.Annotations = map[string]string{"VirtletScratchDiskSize": "1Gi"}
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+
+	pool, err := ct.virtTool.StoragePool()
+	if err != nil {
+		t.Fatalf("StoragePool(): %v", err)
+	}
+	scratchVolumeName := "virtlet-" + containerID + "-scratch"
+	vol, err := pool.LookupVolumeByName(scratchVolumeName)
+	if err != nil {
+		t.Fatalf("the scratch volume wasn't created: %v", err)
+	}
+	if size, err := vol.Size(); err != nil {
+		t.Errorf("Size(): %v", err)
+	} else if size != 1024*1024*1024 {
+		t.Errorf("bad scratch volume size %d", size)
+	}
+
+	ct.startContainer(containerID)
+	ct.stopContainer(containerID)
+	ct.removeContainer(containerID)
+	if _, err := pool.LookupVolumeByName(scratchVolumeName); err != virt.ErrStorageVolumeNotFound {
+		t.Errorf("the scratch volume wasn't removed together with the container")
+	}
+}
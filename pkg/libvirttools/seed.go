@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const (
+	// fwCfgSeedPrefix is the prefix of the names of fw_cfg entries
+	// with cloud-init data. The guest can read the entries from
+	// /sys/firmware/qemu_fw_cfg/by_name/<name>/raw
+	fwCfgSeedPrefix = "opt/io.virtlet/cloud-init/"
+	seedDirTemplate = "seed-*"
+)
+
+// SeedDir returns a full path to the directory with the cloud-init
+// files that are passed to the VM via fw_cfg
+func (g *CloudInitGenerator) SeedDir() string {
+	return filepath.Join(g.isoDir, "seed-"+g.config.DomainUUID)
+}
+
+func (g *CloudInitGenerator) usesFwCfg() bool {
+	return g.config.ParsedAnnotations.SeedMechanism == seedMechanismFwCfg
+}
+
+// hasConfigImage returns true if the config ISO or, for fw_cfg
+// seed mechanism, the seed directory of the VM exists
+func (g *CloudInitGenerator) hasConfigImage() bool {
+	if !g.usesFwCfg() {
+		return isRegularFile(g.IsoPath())
+	}
+	fi, err := os.Stat(g.SeedDir())
+	return err == nil && fi.IsDir()
+}
+
+// writeSeedFiles replaces the contents of the seed directory with
+// the specified files
+func (g *CloudInitGenerator) writeSeedFiles(files map[string][]byte) error {
+	dir := g.SeedDir()
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("can't remove old seed directory %q: %v", dir, err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("error making seed directory %q: %v", dir, err)
+	}
+	if err := utils.WriteFiles(dir, files); err != nil {
+		return fmt.Errorf("can't write cloud-init seed files: %v", err)
+	}
+	return nil
+}
+
+// escapeQEMUOptionValue doubles the commas in the value of a qemu
+// option so they don't separate the options
+func escapeQEMUOptionValue(value string) string {
+	return strings.Replace(value, ",", ",,", -1)
+}
+
+// setupSeed adds the qemu command line arguments which pass the
+// cloud-init seed to the VM for fw_cfg and smbios seed mechanisms
+func (g *CloudInitGenerator) setupSeed(domainDef *libvirtxml.Domain) {
+	var args []string
+	switch g.config.ParsedAnnotations.SeedMechanism {
+	case seedMechanismFwCfg:
+		layout := configImageLayouts[imageTypeNoCloud]
+		names := []string{layout.userData, layout.metaData, layout.networkConfig}
+		sort.Strings(names)
+		for _, name := range names {
+			args = append(args, "-fw_cfg", fmt.Sprintf("name=%s%s,file=%s",
+				fwCfgSeedPrefix, name, escapeQEMUOptionValue(filepath.Join(g.SeedDir(), name))))
+		}
+	case seedMechanismSMBIOS:
+		// cloud-init picks NoCloud datasource right away and
+		// reads the rest of the data from the config ISO
+		serial := fmt.Sprintf("ds=nocloud;i=%s;h=%s", g.instanceID(), g.config.PodName)
+		if seedFrom := g.config.ParsedAnnotations.SeedFrom; seedFrom != "" {
+			serial += ";s=" + seedFrom
+		}
+		args = append(args, "-smbios", "type=1,serial="+escapeQEMUOptionValue(serial))
+	}
+	for _, arg := range args {
+		domainDef.QEMUCommandline.Args = append(domainDef.QEMUCommandline.Args,
+			libvirtxml.DomainQEMUCommandlineArg{Value: arg})
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const (
+	// maxStopDestroyReserve is the maximum part of the stop
+	// timeout reserved for destroying the domain
+	maxStopDestroyReserve = time.Second
+)
+
+// ShutdownMode denotes a mechanism used to shut down the VM
+// gracefully
+type ShutdownMode string
+
+const (
+	// ShutdownModeACPI means sending ACPI power button event to
+	// the VM
+	ShutdownModeACPI ShutdownMode = "acpi"
+	// ShutdownModeAgent means asking the guest agent to shut
+	// down the VM
+	ShutdownModeAgent ShutdownMode = "agent"
+	// ShutdownModeInitctl means using initctl to shut down the
+	// guest OS
+	ShutdownModeInitctl ShutdownMode = "initctl"
+	// ShutdownModeSignal means sending a signal to the init
+	// process of the guest OS
+	ShutdownModeSignal ShutdownMode = "signal"
+)
+
+// parseShutdownModes parses a comma-separated list of shutdown
+// modes, e.g. "agent,acpi"
+func parseShutdownModes(s string) ([]ShutdownMode, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var modes []ShutdownMode
+	seen := make(map[ShutdownMode]bool)
+	for _, item := range strings.Split(s, ",") {
+		mode := ShutdownMode(strings.ToLower(strings.TrimSpace(item)))
+		switch mode {
+		case ShutdownModeACPI, ShutdownModeAgent, ShutdownModeInitctl, ShutdownModeSignal:
+		default:
+			return nil, fmt.Errorf("bad shutdown mode %q. Must be one of %q, %q, %q or %q", item, ShutdownModeACPI, ShutdownModeAgent, ShutdownModeInitctl, ShutdownModeSignal)
+		}
+		if seen[mode] {
+			return nil, fmt.Errorf("duplicate shutdown mode %q", mode)
+		}
+		seen[mode] = true
+		modes = append(modes, mode)
+	}
+	return modes, nil
+}
+
+// defaultShutdownModes returns the shutdown modes used when
+// VirtletShutdownMode annotation isn't set: the guest agent, if the
+// VM has it, followed by ACPI shutdown
+func defaultShutdownModes(hasAgent bool) []ShutdownMode {
+	if hasAgent {
+		return []ShutdownMode{ShutdownModeAgent, ShutdownModeACPI}
+	}
+	return []ShutdownMode{ShutdownModeACPI}
+}
+
+// gracefulShutdownTimeout returns the part of the stop timeout that's
+// used for the graceful shutdown attempts. The rest of it, which is
+// 10% of the timeout but no more than a second, is reserved for
+// destroying the domain, so the container stops within the timeout
+// that's passed by kubelet.
+func gracefulShutdownTimeout(timeout time.Duration) time.Duration {
+	reserve := timeout / 10
+	if reserve > maxStopDestroyReserve {
+		reserve = maxStopDestroyReserve
+	}
+	return timeout - reserve
+}
+
+// containerShutdownModes returns the shutdown modes specified for
+// the container using VirtletShutdownMode annotation. It returns nil
+// if the annotation isn't set or the annotations can't be loaded.
+func (v *VirtualizationTool) containerShutdownModes(containerID string) []ShutdownMode {
+	config, _, err := v.getVMConfigFromMetadata(containerID)
+	if err != nil {
+		glog.Warningf("Can't get the shutdown modes for container %q, using the default ones: %v", containerID, err)
+		return nil
+	}
+	if config == nil || config.ParsedAnnotations == nil {
+		return nil
+	}
+	return config.ParsedAnnotations.ShutdownModes
+}
+
+// requestShutdown makes a single shutdown request using the
+// specified mode other than ACPI before the deadline. ACPI shutdown
+// requests are repeated by shutdownDomain till the VM stops.
+func (v *VirtualizationTool) requestShutdown(domain virt.Domain, mode ShutdownMode, hasAgent bool, deadline time.Time) error {
+	switch mode {
+	case ShutdownModeAgent:
+		if !hasAgent {
+			return fmt.Errorf("the VM has no guest agent")
+		}
+		if state, err := domain.State(); err != nil {
+			return err
+		} else if state != virt.DomainStateRunning {
+			return fmt.Errorf("the VM is not running")
+		}
+		return v.shutdownWithGuestAgent(domain, deadline)
+	case ShutdownModeInitctl:
+		return domain.ShutdownWithInitctl()
+	case ShutdownModeSignal:
+		return domain.ShutdownWithSignal()
+	default:
+		return fmt.Errorf("unexpected shutdown mode %q", mode)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestShutdownModes(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		annotations   map[string]string
+		expectedCalls []string
+	}{
+		{
+			name:          "default",
+			expectedCalls: []string{"Shutdown"},
+		},
+		{
+			name:          "default with guest agent",
+			annotations:   map[string]string{"VirtletGuestAgent": "true"},
+			expectedCalls: []string{"GuestAgentCommand", "ShutdownWithGuestAgent"},
+		},
+		{
+			name:          "signal",
+			annotations:   map[string]string{"VirtletShutdownMode": "signal"},
+			expectedCalls: []string{"ShutdownWithSignal"},
+		},
+		{
+			name:          "initctl then acpi",
+			annotations:   map[string]string{"VirtletShutdownMode": "initctl,acpi"},
+			expectedCalls: []string{"ShutdownWithInitctl"},
+		},
+		{
+			name: "acpi before the guest agent",
+			annotations: map[string]string{
+				"VirtletGuestAgent":   "true",
+				"VirtletShutdownMode": "acpi,agent",
+			},
+			expectedCalls: []string{"Shutdown"},
+		},
+		{
+			name:        "agent without the guest agent channel",
+			annotations: map[string]string{"VirtletShutdownMode": "agent,signal"},
+			// the agent mode is skipped
+			expectedCalls: []string{"ShutdownWithSignal"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newContainerTester(t, testutils.NewToplevelRecorder())
+			defer ct.teardown()
+
+			sandbox := criapi.GetSandboxes(1)[0]
+			sandbox.Annotations = tc.annotations
+			ct.setPodSandbox(sandbox)
+			containerID := ct.createContainer(sandbox, nil)
+			ct.startContainer(containerID)
+
+			start := len(ct.rec.Content())
+			ct.stopContainer(containerID)
+			ct.verifyDomainState(containerID, virt.DomainStateShutoff)
+			if calls := ct.domainCalls(start); !reflect.DeepEqual(calls, tc.expectedCalls) {
+				t.Errorf("bad domain calls: %v instead of %v", calls, tc.expectedCalls)
+			}
+		})
+	}
+}
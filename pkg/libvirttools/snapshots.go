@@ -0,0 +1,229 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+var snapshotNameRx = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+func findSnapshot(snapshots []metadata.SnapshotInfo, name string) int {
+	for n, s := range snapshots {
+		if s.Name == name {
+			return n
+		}
+	}
+	return -1
+}
+
+// checkSnapshotDisks verifies that all of the writable disks of the
+// domain use qcow2 images, which are needed to keep internal
+// snapshots
+func checkSnapshotDisks(domain virt.Domain) error {
+	def, err := domain.XML()
+	if err != nil {
+		return fmt.Errorf("can't get the domain definition: %v", err)
+	}
+	if def.Devices == nil {
+		return nil
+	}
+	for _, disk := range def.Devices.Disks {
+		if disk.Device == "cdrom" || disk.ReadOnly != nil || disk.Target == nil {
+			continue
+		}
+		if disk.Driver == nil || disk.Driver.Type != "qcow2" {
+			return fmt.Errorf("disk %q is not a qcow2 image", disk.Target.Dev)
+		}
+	}
+	return nil
+}
+
+func (v *VirtualizationTool) retrieveSnapshots(containerID string) ([]metadata.SnapshotInfo, error) {
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	if err != nil {
+		return nil, fmt.Errorf("can't retrieve metadata of container %q: %v", containerID, err)
+	}
+	if containerInfo == nil {
+		return nil, fmt.Errorf("container %q not found", containerID)
+	}
+	return containerInfo.Snapshots, nil
+}
+
+func (v *VirtualizationTool) saveSnapshots(containerID string, update func([]metadata.SnapshotInfo) []metadata.SnapshotInfo) error {
+	return v.metadataStore.Container(containerID).Save(
+		func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+			if c == nil {
+				return nil, fmt.Errorf("container %q not found", containerID)
+			}
+			c.Snapshots = update(c.Snapshots)
+			return c, nil
+		})
+}
+
+// CreateSnapshot takes a snapshot of the disks and the memory of
+// the running VM of the specified container. The snapshot is kept
+// inside the qcow2 images of the VM, so all of its writable disks
+// must be qcow2 ones. The snapshot is removed together with the
+// root volume when the container is removed. The blocks of the
+// disks changed after the snapshot is taken are tracked, so the
+// amount of the changes can be checked using ChangedBlocks. Failing
+// to start tracking the changes doesn't fail the snapshot.
+func (v *VirtualizationTool) CreateSnapshot(containerID, name, description string) error {
+	if !snapshotNameRx.MatchString(name) {
+		return fmt.Errorf("bad snapshot name %q", name)
+	}
+	defer v.containerLocks.lock(containerID)()
+
+	snapshots, err := v.retrieveSnapshots(containerID)
+	if err != nil {
+		return err
+	}
+	if findSnapshot(snapshots, name) >= 0 {
+		return fmt.Errorf("snapshot %q already exists for domain %q", name, containerID)
+	}
+	domain, err := v.lookupRunningDomain(containerID)
+	if err != nil {
+		return err
+	}
+	if err := checkSnapshotDisks(domain); err != nil {
+		return fmt.Errorf("can't create snapshot %q for domain %q: %v", name, containerID, err)
+	}
+
+	glog.V(1).Infof("Creating snapshot %q of domain %q", name, containerID)
+	if err := domain.CreateSnapshot(name, description); err != nil {
+		return fmt.Errorf("can't create snapshot %q for domain %q: %v", name, containerID, err)
+	}
+	createdAt := v.clock.Now().UnixNano()
+	if err := v.saveSnapshots(containerID, func(snapshots []metadata.SnapshotInfo) []metadata.SnapshotInfo {
+		return append(snapshots, metadata.SnapshotInfo{
+			Name:        name,
+			Description: description,
+			CreatedAt:   createdAt,
+		})
+	}); err != nil {
+		if rmErr := domain.RemoveSnapshot(name); rmErr != nil {
+			glog.Warningf("Failed to remove snapshot %q of domain %q: %v", name, containerID, rmErr)
+		}
+		return fmt.Errorf("can't save snapshot %q of domain %q: %v", name, containerID, err)
+	}
+	if err := v.addCheckpoint(containerID, domain, name); err != nil {
+		glog.Warningf("Failed to track the changes since snapshot %q: %v", name, err)
+	}
+	return nil
+}
+
+// ListSnapshots returns the snapshots of the VM of the specified
+// container in the order of their creation
+func (v *VirtualizationTool) ListSnapshots(containerID string) ([]metadata.SnapshotInfo, error) {
+	return v.retrieveSnapshots(containerID)
+}
+
+// RevertToSnapshot reverts the running VM of the specified
+// container to the state of the snapshot, including the memory
+// of the VM. The VM keeps running after the revert. The snapshot
+// is kept and may be reverted to again. The changes tracked since the
+// snapshot are reset.
+func (v *VirtualizationTool) RevertToSnapshot(containerID, name string) error {
+	defer v.containerLocks.lock(containerID)()
+
+	snapshots, err := v.retrieveSnapshots(containerID)
+	if err != nil {
+		return err
+	}
+	if findSnapshot(snapshots, name) < 0 {
+		return fmt.Errorf("snapshot %q not found for domain %q", name, containerID)
+	}
+	domain, err := v.lookupRunningDomain(containerID)
+	if err != nil {
+		return err
+	}
+
+	glog.V(1).Infof("Reverting domain %q to snapshot %q", containerID, name)
+	if err := domain.RevertToSnapshot(name); err != nil {
+		return fmt.Errorf("can't revert domain %q to snapshot %q: %v", containerID, name, err)
+	}
+	if err := v.addCheckpoint(containerID, domain, name); err != nil {
+		glog.Warningf("Failed to reset the changes tracked since snapshot %q: %v", name, err)
+	}
+	return nil
+}
+
+// RemoveSnapshot removes the specified snapshot of the VM of the
+// specified container. The VM doesn't have to be running.
+func (v *VirtualizationTool) RemoveSnapshot(containerID, name string) error {
+	defer v.containerLocks.lock(containerID)()
+
+	snapshots, err := v.retrieveSnapshots(containerID)
+	if err != nil {
+		return err
+	}
+	if findSnapshot(snapshots, name) < 0 {
+		return fmt.Errorf("snapshot %q not found for domain %q", name, containerID)
+	}
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		return fmt.Errorf("failed to look up domain %q: %v", containerID, err)
+	}
+
+	glog.V(1).Infof("Removing snapshot %q of domain %q", name, containerID)
+	// the snapshot may already be gone from libvirt, e.g. after
+	// a failed stop, so only the metadata is to be removed then
+	if err := domain.RemoveSnapshot(name); err != nil && err != virt.ErrSnapshotNotFound {
+		return fmt.Errorf("can't remove snapshot %q of domain %q: %v", name, containerID, err)
+	}
+	// the dirty bitmaps can only be removed from a running VM.
+	// Otherwise they're cleared if a snapshot with the same name
+	// is taken later
+	if state, err := domain.State(); err == nil && state == virt.DomainStateRunning {
+		if err := v.removeCheckpoint(containerID, domain, name); err != nil {
+			glog.Warningf("Failed to stop tracking the changes since snapshot %q: %v", name, err)
+		}
+	}
+	return v.saveSnapshots(containerID, func(snapshots []metadata.SnapshotInfo) []metadata.SnapshotInfo {
+		if n := findSnapshot(snapshots, name); n >= 0 {
+			snapshots = append(snapshots[:n], snapshots[n+1:]...)
+		}
+		return snapshots
+	})
+}
+
+// removeAllSnapshots removes the snapshots of the domain before its
+// volumes are removed. It's called with the container lock held.
+func (v *VirtualizationTool) removeAllSnapshots(containerID string, domain virt.Domain) error {
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	if err != nil {
+		return fmt.Errorf("can't retrieve metadata of container %q: %v", containerID, err)
+	}
+	if containerInfo == nil || len(containerInfo.Snapshots) == 0 {
+		return nil
+	}
+	for _, s := range containerInfo.Snapshots {
+		if err := domain.RemoveSnapshot(s.Name); err != nil && err != virt.ErrSnapshotNotFound {
+			glog.Warningf("Failed to remove snapshot %q of domain %q: %v", s.Name, containerID, err)
+		}
+	}
+	return v.saveSnapshots(containerID, func([]metadata.SnapshotInfo) []metadata.SnapshotInfo {
+		return nil
+	})
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestSnapshots(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+
+	// the VM must be running to take a snapshot
+	if err := ct.virtTool.CreateSnapshot(containerID, "snap1", ""); err == nil {
+		t.Errorf("CreateSnapshot() didn't fail for a VM that isn't running")
+	}
+
+	ct.startContainer(containerID)
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	fakeDomain := domain.(*fake.FakeDomain)
+
+	if err := ct.virtTool.CreateSnapshot(containerID, "bad/name", ""); err == nil {
+		t.Errorf("CreateSnapshot() didn't fail for a bad snapshot name")
+	}
+	firstCreatedAt := ct.clock.Now().UnixNano()
+	if err := ct.virtTool.CreateSnapshot(containerID, "snap1", "first snapshot"); err != nil {
+		t.Fatalf("CreateSnapshot(): %v", err)
+	}
+	ct.clock.Advance(time.Minute)
+	secondCreatedAt := ct.clock.Now().UnixNano()
+	if err := ct.virtTool.CreateSnapshot(containerID, "snap2", ""); err != nil {
+		t.Fatalf("CreateSnapshot(): %v", err)
+	}
+	if err := ct.virtTool.CreateSnapshot(containerID, "snap1", ""); err == nil {
+		t.Errorf("CreateSnapshot() didn't fail for a duplicate snapshot name")
+	}
+
+	snapshots, err := ct.virtTool.ListSnapshots(containerID)
+	if err != nil {
+		t.Fatalf("ListSnapshots(): %v", err)
+	}
+	expectedSnapshots := []metadata.SnapshotInfo{
+		{Name: "snap1", Description: "first snapshot", CreatedAt: firstCreatedAt},
+		{Name: "snap2", CreatedAt: secondCreatedAt},
+	}
+	if !reflect.DeepEqual(snapshots, expectedSnapshots) {
+		t.Errorf("bad snapshot list: %#v instead of %#v", snapshots, expectedSnapshots)
+	}
+	if names := fakeDomain.Snapshots(); !reflect.DeepEqual(names, []string{"snap1", "snap2"}) {
+		t.Errorf("bad domain snapshots: %#v", names)
+	}
+
+	if err := ct.virtTool.RevertToSnapshot(containerID, "snap3"); err == nil {
+		t.Errorf("RevertToSnapshot() didn't fail for an unknown snapshot")
+	}
+	if err := ct.virtTool.RevertToSnapshot(containerID, "snap1"); err != nil {
+		t.Errorf("RevertToSnapshot(): %v", err)
+	}
+
+	if err := ct.virtTool.RemoveSnapshot(containerID, "snap1"); err != nil {
+		t.Errorf("RemoveSnapshot(): %v", err)
+	}
+	if err := ct.virtTool.RemoveSnapshot(containerID, "snap1"); err == nil {
+		t.Errorf("RemoveSnapshot() didn't fail for a removed snapshot")
+	}
+	snapshots, err = ct.virtTool.ListSnapshots(containerID)
+	if err != nil {
+		t.Fatalf("ListSnapshots(): %v", err)
+	}
+	if !reflect.DeepEqual(snapshots, expectedSnapshots[1:]) {
+		t.Errorf("bad snapshot list after removal: %#v", snapshots)
+	}
+	if names := fakeDomain.Snapshots(); !reflect.DeepEqual(names, []string{"snap2"}) {
+		t.Errorf("bad domain snapshots after removal: %#v", names)
+	}
+
+	// the snapshots are kept while the container is stopped
+	// as the root volume isn't removed till RemoveContainer()
+	ct.stopContainer(containerID)
+	snapshots, err = ct.virtTool.ListSnapshots(containerID)
+	if err != nil {
+		t.Fatalf("ListSnapshots(): %v", err)
+	}
+	if !reflect.DeepEqual(snapshots, expectedSnapshots[1:]) {
+		t.Errorf("bad snapshot list after StopContainer(): %#v", snapshots)
+	}
+
+	ct.removeContainer(containerID)
+	if names := fakeDomain.Snapshots(); len(names) != 0 {
+		t.Errorf("domain snapshots weren't removed after RemoveContainer(): %#v", names)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/network"
+)
+
+// vfInterface describes an SR-IOV VF that's attached to the VM
+// as a hostdev network interface
+type vfInterface struct {
+	pciAddress *libvirtxml.DomainAddressPCI
+	mac        string
+	vlanID     int
+}
+
+// hasVFInterfaces returns true if the container side network
+// of the VM includes SR-IOV VFs
+func hasVFInterfaces(config *VMConfig) bool {
+	if config.ContainerSideNetwork == nil {
+		return false
+	}
+	for _, iface := range config.ContainerSideNetwork.Interfaces {
+		if iface.Type == network.InterfaceTypeVF {
+			return true
+		}
+	}
+	return false
+}
+
+// vfInterfaces returns the SR-IOV VFs allocated for the pod which
+// are to be attached to the VM. The VFs are bound to vfio-pci driver
+// while the pod network is being set up, and MAC address and VLAN id
+// come from the configuration of the VF done by the CNI plugin.
+func vfInterfaces(config *VMConfig) ([]vfInterface, error) {
+	if config.ContainerSideNetwork == nil {
+		return nil, nil
+	}
+	var r []vfInterface
+	for _, iface := range config.ContainerSideNetwork.Interfaces {
+		if iface.Type != network.InterfaceTypeVF {
+			continue
+		}
+		pciAddr, err := parsePCIAddress(iface.PCIAddress)
+		if err != nil {
+			return nil, fmt.Errorf("bad SR-IOV VF %q: %v", iface.Name, err)
+		}
+		r = append(r, vfInterface{
+			pciAddress: pciAddr,
+			mac:        iface.HardwareAddr.String(),
+			vlanID:     iface.VLanID,
+		})
+	}
+	return r, nil
+}
+
+// addVFInterfaces adds the SR-IOV VFs to the domain as hostdev
+// network interfaces. libvirt programs the MAC address and the VLAN
+// of each VF via its PF when the VM starts. The VFs are not managed
+// by libvirt as they're already bound to vfio-pci driver.
+func (ds *domainSettings) addVFInterfaces(domain *libvirtxml.Domain) {
+	for _, vf := range ds.vfInterfaces {
+		iface := libvirtxml.DomainInterface{
+			Managed: "no",
+			MAC:     &libvirtxml.DomainInterfaceMAC{Address: vf.mac},
+			Source: &libvirtxml.DomainInterfaceSource{
+				Hostdev: &libvirtxml.DomainInterfaceSourceHostdev{
+					PCI: &libvirtxml.DomainHostdevSubsysPCISource{
+						Address: vf.pciAddress,
+					},
+				},
+			},
+		}
+		if vf.vlanID != 0 {
+			iface.VLan = &libvirtxml.DomainInterfaceVLan{
+				Tags: []libvirtxml.DomainInterfaceVLanTag{{ID: uint(vf.vlanID)}},
+			}
+		}
+		domain.Devices.Interfaces = append(domain.Devices.Interfaces, iface)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/xml"
+	"net"
+	"reflect"
+	"testing"
+
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+	"github.com/davecgh/go-spew/spew"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/network"
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestSRIOVInterfaces(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	mustParseMAC := func(s string) net.HardwareAddr {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			t.Fatalf("ParseMAC(): %v", err)
+		}
+		return mac
+	}
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	config := ct.vmConfig(sandbox, nil)
+	config.ContainerSideNetwork = &network.ContainerSideNetwork{
+		Result: &cnicurrent.Result{},
+		Interfaces: []*network.InterfaceDescription{
+			{
+				Type:         network.InterfaceTypeTap,
+				Name:         "eth0",
+				HardwareAddr: mustParseMAC("42:a4:a6:22:80:2e"),
+			},
+			{
+				Type:         network.InterfaceTypeVF,
+				Name:         "eth1",
+				HardwareAddr: mustParseMAC("42:a4:a6:22:80:2f"),
+				PCIAddress:   "0000:03:10.2",
+				VLanID:       100,
+			},
+			{
+				Type:         network.InterfaceTypeVF,
+				Name:         "eth2",
+				HardwareAddr: mustParseMAC("42:a4:a6:22:80:30"),
+				PCIAddress:   "0000:03:10.4",
+			},
+		},
+	}
+	parsedConfig := func(config *VMConfig) *VMConfig {
+		if err := config.LoadAnnotations(); err != nil {
+			t.Fatalf("LoadAnnotations(): %v", err)
+		}
+		return config
+	}
+	vm := &warmVM{config: parsedConfig(ct.vmConfig(sandbox, nil))}
+	if !vm.matches(parsedConfig(ct.vmConfig(sandbox, nil))) {
+		t.Fatalf("the warm VM doesn't match the config without SR-IOV VFs")
+	}
+	if vm.matches(parsedConfig(config)) {
+		t.Errorf("the warm VM matches the config with SR-IOV VFs")
+	}
+
+	containerID, err := ct.virtTool.CreateContainer(config, "/tmp/fakenetns")
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	def, err := domain.XML()
+	if err != nil {
+		t.Fatalf("XML(): %v", err)
+	}
+
+	// the tap interface is added by vmwrapper
+	expectedInterfaces := []libvirtxml.DomainInterface{
+		{
+			XMLName: xml.Name{Local: "interface"},
+			Managed: "no",
+			MAC:     &libvirtxml.DomainInterfaceMAC{Address: "42:a4:a6:22:80:2f"},
+			Source: &libvirtxml.DomainInterfaceSource{
+				Hostdev: &libvirtxml.DomainInterfaceSourceHostdev{
+					PCI: &libvirtxml.DomainHostdevSubsysPCISource{
+						Address: pciAddress(0, 3, 0x10, 2).PCI,
+					},
+				},
+			},
+			VLan: &libvirtxml.DomainInterfaceVLan{
+				Tags: []libvirtxml.DomainInterfaceVLanTag{{ID: 100}},
+			},
+		},
+		{
+			XMLName: xml.Name{Local: "interface"},
+			Managed: "no",
+			MAC:     &libvirtxml.DomainInterfaceMAC{Address: "42:a4:a6:22:80:30"},
+			Source: &libvirtxml.DomainInterfaceSource{
+				Hostdev: &libvirtxml.DomainInterfaceSourceHostdev{
+					PCI: &libvirtxml.DomainHostdevSubsysPCISource{
+						Address: pciAddress(0, 3, 0x10, 4).PCI,
+					},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(def.Devices.Interfaces, expectedInterfaces) {
+		t.Errorf("bad interfaces:\n%s\ninstead of\n%s", spew.Sdump(def.Devices.Interfaces), spew.Sdump(expectedInterfaces))
+	}
+
+	ct.removeContainer(containerID)
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+var sshKeyTypes = map[string]bool{
+	"ssh-rsa":                            true,
+	"ssh-dss":                            true,
+	"ssh-ed25519":                        true,
+	"ecdsa-sha2-nistp256":                true,
+	"ecdsa-sha2-nistp384":                true,
+	"ecdsa-sha2-nistp521":                true,
+	"sk-ecdsa-sha2-nistp256@openssh.com": true,
+	"sk-ssh-ed25519@openssh.com":         true,
+}
+
+// isSSHKeyType returns true if the specified string is a type of
+// SSH public key or certificate, e.g. ssh-rsa or
+// ssh-ed25519-cert-v01@openssh.com
+func isSSHKeyType(s string) bool {
+	return sshKeyTypes[s] || sshKeyTypes[strings.TrimSuffix(s, "-cert-v01@openssh.com")] ||
+		sshKeyTypes[strings.Replace(s, "-cert-v01@openssh.com", "@openssh.com", 1)]
+}
+
+// splitSSHKeyLine splits a line of authorized_keys file into
+// space-separated fields. The spaces inside double quotes, which
+// may be used in the options, don't separate the fields.
+func splitSSHKeyLine(line string) ([]string, error) {
+	var fields []string
+	var cur []rune
+	inQuotes, escaped := false, false
+	for _, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && inQuotes:
+			escaped = true
+		case c == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && (c == ' ' || c == '\t'):
+			if len(cur) != 0 {
+				fields = append(fields, string(cur))
+				cur = nil
+			}
+			continue
+		}
+		cur = append(cur, c)
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quoted string")
+	}
+	if len(cur) != 0 {
+		fields = append(fields, string(cur))
+	}
+	return fields, nil
+}
+
+// checkSSHKeyBlob verifies that the base64-encoded key data is
+// valid and contains the key of the specified type
+func checkSSHKeyBlob(keyType, blob string) error {
+	data, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		return fmt.Errorf("the key data is not valid base64")
+	}
+	if len(data) < 4 {
+		return fmt.Errorf("the key data is too short")
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-4) || string(data[4:4+n]) != keyType {
+		return fmt.Errorf("the key data doesn't match the key type %q", keyType)
+	}
+	return nil
+}
+
+// normalizeSSHKey validates a single public key in authorized_keys
+// format ([options] keytype base64-data [comment]) and returns it
+// with the fields separated by single spaces. It also returns the
+// key type and data which identify the key.
+func normalizeSSHKey(line string) (string, string, error) {
+	fields, err := splitSSHKeyLine(line)
+	if err != nil {
+		return "", "", err
+	}
+	// the options, if any, are a single field
+	keyTypeIndex := 0
+	if len(fields) > 1 && !isSSHKeyType(fields[0]) && isSSHKeyType(fields[1]) {
+		keyTypeIndex = 1
+	}
+	if len(fields) < keyTypeIndex+2 || !isSSHKeyType(fields[keyTypeIndex]) {
+		return "", "", fmt.Errorf("not a public key in authorized_keys format")
+	}
+	keyType, blob := fields[keyTypeIndex], fields[keyTypeIndex+1]
+	if err := checkSSHKeyBlob(keyType, blob); err != nil {
+		return "", "", err
+	}
+	return strings.Join(fields, " "), keyType + " " + blob, nil
+}
+
+// parseSSHKeys parses newline-separated SSH public keys in
+// authorized_keys format. Empty lines and comment lines that start
+// with '#' are skipped. Keys already present in existingKeys
+// and the duplicate keys are skipped, too, even if they have
+// different comments or options. The keys are appended to
+// existingKeys and the resulting list is returned.
+func parseSSHKeys(existingKeys []string, keys string) ([]string, error) {
+	seen := make(map[string]bool)
+	for _, k := range existingKeys {
+		if _, id, err := normalizeSSHKey(k); err == nil {
+			seen[id] = true
+		}
+	}
+	for n, line := range strings.Split(keys, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, id, err := normalizeSSHKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("bad ssh key at line %d (%q): %v", n+1, line, err)
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		existingKeys = append(existingKeys, key)
+	}
+	return existingKeys, nil
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	fakeRSAKey     = "ssh-rsa AAAAB3NzaC1yc2FrZXkx"
+	fakeRSAKey2    = "ssh-rsa AAAAB3NzaC1yc2FrZXky"
+	fakeED25519Key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5a2V5NA=="
+)
+
+func TestParseSSHKeys(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		existingKeys []string
+		keys         string
+		expectedKeys []string
+		errorLine    string
+	}{
+		{
+			name:         "plain keys",
+			keys:         fakeRSAKey + "\n" + fakeED25519Key,
+			expectedKeys: []string{fakeRSAKey, fakeED25519Key},
+		},
+		{
+			name:         "keys with comments and extra whitespace",
+			keys:         "\n  " + fakeRSAKey + "   user@host  \t\n\n" + fakeED25519Key + "\tanother  comment\r\n",
+			expectedKeys: []string{fakeRSAKey + " user@host", fakeED25519Key + " another comment"},
+		},
+		{
+			name:         "comment lines",
+			keys:         "# my keys\n" + fakeRSAKey + "\n   # more keys\n" + fakeED25519Key,
+			expectedKeys: []string{fakeRSAKey, fakeED25519Key},
+		},
+		{
+			name: "keys with options",
+			keys: `no-port-forwarding,command="echo hello  world" ` + fakeRSAKey + " user@host\n" +
+				"from=\"10.0.0.0/8\"   " + fakeED25519Key,
+			expectedKeys: []string{
+				`no-port-forwarding,command="echo hello  world" ` + fakeRSAKey + " user@host",
+				`from="10.0.0.0/8" ` + fakeED25519Key,
+			},
+		},
+		{
+			name:         "duplicate keys",
+			keys:         fakeRSAKey + " first\n" + fakeRSAKey2 + "\n" + fakeRSAKey + " second\n" + fakeED25519Key,
+			expectedKeys: []string{fakeRSAKey + " first", fakeRSAKey2, fakeED25519Key},
+		},
+		{
+			name:         "keys already present",
+			existingKeys: []string{fakeRSAKey + " existing"},
+			keys:         fakeRSAKey + " new\n" + fakeED25519Key,
+			expectedKeys: []string{fakeRSAKey + " existing", fakeED25519Key},
+		},
+		{
+			name:         "certificate",
+			keys:         "ssh-rsa-cert-v01@openssh.com AAAAHHNzaC1yc2EtY2VydC12MDFAb3BlbnNzaC5jb20=",
+			expectedKeys: []string{"ssh-rsa-cert-v01@openssh.com AAAAHHNzaC1yc2EtY2VydC12MDFAb3BlbnNzaC5jb20="},
+		},
+		{
+			name:      "malformed line",
+			keys:      fakeRSAKey + "\nhello world\n" + fakeED25519Key,
+			errorLine: "line 2",
+		},
+		{
+			name:      "key type only",
+			keys:      "ssh-rsa",
+			errorLine: "line 1",
+		},
+		{
+			name:      "bad base64",
+			keys:      fakeRSAKey + "\nssh-rsa AAAA!!!! user@host",
+			errorLine: "line 2",
+		},
+		{
+			name:      "key data of a different type",
+			keys:      "ssh-ed25519 AAAAB3NzaC1yc2FrZXkx",
+			errorLine: "line 1",
+		},
+		{
+			name:      "unterminated quotes in options",
+			keys:      `command="echo ` + fakeRSAKey,
+			errorLine: "line 1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, err := parseSSHKeys(tc.existingKeys, tc.keys)
+			switch {
+			case tc.errorLine != "" && err == nil:
+				t.Errorf("parseSSHKeys() didn't fail")
+			case tc.errorLine != "" && !strings.Contains(err.Error(), tc.errorLine):
+				t.Errorf("the error doesn't name the bad line (%s): %v", tc.errorLine, err)
+			case tc.errorLine == "" && err != nil:
+				t.Errorf("parseSSHKeys(): %v", err)
+			case !reflect.DeepEqual(keys, tc.expectedKeys):
+				t.Errorf("bad keys:\n%#v\ninstead of\n%#v", keys, tc.expectedKeys)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// StartupConfig specifies how long StartContainer may take
+type StartupConfig struct {
+	// Timeout is the time limit for the domain to reach the
+	// running state (and its guest agent to become ready if
+	// WaitForGuestAgent is true). Zero value means using the
+	// default of 10 seconds.
+	Timeout time.Duration
+	// WaitForGuestAgent makes StartContainer wait for the guest
+	// agent to respond to a ping for the VMs that have it enabled
+	WaitForGuestAgent bool
+}
+
+func (c StartupConfig) withDefaults() StartupConfig {
+	if c.Timeout <= 0 {
+		c.Timeout = domainStartTimeout
+	}
+	return c
+}
+
+// SetStartupConfig sets the time limit for starting the VMs
+func (v *VirtualizationTool) SetStartupConfig(config StartupConfig) {
+	v.startupConfig = config.withDefaults()
+}
+
+// startDomain starts the domain and waits for it to reach the
+// running state and, if requested, for its guest agent to become
+// ready. If this doesn't happen within the configured timeout, the
+// domain is destroyed and an error is returned, so a wedged
+// hypervisor doesn't leave a half-started VM behind.
+func (v *VirtualizationTool) startDomain(containerID string, domain virt.Domain) error {
+	return v.waitForDomainStart(containerID, domain, func() error {
+		if err := domain.Create(); err != nil {
+			return fmt.Errorf("failed to create domain %q: %v", containerID, err)
+		}
+		return nil
+	})
+}
+
+// waitForDomainStart starts the domain using the specified function
+// and then waits for it like startDomain does
+func (v *VirtualizationTool) waitForDomainStart(containerID string, domain virt.Domain, start func() error) error {
+	config := v.startupConfig.withDefaults()
+	startTime := v.clock.Now()
+	if err := start(); err != nil {
+		return err
+	}
+
+	if err := utils.WaitLoop(func() (bool, error) {
+		state, err := domain.State()
+		if err != nil {
+			return false, fmt.Errorf("failed to get state of the domain %q: %v", containerID, err)
+		}
+		switch state {
+		case virt.DomainStateRunning:
+			return true, nil
+		case virt.DomainStateShutdown:
+			return false, fmt.Errorf("unexpected shutdown for new domain %q", containerID)
+		case virt.DomainStateCrashed:
+			return false, fmt.Errorf("domain %q crashed on start", containerID)
+		default:
+			return false, nil
+		}
+	}, domainStartCheckInterval, config.Timeout-v.clock.Since(startTime), v.clock); err != nil {
+		if err == utils.ErrTimeout {
+			return v.startupTimedOut(containerID, domain, "didn't reach the running state", config.Timeout)
+		}
+		return err
+	}
+
+	if !config.WaitForGuestAgent {
+		return nil
+	}
+	switch hasGuestAgent, err := domainHasGuestAgent(domain); {
+	case err != nil:
+		return fmt.Errorf("failed to get the definition of the domain %q: %v", containerID, err)
+	case !hasGuestAgent:
+		return nil
+	}
+	if err := utils.WaitLoop(func() (bool, error) {
+		// the agent is not ready till it responds to a ping
+		return v.guestAgentResponds(domain), nil
+	}, domainStartCheckInterval, config.Timeout-v.clock.Since(startTime), v.clock); err != nil {
+		if err == utils.ErrTimeout {
+			return v.startupTimedOut(containerID, domain, "didn't get a ready guest agent", config.Timeout)
+		}
+		return err
+	}
+	return nil
+}
+
+// startupTimedOut destroys the domain that failed to start in time
+// and returns the corresponding error
+func (v *VirtualizationTool) startupTimedOut(containerID string, domain virt.Domain, what string, timeout time.Duration) error {
+	glog.Warningf("Domain %q %s within %v, destroying it", containerID, what, timeout)
+	if err := domain.Destroy(); err != nil {
+		glog.Warningf("Failed to destroy domain %q: %v", containerID, err)
+	}
+	return fmt.Errorf("startup timeout: domain %q %s within %v", containerID, what, timeout)
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestStartupTimeout(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	ct.virtTool.SetStartupConfig(StartupConfig{Timeout: time.Second})
+	ct.domainConn.SetStuckOnStart(true)
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	start := len(ct.rec.Content())
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ct.virtTool.StartContainer(containerID)
+	}()
+	for elapsed := time.Duration(0); elapsed < time.Second; elapsed += domainStartCheckInterval {
+		ct.clock.BlockUntil(1)
+		ct.clock.Advance(domainStartCheckInterval)
+	}
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("StartContainer() didn't fail for a domain that never reaches the running state")
+		}
+		if !strings.Contains(err.Error(), "startup timeout") {
+			t.Errorf("bad error from StartContainer(): %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("StartContainer() is blocked by the domain that doesn't start")
+	}
+
+	// the domain is destroyed before the failed container is removed
+	calls := ct.domainCalls(start)
+	if len(calls) < 2 || !reflect.DeepEqual(calls[:2], []string{"Create", "Destroy"}) {
+		t.Errorf("bad domain calls: %v (expected Create followed by Destroy)", calls)
+	}
+	if _, err := ct.domainConn.LookupDomainByUUIDString(containerID); err != virt.ErrDomainNotFound {
+		t.Errorf("the domain that failed to start wasn't removed")
+	}
+}
+
+func TestStartupWaitsForGuestAgent(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	ct.virtTool.SetStartupConfig(StartupConfig{WaitForGuestAgent: true})
+
+	start := len(ct.rec.Content())
+	containerID := ct.startGuestAgentContainer()
+	ct.verifyDomainState(containerID, virt.DomainStateRunning)
+	calls := ct.domainCalls(start)
+	if len(calls) < 2 || !reflect.DeepEqual(calls[len(calls)-2:], []string{"Create", "GuestAgentCommand"}) {
+		t.Errorf("bad domain calls: %v (expected Create followed by GuestAgentCommand)", calls)
+	}
+}
+
+func TestStartupWithHungGuestAgent(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	ct.virtTool.SetStartupConfig(StartupConfig{WaitForGuestAgent: true, Timeout: 3 * time.Second})
+	ct.virtTool.SetGuestAgentConfig(GuestAgentConfig{Timeout: 3 * time.Second})
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	sandbox.Annotations = map[string]string{"VirtletGuestAgent": "true"}
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	ct.domainConn.SetGuestAgentHung(true)
+	defer ct.domainConn.SetGuestAgentHung(false)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ct.virtTool.StartContainer(containerID)
+	}()
+	// the ping must not block past the guest agent timeout
+	ct.domainConn.WaitForHungGuestAgentCall()
+	ct.clock.BlockUntil(1)
+	ct.clock.Advance(3 * time.Second)
+	ct.clock.BlockUntil(1)
+	ct.clock.Advance(domainStartCheckInterval)
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("StartContainer() didn't fail for a domain with hung guest agent")
+		}
+		if !strings.Contains(err.Error(), "didn't get a ready guest agent") {
+			t.Errorf("bad error from StartContainer(): %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("StartContainer() is blocked by the hung guest agent")
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// ContainerDiskUsage returns the number of bytes actually allocated
+// on the storage for the root volume and qcow2 volumes of the
+// container. For thin volumes this is less than their virtual size.
+func (v *VirtualizationTool) ContainerDiskUsage(containerID string) (uint64, error) {
+	storagePool, err := v.StoragePool()
+	if err != nil {
+		return 0, err
+	}
+	volumes, err := storagePool.ListAllVolumes()
+	if err != nil {
+		return 0, fmt.Errorf("cannot list libvirt volumes: %v", err)
+	}
+
+	var usage uint64
+	for _, volume := range volumes {
+		name := volume.Name()
+		if name != "virtlet_root_"+containerID && !strings.HasPrefix(name, "virtlet-"+containerID+"-") {
+			continue
+		}
+		allocation, err := volume.Allocation()
+		if err != nil {
+			return 0, fmt.Errorf("cannot get allocation of the volume %q: %v", name, err)
+		}
+		usage += allocation
+	}
+	return usage, nil
+}
+
+// ContainerStats returns the stats for the specified container.
+// The writable layer usage corresponds to the disk space used
+// by the VM's volumes. For the running VMs, CPU and memory usage
+// is that of the guest, without the hypervisor overhead, which is
+// reported by HostUsage.
+func (v *VirtualizationTool) ContainerStats(containerID string) (*kubeapi.ContainerStats, error) {
+	stats, err := v.containerStats(containerID)
+	if err != nil {
+		return nil, err
+	}
+	if stats == nil {
+		return nil, fmt.Errorf("missing containerInfo for containerID: %s", containerID)
+	}
+	return stats, nil
+}
+
+// containerStats returns the stats for the specified container,
+// or nil if there's no metadata for the container, e.g. because
+// it's already removed and only its tombstone is left
+func (v *VirtualizationTool) containerStats(containerID string) (*kubeapi.ContainerStats, error) {
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	if err != nil {
+		return nil, err
+	}
+	if containerInfo == nil {
+		return nil, nil
+	}
+
+	stats, err := v.collectContainerStats(containerID, containerInfo)
+	if err == nil {
+		return stats, nil
+	}
+	// The container may have been removed while its stats were
+	// being collected, in which case its volumes and its domain
+	// may be already gone.
+	if containerInfo, retrieveErr := v.metadataStore.Container(containerID).Retrieve(); retrieveErr == nil && containerInfo == nil {
+		glog.V(2).Infof("Container %s was removed while collecting its stats: %v", containerID, err)
+		return nil, nil
+	}
+	return nil, err
+}
+
+// collectContainerStats gathers the stats for the specified container
+// using its metadata
+func (v *VirtualizationTool) collectContainerStats(containerID string, containerInfo *metadata.ContainerInfo) (*kubeapi.ContainerStats, error) {
+	usage, err := v.ContainerDiskUsage(containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := v.clock.Now().UnixNano()
+	stats := &kubeapi.ContainerStats{
+		Attributes: &kubeapi.ContainerAttributes{
+			Id: containerID,
+			Metadata: &kubeapi.ContainerMetadata{
+				Name:    containerInfo.Name,
+				Attempt: containerInfo.Attempt,
+			},
+			Labels:      containerInfo.Labels,
+			Annotations: containerInfo.Annotations,
+		},
+		WritableLayer: &kubeapi.FilesystemUsage{
+			Timestamp: now,
+			UsedBytes: &kubeapi.UInt64Value{Value: usage},
+		},
+	}
+
+	domainStats, err := v.runningDomainStats(containerID)
+	if err != nil {
+		return nil, err
+	}
+	if domainStats != nil {
+		stats.Cpu = &kubeapi.CpuUsage{
+			Timestamp:            now,
+			UsageCoreNanoSeconds: &kubeapi.UInt64Value{Value: guestCPUTime(domainStats)},
+		}
+		stats.Memory = &kubeapi.MemoryUsage{
+			Timestamp:       now,
+			WorkingSetBytes: &kubeapi.UInt64Value{Value: guestMemoryUsage(domainStats)},
+		}
+	}
+	return stats, nil
+}
+
+// runningDomainStats returns the stats of the domain of the
+// specified container, or nil if the domain isn't running
+func (v *VirtualizationTool) runningDomainStats(containerID string) (*virt.DomainStats, error) {
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerID)
+	switch {
+	case err == virt.ErrDomainNotFound:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to look up domain %q: %v", containerID, err)
+	}
+	state, err := domain.State()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state of the domain %q: %v", containerID, err)
+	}
+	if state != virt.DomainStateRunning {
+		return nil, nil
+	}
+	stats, err := domain.Stats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stats of the domain %q: %v", containerID, err)
+	}
+	return stats, nil
+}
+
+// ListContainerStats returns the stats for the containers that
+// match the specified filter. The removed containers that are
+// still listed because of their tombstones are skipped.
+func (v *VirtualizationTool) ListContainerStats(filter *kubeapi.ContainerStatsFilter) ([]*kubeapi.ContainerStats, error) {
+	var containerFilter *kubeapi.ContainerFilter
+	if filter != nil {
+		containerFilter = &kubeapi.ContainerFilter{
+			Id:            filter.Id,
+			PodSandboxId:  filter.PodSandboxId,
+			LabelSelector: filter.LabelSelector,
+		}
+	}
+	containers, err := v.ListContainers(containerFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []*kubeapi.ContainerStats
+	for _, container := range containers {
+		containerStats, err := v.containerStats(container.Id)
+		if err != nil {
+			return nil, err
+		}
+		if containerStats != nil {
+			stats = append(stats, containerStats)
+		}
+	}
+	return stats, nil
+}
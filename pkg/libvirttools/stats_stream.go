@@ -0,0 +1,184 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// DefaultStatsStreamInterval is the default interval between
+// the samples of the container stats stream
+const DefaultStatsStreamInterval = time.Second
+
+// InterfaceStats contains the traffic counters of a VM network
+// interface as seen by the VM
+type InterfaceStats struct {
+	// Name is the name of the tap device of the interface
+	Name string
+	// RxBytes is the number of bytes received by the VM
+	RxBytes uint64
+	// RxPackets is the number of packets received by the VM
+	RxPackets uint64
+	// TxBytes is the number of bytes sent by the VM
+	TxBytes uint64
+	// TxPackets is the number of packets sent by the VM
+	TxPackets uint64
+}
+
+// ContainerStatsSample is a sample of the resource usage of a
+// container that's emitted by the stats stream
+type ContainerStatsSample struct {
+	virt.DomainStats
+	// Timestamp is the time the sample is taken at in nanoseconds
+	Timestamp int64
+	// Interfaces contains the traffic counters of the VM network
+	// interfaces
+	Interfaces []InterfaceStats
+}
+
+// getNICStats retrieves the traffic counters of the tap devices
+// in the specified network namespace. The counters of the tap
+// devices are swapped so they correspond to the VM side.
+func getNICStats(netNSPath string) ([]InterfaceStats, error) {
+	vmNS, err := ns.GetNS(netNSPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network namespace %q: %v", netNSPath, err)
+	}
+	defer vmNS.Close()
+
+	var r []InterfaceStats
+	if err := vmNS.Do(func(ns.NetNS) error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return fmt.Errorf("failed to list links: %v", err)
+		}
+		for _, link := range links {
+			attrs := link.Attrs()
+			if !strings.HasPrefix(attrs.Name, "tap") || attrs.Statistics == nil {
+				continue
+			}
+			r = append(r, InterfaceStats{
+				Name:      attrs.Name,
+				RxBytes:   attrs.Statistics.TxBytes,
+				RxPackets: attrs.Statistics.TxPackets,
+				TxBytes:   attrs.Statistics.RxBytes,
+				TxPackets: attrs.Statistics.RxPackets,
+			})
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// StreamContainerStats starts emitting the samples of CPU, memory
+// and network usage of the running container with the specified
+// interval until either the container stops or the stop channel
+// is closed. Non-positive interval means DefaultStatsStreamInterval.
+// The returned channel is closed when the stream ends.
+func (v *VirtualizationTool) StreamContainerStats(containerID string, interval time.Duration, stop <-chan struct{}) (<-chan *ContainerStatsSample, error) {
+	if interval <= 0 {
+		interval = DefaultStatsStreamInterval
+	}
+
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	switch {
+	case err != nil:
+		return nil, err
+	case containerInfo == nil:
+		return nil, fmt.Errorf("missing containerInfo for containerID: %s", containerID)
+	}
+
+	var netNSPath string
+	sandboxInfo, err := v.metadataStore.PodSandbox(containerInfo.SandboxID).Retrieve()
+	if err != nil {
+		return nil, err
+	}
+	if sandboxInfo != nil && sandboxInfo.ContainerSideNetwork != nil {
+		netNSPath = sandboxInfo.ContainerSideNetwork.NsPath
+	}
+
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up domain %q: %v", containerID, err)
+	}
+
+	ch := make(chan *ContainerStatsSample)
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-v.clock.After(interval):
+			}
+
+			sample, err := v.takeStatsSample(domain, netNSPath)
+			if err != nil {
+				glog.V(3).Infof("Stopping the stats stream of container %q: %v", containerID, err)
+				return
+			}
+			if sample == nil {
+				// the container isn't running anymore
+				return
+			}
+
+			select {
+			case <-stop:
+				return
+			case ch <- sample:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// takeStatsSample returns the current resource usage of the
+// domain. It returns nil if the domain isn't running.
+func (v *VirtualizationTool) takeStatsSample(domain virt.Domain, netNSPath string) (*ContainerStatsSample, error) {
+	state, err := domain.State()
+	if err != nil {
+		return nil, err
+	}
+	if state != virt.DomainStateRunning {
+		return nil, nil
+	}
+
+	stats, err := domain.Stats()
+	if err != nil {
+		return nil, err
+	}
+	sample := &ContainerStatsSample{
+		DomainStats: *stats,
+		Timestamp:   v.clock.Now().UnixNano(),
+	}
+	if netNSPath != "" {
+		if sample.Interfaces, err = v.nicStatsGetter(netNSPath); err != nil {
+			return nil, err
+		}
+	}
+	return sample, nil
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/network"
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+const (
+	fakeStatsNetNSPath  = "/var/run/netns/fake"
+	statsStreamInterval = 5 * time.Second
+)
+
+func setupStatsStreamTest(t *testing.T) (*containerTester, string) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	sandbox := criapi.GetSandboxes(1)[0]
+	psi, err := metadata.NewPodSandboxInfo(sandbox, &network.ContainerSideNetwork{NsPath: fakeStatsNetNSPath}, kubeapi.PodSandboxState_SANDBOX_READY, ct.clock)
+	if err != nil {
+		t.Fatalf("NewPodSandboxInfo(): %v", err)
+	}
+	if err := ct.metadataStore.PodSandbox(sandbox.Metadata.Uid).Save(
+		func(c *metadata.PodSandboxInfo) (*metadata.PodSandboxInfo, error) {
+			return psi, nil
+		}); err != nil {
+		t.Fatalf("Failed to store pod sandbox: %v", err)
+	}
+	ct.virtTool.nicStatsGetter = func(netNSPath string) ([]InterfaceStats, error) {
+		if netNSPath != fakeStatsNetNSPath {
+			t.Errorf("bad netns path %q", netNSPath)
+		}
+		return []InterfaceStats{
+			{Name: "tap0", RxBytes: 1000, RxPackets: 10, TxBytes: 2000, TxPackets: 20},
+		}, nil
+	}
+
+	containerID := ct.createContainer(sandbox, nil)
+	ct.startContainer(containerID)
+	return ct, containerID
+}
+
+func (ct *containerTester) nextStatsSample(ch <-chan *ContainerStatsSample) *ContainerStatsSample {
+	ct.clock.BlockUntil(1)
+	ct.clock.Advance(statsStreamInterval)
+	select {
+	case sample := <-ch:
+		return sample
+	case <-time.After(10 * time.Second):
+		ct.t.Fatalf("timed out waiting for a stats sample")
+	}
+	return nil
+}
+
+func verifyStatsStreamClosed(t *testing.T, ch <-chan *ContainerStatsSample) {
+	select {
+	case sample, ok := <-ch:
+		if ok {
+			t.Errorf("unexpected sample after the end of the stream: %#v", sample)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("the stats stream wasn't closed")
+	}
+}
+
+func TestStreamContainerStats(t *testing.T) {
+	ct, containerID := setupStatsStreamTest(t)
+	defer ct.teardown()
+
+	stop := make(chan struct{})
+	ch, err := ct.virtTool.StreamContainerStats(containerID, statsStreamInterval, stop)
+	if err != nil {
+		t.Fatalf("StreamContainerStats(): %v", err)
+	}
+
+	var lastCPUTime uint64
+	for i := 0; i < 3; i++ {
+		sample := ct.nextStatsSample(ch)
+		if sample == nil {
+			t.Fatalf("the stats stream was closed unexpectedly")
+		}
+		if sample.CPUTime <= lastCPUTime {
+			t.Errorf("CPU time didn't grow: %d after %d", sample.CPUTime, lastCPUTime)
+		}
+		lastCPUTime = sample.CPUTime
+		if sample.BalloonMemory != 1024*1024 {
+			t.Errorf("bad balloon memory: %d", sample.BalloonMemory)
+		}
+		if sample.Timestamp != ct.clock.Now().UnixNano() {
+			t.Errorf("bad sample timestamp %d", sample.Timestamp)
+		}
+		expectedInterfaces := []InterfaceStats{
+			{Name: "tap0", RxBytes: 1000, RxPackets: 10, TxBytes: 2000, TxPackets: 20},
+		}
+		if !reflect.DeepEqual(sample.Interfaces, expectedInterfaces) {
+			t.Errorf("bad interface stats: %#v", sample.Interfaces)
+		}
+	}
+
+	close(stop)
+	verifyStatsStreamClosed(t, ch)
+}
+
+func TestStatsStreamEndsWhenContainerStops(t *testing.T) {
+	ct, containerID := setupStatsStreamTest(t)
+	defer ct.teardown()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	ch, err := ct.virtTool.StreamContainerStats(containerID, statsStreamInterval, stop)
+	if err != nil {
+		t.Fatalf("StreamContainerStats(): %v", err)
+	}
+	if sample := ct.nextStatsSample(ch); sample == nil {
+		t.Fatalf("the stats stream was closed unexpectedly")
+	}
+
+	// the stream goroutine is waiting for the next tick here
+	ct.clock.BlockUntil(1)
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	if err := domain.Destroy(); err != nil {
+		t.Fatalf("Destroy(): %v", err)
+	}
+	ct.clock.Advance(statsStreamInterval)
+	verifyStatsStreamClosed(t, ch)
+}
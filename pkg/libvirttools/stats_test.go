@@ -0,0 +1,202 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestContainerStatsDiskUsage(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+
+	pool, err := ct.virtTool.StoragePool()
+	if err != nil {
+		t.Fatalf("StoragePool(): %v", err)
+	}
+
+	// the root volume is thin, i.e. only a part of its
+	// virtual size is actually allocated
+	rootVolume, err := pool.LookupVolumeByName("virtlet_root_" + containerID)
+	if err != nil {
+		t.Fatalf("can't find the root volume: %v", err)
+	}
+	rootVolume.(*fake.FakeStorageVolume).SetAllocation(4096)
+
+	// fully allocated data volume
+	if _, err := pool.CreateStorageVol(&libvirtxml.StorageVolume{
+		Name:     "virtlet-" + containerID + "-data",
+		Capacity: &libvirtxml.StorageVolumeSize{Unit: "b", Value: 10000},
+	}); err != nil {
+		t.Fatalf("CreateStorageVol(): %v", err)
+	}
+
+	// a volume that belongs to another container
+	if _, err := pool.CreateStorageVol(&libvirtxml.StorageVolume{
+		Name:     "virtlet-" + fakeUUID + "-data",
+		Capacity: &libvirtxml.StorageVolumeSize{Unit: "b", Value: 424242},
+	}); err != nil {
+		t.Fatalf("CreateStorageVol(): %v", err)
+	}
+
+	stats, err := ct.virtTool.ContainerStats(containerID)
+	if err != nil {
+		t.Fatalf("ContainerStats(): %v", err)
+	}
+	if stats.Attributes.Id != containerID {
+		t.Errorf("bad container id in stats: %q instead of %q", stats.Attributes.Id, containerID)
+	}
+	if stats.WritableLayer == nil || stats.WritableLayer.UsedBytes == nil {
+		t.Fatalf("writable layer usage not set")
+	}
+	if stats.WritableLayer.UsedBytes.Value != 14096 {
+		t.Errorf("bad writable layer usage: %d instead of 14096", stats.WritableLayer.UsedBytes.Value)
+	}
+
+	allStats, err := ct.virtTool.ListContainerStats(nil)
+	if err != nil {
+		t.Fatalf("ListContainerStats(): %v", err)
+	}
+	if len(allStats) != 1 || allStats[0].Attributes.Id != containerID {
+		t.Errorf("bad ListContainerStats() result: %#v", allStats)
+	}
+}
+
+// removingDomainConnection removes the container when its domain
+// is looked up, simulating RemoveContainer racing with the stats
+// collection
+type removingDomainConnection struct {
+	virt.DomainConnection
+	ct          *containerTester
+	containerID string
+}
+
+func (c *removingDomainConnection) LookupDomainByUUIDString(uuid string) (virt.Domain, error) {
+	d, err := c.DomainConnection.LookupDomainByUUIDString(uuid)
+	if err == nil && uuid == c.containerID {
+		c.containerID = ""
+		c.ct.removeContainer(uuid)
+	}
+	return d, err
+}
+
+func TestContainerStatsRemovedContainer(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	ct.virtTool.domainConn = &removingDomainConnection{
+		DomainConnection: ct.domainConn,
+		ct:               ct,
+		containerID:      containerID,
+	}
+
+	allStats, err := ct.virtTool.ListContainerStats(nil)
+	if err != nil {
+		t.Fatalf("ListContainerStats(): %v", err)
+	}
+	if len(allStats) != 0 {
+		t.Errorf("stats reported for a removed container: %#v", allStats)
+	}
+}
+
+func TestContainerStatsGuestAndHostUsage(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+
+	// the stopped VMs don't report CPU and memory usage
+	stats, err := ct.virtTool.ContainerStats(containerID)
+	if err != nil {
+		t.Fatalf("ContainerStats(): %v", err)
+	}
+	if stats.Cpu != nil || stats.Memory != nil {
+		t.Errorf("CPU or memory usage reported for a container that's not running")
+	}
+
+	ct.startContainer(containerID)
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	domainName, err := domain.Name()
+	if err != nil {
+		t.Fatalf("Name(): %v", err)
+	}
+	ct.virtTool.cgroupStatsGetter = func(name string) (*CgroupStats, error) {
+		if name != domainName {
+			t.Errorf("bad domain name %q instead of %q", name, domainName)
+		}
+		return &CgroupStats{
+			CPUTime:     uint64(10 * time.Second),
+			MemoryUsage: 1536 * 1024 * 1024,
+		}, nil
+	}
+
+	// the fake domain reports 900ms of vCPU time per Stats() call,
+	// 1 GiB balloon and half of it as unused
+	stats, err = ct.virtTool.ContainerStats(containerID)
+	if err != nil {
+		t.Fatalf("ContainerStats(): %v", err)
+	}
+	if stats.Cpu == nil || stats.Cpu.UsageCoreNanoSeconds == nil {
+		t.Fatalf("CPU usage not set")
+	}
+	if cpuTime := stats.Cpu.UsageCoreNanoSeconds.Value; cpuTime != uint64(900*time.Millisecond) {
+		t.Errorf("bad guest CPU time %d", cpuTime)
+	}
+	if stats.Memory == nil || stats.Memory.WorkingSetBytes == nil {
+		t.Fatalf("memory usage not set")
+	}
+	if mem := stats.Memory.WorkingSetBytes.Value; mem != 512*1024*1024 {
+		t.Errorf("bad guest memory usage %d", mem)
+	}
+
+	usage, err := ct.virtTool.HostUsage(containerID)
+	if err != nil {
+		t.Fatalf("HostUsage(): %v", err)
+	}
+	expectedUsage := &HostUsage{
+		CgroupStats: CgroupStats{
+			CPUTime:     uint64(10 * time.Second),
+			MemoryUsage: 1536 * 1024 * 1024,
+		},
+		CPUOverhead:    uint64(10*time.Second - 1800*time.Millisecond),
+		MemoryOverhead: 512 * 1024 * 1024,
+	}
+	if !reflect.DeepEqual(usage, expectedUsage) {
+		t.Errorf("bad host usage:\n%#v\ninstead of\n%#v", usage, expectedUsage)
+	}
+}
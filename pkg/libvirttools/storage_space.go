@@ -0,0 +1,144 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// InsufficientStorageError is returned when a volume can't be
+// created because there's no space left in the storage pool
+type InsufficientStorageError struct {
+	// VolumeName is the name of the volume that couldn't be
+	// created
+	VolumeName string
+	// Err is the original error
+	Err error
+}
+
+func (e *InsufficientStorageError) Error() string {
+	return fmt.Sprintf("insufficient storage: can't create volume %q: %v", e.VolumeName, e.Err)
+}
+
+// IsInsufficientStorage returns true if the error means that there
+// wasn't enough space in the storage pool to create a volume
+func IsInsufficientStorage(err error) bool {
+	_, ok := err.(*InsufficientStorageError)
+	return ok
+}
+
+// isNoSpaceError returns true if the error is caused by ENOSPC.
+// libvirt doesn't have a separate error code for it, so the error
+// message is checked.
+func isNoSpaceError(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), syscall.ENOSPC.Error())
+}
+
+// removePartialVolume removes a volume which may be left behind
+// when its creation fails
+func removePartialVolume(storagePool virt.StoragePool, name string) {
+	if err := storagePool.RemoveVolumeByName(name); err != nil {
+		glog.Warningf("Failed to remove partially created volume %q: %v", name, err)
+	}
+}
+
+// createStorageVolume creates a storage volume for the VM with the
+// specified domain UUID. If the pool is out of space, the partially
+// created volume is removed. If the owner manages to reclaim some
+// space in the pool, volume creation is retried once. If there's
+// still not enough space, an InsufficientStorageError is returned.
+func createStorageVolume(owner VolumeOwner, storagePool virt.StoragePool, domainUUID string, def *libvirtxml.StorageVolume) (virt.StorageVolume, error) {
+	vol, err := storagePool.CreateStorageVol(def)
+	if err == nil || !isNoSpaceError(err) {
+		return vol, err
+	}
+	glog.Warningf("No space left in the storage pool for volume %q: %v", def.Name, err)
+	removePartialVolume(storagePool, def.Name)
+
+	if owner.ReclaimStorage(domainUUID) {
+		glog.V(1).Infof("Retrying the creation of volume %q", def.Name)
+		vol, err = storagePool.CreateStorageVol(def)
+		if err == nil || !isNoSpaceError(err) {
+			return vol, err
+		}
+		removePartialVolume(storagePool, def.Name)
+	}
+	return nil, &InsufficientStorageError{VolumeName: def.Name, Err: err}
+}
+
+// SetReclaimStorage makes VirtualizationTool remove the orphaned
+// volumes from the storage pool when a volume can't be created
+// because the pool is out of space
+func (v *VirtualizationTool) SetReclaimStorage(reclaimStorage bool) {
+	v.reclaimStorage = reclaimStorage
+}
+
+// trackVMCreation marks the VM with the specified domain UUID as
+// being created, so its volumes aren't considered orphaned by
+// ReclaimStorage before the container metadata is stored. It
+// returns a function that removes the mark.
+func (v *VirtualizationTool) trackVMCreation(domainUUID string) func() {
+	v.creatingVMsLock.Lock()
+	defer v.creatingVMsLock.Unlock()
+	v.creatingVMs[domainUUID] = true
+	return func() {
+		v.creatingVMsLock.Lock()
+		defer v.creatingVMsLock.Unlock()
+		delete(v.creatingVMs, domainUUID)
+	}
+}
+
+// ReclaimStorage implements VolumeOwner ReclaimStorage method.
+// It removes the root and qcow2 volumes that don't belong to any
+// container, warm VM or VM that's being created.
+func (v *VirtualizationTool) ReclaimStorage(domainUUID string) bool {
+	if !v.reclaimStorage {
+		return false
+	}
+	ids, fatal, errs := v.retrieveListOfContainerIDs()
+	if fatal {
+		glog.Errorf("Can't reclaim storage: %v", errs)
+		return false
+	}
+
+	ids = append(ids, domainUUID)
+	v.warmPoolLock.Lock()
+	for _, vm := range v.warmVMs {
+		ids = append(ids, vm.config.DomainUUID)
+	}
+	v.warmPoolLock.Unlock()
+	v.creatingVMsLock.Lock()
+	for id := range v.creatingVMs {
+		ids = append(ids, id)
+	}
+	v.creatingVMsLock.Unlock()
+
+	glog.V(1).Infof("Removing orphaned volumes to reclaim storage space")
+	errs = append(errs, v.removeOrphanRootVolumes(ids)...)
+	errs = append(errs, v.removeOrphanQcow2Volumes(ids)...)
+	for _, err := range errs {
+		glog.Warningf("Error reclaiming storage: %v", err)
+	}
+	return true
+}
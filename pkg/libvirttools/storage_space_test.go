@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+const orphanRootVolumeName = "virtlet_root_2c3b2b6a-4a37-4c5b-9d0c-7a0e8e9fbd3c"
+
+func setupInsufficientStorageTest(t *testing.T, reclaimStorage bool) (*containerTester, *fake.FakeStoragePool) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	ct.virtTool.SetReclaimStorage(reclaimStorage)
+	pool, err := ct.virtTool.StoragePool()
+	if err != nil {
+		t.Fatalf("StoragePool(): %v", err)
+	}
+	fakePool := pool.(*fake.FakeStoragePool)
+	// the root volume of the fake image takes 424242 bytes,
+	// which only fits in the pool without the orphaned volume
+	fakePool.SetCapacity(500000)
+	if _, err := fakePool.CreateStorageVol(&libvirtxml.StorageVolume{
+		Name:     orphanRootVolumeName,
+		Capacity: &libvirtxml.StorageVolumeSize{Unit: "b", Value: 100000},
+	}); err != nil {
+		t.Fatalf("CreateStorageVol(): %v", err)
+	}
+	return ct, fakePool
+}
+
+func TestInsufficientStorage(t *testing.T) {
+	ct, pool := setupInsufficientStorageTest(t, false)
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	config := ct.vmConfig(sandbox, nil)
+	_, err := ct.virtTool.CreateContainer(config, "/tmp/fakenetns")
+	if err == nil {
+		t.Fatalf("CreateContainer() didn't fail")
+	}
+	if !IsInsufficientStorage(err) {
+		t.Errorf("CreateContainer() didn't return an InsufficientStorageError: %v", err)
+	}
+
+	// the partially created root volume must be removed
+	if _, err := pool.LookupVolumeByName("virtlet_root_" + config.DomainUUID); err != virt.ErrStorageVolumeNotFound {
+		t.Errorf("the partially created root volume wasn't removed")
+	}
+	// the orphaned volume must be left alone
+	if _, err := pool.LookupVolumeByName(orphanRootVolumeName); err != nil {
+		t.Errorf("LookupVolumeByName(): %v", err)
+	}
+	if containers := ct.listContainers(nil); len(containers) != 0 {
+		t.Errorf("unexpected containers after a failed CreateContainer(): %v", containers)
+	}
+}
+
+func TestReclaimStorage(t *testing.T) {
+	ct, pool := setupInsufficientStorageTest(t, true)
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+
+	if _, err := pool.LookupVolumeByName("virtlet_root_" + containerID); err != nil {
+		t.Errorf("LookupVolumeByName(): %v", err)
+	}
+	if _, err := pool.LookupVolumeByName(orphanRootVolumeName); err != virt.ErrStorageVolumeNotFound {
+		t.Errorf("the orphaned volume wasn't removed")
+	}
+}
@@ -17,10 +17,14 @@ limitations under the License.
 package libvirttools
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 
+	"github.com/golang/glog"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 
 	"github.com/Mirantis/virtlet/pkg/virt"
@@ -48,25 +52,168 @@ type diskPath struct {
 // diskPathMap maps volume uuids to diskPath items
 type diskPathMap map[string]diskPath
 
-var supportedStoragePools = map[string]string{
-	"volumes": "/var/lib/virtlet/volumes",
+const (
+	// defaultStoragePoolType is the type of the storage pool
+	// which is used by default
+	defaultStoragePoolType = "dir"
+	// defaultStoragePoolTargetPath is the directory for Virtlet volumes
+	// used for "dir" storage pools by default
+	defaultStoragePoolTargetPath = "/var/lib/virtlet/volumes"
+)
+
+// StoragePoolConfig describes the libvirt storage pool that's used
+// by Virtlet to store the volumes
+type StoragePoolConfig struct {
+	// Type denotes the type of the storage pool: "dir", "logical" or "rbd".
+	// Empty value means "dir".
+	Type string
+	// SourceName specifies the volume group name for "logical"
+	// pools or ceph pool name for "rbd" pools
+	SourceName string
+	// SourceDevices specifies the physical volumes for "logical"
+	// pools. The volume group must already exist as logical pools
+	// aren't built by Virtlet, so it may be empty
+	SourceDevices []string
+	// SourceHosts specifies ceph monitor addresses
+	// (host or host:port) for "rbd" pools
+	SourceHosts []string
+	// TargetPath specifies the directory for "dir" pools.
+	// Empty value means /var/lib/virtlet/volumes
+	TargetPath string
+}
+
+func (c *StoragePoolConfig) isDir() bool {
+	return c.Type == "" || c.Type == defaultStoragePoolType
+}
+
+func (c *StoragePoolConfig) targetPath() string {
+	if c.TargetPath == "" {
+		return defaultStoragePoolTargetPath
+	}
+	return c.TargetPath
+}
+
+func (c *StoragePoolConfig) validate() error {
+	if c.TargetPath != "" {
+		if !c.isDir() {
+			return errors.New("target path can only be specified for dir storage pools")
+		}
+		if !filepath.IsAbs(c.TargetPath) {
+			return fmt.Errorf("storage pool target path must be absolute, but it's %q", c.TargetPath)
+		}
+	}
+	switch c.Type {
+	case "", "dir":
+		return nil
+	case "logical":
+		if c.SourceName == "" {
+			return errors.New("volume group name must be specified for logical storage pools")
+		}
+		return nil
+	case "rbd":
+		if c.SourceName == "" {
+			return errors.New("ceph pool name must be specified for rbd storage pools")
+		}
+		if len(c.SourceHosts) == 0 {
+			return errors.New("ceph monitors must be specified for rbd storage pools")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported storage pool type %q", c.Type)
+	}
 }
 
-func ensureStoragePool(conn virt.StorageConnection, name string) (virt.StoragePool, error) {
-	poolDir, found := supportedStoragePools[name]
-	if !found {
-		return nil, fmt.Errorf("pool with name '%s' is unknown", name)
+func (c *StoragePoolConfig) poolDefinition(name string) (*libvirtxml.StoragePool, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
 	}
+	switch c.Type {
+	case "logical":
+		source := &libvirtxml.StoragePoolSource{Name: c.SourceName}
+		for _, dev := range c.SourceDevices {
+			source.Device = append(source.Device, libvirtxml.StoragePoolSourceDevice{Path: dev})
+		}
+		return &libvirtxml.StoragePool{
+			Type:   "logical",
+			Name:   name,
+			Source: source,
+			Target: &libvirtxml.StoragePoolTarget{Path: "/dev/" + c.SourceName},
+		}, nil
+	case "rbd":
+		source := &libvirtxml.StoragePoolSource{Name: c.SourceName}
+		for _, host := range c.SourceHosts {
+			hostDef, err := parseStoragePoolHost(host)
+			if err != nil {
+				return nil, err
+			}
+			source.Host = append(source.Host, *hostDef)
+		}
+		return &libvirtxml.StoragePool{
+			Type:   "rbd",
+			Name:   name,
+			Source: source,
+		}, nil
+	default:
+		return &libvirtxml.StoragePool{
+			Type:   defaultStoragePoolType,
+			Name:   name,
+			Target: &libvirtxml.StoragePoolTarget{Path: c.targetPath()},
+		}, nil
+	}
+}
 
+func parseStoragePoolHost(host string) (*libvirtxml.StoragePoolSourceHost, error) {
+	parts := strings.Split(host, ":")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return &libvirtxml.StoragePoolSourceHost{Name: parts[0]}, nil
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		return &libvirtxml.StoragePoolSourceHost{Name: parts[0], Port: parts[1]}, nil
+	default:
+		return nil, fmt.Errorf("bad storage pool host %q", host)
+	}
+}
+
+// ensureStoragePool looks up the storage pool with the specified name,
+// starting it if it's defined but inactive, or creates it based on
+// the config if it doesn't exist.
+func ensureStoragePool(conn virt.StorageConnection, name string, config StoragePoolConfig) (virt.StoragePool, error) {
 	pool, err := conn.LookupStoragePoolByName(name)
-	if err == nil {
-		return pool, nil
+	switch {
+	case err == virt.ErrStoragePoolNotFound:
+		def, err := config.poolDefinition(name)
+		if err != nil {
+			return nil, err
+		}
+		glog.V(1).Infof("Creating storage pool %q of type %q", name, def.Type)
+		return conn.CreateStoragePool(def)
+	case err != nil:
+		return nil, err
+	}
+
+	if config.isDir() {
+		// make sure the volumes don't end up in an unexpected place
+		// if the pool was created with a different target path
+		targetPath, err := pool.TargetPath()
+		if err != nil {
+			return nil, fmt.Errorf("can't get the target path of the storage pool %q: %v", name, err)
+		}
+		if filepath.Clean(targetPath) != filepath.Clean(config.targetPath()) {
+			return nil, fmt.Errorf("storage pool %q has target path %q instead of %q", name, targetPath, config.targetPath())
+		}
 	}
-	return conn.CreateStoragePool(&libvirtxml.StoragePool{
-		Type:   "dir",
-		Name:   name,
-		Target: &libvirtxml.StoragePoolTarget{Path: poolDir},
-	})
+
+	active, err := pool.IsActive()
+	if err != nil {
+		return nil, fmt.Errorf("can't get the state of the storage pool %q: %v", name, err)
+	}
+	if !active {
+		glog.V(1).Infof("Starting inactive storage pool %q", name)
+		if err := pool.Start(); err != nil {
+			return nil, fmt.Errorf("failed to start the storage pool %q: %v", name, err)
+		}
+	}
+	return pool, nil
 }
 
 func verifyRawDeviceAccess(path string) error {
@@ -78,13 +225,20 @@ func verifyRawDeviceAccess(path string) error {
 	// TODO: verify access rights for qemu process to this path
 	pathInfo, err := os.Stat(path)
 	if err != nil {
-		return err
+		// the device may not be attached yet
+		return &VolumeNotReadyError{Path: path, Err: err}
 	}
 
 	// is this device and not char device?
-	if pathInfo.Mode()&os.ModeDevice != 0 && pathInfo.Mode()&os.ModeCharDevice == 0 {
-		return nil
+	if pathInfo.Mode()&os.ModeDevice == 0 || pathInfo.Mode()&os.ModeCharDevice != 0 {
+		return &BadMountError{HostPath: path, Reason: "not a block device"}
 	}
 
-	return fmt.Errorf("path '%s' points to something other than block device", path)
+	// e.g. a loop device without a backing file can't be opened
+	f, err := os.Open(path)
+	if err != nil {
+		return &VolumeNotReadyError{Path: path, Err: err}
+	}
+	f.Close()
+	return nil
 }
@@ -0,0 +1,179 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+)
+
+func TestEnsureStoragePoolCreatesMissingPool(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		config      StoragePoolConfig
+		expectedDef *libvirtxml.StoragePool
+	}{
+		{
+			name:   "default",
+			config: StoragePoolConfig{},
+			expectedDef: &libvirtxml.StoragePool{
+				Type:   "dir",
+				Name:   "volumes",
+				Target: &libvirtxml.StoragePoolTarget{Path: "/var/lib/virtlet/volumes"},
+			},
+		},
+		{
+			name:   "dir with custom target path",
+			config: StoragePoolConfig{TargetPath: "/mnt/nvme/virtlet"},
+			expectedDef: &libvirtxml.StoragePool{
+				Type:   "dir",
+				Name:   "volumes",
+				Target: &libvirtxml.StoragePoolTarget{Path: "/mnt/nvme/virtlet"},
+			},
+		},
+		{
+			name: "logical",
+			config: StoragePoolConfig{
+				Type:          "logical",
+				SourceName:    "virtlet",
+				SourceDevices: []string{"/dev/sdb", "/dev/sdc"},
+			},
+			expectedDef: &libvirtxml.StoragePool{
+				Type: "logical",
+				Name: "volumes",
+				Source: &libvirtxml.StoragePoolSource{
+					Name: "virtlet",
+					Device: []libvirtxml.StoragePoolSourceDevice{
+						{Path: "/dev/sdb"},
+						{Path: "/dev/sdc"},
+					},
+				},
+				Target: &libvirtxml.StoragePoolTarget{Path: "/dev/virtlet"},
+			},
+		},
+		{
+			name: "rbd",
+			config: StoragePoolConfig{
+				Type:        "rbd",
+				SourceName:  "rbd",
+				SourceHosts: []string{"10.0.0.1", "10.0.0.2:6789"},
+			},
+			expectedDef: &libvirtxml.StoragePool{
+				Type: "rbd",
+				Name: "volumes",
+				Source: &libvirtxml.StoragePoolSource{
+					Name: "rbd",
+					Host: []libvirtxml.StoragePoolSourceHost{
+						{Name: "10.0.0.1"},
+						{Name: "10.0.0.2", Port: "6789"},
+					},
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := testutils.NewToplevelRecorder()
+			conn := fake.NewFakeStorageConnection(rec)
+			if _, err := ensureStoragePool(conn, "volumes", tc.config); err != nil {
+				t.Fatalf("ensureStoragePool(): %v", err)
+			}
+			if _, err := conn.LookupStoragePoolByName("volumes"); err != nil {
+				t.Errorf("the storage pool was not created: %v", err)
+			}
+
+			expectedXML, err := tc.expectedDef.Marshal()
+			if err != nil {
+				t.Fatalf("error marshalling the pool definition: %v", err)
+			}
+			expectedRecs := []*testutils.Record{
+				{Name: "CreateStoragePool", Value: expectedXML},
+			}
+			if !reflect.DeepEqual(rec.Content(), expectedRecs) {
+				t.Errorf("bad storage pool definition:\n%s\nexpected:\n%s", rec.Content()[0].Value, expectedXML)
+			}
+		})
+	}
+}
+
+func TestEnsureStoragePoolStartsInactivePool(t *testing.T) {
+	rec := testutils.NewToplevelRecorder()
+	conn := fake.NewFakeStorageConnection(rec)
+	pool, err := conn.CreateStoragePool(&libvirtxml.StoragePool{
+		Type:   "dir",
+		Name:   "volumes",
+		Target: &libvirtxml.StoragePoolTarget{Path: "/var/lib/virtlet/volumes"},
+	})
+	if err != nil {
+		t.Fatalf("CreateStoragePool(): %v", err)
+	}
+	pool.(*fake.FakeStoragePool).SetActive(false)
+
+	if _, err := ensureStoragePool(conn, "volumes", StoragePoolConfig{}); err != nil {
+		t.Fatalf("ensureStoragePool(): %v", err)
+	}
+
+	active, err := pool.IsActive()
+	if err != nil {
+		t.Fatalf("IsActive(): %v", err)
+	}
+	if !active {
+		t.Errorf("the storage pool was not started")
+	}
+	recs := rec.Content()
+	if len(recs) != 2 || recs[1].Name != "volumes: Start" {
+		t.Errorf("unexpected storage pool actions: %#v", recs)
+	}
+}
+
+func TestEnsureStoragePoolTargetPathMismatch(t *testing.T) {
+	conn := fake.NewFakeStorageConnection(testutils.NullRecorder)
+	if _, err := conn.CreateStoragePool(&libvirtxml.StoragePool{
+		Type:   "dir",
+		Name:   "volumes",
+		Target: &libvirtxml.StoragePoolTarget{Path: "/var/lib/virtlet/volumes"},
+	}); err != nil {
+		t.Fatalf("CreateStoragePool(): %v", err)
+	}
+
+	if _, err := ensureStoragePool(conn, "volumes", StoragePoolConfig{TargetPath: "/var/lib/virtlet/volumes/"}); err != nil {
+		t.Errorf("ensureStoragePool(): %v", err)
+	}
+	if _, err := ensureStoragePool(conn, "volumes", StoragePoolConfig{TargetPath: "/mnt/nvme/virtlet"}); err == nil {
+		t.Errorf("ensureStoragePool() didn't fail for an existing pool with different target path")
+	}
+}
+
+func TestBadStoragePoolConfig(t *testing.T) {
+	for _, config := range []StoragePoolConfig{
+		{Type: "foobar"},
+		{Type: "logical"},
+		{Type: "rbd", SourceName: "rbd"},
+		{Type: "rbd", SourceName: "rbd", SourceHosts: []string{"10.0.0.1:6789:1"}},
+		{TargetPath: "relative/path"},
+		{Type: "logical", SourceName: "virtlet", TargetPath: "/mnt/nvme/virtlet"},
+	} {
+		conn := fake.NewFakeStorageConnection(testutils.NullRecorder)
+		if _, err := ensureStoragePool(conn, "volumes", config); err == nil {
+			t.Errorf("ensureStoragePool() didn't fail for bad config %#v", config)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// guestSetTimeCommand is the guest agent command that sets the
+// guest clock to the specified time in nanoseconds since the epoch
+const guestSetTimeCommand = `{"execute":"guest-set-time","arguments":{"time":%d}}`
+
+// addHypervClock exposes Hyper-V reference clock to the guest, so
+// the guests that support it keep their clock in sync with the host
+// after the VM is resumed without any help from the guest agent
+func addHypervClock(domain *libvirtxml.Domain) {
+	if domain.Clock == nil {
+		domain.Clock = &libvirtxml.DomainClock{Offset: "utc"}
+	}
+	domain.Clock.Timer = append(domain.Clock.Timer, libvirtxml.DomainTimer{Name: "hypervclock", Present: "yes"})
+}
+
+// syncGuestTime resynchronizes the guest clock of the resumed VM
+// with the host according to VirtletGuestTimeSync annotation of the
+// container. The guest keeps running even if the time can't be
+// set, so the failures are only logged.
+func (v *VirtualizationTool) syncGuestTime(containerID string, domain virt.Domain) {
+	config, _, err := v.getVMConfigFromMetadata(containerID)
+	switch {
+	case err != nil:
+		glog.Warningf("Failed to get the config of container %q, guest time sync skipped: %v", containerID, err)
+		return
+	case config == nil || config.ParsedAnnotations == nil || config.ParsedAnnotations.GuestTimeSync != guestTimeSyncAgent:
+		// either no resync is needed or the guest
+		// uses hypervclock
+		return
+	}
+
+	switch hasGuestAgent, err := domainHasGuestAgent(domain); {
+	case err != nil:
+		glog.Warningf("Failed to get the definition of the domain %q, guest time sync skipped: %v", containerID, err)
+		return
+	case !hasGuestAgent:
+		glog.Warningf("Domain %q has no guest agent, guest time sync skipped", containerID)
+		return
+	}
+	if err := v.callGuestAgent("time sync", func(timeout time.Duration) error {
+		_, err := domain.GuestAgentCommand(fmt.Sprintf(guestSetTimeCommand, v.clock.Now().UnixNano()), timeout)
+		return err
+	}); err != nil {
+		glog.Warningf("Failed to sync the guest time of domain %q: %v", containerID, err)
+	}
+}
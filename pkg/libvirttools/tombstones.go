@@ -0,0 +1,156 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+)
+
+// SetContainerTombstoneTTL makes RemoveContainer keep a tombstone
+// with the status of the removed container for the specified time,
+// during which ContainerStatus and ListContainers keep returning the
+// container as an exited one. Zero ttl disables the tombstones.
+func (v *VirtualizationTool) SetContainerTombstoneTTL(ttl time.Duration) {
+	v.tombstoneTTL = ttl
+}
+
+// addTombstone stores the tombstone for the container that's being
+// removed. The VM is destroyed during the removal, so the container
+// is always recorded as an exited one.
+func (v *VirtualizationTool) addTombstone(containerID string) error {
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	if err != nil || containerInfo == nil {
+		return err
+	}
+	tombstone := &metadata.ContainerTombstone{
+		ContainerInfo: *containerInfo,
+		RemovedAt:     v.clock.Now().UnixNano(),
+	}
+	tombstone.State = kubeapi.ContainerState_CONTAINER_EXITED
+	sandboxInfo, err := v.metadataStore.PodSandbox(containerInfo.SandboxID).Retrieve()
+	if err != nil {
+		return fmt.Errorf("can't retrieve the info of sandbox %q: %v", containerInfo.SandboxID, err)
+	}
+	if sandboxInfo != nil && sandboxInfo.LogDirectory != "" {
+		tombstone.LogPath = filepath.Join(sandboxInfo.LogDirectory, fmt.Sprintf("%s_%d.log", containerInfo.Name, containerInfo.Attempt))
+	}
+	return v.metadataStore.SaveTombstone(containerID, tombstone)
+}
+
+func (v *VirtualizationTool) tombstoneExpired(tombstone *metadata.ContainerTombstone) bool {
+	return v.clock.Now().Sub(time.Unix(0, tombstone.RemovedAt)) >= v.tombstoneTTL
+}
+
+// tombstone returns the tombstone of the container, or nil if there's
+// no tombstone or it has expired. The expired tombstones are removed.
+func (v *VirtualizationTool) tombstone(containerID string) (*metadata.ContainerTombstone, error) {
+	tombstone, err := v.metadataStore.Tombstone(containerID)
+	if err != nil || tombstone == nil {
+		return nil, err
+	}
+	if v.tombstoneExpired(tombstone) {
+		if err := v.metadataStore.RemoveTombstone(containerID); err != nil {
+			glog.Warningf("Failed to remove the tombstone of container %q: %v", containerID, err)
+		}
+		return nil, nil
+	}
+	return tombstone, nil
+}
+
+// appendTombstones appends the containers of the tombstones that
+// match the filter to the list of the containers, skipping the
+// containers that are already present in the list. The expired
+// tombstones are removed.
+func (v *VirtualizationTool) appendTombstones(containers []*kubeapi.Container, filter *kubeapi.ContainerFilter) ([]*kubeapi.Container, error) {
+	tombstones, err := v.metadataStore.ListTombstones()
+	if err != nil {
+		return nil, err
+	}
+	if len(tombstones) == 0 {
+		return containers, nil
+	}
+	listed := make(map[string]bool)
+	for _, container := range containers {
+		listed[container.Id] = true
+	}
+	for containerID, tombstone := range tombstones {
+		if v.tombstoneExpired(tombstone) {
+			if err := v.metadataStore.RemoveTombstone(containerID); err != nil {
+				glog.Warningf("Failed to remove the tombstone of container %q: %v", containerID, err)
+			}
+			continue
+		}
+		if listed[containerID] {
+			continue
+		}
+		container := tombstoneContainer(containerID, tombstone)
+		if filterContainer(container, filter) {
+			containers = append(containers, container)
+		}
+	}
+	return containers, nil
+}
+
+func tombstoneContainer(containerID string, tombstone *metadata.ContainerTombstone) *kubeapi.Container {
+	return &kubeapi.Container{
+		Id:           containerID,
+		PodSandboxId: tombstone.SandboxID,
+		Metadata: &kubeapi.ContainerMetadata{
+			Name:    tombstone.Name,
+			Attempt: tombstone.Attempt,
+		},
+		Image:       &kubeapi.ImageSpec{Image: tombstone.Image},
+		ImageRef:    tombstone.Image,
+		State:       tombstone.State,
+		CreatedAt:   tombstone.CreatedAt,
+		Labels:      tombstone.Labels,
+		Annotations: tombstone.Annotations,
+	}
+}
+
+func tombstoneStatus(containerID string, tombstone *metadata.ContainerTombstone) *kubeapi.ContainerStatus {
+	status := &kubeapi.ContainerStatus{
+		Id: containerID,
+		Metadata: &kubeapi.ContainerMetadata{
+			Name:    tombstone.Name,
+			Attempt: tombstone.Attempt,
+		},
+		Image:     &kubeapi.ImageSpec{Image: tombstone.Image},
+		ImageRef:  tombstone.Image,
+		State:     tombstone.State,
+		CreatedAt: tombstone.CreatedAt,
+		StartedAt: tombstone.StartedAt,
+		// the time the VM stopped isn't recorded, but it
+		// can't be later than the removal of the container
+		FinishedAt:  tombstone.RemovedAt,
+		Labels:      tombstone.Labels,
+		Annotations: annotationsWithRestartCount(&tombstone.ContainerInfo),
+		LogPath:     tombstone.LogPath,
+	}
+	if tombstone.GuestShutdown {
+		status.Reason = "GuestShutdown"
+		status.Message = "the VM was powered off by the guest OS"
+	}
+	return status
+}
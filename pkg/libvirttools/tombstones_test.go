@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func (ct *containerTester) verifyListedContainers(filter *kubeapi.ContainerFilter, expectedIDs ...string) {
+	containers, err := ct.virtTool.ListContainers(filter)
+	if err != nil {
+		ct.t.Fatalf("ListContainers(): %v", err)
+	}
+	var ids []string
+	for _, container := range containers {
+		ids = append(ids, container.Id)
+	}
+	if fmt.Sprint(ids) != fmt.Sprint(expectedIDs) {
+		ct.t.Errorf("ListContainers(%#v) returned %v instead of %v", filter, ids, expectedIDs)
+	}
+}
+
+func TestContainerTombstone(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	ct.virtTool.SetContainerTombstoneTTL(time.Minute)
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	ct.clock.Advance(time.Second)
+	ct.startContainer(containerID)
+	startedAt := ct.clock.Now().UnixNano()
+	ct.clock.Advance(time.Second)
+	ct.stopContainer(containerID)
+	ct.clock.Advance(time.Second)
+	ct.removeContainer(containerID)
+	removedAt := ct.clock.Now().UnixNano()
+
+	// the status of the removed container is still queryable
+	// within the retention window
+	ct.clock.Advance(30 * time.Second)
+	status := ct.containerStatus(containerID)
+	if status == nil {
+		t.Fatalf("no status for the removed container")
+	}
+	if status.Id != containerID {
+		t.Errorf("bad container id %q instead of %q", status.Id, containerID)
+	}
+	if status.State != kubeapi.ContainerState_CONTAINER_EXITED {
+		t.Errorf("bad container state %v instead of %v", status.State, kubeapi.ContainerState_CONTAINER_EXITED)
+	}
+	if status.Metadata.Name != fakeContainerName || status.Metadata.Attempt != fakeContainerAttempt {
+		t.Errorf("bad container metadata %#v", status.Metadata)
+	}
+	if status.StartedAt != startedAt {
+		t.Errorf("bad StartedAt %d instead of %d", status.StartedAt, startedAt)
+	}
+	if status.FinishedAt != removedAt {
+		t.Errorf("bad FinishedAt %d instead of %d", status.FinishedAt, removedAt)
+	}
+	expectedLogPath := fmt.Sprintf("/var/log/test_log_directory/%s_%d.log", fakeContainerName, fakeContainerAttempt)
+	if status.LogPath != expectedLogPath {
+		t.Errorf("bad LogPath %q instead of %q", status.LogPath, expectedLogPath)
+	}
+
+	ct.verifyListedContainers(nil, containerID)
+	ct.verifyListedContainers(&kubeapi.ContainerFilter{Id: containerID}, containerID)
+	ct.verifyListedContainers(&kubeapi.ContainerFilter{PodSandboxId: sandbox.Metadata.Uid}, containerID)
+	ct.verifyListedContainers(&kubeapi.ContainerFilter{
+		State: &kubeapi.ContainerStateValue{State: kubeapi.ContainerState_CONTAINER_RUNNING},
+	})
+
+	// the stats of the removed containers aren't reported
+	// while the other container stats are still listed
+	otherSandbox := criapi.GetSandboxes(2)[1]
+	ct.setPodSandbox(otherSandbox)
+	otherID := ct.createContainer(otherSandbox, nil)
+	allStats, err := ct.virtTool.ListContainerStats(nil)
+	if err != nil {
+		t.Fatalf("ListContainerStats(): %v", err)
+	}
+	if len(allStats) != 1 || allStats[0].Attributes.Id != otherID {
+		t.Errorf("bad ListContainerStats() result: %#v", allStats)
+	}
+
+	// the tombstone is purged after the retention window
+	ct.clock.Advance(30 * time.Second)
+	if _, err := ct.virtTool.ContainerStatus(containerID); err == nil {
+		t.Errorf("ContainerStatus() didn't fail for a purged container")
+	}
+	ct.verifyListedContainers(nil, otherID)
+	if tombstone, err := ct.metadataStore.Tombstone(containerID); err != nil {
+		t.Errorf("Tombstone(): %v", err)
+	} else if tombstone != nil {
+		t.Errorf("the tombstone wasn't removed")
+	}
+}
+
+func TestNoTombstonesByDefault(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	ct.removeContainer(containerID)
+
+	if _, err := ct.virtTool.ContainerStatus(containerID); err == nil {
+		t.Errorf("ContainerStatus() didn't fail for a removed container")
+	}
+	ct.verifyListedContainers(nil)
+}
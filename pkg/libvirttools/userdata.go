@@ -0,0 +1,62 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"net/textproto"
+	"strings"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isMultipartUserData returns true if the user-data is a MIME
+// multipart message, such as the one produced by cloud-init's
+// make-mime tool
+func isMultipartUserData(userData string) bool {
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(userData)))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && strings.HasPrefix(mediaType, "multipart/")
+}
+
+// opaqueUserData checks whether the user-data passed via
+// VirtletCloudInitUserData annotation can't be handled as plain
+// cloud-config and must be passed to the VM as is. These are MIME
+// multipart messages and gzip-compressed payloads, which may be
+// base64-encoded as annotation values can't contain binary data.
+// The base64-encoded payloads are decoded. nil is returned for the
+// user-data that should be parsed as cloud-config.
+func opaqueUserData(userData string) []byte {
+	if bytes.HasPrefix([]byte(userData), gzipMagic) {
+		return []byte(userData)
+	}
+	if isMultipartUserData(userData) {
+		return []byte(userData)
+	}
+	encoded := strings.Join(strings.Fields(userData), "")
+	if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil && bytes.HasPrefix(decoded, gzipMagic) {
+		return decoded
+	}
+	return nil
+}
@@ -19,7 +19,10 @@ package libvirttools
 import (
 	"fmt"
 	"os"
-	"strings"
+	"regexp"
+	"runtime"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -42,6 +45,7 @@ const (
 	defaultEmulator   = "/usr/bin/kvm"
 	noKvmDomainType   = "qemu"
 	noKvmEmulator     = "/usr/bin/qemu-system-x86_64"
+	kvmDevice         = "/dev/kvm"
 
 	domainStartCheckInterval      = 250 * time.Millisecond
 	domainStartTimeout            = 10 * time.Second
@@ -53,6 +57,12 @@ const (
 	// ContainerNsUUID template for container ns uuid generation
 	ContainerNsUUID       = "67b7fb47-7735-4b64-86d2-6d062d121966"
 	defaultKubeletRootDir = "/var/lib/kubelet/pods"
+
+	// guestCloudInitRerunScript makes cloud-init in the guest
+	// run all of its modules again, including the per-instance
+	// ones such as the one that sets up the SSH keys, as the
+	// instance id of the VM doesn't change upon the update
+	guestCloudInitRerunScript = "cloud-init clean && cloud-init init && cloud-init modules --mode config && cloud-init modules --mode final"
 )
 
 type domainSettings struct {
@@ -61,12 +71,26 @@ type domainSettings struct {
 	domainUUID       string
 	memory           int
 	memoryUnit       string
+	currentMemory    uint64
 	vcpuNum          int
 	cpuShares        uint
 	cpuPeriod        uint64
 	cpuQuota         int64
 	rootDiskFilepath string
 	netFdKey         string
+	deviceProfile    DeviceProfile
+	numaNodeCPUs     string
+	fileBacked       bool
+	hostPCIDevices   []*libvirtxml.DomainAddressPCI
+	vfInterfaces     []vfInterface
+}
+
+// memoryInBytes returns the amount of the VM memory in bytes
+func (ds *domainSettings) memoryInBytes() uint64 {
+	if ds.memoryUnit == defaultMemoryUnit {
+		return uint64(ds.memory) << 20
+	}
+	return uint64(ds.memory)
 }
 
 func (ds *domainSettings) createDomain(config *VMConfig) *libvirtxml.Domain {
@@ -127,10 +151,12 @@ func (ds *domainSettings) createDomain(config *VMConfig) *libvirtxml.Domain {
 
 		Type: domainType,
 
-		Name:   ds.domainName,
-		UUID:   ds.domainUUID,
-		Memory: &libvirtxml.DomainMemory{Value: uint(ds.memory), Unit: ds.memoryUnit},
-		VCPU:   &libvirtxml.DomainVCPU{Value: ds.vcpuNum},
+		Name:       ds.domainName,
+		UUID:       ds.domainUUID,
+		Metadata:   domainMetadata(config),
+		Memory:     &libvirtxml.DomainMemory{Value: uint(ds.memory), Unit: ds.memoryUnit},
+		MemoryTune: memoryTune(config),
+		VCPU:       &libvirtxml.DomainVCPU{Value: ds.vcpuNum},
 		CPUTune: &libvirtxml.DomainCPUTune{
 			Shares: &libvirtxml.DomainCPUTuneShares{Value: ds.cpuShares},
 			Period: &libvirtxml.DomainCPUTunePeriod{Value: ds.cpuPeriod},
@@ -160,13 +186,111 @@ func (ds *domainSettings) createDomain(config *VMConfig) *libvirtxml.Domain {
 		},
 	}
 
+	if !config.ParsedAnnotations.DisablePanicDevice && panicDeviceSupported() {
+		domain.Devices.Panics = []libvirtxml.DomainPanic{{Model: "isa"}}
+		// Keep the domain in crashed state after guest kernel panic
+		// so the panic can be detected
+		domain.OnCrash = "preserve"
+	}
+
+	// the console logs are written by the stream server which
+	// gets these settings from the environment of the VM process
+	if maxSize := config.ParsedAnnotations.ConsoleLogMaxSize; maxSize != nil {
+		domain.QEMUCommandline.Envs = append(domain.QEMUCommandline.Envs,
+			libvirtxml.DomainQEMUCommandlineEnv{Name: "VIRTLET_CONSOLE_LOG_MAX_SIZE", Value: strconv.FormatInt(*maxSize, 10)})
+	}
+	if maxFiles := config.ParsedAnnotations.ConsoleLogMaxFiles; maxFiles != nil {
+		domain.QEMUCommandline.Envs = append(domain.QEMUCommandline.Envs,
+			libvirtxml.DomainQEMUCommandlineEnv{Name: "VIRTLET_CONSOLE_LOG_MAX_FILES", Value: strconv.Itoa(*maxFiles)})
+	}
+
 	if os.Getenv("VIRTLET_SRIOV_SUPPORT") != "" {
 		domain.QEMUCommandline.Envs = append(domain.QEMUCommandline.Envs,
 			libvirtxml.DomainQEMUCommandlineEnv{Name: "VMWRAPPER_KEEP_PRIVS", Value: "1"})
 	}
+
+	if config.ParsedAnnotations.EnableGuestAgent {
+		addGuestAgentChannel(domain)
+	}
+
+	if config.ParsedAnnotations.GuestTimeSync == guestTimeSyncHypervClock {
+		addHypervClock(domain)
+	}
+
+	if config.ParsedAnnotations.NVDIMM != nil {
+		ds.addNVDIMM(domain, config)
+	}
+
+	if len(config.ParsedAnnotations.CPUFeatures) != 0 {
+		addCPUFeatures(domain, config.ParsedAnnotations.CPUFeatures)
+	}
+
+	if config.ParsedAnnotations.NUMANode != nil {
+		ds.addNUMANodeBinding(domain, config)
+	}
+
+	if ds.fileBacked {
+		ds.addFileBackedMemory(domain)
+	}
+
+	if len(ds.hostPCIDevices) != 0 {
+		ds.addHostPCIDevices(domain)
+	}
+
+	if len(ds.vfInterfaces) != 0 {
+		ds.addVFInterfaces(domain)
+	}
+
+	if ds.currentMemory != 0 {
+		domain.CurrentMemory = &libvirtxml.DomainCurrentMemory{Value: uint(ds.currentMemory), Unit: "b"}
+		// with autodeflate, QEMU deflates the balloon when the
+		// guest is about to run out of memory, so the guest can
+		// grow from the request up to the limit
+		domain.Devices.MemBalloon = &libvirtxml.DomainMemBalloon{Model: "virtio", AutoDeflate: "on"}
+	}
+
+	ds.applyDeviceProfile(domain, config)
+
+	if config.ParsedAnnotations.InterfaceSource != nil {
+		ds.addInterfaceSource(domain, config)
+	}
+
+	if config.ParsedAnnotations.PCIeRootPorts > 0 {
+		addPCIeRootPorts(domain, config.ParsedAnnotations.PCIeRootPorts)
+	}
+
+	if len(config.ParsedAnnotations.NICOffloads) != 0 {
+		domain.QEMUCommandline.Envs = append(domain.QEMUCommandline.Envs,
+			libvirtxml.DomainQEMUCommandlineEnv{
+				Name:  "VIRTLET_NIC_OFFLOADS",
+				Value: network.FormatNICOffloads(config.ParsedAnnotations.NICOffloads),
+			})
+	}
 	return domain
 }
 
+// panicDeviceSupported returns true if the panic device (pvpanic)
+// can be used on the current architecture
+func panicDeviceSupported() bool {
+	return runtime.GOARCH == "amd64" || runtime.GOARCH == "386"
+}
+
+// checkDomainType verifies that the domain type requested
+// for the VM can be used on this node
+func checkDomainType(domainType string) error {
+	emulator := noKvmEmulator
+	if domainType == defaultDomainType {
+		emulator = defaultEmulator
+		if _, err := os.Stat(kvmDevice); err != nil {
+			return fmt.Errorf("domain type %q can't be used: %v", domainType, err)
+		}
+	}
+	if _, err := os.Stat(emulator); err != nil {
+		return fmt.Errorf("domain type %q can't be used: emulator not found: %v", domainType, err)
+	}
+	return nil
+}
+
 func canUseKvm() bool {
 	if os.Getenv("VIRTLET_DISABLE_KVM") != "" {
 		glog.V(0).Infof("VIRTLET_DISABLE_KVM env var not empty, using plain qemu")
@@ -177,24 +301,84 @@ func canUseKvm() bool {
 
 // VirtualizationTool provides methods to operate on libvirt.
 type VirtualizationTool struct {
-	domainConn     virt.DomainConnection
-	storageConn    virt.StorageConnection
-	volumePoolName string
-	imageManager   ImageManager
-	metadataStore  metadata.Store
-	clock          clockwork.Clock
-	forceKVM       bool
-	kubeletRootDir string
-	rawDevices     []string
-	volumeSource   VMVolumeSource
+	domainConn        virt.DomainConnection
+	storageConn       virt.StorageConnection
+	volumePoolName    string
+	storagePoolConfig StoragePoolConfig
+	imageManager      ImageManager
+	metadataStore     metadata.Store
+	clock             clockwork.Clock
+	forceKVM          bool
+	domainTypeChecker func(domainType string) error
+	nvdimmChecker     func(path string) error
+	rtSchedChecker    func() error
+	ifSourceChecker   func(c *InterfaceSourceConfig) error
+	numaInfoGetter    func(node int) (*numaNodeInfo, error)
+	pciDevicesGetter  func(devicePath string) ([]string, error)
+	gpuDevicesGetter  func(addr string) ([]string, error)
+	maxVolumeCount    int
+	minStopTimeout    time.Duration
+	kubeletRootDir    string
+	rawDevices        []string
+	gpuDevices        []string
+	interfaceSources  []InterfaceSourceConfig
+	volumeSource      VMVolumeSource
+	warmPoolConfig    WarmPoolConfig
+	warmPoolLock      sync.Mutex
+	reconcileLock     sync.RWMutex
+	warmVMs           []*warmVM
+	guestAgentConfig  GuestAgentConfig
+	hookConfig        HookConfig
+	startupConfig     StartupConfig
+	bootTimeConfig    BootTimeConfig
+	bootConsoleRx     *regexp.Regexp
+	bootWatchLock     sync.Mutex
+	bootWatches       map[string]*bootWatch
+	hookRunner        func(command string, args, env []string, timeout time.Duration) error
+	deviceProfile     DeviceProfile
+	containerLocks    containerLocks
+	memoryBackingDir  string
+	savedStateDir     string
+	skipNoopConfigISO bool
+	configISOInPool   bool
+	imageTenants      bool
+	volumeClaims      volumeClaimRegistry
+	pciDeviceClaims   pciDeviceRegistry
+	nicStatsGetter    func(netNSPath string) ([]InterfaceStats, error)
+	cgroupStatsGetter func(domainName string) (*CgroupStats, error)
+	diskStats         *diskStatsCollector
+	reclaimStorage    bool
+	missingMounts     MissingMountPolicy
+	nodeAnnotations   map[string]string
+	creatingVMsLock   sync.Mutex
+	creatingVMs       map[string]bool
+	versionLock       sync.Mutex
+	versions          *hypervisorVersions
+	guestInfoLock     sync.Mutex
+	guestInfoCache    map[string]*guestInfoCacheEntry
+	// domainEventsWG is used to wait for the domain events
+	// that are being handled
+	domainEventsWG sync.WaitGroup
+	// tombstoneTTL is the time the tombstones of the removed
+	// containers are kept
+	tombstoneTTL time.Duration
+	// qosScheduling maps the QoS classes to the scheduling
+	// settings of the QEMU processes
+	qosScheduling QOSSchedulingConfig
+	// processTuner applies the scheduling settings to the QEMU
+	// process of the domain with the specified name
+	processTuner func(domainName string, settings QOSSchedulingSettings) error
+	// bootLimiter limits the number of the VMs that are being
+	// started at the same time
+	bootLimiter *bootLimiter
 }
 
-var _ volumeOwner = &VirtualizationTool{}
+var _ VolumeOwner = &VirtualizationTool{}
 
 // NewVirtualizationTool verifies existence of volumes pool in libvirt store
 // and returns initialized VirtualizationTool.
 func NewVirtualizationTool(domainConn virt.DomainConnection, storageConn virt.StorageConnection, imageManager ImageManager,
-	metadataStore metadata.Store, volumePoolName, rawDevices string, volumeSource VMVolumeSource) *VirtualizationTool {
+	metadataStore metadata.Store, volumePoolName string, volumeSource VMVolumeSource) *VirtualizationTool {
 	return &VirtualizationTool{
 		domainConn:     domainConn,
 		storageConn:    storageConn,
@@ -206,9 +390,31 @@ func NewVirtualizationTool(domainConn virt.DomainConnection, storageConn virt.St
 		// Need to remove it from daemonset mounts (both dev and non-dev)
 		// Use 'nsenter -t 1 -m -- tar ...' or something to grab the path
 		// from root namespace
-		kubeletRootDir: defaultKubeletRootDir,
-		rawDevices:     strings.Split(rawDevices, ","),
-		volumeSource:   volumeSource,
+		kubeletRootDir:    defaultKubeletRootDir,
+		volumeSource:      volumeSource,
+		domainTypeChecker: checkDomainType,
+		nvdimmChecker:     checkNVDIMMSupport,
+		rtSchedChecker:    checkRTScheduling,
+		ifSourceChecker:   checkInterfaceSource,
+		numaInfoGetter:    getNUMANodeInfo,
+		pciDevicesGetter:  getVFIOGroupPCIDevices,
+		gpuDevicesGetter:  getGPUGroupPCIDevices,
+		guestAgentConfig:  GuestAgentConfig{Retries: -1}.withDefaults(),
+		hookConfig:        HookConfig{}.withDefaults(),
+		startupConfig:     StartupConfig{}.withDefaults(),
+		bootTimeConfig:    BootTimeConfig{}.withDefaults(),
+		bootWatches:       make(map[string]*bootWatch),
+		bootLimiter:       newBootLimiter(0),
+		hookRunner:        runHookCommand,
+		deviceProfile:     DeviceProfileDefault,
+		savedStateDir:     DefaultSavedStateDir,
+		nicStatsGetter:    getNICStats,
+		cgroupStatsGetter: getCgroupStats,
+		processTuner:      tuneQEMUProcess,
+		diskStats:         newDiskStatsCollector(),
+		creatingVMs:       make(map[string]bool),
+		guestInfoCache:    make(map[string]*guestInfoCacheEntry),
+		missingMounts:     MissingMountFail,
 	}
 }
 
@@ -217,11 +423,67 @@ func (v *VirtualizationTool) SetForceKVM(forceKVM bool) {
 	v.forceKVM = forceKVM
 }
 
+// SetMaxVolumeCount sets the maximum number of volumes per VM
+// including the root and the config volumes. Zero value means
+// that only the limits of the disk drivers are applied.
+func (v *VirtualizationTool) SetMaxVolumeCount(maxVolumeCount int) {
+	v.maxVolumeCount = maxVolumeCount
+}
+
+// SetMinGracefulStopTimeout sets the shortest StopContainer timeout
+// for which Virtlet tries to shut down the VM gracefully. The VMs
+// are destroyed right away if the timeout is shorter than that.
+// Zero timeout always means destroying the VM without graceful
+// shutdown attempts.
+func (v *VirtualizationTool) SetMinGracefulStopTimeout(timeout time.Duration) {
+	v.minStopTimeout = timeout
+}
+
+// SetSkipNoopConfigISO makes Virtlet omit the cloud-init config
+// ISO for the VMs that have no SSH keys, user-data, meta-data,
+// environment variables, mounts or extra network interfaces to
+// configure, unless VirtletForceConfigISO annotation is set
+func (v *VirtualizationTool) SetSkipNoopConfigISO(skip bool) {
+	v.skipNoopConfigISO = skip
+}
+
+// SetConfigISOInPool makes Virtlet store the cloud-init config ISOs
+// as volumes in the storage pool instead of the files in the config
+// ISO directory, so they're accounted like the other volumes. It must
+// be called after SetStoragePoolConfig as only dir storage pools are
+// supported.
+func (v *VirtualizationTool) SetConfigISOInPool(enable bool) error {
+	if enable && !v.storagePoolConfig.isDir() {
+		return fmt.Errorf("config ISOs can only be stored in dir storage pools")
+	}
+	v.configISOInPool = enable
+	return nil
+}
+
+// SetImageTenantIsolation makes Virtlet take the images for the
+// root volumes of the VMs from the image caches of the tenants
+// the VMs belong to. The tenant is determined by the namespace
+// of the pod. The image manager must implement image.TenantStore.
+func (v *VirtualizationTool) SetImageTenantIsolation(enable bool) {
+	v.imageTenants = enable
+}
+
 // SetClock sets the clock to use (used in tests)
 func (v *VirtualizationTool) SetClock(clock clockwork.Clock) {
 	v.clock = clock
 }
 
+// SetStoragePoolConfig sets the configuration of the storage pool that's
+// used for the volumes. The pool is created upon the first use if it
+// doesn't exist yet.
+func (v *VirtualizationTool) SetStoragePoolConfig(config StoragePoolConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	v.storagePoolConfig = config
+	return nil
+}
+
 // SetKubeletRootDir sets kubelet root dir for VirtualizationTool
 func (v *VirtualizationTool) SetKubeletRootDir(kubeletRootDir string) {
 	v.kubeletRootDir = kubeletRootDir
@@ -268,44 +530,108 @@ func (v *VirtualizationTool) addSerialDevicesToDomain(domain *libvirtxml.Domain)
 
 // CreateContainer defines libvirt domain for VM, prepares it's disks and stores
 // all info in metadata store.  It returns domain uuid generated basing on pod
-// sandbox id.
+// sandbox id, or the uuid of a VM taken from the warm pool if there's
+// a matching one.
 func (v *VirtualizationTool) CreateContainer(config *VMConfig, netFdKey string) (string, error) {
+	// keep Reconcile from removing the resources of the
+	// container till its metadata is stored
+	v.reconcileLock.RLock()
+	defer v.reconcileLock.RUnlock()
+
+	config.PodAnnotations = v.withNodeAnnotations(config.PodAnnotations)
 	if err := config.LoadAnnotations(); err != nil {
 		return "", err
 	}
+	v.logEffectiveAnnotations(config)
+
+	if domainType := config.ParsedAnnotations.DomainType; domainType != "" {
+		if err := v.domainTypeChecker(domainType); err != nil {
+			return "", err
+		}
+	}
+
+	if err := v.checkMounts(config); err != nil {
+		return "", err
+	}
+
+	if name := config.ParsedAnnotations.RestoreFrom; name != "" {
+		if _, err := os.Stat(v.savedImagePath(name)); err != nil {
+			return "", fmt.Errorf("can't use saved state image %q: %v", name, err)
+		}
+		if _, err := v.loadSavedImageInfo(name); err != nil {
+			return "", err
+		}
+	}
+
+	if v.imageTenants {
+		config.ImageTenant = config.PodNamespace
+	}
+	config.BootPhoneHomeURL = v.bootPhoneHomeURL()
+
+	containerID, err := v.claimWarmVM(config, netFdKey)
+	if err != nil {
+		return "", err
+	}
+	if containerID != "" {
+		if err := v.runPostCreateHook(containerID, config); err != nil {
+			if rmErr := v.removeContainer(containerID); rmErr != nil {
+				glog.Warningf("Failed to remove container %q: %v", containerID, rmErr)
+			}
+			return "", err
+		}
+		return containerID, nil
+	}
 
-	domainUUID := utils.NewUUID5(ContainerNsUUID, config.PodSandboxID)
 	// FIXME: this field should be moved to VMStatus struct (to be added)
-	config.DomainUUID = domainUUID
-	settings := domainSettings{
-		domainUUID: domainUUID,
-		// Note: using only first 13 characters because libvirt has an issue with handling
-		// long path names for qemu monitor socket
-		domainName: "virtlet-" + domainUUID[:13] + "-" + config.Name,
-		netFdKey:   netFdKey,
+	config.DomainUUID = utils.NewUUID5(ContainerNsUUID, config.PodSandboxID)
+	defer v.trackVMCreation(config.DomainUUID)()
+	if nvdimm := config.ParsedAnnotations.NVDIMM; nvdimm != nil {
+		if nvdimm.Path == "" {
+			if err := os.MkdirAll(nvdimmDir, 0700); err != nil {
+				return "", fmt.Errorf("failed to create NVDIMM directory %q: %v", nvdimmDir, err)
+			}
+		}
+		if err := v.nvdimmChecker(nvdimmPath(config)); err != nil {
+			return "", err
+		}
+	}
+	if config.ParsedAnnotations.RTScheduler != nil {
+		if err := v.rtSchedChecker(); err != nil {
+			return "", err
+		}
 	}
 
-	cloneName := "virtlet_root_" + settings.domainUUID
-	settings.vcpuNum = config.ParsedAnnotations.VCPUCount
-	settings.memory = int(config.MemoryLimitInBytes)
-	settings.cpuShares = uint(config.CPUShares)
-	settings.cpuPeriod = uint64(config.CPUPeriod)
-	// Specified cpu bandwidth limits for domains actually are set equal per each vCPU by libvirt
-	// Thus, to limit overall VM's cpu threads consumption by set value in pod definition need to perform division
-	settings.cpuQuota = config.CPUQuota / int64(settings.vcpuNum)
-	settings.memoryUnit = "b"
-	if settings.memory == 0 {
-		settings.memory = defaultMemory
-		settings.memoryUnit = defaultMemoryUnit
+	if ifSource := config.ParsedAnnotations.InterfaceSource; ifSource != nil {
+		if err := v.checkInterfaceSourceAllowed(ifSource); err != nil {
+			return "", err
+		}
+		if err := v.ifSourceChecker(ifSource); err != nil {
+			return "", err
+		}
 	}
 
-	settings.useKvm = v.forceKVM || canUseKvm()
+	settings := v.newDomainSettings(config, netFdKey)
+	if settings.hostPCIDevices, err = v.hostPCIDevices(config); err != nil {
+		return "", err
+	}
+	if settings.vfInterfaces, err = vfInterfaces(config); err != nil {
+		return "", err
+	}
+	if node := config.ParsedAnnotations.NUMANode; node != nil {
+		if err := v.bindToNUMANode(settings, *node); err != nil {
+			return "", err
+		}
+	}
 	domainDef := settings.createDomain(config)
 
 	diskList, err := newDiskList(config, v.volumeSource, v)
 	if err != nil {
 		return "", err
 	}
+	if v.maxVolumeCount > 0 && len(diskList.items) > v.maxVolumeCount {
+		return "", fmt.Errorf("too many volumes: %d. At most %d volumes are allowed per VM on this node including the root and the config volumes",
+			len(diskList.items), v.maxVolumeCount)
+	}
 	domainDef.Devices.Disks, err = diskList.setup()
 	if err != nil {
 		return "", err
@@ -322,41 +648,46 @@ func (v *VirtualizationTool) CreateContainer(config *VMConfig, netFdKey string)
 		if err := diskList.teardown(); err != nil {
 			glog.Warningf("error tearing down volumes after an error: %v", err)
 		}
+		v.releaseExternalVolumes(settings.domainUUID)
+		v.releasePCIDevices(settings.domainUUID)
 	}()
 
-	if err := v.addSerialDevicesToDomain(domainDef); err != nil {
+	if err := v.claimExternalVolumes(settings.domainUUID, domainDef.Devices.Disks); err != nil {
 		return "", err
 	}
 
-	labels := map[string]string{}
-	for k, v := range config.ContainerLabels {
-		labels[k] = v
+	if err := v.claimPCIDevices(settings.domainUUID, settings.hostPCIDevices); err != nil {
+		return "", err
+	}
+
+	if err := diskList.applyQueueOptions(domainDef); err != nil {
+		return "", err
+	}
+
+	if err := diskList.applyIOOptions(domainDef, v.ioURingSupported); err != nil {
+		return "", err
+	}
+
+	diskList.setupSeed(domainDef)
+
+	if err := applyEmulatorPin(domainDef, config); err != nil {
+		return "", err
+	}
+	applyRTScheduler(domainDef, config)
+
+	if err := v.addSerialDevicesToDomain(domainDef); err != nil {
+		return "", err
 	}
-	labels[kubetypes.KubernetesPodNameLabel] = config.PodName
-	labels[kubetypes.KubernetesPodNamespaceLabel] = config.PodNamespace
-	labels[kubetypes.KubernetesPodUIDLabel] = config.PodSandboxID
-	labels[kubetypes.KubernetesContainerNameLabel] = config.Name
 
 	domain, err := v.domainConn.DefineDomain(domainDef)
 	if err == nil {
 		err = diskList.writeImages(domain)
 	}
 	if err == nil {
-		// FIXME: store VMConfig + VMStatus (to be added)
-		err = v.metadataStore.Container(settings.domainUUID).Save(
-			func(_ *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
-				return &metadata.ContainerInfo{
-					SandboxID:           config.PodSandboxID,
-					Name:                config.Name,
-					CreatedAt:           v.clock.Now().UnixNano(),
-					Image:               config.Image,
-					RootImageVolumeName: cloneName,
-					Labels:              labels,
-					Annotations:         config.ContainerAnnotations,
-					Attempt:             config.Attempt,
-					State:               kubeapi.ContainerState_CONTAINER_CREATED,
-				}, nil
-			})
+		err = v.runPostCreateHook(settings.domainUUID, config)
+	}
+	if err == nil {
+		err = v.saveContainerInfo(config)
 	}
 	if err != nil {
 		return "", err
@@ -366,7 +697,100 @@ func (v *VirtualizationTool) CreateContainer(config *VMConfig, netFdKey string)
 	return settings.domainUUID, nil
 }
 
+// containerDomainName returns the name of the domain of the container
+// with the specified id and name.
+// Note: using only first 13 characters because libvirt has an issue with handling
+// long path names for qemu monitor socket
+func containerDomainName(containerID, name string) string {
+	return "virtlet-" + containerID[:13] + "-" + name
+}
+
+// newDomainSettings returns domainSettings for the specified VMConfig.
+// config.DomainUUID must be set before calling this function.
+func (v *VirtualizationTool) newDomainSettings(config *VMConfig, netFdKey string) *domainSettings {
+	settings := &domainSettings{
+		domainUUID: config.DomainUUID,
+		domainName: containerDomainName(config.DomainUUID, config.Name),
+		netFdKey:   netFdKey,
+	}
+
+	settings.vcpuNum = config.ParsedAnnotations.VCPUCount
+	settings.deviceProfile = v.deviceProfile
+	settings.fileBacked = v.memoryBackingDir != ""
+	settings.memory = int(config.MemoryLimitInBytes)
+	settings.cpuShares = uint(config.CPUShares)
+	settings.cpuPeriod = uint64(config.CPUPeriod)
+	// Specified cpu bandwidth limits for domains actually are set equal per each vCPU by libvirt
+	// Thus, to limit overall VM's cpu threads consumption by set value in pod definition need to perform division
+	settings.cpuQuota = config.CPUQuota / int64(settings.vcpuNum)
+	settings.memoryUnit = "b"
+	if settings.memory == 0 {
+		settings.memory = defaultMemory
+		settings.memoryUnit = defaultMemoryUnit
+	}
+	// the VM starts with its memory request and the balloon
+	// lets the guest grow up to the maximum memory
+	if request := uint64(config.MemoryRequestInBytes); request > 0 && request < settings.memoryInBytes() {
+		settings.currentMemory = request
+	}
+
+	switch config.ParsedAnnotations.DomainType {
+	case defaultDomainType:
+		settings.useKvm = true
+	case noKvmDomainType:
+		settings.useKvm = false
+	default:
+		settings.useKvm = v.forceKVM || canUseKvm()
+	}
+	return settings
+}
+
+// saveContainerInfo stores the metadata of a newly created container
+func (v *VirtualizationTool) saveContainerInfo(config *VMConfig) error {
+	labels := map[string]string{}
+	for k, v := range config.ContainerLabels {
+		labels[k] = v
+	}
+	labels[kubetypes.KubernetesPodNameLabel] = config.PodName
+	labels[kubetypes.KubernetesPodNamespaceLabel] = config.PodNamespace
+	labels[kubetypes.KubernetesPodUIDLabel] = config.PodSandboxID
+	labels[kubetypes.KubernetesContainerNameLabel] = config.Name
+
+	var env []metadata.KeyValue
+	for _, kv := range config.Environment {
+		env = append(env, metadata.KeyValue{Key: kv.Key, Value: kv.Value})
+	}
+	var mounts []metadata.Mount
+	for _, m := range config.Mounts {
+		mounts = append(mounts, metadata.Mount{ContainerPath: m.ContainerPath, HostPath: m.HostPath})
+	}
+
+	// FIXME: store VMConfig + VMStatus (to be added)
+	return v.metadataStore.Container(config.DomainUUID).Save(
+		func(_ *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+			return &metadata.ContainerInfo{
+				SandboxID:             config.PodSandboxID,
+				Name:                  config.Name,
+				CreatedAt:             v.clock.Now().UnixNano(),
+				Image:                 config.Image,
+				ImageDigest:           config.RootImageDigest,
+				RootImageVolumeName:   "virtlet_root_" + config.DomainUUID,
+				Labels:                labels,
+				Annotations:           config.ContainerAnnotations,
+				Attempt:               config.Attempt,
+				State:                 kubeapi.ContainerState_CONTAINER_CREATED,
+				Environment:           env,
+				Mounts:                mounts,
+				ConfigAnnotationsHash: configAnnotationsHash(config),
+				RestartPolicy:         config.ParsedAnnotations.RestartPolicy,
+				ReadonlyRootfs:        config.ReadonlyRootfs,
+				QOSClass:              string(getQOSClass(config)),
+			}, nil
+		})
+}
+
 func (v *VirtualizationTool) startContainer(containerID string) error {
+	start := v.clock.Now()
 	domain, err := v.domainConn.LookupDomainByUUIDString(containerID)
 	if err != nil {
 		return fmt.Errorf("failed to look up domain %q: %v", containerID, err)
@@ -376,58 +800,81 @@ func (v *VirtualizationTool) startContainer(containerID string) error {
 	if err != nil {
 		return fmt.Errorf("failed to get state of the domain %q: %v", containerID, err)
 	}
+	if state == virt.DomainStateRunning && v.claimedFromWarmPool(containerID) {
+		glog.V(1).Infof("Domain %q was taken from the warm pool and is already running", containerID)
+		if err := v.setDomainAutostart(containerID, domain, true); err != nil {
+			return err
+		}
+		v.applyQOSScheduling(containerID, domain)
+		return v.markContainerStarted(containerID)
+	}
 	if state != virt.DomainStateShutoff {
 		return fmt.Errorf("domain %q: bad state %v upon StartContainer()", containerID, state)
 	}
+	v.renameClaimedDomain(containerID, domain)
 
-	if err = domain.Create(); err != nil {
-		return fmt.Errorf("failed to create domain %q: %v", containerID, err)
+	if err := v.refreshConfigISO(containerID, domain); err != nil {
+		return err
 	}
 
-	// XXX: maybe we don't really have to wait here but I couldn't
-	// find it in libvirt docs.
-	if err = utils.WaitLoop(func() (bool, error) {
-		state, err := domain.State()
-		if err != nil {
-			return false, fmt.Errorf("failed to get state of the domain %q: %v", containerID, err)
-		}
-		switch state {
-		case virt.DomainStateRunning:
-			return true, nil
-		case virt.DomainStateShutdown:
-			return false, fmt.Errorf("unexpected shutdown for new domain %q", containerID)
-		case virt.DomainStateCrashed:
-			return false, fmt.Errorf("domain %q crashed on start", containerID)
-		default:
-			return false, nil
-		}
-	}, domainStartCheckInterval, domainStartTimeout, v.clock); err != nil {
+	restorePath, savedImage, err := v.restoreImagePath(containerID)
+	if err != nil {
+		return err
+	}
+	if restorePath != "" {
+		err = v.restoreDomainFromImage(containerID, domain, restorePath, savedImage)
+	} else {
+		err = v.startDomain(containerID, domain)
+	}
+	if err != nil {
+		return err
+	}
+	v.applyQOSScheduling(containerID, domain)
+
+	if err := v.setDomainAutostart(containerID, domain, true); err != nil {
 		return err
 	}
 
+	if err := v.markContainerStarted(containerID); err != nil {
+		return err
+	}
+
+	return v.watchBoot(containerID, domain, start)
+}
+
+func (v *VirtualizationTool) markContainerStarted(containerID string) error {
 	return v.metadataStore.Container(containerID).Save(
 		func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
 			// make sure the container is not removed during the call
 			if c != nil {
 				c.State = kubeapi.ContainerState_CONTAINER_RUNNING
 				c.StartedAt = v.clock.Now().UnixNano()
+				c.BootDuration = 0
+				c.GuestShutdown = false
+				c.FromWarmPool = false
 			}
 			return c, nil
 		})
 }
 
-// StartContainer calls libvirt to start domain, waits up to 10 seconds for
-// DOMAIN_RUNNING state, then updates it's state in metadata store.
+// StartContainer calls libvirt to start domain, waits up to the startup
+// timeout (10 seconds by default, see SetStartupConfig) for DOMAIN_RUNNING
+// state, then updates it's state in metadata store. The domain that
+// doesn't start in time is destroyed. The number of the VMs that
+// are started at the same time may be limited, see SetMaxConcurrentBoots.
 // If there was an error it will be returned to caller after an domain removal
 // attempt.  If also it had an error - both of them will be combined.
 func (v *VirtualizationTool) StartContainer(containerID string) error {
-	if err := v.startContainer(containerID); err != nil {
+	defer v.containerLocks.lock(containerID)()
+	if err := v.bootLimiter.run(v.clock, containerID, func() error {
+		return v.startContainer(containerID)
+	}); err != nil {
 		// FIXME: we do this here because kubelet may attempt new `CreateContainer()`
 		// calls for this VM after failed `StartContainer()` without first removing it.
 		// Better solution is perhaps moving domain setup logic to `StartContainer()`
 		// and cleaning it all up upon failure, but for now we just remove the VM
 		// so the next `CreateContainer()` call succeeds.
-		if rmErr := v.RemoveContainer(containerID); rmErr != nil {
+		if rmErr := v.removeContainer(containerID); rmErr != nil {
 			return fmt.Errorf("container start error: %v \n+ container removal error: %v", err, rmErr)
 		}
 
@@ -438,53 +885,50 @@ func (v *VirtualizationTool) StartContainer(containerID string) error {
 }
 
 // StopContainer calls graceful shutdown of domain and if it was non successful
-// it calls libvirt to destroy that domain.
-// Successful shutdown or destroy of domain is followed by removal of
-// VM info from metadata store.
-// Succeeded removal of metadata is followed by volumes cleanup.
+// it calls libvirt to destroy that domain. The timeout (CRI grace period)
+// limits the graceful shutdown attempts including the guest agent calls.
+// If the timeout is zero or shorter than the one set using
+// SetMinGracefulStopTimeout, the domain is destroyed right away.
+// Successful shutdown or destroy of domain is followed by updating
+// the VM state in metadata store and flexvolume cleanup.
+// The root volume and the config volume are kept till RemoveContainer
+// so the VM can be started again or its disk can be exported.
 func (v *VirtualizationTool) StopContainer(containerID string, timeout time.Duration) error {
+	defer v.containerLocks.lock(containerID)()
 	domain, err := v.domainConn.LookupDomainByUUIDString(containerID)
+	if err == virt.ErrDomainNotFound {
+		// StopContainer may be retried by kubelet after the container
+		// has already been removed by a concurrent RemoveContainer call
+		if containerInfo, err := v.metadataStore.Container(containerID).Retrieve(); err != nil {
+			return err
+		} else if containerInfo == nil {
+			glog.Warningf("StopContainer(): container %q is already removed", containerID)
+			return nil
+		}
+	}
 	if err != nil {
 		return err
 	}
 
-	// We try to shut down the VM gracefully first. This may take several attempts
-	// because shutdown requests may be ignored e.g. when the VM boots.
-	// If this fails, we just destroy the domain (i.e. power off the VM).
-	err = utils.WaitLoop(func() (bool, error) {
-		_, err := v.domainConn.LookupDomainByUUIDString(containerID)
-		if err == virt.ErrDomainNotFound {
-			return true, nil
-		}
-		if err != nil {
-			return false, fmt.Errorf("failed to look up the domain %q: %v", containerID, err)
-		}
-
-		// domain.Shutdown() may return 'invalid operation' error if domain is already
-		// shut down. But checking the state beforehand will not make the situation
-		// any simpler because we'll still have a race, thus we need multiple attempts
-		domainShutdownErr := domain.Shutdown()
-
-		state, err := domain.State()
-		if err != nil {
-			return false, fmt.Errorf("failed to get state of the domain %q: %v", containerID, err)
-		}
-
-		if state == virt.DomainStateShutoff {
-			return true, nil
-		}
+	// the VM that's being stopped must not come back after the
+	// node reboot
+	if err := v.setDomainAutostart(containerID, domain, false); err != nil {
+		glog.Warningf("StopContainer(): %v", err)
+	}
 
-		if domainShutdownErr != nil {
-			// The domain is not in 'DOMAIN_SHUTOFF' state and domain.Shutdown() failed,
-			// so we need to return the error that happened during Shutdown()
-			return false, fmt.Errorf("failed to shut down domain %q: %v", containerID, err)
+	// Zero stop timeout, which is passed e.g. when the container
+	// is force-killed, means destroying the VM right away
+	graceful := timeout > 0 && timeout >= v.minStopTimeout
+	if graceful {
+		deadline := v.clock.Now().Add(gracefulShutdownTimeout(timeout))
+		if err = v.shutdownDomain(containerID, domain, v.containerShutdownModes(containerID), deadline); err != nil {
+			glog.Warningf("Failed to shut down VM %q: %v -- trying to destroy the domain", containerID, err)
 		}
+	} else {
+		glog.V(2).Infof("Stop timeout for VM %q is %v, destroying the domain without graceful shutdown", containerID, timeout)
+	}
 
-		return false, nil
-	}, domainShutdownRetryInterval, timeout, v.clock)
-
-	if err != nil {
-		glog.Warningf("Failed to shut down VM %q: %v -- trying to destroy the domain", containerID, err)
+	if !graceful || err != nil {
 		// if the domain is destroyed successfully we return no error
 		if err = domain.Destroy(); err != nil {
 			return fmt.Errorf("failed to destroy the domain: %v", err)
@@ -503,15 +947,211 @@ func (v *VirtualizationTool) StopContainer(containerID string, timeout time.Dura
 	}
 
 	if err == nil {
-		// Note: volume cleanup is done right after domain has been stopped
+		// Note: flexvolume cleanup is done right after domain has been stopped
 		// due to by the time the ContainerRemove request all flexvolume
-		// data is already removed by kubelet's VolumeManager
+		// data is already removed by kubelet's VolumeManager. The rest
+		// of the volumes are kept till RemoveContainer.
 		return v.cleanupVolumes(containerID)
 	}
 
 	return err
 }
 
+// shutdownDomain tries to shut down the VM gracefully before the
+// deadline, which includes the time spent on the guest agent calls.
+// The shutdown modes are tried in the specified order
+// till one of them accepts the shutdown request. Empty list of
+// modes means using the guest agent, if the VM has it, and then
+// ACPI shutdown.
+func (v *VirtualizationTool) shutdownDomain(containerID string, domain virt.Domain, modes []ShutdownMode, deadline time.Time) error {
+	hasAgent, err := domainHasGuestAgent(domain)
+	if err != nil {
+		return fmt.Errorf("failed to get the definition of the domain %q: %v", containerID, err)
+	}
+	if len(modes) == 0 {
+		modes = defaultShutdownModes(hasAgent)
+	}
+
+	for n, mode := range modes {
+		// The guest agent calls are time-limited, so if the agent
+		// is not responding, we fall back to the next mode
+		if mode != ShutdownModeACPI {
+			if err := v.requestShutdown(domain, mode, hasAgent, deadline); err != nil {
+				glog.Warningf("Failed to shut down VM %q using %s shutdown mode: %v", containerID, mode, err)
+				continue
+			}
+		}
+		requestFailed, err := v.waitForShutdown(containerID, domain, mode == ShutdownModeACPI, deadline)
+		if requestFailed && n < len(modes)-1 {
+			glog.Warningf("Failed to shut down VM %q using %s shutdown mode: %v", containerID, mode, err)
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("none of the shutdown modes %v worked for domain %q", modes, containerID)
+}
+
+// waitForShutdown waits for the VM to stop till the deadline. If
+// repeatACPI is true, ACPI shutdown requests are made till the VM
+// stops. It returns true along with the error if an ACPI shutdown
+// request fails.
+func (v *VirtualizationTool) waitForShutdown(containerID string, domain virt.Domain, repeatACPI bool, deadline time.Time) (bool, error) {
+	// We try to shut down the VM gracefully first. This may take several attempts
+	// because shutdown requests may be ignored e.g. when the VM boots.
+	// If this fails, we just destroy the domain (i.e. power off the VM).
+	// The last retry interval is shortened so the graceful shutdown
+	// doesn't exceed the time budget.
+	for {
+		done, requestFailed, err := v.checkShutdown(containerID, domain, repeatACPI)
+		if done || err != nil {
+			return requestFailed, err
+		}
+		remaining := deadline.Sub(v.clock.Now())
+		if remaining > domainShutdownRetryInterval {
+			remaining = domainShutdownRetryInterval
+		}
+		if remaining > 0 {
+			v.clock.Sleep(remaining)
+		}
+		if !v.clock.Now().Before(deadline) {
+			return false, utils.ErrTimeout
+		}
+	}
+}
+
+// checkShutdown checks whether the VM is stopped, making an ACPI
+// shutdown request first if repeatACPI is true. It returns true as
+// the second value along with the error if the request fails.
+func (v *VirtualizationTool) checkShutdown(containerID string, domain virt.Domain, repeatACPI bool) (bool, bool, error) {
+	_, err := v.domainConn.LookupDomainByUUIDString(containerID)
+	if err == virt.ErrDomainNotFound {
+		return true, false, nil
+	}
+	if err != nil {
+		return false, false, fmt.Errorf("failed to look up the domain %q: %v", containerID, err)
+	}
+
+	// domain.Shutdown() may return 'invalid operation' error if domain is already
+	// shut down. But checking the state beforehand will not make the situation
+	// any simpler because we'll still have a race, thus we need multiple attempts.
+	// If another shutdown mode has accepted the shutdown request, we just wait
+	// for the VM to shut down.
+	var domainShutdownErr error
+	if repeatACPI {
+		domainShutdownErr = domain.Shutdown()
+	}
+
+	state, err := domain.State()
+	if err != nil {
+		return false, false, fmt.Errorf("failed to get state of the domain %q: %v", containerID, err)
+	}
+
+	if state == virt.DomainStateShutoff {
+		return true, false, nil
+	}
+
+	if domainShutdownErr != nil {
+		// The domain is not in 'DOMAIN_SHUTOFF' state and domain.Shutdown() failed,
+		// so we need to return the error that happened during Shutdown()
+		return false, true, fmt.Errorf("failed to shut down domain %q: %v", containerID, domainShutdownErr)
+	}
+
+	return false, false, nil
+}
+
+// UpdateCloudInit stores the new pod annotations in the metadata
+// store, regenerates the config image (cloud-init data) for the
+// container and re-attaches it to the domain without recreating the
+// VM. This can be used e.g. to rotate SSH keys. The guest needs to
+// re-run cloud-init to pick up the changes. If rerun is true and
+// the VM has the guest agent enabled, cloud-init is re-run via the
+// agent. If the VM is stopped, only the annotations are stored, and
+// the config image is regenerated by StartContainer.
+func (v *VirtualizationTool) UpdateCloudInit(containerID string, podAnnotations map[string]string, rerun bool) error {
+	defer v.containerLocks.lock(containerID)()
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		return fmt.Errorf("failed to look up domain %q: %v", containerID, err)
+	}
+	state, err := domain.State()
+	if err != nil {
+		return fmt.Errorf("failed to get state of the domain %q: %v", containerID, err)
+	}
+	if rerun && state != virt.DomainStateRunning {
+		return fmt.Errorf("can't re-run cloud-init in domain %q: the domain is not running", containerID)
+	}
+
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	if err != nil {
+		return err
+	}
+	if containerInfo == nil {
+		return fmt.Errorf("missing containerInfo for containerID: %s", containerID)
+	}
+
+	if err := v.metadataStore.PodSandbox(containerInfo.SandboxID).Save(
+		func(s *metadata.PodSandboxInfo) (*metadata.PodSandboxInfo, error) {
+			if s == nil {
+				return nil, fmt.Errorf("missing metadata for sandbox %q", containerInfo.SandboxID)
+			}
+			// make sure the new annotations are valid before storing them
+			ns := ""
+			if s.Metadata != nil {
+				ns = s.Metadata.Namespace
+			}
+			if _, err := LoadAnnotations(ns, podAnnotations); err != nil {
+				return nil, err
+			}
+			s.Annotations = podAnnotations
+			return s, nil
+		}); err != nil {
+		return err
+	}
+	if state == virt.DomainStateShutoff {
+		glog.V(1).Infof("Domain %q is not running, its config image will be regenerated when it's started", containerID)
+		return nil
+	}
+
+	config, _, err := v.getVMConfigFromMetadata(containerID)
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		return fmt.Errorf("container %q was removed during the update", containerID)
+	}
+
+	diskList, err := newDiskList(config, v.volumeSource, v)
+	if err != nil {
+		return err
+	}
+	if err := diskList.regenerateConfig(domain); err != nil {
+		return err
+	}
+	if err := v.setConfigAnnotationsHash(containerID, configAnnotationsHash(config)); err != nil {
+		return err
+	}
+	if rerun {
+		return v.rerunCloudInit(containerID, domain)
+	}
+	return nil
+}
+
+// rerunCloudInit makes the guest re-run cloud-init via the guest
+// agent so it picks up the regenerated config image
+func (v *VirtualizationTool) rerunCloudInit(containerID string, domain virt.Domain) error {
+	switch hasGuestAgent, err := domainHasGuestAgent(domain); {
+	case err != nil:
+		return fmt.Errorf("failed to get the definition of the domain %q: %v", containerID, err)
+	case !hasGuestAgent:
+		return fmt.Errorf("can't re-run cloud-init in domain %q: the guest agent is not enabled", containerID)
+	}
+	glog.V(1).Infof("Re-running cloud-init in domain %q", containerID)
+	if err := v.guestExec(domain, "cloud-init re-run", "/bin/sh", "-c", guestCloudInitRerunScript); err != nil {
+		return fmt.Errorf("failed to re-run cloud-init in domain %q: %v", containerID, err)
+	}
+	return nil
+}
+
 func (v *VirtualizationTool) getVMConfigFromMetadata(containerID string) (*VMConfig, kubeapi.ContainerState, error) {
 	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
 	if err != nil {
@@ -524,6 +1164,8 @@ func (v *VirtualizationTool) getVMConfigFromMetadata(containerID string) (*VMCon
 	}
 
 	podAnnotations := map[string]string{}
+	var podLabels map[string]string
+	var podName, podNamespace string
 	var csn *network.ContainerSideNetwork
 	if containerInfo.SandboxID != "" {
 		sandbox, err := v.metadataStore.PodSandbox(containerInfo.SandboxID).Retrieve()
@@ -536,20 +1178,36 @@ func (v *VirtualizationTool) getVMConfigFromMetadata(containerID string) (*VMCon
 			return nil, kubeapi.ContainerState_CONTAINER_UNKNOWN, nil
 		}
 		podAnnotations = sandbox.Annotations
+		podLabels = sandbox.Labels
 		csn = sandbox.ContainerSideNetwork
+		if sandbox.Metadata != nil {
+			podName = sandbox.Metadata.Name
+			podNamespace = sandbox.Metadata.Namespace
+		}
 	}
 
 	// TODO: here we're using incomplete VMConfig to tear down the volumes
 	// What actually needs to be done is storing VMConfig and VMStatus (to be added)
 	config := &VMConfig{
 		PodSandboxID:         containerInfo.SandboxID,
+		PodName:              podName,
+		PodNamespace:         podNamespace,
 		Name:                 containerInfo.Name,
 		Image:                containerInfo.Image,
 		DomainUUID:           containerID,
-		PodAnnotations:       podAnnotations,
+		PodAnnotations:       v.withNodeAnnotations(podAnnotations),
+		PodLabels:            podLabels,
 		ContainerAnnotations: containerInfo.Annotations,
 		ContainerLabels:      containerInfo.Labels,
 		ContainerSideNetwork: csn,
+		BootPhoneHomeURL:     v.bootPhoneHomeURL(),
+		ReadonlyRootfs:       containerInfo.ReadonlyRootfs,
+	}
+	for _, kv := range containerInfo.Environment {
+		config.Environment = append(config.Environment, &VMKeyValue{Key: kv.Key, Value: kv.Value})
+	}
+	for _, m := range containerInfo.Mounts {
+		config.Mounts = append(config.Mounts, &VMMount{ContainerPath: m.ContainerPath, HostPath: m.HostPath})
 	}
 
 	if err := config.LoadAnnotations(); err != nil {
@@ -573,7 +1231,7 @@ func (v *VirtualizationTool) cleanupVolumes(containerID string) error {
 
 	diskList, err := newDiskList(config, v.volumeSource, v)
 	if err == nil {
-		err = diskList.teardown()
+		err = diskList.teardownStopped(config.ParsedAnnotations.PreserveVolumesOnDelete)
 	}
 
 	if err != nil {
@@ -594,12 +1252,25 @@ func (v *VirtualizationTool) removeDomain(containerID string, config *VMConfig,
 	}
 
 	if domain != nil {
-		if state == kubeapi.ContainerState_CONTAINER_RUNNING {
+		domainState, err := domain.State()
+		if err != nil {
+			return fmt.Errorf("failed to get state of the domain %q: %v", containerID, err)
+		}
+		// crashed domains are still active and thus must be destroyed, too,
+		// as well as the running VMs taken from the warm pool which
+		// weren't started via StartContainer
+		if state == kubeapi.ContainerState_CONTAINER_RUNNING || domainState == virt.DomainStateCrashed || domainState == virt.DomainStateRunning {
 			if err := domain.Destroy(); err != nil {
 				return fmt.Errorf("failed to destroy the domain: %v", err)
 			}
 		}
 
+		// the internal snapshots are lost together with the
+		// root volume, so their metadata must go, too
+		if err := v.removeAllSnapshots(containerID, domain); err != nil {
+			return err
+		}
+
 		if err := domain.Undefine(); err != nil {
 			return fmt.Errorf("error undefining the domain %q: %v", containerID, err)
 		}
@@ -620,7 +1291,14 @@ func (v *VirtualizationTool) removeDomain(containerID string, config *VMConfig,
 
 	diskList, err := newDiskList(config, v.volumeSource, v)
 	if err == nil {
-		err = diskList.teardown()
+		if config.ParsedAnnotations.PreserveVolumesOnDelete {
+			err = diskList.preserve(v.clock.Now().UTC().Format("20060102T150405Z"))
+		} else {
+			err = diskList.teardown()
+			if nvdimmErr := removeNVDIMMFile(config); nvdimmErr != nil && err == nil {
+				err = nvdimmErr
+			}
+		}
 	}
 
 	switch {
@@ -638,6 +1316,11 @@ func (v *VirtualizationTool) removeDomain(containerID string, config *VMConfig,
 // even if it's still running.
 // It waits up to 5 sec for doing the job by libvirt.
 func (v *VirtualizationTool) RemoveContainer(containerID string) error {
+	defer v.containerLocks.lock(containerID)()
+	return v.removeContainer(containerID)
+}
+
+func (v *VirtualizationTool) removeContainer(containerID string) error {
 	config, state, err := v.getVMConfigFromMetadata(containerID)
 
 	if err != nil {
@@ -654,6 +1337,19 @@ func (v *VirtualizationTool) RemoveContainer(containerID string) error {
 		return err
 	}
 
+	v.releaseExternalVolumes(containerID)
+	v.releasePCIDevices(containerID)
+
+	if err := v.removeSavedState(containerID); err != nil {
+		return err
+	}
+
+	if v.tombstoneTTL > 0 {
+		if err := v.addTombstone(containerID); err != nil {
+			glog.Warningf("Failed to store the tombstone of container %q: %v", containerID, err)
+		}
+	}
+
 	if v.metadataStore.Container(containerID).Save(
 		func(_ *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
 			return nil, nil // delete container
@@ -663,6 +1359,8 @@ func (v *VirtualizationTool) RemoveContainer(containerID string) error {
 		return err
 	}
 
+	v.forgetGuestInfo(containerID)
+	v.runPostRemoveHook(containerID, config)
 	return nil
 }
 
@@ -713,6 +1411,28 @@ func (v *VirtualizationTool) getContainerInfo(domain virt.Domain, containerID st
 	}
 
 	containerState := virtToKubeState(state, containerInfo.State)
+	if containerInfo.FromWarmPool && state == virt.DomainStateRunning {
+		// the VM taken from the warm pool is already running,
+		// but the container is not started yet
+		containerState = kubeapi.ContainerState_CONTAINER_CREATED
+	}
+	if state == virt.DomainStatePaused && containerInfo.State == kubeapi.ContainerState_CONTAINER_RUNNING {
+		// libvirt may pause the domain while it's being shut
+		// down. Like DomainStateShutdown, this is not an exit
+		// yet. The container exits when the domain is shut off.
+		reason, err := domain.StateReason()
+		if err != nil {
+			return nil, err
+		}
+		if reason == virt.DomainStateReasonShuttingDown {
+			containerState = kubeapi.ContainerState_CONTAINER_RUNNING
+		}
+	}
+	if state == virt.DomainStateCrashed && containerInfo.State == kubeapi.ContainerState_CONTAINER_RUNNING && restartsOnCrash(containerInfo) {
+		// the VM is going to be restarted by Virtlet, so it
+		// must not be re-created by kubelet
+		containerState = kubeapi.ContainerState_CONTAINER_RUNNING
+	}
 	if containerInfo.State != containerState {
 		if err := v.metadataStore.Container(containerID).Save(
 			func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
@@ -807,8 +1527,9 @@ func (v *VirtualizationTool) ListContainers(filter *kubeapi.ContainerFilter) ([]
 				return nil, err
 			}
 			if containerInfo == nil {
-				// There's no such container - looks like it's already removed, so return an empty list
-				return containers, nil
+				// There's no such container - looks like it's already removed,
+				// but its tombstone may still be there
+				return v.appendTombstones(containers, filter)
 			}
 
 			// Query libvirt for domain found in metadata store
@@ -833,8 +1554,9 @@ func (v *VirtualizationTool) ListContainers(filter *kubeapi.ContainerFilter) ([]
 		} else if filter.PodSandboxId != "" {
 			domainContainers, err := v.metadataStore.ListPodContainers(filter.PodSandboxId)
 			if err != nil {
-				// There's no such sandbox - looks like it's already removed, so return an empty list
-				return containers, nil
+				// There's no such sandbox - looks like it's already removed,
+				// but the tombstones of its containers may still be there
+				return v.appendTombstones(containers, filter)
 			}
 			for _, containerMeta := range domainContainers {
 				// TODO: Distinguish lack of domain from other errors
@@ -862,7 +1584,7 @@ func (v *VirtualizationTool) ListContainers(filter *kubeapi.ContainerFilter) ([]
 					containers = append(containers, container)
 				}
 			}
-			return containers, nil
+			return v.appendTombstones(containers, filter)
 		}
 	}
 
@@ -891,13 +1613,23 @@ func (v *VirtualizationTool) ListContainers(filter *kubeapi.ContainerFilter) ([]
 		}
 	}
 
-	return containers, nil
+	return v.appendTombstones(containers, filter)
 }
 
 // ContainerStatus queries libvirt for domain setatus, converts it to corresponding
 // kubeapi container status including container info retrieved from metadata store.
 func (v *VirtualizationTool) ContainerStatus(containerID string) (*kubeapi.ContainerStatus, error) {
 	domain, err := v.domainConn.LookupDomainByUUIDString(containerID)
+	if err == virt.ErrDomainNotFound {
+		// the container may have been removed recently
+		tombstone, tErr := v.tombstone(containerID)
+		if tErr != nil {
+			return nil, tErr
+		}
+		if tombstone != nil {
+			return tombstoneStatus(containerID, tombstone), nil
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -913,6 +1645,21 @@ func (v *VirtualizationTool) ContainerStatus(containerID string) (*kubeapi.Conta
 
 	image := &kubeapi.ImageSpec{Image: containerInfo.Image}
 
+	var reason, message string
+	if containerInfo.State == kubeapi.ContainerState_CONTAINER_EXITED {
+		stateReason, err := domain.StateReason()
+		if err != nil {
+			return nil, err
+		}
+		if containerInfo.GuestShutdown {
+			reason = "GuestShutdown"
+			message = "the VM was powered off by the guest OS"
+		} else if stateReason == virt.DomainStateReasonPanicked {
+			reason = "GuestPanicked"
+			message = "guest kernel panic detected"
+		}
+	}
+
 	return &kubeapi.ContainerStatus{
 		Id: containerID,
 		Metadata: &kubeapi.ContainerMetadata{
@@ -925,25 +1672,33 @@ func (v *VirtualizationTool) ContainerStatus(containerID string) (*kubeapi.Conta
 		CreatedAt:   containerInfo.CreatedAt,
 		StartedAt:   containerInfo.StartedAt,
 		Labels:      containerInfo.Labels,
-		Annotations: containerInfo.Annotations,
+		Annotations: annotationsWithRestartCount(containerInfo),
+		Reason:      reason,
+		Message:     message,
 	}, nil
 }
 
-// volumeOwner implementation follows
+// VolumeOwner implementation follows
 
-// StoragePool implements volumeOwner StoragePool method
+// StoragePool implements VolumeOwner StoragePool method
 func (v *VirtualizationTool) StoragePool() (virt.StoragePool, error) {
-	return ensureStoragePool(v.storageConn, v.volumePoolName)
+	return ensureStoragePool(v.storageConn, v.volumePoolName, v.storagePoolConfig)
 }
 
-// DomainConnection implements volumeOwner DomainConnection method
+// DomainConnection implements VolumeOwner DomainConnection method
 func (v *VirtualizationTool) DomainConnection() virt.DomainConnection { return v.domainConn }
 
-// ImageManager implements volumeOwner ImageManager method
+// ImageManager implements VolumeOwner ImageManager method
 func (v *VirtualizationTool) ImageManager() ImageManager { return v.imageManager }
 
-// RawDevices implements volumeOwner RawDevices method
+// RawDevices implements VolumeOwner RawDevices method
 func (v *VirtualizationTool) RawDevices() []string { return v.rawDevices }
 
-// KubeletRootDir implements volumeOwner KubeletRootDir method
+// KubeletRootDir implements VolumeOwner KubeletRootDir method
 func (v *VirtualizationTool) KubeletRootDir() string { return v.kubeletRootDir }
+
+// SkipNoopConfigISO implements VolumeOwner SkipNoopConfigISO method
+func (v *VirtualizationTool) SkipNoopConfigISO() bool { return v.skipNoopConfigISO }
+
+// ConfigISOInPool implements VolumeOwner ConfigISOInPool method
+func (v *VirtualizationTool) ConfigISOInPool() bool { return v.configISOInPool }
@@ -18,21 +18,30 @@ package libvirttools
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/davecgh/go-spew/spew"
+	"github.com/ghodss/yaml"
 	"github.com/jonboulle/clockwork"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
 	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 	kubetypes "k8s.io/kubernetes/pkg/kubelet/types"
 
 	"github.com/Mirantis/virtlet/pkg/flexvolume"
+	"github.com/Mirantis/virtlet/pkg/image"
 	"github.com/Mirantis/virtlet/pkg/metadata"
 	"github.com/Mirantis/virtlet/pkg/utils"
 	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt"
 	"github.com/Mirantis/virtlet/pkg/virt/fake"
 	"github.com/Mirantis/virtlet/tests/criapi"
 	"github.com/Mirantis/virtlet/tests/gm"
@@ -57,6 +66,7 @@ type containerTester struct {
 	domainConn     *fake.FakeDomainConnection
 	storageConn    *fake.FakeStorageConnection
 	metadataStore  metadata.Store
+	imageManager   *FakeImageManager
 }
 
 func newContainerTester(t *testing.T, rec *testutils.TopLevelRecorder) *containerTester {
@@ -83,11 +93,26 @@ func newContainerTester(t *testing.T, rec *testutils.TopLevelRecorder) *containe
 		t.Fatalf("Failed to create fake bolt client: %v", err)
 	}
 
-	imageManager := NewFakeImageManager(ct.rec)
-	ct.virtTool = NewVirtualizationTool(ct.domainConn, ct.storageConn, imageManager, ct.metadataStore, "volumes", "loop*", GetDefaultVolumeSource())
+	ct.imageManager = NewFakeImageManager(ct.rec)
+	ct.virtTool = NewVirtualizationTool(ct.domainConn, ct.storageConn, ct.imageManager, ct.metadataStore, "volumes", GetDefaultVolumeSource())
+	if err := ct.virtTool.SetRawDevices(DefaultRawDevices); err != nil {
+		t.Fatalf("SetRawDevices(): %v", err)
+	}
 	ct.virtTool.SetClock(ct.clock)
 	// avoid unneeded diffs in the golden master data
 	ct.virtTool.SetForceKVM(true)
+	// the emulators aren't available in the test environment
+	ct.virtTool.domainTypeChecker = func(string) error { return nil }
+	ct.virtTool.nvdimmChecker = func(string) error { return nil }
+	ct.virtTool.rtSchedChecker = func() error { return nil }
+	ct.virtTool.ifSourceChecker = func(*InterfaceSourceConfig) error { return nil }
+	if err := ct.virtTool.SetInterfaceSources("bridge:br0,direct:eth1,network:default"); err != nil {
+		t.Fatalf("SetInterfaceSources(): %v", err)
+	}
+	ct.virtTool.numaInfoGetter = fakeNUMANodeInfo
+	if err := ct.virtTool.SetSavedStateDir(filepath.Join(ct.tmpDir, "saved")); err != nil {
+		t.Fatalf("SetSavedStateDir(): %v", err)
+	}
 	ct.kubeletRootDir = filepath.Join(ct.tmpDir, "kubelet-root")
 	ct.virtTool.SetKubeletRootDir(ct.kubeletRootDir)
 
@@ -111,7 +136,7 @@ func (ct *containerTester) teardown() {
 	os.RemoveAll(ct.tmpDir)
 }
 
-func (ct *containerTester) createContainer(sandbox *kubeapi.PodSandboxConfig, mounts []*kubeapi.Mount) string {
+func (ct *containerTester) vmConfig(sandbox *kubeapi.PodSandboxConfig, mounts []*kubeapi.Mount) *VMConfig {
 	req := &kubeapi.CreateContainerRequest{
 		PodSandboxId: sandbox.Metadata.Uid,
 		Config: &kubeapi.ContainerConfig{
@@ -134,8 +159,11 @@ func (ct *containerTester) createContainer(sandbox *kubeapi.PodSandboxConfig, mo
 	if err != nil {
 		ct.t.Fatalf("GetVMConfig(): %v", err)
 	}
+	return vmConfig
+}
 
-	containerID, err := ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns")
+func (ct *containerTester) createContainer(sandbox *kubeapi.PodSandboxConfig, mounts []*kubeapi.Mount) string {
+	containerID, err := ct.virtTool.CreateContainer(ct.vmConfig(sandbox, mounts), "/tmp/fakenetns")
 	if err != nil {
 		ct.t.Fatalf("CreateContainer: %v", err)
 	}
@@ -305,199 +333,1450 @@ func TestDomainForcedShutdown(t *testing.T) {
 	gm.Verify(t, gm.NewYamlVerifier(ct.rec.Content()))
 }
 
-func TestDoubleStartError(t *testing.T) {
-	ct := newContainerTester(t, testutils.NewToplevelRecorder())
-	defer ct.teardown()
-
-	sandbox := criapi.GetSandboxes(1)[0]
-	ct.setPodSandbox(sandbox)
-
-	containerID := ct.createContainer(sandbox, nil)
-	ct.clock.Advance(1 * time.Second)
-	ct.startContainer(containerID)
-	if err := ct.virtTool.StartContainer(containerID); err == nil {
-		t.Errorf("2nd StartContainer() didn't produce an error")
-	}
-}
-
-type volMount struct {
-	name          string
-	containerPath string
-}
-
-func TestDomainDefinitions(t *testing.T) {
-	flexVolumeDriver := flexvolume.NewFlexVolumeDriver(func() string {
-		// note that this is only good for just one flexvolume
-		return fakeUUID
-	}, flexvolume.NullMounter)
+func TestShortStopTimeout(t *testing.T) {
 	for _, tc := range []struct {
-		name        string
-		annotations map[string]string
-		flexVolumes map[string]map[string]interface{}
-		mounts      []volMount
+		name           string
+		minStopTimeout time.Duration
+		timeout        time.Duration
+		expectedCalls  []string
 	}{
 		{
-			name: "plain domain",
-		},
-		{
-			name: "raw devices",
-			flexVolumes: map[string]map[string]interface{}{
-				"raw": {
-					"type": "raw",
-					// FIXME: here we depend upon the fact that /dev/loop0
-					// indeed exists in the build container. But we shouldn't.
-					"path": "/dev/loop0",
-				},
-			},
+			name:          "zero timeout",
+			expectedCalls: []string{"Destroy"},
 		},
 		{
-			name: "volumes",
-			flexVolumes: map[string]map[string]interface{}{
-				"vol1": {
-					"type": "qcow2",
-				},
-				"vol2": {
-					"type":     "qcow2",
-					"capacity": "2MB",
-				},
-				"vol3": {
-					"type": "qcow2",
-				},
-			},
+			name:           "timeout below the minimum",
+			minStopTimeout: 10 * time.Second,
+			timeout:        5 * time.Second,
+			expectedCalls:  []string{"Destroy"},
 		},
 		{
-			name: "vcpu count",
-			annotations: map[string]string{
-				"VirtletVCPUCount": "4",
-			},
+			name:           "timeout above the minimum",
+			minStopTimeout: 10 * time.Second,
+			timeout:        stopContainerTimeout,
+			expectedCalls:  []string{"GuestAgentCommand", "ShutdownWithGuestAgent"},
 		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newContainerTester(t, testutils.NewToplevelRecorder())
+			defer ct.teardown()
+			ct.virtTool.SetMinGracefulStopTimeout(tc.minStopTimeout)
+
+			containerID := ct.startGuestAgentContainer()
+			start := len(ct.rec.Content())
+			if err := ct.virtTool.StopContainer(containerID, tc.timeout); err != nil {
+				t.Fatalf("StopContainer(): %v", err)
+			}
+			ct.verifyDomainState(containerID, virt.DomainStateShutoff)
+			if calls := ct.domainCalls(start); !reflect.DeepEqual(calls, tc.expectedCalls) {
+				t.Errorf("bad domain calls: %v instead of %v", calls, tc.expectedCalls)
+			}
+			if status := ct.containerStatus(containerID); status.State != kubeapi.ContainerState_CONTAINER_EXITED {
+				t.Errorf("Bad container state: %v instead of %v", status.State, kubeapi.ContainerState_CONTAINER_EXITED)
+			}
+		})
+	}
+}
+
+func TestStopContainerGracePeriod(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		gracePeriod time.Duration
+		// sleeps lists the pauses between ACPI shutdown attempts
+		sleeps []time.Duration
+		// destroyAfter is the time after which the domain is destroyed
+		destroyAfter time.Duration
+	}{
 		{
-			name: "ceph flexvolume",
-			flexVolumes: map[string]map[string]interface{}{
-				"ceph": {
-					"type":    "ceph",
-					"monitor": "127.0.0.1:6789",
-					"pool":    "libvirt-pool",
-					"volume":  "rbd-test-image",
-					"secret":  "Zm9vYmFyCg==",
-					"user":    "libvirt",
-				},
-			},
-			mounts: []volMount{
-				{
-					name:          "ceph",
-					containerPath: "/var/lib/whatever",
-				},
-			},
+			name:         "30 seconds",
+			gracePeriod:  30 * time.Second,
+			sleeps:       []time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second, 5 * time.Second, 5 * time.Second, 4 * time.Second},
+			destroyAfter: 29 * time.Second,
 		},
 		{
-			name: "cloud-init",
-			annotations: map[string]string{
-				"VirtletSSHKeys": "key1\nkey2",
-			},
+			name:         "10 seconds",
+			gracePeriod:  10 * time.Second,
+			sleeps:       []time.Duration{5 * time.Second, 4 * time.Second},
+			destroyAfter: 9 * time.Second,
 		},
 		{
-			name: "cloud-init with user data",
-			annotations: map[string]string{
-				"VirtletSSHKeys": "key1\nkey2",
-				"VirtletCloudInitUserData": `
-                                  users:
-                                  - name: cloudy`,
-			},
+			name:         "3 seconds",
+			gracePeriod:  3 * time.Second,
+			sleeps:       []time.Duration{2700 * time.Millisecond},
+			destroyAfter: 2700 * time.Millisecond,
 		},
 		{
-			name: "virtio disk driver",
-			annotations: map[string]string{
-				"VirtletDiskDriver": "virtio",
-			},
+			name:         "1 second",
+			gracePeriod:  time.Second,
+			sleeps:       []time.Duration{900 * time.Millisecond},
+			destroyAfter: 900 * time.Millisecond,
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			rec := testutils.NewToplevelRecorder()
-
-			ct := newContainerTester(t, rec)
+			ct := newContainerTester(t, testutils.NewToplevelRecorder())
 			defer ct.teardown()
 
 			sandbox := criapi.GetSandboxes(1)[0]
-			sandbox.Annotations = tc.annotations
 			ct.setPodSandbox(sandbox)
+			containerID := ct.createContainer(sandbox, nil)
+			ct.startContainer(containerID)
 
-			for name, def := range tc.flexVolumes {
-				targetDir := filepath.Join(ct.kubeletRootDir, sandbox.Metadata.Uid, "volumes/virtlet~flexvolume_driver", name)
-				resultStr := flexVolumeDriver.Run([]string{"mount", targetDir, utils.MapToJSON(def)})
-				var r map[string]interface{}
-				if err := json.Unmarshal([]byte(resultStr), &r); err != nil {
-					t.Errorf("failed to unmarshal flexvolume definition")
-					continue
-				}
-				if r["status"] != "Success" {
-					t.Errorf("mounting flexvolume %q failed: %s", name, r["message"])
+			ct.domainConn.SetIgnoreShutdown(true)
+			go func() {
+				for _, d := range tc.sleeps {
+					ct.clock.BlockUntil(1)
+					ct.clock.Advance(d)
 				}
+			}()
+
+			start := len(ct.rec.Content())
+			startTime := ct.clock.Now()
+			if err := ct.virtTool.StopContainer(containerID, tc.gracePeriod); err != nil {
+				t.Fatalf("StopContainer(): %v", err)
+			}
+			if elapsed := ct.clock.Since(startTime); elapsed != tc.destroyAfter {
+				t.Errorf("the domain was destroyed after %v instead of %v", elapsed, tc.destroyAfter)
 			}
+			ct.verifyDomainState(containerID, virt.DomainStateShutoff)
 
-			var mounts []*kubeapi.Mount
-			for _, m := range tc.mounts {
-				mounts = append(mounts, &kubeapi.Mount{
-					HostPath:      filepath.Join(ct.kubeletRootDir, sandbox.Metadata.Uid, "volumes/virtlet~flexvolume_driver", m.name),
-					ContainerPath: m.containerPath,
-				})
+			var expectedCalls []string
+			for range tc.sleeps {
+				expectedCalls = append(expectedCalls, "Shutdown")
+			}
+			expectedCalls = append(expectedCalls, "Destroy")
+			if calls := ct.domainCalls(start); !reflect.DeepEqual(calls, expectedCalls) {
+				t.Errorf("bad domain calls: %v instead of %v", calls, expectedCalls)
 			}
-			containerID := ct.createContainer(sandbox, mounts)
-			// startContainer will cause fake Domain
-			// to dump the cloudinit iso content
-			ct.startContainer(containerID)
-			ct.removeContainer(containerID)
-			gm.Verify(t, gm.NewYamlVerifier(ct.rec.Content()))
 		})
 	}
 }
 
-func TestDomainResourceConstraints(t *testing.T) {
-	cpuQuota := 25000
-	cpuPeriod := 100000
-	cpuShares := 100
-	memoryLimit := 1234567
-	cpuCount := 2
+func TestDoubleStartError(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
 
-	rec := testutils.NewToplevelRecorder()
-	rec.AddFilter("DefineDomain")
-	ct := newContainerTester(t, rec)
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+
+	containerID := ct.createContainer(sandbox, nil)
+	ct.clock.Advance(1 * time.Second)
+	ct.startContainer(containerID)
+	if err := ct.virtTool.StartContainer(containerID); err == nil {
+		t.Errorf("2nd StartContainer() didn't produce an error")
+	}
+}
+
+func TestCustomStoragePoolPath(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	poolPath := "/mnt/nvme/virtlet"
+	if err := ct.virtTool.SetStoragePoolConfig(StoragePoolConfig{TargetPath: poolPath}); err != nil {
+		t.Fatalf("SetStoragePoolConfig(): %v", err)
+	}
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+
+	pool, err := ct.storageConn.LookupStoragePoolByName("volumes")
+	if err != nil {
+		t.Fatalf("LookupStoragePoolByName(): %v", err)
+	}
+	rootVolume, err := pool.LookupVolumeByName("virtlet_root_" + containerID)
+	if err != nil {
+		t.Fatalf("can't find the root volume: %v", err)
+	}
+	volPath, err := rootVolume.Path()
+	if err != nil {
+		t.Fatalf("Path(): %v", err)
+	}
+	expectedPath := filepath.Join(poolPath, "virtlet_root_"+containerID)
+	if volPath != expectedPath {
+		t.Errorf("bad root volume path: %q instead of %q", volPath, expectedPath)
+	}
+
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	def, err := domain.XML()
+	if err != nil {
+		t.Fatalf("XML(): %v", err)
+	}
+	found := false
+	for _, disk := range def.Devices.Disks {
+		if disk.Source != nil && disk.Source.File != nil && disk.Source.File.File == expectedPath {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("root volume %q is not attached to the domain", expectedPath)
+	}
+
+	ct.removeContainer(containerID)
+	if _, err := pool.LookupVolumeByName("virtlet_root_" + containerID); err != virt.ErrStorageVolumeNotFound {
+		t.Errorf("the root volume was not removed")
+	}
+}
+
+func TestConfigISOInPool(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	poolPath := filepath.Join(ct.tmpDir, "pool")
+	if err := ct.virtTool.SetStoragePoolConfig(StoragePoolConfig{TargetPath: poolPath}); err != nil {
+		t.Fatalf("SetStoragePoolConfig(): %v", err)
+	}
+	if err := ct.virtTool.SetConfigISOInPool(true); err != nil {
+		t.Fatalf("SetConfigISOInPool(): %v", err)
+	}
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+
+	pool, err := ct.storageConn.LookupStoragePoolByName("volumes")
+	if err != nil {
+		t.Fatalf("LookupStoragePoolByName(): %v", err)
+	}
+	volumeName := "virtlet-" + containerID + "-config.iso"
+	if _, err := pool.LookupVolumeByName(volumeName); err != nil {
+		t.Fatalf("can't find the config ISO volume: %v", err)
+	}
+	expectedPath := filepath.Join(poolPath, volumeName)
+	if _, err := os.Stat(expectedPath); err != nil {
+		t.Errorf("the config ISO wasn't written to the volume: %v", err)
+	}
+	oldISOPath := filepath.Join(configIsoDir, "config-"+containerID+".iso")
+	if _, err := os.Stat(oldISOPath); !os.IsNotExist(err) {
+		t.Errorf("the config ISO was written to the config ISO directory")
+	}
+
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	def, err := domain.XML()
+	if err != nil {
+		t.Fatalf("XML(): %v", err)
+	}
+	found := false
+	for _, disk := range def.Devices.Disks {
+		if disk.Device == "cdrom" && disk.Source != nil && disk.Source.File != nil && disk.Source.File.File == expectedPath {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("config ISO volume %q is not attached to the domain", expectedPath)
+	}
+
+	ct.removeContainer(containerID)
+	if _, err := pool.LookupVolumeByName(volumeName); err != virt.ErrStorageVolumeNotFound {
+		t.Errorf("the config ISO volume was not removed")
+	}
+
+	// the orphaned config ISO volumes are removed by GC
+	orphanName := "virtlet-" + orphanVolumeUUID + "-config.iso"
+	if _, err := pool.CreateStorageVol(&libvirtxml.StorageVolume{Name: orphanName}); err != nil {
+		t.Fatalf("CreateStorageVol(): %v", err)
+	}
+	if errs := ct.virtTool.GarbageCollect(); len(errs) != 0 {
+		t.Errorf("GarbageCollect(): %v", errs)
+	}
+	if _, err := pool.LookupVolumeByName(orphanName); err != virt.ErrStorageVolumeNotFound {
+		t.Errorf("the orphaned config ISO volume was not removed")
+	}
+}
+
+func TestConfigISOInLogicalPool(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
 	defer ct.teardown()
+
+	if err := ct.virtTool.SetStoragePoolConfig(StoragePoolConfig{Type: "logical", SourceName: "virtlet"}); err != nil {
+		t.Fatalf("SetStoragePoolConfig(): %v", err)
+	}
+	if err := ct.virtTool.SetConfigISOInPool(true); err == nil {
+		t.Errorf("SetConfigISOInPool() didn't fail for logical storage pool")
+	}
+}
+
+func TestPreserveVolumesOnDelete(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
 	sandbox := criapi.GetSandboxes(1)[0]
 	sandbox.Annotations = map[string]string{
-		"VirtletVCPUCount": strconv.Itoa(cpuCount),
+		"VirtletPreserveVolumesOnDelete": "true",
 	}
 	ct.setPodSandbox(sandbox)
-	req := &kubeapi.CreateContainerRequest{
-		PodSandboxId: sandbox.Metadata.Uid,
-		Config: &kubeapi.ContainerConfig{
-			Metadata: &kubeapi.ContainerMetadata{
-				Name:    fakeContainerName,
-				Attempt: fakeContainerAttempt,
-			},
-			Image: &kubeapi.ImageSpec{
-				Image: fakeImageName,
-			},
-			Linux: &kubeapi.LinuxContainerConfig{
-				Resources: &kubeapi.LinuxContainerResources{
-					CpuQuota:           int64(cpuQuota),
-					CpuPeriod:          int64(cpuPeriod),
-					CpuShares:          int64(cpuShares),
-					MemoryLimitInBytes: int64(memoryLimit),
-				},
-			},
-		},
-		SandboxConfig: sandbox,
+
+	containerID, err := ct.createContainerWithFlexvolume(sandbox, map[string]interface{}{"type": "qcow2"})
+	if err != nil {
+		t.Fatalf("CreateContainer(): %v", err)
 	}
+	ct.clock.Advance(1 * time.Second)
+	ct.startContainer(containerID)
+	ct.stopContainer(containerID)
 
-	vmConfig, err := GetVMConfig(req, nil)
+	pool, err := ct.storageConn.LookupStoragePoolByName("volumes")
 	if err != nil {
-		t.Fatalf("GetVMConfig(): %v", err)
+		t.Fatalf("LookupStoragePoolByName(): %v", err)
+	}
+	// the flexvolumes that can be preserved must not be
+	// torn down when the container is stopped
+	flexVolumeName := "virtlet-" + containerID + "-data"
+	if _, err := pool.LookupVolumeByName(flexVolumeName); err != nil {
+		t.Errorf("the qcow2 flexvolume was removed upon StopContainer(): %v", err)
 	}
 
-	if _, err = ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns"); err != nil {
-		t.Fatalf("CreateContainer: %v", err)
+	ct.removeContainer(containerID)
+	rootVolumeName := "virtlet_root_" + containerID
+	if _, err := pool.LookupVolumeByName(rootVolumeName); err != virt.ErrStorageVolumeNotFound {
+		t.Errorf("the root volume was not renamed")
+	}
+
+	preservedName := "preserved_" + ct.clock.Now().UTC().Format("20060102T150405Z") + "_" + rootVolumeName
+	if errs := ct.virtTool.GarbageCollect(); len(errs) != 0 {
+		t.Errorf("GarbageCollect(): %v", errs)
+	}
+	vol, err := pool.LookupVolumeByName(preservedName)
+	if err != nil {
+		t.Fatalf("the root volume was not preserved: %v", err)
+	}
+	volPath, err := vol.Path()
+	if err != nil {
+		t.Fatalf("Path(): %v", err)
+	}
+	poolPath, err := pool.TargetPath()
+	if err != nil {
+		t.Fatalf("TargetPath(): %v", err)
+	}
+	if expectedPath := filepath.Join(poolPath, preservedName); volPath != expectedPath {
+		t.Errorf("bad preserved volume path: %q instead of %q", volPath, expectedPath)
+	}
+
+	preservedFlexVolumeName := "preserved_" + ct.clock.Now().UTC().Format("20060102T150405Z") + "_" + flexVolumeName
+	if _, err := pool.LookupVolumeByName(preservedFlexVolumeName); err != nil {
+		t.Errorf("the qcow2 flexvolume was not preserved: %v", err)
+	}
+}
+
+func TestWipeVolumesOnDelete(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	sandbox.Annotations = map[string]string{
+		"VirtletWipeOnDelete": "random",
+	}
+	ct.setPodSandbox(sandbox)
+
+	containerID := ct.createContainer(sandbox, nil)
+	ct.startContainer(containerID)
+	ct.stopContainer(containerID)
+	ct.removeContainer(containerID)
+
+	rootVolumeName := "virtlet_root_" + containerID
+	wiped := false
+	removed := false
+	for _, r := range ct.rec.Content() {
+		switch {
+		case r.Name == "storage: volumes: "+rootVolumeName+": Wipe":
+			if removed {
+				t.Errorf("the root volume was wiped after it was removed")
+			}
+			if r.Value != "random" {
+				t.Errorf("bad wipe algorithm %v", r.Value)
+			}
+			wiped = true
+		case r.Name == "storage: volumes: RemoveVolumeByName" && r.Value == rootVolumeName:
+			removed = true
+		}
+	}
+	if !wiped {
+		t.Errorf("the root volume wasn't wiped")
+	}
+	if !removed {
+		t.Errorf("the root volume wasn't removed")
+	}
+}
+
+func TestGuestPanic(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+
+	containerID := ct.createContainer(sandbox, nil)
+	ct.clock.Advance(1 * time.Second)
+	ct.startContainer(containerID)
+
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	if err := domain.(*fake.FakeDomain).InjectPanic(); err != nil {
+		t.Fatalf("InjectPanic(): %v", err)
+	}
+
+	status := ct.containerStatus(containerID)
+	if status.State != kubeapi.ContainerState_CONTAINER_EXITED {
+		t.Errorf("Bad container state: %v instead of %v", status.State, kubeapi.ContainerState_CONTAINER_EXITED)
+	}
+	if status.Reason != "GuestPanicked" {
+		t.Errorf("Bad container state reason: %q instead of \"GuestPanicked\"", status.Reason)
+	}
+
+	// the crashed domain must be destroyed before removal
+	ct.removeContainer(containerID)
+	if _, err := ct.domainConn.LookupDomainByUUIDString(containerID); err != virt.ErrDomainNotFound {
+		t.Errorf("the domain was not removed")
+	}
+}
+
+func TestGuestReboot(t *testing.T) {
+	rec := testutils.NewToplevelRecorder()
+	rec.AddFilter("iso image")
+	ct := newContainerTester(t, rec)
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	sandbox.Annotations = map[string]string{
+		"VirtletPowerState": "mode: reboot\ndelay: now\nmessage: rebooting after provisioning",
+	}
+	ct.setPodSandbox(sandbox)
+
+	containerID := ct.createContainer(sandbox, nil)
+	ct.clock.Advance(1 * time.Second)
+	ct.startContainer(containerID)
+
+	var userData map[string]interface{}
+	for _, r := range ct.rec.Content() {
+		if !strings.HasSuffix(r.Name, "iso image") {
+			continue
+		}
+		isoContent, ok := r.Value.(map[string]interface{})
+		if !ok {
+			t.Fatalf("bad iso image record:\n%s", spew.Sdump(r))
+		}
+		userDataStr, _ := isoContent["user-data"].(string)
+		if err := yaml.Unmarshal([]byte(userDataStr), &userData); err != nil {
+			t.Fatalf("can't unmarshal user-data: %v", err)
+		}
+	}
+	expectedPowerState := map[string]interface{}{
+		"mode":    "reboot",
+		"delay":   "now",
+		"message": "rebooting after provisioning",
+	}
+	if !reflect.DeepEqual(userData["power_state"], expectedPowerState) {
+		t.Errorf("bad power_state in the user-data:\n%s\nexpected:\n%s", spew.Sdump(userData["power_state"]), spew.Sdump(expectedPowerState))
+	}
+
+	// libvirt restarts the domain in place on guest reboots
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	def, err := domain.XML()
+	if err != nil {
+		t.Fatalf("XML(): %v", err)
+	}
+	if def.OnReboot != "restart" {
+		t.Errorf("bad on_reboot action %q", def.OnReboot)
+	}
+}
+
+func TestShutdownPause(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+	ct.clock.Advance(1 * time.Second)
+	ct.startContainer(containerID)
+
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	if err := domain.(*fake.FakeDomain).InjectShutdownPause(); err != nil {
+		t.Fatalf("InjectShutdownPause(): %v", err)
+	}
+	if status := ct.containerStatus(containerID); status.State != kubeapi.ContainerState_CONTAINER_RUNNING {
+		t.Errorf("bad container state while the domain is shutting down: %v instead of %v", status.State, kubeapi.ContainerState_CONTAINER_RUNNING)
+	}
+
+	if err := domain.(*fake.FakeDomain).InjectGuestShutdown(); err != nil {
+		t.Fatalf("InjectGuestShutdown(): %v", err)
+	}
+	if status := ct.containerStatus(containerID); status.State != kubeapi.ContainerState_CONTAINER_EXITED {
+		t.Errorf("bad container state after the shutdown: %v instead of %v", status.State, kubeapi.ContainerState_CONTAINER_EXITED)
+	}
+}
+
+type volMount struct {
+	name          string
+	containerPath string
+}
+
+func TestDomainDefinitions(t *testing.T) {
+	// the flexvolume driver refuses to mount volumes with duplicate
+	// uuids, so each volume gets a uuid of its own
+	uuidCount := 0
+	flexVolumeDriver := flexvolume.NewFlexVolumeDriver(func() string {
+		uuidCount++
+		return fmt.Sprintf("%s%04x", fakeUUID[:len(fakeUUID)-4], uuidCount)
+	}, flexvolume.NullMounter)
+	for _, tc := range []struct {
+		name             string
+		annotations      map[string]string
+		flexVolumes      map[string]map[string]interface{}
+		mounts           []volMount
+		deviceProfile    DeviceProfile
+		memoryBacking    string
+		skipNoopISO      bool
+		recentHypervisor bool
+	}{
+		{
+			name: "plain domain",
+		},
+		{
+			name:          "file-backed memory",
+			memoryBacking: "memory",
+		},
+		{
+			name:        "pcie root ports",
+			annotations: map[string]string{"VirtletPCIeRootPorts": "2"},
+		},
+		{
+			name:        "bridge interface source",
+			annotations: map[string]string{"VirtletInterfaceSource": "type=bridge,source=br0"},
+		},
+		{
+			name:        "direct interface source",
+			annotations: map[string]string{"VirtletInterfaceSource": "type=direct,source=eth1,mode=private"},
+		},
+		{
+			name:        "network interface source",
+			annotations: map[string]string{"VirtletInterfaceSource": "type=network,source=default"},
+		},
+		{
+			name:        "no-op config iso",
+			skipNoopISO: true,
+		},
+		{
+			name: "raw user data with no-op config iso skipping",
+			annotations: map[string]string{
+				"VirtletCloudInitUserData": "Content-Type: multipart/mixed; boundary=\"XYZ\"\nMIME-Version: 1.0\n\n--XYZ\nContent-Type: text/x-shellscript\n\n#!/bin/sh\necho hi\n--XYZ--\n",
+			},
+			skipNoopISO: true,
+		},
+		{
+			name:        "forced config iso",
+			annotations: map[string]string{"VirtletForceConfigISO": "true"},
+			skipNoopISO: true,
+		},
+		{
+			name:        "dual config layout",
+			annotations: map[string]string{"VirtletCloudInitDualLayout": "true"},
+		},
+		{
+			name: "domain metadata",
+			annotations: map[string]string{
+				"VirtletDomainMetadataAnnotations": "hello, VirtletVCPUCount, nonexistent",
+				"hello":                            "world",
+				"VirtletVCPUCount":                 "1",
+			},
+		},
+		{
+			name:        "kvm domain type",
+			annotations: map[string]string{"VirtletDomainType": "kvm"},
+		},
+		{
+			name:        "qemu domain type",
+			annotations: map[string]string{"VirtletDomainType": "qemu"},
+		},
+		{
+			name:        "guest agent",
+			annotations: map[string]string{"VirtletGuestAgent": "true"},
+		},
+		{
+			name:        "nic offloads",
+			annotations: map[string]string{"VirtletNICOffloads": "host.tso4=off,host.tso6=off,1:guest.csum=off"},
+		},
+		{
+			name:        "nvdimm",
+			annotations: map[string]string{"VirtletNVDIMM": "size=1Gi,path=/dev/pmem0"},
+		},
+		{
+			name:          "minimal devices",
+			deviceProfile: DeviceProfileMinimal,
+		},
+		{
+			name:          "minimal devices with graphics",
+			annotations:   map[string]string{"VirtletOptionalDevices": "graphics"},
+			deviceProfile: DeviceProfileMinimal,
+		},
+		{
+			name:        "numa node",
+			annotations: map[string]string{"VirtletNUMANode": "1"},
+		},
+		{
+			name:        "cpu features",
+			annotations: map[string]string{"VirtletCPUFeatures": "+pdpe1gb,-rtm,-hle"},
+		},
+		{
+			name:        "root volume copy-on-read",
+			annotations: map[string]string{"VirtletRootVolumeCopyOnRead": "true"},
+		},
+		{
+			name: "raw devices",
+			flexVolumes: map[string]map[string]interface{}{
+				"raw": {
+					"type": "raw",
+					// FIXME: here we depend upon the fact that /dev/loop0
+					// indeed exists in the build container. But we shouldn't.
+					"path": "/dev/loop0",
+				},
+			},
+		},
+		{
+			name: "volumes",
+			flexVolumes: map[string]map[string]interface{}{
+				"vol1": {
+					"type": "qcow2",
+				},
+				"vol2": {
+					"type":     "qcow2",
+					"capacity": "2MB",
+				},
+				"vol3": {
+					"type": "qcow2",
+				},
+			},
+		},
+		{
+			name: "vcpu count",
+			annotations: map[string]string{
+				"VirtletVCPUCount": "4",
+			},
+		},
+		{
+			name: "ceph flexvolume",
+			flexVolumes: map[string]map[string]interface{}{
+				"ceph": {
+					"type":    "ceph",
+					"monitor": "127.0.0.1:6789",
+					"pool":    "libvirt-pool",
+					"volume":  "rbd-test-image",
+					"secret":  "Zm9vYmFyCg==",
+					"user":    "libvirt",
+				},
+			},
+			mounts: []volMount{
+				{
+					name:          "ceph",
+					containerPath: "/var/lib/whatever",
+				},
+			},
+		},
+		{
+			name: "cloud-init",
+			annotations: map[string]string{
+				"VirtletSSHKeys": "ssh-rsa AAAAB3NzaC1yc2FrZXkx key1\nssh-rsa AAAAB3NzaC1yc2FrZXky key2",
+			},
+		},
+		{
+			name: "cloud-init with user data",
+			annotations: map[string]string{
+				"VirtletSSHKeys": "ssh-rsa AAAAB3NzaC1yc2FrZXkx key1\nssh-rsa AAAAB3NzaC1yc2FrZXky key2",
+				"VirtletCloudInitUserData": `
+                                  users:
+                                  - name: cloudy`,
+			},
+		},
+		{
+			name: "fw_cfg seed mechanism",
+			annotations: map[string]string{
+				"VirtletSSHKeys":       "ssh-rsa AAAAB3NzaC1yc2FrZXkx key1",
+				"VirtletSeedMechanism": "fw_cfg",
+			},
+		},
+		{
+			name: "smbios seed mechanism",
+			annotations: map[string]string{
+				"VirtletSSHKeys":       "ssh-rsa AAAAB3NzaC1yc2FrZXkx key1",
+				"VirtletSeedMechanism": "smbios",
+			},
+		},
+		{
+			name: "virtio disk driver",
+			annotations: map[string]string{
+				"VirtletDiskDriver": "virtio",
+			},
+		},
+		{
+			name: "scsi disk queues",
+			annotations: map[string]string{
+				"VirtletRootVolumeQueues":    "2",
+				"VirtletRootVolumeQueueSize": "128",
+			},
+			flexVolumes: map[string]map[string]interface{}{
+				"vol1": {
+					"type":      "qcow2",
+					"queues":    "4",
+					"queueSize": "256",
+				},
+			},
+		},
+		{
+			name: "scsi disk inquiry data",
+			flexVolumes: map[string]map[string]interface{}{
+				"vol1": {
+					"type":    "qcow2",
+					"wwn":     "0x5000c50015ea71ac",
+					"vendor":  "VIRTLET",
+					"product": "FASTDISK",
+				},
+			},
+		},
+		{
+			name: "virtio disk queues",
+			annotations: map[string]string{
+				"VirtletDiskDriver":          "virtio",
+				"VirtletRootVolumeQueues":    "2",
+				"VirtletRootVolumeQueueSize": "128",
+			},
+			flexVolumes: map[string]map[string]interface{}{
+				"vol1": {
+					"type":      "qcow2",
+					"queues":    "4",
+					"queueSize": "256",
+				},
+			},
+		},
+		{
+			name: "io_uring disk aio",
+			annotations: map[string]string{
+				"VirtletDiskDriver": "virtio",
+			},
+			flexVolumes: map[string]map[string]interface{}{
+				"vol1": {
+					"type":      "qcow2",
+					"aio":       "io_uring",
+					"pollMaxNs": "32768",
+				},
+			},
+			recentHypervisor: true,
+		},
+		{
+			name: "512n sector format",
+			annotations: map[string]string{
+				"VirtletDiskDriver": "virtio",
+			},
+			flexVolumes: map[string]map[string]interface{}{
+				"vol1": {
+					"type":         "qcow2",
+					"sectorFormat": "512n",
+				},
+			},
+		},
+		{
+			name: "512e sector format",
+			annotations: map[string]string{
+				"VirtletDiskDriver": "virtio",
+			},
+			flexVolumes: map[string]map[string]interface{}{
+				"vol1": {
+					"type":              "qcow2",
+					"logicalBlockSize":  "512",
+					"physicalBlockSize": "4096",
+				},
+			},
+		},
+		{
+			name: "4Kn sector format",
+			annotations: map[string]string{
+				"VirtletDiskDriver": "virtio",
+			},
+			flexVolumes: map[string]map[string]interface{}{
+				"vol1": {
+					"type":         "qcow2",
+					"sectorFormat": "4Kn",
+				},
+			},
+		},
+		{
+			name: "real-time scheduler",
+			annotations: map[string]string{
+				"VirtletVCPUCount":       "2",
+				"VirtletNUMANode":        "1",
+				"VirtletEmulatorPin":     "0-1",
+				"VirtletIsolateEmulator": "true",
+				"VirtletRTScheduler":     "scheduler=fifo,priority=10",
+			},
+		},
+		{
+			name: "emulator pin",
+			annotations: map[string]string{
+				"VirtletDiskDriver":      "virtio",
+				"VirtletNUMANode":        "1",
+				"VirtletEmulatorPin":     "0-1",
+				"VirtletIsolateEmulator": "true",
+			},
+			flexVolumes: map[string]map[string]interface{}{
+				"vol1": {
+					"type":      "qcow2",
+					"aio":       "io_uring",
+					"pollMaxNs": "32768",
+				},
+			},
+			recentHypervisor: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := testutils.NewToplevelRecorder()
+
+			ct := newContainerTester(t, rec)
+			defer ct.teardown()
+			if tc.deviceProfile != "" {
+				if err := ct.virtTool.SetDeviceProfile(tc.deviceProfile); err != nil {
+					t.Fatalf("SetDeviceProfile(): %v", err)
+				}
+			}
+			ct.virtTool.SetSkipNoopConfigISO(tc.skipNoopISO)
+			if tc.recentHypervisor {
+				ct.domainConn.SetVersions(minIOURingLibvirtVersion, minIOURingQEMUVersion)
+			}
+			if tc.memoryBacking != "" {
+				if err := ct.virtTool.SetMemoryBackingDir(filepath.Join(ct.tmpDir, tc.memoryBacking)); err != nil {
+					t.Fatalf("SetMemoryBackingDir(): %v", err)
+				}
+			}
+
+			sandbox := criapi.GetSandboxes(1)[0]
+			sandbox.Annotations = tc.annotations
+			ct.setPodSandbox(sandbox)
+
+			for name, def := range tc.flexVolumes {
+				targetDir := filepath.Join(ct.kubeletRootDir, sandbox.Metadata.Uid, "volumes/virtlet~flexvolume_driver", name)
+				resultStr := flexVolumeDriver.Run([]string{"mount", targetDir, utils.MapToJSON(def)})
+				var r map[string]interface{}
+				if err := json.Unmarshal([]byte(resultStr), &r); err != nil {
+					t.Errorf("failed to unmarshal flexvolume definition")
+					continue
+				}
+				if r["status"] != "Success" {
+					t.Errorf("mounting flexvolume %q failed: %s", name, r["message"])
+				}
+			}
+
+			var mounts []*kubeapi.Mount
+			for _, m := range tc.mounts {
+				mounts = append(mounts, &kubeapi.Mount{
+					HostPath:      filepath.Join(ct.kubeletRootDir, sandbox.Metadata.Uid, "volumes/virtlet~flexvolume_driver", m.name),
+					ContainerPath: m.containerPath,
+				})
+			}
+			containerID := ct.createContainer(sandbox, mounts)
+			// startContainer will cause fake Domain
+			// to dump the cloudinit iso content
+			ct.startContainer(containerID)
+			ct.removeContainer(containerID)
+			gm.Verify(t, gm.NewYamlVerifier(ct.rec.Content()))
+		})
+	}
+}
+
+func TestUnusableDomainType(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+	ct.virtTool.domainTypeChecker = func(domainType string) error {
+		return fmt.Errorf("domain type %q can't be used", domainType)
+	}
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	sandbox.Annotations = map[string]string{"VirtletDomainType": "qemu"}
+	ct.setPodSandbox(sandbox)
+	if _, err := ct.virtTool.CreateContainer(ct.vmConfig(sandbox, nil), "/tmp/fakenetns"); err == nil {
+		t.Errorf("CreateContainer() didn't fail for an unusable domain type")
+	}
+	if domains, err := ct.domainConn.ListDomains(); err != nil {
+		t.Errorf("ListDomains(): %v", err)
+	} else if len(domains) != 0 {
+		t.Errorf("unexpected domains after CreateContainer() failure: %d", len(domains))
+	}
+}
+
+func TestCreateContainerImageErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		err       error
+		permanent bool
+	}{
+		{
+			name:      "image not found",
+			err:       image.NewImageNotFoundError(fakeImageName),
+			permanent: true,
+		},
+		{
+			name: "registry unreachable",
+			err: &image.ImageError{
+				Image: fakeImageName,
+				Err:   errors.New("dial tcp: connection refused"),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newContainerTester(t, testutils.NewToplevelRecorder())
+			defer ct.teardown()
+
+			sandbox := criapi.GetSandboxes(1)[0]
+			ct.setPodSandbox(sandbox)
+			ct.imageManager.err = tc.err
+			_, err := ct.virtTool.CreateContainer(ct.vmConfig(sandbox, nil), "/tmp/fakenetns")
+			switch {
+			case err == nil:
+				t.Fatalf("CreateContainer() didn't fail")
+			case image.IsPermanentError(err) != tc.permanent:
+				t.Errorf("bad permanent flag for the error %q: %v instead of %v", err, !tc.permanent, tc.permanent)
+			case image.IsRetryableError(err) == tc.permanent:
+				t.Errorf("bad retryable flag for the error %q: %v instead of %v", err, tc.permanent, !tc.permanent)
+			}
+
+			if domains, err := ct.domainConn.ListDomains(); err != nil {
+				t.Errorf("ListDomains(): %v", err)
+			} else if len(domains) != 0 {
+				t.Errorf("unexpected domains after CreateContainer() failure: %d", len(domains))
+			}
+			pool, err := ct.virtTool.StoragePool()
+			if err != nil {
+				t.Fatalf("StoragePool(): %v", err)
+			}
+			if volumes, err := pool.ListAllVolumes(); err != nil {
+				t.Errorf("ListAllVolumes(): %v", err)
+			} else if len(volumes) != 0 {
+				t.Errorf("unexpected volumes after CreateContainer() failure:\n%s", spew.Sdump(volumes))
+			}
+			if containers := ct.listContainers(nil); len(containers) != 0 {
+				t.Errorf("unexpected containers after CreateContainer() failure:\n%s", spew.Sdump(containers))
+			}
+
+			// the retry must succeed once the image is available
+			ct.imageManager.err = nil
+			if _, err := ct.virtTool.CreateContainer(ct.vmConfig(sandbox, nil), "/tmp/fakenetns"); err != nil {
+				t.Errorf("CreateContainer() failed after the image became available: %v", err)
+			}
+		})
+	}
+}
+
+func TestCreateContainerRemovesStaleRootVolume(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	pool, err := ct.virtTool.StoragePool()
+	if err != nil {
+		t.Fatalf("StoragePool(): %v", err)
+	}
+	staleVolumeName := "virtlet_root_" + utils.NewUUID5(ContainerNsUUID, sandbox.Metadata.Uid)
+	if _, err := pool.CreateStorageVol(&libvirtxml.StorageVolume{Type: "file", Name: staleVolumeName}); err != nil {
+		t.Fatalf("CreateStorageVol(): %v", err)
+	}
+
+	containerID := ct.createContainer(sandbox, nil)
+	if _, err := pool.LookupVolumeByName(staleVolumeName); err != nil {
+		t.Errorf("the root volume was not created: %v", err)
+	}
+	if containers := ct.listContainers(nil); len(containers) != 1 || containers[0].Id != containerID {
+		t.Errorf("bad container list after CreateContainer():\n%s", spew.Sdump(containers))
+	}
+}
+
+type fakeDiskVolume struct {
+	volumeBase
+	n int
+}
+
+var _ VMVolume = &fakeDiskVolume{}
+
+func (v *fakeDiskVolume) UUID() string { return "" }
+
+func (v *fakeDiskVolume) Setup() (*libvirtxml.DomainDisk, error) {
+	return &libvirtxml.DomainDisk{
+		Device: "disk",
+		Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: fmt.Sprintf("/fake/volume%d.img", v.n)}},
+		Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw"},
+	}, nil
+}
+
+func fakeDiskVolumeSource(count int) VMVolumeSource {
+	return func(config *VMConfig, owner VolumeOwner) ([]VMVolume, error) {
+		var vols []VMVolume
+		for n := 0; n < count; n++ {
+			vols = append(vols, &fakeDiskVolume{volumeBase{config, owner}, n})
+		}
+		return vols, nil
+	}
+}
+
+func TestVolumeCountLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		volumeCount    int
+		maxVolumeCount int
+		expectedBus    string
+		expectedError  string
+	}{
+		{
+			name:        "below virtio-blk limit",
+			volumeCount: 10,
+			expectedBus: "virtio",
+		},
+		{
+			name:        "virtio-scsi fallback",
+			volumeCount: 22,
+			expectedBus: "scsi",
+		},
+		{
+			name:          "too many volumes",
+			volumeCount:   30,
+			expectedError: "virtio-scsi driver is used automatically",
+		},
+		{
+			name:           "node limit",
+			volumeCount:    4,
+			maxVolumeCount: 5,
+			expectedError:  "At most 5 volumes are allowed",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newContainerTester(t, testutils.NewToplevelRecorder())
+			defer ct.teardown()
+			// the root and the config volumes are added
+			// to the fake volumes
+			ct.virtTool.volumeSource = CombineVMVolumeSources(GetRootVolume, fakeDiskVolumeSource(tc.volumeCount), GetConfigVolume)
+			ct.virtTool.SetMaxVolumeCount(tc.maxVolumeCount)
+
+			sandbox := criapi.GetSandboxes(1)[0]
+			sandbox.Annotations = map[string]string{"VirtletDiskDriver": "virtio"}
+			ct.setPodSandbox(sandbox)
+			config := ct.vmConfig(sandbox, nil)
+			containerID, err := ct.virtTool.CreateContainer(config, "/tmp/fakenetns")
+			if config.ParsedAnnotations.DiskDriver != diskDriverVirtio {
+				t.Errorf("the disk driver in the annotations was changed to %q", config.ParsedAnnotations.DiskDriver)
+			}
+			if tc.expectedError != "" {
+				switch {
+				case err == nil:
+					t.Errorf("CreateContainer() didn't fail")
+				case !strings.Contains(err.Error(), tc.expectedError):
+					t.Errorf("bad error message %q, expected it to contain %q", err, tc.expectedError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CreateContainer(): %v", err)
+			}
+
+			domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+			if err != nil {
+				t.Fatalf("LookupDomainByUUIDString(): %v", err)
+			}
+			def, err := domain.XML()
+			if err != nil {
+				t.Fatalf("XML(): %v", err)
+			}
+			if len(def.Devices.Disks) != tc.volumeCount+2 {
+				t.Errorf("bad number of disks: %d instead of %d", len(def.Devices.Disks), tc.volumeCount+2)
+			}
+			for _, disk := range def.Devices.Disks {
+				if disk.Target.Bus != tc.expectedBus {
+					t.Errorf("bad bus for disk %q: %q instead of %q", disk.Target.Dev, disk.Target.Bus, tc.expectedBus)
+				}
+			}
+		})
+	}
+}
+
+func TestDomainResourceConstraints(t *testing.T) {
+	cpuQuota := 25000
+	cpuPeriod := 100000
+	cpuShares := 100
+	memoryLimit := 1234567
+	cpuCount := 2
+
+	rec := testutils.NewToplevelRecorder()
+	rec.AddFilter("DefineDomain")
+	ct := newContainerTester(t, rec)
+	defer ct.teardown()
+	sandbox := criapi.GetSandboxes(1)[0]
+	sandbox.Annotations = map[string]string{
+		"VirtletVCPUCount": strconv.Itoa(cpuCount),
+	}
+	ct.setPodSandbox(sandbox)
+	req := &kubeapi.CreateContainerRequest{
+		PodSandboxId: sandbox.Metadata.Uid,
+		Config: &kubeapi.ContainerConfig{
+			Metadata: &kubeapi.ContainerMetadata{
+				Name:    fakeContainerName,
+				Attempt: fakeContainerAttempt,
+			},
+			Image: &kubeapi.ImageSpec{
+				Image: fakeImageName,
+			},
+			Linux: &kubeapi.LinuxContainerConfig{
+				Resources: &kubeapi.LinuxContainerResources{
+					CpuQuota:           int64(cpuQuota),
+					CpuPeriod:          int64(cpuPeriod),
+					CpuShares:          int64(cpuShares),
+					MemoryLimitInBytes: int64(memoryLimit),
+				},
+			},
+		},
+		SandboxConfig: sandbox,
+	}
+
+	vmConfig, err := GetVMConfig(req, nil)
+	if err != nil {
+		t.Fatalf("GetVMConfig(): %v", err)
+	}
+
+	if _, err = ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns"); err != nil {
+		t.Fatalf("CreateContainer: %v", err)
 	}
 
 	gm.Verify(t, gm.NewYamlVerifier(ct.rec.Content()))
 }
+
+func TestMemoryBalloonTargets(t *testing.T) {
+	for _, tc := range []struct {
+		name                  string
+		memoryLimit           int64
+		memoryRequest         string
+		deviceProfile         DeviceProfile
+		expectedMemory        libvirtxml.DomainMemory
+		expectedCurrentMemory *libvirtxml.DomainCurrentMemory
+		expectedBalloonModel  string
+		expectedAutoDeflate   string
+		expectError           bool
+	}{
+		{
+			name:           "limit only",
+			memoryLimit:    2 << 30,
+			expectedMemory: libvirtxml.DomainMemory{Value: 2 << 30, Unit: "b"},
+		},
+		{
+			name:                  "request below limit",
+			memoryLimit:           2 << 30,
+			memoryRequest:         "1Gi",
+			expectedMemory:        libvirtxml.DomainMemory{Value: 2 << 30, Unit: "b"},
+			expectedCurrentMemory: &libvirtxml.DomainCurrentMemory{Value: 1 << 30, Unit: "b"},
+			expectedBalloonModel:  "virtio",
+			expectedAutoDeflate:   "on",
+		},
+		{
+			name:           "request equal to limit",
+			memoryLimit:    1 << 30,
+			memoryRequest:  "1Gi",
+			expectedMemory: libvirtxml.DomainMemory{Value: 1 << 30, Unit: "b"},
+		},
+		{
+			name:                  "request without limit",
+			memoryRequest:         "512Mi",
+			expectedMemory:        libvirtxml.DomainMemory{Value: defaultMemory, Unit: defaultMemoryUnit},
+			expectedCurrentMemory: &libvirtxml.DomainCurrentMemory{Value: 512 << 20, Unit: "b"},
+			expectedBalloonModel:  "virtio",
+			expectedAutoDeflate:   "on",
+		},
+		{
+			name:                  "minimal device profile keeps the balloon",
+			memoryLimit:           2 << 30,
+			memoryRequest:         "1Gi",
+			deviceProfile:         DeviceProfileMinimal,
+			expectedMemory:        libvirtxml.DomainMemory{Value: 2 << 30, Unit: "b"},
+			expectedCurrentMemory: &libvirtxml.DomainCurrentMemory{Value: 1 << 30, Unit: "b"},
+			expectedBalloonModel:  "virtio",
+			expectedAutoDeflate:   "on",
+		},
+		{
+			name:                 "minimal device profile without request",
+			memoryLimit:          2 << 30,
+			deviceProfile:        DeviceProfileMinimal,
+			expectedMemory:       libvirtxml.DomainMemory{Value: 2 << 30, Unit: "b"},
+			expectedBalloonModel: "none",
+		},
+		{
+			name:          "request above limit",
+			memoryLimit:   1 << 30,
+			memoryRequest: "2Gi",
+			expectError:   true,
+		},
+		{
+			name:          "bad request",
+			memoryRequest: "lots",
+			expectError:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newContainerTester(t, testutils.NewToplevelRecorder())
+			defer ct.teardown()
+			if tc.deviceProfile != "" {
+				if err := ct.virtTool.SetDeviceProfile(tc.deviceProfile); err != nil {
+					t.Fatalf("SetDeviceProfile(): %v", err)
+				}
+			}
+			sandbox := criapi.GetSandboxes(1)[0]
+			if tc.memoryRequest != "" {
+				sandbox.Annotations = map[string]string{"VirtletMemoryRequest": tc.memoryRequest}
+			}
+			ct.setPodSandbox(sandbox)
+			req := &kubeapi.CreateContainerRequest{
+				PodSandboxId: sandbox.Metadata.Uid,
+				Config: &kubeapi.ContainerConfig{
+					Metadata: &kubeapi.ContainerMetadata{
+						Name:    fakeContainerName,
+						Attempt: fakeContainerAttempt,
+					},
+					Image: &kubeapi.ImageSpec{
+						Image: fakeImageName,
+					},
+					Linux: &kubeapi.LinuxContainerConfig{
+						Resources: &kubeapi.LinuxContainerResources{
+							CpuShares:          100,
+							MemoryLimitInBytes: tc.memoryLimit,
+						},
+					},
+				},
+				SandboxConfig: sandbox,
+			}
+
+			vmConfig, err := GetVMConfig(req, nil)
+			switch {
+			case tc.expectError && err == nil:
+				t.Fatalf("GetVMConfig() didn't fail")
+			case tc.expectError:
+				return
+			case err != nil:
+				t.Fatalf("GetVMConfig(): %v", err)
+			}
+
+			containerID, err := ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns")
+			if err != nil {
+				t.Fatalf("CreateContainer: %v", err)
+			}
+			domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+			if err != nil {
+				t.Fatalf("LookupDomainByUUIDString(): %v", err)
+			}
+			def, err := domain.XML()
+			if err != nil {
+				t.Fatalf("XML(): %v", err)
+			}
+			if !reflect.DeepEqual(*def.Memory, tc.expectedMemory) {
+				t.Errorf("bad domain memory: %#v instead of %#v", *def.Memory, tc.expectedMemory)
+			}
+			if !reflect.DeepEqual(def.CurrentMemory, tc.expectedCurrentMemory) {
+				t.Errorf("bad domain current memory: %#v instead of %#v", def.CurrentMemory, tc.expectedCurrentMemory)
+			}
+			balloonModel, autoDeflate := "", ""
+			if def.Devices.MemBalloon != nil {
+				balloonModel = def.Devices.MemBalloon.Model
+				autoDeflate = def.Devices.MemBalloon.AutoDeflate
+			}
+			if balloonModel != tc.expectedBalloonModel {
+				t.Errorf("bad domain memory balloon model %q instead of %q", balloonModel, tc.expectedBalloonModel)
+			}
+			if autoDeflate != tc.expectedAutoDeflate {
+				t.Errorf("bad domain memory balloon autodeflate setting %q instead of %q", autoDeflate, tc.expectedAutoDeflate)
+			}
+		})
+	}
+}
+
+func TestUpdateCloudInit(t *testing.T) {
+	rec := testutils.NewToplevelRecorder()
+	rec.AddFilter("UpdateDisk")
+	rec.AddFilter("iso image")
+	rec.AddFilter("GuestAgentCommand")
+	ct := newContainerTester(t, rec)
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	sandbox.Annotations = map[string]string{
+		"VirtletGuestAgent": "true",
+		"VirtletSSHKeys":    "ssh-rsa AAAAB3NzaC1yc2FrZXkx key1",
+	}
+	ct.setPodSandbox(sandbox)
+
+	containerID := ct.createContainer(sandbox, nil)
+	ct.clock.Advance(1 * time.Second)
+	ct.startContainer(containerID)
+
+	newAnnotations := map[string]string{
+		"VirtletGuestAgent": "true",
+		"VirtletSSHKeys":    "ssh-rsa AAAAB3NzaC1yc2FrZXky key2\nssh-rsa AAAAB3NzaC1yc2FrZXkz key3",
+	}
+	if err := ct.virtTool.UpdateCloudInit(containerID, newAnnotations, true); err != nil {
+		t.Fatalf("UpdateCloudInit(): %v", err)
+	}
+
+	// the old media is ejected before the new one is inserted,
+	// after which cloud-init is re-run in the guest
+	recs := ct.rec.Content()
+	if len(recs) != 6 || !strings.HasSuffix(recs[1].Name, "UpdateDisk") || !strings.HasSuffix(recs[2].Name, "UpdateDisk") {
+		t.Fatalf("the config image wasn't re-attached:\n%s", spew.Sdump(recs))
+	}
+	var rerunCommand struct {
+		Execute   string `json:"execute"`
+		Arguments struct {
+			Path string   `json:"path"`
+			Arg  []string `json:"arg"`
+		} `json:"arguments"`
+	}
+	if cmd, ok := recs[4].Value.(string); !ok || !strings.HasSuffix(recs[4].Name, "GuestAgentCommand") || json.Unmarshal([]byte(cmd), &rerunCommand) != nil {
+		t.Errorf("cloud-init wasn't re-run:\n%s", spew.Sdump(recs[4]))
+	} else if rerunCommand.Execute != "guest-exec" || rerunCommand.Arguments.Path != "/bin/sh" || !reflect.DeepEqual(rerunCommand.Arguments.Arg, []string{"-c", guestCloudInitRerunScript}) {
+		t.Errorf("bad cloud-init re-run command: %s", cmd)
+	}
+	if !strings.HasSuffix(recs[5].Name, "GuestAgentCommand") || recs[5].Value != `{"execute":"guest-exec-status","arguments":{"pid":42}}` {
+		t.Errorf("the exit status of cloud-init re-run wasn't checked:\n%s", spew.Sdump(recs[5]))
+	}
+	if diskXML, _ := recs[1].Value.(string); strings.Contains(diskXML, "<source") {
+		t.Errorf("the config image wasn't ejected:\n%s", diskXML)
+	}
+	if diskXML, _ := recs[2].Value.(string); !strings.Contains(diskXML, "<source") {
+		t.Errorf("the config image wasn't inserted:\n%s", diskXML)
+	}
+	isoContent, ok := recs[3].Value.(map[string]interface{})
+	if !ok {
+		t.Fatalf("bad iso image record:\n%s", spew.Sdump(recs[3]))
+	}
+	var metaData map[string]interface{}
+	if err := json.Unmarshal([]byte(isoContent["meta-data"].(string)), &metaData); err != nil {
+		t.Fatalf("can't unmarshal meta-data: %v", err)
+	}
+	expectedKeys := []interface{}{"ssh-rsa AAAAB3NzaC1yc2FrZXky key2", "ssh-rsa AAAAB3NzaC1yc2FrZXkz key3"}
+	if !reflect.DeepEqual(metaData["public-keys"], expectedKeys) {
+		t.Errorf("bad public keys in the regenerated meta-data: %#v instead of %#v", metaData["public-keys"], expectedKeys)
+	}
+
+	sandboxInfo, err := ct.metadataStore.PodSandbox(sandbox.Metadata.Uid).Retrieve()
+	if err != nil {
+		t.Fatalf("can't retrieve sandbox info: %v", err)
+	}
+	if !reflect.DeepEqual(sandboxInfo.Annotations, newAnnotations) {
+		t.Errorf("sandbox annotations not updated: %#v instead of %#v", sandboxInfo.Annotations, newAnnotations)
+	}
+}
+
+func TestConfigISORegeneratedOnStart(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		podAnnotations  map[string]string
+		nodeAnnotations map[string]string
+		update          func(t *testing.T, ct *containerTester, containerID string)
+		expectedKeys    []interface{}
+		regenerated     bool
+	}{
+		{
+			name: "no changes",
+			podAnnotations: map[string]string{
+				"VirtletSSHKeys": fakeRSAKey + " key1",
+			},
+			expectedKeys: []interface{}{fakeRSAKey + " key1"},
+		},
+		{
+			name: "pod annotations updated while the VM is stopped",
+			podAnnotations: map[string]string{
+				"VirtletSSHKeys": fakeRSAKey + " key1",
+			},
+			update: func(t *testing.T, ct *containerTester, containerID string) {
+				if err := ct.virtTool.UpdateCloudInit(containerID, map[string]string{
+					"VirtletSSHKeys": fakeRSAKey2 + " key2",
+				}, false); err != nil {
+					t.Fatalf("UpdateCloudInit(): %v", err)
+				}
+			},
+			expectedKeys: []interface{}{fakeRSAKey2 + " key2"},
+			regenerated:  true,
+		},
+		{
+			name: "node default annotations changed",
+			nodeAnnotations: map[string]string{
+				"VirtletSSHKeys": fakeRSAKey + " key1",
+			},
+			update: func(t *testing.T, ct *containerTester, containerID string) {
+				if err := ct.virtTool.SetNodeDefaultAnnotations(map[string]string{
+					"VirtletSSHKeys": fakeRSAKey2 + " key2",
+				}); err != nil {
+					t.Fatalf("SetNodeDefaultAnnotations(): %v", err)
+				}
+			},
+			expectedKeys: []interface{}{fakeRSAKey2 + " key2"},
+			regenerated:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := testutils.NewToplevelRecorder()
+			rec.AddFilter("iso image")
+			rec.AddFilter("UpdateDisk")
+			ct := newContainerTester(t, rec)
+			defer ct.teardown()
+			if err := ct.virtTool.SetNodeDefaultAnnotations(tc.nodeAnnotations); err != nil {
+				t.Fatalf("SetNodeDefaultAnnotations(): %v", err)
+			}
+
+			sandbox := criapi.GetSandboxes(1)[0]
+			sandbox.Annotations = tc.podAnnotations
+			ct.setPodSandbox(sandbox)
+
+			containerID := ct.createContainer(sandbox, nil)
+			ct.startContainer(containerID)
+			ct.stopContainer(containerID)
+			oldInfo, err := ct.metadataStore.Container(containerID).Retrieve()
+			if err != nil {
+				t.Fatalf("can't retrieve container info: %v", err)
+			}
+			if tc.update != nil {
+				tc.update(t, ct, containerID)
+			}
+			ct.startContainer(containerID)
+
+			// the fake domain records the contents of the ISO
+			// each time the VM is started, and the disks of the
+			// stopped VM must not be updated
+			recs := ct.rec.Content()
+			if len(recs) != 2 {
+				t.Fatalf("unexpected iso image records:\n%s", spew.Sdump(recs))
+			}
+			isoContent, ok := recs[1].Value.(map[string]interface{})
+			if !ok {
+				t.Fatalf("bad iso image record:\n%s", spew.Sdump(recs[1]))
+			}
+			var metaData map[string]interface{}
+			if err := json.Unmarshal([]byte(isoContent["meta-data"].(string)), &metaData); err != nil {
+				t.Fatalf("can't unmarshal meta-data: %v", err)
+			}
+			if !reflect.DeepEqual(metaData["public-keys"], tc.expectedKeys) {
+				t.Errorf("bad public keys in the regenerated meta-data: %#v instead of %#v", metaData["public-keys"], tc.expectedKeys)
+			}
+			newInfo, err := ct.metadataStore.Container(containerID).Retrieve()
+			if err != nil {
+				t.Fatalf("can't retrieve container info: %v", err)
+			}
+			switch {
+			case !tc.regenerated && newInfo.ConfigAnnotationsHash != oldInfo.ConfigAnnotationsHash:
+				t.Errorf("the annotations hash was changed without annotation changes: %q instead of %q", newInfo.ConfigAnnotationsHash, oldInfo.ConfigAnnotationsHash)
+			case tc.regenerated && newInfo.ConfigAnnotationsHash == oldInfo.ConfigAnnotationsHash:
+				t.Errorf("the annotations hash wasn't updated: %q", newInfo.ConfigAnnotationsHash)
+			}
+		})
+	}
+}
@@ -46,10 +46,17 @@ type VMConfig struct {
 	Name string
 	// Image to use for the VM
 	Image string
+	// ImageTenant is the key of the tenant whose image cache is
+	// used for the image. Empty value means the shared cache.
+	ImageTenant string
 	// Attempt is the number of container creation attempts before this one
 	Attempt uint32
 	// Memory limit in bytes. Default: 0 (not specified)
 	MemoryLimitInBytes int64
+	// Memory request in bytes. CRI doesn't pass memory requests,
+	// so it's taken from VirtletMemoryRequest pod annotation.
+	// Default: 0 (not specified)
+	MemoryRequestInBytes int64
 	// CPU shares (relative weight vs. other containers). Default: 0 (not specified)
 	CPUShares int64
 	// CPU CFS (Completely Fair Scheduler) period. Default: 0 (not specified)
@@ -58,6 +65,8 @@ type VMConfig struct {
 	CPUQuota int64
 	// Annotations for the containing pod
 	PodAnnotations map[string]string
+	// Labels for the containing pod
+	PodLabels map[string]string
 	// Annotations for the container
 	ContainerAnnotations map[string]string
 	// Labels for the container
@@ -72,8 +81,23 @@ type VMConfig struct {
 	// Host directories corresponding to the volumes which are to
 	// be mounted inside the VM
 	Mounts []*VMMount
+	// HostDevices contains the host paths of the devices allocated
+	// for the container, e.g. by the device plugins
+	HostDevices []string
+	// RootImageDigest is the digest of the image data used as the
+	// backing file of the root volume (set by the root volume setup)
+	RootImageDigest string
 	// ContainerSideNetwork stores info about container side network configuration
 	ContainerSideNetwork *network.ContainerSideNetwork
+	// BootPhoneHomeURL is the base URL for cloud-init phone_home
+	// module which is used to measure the boot time of the VM.
+	// Empty value means that phone_home isn't added to user-data.
+	BootPhoneHomeURL string
+	// ReadonlyRootfs makes the root disk of the VM read-only.
+	// The mutable paths of the guest are placed on a small
+	// writable overlay volume. It's set from readonly_rootfs
+	// flag of the container security context.
+	ReadonlyRootfs bool
 }
 
 // LoadAnnotations parses pod annotations in the VM config an
@@ -0,0 +1,279 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+// VolumeConflictError is returned when a VM needs an external volume,
+// i.e. a raw device, a raw image file or a Ceph volume, which is
+// already used by another VM in a conflicting way
+type VolumeConflictError struct {
+	// Volume identifies the external volume, e.g. block:/dev/sdb
+	Volume string
+	// ContainerID is the id of the container that uses the volume
+	ContainerID string
+}
+
+func (e *VolumeConflictError) Error() string {
+	return fmt.Sprintf("volume conflict: %q is already in use by container %q", e.Volume, e.ContainerID)
+}
+
+// IsVolumeConflict returns true if the error means that an external
+// volume needed by the VM is used by another VM
+func IsVolumeConflict(err error) bool {
+	_, ok := err.(*VolumeConflictError)
+	return ok
+}
+
+// diskShareOptions contains the setting that allows the disk to be
+// used by several VMs at once
+type diskShareOptions struct {
+	// Shareable marks the disk as shared between the VMs
+	Shareable bool
+}
+
+// shareableVolume is implemented by the volumes that can be
+// shared between the VMs
+type shareableVolume interface {
+	shareOptions() diskShareOptions
+}
+
+func (o *diskShareOptions) shareOptions() diskShareOptions {
+	return *o
+}
+
+// parseFlexvolumeShareOptions extracts the shareable setting from the
+// flexvolume config. It's common for all the flexvolume types.
+func parseFlexvolumeShareOptions(content []byte) (diskShareOptions, error) {
+	var fvOpts struct {
+		Shareable string `json:"shareable,omitempty"`
+	}
+	if err := json.Unmarshal(content, &fvOpts); err != nil {
+		return diskShareOptions{}, err
+	}
+	return diskShareOptions{Shareable: utils.GetBoolFromString(fvOpts.Shareable)}, nil
+}
+
+// volumeClaim denotes the use of an external volume by a VM
+type volumeClaim struct {
+	containerID string
+	readOnly    bool
+	shareable   bool
+}
+
+// compatibleWith returns true if the volume may be used by the VMs
+// of both claims at once, i.e. both of them only read it or both of
+// them are marked as shareable
+func (c volumeClaim) compatibleWith(other volumeClaim) bool {
+	return (c.readOnly && other.readOnly) || (c.shareable && other.shareable)
+}
+
+// volumeClaimRegistry keeps track of the external volumes used by
+// the VMs on the node. It's not persisted by itself but rebuilt
+// from the domain definitions, so it survives Virtlet restarts.
+type volumeClaimRegistry struct {
+	sync.Mutex
+	// claims maps the external volume ids to their claims
+	claims map[string][]volumeClaim
+}
+
+// externalVolumeID returns the identity of the external volume used
+// by the disk or an empty string if the disk refers to the storage
+// managed by Virtlet, e.g. the root volume, or isn't a disk. The
+// paths of the devices and the files are resolved, so the symlinks
+// such as /dev/disk/by-id/... don't hide the conflicts.
+func externalVolumeID(disk *libvirtxml.DomainDisk, managedDirs []string) string {
+	if disk.Device != "disk" || disk.Source == nil {
+		return ""
+	}
+	var kind, path string
+	switch {
+	case disk.Source.Block != nil:
+		kind, path = "block", disk.Source.Block.Dev
+	case disk.Source.File != nil:
+		kind, path = "file", disk.Source.File.File
+		for _, dir := range managedDirs {
+			if dir != "" && strings.HasPrefix(path, filepath.Clean(dir)+"/") {
+				return ""
+			}
+		}
+	case disk.Source.Network != nil && disk.Source.Network.Protocol == "rbd":
+		return "rbd:" + disk.Source.Network.Name
+	default:
+		return ""
+	}
+	if path == "" {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return kind + ":" + filepath.Clean(path)
+}
+
+// managedDirs returns the directories that contain the files of the
+// disks managed by Virtlet
+func (v *VirtualizationTool) managedDirs() ([]string, error) {
+	storagePool, err := v.StoragePool()
+	if err != nil {
+		return nil, err
+	}
+	poolPath, err := storagePool.TargetPath()
+	if err != nil {
+		return nil, fmt.Errorf("can't get the path of the storage pool: %v", err)
+	}
+	return []string{poolPath, configIsoDir}, nil
+}
+
+// diskClaims returns the claims of the external volumes used by the
+// disks keyed by the volume ids
+func diskClaims(containerID string, disks []libvirtxml.DomainDisk, managedDirs []string) map[string]volumeClaim {
+	claims := make(map[string]volumeClaim)
+	for n := range disks {
+		disk := &disks[n]
+		if id := externalVolumeID(disk, managedDirs); id != "" {
+			claims[id] = volumeClaim{
+				containerID: containerID,
+				readOnly:    disk.ReadOnly != nil,
+				shareable:   disk.Shareable != nil,
+			}
+		}
+	}
+	return claims
+}
+
+// virtletDomainDevices returns the devices of the Virtlet domains
+// keyed by the domain uuids. The domains without devices are skipped.
+func (v *VirtualizationTool) virtletDomainDevices() (map[string]*libvirtxml.DomainDeviceList, error) {
+	domains, err := v.domainConn.ListDomains()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list domains: %v", err)
+	}
+	r := make(map[string]*libvirtxml.DomainDeviceList)
+	for _, domain := range domains {
+		name, err := domain.Name()
+		if err != nil {
+			return nil, fmt.Errorf("cannot retrieve domain name: %v", err)
+		}
+		if !strings.HasPrefix(name, "virtlet-") {
+			continue
+		}
+		uuid, err := domain.UUIDString()
+		if err != nil {
+			return nil, fmt.Errorf("cannot retrieve uuid of domain %q: %v", name, err)
+		}
+		def, err := domain.XML()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get xml of the domain %q: %v", uuid, err)
+		}
+		if def.Devices != nil {
+			r[uuid] = def.Devices
+		}
+	}
+	return r, nil
+}
+
+// loadVolumeClaims rebuilds the registry from the definitions of the
+// Virtlet domains. It must be called with the registry locked.
+func (v *VirtualizationTool) loadVolumeClaims() error {
+	managedDirs, err := v.managedDirs()
+	if err != nil {
+		return err
+	}
+	domainDevices, err := v.virtletDomainDevices()
+	if err != nil {
+		return err
+	}
+	claims := make(map[string][]volumeClaim)
+	for uuid, devices := range domainDevices {
+		for id, claim := range diskClaims(uuid, devices.Disks, managedDirs) {
+			claims[id] = append(claims[id], claim)
+		}
+	}
+	v.volumeClaims.claims = claims
+	return nil
+}
+
+// claimExternalVolumes registers the use of the external volumes by
+// the disks of the VM. If any of the volumes is already used by
+// another VM in a conflicting way, none of the volumes are claimed
+// and VolumeConflictError is returned.
+func (v *VirtualizationTool) claimExternalVolumes(containerID string, disks []libvirtxml.DomainDisk) error {
+	managedDirs, err := v.managedDirs()
+	if err != nil {
+		return err
+	}
+	newClaims := diskClaims(containerID, disks, managedDirs)
+	if len(newClaims) == 0 {
+		return nil
+	}
+	v.volumeClaims.Lock()
+	defer v.volumeClaims.Unlock()
+	if v.volumeClaims.claims == nil {
+		if err := v.loadVolumeClaims(); err != nil {
+			return fmt.Errorf("can't load external volume claims: %v", err)
+		}
+	}
+	for id, claim := range newClaims {
+		for _, other := range v.volumeClaims.claims[id] {
+			if other.containerID != containerID && !claim.compatibleWith(other) {
+				return &VolumeConflictError{Volume: id, ContainerID: other.containerID}
+			}
+		}
+	}
+	for id, claim := range newClaims {
+		v.volumeClaims.claims[id] = append(v.volumeClaims.claims[id], claim)
+	}
+	return nil
+}
+
+// releaseExternalVolumes removes the claims of the container
+func (v *VirtualizationTool) releaseExternalVolumes(containerID string) {
+	v.volumeClaims.Lock()
+	defer v.volumeClaims.Unlock()
+	for id, claims := range v.volumeClaims.claims {
+		var rest []volumeClaim
+		for _, claim := range claims {
+			if claim.containerID != containerID {
+				rest = append(rest, claim)
+			}
+		}
+		if len(rest) == 0 {
+			delete(v.volumeClaims.claims, id)
+		} else {
+			v.volumeClaims.claims[id] = rest
+		}
+	}
+}
+
+// reloadVolumeClaims rebuilds the external volume registry from the
+// domain definitions
+func (v *VirtualizationTool) reloadVolumeClaims() error {
+	v.volumeClaims.Lock()
+	defer v.volumeClaims.Unlock()
+	return v.loadVolumeClaims()
+}
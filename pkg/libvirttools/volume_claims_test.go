@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/flexvolume"
+	"github.com/Mirantis/virtlet/pkg/utils"
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func (ct *containerTester) createContainerWithFlexvolume(sandbox *kubeapi.PodSandboxConfig, flexVolume map[string]interface{}) (string, error) {
+	// the flexvolume driver refuses to mount volumes with duplicate
+	// uuids, so the volumes of different pods get different uuids
+	flexVolumeDriver := flexvolume.NewFlexVolumeDriver(func() string {
+		return utils.NewUUID5(fakeUUID, sandbox.Metadata.Uid)
+	}, flexvolume.NullMounter)
+	targetDir := filepath.Join(ct.kubeletRootDir, sandbox.Metadata.Uid, "volumes/virtlet~flexvolume_driver", "data")
+	var r map[string]interface{}
+	if err := json.Unmarshal([]byte(flexVolumeDriver.Run([]string{"mount", targetDir, utils.MapToJSON(flexVolume)})), &r); err != nil {
+		ct.t.Fatalf("failed to unmarshal flexvolume mount result: %v", err)
+	}
+	if r["status"] != "Success" {
+		ct.t.Fatalf("mounting flexvolume failed: %s", r["message"])
+	}
+	return ct.virtTool.CreateContainer(ct.vmConfig(sandbox, []*kubeapi.Mount{
+		{HostPath: targetDir, ContainerPath: "/data"},
+	}), "/tmp/fakenetns")
+}
+
+func TestExternalVolumeClaims(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		firstOptions   map[string]interface{}
+		secondOptions  map[string]interface{}
+		expectConflict bool
+	}{
+		{
+			name:           "read-write in both VMs",
+			expectConflict: true,
+		},
+		{
+			name:           "read-only in the second VM",
+			secondOptions:  map[string]interface{}{"readOnly": "true"},
+			expectConflict: true,
+		},
+		{
+			name:          "read-only in both VMs",
+			firstOptions:  map[string]interface{}{"readOnly": "true"},
+			secondOptions: map[string]interface{}{"readOnly": "true"},
+		},
+		{
+			name:          "shareable in both VMs",
+			firstOptions:  map[string]interface{}{"shareable": "true"},
+			secondOptions: map[string]interface{}{"shareable": "true"},
+		},
+		{
+			name:           "shareable in the first VM only",
+			firstOptions:   map[string]interface{}{"shareable": "true"},
+			expectConflict: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newContainerTester(t, testutils.NewToplevelRecorder())
+			defer ct.teardown()
+
+			imagePath := filepath.Join(ct.tmpDir, "shared.img")
+			if err := ioutil.WriteFile(imagePath, make([]byte, 4096), 0644); err != nil {
+				t.Fatalf("WriteFile(): %v", err)
+			}
+			flexVolume := func(opts map[string]interface{}) map[string]interface{} {
+				r := map[string]interface{}{"type": "rawfile", "path": imagePath}
+				for k, v := range opts {
+					r[k] = v
+				}
+				return r
+			}
+
+			sandboxes := criapi.GetSandboxes(2)
+			for _, sandbox := range sandboxes {
+				ct.setPodSandbox(sandbox)
+			}
+			firstID, err := ct.createContainerWithFlexvolume(sandboxes[0], flexVolume(tc.firstOptions))
+			if err != nil {
+				t.Fatalf("CreateContainer(): %v", err)
+			}
+
+			// the registry is rebuilt from the domain definitions
+			// after Virtlet restart
+			ct.virtTool.volumeClaims.claims = nil
+
+			secondID, err := ct.createContainerWithFlexvolume(sandboxes[1], flexVolume(tc.secondOptions))
+			switch {
+			case !tc.expectConflict && err != nil:
+				t.Fatalf("CreateContainer(): %v", err)
+			case !tc.expectConflict:
+				ct.removeContainer(secondID)
+			case err == nil:
+				t.Fatalf("CreateContainer() didn't fail for a volume that's in use")
+			case !IsVolumeConflict(err):
+				t.Fatalf("CreateContainer() returned a wrong error: %v", err)
+			case err.(*VolumeConflictError).ContainerID != firstID:
+				t.Errorf("bad container id in the conflict error: %v", err)
+			}
+
+			// the volume is released when the container is removed
+			ct.removeContainer(firstID)
+			if _, err := ct.createContainerWithFlexvolume(sandboxes[1], flexVolume(tc.secondOptions)); err != nil {
+				t.Errorf("CreateContainer() after the removal of the other container: %v", err)
+			}
+		})
+	}
+}
@@ -17,6 +17,8 @@ limitations under the License.
 package libvirttools
 
 import (
+	"fmt"
+
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 
 	"github.com/Mirantis/virtlet/pkg/virt"
@@ -27,16 +29,35 @@ type ImageManager interface {
 	GetImagePathAndVirtualSize(ref string) (string, uint64, error)
 }
 
-type volumeOwner interface {
+// VolumeOwner provides the volumes with access to the resources
+// managed by Virtlet
+type VolumeOwner interface {
+	// StoragePool returns the storage pool used for the volumes
 	StoragePool() (virt.StoragePool, error)
+	// DomainConnection returns the libvirt domain connection
 	DomainConnection() virt.DomainConnection
+	// ImageManager returns the image manager
 	ImageManager() ImageManager
+	// RawDevices returns the list of glob patterns of the raw devices
+	// that can be used by the VMs
 	RawDevices() []string
+	// KubeletRootDir returns the path to kubelet root directory
 	KubeletRootDir() string
+	// SkipNoopConfigISO returns true if the config ISO must not be
+	// attached to the VMs that have nothing to configure
+	SkipNoopConfigISO() bool
+	// ConfigISOInPool returns true if the config ISOs must be
+	// stored as volumes in the storage pool
+	ConfigISOInPool() bool
+	// ReclaimStorage tries to free some space in the storage pool
+	// by removing the orphaned volumes, keeping the volumes of the
+	// VM with the specified domain UUID. It returns false if
+	// reclaiming storage is disabled.
+	ReclaimStorage(domainUUID string) bool
 }
 
 // VMVolumeSource is a function that provides `VMVolume`s for VMs
-type VMVolumeSource func(config *VMConfig, owner volumeOwner) ([]VMVolume, error)
+type VMVolumeSource func(config *VMConfig, owner VolumeOwner) ([]VMVolume, error)
 
 // VMVolume describes a volume provider.
 type VMVolume interface {
@@ -46,9 +67,73 @@ type VMVolume interface {
 	Teardown() error
 }
 
+// preservableVolume is implemented by the volumes that can be kept
+// after the container is removed instead of being torn down
+type preservableVolume interface {
+	// Preserve renames the volume using the specified timestamp
+	// so it's not garbage collected and returns the new path of
+	// the volume
+	Preserve(timestamp string) (string, error)
+}
+
+// asPreservableVolume returns the preservableVolume interface of the
+// volume if it supports being preserved. For the flexvolumes, the
+// volume driver is checked.
+func asPreservableVolume(volume VMVolume) (preservableVolume, bool) {
+	if fv, ok := volume.(*driverVolume); ok {
+		pv, ok := fv.driver.(preservableVolume)
+		return pv, ok
+	}
+	pv, ok := volume.(preservableVolume)
+	return pv, ok
+}
+
+// preservedVolumeName returns the name to use for a preserved volume.
+// Note that the name must not start with "virtlet" so the GC doesn't
+// remove the volume.
+func preservedVolumeName(volumeName, timestamp string) string {
+	return "preserved_" + timestamp + "_" + volumeName
+}
+
+// preserveStorageVolume renames the volume in the storage pool
+// and returns its new path
+func preserveStorageVolume(owner VolumeOwner, volumeName, timestamp string) (string, error) {
+	storagePool, err := owner.StoragePool()
+	if err != nil {
+		return "", err
+	}
+	vol, err := storagePool.RenameVolume(volumeName, preservedVolumeName(volumeName, timestamp))
+	if err != nil {
+		return "", err
+	}
+	return vol.Path()
+}
+
+// removeStorageVolume removes the volume from the storage pool.
+// If WipeOnDelete is set for the VM, the volume is wiped first.
+func removeStorageVolume(owner VolumeOwner, config *VMConfig, volumeName string) error {
+	storagePool, err := owner.StoragePool()
+	if err != nil {
+		return err
+	}
+	if config.ParsedAnnotations != nil && config.ParsedAnnotations.WipeOnDelete != "" {
+		vol, err := storagePool.LookupVolumeByName(volumeName)
+		switch {
+		case err == virt.ErrStorageVolumeNotFound:
+			return nil
+		case err != nil:
+			return err
+		}
+		if err := vol.Wipe(config.ParsedAnnotations.WipeOnDelete); err != nil {
+			return fmt.Errorf("error wiping volume %q: %v", volumeName, err)
+		}
+	}
+	return storagePool.RemoveVolumeByName(volumeName)
+}
+
 type volumeBase struct {
 	config *VMConfig
-	owner  volumeOwner
+	owner  VolumeOwner
 }
 
 func (v *volumeBase) WriteImage(diskPathMap) error { return nil }
@@ -57,7 +142,7 @@ func (v *volumeBase) Teardown() error              { return nil }
 // CombineVMVolumeSources returns a function which will pass VM configuration
 // to all listed volumes sources combining returned by them `VMVolume`s.
 func CombineVMVolumeSources(srcs ...VMVolumeSource) VMVolumeSource {
-	return func(config *VMConfig, owner volumeOwner) ([]VMVolume, error) {
+	return func(config *VMConfig, owner VolumeOwner) ([]VMVolume, error) {
 		var vols []VMVolume
 		for _, src := range srcs {
 			vs, err := src(config, owner)
@@ -0,0 +1,383 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/golang/glog"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const (
+	// warmVMName is the container name of the warm VMs till
+	// they're claimed
+	warmVMName = "warm"
+)
+
+// WarmPoolConfig describes the pool of pre-booted VMs which can be
+// used by CreateContainer instead of booting a new VM.
+// Warm VMs are booted without network, as the network can only be
+// passed to the VM upon its startup, so only the pods without
+// container side network can use them. The VMs use default resource
+// settings and annotations. The new cloud-init config is attached to
+// the warm VM upon claiming it, so the base image must be able to
+// re-apply it (e.g. by running cloud-init when the config drive media
+// changes).
+type WarmPoolConfig struct {
+	// Size is the number of warm VMs to keep.
+	// Zero value disables the warm pool.
+	Size int
+	// Image is the base image for the warm VMs
+	Image string
+}
+
+func (c *WarmPoolConfig) validate() error {
+	switch {
+	case c.Size < 0:
+		return fmt.Errorf("bad warm pool size %d", c.Size)
+	case c.Size > 0 && c.Image == "":
+		return errors.New("warm pool image must be specified")
+	default:
+		return nil
+	}
+}
+
+// warmVM denotes a pre-booted VM that's not yet bound to any pod
+type warmVM struct {
+	config *VMConfig
+}
+
+// matches returns true if the warm VM can be used for the specified
+// VMConfig instead of booting a new VM
+func (vm *warmVM) matches(config *VMConfig) bool {
+	key := warmPoolKey(config)
+	return key != "" && key == warmPoolKey(vm.config)
+}
+
+// warmPoolKey returns the hash of the settings of the VM that
+// determine its domain definition and its disks. The warm VM can
+// only be used for a VMConfig with the same key. The identity of the
+// VM and the data that's passed to it via the config ISO, which is
+// regenerated upon claiming the warm VM, are excluded. Any other
+// settings, including the ones added later, make the keys differ
+// unless they match. BestEffort VMs get the minimal CPU shares from
+// kubelet, which are ignored, too. Empty string is returned if the
+// key can't be calculated.
+func warmPoolKey(config *VMConfig) string {
+	if config.ParsedAnnotations == nil {
+		return ""
+	}
+	c := *config
+	// identity of the VM
+	c.PodSandboxID = ""
+	c.PodName = ""
+	c.PodNamespace = ""
+	c.Name = ""
+	c.Attempt = 0
+	c.DomainUUID = ""
+	c.RootImageDigest = ""
+	c.PodAnnotations = nil
+	c.PodLabels = nil
+	c.ContainerAnnotations = nil
+	c.ContainerLabels = nil
+	// config ISO contents
+	c.Environment = nil
+	c.BootPhoneHomeURL = ""
+	if getQOSClass(&c) == qosBestEffort {
+		c.CPUShares = 0
+	}
+
+	va := *config.ParsedAnnotations
+	// config ISO contents
+	va.MetaData = nil
+	va.UserData = nil
+	va.UserDataOverwrite = false
+	va.UserDataScript = ""
+	va.UserDataRaw = nil
+	va.SSHKeys = nil
+	va.SSHHostKeys = nil
+	va.User = ""
+	va.UserPassword = ""
+	va.PowerState = nil
+	va.CACerts = nil
+	va.CACertsRemoveDefaults = false
+	va.SeedFrom = ""
+	va.IPConfigPolicy = ""
+	va.GrowpartDevices = nil
+	va.ImageLabel = ""
+	// the settings that are only used by Virtlet itself
+	// after the domain is created
+	va.PreserveVolumesOnDelete = false
+	va.WipeOnDelete = ""
+	va.MetadataAnnotations = nil
+	va.RestartPolicy = ""
+	va.Autostart = false
+	va.ShutdownModes = nil
+	c.ParsedAnnotations = &va
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		glog.Warningf("Can't calculate warm pool key for container %q: %v", config.Name, err)
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// SetWarmPoolConfig sets the configuration of the warm VM pool.
+// The pool is filled by FillWarmPool calls.
+func (v *VirtualizationTool) SetWarmPoolConfig(config WarmPoolConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	v.warmPoolConfig = config
+	return nil
+}
+
+// FillWarmPool creates and boots new warm VMs till the size of the
+// warm pool reaches the configured value.
+func (v *VirtualizationTool) FillWarmPool() error {
+	for {
+		v.warmPoolLock.Lock()
+		count := len(v.warmVMs)
+		v.warmPoolLock.Unlock()
+		if count >= v.warmPoolConfig.Size {
+			return nil
+		}
+
+		if err := v.addWarmVM(); err != nil {
+			return err
+		}
+	}
+}
+
+// addWarmVM creates a new warm VM and adds it to the pool
+func (v *VirtualizationTool) addWarmVM() error {
+	// keep Reconcile from removing the VM till it's in the pool
+	v.reconcileLock.RLock()
+	defer v.reconcileLock.RUnlock()
+
+	vm, err := v.createWarmVM()
+	if err != nil {
+		return fmt.Errorf("failed to create warm VM: %v", err)
+	}
+	glog.V(1).Infof("Added warm VM %q to the pool", vm.config.DomainUUID)
+
+	v.warmPoolLock.Lock()
+	v.warmVMs = append(v.warmVMs, vm)
+	v.warmPoolLock.Unlock()
+	return nil
+}
+
+// WarmVMCount returns the number of VMs in the warm pool
+// which are ready to be claimed
+func (v *VirtualizationTool) WarmVMCount() int {
+	v.warmPoolLock.Lock()
+	defer v.warmPoolLock.Unlock()
+	return len(v.warmVMs)
+}
+
+func (v *VirtualizationTool) createWarmVM() (*warmVM, error) {
+	config := &VMConfig{
+		Name:       warmVMName,
+		Image:      v.warmPoolConfig.Image,
+		DomainUUID: utils.NewUUID(),
+	}
+	if err := config.LoadAnnotations(); err != nil {
+		return nil, err
+	}
+	defer v.trackVMCreation(config.DomainUUID)()
+
+	settings := v.newDomainSettings(config, "")
+	settings.domainName = warmDomainName(config.DomainUUID)
+	domainDef := settings.createDomain(config)
+
+	diskList, err := newDiskList(config, v.volumeSource, v)
+	if err != nil {
+		return nil, err
+	}
+	domainDef.Devices.Disks, err = diskList.setup()
+	if err != nil {
+		return nil, err
+	}
+
+	ok := false
+	defer func() {
+		if ok {
+			return
+		}
+		if err := v.removeDomain(config.DomainUUID, config, kubeapi.ContainerState_CONTAINER_UNKNOWN, true); err != nil {
+			glog.Warningf("Failed to remove warm domain %q: %v", config.DomainUUID, err)
+		}
+		if err := diskList.teardown(); err != nil {
+			glog.Warningf("error tearing down volumes after an error: %v", err)
+		}
+	}()
+
+	if err := v.addSerialDevicesToDomain(domainDef); err != nil {
+		return nil, err
+	}
+
+	domain, err := v.domainConn.DefineDomain(domainDef)
+	if err == nil {
+		err = diskList.writeImages(domain)
+	}
+	if err == nil {
+		err = domain.Create()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ok = true
+	return &warmVM{config: config}, nil
+}
+
+// takeWarmVM removes a warm VM that matches the specified config
+// from the pool and returns it. It returns nil if there's no such VM.
+func (v *VirtualizationTool) takeWarmVM(config *VMConfig) *warmVM {
+	v.warmPoolLock.Lock()
+	defer v.warmPoolLock.Unlock()
+	for n, vm := range v.warmVMs {
+		if vm.matches(config) {
+			v.warmVMs = append(v.warmVMs[:n], v.warmVMs[n+1:]...)
+			return vm
+		}
+	}
+	return nil
+}
+
+// claimWarmVM tries to take a VM from the warm pool for the
+// specified config, attaching the config's cloud-init data to it.
+// It returns the container id or an empty string if there's no
+// warm VM that can be used.
+func (v *VirtualizationTool) claimWarmVM(config *VMConfig, netFdKey string) (string, error) {
+	// the VMs restored from saved state images don't boot, so
+	// there's no point in taking them from the warm pool
+	if v.warmPoolConfig.Size == 0 || netFdKey != "" || config.ParsedAnnotations.RestoreFrom != "" {
+		return "", nil
+	}
+
+	diskList, err := newDiskList(config, v.volumeSource, v)
+	if err != nil {
+		return "", err
+	}
+	for _, item := range diskList.items {
+		switch item.volume.(type) {
+		case *rootVolume, *configVolume:
+		default:
+			// warm VMs don't have any additional volumes
+			return "", nil
+		}
+	}
+
+	vm := v.takeWarmVM(config)
+	if vm == nil {
+		return "", nil
+	}
+
+	// the volumes in diskList refer to the config, so they
+	// pick up the domain uuid, too
+	config.DomainUUID = vm.config.DomainUUID
+	config.RootImageDigest = vm.config.RootImageDigest
+	err = v.attachToWarmVM(config, diskList)
+	if err == nil {
+		glog.V(1).Infof("Using warm VM %q for container %q", config.DomainUUID, config.Name)
+		return config.DomainUUID, nil
+	}
+
+	glog.Warningf("Failed to use warm VM %q, falling back to creating a new VM: %v", config.DomainUUID, err)
+	if err := v.removeDomain(vm.config.DomainUUID, vm.config, kubeapi.ContainerState_CONTAINER_RUNNING, false); err != nil {
+		glog.Warningf("Failed to remove warm domain %q: %v", vm.config.DomainUUID, err)
+	}
+	return "", nil
+}
+
+func (v *VirtualizationTool) attachToWarmVM(config *VMConfig, diskList *diskList) error {
+	domain, err := v.domainConn.LookupDomainByUUIDString(config.DomainUUID)
+	if err != nil {
+		return fmt.Errorf("failed to look up domain %q: %v", config.DomainUUID, err)
+	}
+	if err := diskList.regenerateConfig(domain); err != nil {
+		return err
+	}
+	// warm VMs don't have any pod labels in their metadata
+	if metadataXML := virtletMetadataXML(config); metadataXML != "" {
+		if err := domain.SetMetadata(virtletMetadataNamespace, virtletMetadataPrefix, metadataXML); err != nil {
+			return fmt.Errorf("failed to set metadata of domain %q: %v", config.DomainUUID, err)
+		}
+	}
+	if err := v.saveContainerInfo(config); err != nil {
+		return err
+	}
+	return v.metadataStore.Container(config.DomainUUID).Save(
+		func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+			if c != nil {
+				c.FromWarmPool = true
+			}
+			return c, nil
+		})
+}
+
+// claimedFromWarmPool returns true if the specified container
+// uses a VM taken from the warm pool that wasn't started via
+// StartContainer yet
+func (v *VirtualizationTool) claimedFromWarmPool(containerID string) bool {
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	if err != nil || containerInfo == nil {
+		return false
+	}
+	return containerInfo.FromWarmPool
+}
+
+// warmDomainName returns the name of the domain of a warm VM. It's
+// only derived from the domain UUID as the VM may be claimed by any
+// container. libvirt can't rename running domains, so the domain is
+// renamed after its container by renameClaimedDomain when it's
+// started again after being stopped.
+func warmDomainName(domainUUID string) string {
+	return "virtlet-" + domainUUID[:13]
+}
+
+// renameClaimedDomain gives the stopped domain the name that's
+// derived from the id and the name of its container if the domain
+// has another name, as it's the case for the VMs taken from the
+// warm pool. The errors are logged, as the domain name is only
+// informational.
+func (v *VirtualizationTool) renameClaimedDomain(containerID string, domain virt.Domain) {
+	containerInfo, err := v.metadataStore.Container(containerID).Retrieve()
+	if err != nil || containerInfo == nil {
+		return
+	}
+	name, err := domain.Name()
+	if err != nil {
+		glog.Warningf("Failed to get the name of domain %q: %v", containerID, err)
+		return
+	}
+	if newName := containerDomainName(containerID, containerInfo.Name); name != newName {
+		if err := domain.Rename(newName); err != nil {
+			glog.Warningf("Failed to rename domain %q from %q to %q: %v", containerID, name, newName, err)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davecgh/go-spew/spew"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func newWarmPoolTester(t *testing.T, rec *testutils.TopLevelRecorder, image string) *containerTester {
+	ct := newContainerTester(t, rec)
+	if err := ct.virtTool.SetWarmPoolConfig(WarmPoolConfig{Size: 2, Image: image}); err != nil {
+		t.Fatalf("SetWarmPoolConfig(): %v", err)
+	}
+	if err := ct.virtTool.FillWarmPool(); err != nil {
+		t.Fatalf("FillWarmPool(): %v", err)
+	}
+	if n := ct.virtTool.WarmVMCount(); n != 2 {
+		t.Fatalf("bad warm VM count after FillWarmPool(): %d instead of 2", n)
+	}
+	return ct
+}
+
+func (ct *containerTester) verifyDomainState(containerID string, expectedState virt.DomainState) {
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		ct.t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	state, err := domain.State()
+	if err != nil {
+		ct.t.Fatalf("State(): %v", err)
+	}
+	if state != expectedState {
+		ct.t.Errorf("bad domain state: %v instead of %v", state, expectedState)
+	}
+}
+
+func TestWarmPoolClaim(t *testing.T) {
+	rec := testutils.NewToplevelRecorder()
+	rec.AddFilter("UpdateDisk")
+	rec.AddFilter("iso image")
+	ct := newWarmPoolTester(t, rec, fakeImageName)
+	defer ct.teardown()
+
+	domains, err := ct.domainConn.ListDomains()
+	if err != nil {
+		t.Fatalf("ListDomains(): %v", err)
+	}
+	if len(domains) != 2 {
+		t.Errorf("bad number of warm domains: %d instead of 2", len(domains))
+	}
+	for _, domain := range domains {
+		state, err := domain.State()
+		if err != nil {
+			t.Fatalf("State(): %v", err)
+		}
+		if state != virt.DomainStateRunning {
+			t.Errorf("warm domain is not running: %v", state)
+		}
+	}
+	if containers := ct.listContainers(nil); len(containers) != 0 {
+		t.Errorf("warm VMs must not be listed as containers:\n%s", spew.Sdump(containers))
+	}
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerID, err := ct.virtTool.CreateContainer(ct.vmConfig(sandbox, nil), "")
+	if err != nil {
+		t.Fatalf("CreateContainer(): %v", err)
+	}
+	if containerID == utils.NewUUID5(ContainerNsUUID, sandbox.Metadata.Uid) {
+		t.Errorf("a new VM was created instead of using a warm one")
+	}
+	if n := ct.virtTool.WarmVMCount(); n != 1 {
+		t.Errorf("bad warm VM count after claiming a VM: %d instead of 1", n)
+	}
+	ct.verifyDomainState(containerID, virt.DomainStateRunning)
+	ct.verifyDomainName(containerID, warmDomainName(containerID))
+
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	def, err := domain.XML()
+	if err != nil {
+		t.Fatalf("XML(): %v", err)
+	}
+	if def.Metadata == nil || !strings.Contains(def.Metadata.XML, `<virtlet:label name="foo">bar</virtlet:label>`) {
+		t.Errorf("the pod labels were not added to the metadata of the warm VM:\n%s", spew.Sdump(def.Metadata))
+	}
+
+	recs := ct.rec.Content()
+	if len(recs) < 2 || !strings.HasSuffix(recs[len(recs)-2].Name, "UpdateDisk") {
+		t.Fatalf("the config image wasn't attached to the warm VM:\n%s", spew.Sdump(recs))
+	}
+	isoContent, ok := recs[len(recs)-1].Value.(map[string]interface{})
+	if !ok {
+		t.Fatalf("bad iso image record:\n%s", spew.Sdump(recs[len(recs)-1]))
+	}
+	var metaData map[string]interface{}
+	if err := json.Unmarshal([]byte(isoContent["meta-data"].(string)), &metaData); err != nil {
+		t.Fatalf("can't unmarshal meta-data: %v", err)
+	}
+	if metaData["local-hostname"] != sandbox.Metadata.Name {
+		t.Errorf("bad hostname in the meta-data: %v instead of %q", metaData["local-hostname"], sandbox.Metadata.Name)
+	}
+
+	// the container that uses the running warm VM is reported
+	// as created till it's started
+	for i := 0; i < 2; i++ {
+		if status := ct.containerStatus(containerID); status.State != kubeapi.ContainerState_CONTAINER_CREATED {
+			t.Errorf("bad container state before StartContainer(): %v instead of %v", status.State, kubeapi.ContainerState_CONTAINER_CREATED)
+		}
+	}
+
+	ct.clock.Advance(1 * time.Second)
+	ct.startContainer(containerID)
+	status := ct.containerStatus(containerID)
+	if status.State != kubeapi.ContainerState_CONTAINER_RUNNING {
+		t.Errorf("bad container state: %v instead of %v", status.State, kubeapi.ContainerState_CONTAINER_RUNNING)
+	}
+
+	if err := ct.virtTool.FillWarmPool(); err != nil {
+		t.Fatalf("FillWarmPool(): %v", err)
+	}
+	if n := ct.virtTool.WarmVMCount(); n != 2 {
+		t.Errorf("the warm pool was not refilled: %d VMs instead of 2", n)
+	}
+
+	// the domain is renamed after the container once
+	// it's shut off
+	ct.stopContainer(containerID)
+	ct.startContainer(containerID)
+	ct.verifyDomainName(containerID, containerDomainName(containerID, fakeContainerName))
+
+	ct.stopContainer(containerID)
+	ct.removeContainer(containerID)
+	if _, err := ct.domainConn.LookupDomainByUUIDString(containerID); err != virt.ErrDomainNotFound {
+		t.Errorf("the domain was not removed")
+	}
+}
+
+func (ct *containerTester) verifyDomainName(containerID, expectedName string) {
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		ct.t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	if name, err := domain.Name(); err != nil {
+		ct.t.Errorf("Name(): %v", err)
+	} else if name != expectedName {
+		ct.t.Errorf("bad domain name %q instead of %q", name, expectedName)
+	}
+}
+
+func TestWarmPoolKey(t *testing.T) {
+	ct := newContainerTester(t, testutils.NewToplevelRecorder())
+	defer ct.teardown()
+
+	vmConfig := func(annotations map[string]string, memoryLimit int64) *VMConfig {
+		sandbox := criapi.GetSandboxes(1)[0]
+		sandbox.Annotations = annotations
+		config := ct.vmConfig(sandbox, nil)
+		config.MemoryLimitInBytes = memoryLimit
+		if err := config.LoadAnnotations(); err != nil {
+			t.Fatalf("LoadAnnotations(): %v", err)
+		}
+		return config
+	}
+	for _, tc := range []struct {
+		name          string
+		vmAnnotations map[string]string
+		annotations   map[string]string
+		memoryLimit   int64
+		matches       bool
+	}{
+		{
+			name:    "default settings",
+			matches: true,
+		},
+		{
+			name: "cloud-init settings",
+			annotations: map[string]string{
+				"VirtletSSHKeys":           "ssh-rsa AAAAB3NzaC1yc2FrZXkx key1",
+				"VirtletCloudInitUserData": "runcmd:\n- echo hi\n",
+				"VirtletRestartPolicy":     "Never",
+			},
+			matches: true,
+		},
+		{
+			name:        "memory limit",
+			memoryLimit: 512 * 1024 * 1024,
+		},
+		{
+			name:        "disk driver",
+			annotations: map[string]string{"VirtletDiskDriver": "virtio"},
+		},
+		{
+			name:        "cpu features",
+			annotations: map[string]string{"VirtletCPUFeatures": "+vmx"},
+		},
+		{
+			name: "realtime scheduler",
+			vmAnnotations: map[string]string{
+				"VirtletEmulatorPin":     "0-1",
+				"VirtletIsolateEmulator": "true",
+			},
+			annotations: map[string]string{
+				"VirtletEmulatorPin":     "0-1",
+				"VirtletIsolateEmulator": "true",
+				"VirtletRTScheduler":     "priority=10",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			vm := &warmVM{config: vmConfig(tc.vmAnnotations, 0)}
+			if r := vm.matches(vmConfig(tc.annotations, tc.memoryLimit)); r != tc.matches {
+				t.Errorf("matches(): %v instead of %v", r, tc.matches)
+			}
+		})
+	}
+}
+
+func TestWarmPoolFallback(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		image       string
+		netFdKey    string
+		annotations map[string]string
+	}{
+		{
+			name:  "image mismatch",
+			image: "fake/other-image",
+		},
+		{
+			name:     "pod with network",
+			image:    fakeImageName,
+			netFdKey: "/tmp/fakenetns",
+		},
+		{
+			name:        "vcpu count mismatch",
+			image:       fakeImageName,
+			annotations: map[string]string{"VirtletVCPUCount": "2"},
+		},
+		{
+			name:        "console log size mismatch",
+			image:       fakeImageName,
+			annotations: map[string]string{"VirtletConsoleLogMaxSize": "1Mi"},
+		},
+		{
+			name:        "console log file count mismatch",
+			image:       fakeImageName,
+			annotations: map[string]string{"VirtletConsoleLogMaxFiles": "3"},
+		},
+		{
+			name:        "guest time sync mismatch",
+			image:       fakeImageName,
+			annotations: map[string]string{"VirtletGuestTimeSync": "hypervclock"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newWarmPoolTester(t, testutils.NewToplevelRecorder(), tc.image)
+			defer ct.teardown()
+
+			sandbox := criapi.GetSandboxes(1)[0]
+			if tc.annotations != nil {
+				sandbox.Annotations = tc.annotations
+			}
+			ct.setPodSandbox(sandbox)
+			containerID, err := ct.virtTool.CreateContainer(ct.vmConfig(sandbox, nil), tc.netFdKey)
+			if err != nil {
+				t.Fatalf("CreateContainer(): %v", err)
+			}
+			if containerID != utils.NewUUID5(ContainerNsUUID, sandbox.Metadata.Uid) {
+				t.Errorf("a warm VM was used instead of creating a new one")
+			}
+			if n := ct.virtTool.WarmVMCount(); n != 2 {
+				t.Errorf("bad warm VM count: %d instead of 2", n)
+			}
+			ct.verifyDomainState(containerID, virt.DomainStateShutoff)
+
+			ct.clock.Advance(1 * time.Second)
+			ct.startContainer(containerID)
+			ct.verifyDomainState(containerID, virt.DomainStateRunning)
+		})
+	}
+}
@@ -0,0 +1,360 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/control"
+	"github.com/Mirantis/virtlet/pkg/libvirttools"
+	"github.com/Mirantis/virtlet/pkg/metadata"
+)
+
+// controlTarget denotes the part of VirtualizationTool that handles
+// the control requests
+type controlTarget interface {
+	UpdateCloudInit(containerID string, podAnnotations map[string]string, rerun bool) error
+	CreateSnapshot(containerID, name, description string) error
+	ListSnapshots(containerID string) ([]metadata.SnapshotInfo, error)
+	RevertToSnapshot(containerID, name string) error
+	RemoveSnapshot(containerID, name string) error
+	ChangedBlocks(containerID, snapshot string) ([]libvirttools.DiskChanges, error)
+	Reconcile(dryRun bool) *libvirttools.ReconcileReport
+	MonitorCommand(containerID, command string) (string, error)
+	SaveContainer(containerID string) error
+	RestoreContainer(containerID string) error
+	SaveStateImage(containerID, name string) (string, error)
+	BlockJobs(containerID string) ([]libvirttools.BlockJob, error)
+	CancelBlockJob(containerID, disk string) error
+}
+
+// controlHandler handles the requests made to the control socket,
+// which are used to change the VMs in the ways not covered by CRI,
+// e.g. to update their cloud-init data, to manage their snapshots or
+// to save and restore their state.
+// The requests are made by virtletctl via 'virtlet -control-request'
+// executed in the Virtlet container.
+type controlHandler struct {
+	target controlTarget
+	// enableMonitorCommands enables the QEMU monitor command
+	// requests, which are rejected otherwise
+	enableMonitorCommands bool
+}
+
+func (h *controlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == control.ReconcilePath {
+		h.handleReconcile(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, control.ContainersPath) {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, control.ContainersPath), "/")
+	switch {
+	case len(parts) < 2 || parts[0] == "":
+		http.NotFound(w, r)
+	case len(parts) == 2 && parts[1] == "cloud-init":
+		h.handleCloudInit(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "snapshots":
+		h.handleSnapshots(w, r, parts[0])
+	case len(parts) == 3 && parts[1] == "snapshots":
+		h.handleSnapshot(w, r, parts[0], parts[2])
+	case len(parts) == 4 && parts[1] == "snapshots" && parts[3] == "revert":
+		h.handleSnapshotRevert(w, r, parts[0], parts[2])
+	case len(parts) == 4 && parts[1] == "snapshots" && parts[3] == "changes":
+		h.handleSnapshotChanges(w, r, parts[0], parts[2])
+	case len(parts) == 2 && parts[1] == "save":
+		h.handleSaveState(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "restore":
+		h.handleRestoreState(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "save-image":
+		h.handleSaveStateImage(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "block-jobs":
+		h.handleBlockJobs(w, r, parts[0])
+	case len(parts) == 3 && parts[1] == "block-jobs":
+		h.handleBlockJob(w, r, parts[0], parts[2])
+	case len(parts) == 2 && parts[1] == "monitor":
+		h.handleMonitor(w, r, parts[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *controlHandler) handleCloudInit(w http.ResponseWriter, r *http.Request, containerID string) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var update control.CloudInitUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, fmt.Sprintf("bad cloud-init update: %v", err), http.StatusBadRequest)
+		return
+	}
+	glog.V(1).Infof("Updating cloud-init data of container %q", containerID)
+	if err := h.target.UpdateCloudInit(containerID, update.PodAnnotations, update.Rerun); err != nil {
+		glog.Errorf("Error updating cloud-init data of container %q: %v", containerID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *controlHandler) handleSnapshots(w http.ResponseWriter, r *http.Request, containerID string) {
+	switch r.Method {
+	case http.MethodGet:
+		snapshots, err := h.target.ListSnapshots(containerID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if snapshots == nil {
+			snapshots = []metadata.SnapshotInfo{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(snapshots); err != nil {
+			glog.Errorf("Error writing the snapshot list of container %q: %v", containerID, err)
+		}
+	case http.MethodPost:
+		var req control.SnapshotRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("bad snapshot request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := h.target.CreateSnapshot(containerID, req.Name, req.Description); err != nil {
+			glog.Errorf("Error creating snapshot %q of container %q: %v", req.Name, containerID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *controlHandler) handleSnapshot(w http.ResponseWriter, r *http.Request, containerID, name string) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.target.RemoveSnapshot(containerID, name); err != nil {
+		glog.Errorf("Error removing snapshot %q of container %q: %v", name, containerID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *controlHandler) handleSnapshotRevert(w http.ResponseWriter, r *http.Request, containerID, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.target.RevertToSnapshot(containerID, name); err != nil {
+		glog.Errorf("Error reverting container %q to snapshot %q: %v", containerID, name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *controlHandler) handleSaveState(w http.ResponseWriter, r *http.Request, containerID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	glog.V(1).Infof("Saving the state of container %q", containerID)
+	if err := h.target.SaveContainer(containerID); err != nil {
+		glog.Errorf("Error saving the state of container %q: %v", containerID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *controlHandler) handleRestoreState(w http.ResponseWriter, r *http.Request, containerID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	glog.V(1).Infof("Restoring the state of container %q", containerID)
+	if err := h.target.RestoreContainer(containerID); err != nil {
+		glog.Errorf("Error restoring the state of container %q: %v", containerID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *controlHandler) handleSaveStateImage(w http.ResponseWriter, r *http.Request, containerID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req control.SaveStateImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad saved state image request: %v", err), http.StatusBadRequest)
+		return
+	}
+	glog.V(1).Infof("Saving the state of container %q as saved state image %q", containerID, req.Name)
+	ref, err := h.target.SaveStateImage(containerID, req.Name)
+	if err != nil {
+		glog.Errorf("Error saving the state of container %q as saved state image %q: %v", containerID, req.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(control.SaveStateImageResult{ImageRef: ref}); err != nil {
+		glog.Errorf("Error writing the saved state image result for container %q: %v", containerID, err)
+	}
+}
+
+func (h *controlHandler) handleBlockJobs(w http.ResponseWriter, r *http.Request, containerID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jobs, err := h.target.BlockJobs(containerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := []control.BlockJob{}
+	for _, job := range jobs {
+		result = append(result, control.BlockJob{
+			Disk:     job.Disk,
+			Type:     string(job.Type),
+			Progress: job.Progress,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		glog.Errorf("Error writing the block job list of container %q: %v", containerID, err)
+	}
+}
+
+func (h *controlHandler) handleBlockJob(w http.ResponseWriter, r *http.Request, containerID, disk string) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.target.CancelBlockJob(containerID, disk); err != nil {
+		glog.Errorf("Error cancelling the block job on disk %q of container %q: %v", disk, containerID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *controlHandler) handleMonitor(w http.ResponseWriter, r *http.Request, containerID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.enableMonitorCommands {
+		http.Error(w, "monitor commands are disabled (use -enable-monitor-commands flag of virtlet to enable them)", http.StatusForbidden)
+		return
+	}
+	var req control.MonitorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad monitor request: %v", err), http.StatusBadRequest)
+		return
+	}
+	glog.Infof("Executing monitor command %q for container %q", req.Command, containerID)
+	result, err := h.target.MonitorCommand(containerID, req.Command)
+	if err != nil {
+		glog.Errorf("Error executing monitor command %q for container %q: %v", req.Command, containerID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := fmt.Fprintln(w, result); err != nil {
+		glog.Errorf("Error writing the monitor command result for container %q: %v", containerID, err)
+	}
+}
+
+func (h *controlHandler) handleSnapshotChanges(w http.ResponseWriter, r *http.Request, containerID, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	changes, err := h.target.ChangedBlocks(containerID, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := []control.DiskChanges{}
+	for _, c := range changes {
+		result = append(result, control.DiskChanges{
+			Device:        c.Device,
+			Granularity:   c.Granularity,
+			ChangedBlocks: c.ChangedBlocks,
+			ChangedBytes:  c.ChangedBytes,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		glog.Errorf("Error writing the changes since snapshot %q of container %q: %v", name, containerID, err)
+	}
+}
+
+func (h *controlHandler) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req control.ReconcileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad reconcile request: %v", err), http.StatusBadRequest)
+		return
+	}
+	glog.V(1).Infof("Reconciling Virtlet state (dry run: %v)", req.DryRun)
+	report := h.target.Reconcile(req.DryRun)
+	result := control.ReconcileResult{Drifts: []control.ReconcileDrift{}}
+	for _, drift := range report.Drifts {
+		result.Drifts = append(result.Drifts, control.ReconcileDrift{
+			Kind:        string(drift.Kind),
+			ContainerID: drift.ContainerID,
+			Name:        drift.Name,
+			Repaired:    drift.Repaired,
+		})
+	}
+	for _, err := range report.Errors {
+		result.Errors = append(result.Errors, err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		glog.Errorf("Error writing the reconcile result: %v", err)
+	}
+}
+
+// serveControl serves the control requests on the control socket
+func (v *VirtletManager) serveControl() {
+	path := v.config.ControlSocketPath
+	if err := syscall.Unlink(path); err != nil && !os.IsNotExist(err) {
+		glog.Errorf("Can't remove the old control socket %q: %v", path, err)
+		return
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		glog.Errorf("Can't listen on the control socket %q: %v", path, err)
+		return
+	}
+	defer ln.Close()
+	glog.V(1).Infof("Serving control requests on socket %s", path)
+	if err := http.Serve(ln, &controlHandler{
+		target:                v.virtTool,
+		enableMonitorCommands: v.config.EnableMonitorCommands,
+	}); err != nil {
+		glog.Errorf("Error serving control requests: %v", err)
+	}
+}
@@ -0,0 +1,439 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Mirantis/virtlet/pkg/control"
+	"github.com/Mirantis/virtlet/pkg/libvirttools"
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+type fakeControlTarget struct {
+	calls     []string
+	snapshots []metadata.SnapshotInfo
+}
+
+var _ controlTarget = &fakeControlTarget{}
+
+func (t *fakeControlTarget) UpdateCloudInit(containerID string, podAnnotations map[string]string, rerun bool) error {
+	t.calls = append(t.calls, fmt.Sprintf("UpdateCloudInit %s %v %v", containerID, podAnnotations, rerun))
+	if containerID == "bad" {
+		return errors.New("simulated failure")
+	}
+	return nil
+}
+
+func (t *fakeControlTarget) CreateSnapshot(containerID, name, description string) error {
+	t.calls = append(t.calls, fmt.Sprintf("CreateSnapshot %s %s %q", containerID, name, description))
+	return nil
+}
+
+func (t *fakeControlTarget) ListSnapshots(containerID string) ([]metadata.SnapshotInfo, error) {
+	t.calls = append(t.calls, fmt.Sprintf("ListSnapshots %s", containerID))
+	if containerID == "bad" {
+		return nil, errors.New("container not found")
+	}
+	return t.snapshots, nil
+}
+
+func (t *fakeControlTarget) RevertToSnapshot(containerID, name string) error {
+	t.calls = append(t.calls, fmt.Sprintf("RevertToSnapshot %s %s", containerID, name))
+	return nil
+}
+
+func (t *fakeControlTarget) RemoveSnapshot(containerID, name string) error {
+	t.calls = append(t.calls, fmt.Sprintf("RemoveSnapshot %s %s", containerID, name))
+	if name == "bad" {
+		return errors.New("snapshot not found")
+	}
+	return nil
+}
+
+func (t *fakeControlTarget) ChangedBlocks(containerID, snapshot string) ([]libvirttools.DiskChanges, error) {
+	t.calls = append(t.calls, fmt.Sprintf("ChangedBlocks %s %s", containerID, snapshot))
+	if snapshot == "bad" {
+		return nil, errors.New("snapshot not found")
+	}
+	return []libvirttools.DiskChanges{
+		{Device: "drive-sda", Granularity: 65536, ChangedBlocks: 2, ChangedBytes: 131072},
+	}, nil
+}
+
+func (t *fakeControlTarget) Reconcile(dryRun bool) *libvirttools.ReconcileReport {
+	t.calls = append(t.calls, fmt.Sprintf("Reconcile %v", dryRun))
+	return &libvirttools.ReconcileReport{
+		DryRun: dryRun,
+		Drifts: []libvirttools.Drift{
+			{
+				Kind:        libvirttools.DriftDomainWithoutContainer,
+				ContainerID: "abc",
+				Name:        "virtlet-abc-vm",
+				Repaired:    !dryRun,
+			},
+		},
+		Errors: []error{errors.New("cannot list libvirt volumes")},
+	}
+}
+
+func (t *fakeControlTarget) MonitorCommand(containerID, command string) (string, error) {
+	t.calls = append(t.calls, fmt.Sprintf("MonitorCommand %s %q", containerID, command))
+	if command != "query-status" {
+		return "", fmt.Errorf("monitor command %q is not allowed", command)
+	}
+	return `{"return":{"running":true,"status":"running"}}`, nil
+}
+
+func (t *fakeControlTarget) SaveContainer(containerID string) error {
+	t.calls = append(t.calls, fmt.Sprintf("SaveContainer %s", containerID))
+	if containerID == "bad" {
+		return errors.New("domain is not running")
+	}
+	return nil
+}
+
+func (t *fakeControlTarget) RestoreContainer(containerID string) error {
+	t.calls = append(t.calls, fmt.Sprintf("RestoreContainer %s", containerID))
+	if containerID == "bad" {
+		return errors.New("container has no saved state")
+	}
+	return nil
+}
+
+func (t *fakeControlTarget) SaveStateImage(containerID, name string) (string, error) {
+	t.calls = append(t.calls, fmt.Sprintf("SaveStateImage %s %s", containerID, name))
+	return "virtlet.cloud/exported/" + name + "@sha256:0123", nil
+}
+
+func (t *fakeControlTarget) BlockJobs(containerID string) ([]libvirttools.BlockJob, error) {
+	t.calls = append(t.calls, fmt.Sprintf("BlockJobs %s", containerID))
+	return []libvirttools.BlockJob{
+		{Disk: "vda", Type: virt.BlockJobTypeActiveCommit, Progress: 42},
+	}, nil
+}
+
+func (t *fakeControlTarget) CancelBlockJob(containerID, disk string) error {
+	t.calls = append(t.calls, fmt.Sprintf("CancelBlockJob %s %s", containerID, disk))
+	if disk == "vdb" {
+		return errors.New("no block job is running")
+	}
+	return nil
+}
+
+func TestControlRequests(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := filepath.Join(tmpDir, "control.sock")
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer ln.Close()
+	target := &fakeControlTarget{
+		snapshots: []metadata.SnapshotInfo{
+			{Name: "snap1", Description: "before upgrade", CreatedAt: 1524648266720331175},
+		},
+	}
+	go http.Serve(ln, &controlHandler{target: target, enableMonitorCommands: true})
+
+	for _, tc := range []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedCalls  []string
+		expectedOutput string
+		errSubstring   string
+	}{
+		{
+			name:          "cloud-init update",
+			method:        http.MethodPut,
+			path:          control.CloudInitPath("abc"),
+			body:          `{"podAnnotations":{"VirtletSSHKeys":"key1"}}`,
+			expectedCalls: []string{"UpdateCloudInit abc map[VirtletSSHKeys:key1] false"},
+		},
+		{
+			name:          "cloud-init update with rerun",
+			method:        http.MethodPut,
+			path:          control.CloudInitPath("abc"),
+			body:          `{"podAnnotations":{"VirtletSSHKeys":"key2"},"rerun":true}`,
+			expectedCalls: []string{"UpdateCloudInit abc map[VirtletSSHKeys:key2] true"},
+		},
+		{
+			name:          "failed cloud-init update",
+			method:        http.MethodPut,
+			path:          control.CloudInitPath("bad"),
+			body:          `{"podAnnotations":{}}`,
+			expectedCalls: []string{"UpdateCloudInit bad map[] false"},
+			errSubstring:  "simulated failure",
+		},
+		{
+			name:         "bad cloud-init update",
+			method:       http.MethodPut,
+			path:         control.CloudInitPath("abc"),
+			body:         "{",
+			errSubstring: "400 Bad Request",
+		},
+		{
+			name:         "bad method",
+			method:       http.MethodGet,
+			path:         control.CloudInitPath("abc"),
+			errSubstring: "405 Method Not Allowed",
+		},
+		{
+			name:          "snapshot creation",
+			method:        http.MethodPost,
+			path:          control.SnapshotsPath("abc"),
+			body:          `{"name":"snap1","description":"before upgrade"}`,
+			expectedCalls: []string{`CreateSnapshot abc snap1 "before upgrade"`},
+		},
+		{
+			name:           "snapshot list",
+			method:         http.MethodGet,
+			path:           control.SnapshotsPath("abc"),
+			expectedCalls:  []string{"ListSnapshots abc"},
+			expectedOutput: `[{"Name":"snap1","Description":"before upgrade","CreatedAt":1524648266720331175}]` + "\n",
+		},
+		{
+			name:          "failed snapshot list",
+			method:        http.MethodGet,
+			path:          control.SnapshotsPath("bad"),
+			expectedCalls: []string{"ListSnapshots bad"},
+			errSubstring:  "container not found",
+		},
+		{
+			name:          "snapshot revert",
+			method:        http.MethodPost,
+			path:          control.SnapshotRevertPath("abc", "snap1"),
+			expectedCalls: []string{"RevertToSnapshot abc snap1"},
+		},
+		{
+			name:          "snapshot removal",
+			method:        http.MethodDelete,
+			path:          control.SnapshotPath("abc", "snap1"),
+			expectedCalls: []string{"RemoveSnapshot abc snap1"},
+		},
+		{
+			name:          "failed snapshot removal",
+			method:        http.MethodDelete,
+			path:          control.SnapshotPath("abc", "bad"),
+			expectedCalls: []string{"RemoveSnapshot abc bad"},
+			errSubstring:  "snapshot not found",
+		},
+		{
+			name:           "snapshot changes",
+			method:         http.MethodGet,
+			path:           control.SnapshotChangesPath("abc", "snap1"),
+			expectedCalls:  []string{"ChangedBlocks abc snap1"},
+			expectedOutput: `[{"device":"drive-sda","granularity":65536,"changedBlocks":2,"changedBytes":131072}]` + "\n",
+		},
+		{
+			name:          "failed snapshot changes",
+			method:        http.MethodGet,
+			path:          control.SnapshotChangesPath("abc", "bad"),
+			expectedCalls: []string{"ChangedBlocks abc bad"},
+			errSubstring:  "snapshot not found",
+		},
+		{
+			name:         "bad snapshot method",
+			method:       http.MethodPut,
+			path:         control.SnapshotPath("abc", "snap1"),
+			errSubstring: "405 Method Not Allowed",
+		},
+		{
+			name:          "reconcile",
+			method:        http.MethodPost,
+			path:          control.ReconcilePath,
+			body:          `{}`,
+			expectedCalls: []string{"Reconcile false"},
+			expectedOutput: `{"drifts":[{"kind":"domain-without-container","containerID":"abc","name":"virtlet-abc-vm","repaired":true}],` +
+				`"errors":["cannot list libvirt volumes"]}` + "\n",
+		},
+		{
+			name:          "reconcile dry run",
+			method:        http.MethodPost,
+			path:          control.ReconcilePath,
+			body:          `{"dryRun":true}`,
+			expectedCalls: []string{"Reconcile true"},
+			expectedOutput: `{"drifts":[{"kind":"domain-without-container","containerID":"abc","name":"virtlet-abc-vm"}],` +
+				`"errors":["cannot list libvirt volumes"]}` + "\n",
+		},
+		{
+			name:         "bad reconcile method",
+			method:       http.MethodGet,
+			path:         control.ReconcilePath,
+			errSubstring: "405 Method Not Allowed",
+		},
+		{
+			name:          "state save",
+			method:        http.MethodPost,
+			path:          control.SaveStatePath("abc"),
+			expectedCalls: []string{"SaveContainer abc"},
+		},
+		{
+			name:          "failed state save",
+			method:        http.MethodPost,
+			path:          control.SaveStatePath("bad"),
+			expectedCalls: []string{"SaveContainer bad"},
+			errSubstring:  "domain is not running",
+		},
+		{
+			name:          "state restore",
+			method:        http.MethodPost,
+			path:          control.RestoreStatePath("abc"),
+			expectedCalls: []string{"RestoreContainer abc"},
+		},
+		{
+			name:          "failed state restore",
+			method:        http.MethodPost,
+			path:          control.RestoreStatePath("bad"),
+			expectedCalls: []string{"RestoreContainer bad"},
+			errSubstring:  "container has no saved state",
+		},
+		{
+			name:           "saved state image",
+			method:         http.MethodPost,
+			path:           control.SaveStateImagePath("abc"),
+			body:           `{"name":"appliance"}`,
+			expectedCalls:  []string{"SaveStateImage abc appliance"},
+			expectedOutput: `{"imageRef":"virtlet.cloud/exported/appliance@sha256:0123"}` + "\n",
+		},
+		{
+			name:         "bad saved state image request",
+			method:       http.MethodPost,
+			path:         control.SaveStateImagePath("abc"),
+			body:         "{",
+			errSubstring: "400 Bad Request",
+		},
+		{
+			name:         "bad state save method",
+			method:       http.MethodGet,
+			path:         control.SaveStatePath("abc"),
+			errSubstring: "405 Method Not Allowed",
+		},
+		{
+			name:           "block job list",
+			method:         http.MethodGet,
+			path:           control.BlockJobsPath("abc"),
+			expectedCalls:  []string{"BlockJobs abc"},
+			expectedOutput: `[{"disk":"vda","type":"active-commit","progress":42}]` + "\n",
+		},
+		{
+			name:          "block job cancellation",
+			method:        http.MethodDelete,
+			path:          control.BlockJobPath("abc", "vda"),
+			expectedCalls: []string{"CancelBlockJob abc vda"},
+		},
+		{
+			name:          "failed block job cancellation",
+			method:        http.MethodDelete,
+			path:          control.BlockJobPath("abc", "vdb"),
+			expectedCalls: []string{"CancelBlockJob abc vdb"},
+			errSubstring:  "no block job is running",
+		},
+		{
+			name:           "monitor command",
+			method:         http.MethodPost,
+			path:           control.MonitorPath("abc"),
+			body:           `{"command":"query-status"}`,
+			expectedCalls:  []string{`MonitorCommand abc "query-status"`},
+			expectedOutput: `{"return":{"running":true,"status":"running"}}` + "\n",
+		},
+		{
+			name:          "disallowed monitor command",
+			method:        http.MethodPost,
+			path:          control.MonitorPath("abc"),
+			body:          `{"command":"quit"}`,
+			expectedCalls: []string{`MonitorCommand abc "quit"`},
+			errSubstring:  "is not allowed",
+		},
+		{
+			name:         "bad monitor method",
+			method:       http.MethodGet,
+			path:         control.MonitorPath("abc"),
+			errSubstring: "405 Method Not Allowed",
+		},
+		{
+			name:         "bad path",
+			method:       http.MethodPut,
+			path:         "/containers/abc/foobar",
+			errSubstring: "404 Not Found",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target.calls = nil
+			var out bytes.Buffer
+			err := control.Request(socketPath, tc.method, tc.path, strings.NewReader(tc.body), &out)
+			switch {
+			case err != nil && tc.errSubstring == "":
+				t.Errorf("Request(): unexpected error: %v", err)
+			case err == nil && tc.errSubstring != "":
+				t.Errorf("Request(): didn't get expected error (substring %q)", tc.errSubstring)
+			case err != nil && !strings.Contains(err.Error(), tc.errSubstring):
+				t.Errorf("Request(): didn't get expected substring %q in the error: %v", tc.errSubstring, err)
+			case out.String() != tc.expectedOutput:
+				t.Errorf("Request(): bad output %q instead of %q", out.String(), tc.expectedOutput)
+			}
+			if !reflect.DeepEqual(target.calls, tc.expectedCalls) {
+				t.Errorf("bad calls: %#v instead of %#v", target.calls, tc.expectedCalls)
+			}
+		})
+	}
+}
+
+func TestDisabledMonitorCommands(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := filepath.Join(tmpDir, "control.sock")
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer ln.Close()
+	target := &fakeControlTarget{}
+	go http.Serve(ln, &controlHandler{target: target})
+
+	var out bytes.Buffer
+	err = control.Request(socketPath, http.MethodPost, control.MonitorPath("abc"), strings.NewReader(`{"command":"query-status"}`), &out)
+	switch {
+	case err == nil:
+		t.Errorf("Request(): didn't get an error for a disabled monitor command")
+	case !strings.Contains(err.Error(), "403 Forbidden"):
+		t.Errorf("Request(): unexpected error: %v", err)
+	}
+	if len(target.calls) != 0 {
+		t.Errorf("unexpected calls: %#v", target.calls)
+	}
+}
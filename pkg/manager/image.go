@@ -18,6 +18,8 @@ package manager
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
 
 	"golang.org/x/net/context"
 	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
@@ -29,6 +31,7 @@ import (
 type VirtletImageService struct {
 	imageStore      image.Store
 	imageTranslator image.Translator
+	tenantIsolation bool
 }
 
 // NewVirtletImageService returns a new instance of VirtletImageService.
@@ -39,6 +42,16 @@ func NewVirtletImageService(imageStore image.Store, imageTranslator image.Transl
 	}
 }
 
+// SetTenantIsolation makes the image service pull the images for
+// the pods into the image caches of the tenants the pods belong
+// to. The tenant is determined by the namespace of the pod. The
+// images pulled for the tenants aren't listed by ListImages and
+// ImageStatus, so the tenants can't see each other's images.
+// The image store must implement image.TenantStore.
+func (v *VirtletImageService) SetTenantIsolation(enable bool) {
+	v.tenantIsolation = enable
+}
+
 // ListImages method implements ListImages from CRI.
 func (v *VirtletImageService) ListImages(ctx context.Context, in *kubeapi.ListImagesRequest) (*kubeapi.ListImagesResponse, error) {
 	images, err := v.imageStore.ListImages(in.GetFilter().GetImage().GetImage())
@@ -61,6 +74,9 @@ func (v *VirtletImageService) ImageStatus(ctx context.Context, in *kubeapi.Image
 		return nil, err
 	}
 	response := &kubeapi.ImageStatusResponse{Image: imageToKubeapi(img)}
+	if img != nil && in.GetVerbose() {
+		response.Info = imageInfo(img)
+	}
 	return response, err
 }
 
@@ -68,7 +84,19 @@ func (v *VirtletImageService) ImageStatus(ctx context.Context, in *kubeapi.Image
 func (v *VirtletImageService) PullImage(ctx context.Context, in *kubeapi.PullImageRequest) (*kubeapi.PullImageResponse, error) {
 	imageName := in.GetImage().GetImage()
 
-	ref, err := v.imageStore.PullImage(ctx, imageName, v.imageTranslator)
+	store := v.imageStore
+	if v.tenantIsolation {
+		tenantStore, ok := v.imageStore.(image.TenantStore)
+		if !ok {
+			return nil, errors.New("the image store doesn't support image tenants")
+		}
+		var err error
+		if store, err = tenantStore.ForTenant(in.GetSandboxConfig().GetMetadata().GetNamespace()); err != nil {
+			return nil, fmt.Errorf("can't pull image %q: %v", imageName, err)
+		}
+	}
+
+	ref, err := store.PullImage(ctx, imageName, image.TranslatorWithAuth(v.imageTranslator, imageAuthConfig(in.GetAuth())))
 	if err != nil {
 		return nil, err
 	}
@@ -77,6 +105,22 @@ func (v *VirtletImageService) PullImage(ctx context.Context, in *kubeapi.PullIma
 	return response, nil
 }
 
+// imageAuthConfig converts the image pull credentials provided by
+// kubelet to image.AuthConfig. It returns nil if there are none.
+func imageAuthConfig(auth *kubeapi.AuthConfig) *image.AuthConfig {
+	if auth == nil {
+		return nil
+	}
+	return &image.AuthConfig{
+		Username:      auth.GetUsername(),
+		Password:      auth.GetPassword(),
+		Auth:          auth.GetAuth(),
+		IdentityToken: auth.GetIdentityToken(),
+		RegistryToken: auth.GetRegistryToken(),
+		ServerAddress: auth.GetServerAddress(),
+	}
+}
+
 // RemoveImage method implements RemoveImage from CRI.
 func (v *VirtletImageService) RemoveImage(ctx context.Context, in *kubeapi.RemoveImageRequest) (*kubeapi.RemoveImageResponse, error) {
 	imageName := in.GetImage().GetImage()
@@ -101,3 +145,15 @@ func imageToKubeapi(img *image.Image) *kubeapi.Image {
 		Size_:    img.Size,
 	}
 }
+
+// imageInfo returns the verbose image info for ImageStatus
+// response that includes the virtual size of the image and
+// whether it's used by some of the containers
+func imageInfo(img *image.Image) map[string]string {
+	return map[string]string{
+		"digest":      img.Digest,
+		"actualSize":  strconv.FormatUint(img.Size, 10),
+		"virtualSize": strconv.FormatUint(img.VirtualSize, 10),
+		"inUse":       strconv.FormatBool(img.InUse),
+	}
+}
@@ -18,11 +18,14 @@ package manager
 
 import (
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/Mirantis/virtlet/pkg/control"
 	"github.com/Mirantis/virtlet/pkg/image"
 	"github.com/Mirantis/virtlet/pkg/imagetranslation"
 	"github.com/Mirantis/virtlet/pkg/libvirttools"
@@ -38,6 +41,9 @@ const (
 	defaultLibvirtURI         = "qemu:///system"
 	streamerSocketPath        = "/var/lib/libvirt/streamer.sock"
 	defaultCRISocketPath      = "/run/virtlet.sock"
+	warmPoolRefillInterval    = 10 * time.Second
+	crashedVMCheckInterval    = 5 * time.Second
+	phoneHomePath             = "/phone-home/"
 )
 
 // VirtletConfig denotes a configuration for VirtletManager.
@@ -54,22 +60,152 @@ type VirtletConfig struct {
 	DownloadProtocol string
 	// ImageDir specifies the image store directory.
 	ImageDir string
+	// ImageDecompression specifies a comma-separated list of
+	// compression formats of the images that are decompressed
+	// during the pull. Empty string means all the supported
+	// formats, "none" disables the decompression.
+	ImageDecompression string
 	// ImageTranslationConfigsDir specifies the directory with
 	// image translation configuration files. Empty string means
 	// such directory is not used.
 	ImageTranslationConfigsDir string
 	// SkipImageTranslation disables image translations
 	SkipImageTranslation bool
+	// QemuImgPriority specifies the CPU and I/O priority for the
+	// qemu-img commands. By default, the priority is not changed.
+	QemuImgPriority image.CommandPriority
+	// ImageTenantIsolation makes Virtlet keep a separate image
+	// cache for each namespace
+	ImageTenantIsolation bool
 	// LibvirtURI specifies the libvirt connnection URI
 	LibvirtURI string
+	// LibvirtConnectionPool specifies the pool of libvirt
+	// connections to keep open
+	LibvirtConnectionPool libvirttools.ConnectionPoolConfig
 	// PodLogDir specifies a directory where Kubernetes pod logs are stored.
 	// The streaming server is not started if this value is empty.
 	PodLogDir string
-	// RawDevices specifies a comma-separated list of raw device
-	// glob patterns which VMs can access
+	// MaxConsoles specifies the maximum number of VM serial
+	// consoles that are read and logged at the same time.
+	// 0 means no limit.
+	MaxConsoles int
+	// ConsoleReconnectMaxBackoff is the maximum interval between
+	// the checks whether the VM is still running while waiting for
+	// it to reconnect its serial console, so the console log resumes
+	// after the console socket drops. 0 means that the console log
+	// is closed as soon as the console disconnects.
+	ConsoleReconnectMaxBackoff time.Duration
+	// ConsoleLogRotation specifies when the VM console logs are
+	// rotated. It can be overridden for a VM using
+	// VirtletConsoleLogMaxSize and VirtletConsoleLogMaxFiles
+	// annotations.
+	ConsoleLogRotation stream.LogRotationConfig
+	// RawDevices specifies a comma-separated list of glob patterns
+	// of the device paths relative to /dev which VMs can access
+	// via raw flexvolumes. Empty string means no raw devices
+	// can be used.
 	RawDevices string
+	// GPUDevices specifies a comma-separated list of the PCI
+	// addresses of the host GPUs which can be passed through to
+	// the VMs using VirtletGPUDevices annotation. Empty string
+	// means no GPUs can be requested this way.
+	GPUDevices string
+	// InterfaceSources specifies a comma-separated list of the
+	// host bridges, host interfaces and libvirt networks which
+	// the VMs can be connected to using VirtletInterfaceSource
+	// annotation, e.g. bridge:br0,network:default. Empty string
+	// means no such interfaces can be requested.
+	InterfaceSources string
 	// CRISocketPath specifies the socket path for the gRPC endpoint.
 	CRISocketPath string
+	// ControlSocketPath specifies the socket path for the control
+	// requests made by virtletctl, such as cloud-init data updates.
+	ControlSocketPath string
+	// StoragePool specifies the libvirt storage pool to use for
+	// the volumes. The pool is created if it doesn't exist.
+	StoragePool libvirttools.StoragePoolConfig
+	// WarmPool specifies the pool of pre-booted VMs.
+	// The warm pool is disabled if its size is zero.
+	WarmPool libvirttools.WarmPoolConfig
+	// MaxVolumeCount specifies the maximum number of volumes per
+	// VM including the root and the config volumes. Zero value
+	// means that only the limits of the disk drivers are applied.
+	MaxVolumeCount int
+	// GuestAgent specifies the time limits for the guest agent calls
+	GuestAgent libvirttools.GuestAgentConfig
+	// NodeDefaultAnnotations specifies the Virtlet annotations
+	// that are applied to all the VMs on the node unless the pod
+	// sets them itself
+	NodeDefaultAnnotations map[string]string
+	// MissingMountPolicy specifies what CreateContainer does when
+	// the host path of a container mount doesn't exist. Empty
+	// value means failing with a retryable error.
+	MissingMountPolicy libvirttools.MissingMountPolicy
+	// Startup specifies the time limit for starting the VMs
+	Startup libvirttools.StartupConfig
+	// BootTime specifies how the boot time of the VMs is
+	// measured. The phone-home endpoint is served on
+	// MetricsAddress. LogDir is set to PodLogDir.
+	BootTime libvirttools.BootTimeConfig
+	// DeviceProfile specifies the set of the optional devices
+	// to add to the VMs. Empty value means the default profile.
+	DeviceProfile libvirttools.DeviceProfile
+	// MemoryBackingDir specifies the directory for file-backed
+	// VM memory. It must match memory_backing_dir setting in
+	// libvirt's qemu.conf. Empty value disables file-backed memory.
+	MemoryBackingDir string
+	// SavedStateDir specifies the directory for the saved VM
+	// states. Empty value means the default directory.
+	SavedStateDir string
+	// MinGracefulStopTimeout is the shortest StopContainer
+	// timeout for which graceful VM shutdown is attempted.
+	// The VMs are destroyed right away if the timeout
+	// is shorter than that or zero.
+	MinGracefulStopTimeout time.Duration
+	// ContainerTombstoneTTL is the time the status of a removed
+	// container is kept, during which the container is still
+	// reported as an exited one. Zero value disables it.
+	ContainerTombstoneTTL time.Duration
+	// MaxConcurrentBoots is the maximum number of VMs that can be
+	// started at the same time. The StartContainer calls over the
+	// limit wait for their turn. Zero value means no limit.
+	MaxConcurrentBoots int
+	// QOSScheduling maps the QoS classes of the pods to the CPU
+	// scheduling settings (nice value and cgroup cpu weight) of
+	// the QEMU processes of their VMs
+	QOSScheduling libvirttools.QOSSchedulingConfig
+	// NetworkDetachOrder specifies whether StopPodSandbox destroys
+	// the VMs of the pod before or after tearing down the pod
+	// network. Empty value means NetworkDetachAfterDestroy.
+	NetworkDetachOrder NetworkDetachOrder
+	// ReclaimStorage makes Virtlet remove the orphaned volumes
+	// from the storage pool when it's out of space before failing
+	// volume creation
+	ReclaimStorage bool
+	// DisableDomainEvents makes Virtlet not watch libvirt domain
+	// events, so the VMs that are powered off by the guest OS are
+	// only detected when the container status is requested
+	DisableDomainEvents bool
+	// SkipNoopConfigISO disables the cloud-init config ISO for
+	// the VMs that have nothing to configure
+	SkipNoopConfigISO bool
+	// ConfigISOInPool makes Virtlet store the cloud-init config
+	// ISOs as volumes in the storage pool
+	ConfigISOInPool bool
+	// EnableMonitorCommands makes Virtlet accept the requests to
+	// execute read-only QEMU monitor commands on its control
+	// socket, which are meant for the cluster operators only
+	EnableMonitorCommands bool
+	// Hooks specifies the commands to run after the VMs are
+	// created and removed
+	Hooks libvirttools.HookConfig
+	// MetricsAddress specifies the address to serve Prometheus
+	// metrics on. The metrics are not served if it's empty.
+	MetricsAddress string
+	// DiskStatsInterval specifies how often the I/O stats of the
+	// VM disks are collected for the metrics. Zero value disables
+	// disk stats collection.
+	DiskStatsInterval time.Duration
 }
 
 // ApplyDefaults applies default settings to VirtletConfig
@@ -83,6 +219,9 @@ func (c *VirtletConfig) applyDefaults() {
 	if c.CRISocketPath == "" {
 		c.CRISocketPath = defaultCRISocketPath
 	}
+	if c.ControlSocketPath == "" {
+		c.ControlSocketPath = control.DefaultSocketPath
+	}
 }
 
 // VirtletManager wraps the Virtlet's Runtime and Image CRI services,
@@ -130,9 +269,20 @@ func (v *VirtletManager) Run() error {
 		return fmt.Errorf("failed to create metadata store: %v", err)
 	}
 
+	decompressionFormats, err := image.ParseDecompressionFormats(v.config.ImageDecompression)
+	if err != nil {
+		return fmt.Errorf("bad image decompression option: %v", err)
+	}
+	qemuImg, err := image.NewQemuImg(v.config.QemuImgPriority)
+	if err != nil {
+		return fmt.Errorf("bad qemu-img priority: %v", err)
+	}
 	downloader := image.NewDownloader(v.config.DownloadProtocol)
-	v.imageStore = image.NewFileStore(v.config.ImageDir, downloader, nil)
-	v.imageStore.SetRefGetter(v.metadataStore.ImagesInUse)
+	fileStore := image.NewFileStore(v.config.ImageDir, downloader, qemuImg.VirtualSize)
+	fileStore.SetRefGetter(v.metadataStore.ImagesInUse)
+	fileStore.SetDecompressionFormats(decompressionFormats)
+	fileStore.SetConvertFunc(qemuImg.Convert)
+	v.imageStore = fileStore
 
 	var translator image.Translator
 	if !v.config.SkipImageTranslation {
@@ -144,7 +294,7 @@ func (v *VirtletManager) Run() error {
 		translator = imagetranslation.GetEmptyImageTranslator()
 	}
 
-	conn, err := libvirttools.NewConnection(v.config.LibvirtURI)
+	conn, err := libvirttools.NewConnection(v.config.LibvirtURI, v.config.LibvirtConnectionPool)
 	if err != nil {
 		return fmt.Errorf("error establishing libvirt connection: %v", err)
 	}
@@ -155,6 +305,16 @@ func (v *VirtletManager) Run() error {
 		if err != nil {
 			return fmt.Errorf("couldn't create stream server: %v", err)
 		}
+		s.SetMaxConsoles(v.config.MaxConsoles)
+		s.SetConsoleLogRotation(v.config.ConsoleLogRotation)
+		s.SetConsoleReconnect(func(containerID string) (bool, error) {
+			// the stream server is started before the
+			// VirtualizationTool is created
+			if v.virtTool == nil {
+				return true, nil
+			}
+			return v.virtTool.DomainActive(containerID)
+		}, v.config.ConsoleReconnectMaxBackoff)
 
 		err = s.Start()
 		if err != nil {
@@ -165,9 +325,67 @@ func (v *VirtletManager) Run() error {
 	}
 
 	volSrc := libvirttools.GetDefaultVolumeSource()
-	v.virtTool = libvirttools.NewVirtualizationTool(conn, conn, v.imageStore, v.metadataStore, "volumes", v.config.RawDevices, volSrc)
+	v.virtTool = libvirttools.NewVirtualizationTool(conn, conn, v.imageStore, v.metadataStore, "volumes", volSrc)
+	if err := v.virtTool.SetRawDevices(v.config.RawDevices); err != nil {
+		return fmt.Errorf("bad raw device list: %v", err)
+	}
+	if err := v.virtTool.SetGPUDevices(v.config.GPUDevices); err != nil {
+		return fmt.Errorf("bad GPU device list: %v", err)
+	}
+	if err := v.virtTool.SetInterfaceSources(v.config.InterfaceSources); err != nil {
+		return fmt.Errorf("bad interface source list: %v", err)
+	}
+	if err := v.virtTool.SetStoragePoolConfig(v.config.StoragePool); err != nil {
+		return fmt.Errorf("bad storage pool config: %v", err)
+	}
+	if _, err := v.virtTool.StoragePool(); err != nil {
+		return fmt.Errorf("failed to set up the storage pool: %v", err)
+	}
+	if err := v.virtTool.SetWarmPoolConfig(v.config.WarmPool); err != nil {
+		return fmt.Errorf("bad warm pool config: %v", err)
+	}
+	v.virtTool.SetMaxVolumeCount(v.config.MaxVolumeCount)
+	if err := v.virtTool.SetMissingMountPolicy(v.config.MissingMountPolicy); err != nil {
+		return err
+	}
+	if err := v.virtTool.SetNodeDefaultAnnotations(v.config.NodeDefaultAnnotations); err != nil {
+		return err
+	}
+	v.virtTool.SetMinGracefulStopTimeout(v.config.MinGracefulStopTimeout)
+	v.virtTool.SetContainerTombstoneTTL(v.config.ContainerTombstoneTTL)
+	v.virtTool.SetMaxConcurrentBoots(v.config.MaxConcurrentBoots)
+	if err := v.virtTool.SetQOSSchedulingConfig(v.config.QOSScheduling); err != nil {
+		return err
+	}
+	v.virtTool.SetGuestAgentConfig(v.config.GuestAgent)
+	v.virtTool.SetStartupConfig(v.config.Startup)
+	bootTimeConfig := v.config.BootTime
+	bootTimeConfig.LogDir = v.config.PodLogDir
+	if err := v.virtTool.SetBootTimeConfig(bootTimeConfig); err != nil {
+		return fmt.Errorf("bad boot time config: %v", err)
+	}
+	if err := v.virtTool.SetDeviceProfile(v.config.DeviceProfile); err != nil {
+		return err
+	}
+	if err := v.virtTool.SetMemoryBackingDir(v.config.MemoryBackingDir); err != nil {
+		return err
+	}
+	if err := v.virtTool.SetSavedStateDir(v.config.SavedStateDir); err != nil {
+		return err
+	}
+	v.virtTool.SetSkipNoopConfigISO(v.config.SkipNoopConfigISO)
+	if err := v.virtTool.SetConfigISOInPool(v.config.ConfigISOInPool); err != nil {
+		return err
+	}
+	v.virtTool.SetHookConfig(v.config.Hooks)
+	v.virtTool.SetImageTenantIsolation(v.config.ImageTenantIsolation)
+	v.virtTool.SetReclaimStorage(v.config.ReclaimStorage)
 	runtimeService := NewVirtletRuntimeService(v.virtTool, v.metadataStore, v.fdManager, streamServer, v.imageStore, nil)
+	if err := runtimeService.SetNetworkDetachOrder(v.config.NetworkDetachOrder); err != nil {
+		return err
+	}
 	imageService := NewVirtletImageService(v.imageStore, translator)
+	imageService.SetTenantIsolation(v.config.ImageTenantIsolation)
 
 	v.server = NewServer()
 	v.server.Register(runtimeService, imageService)
@@ -177,6 +395,32 @@ func (v *VirtletManager) Run() error {
 		glog.Warning(err)
 	}
 
+	if v.config.MetricsAddress != "" {
+		prometheus.MustRegister(image.NewImageStatsCollector(v.imageStore))
+		if v.config.DiskStatsInterval > 0 {
+			prometheus.MustRegister(v.virtTool.DiskStatsCollector())
+			go v.collectDiskStats()
+		}
+		go v.serveMetrics()
+	}
+
+	if v.config.WarmPool.Size > 0 {
+		// this must be done after GC which removes
+		// the warm VMs left from the previous run
+		go v.maintainWarmPool()
+	}
+
+	if !v.config.DisableDomainEvents {
+		if _, err := v.virtTool.WatchDomainEvents(); err != nil {
+			// the guest shutdowns are still detected when
+			// the container status is requested
+			glog.Warningf("Error watching libvirt domain events: %v", err)
+		}
+	}
+
+	go v.restartCrashedVMs()
+	go v.serveControl()
+
 	glog.V(1).Infof("Starting server on socket %s", v.config.CRISocketPath)
 	if err = v.server.Serve(v.config.CRISocketPath); err != nil {
 		return fmt.Errorf("serving failed: %v", err)
@@ -192,6 +436,64 @@ func (v *VirtletManager) Stop() {
 	}
 }
 
+// maintainWarmPool periodically refills the pool of pre-booted VMs
+func (v *VirtletManager) maintainWarmPool() {
+	for {
+		if err := v.virtTool.FillWarmPool(); err != nil {
+			glog.Warningf("Error filling the warm pool: %v", err)
+		}
+		time.Sleep(warmPoolRefillInterval)
+	}
+}
+
+// restartCrashedVMs periodically restarts the crashed VMs
+// according to their restart policy
+func (v *VirtletManager) restartCrashedVMs() {
+	for {
+		for _, err := range v.virtTool.RestartCrashedVMs() {
+			glog.Warningf("Error restarting crashed VMs: %v", err)
+		}
+		time.Sleep(crashedVMCheckInterval)
+	}
+}
+
+// collectDiskStats periodically updates the disk I/O stats of
+// the VMs that are exposed via Prometheus metrics
+func (v *VirtletManager) collectDiskStats() {
+	for {
+		for _, err := range v.virtTool.CollectDiskStats() {
+			glog.Warningf("Error collecting disk stats: %v", err)
+		}
+		time.Sleep(v.config.DiskStatsInterval)
+	}
+}
+
+// serveMetrics serves Prometheus metrics over http
+func (v *VirtletManager) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler())
+	mux.HandleFunc(phoneHomePath, v.handlePhoneHome)
+	glog.V(1).Infof("Serving metrics on %s", v.config.MetricsAddress)
+	if err := http.ListenAndServe(v.config.MetricsAddress, mux); err != nil {
+		glog.Errorf("Error serving metrics: %v", err)
+	}
+}
+
+// handlePhoneHome handles the requests made by cloud-init
+// phone_home module once the VM is booted
+func (v *VirtletManager) handlePhoneHome(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	containerID := strings.TrimPrefix(r.URL.Path, phoneHomePath)
+	if err := v.virtTool.NotifyBootReady(containerID); err != nil {
+		glog.V(2).Infof("Phone home request: %v", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+}
+
 // recoverAndGC performs the initial actions during VirtletManager
 // startup, including recovering network namespaces and performing
 // garbage collection for both libvirt and the image store.
@@ -19,6 +19,8 @@ package manager
 import (
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	cnitypes "github.com/containernetworking/cni/pkg/types"
@@ -26,6 +28,8 @@ import (
 	"github.com/golang/glog"
 	"github.com/jonboulle/clockwork"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
 	"github.com/Mirantis/virtlet/pkg/cni"
@@ -51,14 +55,32 @@ type GCHandler interface {
 	GC() error
 }
 
+// NetworkDetachOrder specifies whether the pod network is released
+// before or after the VMs of the pod are destroyed by StopPodSandbox
+type NetworkDetachOrder string
+
+const (
+	// NetworkDetachAfterDestroy means that the VMs are destroyed
+	// before the tap interfaces are removed from the pod netns
+	// and the pod is removed from the CNI network. This is the
+	// default order.
+	NetworkDetachAfterDestroy NetworkDetachOrder = "destroy-first"
+	// NetworkDetachBeforeDestroy means that the pod network is
+	// torn down while the VMs are still running. It can be used
+	// with the CNI plugins that need the tap interfaces to be
+	// still in use during the teardown.
+	NetworkDetachBeforeDestroy NetworkDetachOrder = "detach-first"
+)
+
 // VirtletRuntimeService handles CRI runtime service calls.
 type VirtletRuntimeService struct {
-	virtTool      *libvirttools.VirtualizationTool
-	metadataStore metadata.Store
-	fdManager     tapmanager.FDManager
-	streamServer  StreamServer
-	gcHandler     GCHandler
-	clock         clockwork.Clock
+	virtTool           *libvirttools.VirtualizationTool
+	metadataStore      metadata.Store
+	fdManager          tapmanager.FDManager
+	streamServer       StreamServer
+	gcHandler          GCHandler
+	clock              clockwork.Clock
+	networkDetachOrder NetworkDetachOrder
 }
 
 // NewVirtletRuntimeService returns a new instance of VirtletRuntimeService.
@@ -73,15 +95,31 @@ func NewVirtletRuntimeService(
 		clock = clockwork.NewRealClock()
 	}
 	return &VirtletRuntimeService{
-		virtTool:      virtTool,
-		metadataStore: metadataStore,
-		fdManager:     fdManager,
-		streamServer:  streamServer,
-		gcHandler:     gcHandler,
-		clock:         clock,
+		virtTool:           virtTool,
+		metadataStore:      metadataStore,
+		fdManager:          fdManager,
+		streamServer:       streamServer,
+		gcHandler:          gcHandler,
+		clock:              clock,
+		networkDetachOrder: NetworkDetachAfterDestroy,
 	}
 }
 
+// SetNetworkDetachOrder sets the order in which StopPodSandbox
+// destroys the VMs that are still running in the pod and releases
+// the pod network. Empty value means NetworkDetachAfterDestroy.
+func (v *VirtletRuntimeService) SetNetworkDetachOrder(order NetworkDetachOrder) error {
+	switch order {
+	case "":
+		order = NetworkDetachAfterDestroy
+	case NetworkDetachAfterDestroy, NetworkDetachBeforeDestroy:
+	default:
+		return fmt.Errorf("bad network detach order %q. Must be either %q or %q", order, NetworkDetachAfterDestroy, NetworkDetachBeforeDestroy)
+	}
+	v.networkDetachOrder = order
+	return nil
+}
+
 // Version implements Version method of CRI.
 func (v *VirtletRuntimeService) Version(ctx context.Context, in *kubeapi.VersionRequest) (*kubeapi.VersionResponse, error) {
 	vRuntimeAPIVersion := runtimeAPIVersion
@@ -129,9 +167,10 @@ func (v *VirtletRuntimeService) RunPodSandbox(ctx context.Context, in *kubeapi.R
 
 	state := kubeapi.PodSandboxState_SANDBOX_READY
 	pnd := &tapmanager.PodNetworkDesc{
-		PodID:   podID,
-		PodNs:   podNs,
-		PodName: podName,
+		PodID:            podID,
+		PodNs:            podNs,
+		PodName:          podName,
+		PrimaryInterface: libvirttools.PrimaryInterfaceName(config.Annotations),
 	}
 	// Mimic kubelet's method of handling nameservers.
 	// As of k8s 1.5.2, kubelet doesn't use any nameserver information from CNI.
@@ -196,6 +235,12 @@ func (v *VirtletRuntimeService) StopPodSandbox(ctx context.Context, in *kubeapi.
 	}
 	status := sandboxInfo.AsPodSandboxStatus()
 
+	if v.networkDetachOrder == NetworkDetachAfterDestroy {
+		if err := v.destroyPodVMs(in.PodSandboxId); err != nil {
+			return nil, err
+		}
+	}
+
 	// check if the sandbox is already stopped
 	if status.State != kubeapi.PodSandboxState_SANDBOX_NOTREADY {
 		if err := sandbox.Save(
@@ -215,10 +260,43 @@ func (v *VirtletRuntimeService) StopPodSandbox(ctx context.Context, in *kubeapi.
 		}
 	}
 
+	// The VMs are destroyed even if the sandbox is already stopped
+	// so a retried StopPodSandbox call doesn't leave them running
+	if v.networkDetachOrder == NetworkDetachBeforeDestroy {
+		if err := v.destroyPodVMs(in.PodSandboxId); err != nil {
+			return nil, err
+		}
+	}
+
 	response := &kubeapi.StopPodSandboxResponse{}
 	return response, nil
 }
 
+// destroyPodVMs destroys the VMs of the pod that weren't stopped
+// by StopContainer before StopPodSandbox call
+func (v *VirtletRuntimeService) destroyPodVMs(podSandboxID string) error {
+	containers, err := v.metadataStore.ListPodContainers(podSandboxID)
+	if err != nil {
+		return fmt.Errorf("error listing containers of the pod %q: %v", podSandboxID, err)
+	}
+	for _, container := range containers {
+		containerID := container.GetID()
+		status, err := v.virtTool.ContainerStatus(containerID)
+		if err != nil {
+			glog.Warningf("Can't get the status of container %q of the pod %q: %v", containerID, podSandboxID, err)
+			continue
+		}
+		if status.State != kubeapi.ContainerState_CONTAINER_RUNNING {
+			continue
+		}
+		glog.V(2).Infof("StopPodSandbox: destroying the VM of container %q of the pod %q", containerID, podSandboxID)
+		if err := v.virtTool.StopContainer(containerID, 0); err != nil {
+			return fmt.Errorf("error destroying the VM of container %q of the pod %q: %v", containerID, podSandboxID, err)
+		}
+	}
+	return nil
+}
+
 // RemovePodSandbox method implements RemovePodSandbox from CRI.
 func (v *VirtletRuntimeService) RemovePodSandbox(ctx context.Context, in *kubeapi.RemovePodSandboxRequest) (*kubeapi.RemovePodSandboxResponse, error) {
 	podSandboxID := in.PodSandboxId
@@ -329,6 +407,17 @@ func (v *VirtletRuntimeService) CreateContainer(ctx context.Context, in *kubeapi
 	uuid, err := v.virtTool.CreateContainer(vmConfig, fdKey)
 	if err != nil {
 		glog.Errorf("Error creating container %s: %v", name, err)
+		switch {
+		case libvirttools.IsInsufficientStorage(err):
+			// let kubelet tell this case from the other errors
+			return nil, grpc.Errorf(codes.ResourceExhausted, "%v", err)
+		case libvirttools.IsVolumeNotReady(err):
+			return nil, grpc.Errorf(codes.Unavailable, "%v", err)
+		case libvirttools.IsBadMount(err):
+			return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+		case libvirttools.IsVolumeConflict(err), libvirttools.IsPCIDeviceConflict(err):
+			return nil, grpc.Errorf(codes.FailedPrecondition, "%v", err)
+		}
 		return nil, err
 	}
 
@@ -346,6 +435,9 @@ func (v *VirtletRuntimeService) StartContainer(ctx context.Context, in *kubeapi.
 	}
 
 	if err := v.virtTool.StartContainer(in.ContainerId); err != nil {
+		if libvirttools.IsBootSlotUnavailable(err) {
+			return nil, grpc.Errorf(codes.Unavailable, "%v", err)
+		}
 		return nil, err
 	}
 	response := &kubeapi.StartContainerResponse{}
@@ -394,9 +486,78 @@ func (v *VirtletRuntimeService) ContainerStatus(ctx context.Context, in *kubeapi
 	}
 
 	response := &kubeapi.ContainerStatusResponse{Status: status}
+	if in.Verbose {
+		info := make(map[string]string)
+		if bootDuration, err := v.virtTool.ContainerBootDuration(in.ContainerId); err != nil {
+			glog.Warningf("Can't get boot duration of container %q: %v", in.ContainerId, err)
+		} else if bootDuration != 0 {
+			info["bootDuration"] = bootDuration.String()
+		}
+		if status.State == kubeapi.ContainerState_CONTAINER_RUNNING {
+			v.addGuestInfo(info, in.ContainerId)
+			v.addBlockJobs(info, in.ContainerId)
+			v.addHostUsage(info, in.ContainerId)
+		}
+		if len(info) != 0 {
+			response.Info = info
+		}
+	}
 	return response, nil
 }
 
+// addGuestInfo adds the information about the guest OS reported
+// by the guest agent to the verbose container status info
+func (v *VirtletRuntimeService) addGuestInfo(info map[string]string, containerID string) {
+	guestInfo, err := v.virtTool.GuestInfo(containerID)
+	if err != nil {
+		if err != libvirttools.ErrGuestAgentUnavailable {
+			glog.Warningf("Can't get guest info of container %q: %v", containerID, err)
+		}
+		info["guestAgent"] = "unavailable"
+		return
+	}
+	info["guestAgent"] = "available"
+	info["guestHostname"] = guestInfo.Hostname
+	info["guestOSName"] = guestInfo.OSName
+	info["guestOSVersion"] = guestInfo.OSVersion
+	info["guestKernelRelease"] = guestInfo.KernelRelease
+	info["guestUptime"] = guestInfo.Uptime.String()
+}
+
+// addBlockJobs adds the progress of the block jobs running on the
+// disks of the VM, if any, to the verbose container status info
+func (v *VirtletRuntimeService) addBlockJobs(info map[string]string, containerID string) {
+	jobs, err := v.virtTool.BlockJobs(containerID)
+	if err != nil {
+		glog.Warningf("Can't get block jobs of container %q: %v", containerID, err)
+		return
+	}
+	if len(jobs) == 0 {
+		return
+	}
+	descs := make([]string, len(jobs))
+	for n, job := range jobs {
+		descs[n] = job.String()
+	}
+	info["blockJobs"] = strings.Join(descs, ", ")
+}
+
+// addHostUsage adds the CPU time and the memory used by the
+// hypervisor process of the VM as a whole, as well as its overhead
+// compared to the usage of the guest, to the verbose container
+// status info
+func (v *VirtletRuntimeService) addHostUsage(info map[string]string, containerID string) {
+	usage, err := v.virtTool.HostUsage(containerID)
+	if err != nil {
+		glog.Warningf("Can't get host usage of container %q: %v", containerID, err)
+		return
+	}
+	info["hostCPUTime"] = time.Duration(usage.CPUTime).String()
+	info["hostMemoryUsage"] = strconv.FormatUint(usage.MemoryUsage, 10)
+	info["hostCPUOverhead"] = time.Duration(usage.CPUOverhead).String()
+	info["hostMemoryOverhead"] = strconv.FormatUint(usage.MemoryOverhead, 10)
+}
+
 // ExecSync is a placeholder for an unimplemented CRI method.
 func (v *VirtletRuntimeService) ExecSync(context.Context, *kubeapi.ExecSyncRequest) (*kubeapi.ExecSyncResponse, error) {
 	return nil, errors.New("not implemented")
@@ -435,10 +596,24 @@ func (v *VirtletRuntimeService) UpdateContainerResources(context.Context, *kubea
 }
 
 // Status method implements Status from CRI for both types of service, Image and Runtime.
-func (v *VirtletRuntimeService) Status(context.Context, *kubeapi.StatusRequest) (*kubeapi.StatusResponse, error) {
+func (v *VirtletRuntimeService) Status(ctx context.Context, in *kubeapi.StatusRequest) (*kubeapi.StatusResponse, error) {
 	ready := true
 	runtimeReadyStr := kubeapi.RuntimeReady
 	networkReadyStr := kubeapi.NetworkReady
+	var info map[string]string
+	if in.Verbose {
+		// the versions are cached by virtTool, so this doesn't
+		// make kubelet's periodic status calls any slower
+		if hvInfo, err := v.virtTool.HypervisorInfo(); err != nil {
+			glog.Warningf("Can't get hypervisor info: %v", err)
+		} else {
+			info = map[string]string{
+				"libvirtVersion": hvInfo.LibvirtVersion,
+				"qemuVersion":    hvInfo.QEMUVersion,
+				"kvmAvailable":   strconv.FormatBool(hvInfo.KVMAvailable),
+			}
+		}
+	}
 	return &kubeapi.StatusResponse{
 		Status: &kubeapi.RuntimeStatus{
 			Conditions: []*kubeapi.RuntimeCondition{
@@ -452,17 +627,26 @@ func (v *VirtletRuntimeService) Status(context.Context, *kubeapi.StatusRequest)
 				},
 			},
 		},
+		Info: info,
 	}, nil
 }
 
-// ContainerStats is a placeholder for an unimplemented CRI method.
+// ContainerStats method implements ContainerStats from CRI.
 func (v *VirtletRuntimeService) ContainerStats(ctx context.Context, in *kubeapi.ContainerStatsRequest) (*kubeapi.ContainerStatsResponse, error) {
-	return nil, errors.New("ContainerStats() not implemented")
+	stats, err := v.virtTool.ContainerStats(in.ContainerId)
+	if err != nil {
+		return nil, err
+	}
+	return &kubeapi.ContainerStatsResponse{Stats: stats}, nil
 }
 
-// ListContainerStats is a placeholder for an unimplemented CRI method.
+// ListContainerStats method implements ListContainerStats from CRI.
 func (v *VirtletRuntimeService) ListContainerStats(ctx context.Context, in *kubeapi.ListContainerStatsRequest) (*kubeapi.ListContainerStatsResponse, error) {
-	return nil, errors.New("ListContainerStats() not implemented")
+	stats, err := v.virtTool.ListContainerStats(in.Filter)
+	if err != nil {
+		return nil, err
+	}
+	return &kubeapi.ListContainerStatsResponse{Stats: stats}, nil
 }
 
 func validatePodSandboxConfig(config *kubeapi.PodSandboxConfig) error {
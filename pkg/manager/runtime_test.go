@@ -229,7 +229,10 @@ func makeVirtletCRITester(t *testing.T) *virtletCRITester {
 	domainConn := fakevirt.NewFakeDomainConnection(rec.Child("domain conn"))
 	storageConn := fakevirt.NewFakeStorageConnection(rec.Child("storage"))
 	clock := clockwork.NewFakeClockAt(time.Unix(0, podTimestap))
-	virtTool := libvirttools.NewVirtualizationTool(domainConn, storageConn, imageStore, metadataStore, "volumes", "loop*", libvirttools.GetDefaultVolumeSource())
+	virtTool := libvirttools.NewVirtualizationTool(domainConn, storageConn, imageStore, metadataStore, "volumes", libvirttools.GetDefaultVolumeSource())
+	if err := virtTool.SetRawDevices(libvirttools.DefaultRawDevices); err != nil {
+		t.Fatalf("SetRawDevices(): %v", err)
+	}
 	virtTool.SetClock(clock)
 	// avoid unneeded diffs in the golden master data
 	virtTool.SetForceKVM(true)
@@ -492,6 +495,99 @@ func TestCRIPods(t *testing.T) {
 	tst.verify()
 }
 
+func TestStopPodSandboxNetworkDetachOrder(t *testing.T) {
+	for _, tc := range []struct {
+		order         NetworkDetachOrder
+		expectedCalls []string
+	}{
+		{
+			order:         "",
+			expectedCalls: []string{"Destroy", "ReleaseFDs"},
+		},
+		{
+			order:         NetworkDetachAfterDestroy,
+			expectedCalls: []string{"Destroy", "ReleaseFDs"},
+		},
+		{
+			order:         NetworkDetachBeforeDestroy,
+			expectedCalls: []string{"ReleaseFDs", "Destroy"},
+		},
+	} {
+		t.Run(string(tc.order), func(t *testing.T) {
+			tst := makeVirtletCRITester(t)
+			defer tst.teardown()
+			if err := tst.handler.SetNetworkDetachOrder(tc.order); err != nil {
+				t.Fatalf("SetNetworkDetachOrder(): %v", err)
+			}
+
+			sandboxes := criapi.GetSandboxes(1)
+			containers := criapi.GetContainersConfig(sandboxes)
+			tst.pullImage(cirrosImg())
+			tst.runPodSandbox(sandboxes[0])
+			containerID := tst.createContainer(sandboxes[0], containers[0], cirrosImg(), nil)
+			tst.startContainer(containerID)
+
+			start := len(tst.rec.Content())
+			// StopContainer is not called, so the VM is still running
+			tst.stopPodSandox(sandboxes[0].Metadata.Uid)
+			var calls []string
+			for _, r := range tst.rec.Content()[start:] {
+				switch {
+				case strings.HasPrefix(r.Name, "domain conn: ") && strings.HasSuffix(r.Name, ": Destroy"):
+					calls = append(calls, "Destroy")
+				case r.Name == "fdManager: ReleaseFDs":
+					calls = append(calls, "ReleaseFDs")
+				}
+			}
+			if !reflect.DeepEqual(calls, tc.expectedCalls) {
+				t.Errorf("bad call order: %v instead of %v", calls, tc.expectedCalls)
+			}
+
+			// the VM must not be destroyed again by a retried call
+			start = len(tst.rec.Content())
+			tst.stopPodSandox(sandboxes[0].Metadata.Uid)
+			for _, r := range tst.rec.Content()[start:] {
+				if strings.HasSuffix(r.Name, ": Destroy") || r.Name == "fdManager: ReleaseFDs" {
+					t.Errorf("unexpected %q call after the pod sandbox has been stopped", r.Name)
+				}
+			}
+		})
+	}
+
+	tst := makeVirtletCRITester(t)
+	defer tst.teardown()
+	if err := tst.handler.SetNetworkDetachOrder("whatever"); err == nil {
+		t.Errorf("SetNetworkDetachOrder() didn't fail for a bad order")
+	}
+}
+
+func TestStatusHypervisorInfo(t *testing.T) {
+	tst := makeVirtletCRITester(t)
+	defer tst.teardown()
+
+	resp, err := tst.handler.Status(context.Background(), &kubeapi.StatusRequest{})
+	if err != nil {
+		t.Fatalf("Status(): %v", err)
+	}
+	if resp.Info != nil {
+		t.Errorf("unexpected info in non-verbose status response: %#v", resp.Info)
+	}
+
+	resp, err = tst.handler.Status(context.Background(), &kubeapi.StatusRequest{Verbose: true})
+	if err != nil {
+		t.Fatalf("Status(): %v", err)
+	}
+	// the versions are the defaults of the fake domain connection
+	expectedInfo := map[string]string{
+		"libvirtVersion": "4.0.0",
+		"qemuVersion":    "2.11.1",
+		"kvmAvailable":   "true",
+	}
+	if !reflect.DeepEqual(resp.Info, expectedInfo) {
+		t.Errorf("bad status info: %#v instead of %#v", resp.Info, expectedInfo)
+	}
+}
+
 func TestRunPodSandboxWithFailingCNI(t *testing.T) {
 	tst := makeVirtletCRITester(t)
 	defer tst.teardown()
@@ -169,7 +169,8 @@ func (b *boltClient) ListPodContainers(podID string) ([]ContainerMetadata, error
 }
 
 // ImagesInUse returns a set of images in use by containers in the store.
-// The keys of the returned map are image names and the values are always true.
+// The keys of the returned map are image names and the digests of the
+// image data backing the root volumes. The values are always true.
 func (b *boltClient) ImagesInUse() (map[string]bool, error) {
 	result := make(map[string]bool)
 	if err := b.db.View(func(tx *bolt.Tx) error {
@@ -188,6 +189,9 @@ func (b *boltClient) ImagesInUse() (map[string]bool, error) {
 					return fmt.Errorf("containerInfo of container %q not found in Virtlet metadata store", containerMeta.GetID())
 				}
 				result[ci.Image] = true
+				if ci.ImageDigest != "" {
+					result[ci.ImageDigest] = true
+				}
 			}
 		}
 		return nil
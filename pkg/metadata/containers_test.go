@@ -63,7 +63,18 @@ func TestGetImagesInUse(t *testing.T) {
 
 	store := setUpTestStore(t, sandboxes, containers, nil)
 
-	expectedImagesInUse := map[string]bool{"testImage": true}
+	// the image data backing the root volume may no longer be
+	// pointed to by the image name
+	const imageDigest = "sha256:0fa6fc2f3e0d4bbf1c5ab2a4ee1ec9c24a5f7e4b9e6ed29b74f34e3a6cbd14ad"
+	if err := store.Container(containers[0].ContainerId).Save(
+		func(c *ContainerInfo) (*ContainerInfo, error) {
+			c.ImageDigest = imageDigest
+			return c, nil
+		}); err != nil {
+		t.Fatalf("Save(): %v", err)
+	}
+
+	expectedImagesInUse := map[string]bool{"testImage": true, imageDigest: true}
 	imagesInUse, err := store.ImagesInUse()
 	if err != nil {
 		t.Fatalf("ImagesInUse(): %v", err)
@@ -101,3 +112,53 @@ func TestRemoveContainer(t *testing.T) {
 		}
 	}
 }
+
+func TestTombstones(t *testing.T) {
+	store := setUpTestStore(t, nil, nil, nil)
+
+	if tombstone, err := store.Tombstone("abc"); err != nil {
+		t.Fatalf("Tombstone(): %v", err)
+	} else if tombstone != nil {
+		t.Errorf("unexpected tombstone in an empty store: %#v", tombstone)
+	}
+
+	tombstones := map[string]*ContainerTombstone{
+		"abc": {
+			ContainerInfo: ContainerInfo{Name: "container1", SandboxID: "pod1", Attempt: 1},
+			RemovedAt:     1000,
+			LogPath:       "/var/log/pods/pod1/container1_1.log",
+		},
+		"def": {
+			ContainerInfo: ContainerInfo{Name: "container2", SandboxID: "pod2"},
+			RemovedAt:     2000,
+		},
+	}
+	for id, tombstone := range tombstones {
+		if err := store.SaveTombstone(id, tombstone); err != nil {
+			t.Fatalf("SaveTombstone(): %v", err)
+		}
+	}
+	tombstone, err := store.Tombstone("abc")
+	if err != nil {
+		t.Fatalf("Tombstone(): %v", err)
+	}
+	if !reflect.DeepEqual(tombstone, tombstones["abc"]) {
+		t.Errorf("bad tombstone %#v instead of %#v", tombstone, tombstones["abc"])
+	}
+
+	if err := store.RemoveTombstone("abc"); err != nil {
+		t.Fatalf("RemoveTombstone(): %v", err)
+	}
+	// removing a nonexistent tombstone is not an error
+	if err := store.RemoveTombstone("abc"); err != nil {
+		t.Fatalf("RemoveTombstone(): %v", err)
+	}
+	delete(tombstones, "abc")
+	listed, err := store.ListTombstones()
+	if err != nil {
+		t.Fatalf("ListTombstones(): %v", err)
+	}
+	if !reflect.DeepEqual(listed, tombstones) {
+		t.Errorf("bad tombstone list %#v instead of %#v", listed, tombstones)
+	}
+}
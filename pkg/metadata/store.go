@@ -107,6 +107,80 @@ type ContainerInfo struct {
 	Annotations         map[string]string
 	Attempt             uint32
 	State               kubeapi.ContainerState
+	// SavedStatePath is the path to the file that contains the
+	// saved state of the VM including its memory. Empty value
+	// means that the VM state isn't saved.
+	SavedStatePath string
+	// ImageDigest is the digest of the image data which is used
+	// as the backing file of the root volume, e.g. sha256:<hex>.
+	// Image name may no longer point to this data if the image
+	// was pulled again, but the data must be kept as long as the
+	// root volume exists.
+	ImageDigest string
+	// Environment and Mounts hold the environment variables and
+	// the mounts of the container that are needed to generate
+	// the config ISO of the VM again
+	Environment []KeyValue
+	Mounts      []Mount
+	// ConfigAnnotationsHash is the hash of the pod and container
+	// annotations the config ISO of the VM was generated for
+	ConfigAnnotationsHash string
+	// RestartPolicy is the restart policy of the VM, which
+	// determines whether Virtlet restarts the VM after a crash.
+	// Empty value means that the VM isn't restarted by Virtlet.
+	RestartPolicy string
+	// RestartCount is the number of times the VM was restarted
+	// by Virtlet after a crash
+	RestartCount int
+	// LastRestartAt is the time of the last restart of the VM
+	// after a crash
+	LastRestartAt int64
+	// BootDuration is the time in nanoseconds it took the guest
+	// OS to become ready after the last start of the VM. Zero
+	// value means that the boot time is not known.
+	BootDuration int64
+	// ReadonlyRootfs is true if the root disk of the VM is
+	// attached read-only with the mutable paths of the guest
+	// placed on the writable rootfs overlay volume
+	ReadonlyRootfs bool
+	// QOSClass is the Kubernetes QoS class of the pod as derived
+	// from the CRI resources of the container, e.g. Guaranteed
+	QOSClass string
+	// GuestShutdown is true if the VM was powered off by the
+	// guest OS while the container was running, without
+	// StopContainer being called
+	GuestShutdown bool
+	// Snapshots lists the snapshots of the VM in the order of
+	// their creation
+	Snapshots []SnapshotInfo
+	// FromWarmPool is true if the container uses an already
+	// running VM taken from the warm pool and StartContainer
+	// wasn't called for it yet
+	FromWarmPool bool
+}
+
+// SnapshotInfo describes a snapshot of the disks and the memory
+// of a VM
+type SnapshotInfo struct {
+	// Name is the name of the snapshot
+	Name string
+	// Description is an optional description of the snapshot
+	Description string
+	// CreatedAt is the time of the creation of the snapshot
+	// in nanoseconds since the epoch
+	CreatedAt int64
+}
+
+// KeyValue denotes a key-value pair, e.g. an environment variable
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Mount denotes a host directory that's mounted into the VM
+type Mount struct {
+	ContainerPath string
+	HostPath      string
 }
 
 // ContainerMetadata contains methods of a single container (VM)
@@ -137,10 +211,41 @@ type ContainerStore interface {
 	ImagesInUse() (map[string]bool, error)
 }
 
+// ContainerTombstone contains the information about a removed
+// container that's kept for a while after the removal, so the
+// status of the container can still be queried
+type ContainerTombstone struct {
+	ContainerInfo
+	// RemovedAt is the time the container was removed
+	RemovedAt int64
+	// LogPath is the path to the log file of the container
+	LogPath string
+}
+
+// TombstoneStore contains methods to operate on the tombstones of
+// the removed containers
+type TombstoneStore interface {
+	// SaveTombstone stores the tombstone of the container with
+	// given ID, replacing the existing one, if any
+	SaveTombstone(containerID string, tombstone *ContainerTombstone) error
+
+	// Tombstone returns the tombstone of the container with given ID
+	// or nil if there's no such tombstone
+	Tombstone(containerID string) (*ContainerTombstone, error)
+
+	// ListTombstones returns all the tombstones keyed by container IDs
+	ListTombstones() (map[string]*ContainerTombstone, error)
+
+	// RemoveTombstone removes the tombstone of the container with
+	// given ID. It's not an error if there's no such tombstone.
+	RemoveTombstone(containerID string) error
+}
+
 // Store provides single interface for metadata storage implementation
 type Store interface {
 	SandboxStore
 	ContainerStore
+	TombstoneStore
 	io.Closer
 }
 
@@ -0,0 +1,104 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/boltdb/bolt"
+)
+
+var tombstonesBucket = []byte("tombstones")
+
+// SaveTombstone stores the tombstone of the container with given ID,
+// replacing the existing one, if any
+func (b *boltClient) SaveTombstone(containerID string, tombstone *ContainerTombstone) error {
+	if containerID == "" {
+		return errors.New("Container ID cannot be empty")
+	}
+	data, err := json.Marshal(tombstone)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(tombstonesBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(containerID), data)
+	})
+}
+
+// Tombstone returns the tombstone of the container with given ID
+// or nil if there's no such tombstone
+func (b *boltClient) Tombstone(containerID string) (*ContainerTombstone, error) {
+	if containerID == "" {
+		return nil, errors.New("Container ID cannot be empty")
+	}
+	var tombstone *ContainerTombstone
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tombstonesBucket)
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(containerID))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &tombstone)
+	})
+	return tombstone, err
+}
+
+// ListTombstones returns all the tombstones keyed by container IDs
+func (b *boltClient) ListTombstones() (map[string]*ContainerTombstone, error) {
+	tombstones := make(map[string]*ContainerTombstone)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tombstonesBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var tombstone *ContainerTombstone
+			if err := json.Unmarshal(v, &tombstone); err != nil {
+				return err
+			}
+			tombstones[string(k)] = tombstone
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tombstones, nil
+}
+
+// RemoveTombstone removes the tombstone of the container with given
+// ID. It's not an error if there's no such tombstone.
+func (b *boltClient) RemoveTombstone(containerID string) error {
+	if containerID == "" {
+		return errors.New("Container ID cannot be empty")
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tombstonesBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(containerID))
+	})
+}
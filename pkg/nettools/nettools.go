@@ -364,6 +364,97 @@ func ValidateAndFixCNIResult(netConfig *cnicurrent.Result, nsPath string, allLin
 	return netConfig, nil
 }
 
+// SetPrimaryInterface reorders the interfaces and IP configs in
+// netConfig so that the interface with the specified name comes
+// first and thus becomes the first NIC of the VM. The default routes
+// with gateways that aren't reachable via this interface are
+// dropped, and the default routes with empty gateways get the
+// gateway of the interface. There must be exactly one default
+// gateway per IP version on the interface after that.
+func SetPrimaryInterface(netConfig *cnicurrent.Result, ifaceName string) error {
+	primary := -1
+	for i, iface := range netConfig.Interfaces {
+		if iface.Name == ifaceName && iface.Sandbox != "" {
+			primary = i
+			break
+		}
+	}
+	if primary < 0 {
+		return fmt.Errorf("primary interface %q not found in the pod network namespace", ifaceName)
+	}
+
+	newIndex := make([]int, len(netConfig.Interfaces))
+	ifaces := []*cnicurrent.Interface{netConfig.Interfaces[primary]}
+	for i, iface := range netConfig.Interfaces {
+		if i != primary {
+			newIndex[i] = len(ifaces)
+			ifaces = append(ifaces, iface)
+		}
+	}
+	netConfig.Interfaces = ifaces
+
+	var primaryIPs []*cnicurrent.IPConfig
+	for _, ipConfig := range netConfig.IPs {
+		if ipConfig.Interface < 0 || ipConfig.Interface >= len(newIndex) {
+			continue
+		}
+		ipConfig.Interface = newIndex[ipConfig.Interface]
+		if ipConfig.Interface == 0 {
+			primaryIPs = append(primaryIPs, ipConfig)
+		}
+	}
+	if len(primaryIPs) == 0 {
+		return fmt.Errorf("primary interface %q has no IP addresses", ifaceName)
+	}
+	sort.SliceStable(netConfig.IPs, func(i, j int) bool {
+		return netConfig.IPs[i].Interface == 0 && netConfig.IPs[j].Interface != 0
+	})
+
+	var routes []*cnitypes.Route
+	defaultGateways := make(map[string][]string)
+	for _, route := range netConfig.Routes {
+		if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+			routes = append(routes, route)
+			continue
+		}
+		version := "4"
+		if route.Dst.IP.To4() == nil {
+			version = "6"
+		}
+		var gw net.IP
+		for _, ipConfig := range primaryIPs {
+			if ipConfig.Version != version {
+				continue
+			}
+			if route.GW == nil {
+				gw = ipConfig.Gateway
+			} else if ipConfig.Address.Contains(route.GW) {
+				gw = route.GW
+			}
+			if gw != nil {
+				break
+			}
+		}
+		if gw == nil {
+			glog.V(3).Infof("Dropping default route %s via %q: it's not on the primary interface %q", route.Dst.String(), route.GW, ifaceName)
+			continue
+		}
+		routes = append(routes, &cnitypes.Route{Dst: route.Dst, GW: gw})
+		defaultGateways[version] = append(defaultGateways[version], gw.String())
+	}
+	if len(defaultGateways) == 0 {
+		return fmt.Errorf("no default gateway found on the primary interface %q", ifaceName)
+	}
+	for version, gws := range defaultGateways {
+		if len(gws) > 1 {
+			return fmt.Errorf("more than one IPv%s default gateway on the primary interface %q: %s", version, ifaceName, strings.Join(gws, ", "))
+		}
+	}
+	netConfig.Routes = routes
+
+	return nil
+}
+
 // GetContainerLinks finds links that correspond to interfaces in the current
 // network namespace
 func GetContainerLinks(info *cnicurrent.Result) ([]netlink.Link, error) {
@@ -804,3 +804,129 @@ func TestFixCalicoNetworking(t *testing.T) {
 		})
 	})
 }
+
+func twoNetworksCNIResult() *cnicurrent.Result {
+	defaultDst := net.IPNet{
+		IP:   net.IP{0, 0, 0, 0},
+		Mask: net.IPMask{0, 0, 0, 0},
+	}
+	return &cnicurrent.Result{
+		Interfaces: []*cnicurrent.Interface{
+			{
+				Name:    "eth0",
+				Mac:     innerHwAddr,
+				Sandbox: "/var/run/netns/foo",
+			},
+			{
+				Name:    "eth1",
+				Mac:     secondInnerHwAddr,
+				Sandbox: "/var/run/netns/foo",
+			},
+		},
+		IPs: []*cnicurrent.IPConfig{
+			{
+				Version:   "4",
+				Interface: 0,
+				Address: net.IPNet{
+					IP:   net.IP{10, 1, 90, 5},
+					Mask: net.IPMask{255, 255, 255, 0},
+				},
+				Gateway: net.IP{10, 1, 90, 1},
+			},
+			{
+				Version:   "4",
+				Interface: 1,
+				Address: net.IPNet{
+					IP:   net.IP{10, 2, 90, 5},
+					Mask: net.IPMask{255, 255, 255, 0},
+				},
+				Gateway: net.IP{10, 2, 90, 1},
+			},
+		},
+		Routes: []*cnitypes.Route{
+			{
+				Dst: defaultDst,
+				GW:  net.IP{10, 1, 90, 1},
+			},
+			{
+				Dst: net.IPNet{
+					IP:   net.IP{10, 10, 0, 0},
+					Mask: net.IPMask{255, 255, 0, 0},
+				},
+				GW: net.IP{10, 1, 90, 1},
+			},
+			{
+				Dst: defaultDst,
+				GW:  net.IP{10, 2, 90, 1},
+			},
+		},
+	}
+}
+
+func TestSetPrimaryInterface(t *testing.T) {
+	netConfig := twoNetworksCNIResult()
+	if err := SetPrimaryInterface(netConfig, "eth1"); err != nil {
+		t.Fatalf("SetPrimaryInterface(): %v", err)
+	}
+
+	expectedInfo := twoNetworksCNIResult()
+	expectedInfo.Interfaces[0], expectedInfo.Interfaces[1] = expectedInfo.Interfaces[1], expectedInfo.Interfaces[0]
+	expectedInfo.IPs[0], expectedInfo.IPs[1] = expectedInfo.IPs[1], expectedInfo.IPs[0]
+	expectedInfo.IPs[0].Interface = 0
+	expectedInfo.IPs[1].Interface = 1
+	// the default route via eth0 is dropped
+	expectedInfo.Routes = expectedInfo.Routes[1:]
+	if !reflect.DeepEqual(netConfig, expectedInfo) {
+		t.Errorf("result different than expected:\nActual:\n%s\nExpected:\n%s",
+			spew.Sdump(netConfig), spew.Sdump(expectedInfo))
+	}
+
+	// the default route with empty gateway gets the gateway
+	// of the primary interface
+	netConfig = twoNetworksCNIResult()
+	netConfig.Routes = []*cnitypes.Route{{Dst: netConfig.Routes[0].Dst}}
+	if err := SetPrimaryInterface(netConfig, "eth1"); err != nil {
+		t.Fatalf("SetPrimaryInterface(): %v", err)
+	}
+	if len(netConfig.Routes) != 1 || !netConfig.Routes[0].GW.Equal(net.IP{10, 2, 90, 1}) {
+		t.Errorf("bad routes:\n%s", spew.Sdump(netConfig.Routes))
+	}
+
+	for _, tc := range []struct {
+		name      string
+		ifaceName string
+		fix       func(netConfig *cnicurrent.Result)
+	}{
+		{
+			name:      "unknown interface",
+			ifaceName: "eth2",
+		},
+		{
+			name:      "no default gateway on the interface",
+			ifaceName: "eth1",
+			fix: func(netConfig *cnicurrent.Result) {
+				netConfig.Routes = netConfig.Routes[:2]
+			},
+		},
+		{
+			name:      "more than one default gateway on the interface",
+			ifaceName: "eth1",
+			fix: func(netConfig *cnicurrent.Result) {
+				netConfig.Routes = append(netConfig.Routes, &cnitypes.Route{
+					Dst: netConfig.Routes[0].Dst,
+					GW:  net.IP{10, 2, 90, 2},
+				})
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			netConfig := twoNetworksCNIResult()
+			if tc.fix != nil {
+				tc.fix(netConfig)
+			}
+			if err := SetPrimaryInterface(netConfig, tc.ifaceName); err == nil {
+				t.Errorf("SetPrimaryInterface() didn't fail")
+			}
+		})
+	}
+}
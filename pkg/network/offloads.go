@@ -0,0 +1,155 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AllNICs is used as NICIndex of NICOffloadSetting that
+// applies to all of the NICs of the VM
+const AllNICs = -1
+
+// nicOffloadProperties maps the offload feature names, which
+// follow the attributes of host and guest elements of libvirt
+// interface driver definition, to the corresponding properties
+// of virtio-net-pci qemu device
+var nicOffloadProperties = []struct {
+	name, prop string
+}{
+	{"host.csum", "csum"},
+	{"host.gso", "gso"},
+	{"host.tso4", "host_tso4"},
+	{"host.tso6", "host_tso6"},
+	{"host.ecn", "host_ecn"},
+	{"host.ufo", "host_ufo"},
+	{"host.mrg_rxbuf", "mrg_rxbuf"},
+	{"guest.csum", "guest_csum"},
+	{"guest.tso4", "guest_tso4"},
+	{"guest.tso6", "guest_tso6"},
+	{"guest.ecn", "guest_ecn"},
+	{"guest.ufo", "guest_ufo"},
+}
+
+// NICOffloadSetting enables or disables an offload feature
+// of virtio NICs
+type NICOffloadSetting struct {
+	// NICIndex is the index of the NIC the setting is applied
+	// to, or AllNICs
+	NICIndex int
+	// Name is the name of the offload feature, e.g. "host.tso4"
+	Name string
+	// Enabled specifies whether the feature is enabled
+	Enabled bool
+}
+
+func isValidNICOffload(name string) bool {
+	for _, p := range nicOffloadProperties {
+		if p.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNICOffloads parses a comma-separated list of NIC offload
+// feature settings in the form of [<nic-index>:]<name>=<on|off>,
+// e.g. "host.tso4=off,host.tso6=off,1:guest.csum=off". If NIC index
+// is omitted, the setting is applied to all of the NICs.
+func ParseNICOffloads(s string) ([]NICOffloadSetting, error) {
+	var r []NICOffloadSetting
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad NIC offload setting %q: must be [<nic-index>:]<name>=<on|off>", item)
+		}
+		setting := NICOffloadSetting{NICIndex: AllNICs, Name: strings.TrimSpace(parts[0])}
+		if colonPos := strings.Index(setting.Name, ":"); colonPos >= 0 {
+			n, err := strconv.Atoi(setting.Name[:colonPos])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("bad NIC index in the offload setting %q", item)
+			}
+			setting.NICIndex = n
+			setting.Name = setting.Name[colonPos+1:]
+		}
+		if !isValidNICOffload(setting.Name) {
+			return nil, fmt.Errorf("unknown NIC offload feature %q", setting.Name)
+		}
+		switch strings.TrimSpace(parts[1]) {
+		case "on":
+			setting.Enabled = true
+		case "off":
+			setting.Enabled = false
+		default:
+			return nil, fmt.Errorf("bad value of the NIC offload setting %q: must be either \"on\" or \"off\"", item)
+		}
+		r = append(r, setting)
+	}
+	return r, nil
+}
+
+// FormatNICOffloads converts the NIC offload settings to the
+// form accepted by ParseNICOffloads
+func FormatNICOffloads(settings []NICOffloadSetting) string {
+	var items []string
+	for _, setting := range settings {
+		value := "off"
+		if setting.Enabled {
+			value = "on"
+		}
+		item := setting.Name + "=" + value
+		if setting.NICIndex != AllNICs {
+			item = strconv.Itoa(setting.NICIndex) + ":" + item
+		}
+		items = append(items, item)
+	}
+	return strings.Join(items, ",")
+}
+
+// NICOffloadDeviceProperties returns the virtio-net-pci device
+// properties for the NIC with the specified index, e.g.
+// ",host_tso4=off,guest_csum=off". The settings are applied in
+// order, so the later ones override the earlier ones. Empty string
+// is returned if no settings apply to the NIC, which means using
+// the hypervisor defaults.
+func NICOffloadDeviceProperties(settings []NICOffloadSetting, nicIndex int) string {
+	values := make(map[string]bool)
+	for _, setting := range settings {
+		if setting.NICIndex == AllNICs || setting.NICIndex == nicIndex {
+			values[setting.Name] = setting.Enabled
+		}
+	}
+	var r string
+	for _, p := range nicOffloadProperties {
+		enabled, found := values[p.name]
+		if !found {
+			continue
+		}
+		value := "off"
+		if enabled {
+			value = "on"
+		}
+		r += fmt.Sprintf(",%s=%s", p.prop, value)
+	}
+	return r
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"testing"
+)
+
+func TestNICOffloads(t *testing.T) {
+	settingStr := "host.tso4=off,host.tso6=off,guest.csum=off,1:host.tso6=on,1:host.csum=off"
+	settings, err := ParseNICOffloads(settingStr)
+	if err != nil {
+		t.Fatalf("ParseNICOffloads(): %v", err)
+	}
+	if s := FormatNICOffloads(settings); s != settingStr {
+		t.Errorf("FormatNICOffloads(): %q instead of %q", s, settingStr)
+	}
+	for _, tc := range []struct {
+		nicIndex      int
+		expectedProps string
+	}{
+		{0, ",host_tso4=off,host_tso6=off,guest_csum=off"},
+		{1, ",csum=off,host_tso4=off,host_tso6=on,guest_csum=off"},
+	} {
+		if props := NICOffloadDeviceProperties(settings, tc.nicIndex); props != tc.expectedProps {
+			t.Errorf("bad device properties for NIC %d: %q instead of %q", tc.nicIndex, props, tc.expectedProps)
+		}
+	}
+	if props := NICOffloadDeviceProperties(nil, 0); props != "" {
+		t.Errorf("non-empty device properties without offload settings: %q", props)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stream
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reclaimedConsoleTTL is the time after which a reclaimed console
+// is forgotten if its VM doesn't try to reconnect
+const reclaimedConsoleTTL = time.Minute
+
+var (
+	openConsoles = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "virtlet",
+			Subsystem: "stream",
+			Name:      "open_consoles",
+			Help:      "Number of VM serial consoles that are being read and logged. Each console holds a socket and a log file open",
+		},
+	)
+	reclaimedConsoles = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "virtlet",
+			Subsystem: "stream",
+			Name:      "reclaimed_consoles_total",
+			Help:      "Number of VM serial consoles that stopped being read because of the open console limit",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(openConsoles, reclaimedConsoles)
+}
+
+type openConsole struct {
+	conn       io.Closer
+	lastActive time.Time
+}
+
+// consoleTracker keeps track of the open VM consoles and enforces
+// the limit on their number
+type consoleTracker struct {
+	sync.Mutex
+	clock     clockwork.Clock
+	max       int
+	consoles  map[string]*openConsole
+	reclaimed map[string]time.Time
+}
+
+func newConsoleTracker(clock clockwork.Clock) *consoleTracker {
+	return &consoleTracker{
+		clock:     clock,
+		consoles:  make(map[string]*openConsole),
+		reclaimed: make(map[string]time.Time),
+	}
+}
+
+// setMax sets the maximum number of open consoles. 0 means no limit.
+func (t *consoleTracker) setMax(max int) {
+	t.Lock()
+	defer t.Unlock()
+	t.max = max
+}
+
+// admit registers a new console connection of the specified
+// container. If the limit on the open consoles is reached, the
+// console that's been idle for the longest time is reclaimed and its
+// connection is returned so it can be closed. The consoles that were
+// reclaimed aren't admitted again until there's a free slot, so they
+// don't displace other consoles in turn. admit returns false if the
+// connection must not be used.
+func (t *consoleTracker) admit(containerID string, conn io.Closer) (io.Closer, bool) {
+	t.Lock()
+	defer t.Unlock()
+	defer t.updateMetric()
+
+	now := t.clock.Now()
+	for id, ts := range t.reclaimed {
+		if now.Sub(ts) > reclaimedConsoleTTL {
+			delete(t.reclaimed, id)
+		}
+	}
+
+	// a reconnecting VM reuses its slot
+	if _, found := t.consoles[containerID]; found || t.max <= 0 || len(t.consoles) < t.max {
+		t.consoles[containerID] = &openConsole{conn: conn, lastActive: now}
+		delete(t.reclaimed, containerID)
+		return nil, true
+	}
+
+	if _, found := t.reclaimed[containerID]; found {
+		t.reclaimed[containerID] = now
+		return nil, false
+	}
+
+	var victimID string
+	var victim *openConsole
+	for id, c := range t.consoles {
+		if victim == nil || c.lastActive.Before(victim.lastActive) {
+			victimID, victim = id, c
+		}
+	}
+	delete(t.consoles, victimID)
+	t.reclaimed[victimID] = now
+	reclaimedConsoles.Inc()
+
+	t.consoles[containerID] = &openConsole{conn: conn, lastActive: now}
+	return victim.conn, true
+}
+
+// touch updates the time of the last activity on the console
+func (t *consoleTracker) touch(containerID string) {
+	t.Lock()
+	defer t.Unlock()
+	if c, found := t.consoles[containerID]; found {
+		c.lastActive = t.clock.Now()
+	}
+}
+
+// release removes the console connection from the list of the open
+// consoles unless it was already replaced with another connection or
+// reclaimed. It returns false if the connection wasn't in the list.
+func (t *consoleTracker) release(containerID string, conn io.Closer) bool {
+	t.Lock()
+	defer t.Unlock()
+	if c, found := t.consoles[containerID]; found && c.conn == conn {
+		delete(t.consoles, containerID)
+		t.updateMetric()
+		return true
+	}
+	return false
+}
+
+// count returns the number of open consoles
+func (t *consoleTracker) count() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.consoles)
+}
+
+func (t *consoleTracker) updateMetric() {
+	openConsoles.Set(float64(len(t.consoles)))
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type fakeConsoleConn struct {
+	closed bool
+}
+
+func (c *fakeConsoleConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func openConsolesMetric(t *testing.T) float64 {
+	var m dto.Metric
+	if err := openConsoles.Write(&m); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func verifyOpenConsoles(t *testing.T, tracker *consoleTracker, expected int) {
+	if n := tracker.count(); n != expected {
+		t.Errorf("bad open console count: %d instead of %d", n, expected)
+	}
+	if v := openConsolesMetric(t); v != float64(expected) {
+		t.Errorf("bad open console metric value: %v instead of %d", v, expected)
+	}
+}
+
+func TestConsoleLimit(t *testing.T) {
+	clock := clockwork.NewFakeClockAt(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	tracker := newConsoleTracker(clock)
+	tracker.setMax(2)
+
+	conns := map[string]*fakeConsoleConn{}
+	admit := func(id string) (*fakeConsoleConn, bool) {
+		conn := &fakeConsoleConn{}
+		victim, ok := tracker.admit(id, conn)
+		if ok {
+			conns[id] = conn
+		}
+		if victim == nil {
+			return nil, ok
+		}
+		return victim.(*fakeConsoleConn), ok
+	}
+
+	for _, id := range []string{"vm1", "vm2"} {
+		if victim, ok := admit(id); !ok || victim != nil {
+			t.Fatalf("console of %s wasn't admitted without reclaiming other consoles", id)
+		}
+		clock.Advance(time.Second)
+	}
+	verifyOpenConsoles(t, tracker, 2)
+
+	// vm1 is more active than vm2
+	tracker.touch("vm1")
+	clock.Advance(time.Second)
+
+	victim, ok := admit("vm3")
+	switch {
+	case !ok:
+		t.Fatalf("console of vm3 wasn't admitted")
+	case victim != conns["vm2"]:
+		t.Errorf("the console of the least active VM wasn't reclaimed")
+	}
+	verifyOpenConsoles(t, tracker, 2)
+
+	// the reclaimed console doesn't displace other consoles
+	// when its VM reconnects
+	if _, ok := admit("vm2"); ok {
+		t.Errorf("reclaimed console was admitted while the limit is reached")
+	}
+	verifyOpenConsoles(t, tracker, 2)
+
+	// the stale connection of the reclaimed console doesn't
+	// release the slot of another one
+	tracker.release("vm2", victim)
+	verifyOpenConsoles(t, tracker, 2)
+
+	tracker.release("vm1", conns["vm1"])
+	verifyOpenConsoles(t, tracker, 1)
+	if victim, ok := admit("vm2"); !ok || victim != nil {
+		t.Errorf("reclaimed console wasn't admitted after a slot was freed")
+	}
+	verifyOpenConsoles(t, tracker, 2)
+
+	// reconnecting VM reuses its slot
+	if victim, ok := admit("vm3"); !ok || victim != nil {
+		t.Errorf("reconnecting console wasn't admitted in place of its old connection")
+	}
+	verifyOpenConsoles(t, tracker, 2)
+
+	tracker.release("vm2", conns["vm2"])
+	tracker.release("vm3", conns["vm3"])
+	verifyOpenConsoles(t, tracker, 0)
+}
@@ -31,6 +31,7 @@ import (
 	"golang.org/x/sync/syncmap"
 
 	"github.com/golang/glog"
+	"github.com/jonboulle/clockwork"
 )
 
 // UnixServer listens for connections from qemu instances and sends its
@@ -46,6 +47,15 @@ type UnixServer struct {
 	outputReaders    map[string][]chan []byte
 	outputReadersMux sync.Mutex
 
+	consoles *consoleTracker
+
+	consoleLogs         map[string]*consoleLog
+	consoleLogsMux      sync.Mutex
+	clock               clockwork.Clock
+	domainActive        DomainActiveFunc
+	maxReconnectBackoff time.Duration
+	logRotation         LogRotationConfig
+
 	workersWG sync.WaitGroup
 }
 
@@ -59,11 +69,45 @@ func NewUnixServer(socketPath, kubernetesDir string) *UnixServer {
 	}
 	u.UnixConnections = new(syncmap.Map)
 	u.outputReaders = map[string][]chan []byte{}
+	u.consoleLogs = map[string]*consoleLog{}
+	u.clock = clockwork.NewRealClock()
+	u.consoles = newConsoleTracker(u.clock)
 	u.closeCh = make(chan bool)
 	u.listenDone = make(chan bool)
 	return &u
 }
 
+// SetMaxConsoles sets the maximum number of VM consoles that are
+// read and logged at the same time. When a new VM connects after
+// the limit is reached, Virtlet stops reading the console that was
+// idle for the longest time. 0 means no limit.
+func (u *UnixServer) SetMaxConsoles(max int) {
+	u.consoles.setMax(max)
+}
+
+// SetConsoleLogRotation sets the default rotation settings for the
+// VM console logs. They can be overridden for a VM using the
+// environment variables of its process.
+func (u *UnixServer) SetConsoleLogRotation(config LogRotationConfig) {
+	u.logRotation = config
+}
+
+// ReopenConsoleLog makes the console log writer of the container
+// close the log file and open it again, so the log continues in a
+// new file after the old one was moved away
+func (u *UnixServer) ReopenConsoleLog(containerID string) error {
+	// the log writer can't be stopped while the lock is held
+	u.consoleLogsMux.Lock()
+	defer u.consoleLogsMux.Unlock()
+	cl := u.consoleLogs[containerID]
+	if cl == nil {
+		return fmt.Errorf("container %q has no console log", containerID)
+	}
+	done := make(chan error)
+	cl.reopen <- done
+	return <-done
+}
+
 // Listen starts listening for connections from qemus
 func (u *UnixServer) Listen() {
 	glog.V(1).Info("UnixSocket Listener started")
@@ -116,39 +160,73 @@ func (u *UnixServer) Listen() {
 			glog.Warningf("couldn't get pod information from pid: %v", err)
 			continue
 		}
-		podUID := podEnv["VIRTLET_POD_UID"]
-		containerName := podEnv["VIRTLET_CONTAINER_NAME"]
-		containerID := podEnv["VIRTLET_CONTAINER_ID"]
-		attempt := podEnv["CONTAINER_ATTEMPTS"]
-
-		oldConn, ok := u.UnixConnections.Load(containerID)
-		if ok {
-			glog.Warningf("closing old unix connection for vm: %s", containerID)
-			go oldConn.(*net.UnixConn).Close()
-		}
-		u.UnixConnections.Store(containerID, conn)
+		u.handleConsole(conn, podEnv)
+	}
+}
 
-		logChan := make(chan []byte)
-		u.AddOutputReader(containerID, logChan)
-		u.workersWG.Add(1)
-		go u.reader(containerID, &u.workersWG)
+// handleConsole starts reading the console of a VM from the new
+// connection and logging it. If the VM reconnects its console, the
+// logging resumes in the same log after a gap marker.
+func (u *UnixServer) handleConsole(conn *net.UnixConn, podEnv map[string]string) {
+	podUID := podEnv["VIRTLET_POD_UID"]
+	containerName := podEnv["VIRTLET_CONTAINER_NAME"]
+	containerID := podEnv["VIRTLET_CONTAINER_ID"]
+	attempt := podEnv["CONTAINER_ATTEMPTS"]
+
+	victim, admitted := u.consoles.admit(containerID, conn)
+	if !admitted {
+		glog.V(2).Infof("open console limit reached, not reading the console of container %s", containerID)
+		conn.Close()
+		return
+	}
+	if victim != nil {
+		glog.Warningf("open console limit reached, stopping reading the least active console to read the console of container %s", containerID)
+		go victim.Close()
+	}
+
+	fileName := fmt.Sprintf("%s_%s.log", containerName, attempt)
+	outputFile := filepath.Join(u.kubernetesDir, podUID, fileName)
+
+	u.consoleLogsMux.Lock()
+	oldConn, ok := u.UnixConnections.Load(containerID)
+	if ok {
+		glog.Warningf("closing old unix connection for vm: %s", containerID)
+		go oldConn.(*net.UnixConn).Close()
+	}
+	u.UnixConnections.Store(containerID, conn)
 
-		fileName := fmt.Sprintf("%s_%s.log", containerName, attempt)
-		outputFile := filepath.Join(u.kubernetesDir, podUID, fileName)
+	cl := u.consoleLogs[containerID]
+	if cl != nil && cl.file != outputFile {
+		// the container was restarted, so it needs another log
+		u.closeConsoleLog(containerID, cl)
+		cl = nil
+	}
+	var marker string
+	switch {
+	case cl == nil:
+		cl = newConsoleLog(outputFile)
+		u.consoleLogs[containerID] = cl
+		u.AddOutputReader(containerID, cl.ch)
 		u.workersWG.Add(1)
-		go NewLogWriter(logChan, outputFile, &u.workersWG)
+		go writeConsoleLog(cl.ch, cl.gaps, cl.reopen, outputFile, u.logRotation.withPodEnv(podEnv), &u.workersWG)
+	case cl.waiting != nil:
+		marker = cl.reconnected(u.clock.Now())
+		glog.V(1).Infof("Console of container %s reconnected", containerID)
+		u.AddOutputReader(containerID, cl.ch)
+	}
+	u.consoleLogsMux.Unlock()
+
+	// the marker must be written before the new console output
+	if marker != "" {
+		cl.gaps <- marker
 	}
+	u.workersWG.Add(1)
+	go u.reader(containerID, conn, &u.workersWG)
 }
 
-func (u *UnixServer) reader(containerID string, wg *sync.WaitGroup) {
+func (u *UnixServer) reader(containerID string, conn *net.UnixConn, wg *sync.WaitGroup) {
 	defer wg.Done()
 	glog.V(1).Infoln("Spawned new stream reader for container", containerID)
-	connObj, ok := u.UnixConnections.Load(containerID)
-	if !ok {
-		glog.Error("can not load unix connection")
-		return
-	}
-	conn := connObj.(*net.UnixConn)
 
 	buf := make([]byte, 4096)
 	for {
@@ -159,25 +237,48 @@ func (u *UnixServer) reader(containerID string, wg *sync.WaitGroup) {
 			}
 			break
 		}
+		u.consoles.touch(containerID)
 		bufCopy := make([]byte, n)
 		copy(bufCopy, buf)
 		u.broadcast(containerID, bufCopy)
 	}
 	conn.Close()
+	reclaimed := !u.consoles.release(containerID, conn)
+
+	u.consoleLogsMux.Lock()
+	defer u.consoleLogsMux.Unlock()
+	if cur, ok := u.UnixConnections.Load(containerID); ok && cur.(*net.UnixConn) != conn {
+		// the VM has already reconnected its console
+		glog.V(1).Infof("Stream reader for container '%s' replaced by a new one", containerID)
+		return
+	}
 	u.UnixConnections.Delete(containerID)
 
-	// Closing all channels
+	// Closing all channels except for the console log one
+	cl := u.consoleLogs[containerID]
 	u.outputReadersMux.Lock()
 	outputReaders, ok := u.outputReaders[containerID]
 	if ok == false {
 		outputReaders = []chan []byte{}
 	}
 	for _, reader := range outputReaders {
-		close(reader)
+		if cl == nil || reader != cl.ch {
+			close(reader)
+		}
 	}
 	delete(u.outputReaders, containerID)
 	u.outputReadersMux.Unlock()
 
+	if cl != nil {
+		if reclaimed || !u.reconnectEnabled() || u.stopping() {
+			u.closeConsoleLog(containerID, cl)
+		} else {
+			cl.disconnected(u.clock.Now())
+			wg.Add(1)
+			go u.awaitReconnect(containerID, cl, cl.waiting, wg)
+		}
+	}
+
 	glog.V(1).Infof("Stream reader for container '%s' stopped gracefully", containerID)
 }
 
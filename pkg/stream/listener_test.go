@@ -19,11 +19,15 @@ package stream
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/jonboulle/clockwork"
+
 	testutils "github.com/Mirantis/virtlet/pkg/utils/testing"
 )
 
@@ -135,6 +139,103 @@ func TestCleaningReader(t *testing.T) {
 	}
 }
 
+func connectConsole(t *testing.T, u *UnixServer, l *net.UnixListener, podEnv map[string]string) *net.UnixConn {
+	client, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: u.SocketPath, Net: "unix"})
+	if err != nil {
+		t.Fatalf("DialUnix(): %v", err)
+	}
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		t.Fatalf("AcceptUnix(): %v", err)
+	}
+	u.handleConsole(conn, podEnv)
+	return client
+}
+
+func TestConsoleReconnect(t *testing.T) {
+	u := getServer()
+	defer os.RemoveAll(u.kubernetesDir)
+	clock := clockwork.NewFakeClockAt(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	u.clock = clock
+
+	var activeMux sync.Mutex
+	active := true
+	containerID := "1123ab2-baed-32e7-6d1d-13110da12345"
+	u.SetConsoleReconnect(func(id string) (bool, error) {
+		if id != containerID {
+			t.Errorf("bad container id %q", id)
+		}
+		activeMux.Lock()
+		defer activeMux.Unlock()
+		return active, nil
+	}, 10*time.Second)
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: u.SocketPath, Net: "unix"})
+	if err != nil {
+		t.Fatalf("ListenUnix(): %v", err)
+	}
+	defer l.Close()
+
+	podUID := "8c8e8cf1-acea-11e7-8e0e-02420ac00002"
+	if err := os.Mkdir(filepath.Join(u.kubernetesDir, podUID), 0777); err != nil {
+		t.Fatalf("Mkdir(): %v", err)
+	}
+	podEnv := map[string]string{
+		"VIRTLET_POD_UID":        podUID,
+		"VIRTLET_CONTAINER_NAME": "ubuntu",
+		"VIRTLET_CONTAINER_ID":   containerID,
+		"CONTAINER_ATTEMPTS":     "0",
+	}
+
+	client := connectConsole(t, u, l, podEnv)
+	if _, err := client.Write([]byte("before\n")); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	client.Close()
+
+	// the log is kept open while the VM is running
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	clock.BlockUntil(1)
+	clock.Advance(2 * time.Second)
+	clock.BlockUntil(1)
+
+	client = connectConsole(t, u, l, podEnv)
+	if _, err := client.Write([]byte("after\n")); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+
+	// the log is closed after the VM stops
+	activeMux.Lock()
+	active = false
+	activeMux.Unlock()
+	client.Close()
+	// the fake clock still counts the timer of the previous
+	// wait for reconnection
+	clock.BlockUntil(2)
+	clock.Advance(time.Second)
+
+	done := make(chan struct{})
+	go func() {
+		u.workersWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the console log wasn't closed after the VM stopped")
+	}
+
+	verifyJSONLines(t, filepath.Join(u.kubernetesDir, podUID, "ubuntu_0.log"), []map[string]interface{}{
+		{"log": "before\n"},
+		{"log": "--- serial console disconnected at 2018-01-01T00:00:00Z, reconnected after 3s ---\n"},
+		{"log": "after\n"},
+	})
+	if len(u.consoleLogs) != 0 {
+		t.Errorf("console logs are left after the VM stopped: %v", u.consoleLogs)
+	}
+}
+
 func waitForSocket(path string, timeout int) error {
 	passed := 0
 	for {
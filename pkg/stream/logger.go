@@ -29,46 +29,63 @@ import (
 
 // NewLogWriter writes the lines from stdout channel to logFile in k8s format
 func NewLogWriter(stdout <-chan []byte, logFile string, wg *sync.WaitGroup) {
+	writeConsoleLog(stdout, nil, nil, logFile, LogRotationConfig{}, wg)
+}
+
+// writeConsoleLog writes the lines from stdout channel to logFile in
+// k8s format. The gap markers received from gaps channel are written
+// as separate lines after the unfinished line, if any. The log is
+// rotated according to the rotation config. The requests received
+// from reopen channel make the writer reopen the log file, and the
+// result is sent back over the request channel.
+func writeConsoleLog(stdout <-chan []byte, gaps <-chan string, reopen <-chan chan error, logFile string, rotation LogRotationConfig, wg *sync.WaitGroup) {
 	defer wg.Done()
 	glog.V(1).Info("Spawned new log writer. Log file:", logFile)
-	if _, err := os.Stat(logFile); os.IsNotExist(err) {
-		file, err := os.Create(logFile)
-		if err != nil {
-			glog.Warningln("Failed to create output file:", err)
-			return
-		}
-		file.Close()
-	}
-
-	f, err := os.OpenFile(logFile, os.O_WRONLY, 0777)
+	// the writer keeps running if the file can't be opened,
+	// so the console can still be read and the log reopened
+	f, err := openLogFile(logFile, rotation)
 	if err != nil {
 		glog.Error("Failed to open output file:", err)
-		return
 	}
-	defer f.Close()
+	defer f.close()
 
 	buffer := bytes.NewBufferString("")
-	for data := range stdout {
-		buffer.Write(data)
-		for {
-			line, err := buffer.ReadString('\n')
-			if err != nil {
-				// if EOF then write data back to buffer. It's unfinished line
-				if err == io.EOF {
-					buffer.WriteString(line)
+	for {
+		select {
+		case data, ok := <-stdout:
+			if !ok {
+				glog.V(1).Info("Log writter stopped. Finished logging to file:", logFile)
+				return
+			}
+			buffer.Write(data)
+			for {
+				line, err := buffer.ReadString('\n')
+				if err != nil {
+					// if EOF then write data back to buffer. It's unfinished line
+					if err == io.EOF {
+						buffer.WriteString(line)
+						break
+					} else {
+						glog.Error("Error when reading from buffer:", err)
+					}
+
+				}
+				err = f.write(line)
+				if err != nil {
 					break
-				} else {
-					glog.Error("Error when reading from buffer:", err)
 				}
-
 			}
-			err = writeLog(f, line)
-			if err != nil {
-				break
+		case marker := <-gaps:
+			if buffer.Len() != 0 {
+				f.write(buffer.String())
+				buffer.Reset()
 			}
+			f.write(marker + "\n")
+		case done := <-reopen:
+			glog.V(1).Info("Reopening log file:", logFile)
+			done <- f.reopen()
 		}
 	}
-	glog.V(1).Info("Log writter stopped. Finished logging to file:", logFile)
 }
 
 func writeLog(f *os.File, line string) error {
@@ -0,0 +1,156 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stream
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// consoleLogMaxSizeEnv and consoleLogMaxFilesEnv environment
+	// variables of the VM process override the node-wide console
+	// log rotation settings for the VM
+	consoleLogMaxSizeEnv  = "VIRTLET_CONSOLE_LOG_MAX_SIZE"
+	consoleLogMaxFilesEnv = "VIRTLET_CONSOLE_LOG_MAX_FILES"
+)
+
+// LogRotationConfig specifies when the VM console logs are rotated
+type LogRotationConfig struct {
+	// MaxSize is the size of the console log file in bytes after
+	// which the log is rotated. Zero value disables the rotation.
+	MaxSize int64
+	// MaxFiles is the number of the rotated log files to keep
+	// besides the current one. The rotated files are named
+	// <log>.1, <log>.2 and so on, <log>.1 being the most recent
+	// one. Zero value means that the log is truncated instead.
+	MaxFiles int
+}
+
+// withPodEnv returns the config with the settings overridden by
+// the environment variables of the VM process, if they're set
+func (c LogRotationConfig) withPodEnv(podEnv map[string]string) LogRotationConfig {
+	if s, found := podEnv[consoleLogMaxSizeEnv]; found {
+		if maxSize, err := strconv.ParseInt(s, 10, 64); err != nil || maxSize < 0 {
+			glog.Warningf("Bad %s value %q", consoleLogMaxSizeEnv, s)
+		} else {
+			c.MaxSize = maxSize
+		}
+	}
+	if s, found := podEnv[consoleLogMaxFilesEnv]; found {
+		if maxFiles, err := strconv.Atoi(s); err != nil || maxFiles < 0 {
+			glog.Warningf("Bad %s value %q", consoleLogMaxFilesEnv, s)
+		} else {
+			c.MaxFiles = maxFiles
+		}
+	}
+	return c
+}
+
+// logFile is a console log file that's rotated when it grows past
+// the size limit. If the file can't be opened, the log lines are
+// dropped till it's reopened or rotated successfully.
+type logFile struct {
+	path   string
+	config LogRotationConfig
+	f      *os.File
+}
+
+func openLogFile(path string, config LogRotationConfig) (*logFile, error) {
+	lf := &logFile{path: path, config: config}
+	return lf, lf.open(0)
+}
+
+func (lf *logFile) open(flags int) error {
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND|flags, 0777)
+	if err != nil {
+		return fmt.Errorf("failed to open log file %q: %v", lf.path, err)
+	}
+	lf.f = f
+	return nil
+}
+
+func (lf *logFile) close() {
+	if lf.f != nil {
+		lf.f.Close()
+		lf.f = nil
+	}
+}
+
+// write writes the line to the log in k8s format, rotating the log
+// if it has reached the size limit
+func (lf *logFile) write(line string) error {
+	if lf.f == nil {
+		return nil
+	}
+	if err := writeLog(lf.f, line); err != nil {
+		return err
+	}
+	if lf.config.MaxSize <= 0 {
+		return nil
+	}
+	fi, err := lf.f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat log file %q: %v", lf.path, err)
+	}
+	if fi.Size() < lf.config.MaxSize {
+		return nil
+	}
+	if err := lf.rotate(); err != nil {
+		glog.Warningf("Error rotating console log: %v", err)
+	}
+	return nil
+}
+
+func (lf *logFile) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", lf.path, n)
+}
+
+// rotate moves the current log file to <log>.1, shifting the older
+// rotated files and removing the oldest one, and starts a new log
+// file. If no rotated files are kept, the log file is truncated.
+func (lf *logFile) rotate() error {
+	lf.close()
+	if lf.config.MaxFiles == 0 {
+		return lf.open(os.O_TRUNC)
+	}
+	if err := os.Remove(lf.rotatedPath(lf.config.MaxFiles)); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("Failed to remove old console log: %v", err)
+	}
+	for n := lf.config.MaxFiles - 1; n > 0; n-- {
+		if err := os.Rename(lf.rotatedPath(n), lf.rotatedPath(n+1)); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("Failed to rename old console log: %v", err)
+		}
+	}
+	if err := os.Rename(lf.path, lf.rotatedPath(1)); err != nil {
+		// keep writing to the same file, it will
+		// be rotated after the next line
+		glog.Warningf("Failed to rename console log: %v", err)
+	}
+	return lf.open(0)
+}
+
+// reopen closes the log file and opens it again at the same path,
+// so the log continues in a new file after the current one was
+// moved away, e.g. by kubelet's log rotation
+func (lf *logFile) reopen() error {
+	lf.close()
+	return lf.open(0)
+}
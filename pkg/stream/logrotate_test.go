@@ -0,0 +1,147 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stream
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func runConsoleLogWriter(logFile string, rotation LogRotationConfig) (chan []byte, chan chan error, func()) {
+	var wg sync.WaitGroup
+	stdout := make(chan []byte)
+	reopen := make(chan chan error)
+	wg.Add(1)
+	go writeConsoleLog(stdout, make(chan string), reopen, logFile, rotation, &wg)
+	return stdout, reopen, func() {
+		close(stdout)
+		wg.Wait()
+	}
+}
+
+func verifyNoFile(t *testing.T, path string) {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%q is not expected to exist", path)
+	}
+}
+
+func TestConsoleLogRotation(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		maxFiles int
+		rotated  []string
+	}{
+		{
+			name:     "rotation",
+			maxFiles: 2,
+			rotated:  []string{"line4\n", "line3\n"},
+		},
+		{
+			name:     "truncation",
+			maxFiles: 0,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logFile := setupTmpLogFile()
+			defer os.RemoveAll(filepath.Dir(logFile))
+			// each line exceeds the size limit, so the log
+			// is rotated after every line
+			stdout, _, stop := runConsoleLogWriter(logFile, LogRotationConfig{MaxSize: 1, MaxFiles: tc.maxFiles})
+			for i := 1; i <= 4; i++ {
+				stdout <- []byte(fmt.Sprintf("line%d\n", i))
+			}
+			stop()
+
+			verifyJSONLines(t, logFile, nil)
+			for n, line := range tc.rotated {
+				verifyJSONLines(t, fmt.Sprintf("%s.%d", logFile, n+1), []map[string]interface{}{
+					{"log": line},
+				})
+			}
+			verifyNoFile(t, fmt.Sprintf("%s.%d", logFile, len(tc.rotated)+1))
+		})
+	}
+}
+
+func TestConsoleLogReopen(t *testing.T) {
+	logFile := setupTmpLogFile()
+	defer os.RemoveAll(filepath.Dir(logFile))
+	stdout, reopen, stop := runConsoleLogWriter(logFile, LogRotationConfig{})
+	stdout <- []byte("before\n")
+
+	// the log is moved away, e.g. by kubelet
+	movedLogFile := logFile + ".moved"
+	if err := os.Rename(logFile, movedLogFile); err != nil {
+		t.Fatalf("Rename(): %v", err)
+	}
+	stdout <- []byte("still before\n")
+	done := make(chan error)
+	reopen <- done
+	if err := <-done; err != nil {
+		t.Fatalf("failed to reopen the log: %v", err)
+	}
+	stdout <- []byte("after\n")
+	stop()
+
+	verifyJSONLines(t, movedLogFile, []map[string]interface{}{
+		{"log": "before\n"},
+		{"log": "still before\n"},
+	})
+	verifyJSONLines(t, logFile, []map[string]interface{}{
+		{"log": "after\n"},
+	})
+}
+
+func TestLogRotationConfigWithPodEnv(t *testing.T) {
+	config := LogRotationConfig{MaxSize: 1000, MaxFiles: 1}
+	for _, tc := range []struct {
+		name     string
+		podEnv   map[string]string
+		expected LogRotationConfig
+	}{
+		{
+			name:     "no overrides",
+			expected: config,
+		},
+		{
+			name: "overrides",
+			podEnv: map[string]string{
+				consoleLogMaxSizeEnv:  "4096",
+				consoleLogMaxFilesEnv: "0",
+			},
+			expected: LogRotationConfig{MaxSize: 4096, MaxFiles: 0},
+		},
+		{
+			name: "bad values",
+			podEnv: map[string]string{
+				consoleLogMaxSizeEnv:  "-1",
+				consoleLogMaxFilesEnv: "many",
+			},
+			expected: config,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if c := config.withPodEnv(tc.podEnv); !reflect.DeepEqual(c, tc.expected) {
+				t.Errorf("bad config %#v instead of %#v", c, tc.expected)
+			}
+		})
+	}
+}
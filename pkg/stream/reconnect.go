@@ -0,0 +1,155 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stream
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// initialConsoleReconnectBackoff is the initial interval between the
+// checks whether the VM is still active while waiting for it to
+// reconnect its console
+const initialConsoleReconnectBackoff = time.Second
+
+// DomainActiveFunc returns true if the VM of the specified container
+// hasn't stopped
+type DomainActiveFunc func(containerID string) (bool, error)
+
+// consoleLog is the log of a VM serial console. It's kept open while
+// the VM reconnects its console, so the log isn't interrupted when
+// the console socket drops, e.g. after QEMU restart.
+type consoleLog struct {
+	ch     chan []byte
+	gaps   chan string
+	reopen chan chan error
+	file   string
+	// waiting is closed when the console reconnects. It's nil
+	// while the console is connected.
+	waiting        chan struct{}
+	disconnectedAt time.Time
+}
+
+func newConsoleLog(file string) *consoleLog {
+	return &consoleLog{
+		ch:     make(chan []byte),
+		gaps:   make(chan string),
+		reopen: make(chan chan error),
+		file:   file,
+	}
+}
+
+// disconnected marks the start of waiting for the console to
+// reconnect
+func (cl *consoleLog) disconnected(now time.Time) {
+	cl.waiting = make(chan struct{})
+	cl.disconnectedAt = now
+}
+
+// reconnected stops waiting for the console to reconnect and returns
+// the gap marker to be written to the log
+func (cl *consoleLog) reconnected(now time.Time) string {
+	close(cl.waiting)
+	cl.waiting = nil
+	return fmt.Sprintf("--- serial console disconnected at %s, reconnected after %v ---",
+		cl.disconnectedAt.UTC().Format(time.RFC3339), now.Sub(cl.disconnectedAt))
+}
+
+// SetConsoleReconnect makes UnixServer keep the log of a VM console
+// open when the console socket drops while the VM is still active,
+// so the logging resumes after QEMU reconnects to the socket. While
+// waiting for the console to reconnect, isActive is called with
+// exponential backoff up to maxBackoff, and the log is closed as
+// soon as it returns false. 0 maxBackoff disables waiting.
+func (u *UnixServer) SetConsoleReconnect(isActive DomainActiveFunc, maxBackoff time.Duration) {
+	u.domainActive = isActive
+	u.maxReconnectBackoff = maxBackoff
+}
+
+func (u *UnixServer) reconnectEnabled() bool {
+	return u.domainActive != nil && u.maxReconnectBackoff > 0
+}
+
+func (u *UnixServer) stopping() bool {
+	select {
+	case <-u.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeConsoleLog stops the log writer of the console.
+// It must be called with consoleLogsMux held.
+func (u *UnixServer) closeConsoleLog(containerID string, cl *consoleLog) {
+	if cl.waiting != nil {
+		close(cl.waiting)
+		cl.waiting = nil
+	} else {
+		u.RemoveOutputReader(containerID, cl.ch)
+	}
+	close(cl.ch)
+	delete(u.consoleLogs, containerID)
+}
+
+// awaitReconnect waits for the VM to reconnect its console till the
+// VM stops or the server is stopped, closing the console log in the
+// latter cases
+func (u *UnixServer) awaitReconnect(containerID string, cl *consoleLog, waiting chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	glog.V(1).Infof("Console of container %s disconnected, waiting for it to reconnect", containerID)
+	backoff := initialConsoleReconnectBackoff
+	if backoff > u.maxReconnectBackoff {
+		backoff = u.maxReconnectBackoff
+	}
+	for {
+		select {
+		case <-waiting:
+			return
+		case <-u.closeCh:
+			u.closeWaitingConsoleLog(containerID, cl, waiting)
+			return
+		case <-u.clock.After(backoff):
+		}
+		active, err := u.domainActive(containerID)
+		switch {
+		case err != nil:
+			glog.Warningf("Can't check whether the VM of container %s is active: %v", containerID, err)
+		case !active:
+			glog.V(1).Infof("The VM of container %s stopped, closing its console log", containerID)
+			u.closeWaitingConsoleLog(containerID, cl, waiting)
+			return
+		}
+		backoff *= 2
+		if backoff > u.maxReconnectBackoff {
+			backoff = u.maxReconnectBackoff
+		}
+	}
+}
+
+// closeWaitingConsoleLog closes the console log unless the console
+// has reconnected in the meantime
+func (u *UnixServer) closeWaitingConsoleLog(containerID string, cl *consoleLog, waiting chan struct{}) {
+	u.consoleLogsMux.Lock()
+	defer u.consoleLogsMux.Unlock()
+	if u.consoleLogs[containerID] == cl && cl.waiting == waiting {
+		u.closeConsoleLog(containerID, cl)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"net"
 	"os"
 	"syscall"
+	"time"
 
 	"github.com/Mirantis/virtlet/pkg/metadata"
 
@@ -70,6 +71,34 @@ func NewServer(kubernetesDir, socketPath string, metadataStore metadata.Store) (
 	return s, nil
 }
 
+// SetMaxConsoles sets the maximum number of VM consoles that are
+// read and logged at the same time. 0 means no limit.
+func (s *Server) SetMaxConsoles(max int) {
+	s.unixServer.SetMaxConsoles(max)
+}
+
+// SetConsoleReconnect makes the server keep logging the console of
+// a VM in the same log after the VM reconnects its console. The log
+// is closed when isActive reports that the VM has stopped, and it's
+// checked at most every maxBackoff. 0 maxBackoff means that the log
+// is closed as soon as the console disconnects.
+func (s *Server) SetConsoleReconnect(isActive DomainActiveFunc, maxBackoff time.Duration) {
+	s.unixServer.SetConsoleReconnect(isActive, maxBackoff)
+}
+
+// SetConsoleLogRotation sets the default rotation settings for the
+// VM console logs
+func (s *Server) SetConsoleLogRotation(config LogRotationConfig) {
+	s.unixServer.SetConsoleLogRotation(config)
+}
+
+// ReopenContainerLog makes the console log of the container continue
+// in a new file at the same path. It's meant to be called after the
+// log file is moved away by the log rotation done outside Virtlet.
+func (s *Server) ReopenContainerLog(containerID string) error {
+	return s.unixServer.ReopenConsoleLog(containerID)
+}
+
 // Start starts streaming server gorutine and unixServer gorutine
 func (s *Server) Start() error {
 	if err := syscall.Unlink(s.unixServer.SocketPath); err != nil && !os.IsNotExist(err) {
@@ -62,6 +62,10 @@ type PodNetworkDesc struct {
 	PodName string `json:"podName"`
 	// DNS specifies DNS settings for the pod
 	DNS *cnitypes.DNS
+	// PrimaryInterface specifies the name of the pod network
+	// interface to be made the first NIC of the VM, the one with
+	// the default route. Empty value means keeping the CNI order.
+	PrimaryInterface string `json:"primaryInterface,omitempty"`
 }
 
 // GetFDPayload contains the data that are required by TapFDSource
@@ -176,6 +180,12 @@ func (s *TapFDSource) GetFDs(key string, data []byte) ([]int, []byte, error) {
 			// don't fail in this case because there may be even no Calico
 			glog.Warningf("Calico detection/fix didn't work: %v", err)
 		}
+		if pnd.PrimaryInterface != "" {
+			if err := nettools.SetPrimaryInterface(netConfig, pnd.PrimaryInterface); err != nil {
+				gotError = true
+				return nil, fmt.Errorf("error setting the primary interface: %v", err)
+			}
+		}
 		glog.V(3).Infof("CNI Result after fix:\n%s", spew.Sdump(netConfig))
 
 		var err error
@@ -0,0 +1,109 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/renstrom/dedent"
+	"github.com/spf13/cobra"
+
+	"github.com/Mirantis/virtlet/pkg/control"
+)
+
+// blockJobCommand contains the data needed by the block-job
+// subcommand which lists and cancels the block jobs of a VM pod.
+type blockJobCommand struct {
+	client  KubeClient
+	action  string
+	podName string
+	disk    string
+	out     io.Writer
+}
+
+// NewBlockJobCmd returns a cobra.Command that lists and cancels the
+// block jobs running on the disks of a VM pod.
+func NewBlockJobCmd(client KubeClient, out io.Writer) *cobra.Command {
+	blockJob := &blockJobCommand{client: client, out: out}
+	return &cobra.Command{
+		Use:   "block-job (list|cancel) pod [disk]",
+		Short: "List and cancel the block jobs of a VM pod",
+		Long: dedent.Dedent(`
+                        This command manages the long-running block operations,
+                        such as disk copies and snapshot commits, on the disks
+                        of the running VM of a pod. 'list' lists the block jobs
+                        together with their progress, 'cancel' aborts the block
+                        job running on the disk identified by its target device
+                        name, e.g. vda.`),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 2 {
+				return errors.New("action and pod name not specified")
+			}
+			blockJob.action = args[0]
+			blockJob.podName = args[1]
+			switch {
+			case blockJob.action == "list" && len(args) != 2:
+				return errors.New("list action doesn't accept disk name")
+			case blockJob.action != "list" && len(args) != 3:
+				return fmt.Errorf("%s action requires pod name and disk name", blockJob.action)
+			case len(args) == 3:
+				blockJob.disk = args[2]
+			}
+			return blockJob.Run()
+		},
+	}
+}
+
+// Run executes the command.
+func (b *blockJobCommand) Run() error {
+	vmPodInfo, err := b.client.GetVMPodInfo(b.podName)
+	if err != nil {
+		return fmt.Errorf("can't get VM pod info for %q: %v", b.podName, err)
+	}
+	switch b.action {
+	case "list":
+		return b.list(vmPodInfo)
+	case "cancel":
+		if err := makeControlRequest(b.client, vmPodInfo, http.MethodDelete, control.BlockJobPath(vmPodInfo.VirtletContainerID(), b.disk), nil, b.out); err != nil {
+			return err
+		}
+		fmt.Fprintf(b.out, "Cancelled the block job on disk %q of VM pod %q\n", b.disk, b.podName)
+	default:
+		return fmt.Errorf("bad block job action %q", b.action)
+	}
+	return nil
+}
+
+func (b *blockJobCommand) list(vmPodInfo *VMPodInfo) error {
+	var buf bytes.Buffer
+	if err := makeControlRequest(b.client, vmPodInfo, http.MethodGet, control.BlockJobsPath(vmPodInfo.VirtletContainerID()), nil, &buf); err != nil {
+		return err
+	}
+	var jobs []control.BlockJob
+	if err := json.Unmarshal(buf.Bytes(), &jobs); err != nil {
+		return fmt.Errorf("error unmarshalling the block job list: %v", err)
+	}
+	for _, job := range jobs {
+		fmt.Fprintf(b.out, "%s\t%s\t%d%%\n", job.Disk, job.Type, job.Progress)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// makeControlRequest makes a request to the control socket of the
+// Virtlet process that manages the VM pod by executing
+// 'virtlet -control-request' in the Virtlet container. The data,
+// if not nil, is marshalled as JSON and passed as the request body.
+func makeControlRequest(client KubeClient, vmPodInfo *VMPodInfo, method, path string, data interface{}, out io.Writer) error {
+	return makeVirtletControlRequest(client, vmPodInfo.VirtletPodName, method, path, data, out)
+}
+
+// makeVirtletControlRequest makes a request to the control socket of
+// the Virtlet process running in the specified Virtlet pod
+func makeVirtletControlRequest(client KubeClient, virtletPodName, method, path string, data interface{}, out io.Writer) error {
+	cmd := []string{"virtlet", "-control-request", method + " " + path}
+	if data != nil {
+		bs, err := json.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("error marshalling the control request: %v", err)
+		}
+		cmd = append(cmd, "-control-data", string(bs))
+	}
+	exitCode, err := client.ExecInContainer(
+		virtletPodName, "virtlet", "kube-system",
+		nil, out, os.Stderr, cmd)
+	if err != nil {
+		return fmt.Errorf("error executing virtlet in Virtlet pod %q: %v", virtletPodName, err)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("control request to Virtlet pod %q failed with exit code %d", virtletPodName, exitCode)
+	}
+	return nil
+}
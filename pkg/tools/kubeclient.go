@@ -56,14 +56,25 @@ type VMPodInfo struct {
 	ContainerID string
 	// ContainerName is the name of the container in the VM pod
 	ContainerName string
+	// Annotations are the annotations of the VM pod
+	Annotations map[string]string
 }
 
-// LibvirtDomainName returns the name of the libvirt domain for the VMPodInfo.
-func (podInfo VMPodInfo) LibvirtDomainName() string {
+// VirtletContainerID returns the id of the container in the VM pod
+// as it's known to Virtlet, i.e. without the runtime prefix.
+func (podInfo VMPodInfo) VirtletContainerID() string {
 	containerID := podInfo.ContainerID
 	if p := strings.Index(containerID, "__"); p >= 0 {
 		containerID = containerID[p+2:]
+	} else if p := strings.Index(containerID, "://"); p >= 0 {
+		containerID = containerID[p+3:]
 	}
+	return containerID
+}
+
+// LibvirtDomainName returns the name of the libvirt domain for the VMPodInfo.
+func (podInfo VMPodInfo) LibvirtDomainName() string {
+	containerID := podInfo.VirtletContainerID()
 	if len(containerID) > 13 {
 		containerID = containerID[:13]
 	}
@@ -321,6 +332,7 @@ func (c *RealKubeClient) GetVMPodInfo(podName string) (*VMPodInfo, error) {
 		VirtletPodName: virtletPodName,
 		ContainerID:    pod.Status.ContainerStatuses[0].ContainerID,
 		ContainerName:  pod.Spec.Containers[0].Name,
+		Annotations:    pod.Annotations,
 	}, nil
 }
 
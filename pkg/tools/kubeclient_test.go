@@ -301,6 +301,9 @@ func TestGetVMPodInfo(t *testing.T) {
 		VirtletPodName: "virtlet-g9wtz",
 		ContainerID:    sampleContainerID,
 		ContainerName:  "foocontainer",
+		Annotations: map[string]string{
+			"kubernetes.io/target-runtime": "virtlet.cloud",
+		},
 	}
 	if !reflect.DeepEqual(expectedVMPodInfo, vmPodInfo) {
 		t.Errorf("Bad VM PodInfo: got:\n%s\ninstead of\n%s", spew.Sdump(vmPodInfo), spew.Sdump(expectedVMPodInfo))
@@ -310,6 +313,11 @@ func TestGetVMPodInfo(t *testing.T) {
 	if vmPodInfo.LibvirtDomainName() != expectedDomainName {
 		t.Errorf("Bad libvirt domain name: %q instead of %q", vmPodInfo.LibvirtDomainName(), expectedDomainName)
 	}
+
+	expectedContainerID := "2232e3bf-d702-5824-5e3c-f12e60e616b0"
+	if vmPodInfo.VirtletContainerID() != expectedContainerID {
+		t.Errorf("Bad Virtlet container id: %q instead of %q", vmPodInfo.VirtletContainerID(), expectedContainerID)
+	}
 }
 
 func TestCheckForVMPod(t *testing.T) {
@@ -0,0 +1,76 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/renstrom/dedent"
+	"github.com/spf13/cobra"
+
+	"github.com/Mirantis/virtlet/pkg/control"
+)
+
+// monitorCommand contains the data needed by the monitor subcommand
+// which executes a read-only QEMU monitor command for a VM pod.
+type monitorCommand struct {
+	client  KubeClient
+	podName string
+	command string
+	out     io.Writer
+}
+
+// NewMonitorCmd returns a cobra.Command that executes a read-only
+// QEMU monitor command for a VM pod.
+func NewMonitorCmd(client KubeClient, out io.Writer) *cobra.Command {
+	monitor := &monitorCommand{client: client, out: out}
+	return &cobra.Command{
+		Use:   "monitor pod command...",
+		Short: "Execute a read-only QEMU monitor command for a VM pod",
+		Long: dedent.Dedent(`
+                        This command executes a QEMU monitor command for the
+                        running VM of the pod for diagnostic purposes and
+                        prints its JSON result. Only the read-only commands
+                        are allowed: query-status, query-blockstats and
+                        'info registers'. The monitor commands must be
+                        enabled by setting enable_monitor_commands key in
+                        virtlet-config ConfigMap.`),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 2 {
+				return errors.New("pod name and monitor command not specified")
+			}
+			monitor.podName = args[0]
+			monitor.command = strings.Join(args[1:], " ")
+			return monitor.Run()
+		},
+	}
+}
+
+// Run executes the command.
+func (m *monitorCommand) Run() error {
+	vmPodInfo, err := m.client.GetVMPodInfo(m.podName)
+	if err != nil {
+		return fmt.Errorf("can't get VM pod info for %q: %v", m.podName, err)
+	}
+	return makeControlRequest(m.client, vmPodInfo, http.MethodPost, control.MonitorPath(vmPodInfo.VirtletContainerID()), control.MonitorRequest{
+		Command: m.command,
+	}, m.out)
+}
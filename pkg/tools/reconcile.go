@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/renstrom/dedent"
+	"github.com/spf13/cobra"
+
+	"github.com/Mirantis/virtlet/pkg/control"
+)
+
+// reconcileCommand contains the data needed by the reconcile
+// subcommand which makes Virtlet look for the inconsistencies
+// in its state and repair them.
+type reconcileCommand struct {
+	client   KubeClient
+	nodeName string
+	dryRun   bool
+	out      io.Writer
+}
+
+// NewReconcileCmd returns a cobra.Command that makes Virtlet look for
+// the inconsistencies in its state and repair them.
+func NewReconcileCmd(client KubeClient, out io.Writer) *cobra.Command {
+	reconcile := &reconcileCommand{client: client, out: out}
+	cmd := &cobra.Command{
+		Use:   "reconcile [flags]",
+		Short: "Find and repair the inconsistencies in Virtlet state",
+		Long: dedent.Dedent(`
+                        This command makes Virtlet look for the inconsistencies
+                        between its metadata, libvirt domains, the storage pool
+                        and the config ISOs, such as the domains and the volumes
+                        that don't belong to any container, and repair them.
+                        With --dry-run, the inconsistencies are only listed.
+                        Unless --node is specified, the command is executed on
+                        every node and the output for every node is prepended
+                        with a line with the node name and corresponding
+                        Virtlet pod name.`),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 0 {
+				return errors.New("This command does not accept arguments")
+			}
+			return reconcile.Run()
+		},
+	}
+	cmd.Flags().StringVar(&reconcile.nodeName, "node", "", "the name of the target node")
+	cmd.Flags().BoolVar(&reconcile.dryRun, "dry-run", false, "only list the inconsistencies without repairing them")
+	return cmd
+}
+
+// Run executes the command.
+func (r *reconcileCommand) Run() error {
+	if r.nodeName != "" {
+		virtletPodName, err := r.client.GetVirtletPodNameForNode(r.nodeName)
+		if err != nil {
+			return fmt.Errorf("couldn't get Virtlet pod name for node %q: %v", r.nodeName, err)
+		}
+		return r.reconcile(virtletPodName)
+	}
+
+	podNames, nodeNames, err := r.client.GetVirtletPodAndNodeNames()
+	if err != nil {
+		return err
+	}
+	gotErrors := false
+	for n, nodeName := range nodeNames {
+		fmt.Fprintf(r.out, "*** node: %s pod: %s ***\n", nodeName, podNames[n])
+		if err := r.reconcile(podNames[n]); err != nil {
+			fmt.Fprintf(r.out, "ERROR: %v\n", err)
+			gotErrors = true
+		}
+		fmt.Fprint(r.out, "\n")
+	}
+	if gotErrors {
+		return errors.New("some of the nodes returned errors")
+	}
+	return nil
+}
+
+func (r *reconcileCommand) reconcile(virtletPodName string) error {
+	var buf bytes.Buffer
+	if err := makeVirtletControlRequest(r.client, virtletPodName, http.MethodPost, control.ReconcilePath, control.ReconcileRequest{
+		DryRun: r.dryRun,
+	}, &buf); err != nil {
+		return err
+	}
+	var result control.ReconcileResult
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		return fmt.Errorf("error unmarshalling the reconcile result: %v", err)
+	}
+	for _, drift := range result.Drifts {
+		status := "found"
+		if drift.Repaired {
+			status = "repaired"
+		}
+		line := fmt.Sprintf("%s\t%s", status, drift.Kind)
+		if drift.ContainerID != "" {
+			line += "\t" + drift.ContainerID
+		}
+		if drift.Name != "" {
+			line += "\t" + drift.Name
+		}
+		fmt.Fprintln(r.out, line)
+	}
+	if len(result.Errors) != 0 {
+		for _, msg := range result.Errors {
+			fmt.Fprintf(r.out, "ERROR: %s\n", msg)
+		}
+		return fmt.Errorf("reconcile in Virtlet pod %q returned errors", virtletPodName)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tools
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReconcileCommand(t *testing.T) {
+	const (
+		node1Request = "virtlet-foo42/virtlet/kube-system: virtlet -control-request POST /reconcile -control-data "
+		node2Request = "virtlet-bar42/virtlet/kube-system: virtlet -control-request POST /reconcile -control-data "
+		node1Result  = `{"drifts":[` +
+			`{"kind":"domain-without-container","containerID":"cc349e91-dcf7-4f11-a077-36c3673c3fc4","name":"virtlet-cc349e91-dcf7-foocontainer","repaired":true},` +
+			`{"kind":"container-without-domain","containerID":"4f9ae099-bb24-4d8f-a9eb-8bcb2c1cf0c4","repaired":true}]}`
+		node2Result = `{"drifts":[]}`
+	)
+	for _, tc := range []struct {
+		args             string
+		expectedCommands map[string]string
+		expectedOutput   string
+		errSubstring     string
+	}{
+		{
+			args: "--node=kube-node-1",
+			expectedCommands: map[string]string{
+				node1Request + "{}": node1Result,
+			},
+			expectedOutput: "repaired\tdomain-without-container\tcc349e91-dcf7-4f11-a077-36c3673c3fc4\tvirtlet-cc349e91-dcf7-foocontainer\n" +
+				"repaired\tcontainer-without-domain\t4f9ae099-bb24-4d8f-a9eb-8bcb2c1cf0c4\n",
+		},
+		{
+			args: "--node=kube-node-1 --dry-run",
+			expectedCommands: map[string]string{
+				node1Request + `{"dryRun":true}`: `{"drifts":[{"kind":"volume-without-container","containerID":"cc349e91-dcf7-4f11-a077-36c3673c3fc4","name":"virtlet_root_cc349e91-dcf7-4f11-a077-36c3673c3fc4"}]}`,
+			},
+			expectedOutput: "found\tvolume-without-container\tcc349e91-dcf7-4f11-a077-36c3673c3fc4\tvirtlet_root_cc349e91-dcf7-4f11-a077-36c3673c3fc4\n",
+		},
+		{
+			args: "",
+			expectedCommands: map[string]string{
+				node1Request + "{}": node1Result,
+				node2Request + "{}": node2Result,
+			},
+			expectedOutput: "*** node: kube-node-1 pod: virtlet-foo42 ***\n" +
+				"repaired\tdomain-without-container\tcc349e91-dcf7-4f11-a077-36c3673c3fc4\tvirtlet-cc349e91-dcf7-foocontainer\n" +
+				"repaired\tcontainer-without-domain\t4f9ae099-bb24-4d8f-a9eb-8bcb2c1cf0c4\n" +
+				"\n" +
+				"*** node: kube-node-2 pod: virtlet-bar42 ***\n" +
+				"\n",
+		},
+		{
+			args: "--node=kube-node-2",
+			expectedCommands: map[string]string{
+				node2Request + "{}": `{"drifts":[],"errors":["cannot list libvirt volumes: simulated failure"]}`,
+			},
+			errSubstring: "returned errors",
+		},
+		{
+			args:         "--node=kube-node-3",
+			errSubstring: "couldn't get Virtlet pod name",
+		},
+		{
+			args:         "foo",
+			errSubstring: "does not accept arguments",
+		},
+	} {
+		t.Run(tc.args, func(t *testing.T) {
+			c := &fakeKubeClient{
+				t: t,
+				virtletPods: map[string]string{
+					"kube-node-1": "virtlet-foo42",
+					"kube-node-2": "virtlet-bar42",
+				},
+				expectedCommands: tc.expectedCommands,
+			}
+			var out bytes.Buffer
+			cmd := NewReconcileCmd(c, &out)
+			if tc.args != "" {
+				cmd.SetArgs(strings.Split(tc.args, " "))
+			} else {
+				cmd.SetArgs([]string{})
+			}
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+			switch err := cmd.Execute(); {
+			case err != nil && tc.errSubstring == "":
+				t.Errorf("reconcile command returned an unexpected error: %v", err)
+			case err == nil && tc.errSubstring != "":
+				t.Errorf("Didn't get expected error (substring %q), output: %q", tc.errSubstring, out.String())
+			case err != nil && !strings.Contains(err.Error(), tc.errSubstring):
+				t.Errorf("Didn't get expected substring %q in the error: %v", tc.errSubstring, err)
+			case err == nil && out.String() != tc.expectedOutput:
+				t.Errorf("Unexpected output from the command: %q instead of %q", out.String(), tc.expectedOutput)
+			}
+			for c := range tc.expectedCommands {
+				t.Errorf("command not executed: %q", c)
+			}
+		})
+	}
+}
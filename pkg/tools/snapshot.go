@@ -0,0 +1,152 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/renstrom/dedent"
+	"github.com/spf13/cobra"
+
+	"github.com/Mirantis/virtlet/pkg/control"
+	"github.com/Mirantis/virtlet/pkg/metadata"
+)
+
+// snapshotCommand contains the data needed by the snapshot
+// subcommand which manages the snapshots of a VM pod.
+type snapshotCommand struct {
+	client      KubeClient
+	action      string
+	podName     string
+	name        string
+	description string
+	out         io.Writer
+}
+
+// NewSnapshotCmd returns a cobra.Command that manages the snapshots
+// of a VM pod.
+func NewSnapshotCmd(client KubeClient, out io.Writer) *cobra.Command {
+	snapshot := &snapshotCommand{client: client, out: out}
+	cmd := &cobra.Command{
+		Use:   "snapshot [flags] (create|list|revert|remove|changes) pod [snapshot_name]",
+		Short: "Manage the snapshots of a VM pod",
+		Long: dedent.Dedent(`
+                        This command manages the snapshots of the disks and the
+                        memory of a VM pod. 'create' takes a snapshot of the
+                        running VM, 'list' lists the snapshots of the VM, 'revert'
+                        reverts the running VM to the snapshot, 'remove'
+                        removes the snapshot and 'changes' lists the number of
+                        the blocks of each disk of the running VM changed since
+                        the snapshot was taken or the VM was reverted to it.
+                        All of the writable disks of the VM must be qcow2
+                        images. The snapshots are removed together with the VM.`),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 2 {
+				return errors.New("action and pod name not specified")
+			}
+			snapshot.action = args[0]
+			snapshot.podName = args[1]
+			switch {
+			case snapshot.action == "list" && len(args) != 2:
+				return errors.New("list action doesn't accept snapshot name")
+			case snapshot.action != "list" && len(args) != 3:
+				return fmt.Errorf("%s action requires pod name and snapshot name", snapshot.action)
+			case len(args) == 3:
+				snapshot.name = args[2]
+			}
+			return snapshot.Run()
+		},
+	}
+	cmd.Flags().StringVar(&snapshot.description, "description", "", "the description of the snapshot being created")
+	return cmd
+}
+
+// Run executes the command.
+func (s *snapshotCommand) Run() error {
+	vmPodInfo, err := s.client.GetVMPodInfo(s.podName)
+	if err != nil {
+		return fmt.Errorf("can't get VM pod info for %q: %v", s.podName, err)
+	}
+	containerID := vmPodInfo.VirtletContainerID()
+	switch s.action {
+	case "create":
+		if err := makeControlRequest(s.client, vmPodInfo, http.MethodPost, control.SnapshotsPath(containerID), control.SnapshotRequest{
+			Name:        s.name,
+			Description: s.description,
+		}, s.out); err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "Created snapshot %q of VM pod %q\n", s.name, s.podName)
+	case "list":
+		return s.list(vmPodInfo)
+	case "changes":
+		return s.changes(vmPodInfo)
+	case "revert":
+		if err := makeControlRequest(s.client, vmPodInfo, http.MethodPost, control.SnapshotRevertPath(containerID, s.name), nil, s.out); err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "Reverted VM pod %q to snapshot %q\n", s.podName, s.name)
+	case "remove":
+		if err := makeControlRequest(s.client, vmPodInfo, http.MethodDelete, control.SnapshotPath(containerID, s.name), nil, s.out); err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "Removed snapshot %q of VM pod %q\n", s.name, s.podName)
+	default:
+		return fmt.Errorf("bad snapshot action %q", s.action)
+	}
+	return nil
+}
+
+func (s *snapshotCommand) list(vmPodInfo *VMPodInfo) error {
+	var buf bytes.Buffer
+	if err := makeControlRequest(s.client, vmPodInfo, http.MethodGet, control.SnapshotsPath(vmPodInfo.VirtletContainerID()), nil, &buf); err != nil {
+		return err
+	}
+	var snapshots []metadata.SnapshotInfo
+	if err := json.Unmarshal(buf.Bytes(), &snapshots); err != nil {
+		return fmt.Errorf("error unmarshalling the snapshot list: %v", err)
+	}
+	for _, snapshot := range snapshots {
+		line := fmt.Sprintf("%s\t%s", snapshot.Name, time.Unix(0, snapshot.CreatedAt).UTC().Format(time.RFC3339))
+		if snapshot.Description != "" {
+			line += "\t" + snapshot.Description
+		}
+		fmt.Fprintln(s.out, line)
+	}
+	return nil
+}
+
+func (s *snapshotCommand) changes(vmPodInfo *VMPodInfo) error {
+	var buf bytes.Buffer
+	if err := makeControlRequest(s.client, vmPodInfo, http.MethodGet, control.SnapshotChangesPath(vmPodInfo.VirtletContainerID(), s.name), nil, &buf); err != nil {
+		return err
+	}
+	var changes []control.DiskChanges
+	if err := json.Unmarshal(buf.Bytes(), &changes); err != nil {
+		return fmt.Errorf("error unmarshalling the changes since the snapshot: %v", err)
+	}
+	for _, c := range changes {
+		fmt.Fprintf(s.out, "%s\t%d blocks\t%d bytes\n", c.Device, c.ChangedBlocks, c.ChangedBytes)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tools
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotCommand(t *testing.T) {
+	const controlRequest = "virtlet-foo42/virtlet/kube-system: virtlet -control-request "
+	for _, tc := range []struct {
+		args             string
+		expectedCommands map[string]string
+		expectedOutput   string
+		errSubstring     string
+	}{
+		{
+			args: "create cirros snap1",
+			expectedCommands: map[string]string{
+				controlRequest + `POST /containers/cc349e91-dcf7-4f11-a077-36c3673c3fc4/snapshots -control-data {"name":"snap1"}`: "",
+			},
+			expectedOutput: "Created snapshot \"snap1\" of VM pod \"cirros\"\n",
+		},
+		{
+			args: "create --description=before-upgrade cirros snap1",
+			expectedCommands: map[string]string{
+				controlRequest + `POST /containers/cc349e91-dcf7-4f11-a077-36c3673c3fc4/snapshots -control-data {"name":"snap1","description":"before-upgrade"}`: "",
+			},
+			expectedOutput: "Created snapshot \"snap1\" of VM pod \"cirros\"\n",
+		},
+		{
+			args: "list cirros",
+			expectedCommands: map[string]string{
+				controlRequest + "GET /containers/cc349e91-dcf7-4f11-a077-36c3673c3fc4/snapshots": `[` +
+					`{"Name":"snap1","Description":"","CreatedAt":1524648266720331175},` +
+					`{"Name":"snap2","Description":"before upgrade","CreatedAt":1524648366720331175}]`,
+			},
+			expectedOutput: "snap1\t2018-04-25T09:24:26Z\n" +
+				"snap2\t2018-04-25T09:26:06Z\tbefore upgrade\n",
+		},
+		{
+			args: "revert cirros snap1",
+			expectedCommands: map[string]string{
+				controlRequest + "POST /containers/cc349e91-dcf7-4f11-a077-36c3673c3fc4/snapshots/snap1/revert": "",
+			},
+			expectedOutput: "Reverted VM pod \"cirros\" to snapshot \"snap1\"\n",
+		},
+		{
+			args: "remove cirros snap1",
+			expectedCommands: map[string]string{
+				controlRequest + "DELETE /containers/cc349e91-dcf7-4f11-a077-36c3673c3fc4/snapshots/snap1": "",
+			},
+			expectedOutput: "Removed snapshot \"snap1\" of VM pod \"cirros\"\n",
+		},
+		{
+			args: "changes cirros snap1",
+			expectedCommands: map[string]string{
+				controlRequest + "GET /containers/cc349e91-dcf7-4f11-a077-36c3673c3fc4/snapshots/snap1/changes": `[` +
+					`{"device":"drive-sda","granularity":65536,"changedBlocks":2,"changedBytes":131072}]`,
+			},
+			expectedOutput: "drive-sda\t2 blocks\t131072 bytes\n",
+		},
+		{
+			args:         "create cirros",
+			errSubstring: "requires pod name and snapshot name",
+		},
+		{
+			args:         "list cirros snap1",
+			errSubstring: "doesn't accept snapshot name",
+		},
+		{
+			args:         "foobar cirros snap1",
+			errSubstring: "bad snapshot action",
+		},
+		{
+			args:         "list ubuntu",
+			errSubstring: "can't get VM pod info",
+		},
+	} {
+		t.Run(tc.args, func(t *testing.T) {
+			c := &fakeKubeClient{
+				t: t,
+				virtletPods: map[string]string{
+					"kube-node-1": "virtlet-foo42",
+				},
+				vmPods: map[string]VMPodInfo{
+					"cirros": {
+						NodeName:       "kube-node-1",
+						VirtletPodName: "virtlet-foo42",
+						ContainerID:    "virtlet.cloud://cc349e91-dcf7-4f11-a077-36c3673c3fc4",
+						ContainerName:  "foocontainer",
+					},
+				},
+				expectedCommands: tc.expectedCommands,
+			}
+			var out bytes.Buffer
+			cmd := NewSnapshotCmd(c, &out)
+			cmd.SetArgs(strings.Split(tc.args, " "))
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+			switch err := cmd.Execute(); {
+			case err != nil && tc.errSubstring == "":
+				t.Errorf("snapshot command returned an unexpected error: %v", err)
+			case err == nil && tc.errSubstring != "":
+				t.Errorf("Didn't get expected error (substring %q), output: %q", tc.errSubstring, out.String())
+			case err != nil && !strings.Contains(err.Error(), tc.errSubstring):
+				t.Errorf("Didn't get expected substring %q in the error: %v", tc.errSubstring, err)
+			case err == nil && out.String() != tc.expectedOutput:
+				t.Errorf("Unexpected output from the command: %q instead of %q", out.String(), tc.expectedOutput)
+			}
+			for c := range tc.expectedCommands {
+				t.Errorf("command not executed: %q", c)
+			}
+		})
+	}
+}
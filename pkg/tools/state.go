@@ -0,0 +1,119 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/renstrom/dedent"
+	"github.com/spf13/cobra"
+
+	"github.com/Mirantis/virtlet/pkg/control"
+)
+
+// stateCommand contains the data needed by the state subcommand
+// which saves and restores the state of a VM pod.
+type stateCommand struct {
+	client    KubeClient
+	action    string
+	podName   string
+	imageName string
+	out       io.Writer
+}
+
+// NewStateCmd returns a cobra.Command that saves and restores the
+// state of a VM pod.
+func NewStateCmd(client KubeClient, out io.Writer) *cobra.Command {
+	state := &stateCommand{client: client, out: out}
+	return &cobra.Command{
+		Use:   "state (save|restore|save-image) pod [image_name]",
+		Short: "Save and restore the state of a VM pod",
+		Long: dedent.Dedent(`
+                        This command saves and restores the state of the VM
+                        of a pod including its memory. 'save' saves the state
+                        of the running VM under the saved state dir of
+                        Virtlet and stops the VM, 'restore' resumes the VM
+                        from the saved state. 'save-image' saves the state of
+                        the running VM as a saved state image with the
+                        specified name and exports the root disk of the VM
+                        under the same name, so new VMs can be restored from
+                        it using VirtletRestoreFrom annotation. The reference
+                        to the exported image is printed.`),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 2 {
+				return errors.New("action and pod name not specified")
+			}
+			state.action = args[0]
+			state.podName = args[1]
+			switch {
+			case state.action == "save-image" && len(args) != 3:
+				return errors.New("save-image action requires pod name and image name")
+			case state.action != "save-image" && len(args) != 2:
+				return fmt.Errorf("%s action doesn't accept image name", state.action)
+			case len(args) == 3:
+				state.imageName = args[2]
+			}
+			return state.Run()
+		},
+	}
+}
+
+// Run executes the command.
+func (s *stateCommand) Run() error {
+	vmPodInfo, err := s.client.GetVMPodInfo(s.podName)
+	if err != nil {
+		return fmt.Errorf("can't get VM pod info for %q: %v", s.podName, err)
+	}
+	containerID := vmPodInfo.VirtletContainerID()
+	switch s.action {
+	case "save":
+		if err := makeControlRequest(s.client, vmPodInfo, http.MethodPost, control.SaveStatePath(containerID), nil, s.out); err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "Saved the state of VM pod %q\n", s.podName)
+	case "restore":
+		if err := makeControlRequest(s.client, vmPodInfo, http.MethodPost, control.RestoreStatePath(containerID), nil, s.out); err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "Restored the state of VM pod %q\n", s.podName)
+	case "save-image":
+		return s.saveImage(vmPodInfo)
+	default:
+		return fmt.Errorf("bad state action %q", s.action)
+	}
+	return nil
+}
+
+func (s *stateCommand) saveImage(vmPodInfo *VMPodInfo) error {
+	var buf bytes.Buffer
+	if err := makeControlRequest(s.client, vmPodInfo, http.MethodPost, control.SaveStateImagePath(vmPodInfo.VirtletContainerID()), control.SaveStateImageRequest{
+		Name: s.imageName,
+	}, &buf); err != nil {
+		return err
+	}
+	var result control.SaveStateImageResult
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		return fmt.Errorf("error unmarshalling the saved state image result: %v", err)
+	}
+	fmt.Fprintf(s.out, "Saved the state of VM pod %q as saved state image %q, root disk image: %s\n", s.podName, s.imageName, result.ImageRef)
+	return nil
+}
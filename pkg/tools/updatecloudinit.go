@@ -0,0 +1,83 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/renstrom/dedent"
+	"github.com/spf13/cobra"
+
+	"github.com/Mirantis/virtlet/pkg/control"
+)
+
+// updateCloudInitCommand contains the data needed by the
+// update-cloud-init subcommand which applies the current annotations
+// of a VM pod to the cloud-init data of its VM.
+type updateCloudInitCommand struct {
+	client  KubeClient
+	podName string
+	rerun   bool
+	out     io.Writer
+}
+
+// NewUpdateCloudInitCmd returns a cobra.Command that updates the
+// cloud-init data of a VM pod.
+func NewUpdateCloudInitCmd(client KubeClient, out io.Writer) *cobra.Command {
+	update := &updateCloudInitCommand{client: client, out: out}
+	cmd := &cobra.Command{
+		Use:   "update-cloud-init [flags] pod",
+		Short: "Update the cloud-init data of a VM pod",
+		Long: dedent.Dedent(`
+                        This command regenerates the cloud-init data of the VM
+                        using the current annotations of the VM pod, e.g. after
+                        VirtletSSHKeys annotation is changed using 'kubectl annotate',
+                        and re-attaches it to the VM without recreating the VM.
+                        If the VM is stopped, the changes are applied when it's
+                        started again. With --rerun, cloud-init is re-run in the
+                        guest using the guest agent, which must be enabled using
+                        VirtletGuestAgent annotation.`),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("must specify exactly one VM pod name")
+			}
+			update.podName = args[0]
+			return update.Run()
+		},
+	}
+	cmd.Flags().BoolVar(&update.rerun, "rerun", false, "re-run cloud-init in the guest using the guest agent")
+	return cmd
+}
+
+// Run executes the command.
+func (u *updateCloudInitCommand) Run() error {
+	vmPodInfo, err := u.client.GetVMPodInfo(u.podName)
+	if err != nil {
+		return fmt.Errorf("can't get VM pod info for %q: %v", u.podName, err)
+	}
+	if err := makeControlRequest(u.client, vmPodInfo, http.MethodPut, control.CloudInitPath(vmPodInfo.VirtletContainerID()), control.CloudInitUpdate{
+		PodAnnotations: vmPodInfo.Annotations,
+		Rerun:          u.rerun,
+	}, u.out); err != nil {
+		return err
+	}
+	fmt.Fprintf(u.out, "Updated cloud-init data of VM pod %q\n", u.podName)
+	return nil
+}
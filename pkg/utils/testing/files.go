@@ -88,3 +88,42 @@ func IsoToMap(isoPath string) (map[string]interface{}, error) {
 	}
 	return DirToMap(tmpDir)
 }
+
+// IsoVolumeID returns the volume id (label) of an iso image. Like
+// blkid, it prefers the Joliet volume id if the image has Joliet
+// extensions, as the primary volume descriptor may only contain
+// upper case letters.
+func IsoVolumeID(isoPath string) (string, error) {
+	f, err := os.Open(isoPath)
+	if err != nil {
+		return "", fmt.Errorf("os.Open(): %v", err)
+	}
+	defer f.Close()
+	// the volume descriptors start at sector 16 and end with
+	// the terminator which has type 255. The volume id is
+	// located at offset 40.
+	var primaryID string
+	for sector := int64(16); ; sector++ {
+		var desc [2048]byte
+		if _, err := f.ReadAt(desc[:], sector*2048); err != nil {
+			return "", fmt.Errorf("error reading the volume descriptor: %v", err)
+		}
+		if string(desc[1:6]) != "CD001" {
+			return "", fmt.Errorf("bad volume descriptor at sector %d", sector)
+		}
+		volumeID := desc[40:72]
+		switch {
+		case desc[0] == 1:
+			primaryID = strings.TrimRight(string(volumeID), " ")
+		case desc[0] == 2 && desc[88] == '%' && desc[89] == '/':
+			// Joliet volume id is encoded as UCS-2 big endian
+			var runes []rune
+			for n := 0; n < len(volumeID); n += 2 {
+				runes = append(runes, rune(volumeID[n])<<8|rune(volumeID[n+1]))
+			}
+			return strings.TrimRight(string(runes), " \x00"), nil
+		case desc[0] == 255:
+			return primaryID, nil
+		}
+	}
+}
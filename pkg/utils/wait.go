@@ -17,12 +17,15 @@ limitations under the License.
 package utils
 
 import (
-	"fmt"
+	"errors"
 	"time"
 
 	"github.com/jonboulle/clockwork"
 )
 
+// ErrTimeout is returned by WaitLoop if the timeout elapses
+var ErrTimeout = errors.New("timeout reached")
+
 // WaitLoop executes test func in loop until it returns error, true, or the timeout elapses.
 // clock argument denotes a clock object to use for waiting.
 // When clock is nil, WaitLoop uses clockwork.NewRealClock()
@@ -40,5 +43,5 @@ func WaitLoop(test func() (bool, error), retryPeriod time.Duration, timeout time
 		}
 	}
 
-	return fmt.Errorf("timeout reached")
+	return ErrTimeout
 }
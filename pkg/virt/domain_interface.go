@@ -18,6 +18,7 @@ package virt
 
 import (
 	"errors"
+	"time"
 
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 )
@@ -44,10 +45,122 @@ const (
 // DomainState represents a state of a domain
 type DomainState int
 
+const (
+	// DomainStateReasonUnknown means that the reason for the
+	// current domain state is unknown or not interesting
+	DomainStateReasonUnknown DomainStateReason = iota
+	// DomainStateReasonPanicked means that the domain has crashed
+	// because of guest kernel panic reported via the panic device
+	DomainStateReasonPanicked
+	// DomainStateReasonShuttingDown means that the domain is
+	// paused while it's being shut down
+	DomainStateReasonShuttingDown
+)
+
+// DomainStateReason represents the reason for the current state of a domain
+type DomainStateReason int
+
+// DomainEventType denotes the kind of a domain lifecycle event
+type DomainEventType int
+
+const (
+	// DomainEventOther denotes the lifecycle events that aren't
+	// handled by Virtlet
+	DomainEventOther DomainEventType = iota
+	// DomainEventGuestShutdown means that the domain was shut off
+	// because the guest OS powered the VM off
+	DomainEventGuestShutdown
+)
+
+// DomainEvent describes a lifecycle event of a domain
+type DomainEvent struct {
+	// DomainUUID is the uuid of the domain
+	DomainUUID string
+	// Type is the kind of the event
+	Type DomainEventType
+}
+
+// DomainStats contains resource usage statistics of a running domain
+type DomainStats struct {
+	// CPUTime is the CPU time used by the domain in nanoseconds
+	CPUTime uint64
+	// VCPUTime is the CPU time used by the virtual CPUs of the
+	// guest in nanoseconds. Unlike CPUTime, it doesn't include the
+	// time used by the hypervisor itself, e.g. for emulating the
+	// devices. It's zero if the hypervisor doesn't report it
+	VCPUTime uint64
+	// BalloonMemory is the current balloon size in KiB, that is
+	// the amount of memory available to the guest
+	BalloonMemory uint64
+	// UnusedMemory is the amount of memory left unused by the
+	// guest in KiB as reported by the balloon driver. It's zero if
+	// the guest doesn't report it
+	UnusedMemory uint64
+	// RSS is the resident set size of the hypervisor process in KiB
+	RSS uint64
+}
+
+// BlockStats contains the I/O statistics of a disk of the domain.
+// The values are accumulated since the hypervisor process of the
+// domain was started
+type BlockStats struct {
+	// ReadRequests is the number of read requests
+	ReadRequests uint64
+	// ReadBytes is the number of bytes read
+	ReadBytes uint64
+	// WriteRequests is the number of write requests
+	WriteRequests uint64
+	// WriteBytes is the number of bytes written
+	WriteBytes uint64
+}
+
+// BlockJobType denotes the kind of a block job
+type BlockJobType string
+
+const (
+	// BlockJobTypeUnknown means that the kind of the block job
+	// is not known
+	BlockJobTypeUnknown BlockJobType = "unknown"
+	// BlockJobTypePull means that the disk is being populated
+	// from its backing image
+	BlockJobTypePull BlockJobType = "pull"
+	// BlockJobTypeCopy means that the disk is being copied to
+	// another image, e.g. for migration
+	BlockJobTypeCopy BlockJobType = "copy"
+	// BlockJobTypeCommit means that an image in the backing chain
+	// of the disk is being committed into its backing image
+	BlockJobTypeCommit BlockJobType = "commit"
+	// BlockJobTypeActiveCommit means that the active image of the
+	// disk is being committed into its backing image, e.g. while
+	// removing a snapshot
+	BlockJobTypeActiveCommit BlockJobType = "active-commit"
+)
+
+// BlockJobInfo describes a block job running on a disk of a domain
+type BlockJobInfo struct {
+	// Type is the kind of the block job
+	Type BlockJobType
+	// Cur is the amount of work done so far. The units are
+	// unspecified, Cur is only meaningful relative to End
+	Cur uint64
+	// End is the total amount of work to be done. The job is
+	// complete when Cur equals End
+	End uint64
+}
+
 // ErrDomainNotFound error is returned by DomainConnection's
 // Lookup*() methods when the domain in question cannot be found
 var ErrDomainNotFound = errors.New("domain not found")
 
+// ErrGuestAgentUnresponsive error is returned by Domain's guest
+// agent methods when the guest agent doesn't respond in time or
+// isn't connected
+var ErrGuestAgentUnresponsive = errors.New("guest agent is not responding")
+
+// ErrSnapshotNotFound error is returned by Domain's snapshot
+// methods when the snapshot in question cannot be found
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
 // ErrSecretNotFound error is returned by DomainConnection's
 // Lookup*() methods when the domain in question cannot be found
 var ErrSecretNotFound = errors.New("secret not found")
@@ -76,6 +189,24 @@ type DomainConnection interface {
 	// secret cannot be found but no other error occurred, it returns
 	// ErrSecretNotFound
 	LookupSecretByUsageName(usageType string, usageName string) (Secret, error)
+	// RestoreDomain restores the domain from the state file
+	// created by Domain's Save() method and resumes it
+	RestoreDomain(path string) error
+	// RestoreDomainWithXML restores the domain from the state
+	// file replacing the saved domain definition with the
+	// specified one, which must be compatible with it
+	RestoreDomainWithXML(path string, def *libvirtxml.Domain) error
+	// LibVersion returns the version of libvirt as
+	// major * 1000000 + minor * 1000 + release
+	LibVersion() (uint32, error)
+	// HypervisorVersion returns the version of the hypervisor
+	// (qemu) as major * 1000000 + minor * 1000 + release
+	HypervisorVersion() (uint32, error)
+	// WatchDomainEvents makes the connection call the handler for
+	// the lifecycle events of the domains till the returned
+	// function is called. The handler is called from the event
+	// loop and must not block
+	WatchDomainEvents(handler func(event DomainEvent)) (func(), error)
 }
 
 // Secret represents a secret that's used by the domain
@@ -99,10 +230,82 @@ type Domain interface {
 	Shutdown() error
 	// State obtains the current state of the domain
 	State() (DomainState, error)
+	// StateReason obtains the reason for the current state of the domain
+	StateReason() (DomainStateReason, error)
 	// UUIDString returns UUID string for this domain
 	UUIDString() (string, error)
 	// Name returns the name of this domain
 	Name() (string, error)
 	// XML retrieves xml definition of the domain
 	XML() (*libvirtxml.Domain, error)
+	// UpdateDisk updates the definition of a disk device attached
+	// to the domain, which is identified by its target, e.g. to
+	// replace the media in a cdrom drive. The change is applied
+	// both to the running domain (if any) and its persistent config
+	UpdateDisk(def *libvirtxml.DomainDisk) error
+	// SetMetadata replaces the element of the domain metadata that
+	// belongs to the specified XML namespace with the specified one.
+	// The change is applied both to the running domain (if any)
+	// and its persistent config
+	SetMetadata(namespaceURI, prefix, metadataXML string) error
+	// GuestAgentCommand sends the specified JSON command to the
+	// guest agent and returns its JSON response. In case if the
+	// agent doesn't respond within the timeout, it returns
+	// ErrGuestAgentUnresponsive
+	GuestAgentCommand(command string, timeout time.Duration) (string, error)
+	// ShutdownWithGuestAgent asks the guest agent to shut down the
+	// domain. In case if the agent doesn't respond, it returns
+	// ErrGuestAgentUnresponsive. The time limit for the agent
+	// response is fixed by libvirt, so the callers that need a
+	// shorter one must stop waiting for the call by themselves
+	ShutdownWithGuestAgent() error
+	// ShutdownWithInitctl shuts down the domain using initctl
+	// in the guest
+	ShutdownWithInitctl() error
+	// ShutdownWithSignal shuts down the domain by sending a signal
+	// to the init process of the guest
+	ShutdownWithSignal() error
+	// Save saves the state of the running domain including its
+	// memory to the specified file and stops the domain. The domain
+	// can then be resumed using DomainConnection's RestoreDomain()
+	Save(path string) error
+	// Stats returns the resource usage statistics of the running
+	// domain
+	Stats() (*DomainStats, error)
+	// BlockStats returns the I/O statistics of the disk with the
+	// specified target device name, e.g. "vda", of the running
+	// domain
+	BlockStats(disk string) (*BlockStats, error)
+	// Rename changes the name of the domain. Only the domains
+	// that are shut off can be renamed
+	Rename(name string) error
+	// SetAutostart sets whether libvirt starts the domain
+	// automatically when libvirtd starts, e.g. after node reboot
+	SetAutostart(autostart bool) error
+	// Autostart returns true if the domain is started automatically
+	// when libvirtd starts
+	Autostart() (bool, error)
+	// QemuMonitorCommand sends the specified QMP command to the
+	// QEMU monitor of the running domain and returns its JSON
+	// response
+	QemuMonitorCommand(command string) (string, error)
+	// BlockJob returns the block job that's running on the disk
+	// with the specified target device name, e.g. "vda", or nil if
+	// there's no such job
+	BlockJob(disk string) (*BlockJobInfo, error)
+	// AbortBlockJob cancels the block job that's running on the
+	// disk with the specified target device name
+	AbortBlockJob(disk string) error
+	// CreateSnapshot takes a snapshot of the disks and the memory
+	// of the running domain with the specified name and
+	// description. The snapshot data is kept inside the qcow2
+	// images of the domain
+	CreateSnapshot(name, description string) error
+	// RevertToSnapshot reverts the domain to the state of the
+	// specified snapshot, leaving it running. In case if the
+	// snapshot cannot be found, it returns ErrSnapshotNotFound
+	RevertToSnapshot(name string) error
+	// RemoveSnapshot removes the specified snapshot. In case if
+	// the snapshot cannot be found, it returns ErrSnapshotNotFound
+	RemoveSnapshot(name string) error
 }
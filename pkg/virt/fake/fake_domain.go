@@ -17,11 +17,16 @@ limitations under the License.
 package fake
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 
@@ -32,6 +37,12 @@ import (
 const (
 	configPathHint        = "/__config__/"
 	configPathReplacement = "/var/lib/virtlet/config/"
+	// libvirt 4.0.0 and qemu 2.11.1
+	defaultFakeLibVersion        = 4000000
+	defaultFakeHypervisorVersion = 2011001
+	// FakeDirtyBitmapGranularity is the granularity of the dirty
+	// bitmaps of the fake domains
+	FakeDirtyBitmapGranularity = 65536
 )
 
 func mustMarshal(d libvirtxml.Document) string {
@@ -48,7 +59,19 @@ type FakeDomainConnection struct {
 	domains            map[string]*FakeDomain
 	domainsByUuid      map[string]*FakeDomain
 	secretsByUsageName map[string]*FakeSecret
+	secretsByUUID      map[string]*FakeSecret
 	ignoreShutdown     bool
+	stuckOnStart       bool
+	guestAgentRelease  chan struct{}
+	hungGuestAgentCall chan struct{}
+	guestExecExitCode  int
+	guestExecErrData   string
+	libVersion         uint32
+	hypervisorVersion  uint32
+	// eventHandlers maps the ids of the domain event watches
+	// to their handlers
+	eventHandlers    map[int]func(virt.DomainEvent)
+	lastEventWatchID int
 }
 
 var _ virt.DomainConnection = &FakeDomainConnection{}
@@ -64,6 +87,10 @@ func NewFakeDomainConnection(rec testutils.Recorder) *FakeDomainConnection {
 		domains:            make(map[string]*FakeDomain),
 		domainsByUuid:      make(map[string]*FakeDomain),
 		secretsByUsageName: make(map[string]*FakeSecret),
+		secretsByUUID:      make(map[string]*FakeSecret),
+		libVersion:         defaultFakeLibVersion,
+		hypervisorVersion:  defaultFakeHypervisorVersion,
+		eventHandlers:      make(map[int]func(virt.DomainEvent)),
 	}
 }
 
@@ -72,6 +99,48 @@ func (dc *FakeDomainConnection) SetIgnoreShutdown(ignoreShutdown bool) {
 	dc.ignoreShutdown = ignoreShutdown
 }
 
+// SetVersions sets the versions of libvirt and the hypervisor
+// that are reported by the connection
+func (dc *FakeDomainConnection) SetVersions(libVersion, hypervisorVersion uint32) {
+	dc.libVersion = libVersion
+	dc.hypervisorVersion = hypervisorVersion
+}
+
+// SetStuckOnStart makes the domains that are started stay paused
+// instead of reaching the running state, as it happens if the
+// hypervisor gets wedged during the startup
+func (dc *FakeDomainConnection) SetStuckOnStart(stuck bool) {
+	dc.stuckOnStart = stuck
+}
+
+// SetGuestAgentHung makes the guest agents of all the domains stop
+// responding. The guest agent calls block till the agents are
+// unhung, after which they fail with ErrGuestAgentUnresponsive.
+func (dc *FakeDomainConnection) SetGuestAgentHung(hung bool) {
+	switch {
+	case hung && dc.guestAgentRelease == nil:
+		dc.guestAgentRelease = make(chan struct{})
+		dc.hungGuestAgentCall = make(chan struct{}, 100)
+	case !hung && dc.guestAgentRelease != nil:
+		close(dc.guestAgentRelease)
+		dc.guestAgentRelease = nil
+	}
+}
+
+// SetGuestExecResult sets the exit code and the stderr output
+// reported by guest-exec-status for the commands started via
+// guest-exec
+func (dc *FakeDomainConnection) SetGuestExecResult(exitCode int, errData string) {
+	dc.guestExecExitCode = exitCode
+	dc.guestExecErrData = errData
+}
+
+// WaitForHungGuestAgentCall waits till a guest agent call blocks
+// because of the agent being hung
+func (dc *FakeDomainConnection) WaitForHungGuestAgentCall() {
+	<-dc.hungGuestAgentCall
+}
+
 func (dc *FakeDomainConnection) removeDomain(d *FakeDomain) {
 	if _, found := dc.domains[d.def.Name]; !found {
 		log.Panicf("domain %q not found", d.def.Name)
@@ -88,6 +157,7 @@ func (dc *FakeDomainConnection) removeSecret(s *FakeSecret) {
 		log.Panicf("secret %q not found", s.usageName)
 	}
 	delete(dc.secretsByUsageName, s.usageName)
+	delete(dc.secretsByUUID, s.uuid)
 }
 
 // DefineDomain implements DefineDomain method of DomainConnection interface.
@@ -116,10 +186,13 @@ func (dc *FakeDomainConnection) DefineDomain(def *libvirtxml.Domain) (virt.Domai
 			if disk.Source == nil || disk.Source.File == nil {
 				continue
 			}
-			p := strings.Index(disk.Source.File.File, configPathHint)
-			if p >= 0 {
-				disk.Source.File.File = configPathReplacement + disk.Source.File.File[p+len(configPathHint):]
-			}
+			disk.Source.File.File = fixConfigPath(disk.Source.File.File)
+		}
+	}
+	if updatedDef.QEMUCommandline != nil {
+		for n := range updatedDef.QEMUCommandline.Args {
+			arg := &updatedDef.QEMUCommandline.Args[n]
+			arg.Value = fixConfigPath(arg.Value)
 		}
 	}
 
@@ -166,17 +239,21 @@ func (dc *FakeDomainConnection) DefineSecret(def *libvirtxml.Secret) (virt.Secre
 	if def.Usage.Name == "" {
 		return nil, fmt.Errorf("the secret has empty Usage name")
 	}
+	s := newFakeSecret(dc, def.Usage.Name, def.UUID)
 	// clear secret uuid as it's generated randomly
 	def.UUID = ""
 	dc.rec.Rec("DefineSecret", mustMarshal(def))
 
-	s := newFakeSecret(dc, def.Usage.Name)
 	dc.secretsByUsageName[def.Usage.Name] = s
+	dc.secretsByUUID[s.uuid] = s
 	return s, nil
 }
 
 // LookupSecretByUUIDString implements LookupSecretByUUIDString method of DomainConnection interface.
 func (dc *FakeDomainConnection) LookupSecretByUUIDString(uuid string) (virt.Secret, error) {
+	if s, found := dc.secretsByUUID[uuid]; found {
+		return s, nil
+	}
 	return nil, virt.ErrSecretNotFound
 }
 
@@ -188,56 +265,203 @@ func (dc *FakeDomainConnection) LookupSecretByUsageName(usageType string, usageN
 	return nil, virt.ErrSecretNotFound
 }
 
+// RestoreDomain implements RestoreDomain method of DomainConnection interface.
+// The state file written by FakeDomain's Save() contains the domain UUID.
+func (dc *FakeDomainConnection) RestoreDomain(path string) error {
+	dc.rec.Rec("RestoreDomain", path)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("can't read the domain state file %q: %v", path, err)
+	}
+	d, found := dc.domainsByUuid[string(data)]
+	if !found {
+		return fmt.Errorf("domain %q not found", string(data))
+	}
+	if d.state != virt.DomainStateShutoff {
+		return fmt.Errorf("can't restore active domain %q", d.def.Name)
+	}
+	d.state = virt.DomainStateRunning
+	d.reason = virt.DomainStateReasonUnknown
+	return nil
+}
+
+// RestoreDomainWithXML implements RestoreDomainWithXML method of
+// DomainConnection interface. The domain with the UUID from the
+// specified definition is started with that definition.
+func (dc *FakeDomainConnection) RestoreDomainWithXML(path string, def *libvirtxml.Domain) error {
+	dc.rec.Rec("RestoreDomainWithXML", map[string]string{"path": path, "uuid": def.UUID})
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("can't access the domain state file %q: %v", path, err)
+	}
+	d, found := dc.domainsByUuid[def.UUID]
+	if !found {
+		return fmt.Errorf("domain %q not found", def.UUID)
+	}
+	if d.state != virt.DomainStateShutoff {
+		return fmt.Errorf("can't restore active domain %q", d.def.Name)
+	}
+	d.def = def
+	d.state = virt.DomainStateRunning
+	d.reason = virt.DomainStateReasonUnknown
+	return nil
+}
+
+// LibVersion implements LibVersion method of DomainConnection interface.
+func (dc *FakeDomainConnection) LibVersion() (uint32, error) {
+	return dc.libVersion, nil
+}
+
+// HypervisorVersion implements HypervisorVersion method of DomainConnection interface.
+func (dc *FakeDomainConnection) HypervisorVersion() (uint32, error) {
+	return dc.hypervisorVersion, nil
+}
+
+// WatchDomainEvents implements WatchDomainEvents method of DomainConnection interface.
+func (dc *FakeDomainConnection) WatchDomainEvents(handler func(event virt.DomainEvent)) (func(), error) {
+	dc.lastEventWatchID++
+	id := dc.lastEventWatchID
+	dc.eventHandlers[id] = handler
+	return func() {
+		delete(dc.eventHandlers, id)
+	}, nil
+}
+
+func (dc *FakeDomainConnection) sendEvent(d *FakeDomain, eventType virt.DomainEventType) {
+	for _, handler := range dc.eventHandlers {
+		handler(virt.DomainEvent{DomainUUID: d.def.UUID, Type: eventType})
+	}
+}
+
 // FakeDomain is a fake implementation of Domain interface.
 type FakeDomain struct {
 	rec     testutils.Recorder
 	dc      *FakeDomainConnection
 	removed bool
-	created bool
 	state   virt.DomainState
+	reason  virt.DomainStateReason
 	def     *libvirtxml.Domain
+	// statsCalls is the number of Stats() calls
+	statsCalls uint64
+	autostart  bool
+	// bitmaps maps the block device names to the dirty bitmaps
+	// which map the bitmap names to the dirty byte counts
+	bitmaps map[string]map[string]uint64
+	// blockJobs maps the disk target device names to the block
+	// jobs running on them
+	blockJobs map[string]*virt.BlockJobInfo
+	// blockStatsCalls maps the disk target device names to the
+	// number of BlockStats() calls since the domain was started
+	blockStatsCalls map[string]uint64
+	// snapshots maps the names of the snapshots to their
+	// descriptions
+	snapshots map[string]string
 }
 
 var _ virt.Domain = &FakeDomain{}
 
 func newFakeDomain(dc *FakeDomainConnection, def *libvirtxml.Domain) *FakeDomain {
 	return &FakeDomain{
-		rec:   testutils.NewChildRecorder(dc.rec, def.Name),
-		dc:    dc,
-		state: virt.DomainStateShutoff,
-		def:   def,
+		rec:             testutils.NewChildRecorder(dc.rec, def.Name),
+		dc:              dc,
+		state:           virt.DomainStateShutoff,
+		def:             def,
+		bitmaps:         make(map[string]map[string]uint64),
+		blockJobs:       make(map[string]*virt.BlockJobInfo),
+		blockStatsCalls: make(map[string]uint64),
+		snapshots:       make(map[string]string),
+	}
+}
+
+// fixConfigPath replaces the part of the path up to the config
+// dir hint with the default config dir, so the paths in the
+// recorded domain definitions don't depend on the temporary
+// directory used by the test
+func fixConfigPath(path string) string {
+	p := strings.Index(path, configPathHint)
+	if p < 0 {
+		return path
 	}
+	// keep the option name for qemu command line arguments
+	start := strings.LastIndexAny(path[:p], "=,") + 1
+	return path[:start] + configPathReplacement + path[p+len(configPathHint):]
+}
+
+// recordFwCfgFiles records the contents of the files passed to
+// the domain via -fw_cfg qemu command line option
+func (d *FakeDomain) recordFwCfgFiles() error {
+	if d.def.QEMUCommandline == nil {
+		return nil
+	}
+	m := make(map[string]interface{})
+	args := d.def.QEMUCommandline.Args
+	for n := 0; n < len(args)-1; n++ {
+		if args[n].Value != "-fw_cfg" {
+			continue
+		}
+		var name, file string
+		for _, opt := range strings.Split(args[n+1].Value, ",") {
+			switch {
+			case strings.HasPrefix(opt, "name="):
+				name = strings.TrimPrefix(opt, "name=")
+			case strings.HasPrefix(opt, "file="):
+				file = strings.TrimPrefix(opt, "file=")
+			}
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("bad fw_cfg file %q: %v", file, err)
+		}
+		m[name] = string(content)
+	}
+	if len(m) != 0 {
+		d.rec.Rec("fw_cfg", m)
+	}
+	return nil
+}
+
+func (d *FakeDomain) recordIsoImage(disk *libvirtxml.DomainDisk) error {
+	if disk.Source == nil || disk.Source.File == nil {
+		return nil
+	}
+	origPath := disk.Source.File.File
+	if filepath.Ext(origPath) == ".iso" || strings.HasPrefix(filepath.Base(origPath), "config-iso") {
+		m, err := testutils.IsoToMap(origPath)
+		if err != nil {
+			return fmt.Errorf("bad iso image: %q", origPath)
+		}
+		d.rec.Rec("iso image", m)
+	}
+	return nil
 }
 
 // Create implements Create method of Domain interface.
 func (d *FakeDomain) Create() error {
 	d.rec.Rec("Create", nil)
 	if d.def.Devices != nil {
-		for _, disk := range d.def.Devices.Disks {
-			if disk.Source == nil || disk.Source.File == nil {
-				continue
-			}
-			origPath := disk.Source.File.File
-			if filepath.Ext(origPath) == ".iso" || strings.HasPrefix(filepath.Base(origPath), "config-iso") {
-				m, err := testutils.IsoToMap(origPath)
-				if err != nil {
-					return fmt.Errorf("bad iso image: %q", origPath)
-				}
-				d.rec.Rec("iso image", m)
+		for n := range d.def.Devices.Disks {
+			if err := d.recordIsoImage(&d.def.Devices.Disks[n]); err != nil {
+				return err
 			}
 		}
 	}
+	if err := d.recordFwCfgFiles(); err != nil {
+		return err
+	}
 	if d.removed {
 		return fmt.Errorf("Create() called on a removed (undefined) domain %q", d.def.Name)
 	}
-	if d.created {
-		return fmt.Errorf("trying to re-create domain %q", d.def.Name)
-	}
+	// like libvirt, allow starting the domain again after it's
+	// stopped, but not when it's active
 	if d.state != virt.DomainStateShutoff {
 		return fmt.Errorf("invalid domain state %d", d.state)
 	}
-	d.created = true
+	// the block stats are kept by the hypervisor process
+	d.blockStatsCalls = make(map[string]uint64)
 	d.state = virt.DomainStateRunning
+	if d.dc.stuckOnStart {
+		d.state = virt.DomainStatePaused
+	}
+	d.reason = virt.DomainStateReasonUnknown
 	return nil
 }
 
@@ -248,6 +472,7 @@ func (d *FakeDomain) Destroy() error {
 		return fmt.Errorf("Destroy() called on a removed (undefined) domain %q", d.def.Name)
 	}
 	d.state = virt.DomainStateShutoff
+	d.reason = virt.DomainStateReasonUnknown
 	return nil
 }
 
@@ -275,6 +500,10 @@ func (d *FakeDomain) Shutdown() error {
 	if !d.dc.ignoreShutdown {
 		// TODO: need to test DomainStateShutdown stage too
 		d.state = virt.DomainStateShutoff
+		d.reason = virt.DomainStateReasonUnknown
+		// libvirt can't tell the shutdowns requested by the
+		// host from the ones initiated by the guest
+		d.dc.sendEvent(d, virt.DomainEventGuestShutdown)
 	}
 	return nil
 }
@@ -287,6 +516,53 @@ func (d *FakeDomain) State() (virt.DomainState, error) {
 	return d.state, nil
 }
 
+// StateReason implements StateReason method of Domain interface.
+func (d *FakeDomain) StateReason() (virt.DomainStateReason, error) {
+	if d.removed {
+		return virt.DomainStateReasonUnknown, fmt.Errorf("StateReason() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	return d.reason, nil
+}
+
+// InjectPanic simulates a guest kernel panic reported via the panic
+// device. The domain ends up in crashed state as it happens with
+// 'preserve' crash action.
+func (d *FakeDomain) InjectPanic() error {
+	d.rec.Rec("InjectPanic", nil)
+	if d.state != virt.DomainStateRunning {
+		return fmt.Errorf("InjectPanic(): domain %q is not running", d.def.Name)
+	}
+	d.state = virt.DomainStateCrashed
+	d.reason = virt.DomainStateReasonPanicked
+	return nil
+}
+
+// InjectGuestShutdown simulates the guest OS powering the VM off,
+// e.g. after 'poweroff' command is run inside the VM
+func (d *FakeDomain) InjectGuestShutdown() error {
+	d.rec.Rec("InjectGuestShutdown", nil)
+	shuttingDown := d.state == virt.DomainStatePaused && d.reason == virt.DomainStateReasonShuttingDown
+	if d.state != virt.DomainStateRunning && !shuttingDown {
+		return fmt.Errorf("InjectGuestShutdown(): domain %q is not running", d.def.Name)
+	}
+	d.state = virt.DomainStateShutoff
+	d.reason = virt.DomainStateReasonUnknown
+	d.dc.sendEvent(d, virt.DomainEventGuestShutdown)
+	return nil
+}
+
+// InjectShutdownPause simulates libvirt pausing the domain while
+// it's being shut down. InjectGuestShutdown completes the shutdown.
+func (d *FakeDomain) InjectShutdownPause() error {
+	d.rec.Rec("InjectShutdownPause", nil)
+	if d.state != virt.DomainStateRunning {
+		return fmt.Errorf("InjectShutdownPause(): domain %q is not running", d.def.Name)
+	}
+	d.state = virt.DomainStatePaused
+	d.reason = virt.DomainStateReasonShuttingDown
+	return nil
+}
+
 // UUIDString implements UUIDString method of Domain interface.
 func (d *FakeDomain) UUIDString() (string, error) {
 	if d.removed {
@@ -305,20 +581,504 @@ func (d *FakeDomain) XML() (*libvirtxml.Domain, error) {
 	return d.def, nil
 }
 
+// UpdateDisk implements UpdateDisk method of Domain interface.
+func (d *FakeDomain) UpdateDisk(def *libvirtxml.DomainDisk) error {
+	diskXML, err := def.Marshal()
+	if err != nil {
+		return fmt.Errorf("UpdateDisk(): error marshalling the disk: %v", err)
+	}
+	d.rec.Rec("UpdateDisk", diskXML)
+	if d.removed {
+		return fmt.Errorf("UpdateDisk() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if def.Target == nil {
+		return fmt.Errorf("UpdateDisk(): no target specified for the disk")
+	}
+	if d.def.Devices != nil {
+		for n, disk := range d.def.Devices.Disks {
+			if disk.Target != nil && disk.Target.Dev == def.Target.Dev {
+				d.def.Devices.Disks[n] = *def
+				return d.recordIsoImage(def)
+			}
+		}
+	}
+	return fmt.Errorf("UpdateDisk(): disk %q not found in domain %q", def.Target.Dev, d.def.Name)
+}
+
+// SetMetadata implements SetMetadata method of Domain interface.
+// The fake domain only supports a single metadata element.
+func (d *FakeDomain) SetMetadata(namespaceURI, prefix, metadataXML string) error {
+	d.rec.Rec("SetMetadata", map[string]string{
+		"namespace": namespaceURI,
+		"prefix":    prefix,
+		"metadata":  metadataXML,
+	})
+	if d.removed {
+		return fmt.Errorf("SetMetadata() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	d.def.Metadata = &libvirtxml.DomainMetadata{XML: metadataXML}
+	return nil
+}
+
+func (d *FakeDomain) checkGuestAgent(method string) (bool, error) {
+	if d.removed {
+		return false, fmt.Errorf("%s() called on a removed (undefined) domain %q", method, d.def.Name)
+	}
+	if d.state != virt.DomainStateRunning {
+		return false, fmt.Errorf("%s(): domain %q is not running", method, d.def.Name)
+	}
+	hasAgent := false
+	if d.def.Devices != nil {
+		for _, ch := range d.def.Devices.Channels {
+			if ch.Target != nil && ch.Target.VirtIO != nil && ch.Target.VirtIO.Name == "org.qemu.guest_agent.0" {
+				hasAgent = true
+			}
+		}
+	}
+	if !hasAgent {
+		return false, fmt.Errorf("%s(): guest agent is not configured for domain %q", method, d.def.Name)
+	}
+	if release := d.dc.guestAgentRelease; release != nil {
+		d.dc.hungGuestAgentCall <- struct{}{}
+		<-release
+		return false, virt.ErrGuestAgentUnresponsive
+	}
+	return true, nil
+}
+
+// GuestAgentCommand implements GuestAgentCommand method of Domain interface.
+// The fake guest agent only supports guest-ping, guest-get-osinfo,
+// guest-get-host-name, guest-set-time, guest-exec and
+// guest-exec-status commands. The commands started via guest-exec
+// finish immediately.
+func (d *FakeDomain) GuestAgentCommand(command string, timeout time.Duration) (string, error) {
+	d.rec.Rec("GuestAgentCommand", command)
+	if ok, err := d.checkGuestAgent("GuestAgentCommand"); !ok {
+		return "", err
+	}
+	var cmd struct {
+		Execute string `json:"execute"`
+	}
+	if err := json.Unmarshal([]byte(command), &cmd); err != nil {
+		return "", fmt.Errorf("GuestAgentCommand(): bad command %q: %v", command, err)
+	}
+	switch cmd.Execute {
+	case "guest-ping", "guest-set-time":
+		return `{"return":{}}`, nil
+	case "guest-get-osinfo":
+		return `{"return":{"id":"ubuntu","name":"Ubuntu","pretty-name":"Ubuntu 18.04 LTS","version":"18.04 LTS (Bionic Beaver)","version-id":"18.04","kernel-release":"4.15.0-20-generic","machine":"x86_64"}}`, nil
+	case "guest-get-host-name":
+		return fmt.Sprintf(`{"return":{"host-name":%q}}`, d.def.Name), nil
+	case "guest-exec":
+		return `{"return":{"pid":42}}`, nil
+	case "guest-exec-status":
+		return fmt.Sprintf(`{"return":{"exited":true,"exitcode":%d,"err-data":%q}}`,
+			d.dc.guestExecExitCode,
+			base64.StdEncoding.EncodeToString([]byte(d.dc.guestExecErrData))), nil
+	default:
+		return "", fmt.Errorf("GuestAgentCommand(): unsupported command %q", cmd.Execute)
+	}
+}
+
+// ShutdownWithGuestAgent implements ShutdownWithGuestAgent method of Domain interface.
+func (d *FakeDomain) ShutdownWithGuestAgent() error {
+	d.rec.Rec("ShutdownWithGuestAgent", nil)
+	if ok, err := d.checkGuestAgent("ShutdownWithGuestAgent"); !ok {
+		return err
+	}
+	d.state = virt.DomainStateShutoff
+	d.reason = virt.DomainStateReasonUnknown
+	return nil
+}
+
+// ShutdownWithInitctl implements ShutdownWithInitctl method of Domain interface.
+func (d *FakeDomain) ShutdownWithInitctl() error {
+	return d.shutdownWithFlags("ShutdownWithInitctl")
+}
+
+// ShutdownWithSignal implements ShutdownWithSignal method of Domain interface.
+func (d *FakeDomain) ShutdownWithSignal() error {
+	return d.shutdownWithFlags("ShutdownWithSignal")
+}
+
+func (d *FakeDomain) shutdownWithFlags(method string) error {
+	d.rec.Rec(method, nil)
+	if d.removed {
+		return fmt.Errorf("%s() called on a removed (undefined) domain %q", method, d.def.Name)
+	}
+	if d.state != virt.DomainStateRunning {
+		return fmt.Errorf("%s(): domain %q is not running", method, d.def.Name)
+	}
+	d.state = virt.DomainStateShutoff
+	d.reason = virt.DomainStateReasonUnknown
+	return nil
+}
+
+// Rename implements Rename method of Domain interface.
+func (d *FakeDomain) Rename(name string) error {
+	d.rec.Rec("Rename", name)
+	switch {
+	case d.removed:
+		return fmt.Errorf("Rename() called on a removed (undefined) domain %q", d.def.Name)
+	case d.state != virt.DomainStateShutoff:
+		return fmt.Errorf("Rename(): domain %q is not shut off", d.def.Name)
+	}
+	if _, found := d.dc.domains[name]; found {
+		return fmt.Errorf("Rename(): domain %q already exists", name)
+	}
+	delete(d.dc.domains, d.def.Name)
+	d.def.Name = name
+	d.dc.domains[name] = d
+	return nil
+}
+
+// SetAutostart implements SetAutostart method of Domain interface.
+func (d *FakeDomain) SetAutostart(autostart bool) error {
+	d.rec.Rec("SetAutostart", autostart)
+	if d.removed {
+		return fmt.Errorf("SetAutostart() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	d.autostart = autostart
+	return nil
+}
+
+// Autostart implements Autostart method of Domain interface.
+func (d *FakeDomain) Autostart() (bool, error) {
+	if d.removed {
+		return false, fmt.Errorf("Autostart() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	return d.autostart, nil
+}
+
+// fakeBlockDeviceName returns the name of the QEMU block device
+// that corresponds to the disk
+func fakeBlockDeviceName(disk *libvirtxml.DomainDisk) string {
+	return "drive-" + disk.Target.Dev
+}
+
+func (d *FakeDomain) queryBlock() []interface{} {
+	var r []interface{}
+	for n := range d.def.Devices.Disks {
+		disk := &d.def.Devices.Disks[n]
+		if disk.Target == nil {
+			continue
+		}
+		device := fakeBlockDeviceName(disk)
+		var names []string
+		for name := range d.bitmaps[device] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		bitmaps := []interface{}{}
+		for _, name := range names {
+			bitmaps = append(bitmaps, map[string]interface{}{
+				"name":        name,
+				"count":       d.bitmaps[device][name],
+				"granularity": FakeDirtyBitmapGranularity,
+				"persistent":  true,
+				"status":      "active",
+			})
+		}
+		r = append(r, map[string]interface{}{
+			"device": device,
+			"inserted": map[string]interface{}{
+				"ro": disk.ReadOnly != nil,
+			},
+			"dirty-bitmaps": bitmaps,
+		})
+	}
+	return r
+}
+
+func (d *FakeDomain) findBlockDevice(device string) bool {
+	for n := range d.def.Devices.Disks {
+		disk := &d.def.Devices.Disks[n]
+		if disk.Target != nil && fakeBlockDeviceName(disk) == device {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkDirty marks the specified number of bytes as changed on the
+// block device, updating all of its dirty bitmaps. The counts are
+// rounded up to FakeDirtyBitmapGranularity.
+func (d *FakeDomain) MarkDirty(device string, bytes uint64) {
+	bytes = (bytes + FakeDirtyBitmapGranularity - 1) / FakeDirtyBitmapGranularity * FakeDirtyBitmapGranularity
+	for name := range d.bitmaps[device] {
+		d.bitmaps[device][name] += bytes
+	}
+}
+
+// QemuMonitorCommand implements QemuMonitorCommand method of Domain interface.
+// The fake monitor only supports query-status, query-blockstats,
+// query-block, block-dirty-bitmap-add, block-dirty-bitmap-remove,
+// block-dirty-bitmap-clear and human-monitor-command commands.
+func (d *FakeDomain) QemuMonitorCommand(command string) (string, error) {
+	d.rec.Rec("QemuMonitorCommand", command)
+	if d.removed {
+		return "", fmt.Errorf("QemuMonitorCommand() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if d.state != virt.DomainStateRunning {
+		return "", fmt.Errorf("QemuMonitorCommand(): domain %q is not running", d.def.Name)
+	}
+	var cmd struct {
+		Execute   string `json:"execute"`
+		Arguments struct {
+			CommandLine string `json:"command-line"`
+			Node        string `json:"node"`
+			Name        string `json:"name"`
+			Persistent  bool   `json:"persistent"`
+		} `json:"arguments"`
+	}
+	if err := json.Unmarshal([]byte(command), &cmd); err != nil {
+		return "", fmt.Errorf("QemuMonitorCommand(): bad command %q: %v", command, err)
+	}
+	switch cmd.Execute {
+	case "query-status":
+		return `{"return":{"running":true,"singlestep":false,"status":"running"}}`, nil
+	case "query-blockstats":
+		return `{"return":[{"device":"drive-scsi0-0-0-0","stats":{"rd_bytes":1024,"wr_bytes":2048}}]}`, nil
+	case "human-monitor-command":
+		r, err := json.Marshal(map[string]string{"return": "fake output of " + cmd.Arguments.CommandLine})
+		if err != nil {
+			return "", err
+		}
+		return string(r), nil
+	case "query-block":
+		r, err := json.Marshal(map[string]interface{}{"return": d.queryBlock()})
+		if err != nil {
+			return "", err
+		}
+		return string(r), nil
+	case "block-dirty-bitmap-add", "block-dirty-bitmap-remove", "block-dirty-bitmap-clear":
+		node, name := cmd.Arguments.Node, cmd.Arguments.Name
+		if !d.findBlockDevice(node) {
+			return "", fmt.Errorf("QemuMonitorCommand(): Cannot find device=%s nor node_name=%s", node, node)
+		}
+		_, found := d.bitmaps[node][name]
+		switch {
+		case cmd.Execute == "block-dirty-bitmap-add" && found:
+			return "", fmt.Errorf("QemuMonitorCommand(): Bitmap already exists: %s", name)
+		case cmd.Execute == "block-dirty-bitmap-add":
+			if !cmd.Arguments.Persistent {
+				return "", fmt.Errorf("QemuMonitorCommand(): the fake monitor only supports persistent bitmaps")
+			}
+			if d.bitmaps[node] == nil {
+				d.bitmaps[node] = make(map[string]uint64)
+			}
+			d.bitmaps[node][name] = 0
+		case !found:
+			return "", fmt.Errorf("QemuMonitorCommand(): Dirty bitmap '%s' not found", name)
+		case cmd.Execute == "block-dirty-bitmap-remove":
+			delete(d.bitmaps[node], name)
+		default:
+			d.bitmaps[node][name] = 0
+		}
+		return `{"return":{}}`, nil
+	default:
+		return "", fmt.Errorf("QemuMonitorCommand(): unsupported command %q", cmd.Execute)
+	}
+}
+
+// Save implements Save method of Domain interface.
+func (d *FakeDomain) Save(path string) error {
+	d.rec.Rec("Save", path)
+	if d.removed {
+		return fmt.Errorf("Save() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if d.state != virt.DomainStateRunning {
+		return fmt.Errorf("can't save inactive domain %q", d.def.Name)
+	}
+	if err := ioutil.WriteFile(path, []byte(d.def.UUID), 0600); err != nil {
+		return fmt.Errorf("can't write the domain state file %q: %v", path, err)
+	}
+	d.state = virt.DomainStateShutoff
+	d.reason = virt.DomainStateReasonUnknown
+	return nil
+}
+
+// Stats implements Stats method of Domain interface.
+// The CPU time grows by one second with each call, 900ms of which
+// are used by the virtual CPUs.
+func (d *FakeDomain) Stats() (*virt.DomainStats, error) {
+	if d.removed {
+		return nil, fmt.Errorf("Stats() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if d.state != virt.DomainStateRunning {
+		return nil, fmt.Errorf("can't get stats of inactive domain %q", d.def.Name)
+	}
+	d.statsCalls++
+	var memory uint64
+	if d.def.Memory != nil {
+		memory = uint64(d.def.Memory.Value)
+		if d.def.Memory.Unit == "MiB" {
+			memory *= 1024
+		}
+	}
+	return &virt.DomainStats{
+		CPUTime:       d.statsCalls * uint64(time.Second),
+		VCPUTime:      d.statsCalls * uint64(900*time.Millisecond),
+		BalloonMemory: memory,
+		UnusedMemory:  memory / 2,
+		RSS:           memory / 4,
+	}, nil
+}
+
+// BlockStats implements BlockStats method of Domain interface.
+// The stats of each disk grow with each call and are reset when
+// the domain is started.
+func (d *FakeDomain) BlockStats(disk string) (*virt.BlockStats, error) {
+	if d.removed {
+		return nil, fmt.Errorf("BlockStats() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if d.state != virt.DomainStateRunning {
+		return nil, fmt.Errorf("can't get block stats of inactive domain %q", d.def.Name)
+	}
+	if !d.hasDisk(disk) {
+		return nil, fmt.Errorf("BlockStats(): disk %q not found in domain %q", disk, d.def.Name)
+	}
+	d.blockStatsCalls[disk]++
+	n := d.blockStatsCalls[disk]
+	return &virt.BlockStats{
+		ReadRequests:  n * 10,
+		ReadBytes:     n * 10 * 4096,
+		WriteRequests: n * 5,
+		WriteBytes:    n * 5 * 4096,
+	}, nil
+}
+
+func (d *FakeDomain) hasDisk(disk string) bool {
+	if d.def.Devices == nil {
+		return false
+	}
+	for _, dd := range d.def.Devices.Disks {
+		if dd.Target != nil && dd.Target.Dev == disk {
+			return true
+		}
+	}
+	return false
+}
+
+// StartBlockJob simulates a block job running on the disk with the
+// specified target device name. The job stays at the specified
+// progress until it's aborted.
+func (d *FakeDomain) StartBlockJob(disk string, info virt.BlockJobInfo) error {
+	d.rec.Rec("StartBlockJob", map[string]interface{}{
+		"disk": disk,
+		"type": string(info.Type),
+		"cur":  info.Cur,
+		"end":  info.End,
+	})
+	if d.state != virt.DomainStateRunning {
+		return fmt.Errorf("StartBlockJob(): domain %q is not running", d.def.Name)
+	}
+	if !d.hasDisk(disk) {
+		return fmt.Errorf("StartBlockJob(): disk %q not found in domain %q", disk, d.def.Name)
+	}
+	d.blockJobs[disk] = &info
+	return nil
+}
+
+// BlockJob implements BlockJob method of Domain interface.
+func (d *FakeDomain) BlockJob(disk string) (*virt.BlockJobInfo, error) {
+	if d.removed {
+		return nil, fmt.Errorf("BlockJob() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if !d.hasDisk(disk) {
+		return nil, fmt.Errorf("BlockJob(): disk %q not found in domain %q", disk, d.def.Name)
+	}
+	info, found := d.blockJobs[disk]
+	if !found {
+		return nil, nil
+	}
+	r := *info
+	return &r, nil
+}
+
+// AbortBlockJob implements AbortBlockJob method of Domain interface.
+func (d *FakeDomain) AbortBlockJob(disk string) error {
+	d.rec.Rec("AbortBlockJob", disk)
+	if d.removed {
+		return fmt.Errorf("AbortBlockJob() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if _, found := d.blockJobs[disk]; !found {
+		return fmt.Errorf("AbortBlockJob(): no block job running on disk %q of domain %q", disk, d.def.Name)
+	}
+	delete(d.blockJobs, disk)
+	return nil
+}
+
+// CreateSnapshot implements CreateSnapshot method of Domain interface.
+func (d *FakeDomain) CreateSnapshot(name, description string) error {
+	d.rec.Rec("CreateSnapshot", map[string]string{"name": name, "description": description})
+	if d.removed {
+		return fmt.Errorf("CreateSnapshot() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if d.state != virt.DomainStateRunning {
+		return fmt.Errorf("CreateSnapshot(): domain %q is not running", d.def.Name)
+	}
+	if _, found := d.snapshots[name]; found {
+		return fmt.Errorf("CreateSnapshot(): snapshot %q already exists for domain %q", name, d.def.Name)
+	}
+	d.snapshots[name] = description
+	return nil
+}
+
+// RevertToSnapshot implements RevertToSnapshot method of Domain interface.
+func (d *FakeDomain) RevertToSnapshot(name string) error {
+	d.rec.Rec("RevertToSnapshot", name)
+	if d.removed {
+		return fmt.Errorf("RevertToSnapshot() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if _, found := d.snapshots[name]; !found {
+		return virt.ErrSnapshotNotFound
+	}
+	d.state = virt.DomainStateRunning
+	d.reason = virt.DomainStateReasonUnknown
+	return nil
+}
+
+// RemoveSnapshot implements RemoveSnapshot method of Domain interface.
+func (d *FakeDomain) RemoveSnapshot(name string) error {
+	d.rec.Rec("RemoveSnapshot", name)
+	if d.removed {
+		return fmt.Errorf("RemoveSnapshot() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if _, found := d.snapshots[name]; !found {
+		return virt.ErrSnapshotNotFound
+	}
+	delete(d.snapshots, name)
+	return nil
+}
+
+// Snapshots returns the sorted list of the names of the snapshots
+// of the domain
+func (d *FakeDomain) Snapshots() []string {
+	var r []string
+	for name := range d.snapshots {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
 // FakeSecret is a fake implementation of Secret interace.
 type FakeSecret struct {
 	rec       testutils.Recorder
 	dc        *FakeDomainConnection
 	usageName string
+	uuid      string
 }
 
 var _ virt.Secret = &FakeSecret{}
 
-func newFakeSecret(dc *FakeDomainConnection, usageName string) *FakeSecret {
+func newFakeSecret(dc *FakeDomainConnection, usageName, uuid string) *FakeSecret {
 	return &FakeSecret{
 		rec:       testutils.NewChildRecorder(dc.rec, "secret "+usageName),
 		dc:        dc,
 		usageName: usageName,
+		uuid:      uuid,
 	}
 }
 
@@ -360,6 +1120,26 @@ func addPciRoot(def *libvirtxml.Domain) {
 		Type:  "pci",
 		Model: "pci-root",
 	})
+	addPciBridges(def)
+}
+
+// addPciBridges adds pci-bridge controllers for the PCI buses used
+// by the disks of the domain, like libvirt does
+func addPciBridges(def *libvirtxml.Domain) {
+	maxBus := uint(0)
+	for _, disk := range def.Devices.Disks {
+		if disk.Address != nil && disk.Address.PCI != nil && disk.Address.PCI.Bus != nil && *disk.Address.PCI.Bus > maxBus {
+			maxBus = *disk.Address.PCI.Bus
+		}
+	}
+	for n := uint(1); n <= maxBus; n++ {
+		index := n
+		def.Devices.Controllers = append(def.Devices.Controllers, libvirtxml.DomainController{
+			Type:  "pci",
+			Index: &index,
+			Model: "pci-bridge",
+		})
+	}
 }
 
 func assignFakePCIAddressesToControllers(def *libvirtxml.Domain) {
@@ -370,7 +1150,8 @@ func assignFakePCIAddressesToControllers(def *libvirtxml.Domain) {
 	bus := uint(0)
 	function := uint(0)
 	for n, c := range def.Devices.Controllers {
-		if c.Type == "pci" || c.Address != nil {
+		// controllers with model "none" are not actually added
+		if (c.Type == "pci" && c.Model != "pci-bridge") || c.Address != nil || c.Model == "none" {
 			continue
 		}
 		slot := uint(n + 1)
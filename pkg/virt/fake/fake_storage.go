@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"path"
 	"sort"
+	"syscall"
 
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 
@@ -86,10 +87,12 @@ func (sc *FakeStorageConnection) LookupStoragePoolByName(name string) (virt.Stor
 
 // FakeStoragePool is a fake implementation of StoragePool interface.
 type FakeStoragePool struct {
-	rec     testutils.Recorder
-	name    string
-	path    string
-	volumes map[string]*FakeStorageVolume
+	rec      testutils.Recorder
+	name     string
+	path     string
+	volumes  map[string]*FakeStorageVolume
+	inactive bool
+	capacity uint64
 }
 
 // NewFakeStoragePool creates a new StoragePool using the specified
@@ -112,9 +115,21 @@ func (p *FakeStoragePool) createStorageVol(def *libvirtxml.StorageVolume) (virt.
 		return nil, err
 	}
 	p.volumes[def.Name] = v
+	if p.capacity != 0 && p.usedSpace() > p.capacity {
+		// like qemu-img, leave the partially created volume behind
+		return nil, fmt.Errorf("cannot create volume %q: %v", def.Name, syscall.ENOSPC)
+	}
 	return v, nil
 }
 
+func (p *FakeStoragePool) usedSpace() uint64 {
+	var r uint64
+	for _, v := range p.volumes {
+		r += v.size
+	}
+	return r
+}
+
 // CreateStorageVol implements CreateStorageVol method of StoragePool interface.
 func (p *FakeStoragePool) CreateStorageVol(def *libvirtxml.StorageVolume) (virt.StorageVolume, error) {
 	p.rec.Rec("CreateStorageVol", mustMarshal(def))
@@ -156,13 +171,65 @@ func (p *FakeStoragePool) RemoveVolumeByName(name string) error {
 	return p.removeVolumeByName(name)
 }
 
+// RenameVolume implements RenameVolume method of StoragePool interface.
+func (p *FakeStoragePool) RenameVolume(name, newName string) (virt.StorageVolume, error) {
+	p.rec.Rec("RenameVolume", []string{name, newName})
+	v, found := p.volumes[name]
+	if !found {
+		return nil, virt.ErrStorageVolumeNotFound
+	}
+	if _, found := p.volumes[newName]; found {
+		return nil, fmt.Errorf("storage volume already exists: %v", newName)
+	}
+	delete(p.volumes, name)
+	v.name = newName
+	v.path = path.Join(path.Dir(v.path), newName)
+	v.rec = testutils.NewChildRecorder(p.rec, newName)
+	p.volumes[newName] = v
+	return v, nil
+}
+
+// IsActive implements IsActive method of StoragePool interface.
+func (p *FakeStoragePool) IsActive() (bool, error) {
+	return !p.inactive, nil
+}
+
+// Start implements Start method of StoragePool interface.
+func (p *FakeStoragePool) Start() error {
+	p.rec.Rec("Start", nil)
+	if !p.inactive {
+		return fmt.Errorf("storage pool %q is already active", p.name)
+	}
+	p.inactive = false
+	return nil
+}
+
+// TargetPath implements TargetPath method of StoragePool interface.
+func (p *FakeStoragePool) TargetPath() (string, error) {
+	return p.path, nil
+}
+
+// SetActive sets the state of the fake storage pool. It can be
+// used to simulate a storage pool that's defined but inactive.
+func (p *FakeStoragePool) SetActive(active bool) {
+	p.inactive = !active
+}
+
+// SetCapacity sets the capacity of the fake storage pool in bytes.
+// Volume creation fails with ENOSPC if the total size of the volumes
+// exceeds the capacity. Zero value means unlimited capacity.
+func (p *FakeStoragePool) SetCapacity(capacity uint64) {
+	p.capacity = capacity
+}
+
 // FakeStorageVolume is a fake implementation of StorageVolume interface.
 type FakeStorageVolume struct {
-	rec  testutils.Recorder
-	pool *FakeStoragePool
-	name string
-	path string
-	size uint64
+	rec        testutils.Recorder
+	pool       *FakeStoragePool
+	name       string
+	path       string
+	size       uint64
+	allocation uint64
 }
 
 func newFakeStorageVolume(rec testutils.Recorder, pool *FakeStoragePool, def *libvirtxml.StorageVolume) (*FakeStorageVolume, error) {
@@ -187,6 +254,16 @@ func newFakeStorageVolume(rec testutils.Recorder, pool *FakeStoragePool, def *li
 		}
 		v.size = def.Capacity.Value * coef
 	}
+	if def.Allocation != nil {
+		coef, found := capacityUnits[def.Allocation.Unit]
+		if !found {
+			return nil, fmt.Errorf("bad allocation units: %q", def.Allocation.Unit)
+		}
+		v.allocation = def.Allocation.Value * coef
+	} else {
+		// the volume is fully allocated
+		v.allocation = v.size
+	}
 
 	return v, nil
 }
@@ -205,6 +282,17 @@ func (v *FakeStorageVolume) Size() (uint64, error) {
 	return v.size, nil
 }
 
+// Allocation implements Allocation method of StorageVolume interface.
+func (v *FakeStorageVolume) Allocation() (uint64, error) {
+	return v.allocation, nil
+}
+
+// SetAllocation sets the number of bytes allocated for the volume.
+// It can be used to simulate the guest writing to a thin volume.
+func (v *FakeStorageVolume) SetAllocation(allocation uint64) {
+	v.allocation = allocation
+}
+
 // Path implements Path method of StorageVolume interface.
 func (v *FakeStorageVolume) Path() (string, error) {
 	return v.path, nil
@@ -216,6 +304,12 @@ func (v *FakeStorageVolume) Remove() error {
 	return v.pool.removeVolumeByName(v.name)
 }
 
+// Wipe implements Wipe method of StorageVolume interface.
+func (v *FakeStorageVolume) Wipe(algorithm virt.WipeAlgorithm) error {
+	v.rec.Rec("Wipe", string(algorithm))
+	return nil
+}
+
 // Format implements Format method of StorageVolume interface.
 func (v *FakeStorageVolume) Format() error {
 	v.rec.Rec("Format", nil)
@@ -32,6 +32,38 @@ var ErrStoragePoolNotFound = errors.New("storage pool not found")
 // be found
 var ErrStorageVolumeNotFound = errors.New("storage volume not found")
 
+// WipeAlgorithm denotes the algorithm used to wipe the storage
+// volume contents
+type WipeAlgorithm string
+
+const (
+	// WipeAlgorithmZero fills the volume with zeroes
+	WipeAlgorithmZero WipeAlgorithm = "zero"
+	// WipeAlgorithmRandom fills the volume with random data
+	WipeAlgorithmRandom WipeAlgorithm = "random"
+	// WipeAlgorithmNNSA uses the 4-pass NNSA Policy Letter NAP-14.1-C
+	// (XVI-8) pattern
+	WipeAlgorithmNNSA WipeAlgorithm = "nnsa"
+	// WipeAlgorithmDoD uses the 4-pass DoD 5220.22-M section
+	// 8-306 procedure
+	WipeAlgorithmDoD WipeAlgorithm = "dod"
+	// WipeAlgorithmBSI uses the 9-pass method recommended by the
+	// German Center of Security in Information Technologies
+	WipeAlgorithmBSI WipeAlgorithm = "bsi"
+	// WipeAlgorithmGutmann uses the canonical 35-pass sequence
+	WipeAlgorithmGutmann WipeAlgorithm = "gutmann"
+)
+
+// WipeAlgorithms lists the supported volume wipe algorithms
+var WipeAlgorithms = []WipeAlgorithm{
+	WipeAlgorithmZero,
+	WipeAlgorithmRandom,
+	WipeAlgorithmNNSA,
+	WipeAlgorithmDoD,
+	WipeAlgorithmBSI,
+	WipeAlgorithmGutmann,
+}
+
 // StorageConnection provides operations on the storage pools and storage volumes
 type StorageConnection interface {
 	// CreateStoragePool creates a storage pool based on the specified definition
@@ -55,6 +87,17 @@ type StoragePool interface {
 	// RemoveVolumeByName removes the storage volume with the
 	// specified name
 	RemoveVolumeByName(name string) error
+	// RenameVolume renames the storage volume. It's only
+	// supported for file based volumes
+	RenameVolume(name, newName string) (StorageVolume, error)
+	// IsActive returns true if the storage pool is active
+	IsActive() (bool, error)
+	// Start starts (activates) a storage pool that's defined
+	// but inactive
+	Start() error
+	// TargetPath returns the target path of the storage pool,
+	// i.e. the directory for "dir" pools
+	TargetPath() (string, error)
 }
 
 // StorageVolume represents a particular volume in pool
@@ -63,10 +106,17 @@ type StorageVolume interface {
 	Name() string
 	// Size returns the size of this storage volume
 	Size() (uint64, error)
+	// Allocation returns the number of bytes actually allocated
+	// for this storage volume, which may be less than its size
+	// for thin (e.g. qcow2) volumes
+	Allocation() (uint64, error)
 	// Path returns the path to the file representing this storage volume
 	Path() (string, error)
 	// Remove removes this storage volume
 	Remove() error
+	// Wipe overwrites the contents of this storage volume using
+	// the specified algorithm
+	Wipe(algorithm WipeAlgorithm) error
 	// Format formats the volume as ext4 filesystem
 	Format() error
 }